@@ -0,0 +1,448 @@
+// This module handles the version management of actions-runner-controller (ARC) runner scale sets.
+//
+// It relies on the version-bumper module to track the gha-runner-scale-set chart releases. The controller and the
+// runner scale sets must run the same chart version, so they are bumped together, along with the actions/runner image
+// of the scale sets. Pending releases mentioning breaking changes block the update until they are acknowledged.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// chartTagPrefix prefixes the release tags of the gha-runner-scale-set charts, the legacy controller has its own tags
+const chartTagPrefix = "gha-runner-scale-set-"
+
+// breakingChange matches the release notes lines announcing a change needing action before upgrading
+var breakingChange = regexp.MustCompile(`(?i)breaking|deprecat|no longer supported|must (be )?(uninstall|reinstall|upgrade|update)|manual (step|action)`)
+
+type ActionsRunnerController struct {
+	// Latest gha-runner-scale-set chart version
+	LatestVersion string
+	// Chart version of the controller
+	LocalVersion string
+	// Latest actions/runner version
+	LatestRunnerVersion string
+	// +private
+	Dir *Directory
+	// +private
+	Controller string
+	// +private
+	ScaleSets []string
+	// +private
+	Key string
+	// +private
+	RunnerImageKey string
+	// +private
+	Constraint string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new ActionsRunnerController module comparing the latest chart and runner releases with the versions pinned in the cluster repository
+//
+// Example usage: dagger call --dir=. --controller=clusters/dev/arc/controller.yaml --scale-sets=clusters/dev/arc/runners/*.yaml report export --path=report.json
+func New(
+	ctx context.Context,
+	// Cluster repository
+	// +required
+	dir *Directory,
+	// HelmRelease of the gha-runner-scale-set-controller chart, relative to dir
+	// +required
+	controller string,
+	// Glob patterns of the gha-runner-scale-set HelmReleases, relative to dir
+	// +optional
+	scaleSets []string,
+	// Dot separated path of the chart version in the HelmReleases
+	// +optional
+	// +default="spec.chart.spec.version"
+	key string,
+	// Dot separated path of the runner image in the scale set HelmReleases (ex: ghcr.io/actions/actions-runner:2.316.0)
+	// +optional
+	// +default="spec.values.template.spec.containers.0.image"
+	runnerImageKey string,
+	// Semver constraint the latest chart version must satisfy (ex: "~0.9")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*ActionsRunnerController, error) {
+	m := &ActionsRunnerController{
+		Dir:            dir,
+		Controller:     controller,
+		ScaleSets:      scaleSets,
+		Key:            key,
+		RunnerImageKey: runnerImageKey,
+		Constraint:     constraint,
+		ProxyURL:       proxyUrl,
+		NoProxy:        noProxy,
+		CABundle:       caBundle,
+		CacheTTL:       cacheTtl,
+		OtlpEndpoint:   otlpEndpoint,
+		OtlpHeaders:    otlpHeaders,
+		Traceparent:    traceparent,
+	}
+
+	var err error
+	if m.LocalVersion, err = m.bumper().LocalVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get local version: %w", err)
+	}
+	if m.LatestVersion, err = m.bumper().LatestVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	if err := m.setLatestRunnerVersion(ctx); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type UpdateReport struct {
+	CurrentVersion      string `json:"currentVersion"`
+	LatestVersion       string `json:"latestVersion"`
+	UpdateNeeded        bool   `json:"updateNeeded"`
+	Constraint          string `json:"constraint"`
+	LatestRunnerVersion string `json:"latestRunnerVersion"`
+	// Chart and runner versions pinned by each scale set, by path
+	ScaleSets map[string]scaleSetVersion `json:"scaleSets"`
+	// Lines of the pending release notes announcing breaking changes
+	BreakingChanges []string `json:"breakingChanges"`
+}
+
+type scaleSetVersion struct {
+	ChartVersion  string `json:"chartVersion"`
+	RunnerVersion string `json:"runnerVersion"`
+}
+
+// bumper returns the version-bumper tracking the gha-runner-scale-set chart releases
+func (m *ActionsRunnerController) bumper() *VersionBumper {
+	return dag.VersionBumper("actions", "actions-runner-controller", m.Dir.File(m.Controller), VersionBumperOpts{
+		Key:        m.Key,
+		TagPrefix:  chartTagPrefix,
+		Constraint: m.Constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// runnerReleases Get the stable actions/runner releases, newest first
+func (m *ActionsRunnerController) runnerReleases(ctx context.Context) ([]ghrelease.Release, error) {
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	releases, err := (&ghrelease.Client{HTTP: client}).List(ctx, "actions", "runner")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get runner releases: %w", err)
+	}
+
+	stable := []ghrelease.Release{}
+	for _, r := range releases {
+		if v, err := semver.NewVersion(r.TagName); err == nil && v.Prerelease() == "" {
+			stable = append(stable, r)
+		}
+	}
+	sort.Slice(stable, func(i, j int) bool {
+		return semver.MustParse(stable[i].TagName).GreaterThan(semver.MustParse(stable[j].TagName))
+	})
+
+	return stable, nil
+}
+
+// setLatestRunnerVersion Get the latest actions/runner version, the image tags have no v prefix
+func (m *ActionsRunnerController) setLatestRunnerVersion(ctx context.Context) error {
+	releases, err := m.runnerReleases(ctx)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		return fmt.Errorf("no stable actions/runner release found")
+	}
+
+	m.LatestRunnerVersion = strings.TrimPrefix(releases[0].TagName, "v")
+
+	return nil
+}
+
+// scaleSetPaths List the scale set HelmReleases matching the patterns
+func (m *ActionsRunnerController) scaleSetPaths(ctx context.Context) ([]string, error) {
+	paths := []string{}
+	for _, pattern := range m.ScaleSets {
+		matches, err := m.Dir.Glob(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list scale sets matching %s: %w", pattern, err)
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// scaleSetVersions Read the chart and runner versions pinned by each scale set
+func (m *ActionsRunnerController) scaleSetVersions(ctx context.Context) (map[string]scaleSetVersion, error) {
+	paths, err := m.scaleSetPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[string]scaleSetVersion{}
+	for _, path := range paths {
+		content, err := m.Dir.File(path).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		chart, err := yamlpath.Get(content, m.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in %s: %w", m.Key, path, err)
+		}
+		image, err := yamlpath.Get(content, m.RunnerImageKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in %s: %w", m.RunnerImageKey, path, err)
+		}
+		runner := imageTag(image)
+		if runner == "" {
+			return nil, fmt.Errorf("failed to extract version from runner image %q in %s", image, path)
+		}
+
+		versions[path] = scaleSetVersion{ChartVersion: chart, RunnerVersion: runner}
+	}
+
+	return versions, nil
+}
+
+// IsNewerVersion Check if the controller or a scale set is behind the latest chart, or a scale set behind the latest runner
+//
+// Example usage: dagger call --dir=. --controller=clusters/dev/arc/controller.yaml --scale-sets=clusters/dev/arc/runners/*.yaml is-newer-version
+func (m *ActionsRunnerController) IsNewerVersion(ctx context.Context) (ok bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	newer, err := m.bumper().IsNewerVersion(ctx)
+	if err != nil || newer {
+		return newer, err
+	}
+
+	versions, err := m.scaleSetVersions(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range versions {
+		if v.ChartVersion != m.LatestVersion || v.RunnerVersion != m.LatestRunnerVersion {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// BreakingChanges Return the lines of the pending chart and runner release notes announcing breaking changes, prefixed by their release
+//
+// Example usage: dagger call --dir=. --controller=clusters/dev/arc/controller.yaml --scale-sets=clusters/dev/arc/runners/*.yaml breaking-changes
+func (m *ActionsRunnerController) BreakingChanges(ctx context.Context) (items []string, err error) {
+	s := m.startSpan(ctx, "BreakingChanges")
+	defer s.End(&err)
+
+	notes, err := m.bumper().PendingReleaseNotes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending chart release notes: %w", err)
+	}
+
+	changes := []string{}
+	tag := ""
+	for _, line := range strings.Split(notes, "\n") {
+		if heading, ok := strings.CutPrefix(line, "## "); ok && strings.HasPrefix(heading, chartTagPrefix) {
+			tag = heading
+			continue
+		}
+		if breakingChange.MatchString(line) {
+			changes = append(changes, fmt.Sprintf("%s: %s", tag, strings.TrimSpace(line)))
+		}
+	}
+
+	versions, err := m.scaleSetVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var oldest *semver.Version
+	for _, v := range versions {
+		if runner, err := semver.NewVersion(v.RunnerVersion); err == nil && (oldest == nil || runner.LessThan(oldest)) {
+			oldest = runner
+		}
+	}
+	if oldest == nil {
+		return changes, nil
+	}
+
+	releases, err := m.runnerReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range releases {
+		if !semver.MustParse(r.TagName).GreaterThan(oldest) {
+			continue
+		}
+		for _, line := range strings.Split(r.Body, "\n") {
+			if breakingChange.MatchString(line) {
+				changes = append(changes, fmt.Sprintf("runner %s: %s", r.TagName, strings.TrimSpace(line)))
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// UpdatedManifests Return the repository with the controller and scale sets set to the latest chart, and the scale sets to the latest runner.
+// It fails when the pending releases announce breaking changes, unless they are allowed.
+//
+// Example usage: dagger call --dir=. --controller=clusters/dev/arc/controller.yaml --scale-sets=clusters/dev/arc/runners/*.yaml updated-manifests --allow-breaking export --path=.
+func (m *ActionsRunnerController) UpdatedManifests(
+	ctx context.Context,
+	// Update even when the pending releases announce breaking changes, once they have been reviewed
+	// +optional
+	allowBreaking bool,
+) (result *Directory, err error) {
+	s := m.startSpan(ctx, "UpdatedManifests")
+	defer s.End(&err)
+
+	if !allowBreaking {
+		changes, err := m.BreakingChanges(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) > 0 {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("pending releases announce breaking changes, review them and set allowBreaking:\n%s", strings.Join(changes, "\n")),
+				Hint: "review the breaking changes of the pending releases, then set allowBreaking",
+			}
+		}
+	}
+
+	dir := m.Dir.WithFile(m.Controller, m.bumper().UpdatedManifest())
+
+	versions, err := m.scaleSetVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for path, v := range versions {
+		if v.ChartVersion == m.LatestVersion && v.RunnerVersion == m.LatestRunnerVersion {
+			continue
+		}
+
+		content, err := m.Dir.File(path).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if content, err = yamlpath.Set(content, m.Key, m.LatestVersion); err != nil {
+			return nil, fmt.Errorf("failed to set %s in %s: %w", m.Key, path, err)
+		}
+
+		image, err := yamlpath.Get(content, m.RunnerImageKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in %s: %w", m.RunnerImageKey, path, err)
+		}
+		// The digest of the pinned tag is dropped, it does not match the new tag
+		ref, _, _ := strings.Cut(image, "@")
+		if content, err = yamlpath.Set(content, m.RunnerImageKey, ref[:strings.LastIndex(ref, ":")]+":"+m.LatestRunnerVersion); err != nil {
+			return nil, fmt.Errorf("failed to set %s in %s: %w", m.RunnerImageKey, path, err)
+		}
+
+		dir = dir.WithNewFile(path, content)
+	}
+
+	return dir, nil
+}
+
+// Report Generate a JSON report describing the pending chart and runner updates and their breaking changes
+//
+// Example usage: dagger call --dir=. --controller=clusters/dev/arc/controller.yaml --scale-sets=clusters/dev/arc/runners/*.yaml report export --path=report.json
+func (m *ActionsRunnerController) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	updateNeeded, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+
+	versions, err := m.scaleSetVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := m.BreakingChanges(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.MarshalIndent(&UpdateReport{
+		CurrentVersion:      m.LocalVersion,
+		LatestVersion:       m.LatestVersion,
+		UpdateNeeded:        updateNeeded,
+		Constraint:          m.Constraint,
+		LatestRunnerVersion: m.LatestRunnerVersion,
+		ScaleSets:           versions,
+		BreakingChanges:     changes,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
+
+// imageTag Extract the tag of an image reference (ex: ghcr.io/actions/actions-runner:2.316.0@sha256:... -> 2.316.0)
+func imageTag(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+
+	return image[i+1:]
+}
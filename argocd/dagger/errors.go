@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the argocd commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"application not found", "comparisonerror"},
+	AuthHint:       "check that the argocd token is valid and its project role allows the application",
+	ValidationHint: "check the application name and the argocd server",
+}
+
+// commandError types the error of an argocd command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
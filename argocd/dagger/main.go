@@ -0,0 +1,297 @@
+// This module syncs ArgoCD applications, waits for their health and diffs them against the cluster with the argocd CLI.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Argocd struct {
+	// The ArgoCD API server (ex: argocd.example.com)
+	// +private
+	Server string
+	// API token of an ArgoCD account
+	// +private
+	Token *Secret
+	// The version of the argocd CLI (ex: v2.10.4)
+	// +private
+	Version string
+	// Use gRPC-web, required behind most ingress controllers
+	// +private
+	GrpcWeb bool
+	// Skip the server certificate verification
+	// +private
+	Insecure bool
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Argocd module authenticated on the provided server
+func New(
+	// The ArgoCD API server (ex: argocd.example.com)
+	// +required
+	server string,
+	// API token of an ArgoCD account
+	// +required
+	token *Secret,
+	// The version of the argocd CLI
+	// +optional
+	// +default="v2.10.4"
+	version string,
+	// Use gRPC-web, required behind most ingress controllers
+	// +optional
+	// +default=true
+	grpcWeb bool,
+	// Skip the server certificate verification
+	// +optional
+	insecure bool,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Argocd {
+	return &Argocd{
+		Server:       server,
+		Token:        token,
+		Version:      version,
+		GrpcWeb:      grpcWeb,
+		Insecure:     insecure,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type AppStatus struct {
+	// Health status of the application (ex: Healthy, Progressing, Degraded)
+	Health string
+	// Sync status of the application (ex: Synced, OutOfSync)
+	Sync string
+	// Revision the application is synced to
+	Revision string
+	// Message of the last operation
+	Message string
+}
+
+type DiffResult struct {
+	// Whether the live state differs from the target state
+	HasChanges bool
+	// Diff between the live and the target state
+	Diff string
+}
+
+type application struct {
+	Status struct {
+		Health struct {
+			Status string `json:"status"`
+		} `json:"health"`
+		Sync struct {
+			Status   string `json:"status"`
+			Revision string `json:"revision"`
+		} `json:"sync"`
+		OperationState struct {
+			Message string `json:"message"`
+		} `json:"operationState"`
+	} `json:"status"`
+}
+
+// base returns an argocd CLI container authenticated on the server.
+// The applications state changes outside of Dagger, so commands are never cached.
+func (m *Argocd) base() *Container {
+	c := m.withProxy(dag.Container().From("quay.io/argoproj/argocd:"+m.Version)).
+		WithEnvVariable("ARGOCD_SERVER", m.Server).
+		WithSecretVariable("ARGOCD_AUTH_TOKEN", m.Token).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	var opts []string
+	if m.GrpcWeb {
+		opts = append(opts, "--grpc-web")
+	}
+	if m.Insecure {
+		opts = append(opts, "--insecure")
+	}
+
+	return c.WithEnvVariable("ARGOCD_OPTS", strings.Join(opts, " "))
+}
+
+// Sync syncs an application to its target revision and returns the sync output.
+//
+// Example usage: dagger call --server=argocd.example.com --token=env:ARGOCD_TOKEN sync --app=shop-api --prune
+func (m *Argocd) Sync(
+	ctx context.Context,
+	// Name of the application
+	// +required
+	app string,
+	// Delete the resources no longer in the target state
+	// +optional
+	prune bool,
+	// Target revision, defaults to the revision of the application
+	// +optional
+	revision string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Sync")
+	defer s.End(&err)
+
+	args := []string{"argocd", "app", "sync", app}
+	if prune {
+		args = append(args, "--prune")
+	}
+	if revision != "" {
+		args = append(args, "--revision", revision)
+	}
+
+	out, err := m.base().
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to sync %s: %w", app, commandError(err))
+	}
+
+	return out, nil
+}
+
+// WaitHealthy waits for an application to be synced and healthy, and returns its status.
+//
+// Example usage: dagger call --server=argocd.example.com --token=env:ARGOCD_TOKEN wait-healthy --app=shop-api --timeout=600 health
+func (m *Argocd) WaitHealthy(
+	ctx context.Context,
+	// Name of the application
+	// +required
+	app string,
+	// Maximum duration to wait for, in seconds
+	// +optional
+	// +default=300
+	timeout int,
+) (result *AppStatus, err error) {
+	s := m.startSpan(ctx, "WaitHealthy")
+	defer s.End(&err)
+
+	c := m.base()
+
+	_, err = c.
+		WithExec([]string{
+			"argocd", "app", "wait", app, "--sync", "--health", "--timeout", strconv.Itoa(timeout),
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Sync(ctx)
+	if err != nil {
+		status, statusErr := m.status(ctx, c, app)
+		if statusErr != nil {
+			return nil, fmt.Errorf("%s is not healthy: %w", app, commandError(err))
+		}
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("%s is not healthy after %ds: health=%s sync=%s %s", app, timeout, status.Health, status.Sync, status.Message),
+			Hint: "check the resources of the application in argocd, or raise the timeout",
+		}
+	}
+
+	return m.status(ctx, c, app)
+}
+
+// AppDiff returns the diff between the live state of an application and its target state.
+//
+// Example usage: dagger call --server=argocd.example.com --token=env:ARGOCD_TOKEN app-diff --app=shop-api diff
+func (m *Argocd) AppDiff(
+	ctx context.Context,
+	// Name of the application
+	// +required
+	app string,
+	// Target revision to diff against, defaults to the revision of the application
+	// +optional
+	revision string,
+) (result *DiffResult, err error) {
+	s := m.startSpan(ctx, "AppDiff")
+	defer s.End(&err)
+
+	args := []string{"argocd", "app", "diff", app}
+	if revision != "" {
+		args = append(args, "--revision", revision)
+	}
+
+	// argocd app diff exits with 1 when there are differences and above 1 on errors
+	out, err := m.base().
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		var execErr *ExecError
+		if errors.As(err, &execErr) && execErr.ExitCode == 1 {
+			return &DiffResult{
+				HasChanges: true,
+				Diff:       execErr.Stdout,
+			}, nil
+		}
+		return nil, fmt.Errorf("failed to diff %s: %w", app, commandError(err))
+	}
+
+	return &DiffResult{
+		HasChanges: false,
+		Diff:       out,
+	}, nil
+}
+
+// status returns the health and sync status of an application
+func (m *Argocd) status(ctx context.Context, c *Container, app string) (*AppStatus, error) {
+	out, err := c.
+		WithExec([]string{"argocd", "app", "get", app, "--output", "json"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", app, commandError(err))
+	}
+
+	var a application
+	if err := json.Unmarshal([]byte(out), &a); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", app, err)
+	}
+
+	return &AppStatus{
+		Health:   a.Status.Health.Status,
+		Sync:     a.Status.Sync.Status,
+		Revision: a.Status.Sync.Revision,
+		Message:  a.Status.OperationState.Message,
+	}, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Argocd) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the git clone commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"repository not found"},
+	AuthHint:       "check that the token can read the repositories",
+	ValidationHint: "check the owner/name of the repositories",
+}
+
+// commandError types the error of a git clone command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
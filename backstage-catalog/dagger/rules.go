@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	namePattern      = regexp.MustCompile(`^[a-zA-Z0-9]+([-_.][a-zA-Z0-9]+)*$`)
+	namespacePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	prefixPattern    = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*(\.[a-z0-9]+(-[a-z0-9]+)*)*$`)
+	tagPattern       = regexp.MustCompile(`^[a-z0-9:+#]+(-[a-z0-9:+#]+)*$`)
+)
+
+// kind is the schema of a Backstage entity kind: its API versions and the required fields of its spec
+type kind struct {
+	apiVersions []string
+	required    []string
+}
+
+// kinds are the entity kinds of the Backstage catalog model
+var kinds = map[string]kind{
+	"Component": {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{"type", "lifecycle", "owner"}},
+	"API":       {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{"type", "lifecycle", "owner", "definition"}},
+	"Resource":  {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{"type", "owner"}},
+	"System":    {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{"owner"}},
+	"Domain":    {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{"owner"}},
+	"Group":     {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{"type", "children"}},
+	"User":      {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{}},
+	"Location":  {[]string{"backstage.io/v1alpha1", "backstage.io/v1beta1"}, []string{}},
+	"Template":  {[]string{"scaffolder.backstage.io/v1beta3"}, []string{"type", "steps"}},
+}
+
+type entity struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name        string            `yaml:"name"`
+		Namespace   string            `yaml:"namespace"`
+		Labels      map[string]string `yaml:"labels"`
+		Annotations map[string]string `yaml:"annotations"`
+		Tags        []string          `yaml:"tags"`
+	} `yaml:"metadata"`
+	Spec map[string]any `yaml:"spec"`
+}
+
+// ref returns the entity reference, as kind:namespace/name
+func (e *entity) ref() string {
+	namespace := e.Metadata.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	return strings.ToLower(e.Kind) + ":" + namespace + "/" + e.Metadata.Name
+}
+
+// schema returns the violations of the Backstage entity schema
+func (e *entity) schema() []*Violation {
+	violations := []*Violation{}
+	add := func(format string, args ...any) {
+		violations = append(violations, &Violation{Rule: "schema", Message: fmt.Sprintf(format, args...)})
+	}
+
+	k, ok := kinds[e.Kind]
+	if !ok {
+		add("unknown kind %q", e.Kind)
+		return violations
+	}
+	if !slices.Contains(k.apiVersions, e.APIVersion) {
+		add("apiVersion %q is not supported by %s, expected one of %s", e.APIVersion, e.Kind, strings.Join(k.apiVersions, ", "))
+	}
+
+	m := e.Metadata
+	if !validName(m.Name) {
+		add("metadata.name %q must be 1-63 alphanumeric characters separated by [-_.]", m.Name)
+	}
+	if m.Namespace != "" && (len(m.Namespace) > 63 || !namespacePattern.MatchString(m.Namespace)) {
+		add("metadata.namespace %q must be 1-63 lowercase alphanumeric characters separated by -", m.Namespace)
+	}
+	for key, value := range m.Labels {
+		if !validKey(key) {
+			add("invalid label key %q", key)
+		}
+		if value != "" && !validName(value) {
+			add("invalid value %q of label %s", value, key)
+		}
+	}
+	for key := range m.Annotations {
+		if !validKey(key) {
+			add("invalid annotation key %q", key)
+		}
+	}
+	for _, tag := range m.Tags {
+		if len(tag) > 63 || !tagPattern.MatchString(tag) {
+			add("tag %q must be 1-63 lowercase alphanumeric or [:+#] characters separated by -", tag)
+		}
+	}
+
+	for _, field := range k.required {
+		if value, ok := e.Spec[field]; !ok || value == nil || value == "" {
+			add("spec.%s is required for %s", field, e.Kind)
+		}
+	}
+	if e.Kind == "Location" && e.Spec["target"] == nil && e.Spec["targets"] == nil {
+		add("spec.target or spec.targets is required for Location")
+	}
+	for _, field := range []string{"owner", "system", "domain", "lifecycle", "type"} {
+		if value, ok := e.Spec[field]; ok {
+			if _, isString := value.(string); !isString {
+				add("spec.%s must be a string", field)
+			}
+		}
+	}
+
+	return violations
+}
+
+// conventions returns the violations of the organization conventions
+func (e *entity) conventions(m *BackstageCatalog) []*Violation {
+	violations := []*Violation{}
+	if _, ok := kinds[e.Kind]; !ok {
+		return violations
+	}
+
+	if owner, ok := e.Spec["owner"].(string); ok && owner != "" {
+		if k := refKind(owner, "group"); !slices.Contains(m.OwnerKinds, k) {
+			violations = append(violations, &Violation{Rule: "owner", Message: fmt.Sprintf("owner %q is a %s, expected one of %s", owner, k, strings.Join(m.OwnerKinds, ", "))})
+		}
+	}
+
+	if slices.Contains(m.SystemKinds, e.Kind) {
+		if system, _ := e.Spec["system"].(string); system == "" {
+			violations = append(violations, &Violation{Rule: "system", Message: fmt.Sprintf("spec.system is required for %s", e.Kind)})
+		}
+	}
+
+	if lifecycle, ok := e.Spec["lifecycle"].(string); ok && len(m.Lifecycles) > 0 && !slices.Contains(m.Lifecycles, lifecycle) {
+		violations = append(violations, &Violation{Rule: "lifecycle", Message: fmt.Sprintf("lifecycle %q is not one of %s", lifecycle, strings.Join(m.Lifecycles, ", "))})
+	}
+
+	if e.Kind == "Component" || e.Kind == "API" {
+		for _, a := range m.RequiredAnnotations {
+			if e.Metadata.Annotations[a] == "" {
+				violations = append(violations, &Violation{Rule: "annotations", Message: fmt.Sprintf("annotation %s is required for %s", a, e.Kind)})
+			}
+		}
+	}
+
+	return violations
+}
+
+// validName checks a name or label value: 1-63 alphanumeric characters separated by [-_.]
+func validName(name string) bool {
+	return len(name) <= 63 && namePattern.MatchString(name)
+}
+
+// validKey checks a label or annotation key: a name, optionally prefixed by a DNS subdomain and /
+func validKey(key string) bool {
+	prefix, name, found := strings.Cut(key, "/")
+	if !found {
+		return validName(key)
+	}
+
+	return len(prefix) <= 253 && prefixPattern.MatchString(prefix) && validName(name)
+}
+
+// refKind returns the kind of an entity reference ([kind:][namespace/]name), or the default kind when omitted
+func refKind(ref, defaultKind string) string {
+	if k, _, found := strings.Cut(ref, ":"); found {
+		return strings.ToLower(k)
+	}
+
+	return defaultKind
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// Config is the list of components bumped by the orchestrator, read from a YAML file:
+//
+//	components:
+//	  - name: cert-manager
+//	    repo: cert-manager/cert-manager
+//	    file: clusters/dev/cert-manager/helmrelease.yaml
+//	    key: spec.chart.spec.version
+//	    constraint: "<2"
+//	    policy: minor
+type Config struct {
+	Components []Component `yaml:"components"`
+}
+
+type Component struct {
+	// Name of the component, components sharing a name are bumped in the same pull request
+	Name string `yaml:"name"`
+	// GitHub repository publishing the releases (ex: cert-manager/cert-manager)
+	Repo string `yaml:"repo"`
+	// Only consider release tags with this prefix (ex: helm-chart-)
+	TagPrefix string `yaml:"tagPrefix"`
+	// Semver constraint the latest version must satisfy (ex: "~1.14")
+	Constraint string `yaml:"constraint"`
+	// Manifest storing the pinned version, relative to the source directory
+	File string `yaml:"file"`
+	// Dot separated path of the version field in the manifest
+	Key string `yaml:"key"`
+	// Largest bump allowed from the pinned version: major, minor or patch
+	Policy string `yaml:"policy"`
+}
+
+// parseConfig Parse and validate the orchestrator configuration
+func parseConfig(content string) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal([]byte(content), config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if len(config.Components) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("config does not list any component"),
+			Hint: "list the components of the config, see the README for its format",
+		}
+	}
+
+	for i := range config.Components {
+		c := &config.Components[i]
+		if c.Name == "" || c.File == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("component %d: name and file are required", i),
+				Hint: "set the name and the file of every component of the config",
+			}
+		}
+		if _, _, found := strings.Cut(c.Repo, "/"); !found {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("component %s: invalid repo %q, expected owner/name", c.Name, c.Repo),
+				Hint: "set the repo of the component as owner/name",
+			}
+		}
+		if c.Key == "" {
+			c.Key = "spec.chart.spec.version"
+		}
+		if c.Policy == "" {
+			c.Policy = "major"
+		}
+		if c.Policy != "major" && c.Policy != "minor" && c.Policy != "patch" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("component %s: invalid policy %q, expected major, minor or patch", c.Name, c.Policy),
+				Hint: "use the major, minor or patch policy",
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// constraint Combine the constraint of the component with the bound of its policy relative to the local version
+func (c Component) constraint(localVersion string) (string, error) {
+	v, err := semver.NewVersion(localVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse local version of %s: %w", c.Name, err)
+	}
+
+	var bound string
+	switch c.Policy {
+	case "minor":
+		bound = fmt.Sprintf("<%d.0.0", v.Major()+1)
+	case "patch":
+		bound = fmt.Sprintf("<%d.%d.0", v.Major(), v.Minor()+1)
+	}
+
+	switch {
+	case bound == "":
+		return c.Constraint, nil
+	case c.Constraint == "":
+		return bound, nil
+	default:
+		return c.Constraint + ", " + bound, nil
+	}
+}
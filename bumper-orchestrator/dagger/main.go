@@ -0,0 +1,302 @@
+// This module orchestrates the version bumps of many components from a single YAML config.
+//
+// Every component of the config is bumped with the version-bumper module, the updated manifests are
+// collected in one directory, and pushed to GitHub as one combined pull request or one per component.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type BumperOrchestrator struct {
+	// +private
+	Source *Directory
+	// +private
+	Config string
+	// +private
+	Token *Secret
+	// +private
+	BaseBranch string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new BumperOrchestrator module bumping the components listed in the config of the source repository
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN open-pull-requests --per-component
+func New(
+	// Repository holding the config and the manifests, including its .git directory to open pull requests
+	// +required
+	source *Directory,
+	// Path of the YAML config listing the components, relative to source
+	// +optional
+	// +default="bumpers.yaml"
+	config string,
+	// GitHub token used to push the branches and open the pull requests
+	// +optional
+	token *Secret,
+	// Branch the pull requests are opened against
+	// +optional
+	// +default="master"
+	baseBranch string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *BumperOrchestrator {
+	return &BumperOrchestrator{
+		Source:       source,
+		Config:       config,
+		Token:        token,
+		BaseBranch:   baseBranch,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		CacheTTL:     cacheTtl,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ComponentUpdate struct {
+	// Name of the component
+	Name string
+	// Manifest storing the pinned version, relative to the source directory
+	File           string
+	CurrentVersion string
+	LatestVersion  string
+	// Constraint resulting from the component constraint and policy
+	Constraint   string
+	UpdateNeeded bool
+}
+
+// components Read the config from the source directory
+func (m *BumperOrchestrator) components(ctx context.Context) ([]Component, error) {
+	content, err := m.Source.File(m.Config).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", m.Config, err)
+	}
+
+	config, err := parseConfig(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Components, nil
+}
+
+// bumper returns the version-bumper tracking the releases of the component
+func (m *BumperOrchestrator) bumper(c Component, constraint string) *VersionBumper {
+	owner, repo, _ := strings.Cut(c.Repo, "/")
+
+	return dag.VersionBumper(owner, repo, m.Source.File(c.File), VersionBumperOpts{
+		Key:        c.Key,
+		TagPrefix:  c.TagPrefix,
+		Constraint: constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// plan Resolve the update of every component of the config, along with the bumper producing it
+func (m *BumperOrchestrator) plan(ctx context.Context) ([]*ComponentUpdate, []*VersionBumper, error) {
+	components, err := m.components(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var updates []*ComponentUpdate
+	var bumpers []*VersionBumper
+	for _, c := range components {
+		u := &ComponentUpdate{Name: c.Name, File: c.File}
+		if u.CurrentVersion, err = m.bumper(c, c.Constraint).LocalVersion(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to get local version of %s: %w", c.Name, err)
+		}
+		if u.Constraint, err = c.constraint(u.CurrentVersion); err != nil {
+			return nil, nil, err
+		}
+
+		b := m.bumper(c, u.Constraint)
+		if u.LatestVersion, err = b.LatestVersion(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to get latest version of %s: %w", c.Name, err)
+		}
+		if u.UpdateNeeded, err = b.IsNewerVersion(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to check if newer version of %s: %w", c.Name, err)
+		}
+
+		updates = append(updates, u)
+		bumpers = append(bumpers, b)
+	}
+
+	return updates, bumpers, nil
+}
+
+// Plan Return the pinned and latest versions of every component of the config
+//
+// Example usage: dagger call --source=. plan
+func (m *BumperOrchestrator) Plan(ctx context.Context) (componentUpdates []*ComponentUpdate, err error) {
+	s := m.startSpan(ctx, "Plan")
+	defer s.End(&err)
+
+	updates, _, err := m.plan(ctx)
+
+	return updates, err
+}
+
+// Changes Return a directory holding only the updated manifests, at their path in the source directory
+//
+// Example usage: dagger call --source=. changes export --path=.
+func (m *BumperOrchestrator) Changes(ctx context.Context) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Changes")
+	defer s.End(&err)
+
+	updates, bumpers, err := m.plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := dag.Directory()
+	for i, u := range updates {
+		if u.UpdateNeeded {
+			changes = changes.WithFile(u.File, bumpers[i].UpdatedManifest())
+		}
+	}
+
+	return changes, nil
+}
+
+// OpenPullRequests Push the updated manifests and open one combined pull request, or one per component, returning their URLs
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN open-pull-requests --per-component
+func (m *BumperOrchestrator) OpenPullRequests(
+	ctx context.Context,
+	// Open one pull request per component instead of a combined one
+	// +optional
+	perComponent bool,
+	// Prefix of the pushed branches
+	// +optional
+	// +default="bump/"
+	branchPrefix string,
+	// Resolve the updates without pushing anything
+	// +optional
+	dryRun bool,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "OpenPullRequests")
+	defer s.End(&err)
+
+	if m.Token == nil && !dryRun {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("a GitHub token is required to open pull requests"),
+			Hint: "set the token, it opens the pull requests of the bumps",
+		}
+	}
+
+	updates, bumpers, err := m.plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Updates grouped by pull request, in config order
+	var groups []string
+	grouped := map[string][]int{}
+	for i, u := range updates {
+		if !u.UpdateNeeded {
+			continue
+		}
+		group := "all"
+		if perComponent {
+			group = u.Name
+		}
+		if _, ok := grouped[group]; !ok {
+			groups = append(groups, group)
+		}
+		grouped[group] = append(grouped[group], i)
+	}
+
+	urls := []string{}
+	for _, group := range groups {
+		var files, lines []string
+		dir := m.Source
+		for _, i := range grouped[group] {
+			u := updates[i]
+			dir = dir.WithFile(u.File, bumpers[i].UpdatedManifest())
+			files = append(files, u.File)
+			lines = append(lines, fmt.Sprintf("- %s: %s -> %s (`%s`)", u.Name, u.CurrentVersion, u.LatestVersion, u.File))
+		}
+
+		title := "chore(deps): bump components"
+		if perComponent {
+			u := updates[grouped[group][0]]
+			title = fmt.Sprintf("chore(deps): bump %s to %s", u.Name, u.LatestVersion)
+		}
+		branch := branchPrefix + group
+		if dryRun {
+			urls = append(urls, fmt.Sprintf("%s: %s", branch, title))
+			continue
+		}
+
+		// Only the manifests are committed, the .bump directory stays untracked.
+		// Its timestamp makes sure the push and the pull request are never cached.
+		dir = dir.
+			WithNewFile(".bump/body.md", "Automated version bumps:\n\n"+strings.Join(lines, "\n")+"\n").
+			WithNewFile(".bump/timestamp", time.Now().String())
+
+		gh := dag.Gh(m.Token, GhOpts{BaseBranch: m.BaseBranch, ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+
+		pushed, err := gh.RunGit(dir, fmt.Sprintf(
+			"checkout -B %s && git add %s && git commit -m '%s' && git push --force origin HEAD:%s",
+			branch, strings.Join(files, " "), title, branch,
+		)).Directory("/workspace").Sync(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to push %s: %w", branch, err)
+		}
+
+		url, err := gh.RunGh(ctx, pushed, fmt.Sprintf(
+			"pr create --base %s --head %s --title '%s' --body-file .bump/body.md",
+			m.BaseBranch, branch, title,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pull request for %s: %w", branch, err)
+		}
+		urls = append(urls, strings.TrimSpace(url))
+	}
+
+	return urls, nil
+}
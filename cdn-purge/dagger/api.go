@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"time"
+)
+
+// post calls the CDN API with the headers and the JSON payload when not nil, and returns the response body.
+// The status is returned as an error when not 2xx.
+func (m *CdnPurge) post(ctx context.Context, url string, headers map[string]string, payload any) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, typederr.FromResponse(resp, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, body))
+	}
+
+	return body, nil
+}
+
+// chunks splits the values in chunks of at most size values, the limit of a purge request
+func chunks(values []string, size int) [][]string {
+	var c [][]string
+	for len(values) > size {
+		c = append(c, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		c = append(c, values)
+	}
+
+	return c
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// cloudflareBatchSize is the number of URLs, prefixes or tags purged per request on every plan
+const cloudflareBatchSize = 30
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// cloudflarePurge purges the zone cache, one request per kind of target as Cloudflare does not mix them
+func (m *CdnPurge) cloudflarePurge(ctx context.Context, token string, urls, prefixes, tags []string, everything bool) error {
+	var payloads []map[string]any
+	if everything {
+		payloads = append(payloads, map[string]any{"purge_everything": true})
+	}
+	for key, values := range map[string][]string{"files": urls, "prefixes": prefixes, "tags": tags} {
+		for _, c := range chunks(values, cloudflareBatchSize) {
+			payloads = append(payloads, map[string]any{key: c})
+		}
+	}
+
+	url := "https://api.cloudflare.com/client/v4/zones/" + m.ZoneID + "/purge_cache"
+	for _, p := range payloads {
+		body, err := m.post(ctx, url, map[string]string{"Authorization": "Bearer " + token}, p)
+		if err != nil {
+			return fmt.Errorf("failed to purge cloudflare cache: %w", err)
+		}
+
+		resp := &cloudflareResponse{}
+		if err := json.Unmarshal(body, resp); err != nil {
+			return fmt.Errorf("failed to parse cloudflare response: %w", err)
+		}
+		if !resp.Success {
+			return fmt.Errorf("failed to purge cloudflare cache: %v", resp.Errors)
+		}
+	}
+
+	return nil
+}
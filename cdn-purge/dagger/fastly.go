@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+// fastlyBatchSize is the number of surrogate keys purged per request
+const fastlyBatchSize = 256
+
+// fastlyPurge purges the service cache. URLs are purged one by one, surrogate keys in batches.
+func (m *CdnPurge) fastlyPurge(ctx context.Context, token string, urls, prefixes, tags []string, everything bool) error {
+	if len(prefixes) > 0 {
+		return &typederr.ValidationError{
+			Err:  fmt.Errorf("fastly does not purge prefixes, tag the objects with surrogate keys and purge the tags"),
+			Hint: "purge the surrogate keys of the objects with tags on fastly",
+		}
+	}
+	if (everything || len(tags) > 0) && m.ServiceID == "" {
+		return &typederr.ValidationError{
+			Err:  fmt.Errorf("serviceId is required to purge tags or everything on fastly"),
+			Hint: "set serviceId to purge tags or everything on fastly",
+		}
+	}
+
+	headers := map[string]string{"Fastly-Key": token}
+	if everything {
+		if _, err := m.post(ctx, "https://api.fastly.com/service/"+m.ServiceID+"/purge_all", headers, nil); err != nil {
+			return fmt.Errorf("failed to purge fastly service: %w", err)
+		}
+	}
+	for _, u := range urls {
+		target := strings.TrimPrefix(strings.TrimPrefix(u, "https://"), "http://")
+		if _, err := m.post(ctx, "https://api.fastly.com/purge/"+target, headers, nil); err != nil {
+			return fmt.Errorf("failed to purge %s: %w", u, err)
+		}
+	}
+	for _, c := range chunks(tags, fastlyBatchSize) {
+		keyHeaders := map[string]string{"Fastly-Key": token, "Surrogate-Key": strings.Join(c, " ")}
+		if _, err := m.post(ctx, "https://api.fastly.com/service/"+m.ServiceID+"/purge", keyHeaders, nil); err != nil {
+			return fmt.Errorf("failed to purge fastly surrogate keys: %w", err)
+		}
+	}
+
+	return nil
+}
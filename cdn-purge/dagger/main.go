@@ -0,0 +1,255 @@
+// This module purges the CDN caches of Cloudflare or Fastly after a deploy, by URL, prefix or tag, and polls the
+// URLs until the CDN serves their fresh version.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	providerCloudflare = "cloudflare"
+	providerFastly     = "fastly"
+)
+
+type CdnPurge struct {
+	// cloudflare or fastly
+	// +private
+	Provider string
+	// API token allowed to purge the zone or service
+	// +private
+	Token *Secret
+	// Cloudflare zone ID
+	// +private
+	ZoneID string
+	// Fastly service ID
+	// +private
+	ServiceID string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new CdnPurge module purging the Cloudflare zone or the Fastly service
+func New(
+	// CDN provider: cloudflare or fastly
+	// +required
+	provider string,
+	// API token allowed to purge, with the Cache Purge permission on Cloudflare or the purge_select scope on Fastly
+	// +required
+	token *Secret,
+	// Cloudflare zone ID
+	// +optional
+	zoneId string,
+	// Fastly service ID, required to purge tags (surrogate keys) or everything
+	// +optional
+	serviceId string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*CdnPurge, error) {
+	switch {
+	case provider == providerCloudflare && zoneId == "":
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("zoneId is required by cloudflare"),
+			Hint: "set zoneId with the cloudflare provider",
+		}
+	case provider != providerCloudflare && provider != providerFastly:
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported provider %s, expected %s or %s", provider, providerCloudflare, providerFastly),
+			Hint: "use the cloudflare or fastly provider",
+		}
+	}
+
+	return &CdnPurge{
+		Provider:     provider,
+		Token:        token,
+		ZoneID:       zoneId,
+		ServiceID:    serviceId,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+// Purge purges the URLs, prefixes and tags, or everything, then polls the verified URLs until the CDN serves a
+// version cached after the purge. Fastly has no prefix purge, tag the objects with surrogate keys instead.
+//
+// Example usage: dagger call --provider=cloudflare --token=env:CF_API_TOKEN --zone-id=023e105f4ecef8ad9ca31a8372d0c353 purge --prefixes=www.example.com/static/ --verify-urls=https://www.example.com/static/app.js
+func (m *CdnPurge) Purge(
+	ctx context.Context,
+	// URLs purged (ex: https://www.example.com/index.html)
+	// +optional
+	urls []string,
+	// Prefixes purged, host and path without the scheme, Cloudflare only (ex: www.example.com/static/)
+	// +optional
+	prefixes []string,
+	// Tags purged: cache tags on Cloudflare, surrogate keys on Fastly
+	// +optional
+	tags []string,
+	// Purge the whole zone or service
+	// +optional
+	everything bool,
+	// URLs polled after the purge, defaults to the purged URLs
+	// +optional
+	verifyUrls []string,
+	// How long the URLs are polled before failing, no URL is polled when 0s
+	// +optional
+	// +default="2m"
+	timeout string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Purge")
+	defer s.End(&err)
+
+	if len(urls) == 0 && len(prefixes) == 0 && len(tags) == 0 && !everything {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("urls, prefixes, tags or everything is required"),
+			Hint: "set the urls, prefixes, tags or everything to purge",
+		}
+	}
+	wait, err := time.ParseDuration(timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse timeout %s: %w", timeout, err)
+	}
+
+	token, err := m.Token.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get api token: %w", err)
+	}
+
+	purgedAt := time.Now()
+	if m.Provider == providerCloudflare {
+		err = m.cloudflarePurge(ctx, token, urls, prefixes, tags, everything)
+	} else {
+		err = m.fastlyPurge(ctx, token, urls, prefixes, tags, everything)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var purged []string
+	for _, p := range [][2]string{
+		{strconv.Itoa(len(urls)), "URLs"}, {strconv.Itoa(len(prefixes)), "prefixes"}, {strconv.Itoa(len(tags)), "tags"},
+	} {
+		if p[0] != "0" {
+			purged = append(purged, p[0]+" "+p[1])
+		}
+	}
+	summary := "Purged " + strings.Join(purged, ", ")
+	if everything {
+		summary = "Purged everything"
+	}
+
+	if len(verifyUrls) == 0 {
+		verifyUrls = urls
+	}
+	if wait == 0 || len(verifyUrls) == 0 {
+		return summary, nil
+	}
+	if err := m.verify(ctx, verifyUrls, purgedAt, wait); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s, %d URLs verified", summary, len(verifyUrls)), nil
+}
+
+// verify polls the URLs until their cached version is younger than the purge. A URL is fresh when its Age header is
+// missing or lower than the time elapsed since the purge, or when the CDN reports a cache miss.
+func (m *CdnPurge) verify(ctx context.Context, urls []string, purgedAt time.Time, timeout time.Duration) error {
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pending := urls
+	for {
+		var stale []string
+		for _, u := range pending {
+			fresh, err := isFresh(ctx, client, u, purgedAt)
+			if err != nil || !fresh {
+				stale = append(stale, u)
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		pending = stale
+
+		select {
+		case <-ctx.Done():
+			return &typederr.ConflictError{
+				Err:  fmt.Errorf("still cached after %s: %s", timeout, strings.Join(pending, ", ")),
+				Hint: "the CDN is still purging, raise the timeout or check the purge again later",
+			}
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// isFresh tells whether the CDN serves a version of the URL cached after the purge
+func isFresh(ctx context.Context, client *http.Client, url string, purgedAt time.Time) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to get %s: %w", url, err)
+	}
+	resp.Body.Close()
+
+	// CF-Cache-Status on Cloudflare, X-Cache on Fastly, which lists one status per cache layer
+	status := strings.ToUpper(resp.Header.Get("CF-Cache-Status") + " " + resp.Header.Get("X-Cache"))
+	if strings.Contains(status, "MISS") || strings.Contains(status, "EXPIRED") {
+		return true, nil
+	}
+	age, err := strconv.Atoi(resp.Header.Get("Age"))
+	if err != nil {
+		return true, nil
+	}
+
+	return time.Duration(age)*time.Second <= time.Since(purgedAt), nil
+}
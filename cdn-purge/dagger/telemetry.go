@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"github.com/adore-me/daggerverse/common/pkg/tracing"
+)
+
+// startSpan starts the span of a function, with attributes as key=value pairs
+func (m *CdnPurge) startSpan(ctx context.Context, name string, attributes ...string) *tracing.Span {
+	return tracing.Start(ctx, "cdn-purge", name, spanExporter(m.OtlpEndpoint, m.OtlpHeaders, m.Traceparent), attributes...)
+}
+
+// spanExporter exports the spans with the common module, none are exported when no OTLP endpoint is configured
+func spanExporter(endpoint string, headers *Secret, traceparent string) tracing.Exporter {
+	if endpoint == "" {
+		return nil
+	}
+
+	return func(ctx context.Context, record string) error {
+		_, err := dag.Common().
+			Telemetry(endpoint, CommonTelemetryOpts{Headers: headers, Traceparent: traceparent}).
+			Export(ctx, record)
+		return err
+	}
+}
@@ -0,0 +1,221 @@
+// This module handles the version management of cert-manager.
+//
+// It relies on the version-bumper module to resolve the latest stable release and rewrite the pinned
+// version, and adds the API deprecation notes of the pending releases to the update report.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// deprecationPattern matches the release note lines announcing deprecations, removals or required actions
+var deprecationPattern = regexp.MustCompile(`(?i)deprecat|remov|breaking|action required|no longer`)
+
+type CertManager struct {
+	LatestVersion string
+	LocalVersion  string
+	// +private
+	Manifest *File
+	// +private
+	Key string
+	// +private
+	Constraint string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	Retries int
+	// +private
+	Backoff string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new CertManager module comparing the latest cert-manager release with the version pinned in the manifest
+//
+// Example usage: dagger call --manifest=clusters/dev/cert-manager/helmrelease.yaml report export --path=report.json
+func New(
+	ctx context.Context,
+	// HelmRelease or ConfigMap storing the current version
+	// +required
+	manifest *File,
+	// Dot separated path of the version field in the manifest (ex: spec.chart.spec.version, data.version)
+	// +optional
+	// +default="spec.chart.spec.version"
+	key string,
+	// Semver constraint the latest version must satisfy (ex: "~1.14")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// Number of retries of a failed GitHub API call
+	// +optional
+	// +default=3
+	retries int,
+	// Initial delay between retries, doubled after each attempt (ex: 2s)
+	// +optional
+	// +default="2s"
+	backoff string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*CertManager, error) {
+	m := &CertManager{
+		Manifest:     manifest,
+		Key:          key,
+		Constraint:   constraint,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		CacheTTL:     cacheTtl,
+		Retries:      retries,
+		Backoff:      backoff,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+
+	var err error
+	if m.LocalVersion, err = m.bumper().LocalVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get local version: %w", err)
+	}
+	if m.LatestVersion, err = m.bumper().LatestVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+
+	return m, nil
+}
+
+type UpdateReport struct {
+	CurrentVersion string `json:"currentVersion"`
+	LatestVersion  string `json:"latestVersion"`
+	UpdateNeeded   bool   `json:"updateNeeded"`
+	Constraint     string `json:"constraint"`
+	// Release note lines of the pending releases announcing deprecations, removals or required actions
+	Deprecations []string `json:"deprecations"`
+}
+
+// bumper returns the version-bumper tracking the cert-manager releases
+func (m *CertManager) bumper() *VersionBumper {
+	return dag.VersionBumper("cert-manager", "cert-manager", m.Manifest, VersionBumperOpts{
+		Key:        m.Key,
+		Constraint: m.Constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+		Retries:    m.Retries,
+		Backoff:    m.Backoff,
+	})
+}
+
+// IsNewerVersion Check if the latest version is newer than the local version
+//
+// Example usage: dagger call --manifest=clusters/dev/cert-manager/helmrelease.yaml is-newer-version
+func (m *CertManager) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	return m.bumper().IsNewerVersion(ctx)
+}
+
+// UpdatedManifest Return the manifest with the version field set to the latest version
+//
+// Example usage: dagger call --manifest=clusters/dev/cert-manager/helmrelease.yaml updated-manifest export --path=clusters/dev/cert-manager/helmrelease.yaml
+func (m *CertManager) UpdatedManifest(ctx context.Context) *File {
+	s := m.startSpan(ctx, "UpdatedManifest")
+	defer s.End(nil)
+
+	return m.bumper().UpdatedManifest()
+}
+
+// DeprecationNotes Return the release note lines of the pending releases announcing deprecations, removals or required actions
+//
+// Example usage: dagger call --manifest=clusters/dev/cert-manager/helmrelease.yaml deprecation-notes
+func (m *CertManager) DeprecationNotes(ctx context.Context) (items []string, err error) {
+	s := m.startSpan(ctx, "DeprecationNotes")
+	defer s.End(&err)
+
+	notes, err := m.bumper().PendingReleaseNotes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get release notes: %w", err)
+	}
+
+	deprecations := []string{}
+	release := ""
+	for _, line := range strings.Split(notes, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "## ") {
+			release = strings.TrimPrefix(line, "## ")
+			continue
+		}
+		if line != "" && deprecationPattern.MatchString(line) {
+			deprecations = append(deprecations, release+": "+strings.TrimLeft(line, "-* "))
+		}
+	}
+
+	return deprecations, nil
+}
+
+// Report Generate a JSON report describing the pending cert-manager update and its deprecation notes
+//
+// Example usage: dagger call --manifest=clusters/dev/cert-manager/helmrelease.yaml report export --path=report.json
+func (m *CertManager) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	updateNeeded, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+
+	deprecations := []string{}
+	if updateNeeded {
+		if deprecations, err = m.DeprecationNotes(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := json.MarshalIndent(&UpdateReport{
+		CurrentVersion: m.LocalVersion,
+		LatestVersion:  m.LatestVersion,
+		UpdateNeeded:   updateNeeded,
+		Constraint:     m.Constraint,
+		Deprecations:   deprecations,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the ct commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"chart.yaml", "lint failed", "version increment"},
+	AuthHint:       "check the credentials of the chart repositories",
+	ValidationHint: "fix the charts reported by ct lint, and bump their version",
+}
+
+// commandError types the error of a ct command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
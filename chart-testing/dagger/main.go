@@ -0,0 +1,229 @@
+// This module validates the charts of a Helm charts repository with chart-testing (ct).
+//
+// Only the charts changed against the target branch are linted and installed, unless all charts are requested.
+// Changes are detected with the git history of the repository, which must include its .git directory.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ChartTesting struct {
+	// The version of chart-testing (ex: v3.10.1)
+	// +private
+	Version string
+	// chart-testing config (ct.yaml)
+	// +private
+	Config *File
+	// Branch the changed charts are detected against
+	// +private
+	TargetBranch string
+	// Remote holding the target branch
+	// +private
+	Remote string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new ChartTesting module pinned to the provided chart-testing version
+func New(
+	// The version of chart-testing
+	// +optional
+	// +default="v3.10.1"
+	version string,
+	// chart-testing config (ct.yaml), defaults to the ct.yaml of the repository when present
+	// +optional
+	config *File,
+	// Branch the changed charts are detected against
+	// +optional
+	// +default="master"
+	targetBranch string,
+	// Remote holding the target branch
+	// +optional
+	// +default="origin"
+	remote string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *ChartTesting {
+	return &ChartTesting{
+		Version:      version,
+		Config:       config,
+		TargetBranch: targetBranch,
+		Remote:       remote,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// base returns a container with the pinned chart-testing tools (ct, helm, git, yamllint) and the repository mounted in /workspace
+func (m *ChartTesting) base(dir *Directory) *Container {
+	c := m.withProxy(dag.Container().From("quay.io/helmpack/chart-testing:"+m.Version)).
+		WithMountedCache("/root/.cache/helm", dag.CacheVolume("helm-cache")).
+		WithDirectory("/workspace", dir).
+		WithWorkdir("/workspace").
+		// The repository is mounted with another owner than the container user
+		WithExec([]string{"git", "config", "--global", "--add", "safe.directory", "/workspace"}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	if m.Config != nil {
+		c = c.WithFile("/etc/ct/ct.yaml", m.Config)
+	}
+
+	return c
+}
+
+// args returns the flags shared by the ct commands
+func (m *ChartTesting) args(all bool) []string {
+	args := []string{"--target-branch", m.TargetBranch, "--remote", m.Remote}
+	if all {
+		args = append(args, "--all")
+	}
+
+	return args
+}
+
+// ChangedCharts returns the charts changed against the target branch (ct list-changed).
+//
+// Example usage: dagger call changed-charts --dir=.
+func (m *ChartTesting) ChangedCharts(
+	ctx context.Context,
+	// The charts repository, including its .git directory
+	// +required
+	dir *Directory,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "ChangedCharts")
+	defer s.End(&err)
+
+	out, err := m.base(dir).
+		WithExec(append([]string{"ct", "list-changed"}, m.args(false)...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed charts: %w", commandError(err))
+	}
+
+	return strings.Fields(out), nil
+}
+
+// LintCharts lints the changed charts, checking their version bump, maintainers and YAML along with helm lint (ct lint).
+//
+// Example usage: dagger call lint-charts --dir=.
+func (m *ChartTesting) LintCharts(
+	ctx context.Context,
+	// The charts repository, including its .git directory
+	// +required
+	dir *Directory,
+	// Lint every chart instead of the changed ones
+	// +optional
+	all bool,
+	// Skip the check that changed charts bump their version
+	// +optional
+	skipVersionIncrement bool,
+) (result string, err error) {
+	s := m.startSpan(ctx, "LintCharts")
+	defer s.End(&err)
+
+	args := append([]string{"ct", "lint"}, m.args(all)...)
+	if skipVersionIncrement {
+		args = append(args, "--check-version-increment=false")
+	}
+
+	out, err := m.base(dir).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to lint charts: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// InstallCharts installs the changed charts in throwaway namespaces of the cluster, runs their helm tests and uninstalls them (ct install).
+//
+// Example usage: dagger call install-charts --dir=. --kubeconfig=file:$HOME/.kube/config
+func (m *ChartTesting) InstallCharts(
+	ctx context.Context,
+	// The charts repository, including its .git directory
+	// +required
+	dir *Directory,
+	// Kubeconfig giving access to the test cluster (ex: the kubeconfig of the ephemeral-cluster module)
+	// +required
+	kubeconfig *Secret,
+	// Install every chart instead of the changed ones
+	// +optional
+	all bool,
+	// Also test the upgrade from the version of the target branch
+	// +optional
+	upgrade bool,
+	// Arguments passed to helm install and upgrade (ex: --timeout 10m)
+	// +optional
+	helmExtraArgs string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "InstallCharts")
+	defer s.End(&err)
+
+	args := append([]string{"ct", "install"}, m.args(all)...)
+	if upgrade {
+		args = append(args, "--upgrade")
+	}
+	if helmExtraArgs != "" {
+		args = append(args, "--helm-extra-args", helmExtraArgs)
+	}
+
+	// The cluster state changes outside of Dagger, so installs are never cached
+	out, err := m.base(dir).
+		WithMountedSecret("/tmp/kubeconfig", kubeconfig).
+		WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to install charts: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *ChartTesting) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
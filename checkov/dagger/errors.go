@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the checkov commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check the credentials of the private module registries",
+	ValidationHint: "check the framework and the paths passed to checkov",
+}
+
+// commandError types the error of a checkov command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
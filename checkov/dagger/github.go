@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UploadSarif uploads the SARIF report to GitHub code scanning for the commit, and returns the ID of the upload.
+// Code scanning closes the alerts of the findings which are gone, and keeps the dismissed ones dismissed.
+//
+// Example usage: dagger call scan --dir=. upload-sarif --repo=. --token=env:GITHUB_TOKEN --sha=$GITHUB_SHA --ref=$GITHUB_REF
+func (r *ScanResult) UploadSarif(
+	ctx context.Context,
+	// The repository, including its .git directory, its origin remote selects the GitHub repository
+	// +required
+	repo *Directory,
+	// Token allowed to write security events
+	// +required
+	token *Secret,
+	// Commit the findings belong to
+	// +required
+	sha string,
+	// Git reference of the commit (ex: refs/heads/master, refs/pull/42/merge)
+	// +required
+	ref string,
+	// Category of the analysis, distinct per scanned directory of the repository
+	// +optional
+	// +default="checkov"
+	category string,
+) (out string, err error) {
+	s := r.startSpan(ctx, "UploadSarif")
+	defer s.End(&err)
+
+	sarif, err := r.Sarif.Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read sarif report: %w", err)
+	}
+
+	// Code scanning reads the category from the runs, where uploads of the same category replace each other
+	var report map[string]any
+	if err := json.Unmarshal([]byte(sarif), &report); err != nil {
+		return "", fmt.Errorf("failed to unmarshal sarif report: %w", err)
+	}
+	runs, _ := report["runs"].([]any)
+	for _, run := range runs {
+		if run, ok := run.(map[string]any); ok {
+			run["automationDetails"] = map[string]string{"id": category + "/"}
+		}
+	}
+	content, err := json.Marshal(report)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal sarif report: %w", err)
+	}
+
+	// The API takes the report gzipped and base64 encoded
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(content); err != nil {
+		return "", fmt.Errorf("failed to compress sarif report: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress sarif report: %w", err)
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"commit_sha": sha,
+		"ref":        ref,
+		"sarif":      base64.StdEncoding.EncodeToString(compressed.Bytes()),
+		"tool_name":  "checkov",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal sarif upload: %w", err)
+	}
+	// The payload stays untracked, its timestamp makes sure the call is never cached
+	dir := repo.
+		WithNewFile(".code-scanning/payload.json", string(payload)).
+		WithNewFile(".code-scanning/timestamp", time.Now().String())
+
+	gh := dag.Gh(token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+	id, err := gh.RunGh(ctx, dir, "api -X POST repos/{owner}/{repo}/code-scanning/sarifs --input .code-scanning/payload.json --jq .id")
+	if err != nil {
+		return "", fmt.Errorf("failed to upload sarif report: %w", err)
+	}
+
+	return strings.TrimSpace(id), nil
+}
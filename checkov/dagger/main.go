@@ -0,0 +1,293 @@
+// This module scans Terraform, Kubernetes and Dockerfile sources for misconfigurations with Checkov.
+//
+// Custom policies are loaded from a directory, and known findings are suppressed with a Checkov baseline file. The
+// SARIF report is uploaded to GitHub code scanning with the gh module.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+type Checkov struct {
+	// The version of Checkov (ex: 3.2.50)
+	// +private
+	Version string
+	// Custom policies, in Python or YAML
+	// +private
+	Policies *Directory
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Checkov module pinned to the provided Checkov version
+func New(
+	// The version of Checkov
+	// +optional
+	// +default="3.2.50"
+	version string,
+	// Directory of the custom policies (Python or YAML checks), run in addition to the built-in ones
+	// +optional
+	policies *Directory,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Checkov {
+	return &Checkov{
+		Version:      version,
+		Policies:     policies,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ScanResult struct {
+	// Whether no check failed, suppressed findings aside
+	Passed   bool
+	Findings []*Finding
+	// Checkov JSON report
+	Report *File
+	// SARIF report, suitable for GitHub code scanning
+	Sarif *File
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Finding struct {
+	// ID of the check (ex: CKV_AWS_20, or the ID of a custom policy)
+	CheckID string
+	Name    string
+	// terraform, kubernetes or dockerfile
+	Framework string
+	// File of the resource, relative to the scanned directory
+	File      string
+	StartLine int
+	EndLine   int
+	// Resource failing the check (ex: aws_s3_bucket.artifacts)
+	Resource string
+	// Documentation of the check and its fix
+	Guideline string
+}
+
+type checkovReport struct {
+	CheckType string `json:"check_type"`
+	Results   struct {
+		FailedChecks []struct {
+			CheckID       string `json:"check_id"`
+			CheckName     string `json:"check_name"`
+			FilePath      string `json:"file_path"`
+			FileLineRange []int  `json:"file_line_range"`
+			Resource      string `json:"resource"`
+			Guideline     string `json:"guideline"`
+		} `json:"failed_checks"`
+	} `json:"results"`
+}
+
+// base returns a container with the pinned Checkov CLI, the sources in /workspace and the custom policies in /policies
+func (m *Checkov) base(dir *Directory) *Container {
+	c := m.withProxy(dag.Container().From("bridgecrew/checkov:"+m.Version)).
+		WithDirectory("/workspace", dir).
+		WithWorkdir("/workspace")
+	if m.Policies != nil {
+		c = c.WithDirectory("/policies", m.Policies)
+	}
+
+	return c
+}
+
+// args returns the Checkov flags shared by the scan and the baseline creation
+func (m *Checkov) args(frameworks string, skipChecks []string) []string {
+	args := []string{"checkov", "--directory", ".", "--framework", frameworks, "--quiet", "--compact"}
+	if m.Policies != nil {
+		args = append(args, "--external-checks-dir", "/policies")
+	}
+	if len(skipChecks) > 0 {
+		args = append(args, "--skip-check", strings.Join(skipChecks, ","))
+	}
+
+	return args
+}
+
+// Scan scans the directory, skipping the findings of the baseline.
+//
+// Example usage: dagger call --policies=./policies scan --dir=./infra --baseline=./infra/.checkov.baseline check
+func (m *Checkov) Scan(
+	ctx context.Context,
+	// Directory of the sources
+	// +required
+	dir *Directory,
+	// Comma separated frameworks scanned
+	// +optional
+	// +default="terraform,kubernetes,dockerfile"
+	frameworks string,
+	// Baseline file created by the Baseline function, its findings are suppressed
+	// +optional
+	baseline *File,
+	// IDs of the checks skipped (ex: CKV_K8S_43)
+	// +optional
+	skipChecks []string,
+) (scanResult *ScanResult, err error) {
+	s := m.startSpan(ctx, "Scan")
+	defer s.End(&err)
+
+	c := m.base(dir)
+	args := append(m.args(frameworks, skipChecks), "--soft-fail", "--output", "json", "--output", "sarif", "--output-file-path", "/tmp/report")
+	if baseline != nil {
+		c = c.WithMountedFile("/tmp/.checkov.baseline", baseline)
+		args = append(args, "--baseline", "/tmp/.checkov.baseline")
+	}
+	c = c.WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	report := c.File("/tmp/report/results_json.json")
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run checkov: %w", commandError(err))
+	}
+
+	// Checkov reports a single framework as an object, several as an array
+	var parsed []checkovReport
+	if strings.HasPrefix(strings.TrimSpace(content), "[") {
+		err = json.Unmarshal([]byte(content), &parsed)
+	} else {
+		parsed = make([]checkovReport, 1)
+		err = json.Unmarshal([]byte(content), &parsed[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal checkov report: %w", err)
+	}
+
+	result := &ScanResult{
+		Findings:     []*Finding{},
+		Report:       report,
+		Sarif:        c.File("/tmp/report/results_sarif.sarif"),
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CABundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, r := range parsed {
+		for _, f := range r.Results.FailedChecks {
+			finding := &Finding{
+				CheckID:   f.CheckID,
+				Name:      f.CheckName,
+				Framework: r.CheckType,
+				File:      strings.TrimPrefix(f.FilePath, "/"),
+				Resource:  f.Resource,
+				Guideline: f.Guideline,
+			}
+			if len(f.FileLineRange) == 2 {
+				finding.StartLine, finding.EndLine = f.FileLineRange[0], f.FileLineRange[1]
+			}
+			result.Findings = append(result.Findings, finding)
+		}
+	}
+	result.Passed = len(result.Findings) == 0
+
+	return result, nil
+}
+
+// Baseline returns a baseline file of the current findings, to commit and pass to Scan so only new findings fail
+//
+// Example usage: dagger call baseline --dir=./infra export --path=./infra/.checkov.baseline
+func (m *Checkov) Baseline(
+	ctx context.Context,
+	// Directory of the sources
+	// +required
+	dir *Directory,
+	// Comma separated frameworks scanned
+	// +optional
+	// +default="terraform,kubernetes,dockerfile"
+	frameworks string,
+	// IDs of the checks skipped (ex: CKV_K8S_43)
+	// +optional
+	skipChecks []string,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Baseline")
+	defer s.End(&err)
+
+	// --create-baseline writes .checkov.baseline in the scanned directory
+	f := m.base(dir).
+		WithExec(append(m.args(frameworks, skipChecks), "--soft-fail", "--create-baseline"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/workspace/.checkov.baseline")
+	if _, err := f.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create checkov baseline: %w", commandError(err))
+	}
+
+	return f, nil
+}
+
+// Check fails when a check failed, and returns a summary otherwise
+func (r *ScanResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, f := range r.Findings {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s %s (%s)", f.File, f.StartLine, f.CheckID, f.Name, f.Resource))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d failed checks:\n%s", len(r.Findings), strings.Join(lines, "\n")),
+			Hint: "fix the misconfigurations or skip their checks in .checkov.yaml",
+		}
+	}
+
+	return "No failed check", nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Checkov) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"github.com/adore-me/daggerverse/common/pkg/tracing"
+)
+
+// startSpan starts the span of a function, with attributes as key=value pairs
+func (m *Checkov) startSpan(ctx context.Context, name string, attributes ...string) *tracing.Span {
+	attributes = append([]string{"version=" + m.Version}, attributes...)
+	return tracing.Start(ctx, "checkov", name, spanExporter(m.OtlpEndpoint, m.OtlpHeaders, m.Traceparent), attributes...)
+}
+
+// startSpan starts the span of a function of the scan result
+func (r *ScanResult) startSpan(ctx context.Context, name string, attributes ...string) *tracing.Span {
+	return tracing.Start(ctx, "checkov", name, spanExporter(r.OtlpEndpoint, r.OtlpHeaders, r.Traceparent), attributes...)
+}
+
+// spanExporter exports the spans with the common module, none are exported when no OTLP endpoint is configured
+func spanExporter(endpoint string, headers *Secret, traceparent string) tracing.Exporter {
+	if endpoint == "" {
+		return nil
+	}
+
+	return func(ctx context.Context, record string) error {
+		_, err := dag.Common().
+			Telemetry(endpoint, CommonTelemetryOpts{Headers: headers, Traceparent: traceparent}).
+			Export(ctx, record)
+		return err
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// cacheVolume keeps the entries of the Cache across the runs of the engine
+const cacheVolume = "daggerverse-cache"
+
+// Cache is an entry kept in a cache volume of the engine, so the responses of the rate limited APIs are reused across
+// the calls and the runs instead of being fetched by every constructor. The entry is fresh while younger than its TTL.
+type Cache struct {
+	// Key of the entry (ex: github-releases/istio/istio)
+	Key string
+	// How long the entry is fresh after being stored (ex: 10m)
+	TTL string
+	// +private
+	Pins []string
+}
+
+// Cache returns the entry of the key in the cache of the engine
+//
+// Example usage: dagger call cache --key=github-releases/istio/istio --ttl=1h get
+func (m *Common) Cache(
+	// Key of the entry (ex: github-releases/istio/istio)
+	// +required
+	key string,
+	// How long the entry is fresh after being stored, never when 0 (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	ttl string,
+) *Cache {
+	return &Cache{
+		Key:  key,
+		TTL:  ttl,
+		Pins: m.Pins,
+	}
+}
+
+// Get returns the content of the entry, empty when it is missing or older than the TTL
+//
+// Example usage: dagger call cache --key=github-releases/istio/istio get
+func (c *Cache) Get(ctx context.Context) (string, error) {
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse cache ttl: %w", err)
+	}
+
+	ctr, err := c.container(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	script := `f="/cache/$0"; if [ -f "$f" ] && [ $(($(date +%s) - $(stat -c %Y "$f"))) -lt "$1" ]; then cat "$f"; fi`
+	content, err := ctr.
+		WithExec([]string{"sh", "-c", script, c.file(), strconv.Itoa(int(ttl.Seconds()))}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cache entry %s: %w", c.Key, err)
+	}
+
+	return content, nil
+}
+
+// Put stores the content of the entry, restarting its TTL, and returns it
+//
+// Example usage: dagger call cache --key=github-releases/istio/istio put --content="[]"
+func (c *Cache) Put(
+	ctx context.Context,
+	// Content of the entry
+	// +required
+	content string,
+) (string, error) {
+	ctr, err := c.container(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// The entry is renamed once written, a concurrent Get never reads it partially
+	_, err = ctr.
+		WithNewFile("/tmp/content", ContainerWithNewFileOpts{Contents: content}).
+		WithExec(
+			[]string{"sh", "-c", `cp /tmp/content "/cache/$0.tmp" && mv "/cache/$0.tmp" "/cache/$0"`, c.file()},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to store cache entry %s: %w", c.Key, err)
+	}
+
+	return content, nil
+}
+
+// container returns the container mounting the cache volume, whose commands always run again
+func (c *Cache) container(ctx context.Context) (*Container, error) {
+	ctr, err := (&Common{Pins: c.Pins}).Image(ctx, "alpine:3.19")
+	if err != nil {
+		return nil, err
+	}
+
+	return ctr.
+		WithMountedCache("/cache", dag.CacheVolume(cacheVolume)).
+		// The entry changes outside of the inputs of the commands
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()), nil
+}
+
+// file returns the name of the file of the entry, the key may contain any character
+func (c *Cache) file() string {
+	sum := sha256.Sum256([]byte(c.Key))
+
+	return hex.EncodeToString(sum[:])
+}
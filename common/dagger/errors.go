@@ -0,0 +1,35 @@
+package main
+
+import "github.com/adore-me/daggerverse/common/pkg/typederr"
+
+// ErrorClass is the failure class of an error returned by a module function
+type ErrorClass struct {
+	// AUTH, RATE_LIMITED, CONFLICT, VALIDATION, or UNKNOWN when the error is not typed
+	Code string
+	// Whether calling the function again, after a while, may succeed. Other failures need someone to act.
+	Retryable bool
+	// What to do about the failure
+	Hint string
+}
+
+// Classify returns the failure class of an error message returned by a module function, so pipelines can decide
+// whether to retry or page someone. The modules return the typed errors of the typederr package of common/pkg:
+// AuthError, RateLimitError, ConflictError and ValidationError.
+//
+// Example usage: dagger call classify --message="$(dagger call -m istio --config-map=istio.yaml is-newer-version 2>&1)" retryable
+func (m *Common) Classify(
+	// Error message, as printed by dagger call or returned to the calling module
+	// +required
+	message string,
+) *ErrorClass {
+	match := typederr.Pattern.FindStringSubmatch(message)
+	if match == nil {
+		return &ErrorClass{Code: typederr.CodeUnknown}
+	}
+
+	return &ErrorClass{
+		Code:      match[1],
+		Retryable: typederr.Retryable(match[1]),
+		Hint:      match[2],
+	}
+}
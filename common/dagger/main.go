@@ -0,0 +1,142 @@
+// This module holds the building blocks shared by the other modules of the daggerverse.
+//
+// Base images are resolved to their digest, or to the digest pinned by the caller, so every function of a run uses
+// the same image. Commands touching the network retry with the standard attempts and backoff, and the git identity
+// of the commits is the standard one. The modules trace their functions calls to an OTLP endpoint through Telemetry,
+// and keep the responses of the rate limited APIs across the runs in a Cache.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Common struct {
+	// Digest-pinned image references (ex: alpine/git:2.43.0@sha256:...)
+	// +private
+	Pins []string
+}
+
+// New creates a new Common module, resolving the images listed in pins to their pinned digest
+func New(
+	// Digest-pinned image references, used instead of resolving their tag (ex: alpine/git:2.43.0@sha256:...)
+	// +optional
+	pins []string,
+) *Common {
+	return &Common{
+		Pins: pins,
+	}
+}
+
+// Defaults are the standard options of the modules
+type Defaults struct {
+	// Email of the commits author
+	GitUserEmail string
+	// Name of the commits author
+	GitUserName string
+	// Number of attempts of the retried commands
+	Attempts int
+	// Delay before the first retry, doubled on every attempt
+	Backoff string
+}
+
+// Defaults returns the standard options of the modules
+//
+// Example usage: dagger call defaults git-user-email
+func (m *Common) Defaults() *Defaults {
+	return &Defaults{
+		GitUserEmail: "action@github.com",
+		GitUserName:  "GitHub Action",
+		Attempts:     3,
+		Backoff:      "2s",
+	}
+}
+
+// PinnedRef returns the image reference pinned to its digest: the pinned one when listed in pins, the digest the tag
+// currently resolves to otherwise
+//
+// Example usage: dagger call pinned-ref --ref=alpine/git:2.43.0
+func (m *Common) PinnedRef(
+	ctx context.Context,
+	// Image reference (ex: alpine/git:2.43.0)
+	// +required
+	ref string,
+) (string, error) {
+	for _, pin := range m.Pins {
+		if image, _, found := strings.Cut(pin, "@"); found && image == ref {
+			return pin, nil
+		}
+	}
+
+	pinned, err := dag.Container().From(ref).ImageRef(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest of %s: %w", ref, err)
+	}
+
+	return pinned, nil
+}
+
+// Image returns a container from the digest-pinned image
+//
+// Example usage: dagger call image --ref=alpine/git:2.43.0 with-exec --args=git,version stdout
+func (m *Common) Image(
+	ctx context.Context,
+	// Image reference (ex: alpine/git:2.43.0)
+	// +required
+	ref string,
+) (*Container, error) {
+	pinned, err := m.PinnedRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Container().From(pinned), nil
+}
+
+// Retry runs the command in the container, retrying it with an exponential backoff until it succeeds or the attempts
+// are exhausted. The container needs sh, and the command must be safe to run again.
+//
+// Example usage: dagger call retry --ctr=alpine/git:2.43.0 --args=git,ls-remote,https://github.com/adore-me/daggerverse stdout
+func (m *Common) Retry(
+	// Container running the command
+	// +required
+	ctr *Container,
+	// Command and its arguments
+	// +required
+	args []string,
+	// Number of attempts, the standard one when 0
+	// +optional
+	attempts int,
+	// Delay before the first retry, doubled on every attempt, the standard one when empty (ex: 2s)
+	// +optional
+	backoff string,
+) (*Container, error) {
+	defaults := m.Defaults()
+	if attempts <= 0 {
+		attempts = defaults.Attempts
+	}
+	if backoff == "" {
+		backoff = defaults.Backoff
+	}
+	delay, err := time.ParseDuration(backoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backoff: %w", err)
+	}
+
+	// sleep only takes whole seconds on busybox
+	script := `attempt=1; delay="$RETRY_DELAY"
+until "$@"; do
+	code=$?
+	if [ "$attempt" -ge "$RETRY_ATTEMPTS" ]; then exit "$code"; fi
+	echo "attempt $attempt/$RETRY_ATTEMPTS failed with exit code $code, retrying in ${delay}s" >&2
+	sleep "$delay"; attempt=$((attempt + 1)); delay=$((delay * 2))
+done`
+
+	return ctr.
+		WithEnvVariable("RETRY_ATTEMPTS", strconv.Itoa(attempts)).
+		WithEnvVariable("RETRY_DELAY", strconv.Itoa(max(int(delay.Seconds()), 1))).
+		WithExec(append([]string{"sh", "-c", script, "sh"}, args...), ContainerWithExecOpts{SkipEntrypoint: true}), nil
+}
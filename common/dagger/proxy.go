@@ -0,0 +1,103 @@
+package main
+
+import "context"
+
+// caCertificatesPath is where Debian, Ubuntu and Alpine based images, and most tools, read the trusted roots
+const caCertificatesPath = "/etc/ssl/certs/ca-certificates.crt"
+
+// Proxy are the egress settings of the runners: the HTTP(S) proxy and the CA bundle of TLS-intercepting proxies.
+// The modules take them as proxyUrl, noProxy and caBundle options, apply them to their Go HTTP clients, and to the
+// containers they run with Apply.
+type Proxy struct {
+	// HTTP(S) proxy URL (ex: http://proxy.internal:3128)
+	URL string
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	NoProxy string
+	// +private
+	CaBundle *File
+	// +private
+	Pins []string
+}
+
+// Proxy returns the proxy settings applied to the containers of the modules
+//
+// Example usage: dagger call proxy --url=http://proxy.internal:3128 --ca-bundle=ca.pem apply --ctr=alpine:3.19 with-exec --args=wget,-qO-,https://github.com stdout
+func (m *Common) Proxy(
+	// HTTP(S) proxy URL, no proxy is used when empty (ex: http://proxy.internal:3128)
+	// +optional
+	url string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+) *Proxy {
+	return &Proxy{
+		URL:      url,
+		NoProxy:  noProxy,
+		CaBundle: caBundle,
+		Pins:     m.Pins,
+	}
+}
+
+// CaCertificates returns the system roots followed by the custom CA bundle, as trusted by the containers. The roots
+// come from the alpine image, pinned like the other images of the modules.
+//
+// Example usage: dagger call proxy --ca-bundle=ca.pem ca-certificates export --path=ca-certificates.crt
+func (p *Proxy) CaCertificates(ctx context.Context) (*File, error) {
+	roots, err := (&Common{Pins: p.Pins}).Image(ctx, "alpine:3.19")
+	if err != nil {
+		return nil, err
+	}
+	if p.CaBundle == nil {
+		return roots.File(caCertificatesPath), nil
+	}
+
+	return roots.
+		WithMountedFile("/tmp/ca-bundle.pem", p.CaBundle).
+		WithExec(
+			[]string{"sh", "-c", "cat " + caCertificatesPath + " /tmp/ca-bundle.pem > /tmp/ca-certificates.crt"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		File("/tmp/ca-certificates.crt"), nil
+}
+
+// Apply sets the proxy variables in the container, in upper and lower case as tools read either, and makes it trust
+// the CA bundle. The bundle is mounted, so it never ends up in a published image.
+//
+// Example usage: dagger call proxy --url=http://proxy.internal:3128 apply --ctr=alpine:3.19 with-exec --args=env stdout
+func (p *Proxy) Apply(
+	ctx context.Context,
+	// Container making outbound calls
+	// +required
+	ctr *Container,
+) (*Container, error) {
+	if p.URL != "" {
+		for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+			ctr = ctr.WithEnvVariable(name, p.URL)
+		}
+	}
+	if p.NoProxy != "" {
+		ctr = ctr.
+			WithEnvVariable("NO_PROXY", p.NoProxy).
+			WithEnvVariable("no_proxy", p.NoProxy)
+	}
+	if p.CaBundle != nil {
+		roots, err := p.CaCertificates(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ctr = ctr.
+			WithMountedFile(caCertificatesPath, roots).
+			// Tools with their own trust store, or images keeping the roots elsewhere
+			WithEnvVariable("SSL_CERT_FILE", caCertificatesPath).
+			WithEnvVariable("GIT_SSL_CAINFO", caCertificatesPath).
+			WithEnvVariable("CURL_CA_BUNDLE", caCertificatesPath).
+			WithEnvVariable("REQUESTS_CA_BUNDLE", caCertificatesPath).
+			WithMountedFile("/etc/ssl/certs/custom-ca.pem", p.CaBundle).
+			WithEnvVariable("NODE_EXTRA_CA_CERTS", "/etc/ssl/certs/custom-ca.pem")
+	}
+
+	return ctr, nil
+}
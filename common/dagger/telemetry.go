@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+type Telemetry struct {
+	// +private
+	Endpoint string
+	// +private
+	Headers *Secret
+	// +private
+	Traceparent string
+}
+
+// Telemetry returns the exporter of the module functions spans to the OTLP/HTTP endpoint
+//
+// Example usage: dagger call telemetry --endpoint=http://otel-collector:4318 span --service=istio --name=IsNewerVersion --start=2024-04-01T02:00:00Z end --end=2024-04-01T02:00:05Z
+func (m *Common) Telemetry(
+	// OTLP/HTTP endpoint receiving the traces, /v1/traces being the default path (ex: http://otel-collector:4318)
+	// +required
+	endpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	headers *Secret,
+	// W3C traceparent of the parent span, so the functions of a pipeline run share its trace
+	// +optional
+	traceparent string,
+) *Telemetry {
+	return &Telemetry{
+		Endpoint:    endpoint,
+		Headers:     headers,
+		Traceparent: traceparent,
+	}
+}
+
+// Span is a module function call, exported with its logs when it ends
+type Span struct {
+	// +private
+	Telemetry *Telemetry
+	// +private
+	Service string
+	// +private
+	Name string
+	// +private
+	Start string
+	// +private
+	Attributes []string
+	// +private
+	Logs []string
+}
+
+// Span starts the span of a module function call. Its calls are lazy, so the module records the times itself.
+//
+// Example usage: dagger call telemetry --endpoint=http://otel-collector:4318 span --service=istio --name=IsNewerVersion --start=2024-04-01T02:00:00Z end
+func (t *Telemetry) Span(
+	// Module of the function (ex: istio)
+	// +required
+	service string,
+	// Function name (ex: IsNewerVersion)
+	// +required
+	name string,
+	// Start time of the call, in RFC 3339 format (ex: 2024-04-01T02:00:00Z)
+	// +required
+	start string,
+) *Span {
+	return &Span{
+		Telemetry:  t,
+		Service:    service,
+		Name:       name,
+		Start:      start,
+		Attributes: []string{},
+		Logs:       []string{},
+	}
+}
+
+// WithAttribute sets an attribute of the span, such as the repository or the version it worked on
+//
+// Example usage: dagger call telemetry --endpoint=http://otel-collector:4318 span --service=istio --name=IsNewerVersion --start=2024-04-01T02:00:00Z with-attribute --key=version --value=1.20.3 end
+func (s *Span) WithAttribute(
+	// Attribute key (ex: repo, version)
+	// +required
+	key string,
+	// Attribute value
+	// +required
+	value string,
+) *Span {
+	s.Attributes = append(s.Attributes, key+"="+value)
+	return s
+}
+
+// WithLog adds a structured log to the span
+//
+// Example usage: dagger call telemetry --endpoint=http://otel-collector:4318 span --service=istio --name=IsNewerVersion --start=2024-04-01T02:00:00Z with-log --timestamp=2024-04-01T02:00:01Z --level=info --message="fetched releases" --attributes=count=30 end
+func (s *Span) WithLog(
+	// Time of the log, in RFC 3339 format (ex: 2024-04-01T02:00:01Z)
+	// +required
+	timestamp string,
+	// Log level (ex: debug, info, warn, error)
+	// +required
+	level string,
+	// Log message
+	// +required
+	message string,
+	// Log attributes, as key=value pairs
+	// +optional
+	attributes []string,
+) (*Span, error) {
+	at, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time of log %q: %w", message, err)
+	}
+	entry, err := json.Marshal(tracing.Log{Time: at, Level: level, Message: message, Attributes: attributes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log: %w", err)
+	}
+	s.Logs = append(s.Logs, string(entry))
+	return s, nil
+}
+
+// End ends the span and exports it, returning its W3C traceparent for child spans
+//
+// Example usage: dagger call telemetry --endpoint=http://otel-collector:4318 span --service=istio --name=IsNewerVersion --start=2024-04-01T02:00:00Z end --end=2024-04-01T02:00:05Z
+func (s *Span) End(
+	ctx context.Context,
+	// End time of the call, in RFC 3339 format, now when empty (ex: 2024-04-01T02:00:05Z)
+	// +optional
+	end string,
+	// Error returned by the call, the span is successful when empty
+	// +optional
+	failure string,
+) (string, error) {
+	record := &tracing.Record{
+		Service:    s.Service,
+		Name:       s.Name,
+		End:        time.Now(),
+		Attributes: s.Attributes,
+		Logs:       []tracing.Log{},
+		Failure:    failure,
+	}
+	var err error
+	if record.Start, err = time.Parse(time.RFC3339Nano, s.Start); err != nil {
+		return "", fmt.Errorf("failed to parse start time: %w", err)
+	}
+	if end != "" {
+		if record.End, err = time.Parse(time.RFC3339Nano, end); err != nil {
+			return "", fmt.Errorf("failed to parse end time: %w", err)
+		}
+	}
+	for _, l := range s.Logs {
+		entry := tracing.Log{}
+		if err := json.Unmarshal([]byte(l), &entry); err != nil {
+			return "", fmt.Errorf("failed to decode log: %w", err)
+		}
+		record.Logs = append(record.Logs, entry)
+	}
+
+	return s.Telemetry.export(ctx, record)
+}
+
+// Export exports a span recorded by the tracing package of common/pkg, returning its W3C traceparent for child spans.
+// The modules export their spans with it, from the exporter they pass to the package.
+//
+// Example usage: dagger call telemetry --endpoint=http://otel-collector:4318 export --record='{"service":"istio","name":"IsNewerVersion","start":"2024-04-01T02:00:00Z","end":"2024-04-01T02:00:05Z"}'
+func (t *Telemetry) Export(
+	ctx context.Context,
+	// Span, as a Record of the tracing package encoded in JSON
+	// +required
+	record string,
+) (string, error) {
+	r := &tracing.Record{}
+	if err := json.Unmarshal([]byte(record), r); err != nil {
+		return "", fmt.Errorf("failed to decode span: %w", err)
+	}
+
+	return t.export(ctx, r)
+}
+
+// export exports the span to the OTLP endpoint, returning its W3C traceparent
+func (t *Telemetry) export(ctx context.Context, r *tracing.Record) (string, error) {
+	// Headers are always set, so the ones of the engine telemetry never reach the endpoint
+	headers := map[string]string{}
+	if t.Headers != nil {
+		plain, err := t.Headers.Plaintext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get telemetry headers: %w", err)
+		}
+		for _, pair := range strings.Split(plain, ",") {
+			if key, value, found := strings.Cut(pair, "="); found {
+				headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(t.Endpoint),
+		otlptracehttp.WithHeaders(headers),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// The span is exported by the call rather than by a span processor, which reports the export errors to the
+	// global handler of the SDK only, shared by the concurrent calls
+	recorded := &recorder{}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorded),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(r.Service))),
+	)
+	defer provider.Shutdown(ctx)
+
+	// The span is a root span unless a parent is given, rather than a child of the engine span the function runs in
+	parent := context.Background()
+	opts := []trace.SpanStartOption{trace.WithTimestamp(r.Start), trace.WithAttributes(attributes(r.Attributes)...)}
+	if t.Traceparent != "" {
+		parent = propagation.TraceContext{}.Extract(parent, propagation.MapCarrier{"traceparent": t.Traceparent})
+	} else {
+		opts = append(opts, trace.WithNewRoot())
+	}
+	spanCtx, span := provider.Tracer("daggerverse").Start(parent, r.Name, opts...)
+
+	for _, l := range r.Logs {
+		span.AddEvent(l.Message, trace.WithTimestamp(l.Time), trace.WithAttributes(
+			append(attributes(l.Attributes), attribute.String("level", l.Level))...,
+		))
+	}
+	if r.Failure != "" {
+		span.SetStatus(codes.Error, r.Failure)
+	}
+	span.End(trace.WithTimestamp(r.End))
+
+	if err := exporter.ExportSpans(ctx, recorded.spans); err != nil {
+		return "", fmt.Errorf("failed to export span to %s: %w", t.Endpoint, err)
+	}
+	if err := exporter.Shutdown(ctx); err != nil {
+		return "", fmt.Errorf("failed to shut down OTLP exporter: %w", err)
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(spanCtx, carrier)
+
+	return carrier["traceparent"], nil
+}
+
+// recorder keeps the ended spans, for the call to export them itself
+type recorder struct {
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (r *recorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+func (r *recorder) OnEnd(s sdktrace.ReadOnlySpan)                   { r.spans = append(r.spans, s) }
+func (r *recorder) Shutdown(context.Context) error                  { return nil }
+func (r *recorder) ForceFlush(context.Context) error                { return nil }
+
+// attributes converts key=value pairs to span attributes, ignoring the others
+func attributes(pairs []string) []attribute.KeyValue {
+	kvs := []attribute.KeyValue{}
+	for _, pair := range pairs {
+		if key, value, found := strings.Cut(pair, "="); found {
+			kvs = append(kvs, attribute.String(key, value))
+		}
+	}
+	return kvs
+}
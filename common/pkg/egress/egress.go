@@ -0,0 +1,70 @@
+// Package egress builds the HTTP client of the modules of the daggerverse calling APIs from Go.
+//
+// The client applies the same egress settings as the Proxy of the common module applies to the containers: the
+// HTTP(S) proxy, the hosts reached without it, and the CA bundle of TLS-intercepting proxies trusted in addition to
+// the system roots.
+package egress
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// Bundle is the PEM encoded CA bundle, the File of the generated client of each module
+type Bundle interface {
+	Contents(ctx context.Context) (string, error)
+}
+
+// Client returns an HTTP client going through the proxy, except for the hosts, domains and CIDRs of noProxy, and
+// trusting the CA bundle in addition to the system roots. Empty settings keep the defaults, a zero timeout means no
+// timeout.
+func Client(ctx context.Context, proxyURL, noProxy string, caBundle Bundle, timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxyURL != "" {
+		if _, err := url.Parse(proxyURL); err != nil {
+			return nil, fmt.Errorf("failed to parse proxy url: %w", WithoutURL(err))
+		}
+		// httpproxy matches NO_PROXY like curl and most of the tools of the containers
+		proxy := (&httpproxy.Config{HTTPProxy: proxyURL, HTTPSProxy: proxyURL, NoProxy: noProxy}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) { return proxy(req.URL) }
+	}
+
+	// The modules pass their *File, nil when no bundle is set
+	if caBundle != nil && !reflect.ValueOf(caBundle).IsNil() {
+		bundle, err := caBundle.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(bundle)) {
+			return nil, fmt.Errorf("failed to parse CA bundle: no valid certificates found")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// WithoutURL returns the error of a request without the URL the *url.Error of net/http quotes, the URLs of the webhooks
+// and the proxies embed their credentials. The callers must not quote the URL in their own messages either.
+func WithoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+
+	return err
+}
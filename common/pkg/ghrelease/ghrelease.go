@@ -0,0 +1,200 @@
+// Package ghrelease gets the releases of the GitHub repositories tracked by the version management modules of the
+// daggerverse.
+//
+// The calls are anonymous, through the HTTP client of the module built with the egress package, and retried on the
+// network errors, rate limits and server errors.
+package ghrelease
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// nextLink matches the next page of the Link header of the paginated GitHub API responses
+var nextLink = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+type Release struct {
+	TagName     string `json:"tag_name"`
+	Name        string `json:"name"`
+	Body        string `json:"body"`
+	HTMLURL     string `json:"html_url"`
+	Draft       bool   `json:"draft"`
+	Prerelease  bool   `json:"prerelease"`
+	PublishedAt string `json:"published_at"`
+}
+
+// Client gets the releases from the GitHub API
+type Client struct {
+	HTTP *http.Client
+	// Retries of a failed call, none when zero
+	Retries int
+	// Wait before the first retry, doubled on every retry
+	Backoff time.Duration
+}
+
+// Store keeps the releases between the calls of the modules, the Cache of the common module
+type Store interface {
+	// Get returns the stored content, empty when there is none or it expired
+	Get(ctx context.Context) (string, error)
+	// Put stores the content and returns it
+	Put(ctx context.Context, content string) (string, error)
+}
+
+// Cached returns the releases of the repository kept in the store, listing and storing them when it has none
+func (c *Client) Cached(ctx context.Context, store Store, owner, repo string) ([]Release, error) {
+	content, err := store.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached releases: %w", err)
+	}
+	if content != "" {
+		var releases []Release
+		if err := json.Unmarshal([]byte(content), &releases); err == nil {
+			return releases, nil
+		}
+	}
+
+	releases, err := c.List(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := json.Marshal(releases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal releases: %w", err)
+	}
+	if _, err := store.Put(ctx, string(stored)); err != nil {
+		return nil, fmt.Errorf("failed to cache releases: %w", err)
+	}
+
+	return releases, nil
+}
+
+// List returns the published (non draft, non prerelease) releases of the repository, following the pages of the Link
+// header
+func (c *Client) List(ctx context.Context, owner, repo string) ([]Release, error) {
+	var releases []Release
+	endpoint := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases?per_page=100", owner, repo)
+	for endpoint != "" {
+		body, header, err := c.fetch(ctx, endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get releases: %w", err)
+		}
+
+		var page []Release
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal json: %w", err)
+		}
+		for _, r := range page {
+			if r.Draft || r.Prerelease {
+				continue
+			}
+			releases = append(releases, r)
+		}
+
+		endpoint = nextPage(header.Get("Link"))
+	}
+
+	return releases, nil
+}
+
+// Get returns the release of the tag, whether it is published or not
+func (c *Client) Get(ctx context.Context, owner, repo, tag string) (Release, error) {
+	body, err := c.Fetch(ctx, fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/tags/%s", owner, repo, tag))
+	if err != nil {
+		return Release{}, fmt.Errorf("failed to get release %s: %w", tag, err)
+	}
+
+	var release Release
+	if err := json.Unmarshal(body, &release); err != nil {
+		return Release{}, fmt.Errorf("failed to unmarshal json: %w", err)
+	}
+
+	return release, nil
+}
+
+// Fetch returns the body of a GitHub endpoint, such as the raw content of a file, retrying the network errors, rate
+// limits and server errors with an exponential backoff
+func (c *Client) Fetch(ctx context.Context, endpoint string) ([]byte, error) {
+	body, _, err := c.fetch(ctx, endpoint)
+
+	return body, err
+}
+
+// fetch returns the body and the headers of the endpoint, retrying as Fetch
+func (c *Client) fetch(ctx context.Context, endpoint string) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		body, header, retryable, err := c.get(ctx, endpoint)
+		if err == nil {
+			return body, header, nil
+		}
+		if !retryable || attempt >= c.Retries {
+			return nil, nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(c.Backoff << attempt):
+		}
+	}
+}
+
+// get GET the endpoint once, reporting whether a failure is worth retrying
+func (c *Client) get(ctx context.Context, endpoint string) ([]byte, http.Header, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return nil, nil, retryable, statusError(resp, fmt.Errorf("unexpected status %s from %s", resp.Status, endpoint))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, true, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return body, resp.Header, false, nil
+}
+
+// nextPage returns the URL of the next page of a Link header, empty on the last page
+func nextPage(link string) string {
+	if match := nextLink.FindStringSubmatch(link); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// statusError types the error of an unexpected status with the hints of the anonymous calls, falling back to
+// typederr.FromResponse
+func statusError(resp *http.Response, err error) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0":
+		hint := "retry later"
+		if reset, parseErr := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); parseErr == nil {
+			hint = "retry after " + time.Unix(reset, 0).UTC().Format(time.RFC3339)
+		}
+		return &typederr.RateLimitError{Err: err, Hint: hint + ", anonymous GitHub API calls are limited to 60 per hour and IP"}
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return &typederr.AuthError{Err: err, Hint: "check that the proxy allows anonymous calls to api.github.com and raw.githubusercontent.com"}
+	}
+
+	return typederr.FromResponse(resp, err)
+}
@@ -0,0 +1,117 @@
+package ghrelease
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+// Selection selects the stable releases of a repository, the latest of which the version management modules bump to
+type Selection struct {
+	// Prefix of the tags, trimmed before parsing them as semantic versions, the tags without it are never selected
+	TagPrefix string
+	// Semver constraint of the selected versions (ex: ~1.20), any version when empty
+	Constraint string
+	// Minimum age of the selected releases since their publication, any age when zero
+	MinAge time.Duration
+}
+
+// Latest returns the release of the greatest selected version, along with the version, its tag without the prefix
+func (s Selection) Latest(releases []Release) (Release, string, error) {
+	constraint, err := s.constraint()
+	if err != nil {
+		return Release{}, "", err
+	}
+
+	var latest *semver.Version
+	var release Release
+	for _, r := range releases {
+		v, err := s.check(r, constraint)
+		if err != nil {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+			release = r
+		}
+	}
+
+	if latest == nil {
+		err := fmt.Errorf("no release matches constraint %q", s.Constraint)
+		if s.MinAge > 0 {
+			err = fmt.Errorf("no release matches constraint %q and min release age %s", s.Constraint, s.MinAge)
+		}
+		return Release{}, "", &typederr.ValidationError{Err: err, Hint: "relax the constraint or the min release age"}
+	}
+
+	return release, strings.TrimPrefix(release.TagName, s.TagPrefix), nil
+}
+
+// Validate checks the constraint of the selection, before any release is fetched
+func (s Selection) Validate() error {
+	_, err := s.constraint()
+
+	return err
+}
+
+// Check returns why the release is not selected, nil when it is
+func (s Selection) Check(r Release) error {
+	constraint, err := s.constraint()
+	if err != nil {
+		return err
+	}
+	_, err = s.check(r, constraint)
+
+	return err
+}
+
+// constraint parses the constraint of the selection, nil when there is none
+func (s Selection) constraint() (*semver.Constraints, error) {
+	if s.Constraint == "" {
+		return nil, nil
+	}
+
+	constraint, err := semver.NewConstraint(s.Constraint)
+	if err != nil {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("failed to parse constraint: %w", err),
+			Hint: "use a semver constraint, ex: ~1.20 or >=1.20, <1.22",
+		}
+	}
+
+	return constraint, nil
+}
+
+// check returns the version of a stable release satisfying the constraint and old enough
+func (s Selection) check(r Release, constraint *semver.Constraints) (*semver.Version, error) {
+	if r.Draft || r.Prerelease {
+		return nil, fmt.Errorf("release %s is not published as stable", r.TagName)
+	}
+	if !strings.HasPrefix(r.TagName, s.TagPrefix) {
+		return nil, fmt.Errorf("tag %q does not have prefix %q", r.TagName, s.TagPrefix)
+	}
+
+	v, err := semver.NewVersion(strings.TrimPrefix(r.TagName, s.TagPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse version %s: %w", r.TagName, err)
+	}
+	if v.Prerelease() != "" {
+		return nil, fmt.Errorf("version %s is a prerelease", r.TagName)
+	}
+	if constraint != nil && !constraint.Check(v) {
+		return nil, fmt.Errorf("version %s does not satisfy the constraint", r.TagName)
+	}
+	if s.MinAge > 0 {
+		publishedAt, err := time.Parse(time.RFC3339, r.PublishedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse publish date of %s: %w", r.TagName, err)
+		}
+		if age := time.Since(publishedAt); age < s.MinAge {
+			return nil, fmt.Errorf("release %s is only %s old", r.TagName, age.Round(time.Hour))
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,11 @@
+module github.com/adore-me/daggerverse/common/pkg
+
+go 1.21.7
+
+require (
+	github.com/Masterminds/semver v1.5.0
+	golang.org/x/net v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/text v0.14.0 // indirect
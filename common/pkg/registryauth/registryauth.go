@@ -0,0 +1,91 @@
+// Package registryauth authenticates the tools of the modules of the daggerverse (crane, cosign, syft, buildkit…)
+// against the image registries, with the docker config.json they all read.
+//
+// Docker Hub is the registry of the image references without registry (ex: alpine:3.19). Its credentials are stored
+// under the https://index.docker.io/v1/ key, the only one docker/cli and go-containerregistry look up for it.
+package registryauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DockerHub is the registry of the image references without registry
+const DockerHub = "docker.io"
+
+// dockerHubKey is the auths key of the Docker Hub credentials in a docker config.json
+const dockerHubKey = "https://index.docker.io/v1/"
+
+// Password is the registry password or token, the Secret of the generated client of each module
+type Password interface {
+	Plaintext(ctx context.Context) (string, error)
+}
+
+// Auth is the credentials of a registry
+type Auth struct {
+	// Registry host, Host of the image reference
+	Registry string
+	// Registry username
+	Username string
+	// Registry password or token
+	Password Password
+}
+
+// Host returns the registry of an image reference, docker.io when omitted
+func Host(ref string) string {
+	host, _, found := strings.Cut(ref, "/")
+	if !found || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return DockerHub
+	}
+
+	return host
+}
+
+// Authority returns the name go-containerregistry gives the registry, index.docker.io for Docker Hub, which the tools
+// matching the credentials against the image reference (ex: SYFT_REGISTRY_AUTH_AUTHORITY) compare with
+func Authority(registry string) string {
+	if isDockerHub(registry) {
+		return "index.docker.io"
+	}
+
+	return registry
+}
+
+// DockerConfig returns a docker config.json authenticating against the registries
+func DockerConfig(ctx context.Context, auths ...Auth) (string, error) {
+	entries := map[string]any{}
+	for _, a := range auths {
+		pw, err := a.Password.Plaintext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get password of %s: %w", a.Registry, err)
+		}
+
+		key := a.Registry
+		if isDockerHub(key) {
+			key = dockerHubKey
+		}
+		entries[key] = map[string]string{
+			"auth": base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + pw)),
+		}
+	}
+
+	config, err := json.Marshal(map[string]any{"auths": entries})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal docker config: %w", err)
+	}
+
+	return string(config), nil
+}
+
+// isDockerHub tells whether the registry is one of the names of Docker Hub
+func isDockerHub(registry string) bool {
+	switch strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://"), "/") {
+	case DockerHub, "index.docker.io", "registry-1.docker.io", "index.docker.io/v1":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,17 @@
+// Package severity ranks the severities of the findings reported by the scanners and policy engines wrapped by the
+// modules of the daggerverse, to compare them with the failure threshold of the modules.
+package severity
+
+// Scale lists the severities of a tool, from the most to the least severe (ex: CRITICAL, HIGH, MEDIUM, LOW)
+type Scale []string
+
+// Rank returns the index of the severity in the scale, or -1 when unknown. The most severe has the lowest rank.
+func (s Scale) Rank(severity string) int {
+	for i, level := range s {
+		if level == severity {
+			return i
+		}
+	}
+
+	return -1
+}
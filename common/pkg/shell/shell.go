@@ -0,0 +1,9 @@
+// Package shell builds the sh scripts the modules of the daggerverse run in their containers.
+package shell
+
+import "strings"
+
+// Quote quotes a value as a single sh word, the single quotes it contains included
+func Quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,82 @@
+package typederr
+
+import "strings"
+
+// Output patterns of the failures shared by the CLIs, matched case-insensitively
+var (
+	rateLimitPatterns = []string{"rate limit", "too many requests", "toomanyrequests", "http 429", "status 429", "status code 429"}
+	authPatterns      = []string{
+		"unauthorized", "unauthenticated", "authentication required", "authentication failed", "requires authentication",
+		"bad credentials", "invalid credentials", "no basic auth credentials", "could not read username", "access denied",
+		"accessdenied", "permission_denied", "forbidden", "http 401", "http 403", "status 401", "status 403",
+		"status code 401", "status code 403", "expired token", "expiredtoken", "token has expired", "invalidclienttokenid",
+		"signaturedoesnotmatch", "permission denied (publickey)",
+	}
+	conflictPatterns = []string{
+		"already exists", "conflict", "http 409", "status 409", "status code 409", "[rejected]", "non-fast-forward",
+		"fetch first", "state lock", "resourceinuse", "the object has been modified",
+	}
+	validationPatterns = []string{
+		"unknown flag", "unknown shorthand flag", "unknown command", "unknown option", "invalid argument",
+		"invalid value", "invalid reference format", "manifest unknown", "name unknown", "syntax error", "parse error",
+		"error parsing", "failed to parse", "http 400", "http 404", "http 422", "status 400", "status 404", "status 422",
+		"status code 400", "status code 404", "status code 422",
+	}
+)
+
+// Command types the failures of a CLI from its output. The patterns of the CLI are matched before the ones shared by
+// the CLIs, and the generic hints apply when the CLI has none.
+type Command struct {
+	// Output patterns of the invalid inputs, manifests or policies of the CLI (ex: "is invalid")
+	Invalid []string
+	// Output patterns of the conflicting changes of the CLI (ex: "resource version")
+	Conflicting []string
+	// Hint of the authentication and permission failures
+	AuthHint string
+	// Hint of the rate limits
+	RateLimitHint string
+	// Hint of the conflicts
+	ConflictHint string
+	// Hint of the invalid inputs
+	ValidationHint string
+}
+
+// Type types the error of the command from its output, the stdout and stderr of the failed exec, and returns it
+// unchanged when no pattern matches
+func (c Command) Type(err error, output string) error {
+	output = strings.ToLower(output)
+	has := func(patterns []string) bool {
+		for _, p := range patterns {
+			if strings.Contains(output, strings.ToLower(p)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has(c.Invalid):
+		return &ValidationError{Err: err, Hint: or(c.ValidationHint, "check the inputs and the manifests passed to the command")}
+	case has(c.Conflicting):
+		return &ConflictError{Err: err, Hint: or(c.ConflictHint, "the state changed during the command, run it again once the change settles")}
+	case has(rateLimitPatterns):
+		return &RateLimitError{Err: err, Hint: or(c.RateLimitHint, "retry once the rate limit of the API resets")}
+	case has(authPatterns):
+		return &AuthError{Err: err, Hint: or(c.AuthHint, "check that the credentials are valid and have the permissions required by the command")}
+	case has(conflictPatterns):
+		return &ConflictError{Err: err, Hint: or(c.ConflictHint, "the state changed during the command, run it again once the change settles")}
+	case has(validationPatterns):
+		return &ValidationError{Err: err, Hint: or(c.ValidationHint, "check the inputs and the manifests passed to the command")}
+	}
+
+	return err
+}
+
+// or returns the hint, the fallback when it is empty
+func or(hint, fallback string) string {
+	if hint == "" {
+		return fallback
+	}
+
+	return hint
+}
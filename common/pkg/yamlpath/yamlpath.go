@@ -0,0 +1,275 @@
+// Package yamlpath reads and rewrites the values of the manifests tracked by the modules of the daggerverse.
+//
+// Values are addressed by dot separated paths of map keys and list indexes (ex: spec.chart.spec.version,
+// spec.template.spec.containers.0.image). Rewritten documents keep their comments and key order, and are encoded with
+// the two spaces indentation of our manifests.
+package yamlpath
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Get reads the scalar stored at the path of a YAML document
+func Get(content, path string) (string, error) {
+	doc, err := decode(content)
+	if err != nil {
+		return "", err
+	}
+
+	node, err := lookup(doc, path)
+	if err != nil {
+		return "", err
+	}
+
+	return node.Value, nil
+}
+
+// Set replaces the scalar stored at the path of a YAML document
+func Set(content, path, value string) (string, error) {
+	return SetValues(content, map[string]string{path: value})
+}
+
+// SetValues replaces the scalars stored at the paths of a YAML document
+func SetValues(content string, values map[string]string) (string, error) {
+	doc, err := decode(content)
+	if err != nil {
+		return "", err
+	}
+
+	for path, value := range values {
+		node, err := lookup(doc, path)
+		if err != nil {
+			return "", fmt.Errorf("failed to set %s: %w", path, err)
+		}
+		// Versions such as 1.20 must stay strings once re-encoded
+		node.Value, node.Tag, node.Style = value, "!!str", 0
+	}
+
+	return encode(doc)
+}
+
+// Upsert sets the scalar at the path of a YAML document, creating the missing map keys
+func Upsert(content, path, value string) (string, error) {
+	doc, err := decode(content)
+	if err != nil {
+		return "", err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", fmt.Errorf("failed to set %s: document is not a map", path)
+	}
+
+	node := doc.Content[0]
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		if node, err = mappingEntry(node, segment); err != nil {
+			return "", fmt.Errorf("failed to set %s: %w", path, err)
+		}
+	}
+	setEntry(node, segments[len(segments)-1], value)
+
+	return encode(doc)
+}
+
+// SetAnnotations adds or refreshes the metadata.annotations entries of a YAML document, creating the maps when missing
+func SetAnnotations(content string, annotations map[string]string) (string, error) {
+	doc, err := decode(content)
+	if err != nil {
+		return "", err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", fmt.Errorf("failed to set annotations: document is not a map")
+	}
+
+	// Annotation keys contain dots, add them as map entries rather than dot separated paths
+	metadata, err := mappingEntry(doc.Content[0], "metadata")
+	if err != nil {
+		return "", fmt.Errorf("failed to set annotations: %w", err)
+	}
+	node, err := mappingEntry(metadata, "annotations")
+	if err != nil {
+		return "", fmt.Errorf("failed to set annotations: %w", err)
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		setEntry(node, key, annotations[key])
+	}
+
+	return encode(doc)
+}
+
+// Build creates a YAML document from paths and their scalar values, keeping the order of the paths
+func Build(paths []string, values map[string]string) (string, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, path := range paths {
+		node := root
+		segments := strings.Split(path, ".")
+		for i, segment := range segments {
+			var next *yaml.Node
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == segment {
+					next = node.Content[j+1]
+					break
+				}
+			}
+			if next == nil {
+				next = &yaml.Node{Kind: yaml.MappingNode}
+				if i == len(segments)-1 {
+					next = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[path]}
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: segment}, next)
+			}
+			if next.Kind != yaml.MappingNode && i < len(segments)-1 {
+				return "", fmt.Errorf("cannot descend into %q in %s", segment, path)
+			}
+			node = next
+		}
+	}
+
+	return encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}})
+}
+
+// ListValues reads the field of every item of the list stored at the path, empty for the items without it
+func ListValues(content, path, field string) ([]string, error) {
+	doc, err := decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := walk(doc, path)
+	if err != nil {
+		return nil, err
+	}
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s is not a list", path)
+	}
+
+	values := make([]string, len(list.Content))
+	for i, item := range list.Content {
+		if node, err := walk(item, field); err == nil {
+			values[i] = node.Value
+		}
+	}
+
+	return values, nil
+}
+
+// mappingEntry returns the map stored under the key, adding an empty one when missing. An empty value (ex:
+// annotations: with nothing after) becomes the map, any other value is an error rather than a duplicated key.
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, error) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != key {
+			continue
+		}
+		value := node.Content[i+1]
+		switch {
+		case value.Kind == yaml.MappingNode:
+			return value, nil
+		case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+			entry := &yaml.Node{Kind: yaml.MappingNode}
+			node.Content[i+1] = entry
+			return entry, nil
+		}
+		return nil, fmt.Errorf("%s is not a map", key)
+	}
+
+	entry := &yaml.Node{Kind: yaml.MappingNode}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, entry)
+
+	return entry, nil
+}
+
+// setEntry sets the scalar stored under the key of a map, appending the key when missing
+func setEntry(node *yaml.Node, key, value string) {
+	scalar := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = scalar
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, scalar)
+}
+
+// decode parses a YAML document, keeping its comments
+func decode(content string) (*yaml.Node, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(content), doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal yaml: %w", err)
+	}
+
+	return doc, nil
+}
+
+// encode marshals a YAML node with the two spaces indentation of our manifests
+func encode(doc *yaml.Node) (string, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return "", fmt.Errorf("failed to marshal yaml: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("failed to marshal yaml: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// lookup walks the path down to a scalar node
+func lookup(doc *yaml.Node, path string) (*yaml.Node, error) {
+	node, err := walk(doc, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("%s is not a scalar value", path)
+	}
+
+	return node, nil
+}
+
+// walk walks the path down to any node
+func walk(doc *yaml.Node, path string) (*yaml.Node, error) {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		switch node.Kind {
+		case yaml.MappingNode:
+			var next *yaml.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == segment {
+					next = node.Content[i+1]
+					break
+				}
+			}
+			if next == nil {
+				return nil, fmt.Errorf("key %q not found in %s", segment, path)
+			}
+			node = next
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				return nil, fmt.Errorf("invalid index %q in %s", segment, path)
+			}
+			node = node.Content[i]
+		default:
+			return nil, fmt.Errorf("cannot descend into %q in %s", segment, path)
+		}
+	}
+
+	return node, nil
+}
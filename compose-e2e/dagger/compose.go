@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// variablePattern matches the compose interpolations: $$, $VAR, ${VAR}, ${VAR:-default} and ${VAR-default}
+var variablePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+type composeFile struct {
+	Services map[string]*composeService `yaml:"services"`
+}
+
+// composeService holds the attributes of a compose service run as a Dagger service, the others are ignored
+type composeService struct {
+	Image       string              `yaml:"image"`
+	Build       *composeBuild       `yaml:"build"`
+	Environment composeMap          `yaml:"environment"`
+	Entrypoint  composeCommand      `yaml:"entrypoint"`
+	Command     composeCommand      `yaml:"command"`
+	WorkingDir  string              `yaml:"working_dir"`
+	Ports       []composePort       `yaml:"ports"`
+	Expose      []composePort       `yaml:"expose"`
+	DependsOn   composeDependsOn    `yaml:"depends_on"`
+	Healthcheck *composeHealthcheck `yaml:"healthcheck"`
+	Profiles    []string            `yaml:"profiles"`
+}
+
+type composeBuild struct {
+	Context    string     `yaml:"context"`
+	Dockerfile string     `yaml:"dockerfile"`
+	Target     string     `yaml:"target"`
+	Args       composeMap `yaml:"args"`
+}
+
+type composeHealthcheck struct {
+	Test     composeTest `yaml:"test"`
+	Interval string      `yaml:"interval"`
+	Disable  bool        `yaml:"disable"`
+}
+
+// UnmarshalYAML reads the short syntax of build, the path of the context
+func (b *composeBuild) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		b.Context = node.Value
+		return nil
+	}
+
+	type plain composeBuild
+	return node.Decode((*plain)(b))
+}
+
+// composeMap is a mapping written as KEY: value pairs or as a list of KEY=value
+type composeMap map[string]string
+
+func (m *composeMap) UnmarshalYAML(node *yaml.Node) error {
+	*m = composeMap{}
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			key, value, _ := strings.Cut(item.Value, "=")
+			(*m)[key] = value
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			// Numbers and booleans are kept as written
+			(*m)[node.Content[i].Value] = node.Content[i+1].Value
+		}
+	default:
+		return fmt.Errorf("line %d: expected a mapping or a list", node.Line)
+	}
+
+	return nil
+}
+
+// composeCommand is a command written as a list, or as a string split like a shell does
+type composeCommand []string
+
+func (c *composeCommand) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		args, err := splitShell(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*c = args
+		return nil
+	}
+
+	var args []string
+	if err := node.Decode(&args); err != nil {
+		return err
+	}
+	*c = args
+
+	return nil
+}
+
+// composeTest is the test of a healthcheck: NONE, CMD or CMD-SHELL followed by the command, or a shell command
+type composeTest []string
+
+func (t *composeTest) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = []string{"CMD-SHELL", node.Value}
+		return nil
+	}
+
+	var test []string
+	if err := node.Decode(&test); err != nil {
+		return err
+	}
+	*t = test
+
+	return nil
+}
+
+// composeDependsOn lists the services a service depends on, written as a list or as a mapping of conditions
+type composeDependsOn []string
+
+func (d *composeDependsOn) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+		*d = names
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			*d = append(*d, node.Content[i].Value)
+		}
+	default:
+		return fmt.Errorf("line %d: expected a mapping or a list", node.Line)
+	}
+
+	return nil
+}
+
+// composePort is the port of the container, from the short (8080:80/tcp) or long (target: 80) syntax
+type composePort int
+
+func (p *composePort) UnmarshalYAML(node *yaml.Node) error {
+	value := node.Value
+	if node.Kind == yaml.MappingNode {
+		var long struct {
+			Target string `yaml:"target"`
+		}
+		if err := node.Decode(&long); err != nil {
+			return err
+		}
+		value = long.Target
+	}
+
+	// The container port comes last, ranges are not supported
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		value = value[i+1:]
+	}
+	value, _, _ = strings.Cut(value, "/")
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("line %d: unsupported port %q", node.Line, node.Value)
+	}
+	*p = composePort(port)
+
+	return nil
+}
+
+// parseCompose interpolates the variables of the compose file, and returns the services enabled by the profiles
+func parseCompose(content string, vars map[string]string, profiles []string) (map[string]*composeService, error) {
+	var missing []string
+	content = variablePattern.ReplaceAllStringFunc(content, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		groups := variablePattern.FindStringSubmatch(match)
+		name := groups[1] + groups[4]
+		value, set := vars[name]
+		switch {
+		case groups[2] == ":-" && value == "", groups[2] == "-" && !set:
+			return groups[3]
+		case !set:
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("variables not set: %s", strings.Join(missing, ", ")),
+			Hint: "set the variables of the compose file",
+		}
+	}
+
+	file := &composeFile{}
+	if err := yaml.Unmarshal([]byte(content), file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal compose file: %w", err)
+	}
+
+	services := map[string]*composeService{}
+	for name, s := range file.Services {
+		enabled := len(s.Profiles) == 0
+		for _, p := range s.Profiles {
+			for _, active := range profiles {
+				enabled = enabled || p == active
+			}
+		}
+		if enabled {
+			services[name] = s
+		}
+	}
+
+	return services, nil
+}
+
+// splitShell splits a command into arguments like a shell, honoring quotes and backslashes
+func splitShell(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("unterminated quote in %q", command), Hint: "close the quotes of the command"}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,466 @@
+// This module brings up a docker-compose stack (the app and its dependencies) as Dagger services, waits for their
+// health checks, runs a test command against it, and collects the service logs when the tests fail.
+//
+// Services reach each other, and the tests reach them, by their compose name. Volumes, networks and host ports are
+// ignored: the stack only lives for the duration of the tests.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ComposeE2e struct {
+	// The compose project, with the build contexts of its services
+	// +private
+	Source *Directory
+	// Path of the compose file, relative to the project
+	// +private
+	ComposeFile string
+	// Profiles enabling the services listed under them
+	// +private
+	Profiles []string
+	// Variables interpolated in the compose file
+	// +private
+	Env []string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new ComposeE2e module for the compose file of the project
+func New(
+	// The compose project, with the build contexts of its services
+	// +required
+	source *Directory,
+	// Path of the compose file, relative to source
+	// +optional
+	// +default="docker-compose.yml"
+	composeFile string,
+	// Profiles enabling the services listed under them, the services without profiles are always enabled
+	// +optional
+	profiles []string,
+	// Variables interpolated in the compose file, replacing the .env file of compose (ex: TAG=e2e)
+	// +optional
+	env []string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *ComposeE2e {
+	return &ComposeE2e{
+		Source:       source,
+		ComposeFile:  composeFile,
+		Profiles:     profiles,
+		Env:          env,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type E2EResult struct {
+	// Whether the services became healthy and the test command passed
+	Passed bool
+	// Test command output, or the service which did not become healthy
+	Output string
+	// Logs of the services, one <service>.log file per service, only collected when the tests failed
+	Logs *Directory
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// stack holds the services of the compose file, in dependency order
+type stack struct {
+	order    []string
+	services map[string]*Service
+	// Containers of the services before their command, running the health checks
+	containers   map[string]*Container
+	healthchecks map[string]*composeHealthcheck
+}
+
+// Test starts the services in dependency order, waits for their health checks, and runs the test command in the tests
+// container with the services bound by name.
+// Health checks run from a container of the service image, reaching it by name instead of localhost: tests through
+// a socket or a file are not supported.
+//
+// Example usage: dagger call --source=. test --tests=$(dagger call e2e-runner) --test-command="npm,run,e2e" logs export --path=compose-logs
+func (m *ComposeE2e) Test(
+	ctx context.Context,
+	// Container running the test suite
+	// +required
+	tests *Container,
+	// Command running the test suite in the tests container
+	// +required
+	testCommand []string,
+	// Maximum duration to wait for each service to become healthy
+	// +optional
+	// +default="2m"
+	healthTimeout string,
+) (result *E2EResult, err error) {
+	span := m.startSpan(ctx, "Test")
+	defer span.End(&err)
+
+	timeout, err := time.ParseDuration(healthTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse health timeout %s: %w", healthTimeout, err)
+	}
+
+	// A dedicated volume collects the logs of this run only
+	logs := dag.CacheVolume(fmt.Sprintf("compose-e2e-%d", time.Now().UnixNano()))
+	s, err := m.stack(ctx, logs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range s.order {
+		if _, err := s.services[name].Start(ctx); err != nil {
+			return m.failed(fmt.Sprintf("service %s failed to start: %s", name, err), logs), nil
+		}
+		if err := s.waitHealthy(ctx, name, timeout); err != nil {
+			return m.failed(fmt.Sprintf("service %s did not become healthy within %s: %s", name, timeout, err), logs), nil
+		}
+	}
+
+	// Failing tests are reported, not returned as an error
+	c := tests
+	for _, name := range s.order {
+		c = c.WithServiceBinding(name, s.services[name])
+	}
+	c = c.WithExec(
+		append([]string{"sh", "-c", `"$@" > /tmp/e2e-output.log 2>&1; echo $? > /tmp/e2e-exit-code`, "sh"}, testCommand...),
+		ContainerWithExecOpts{SkipEntrypoint: true},
+	)
+
+	exitCode, err := c.File("/tmp/e2e-exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test exit code: %w", commandError(err))
+	}
+	output, err := c.File("/tmp/e2e-output.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test output: %w", commandError(err))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected test exit code %q", exitCode)
+	}
+	if code != 0 {
+		return m.failed(output, logs), nil
+	}
+
+	return &E2EResult{
+		Passed:       true,
+		Output:       output,
+		Logs:         dag.Directory(),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Service returns a service of the stack, with the services it depends on, to run other steps against it
+//
+// Example usage: dagger call --source=. service --name=api up --ports=8080:8080
+func (m *ComposeE2e) Service(
+	ctx context.Context,
+	// Name of the service in the compose file
+	// +required
+	name string,
+) (result *Service, err error) {
+	span := m.startSpan(ctx, "Service")
+	defer span.End(&err)
+
+	s, err := m.stack(ctx, dag.CacheVolume(fmt.Sprintf("compose-e2e-%d", time.Now().UnixNano())))
+	if err != nil {
+		return nil, err
+	}
+	svc, ok := s.services[name]
+	if !ok {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("service %s is not defined, or not enabled by the profiles", name),
+			Hint: "check the name of the service and the enabled profiles",
+		}
+	}
+
+	return svc, nil
+}
+
+// Check fails when the test suite failed, and returns its output otherwise
+func (r *E2EResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("e2e tests failed:\n%s", r.Output), Hint: "fix the failing e2e tests"}
+	}
+
+	return r.Output, nil
+}
+
+// failed returns the result of a failed run, with the logs the services wrote to the volume
+func (m *ComposeE2e) failed(output string, logs *CacheVolume) *E2EResult {
+	return &E2EResult{
+		Passed: false,
+		Output: output,
+		Logs: m.withProxy(dag.Container().From("alpine:3.19")).
+			WithMountedCache("/compose-logs", logs).
+			WithExec([]string{"sh", "-c", "mkdir -p /tmp/logs && cp /compose-logs/*.log /tmp/logs/ 2>/dev/null || true"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+			Directory("/tmp/logs"),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+}
+
+// stack parses the compose file and returns its services, each bound to the services it depends on and writing its
+// output to the logs volume
+func (m *ComposeE2e) stack(ctx context.Context, logs *CacheVolume) (*stack, error) {
+	content, err := m.Source.File(m.ComposeFile).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", m.ComposeFile, commandError(err))
+	}
+	vars := map[string]string{}
+	for _, e := range m.Env {
+		key, value, _ := strings.Cut(e, "=")
+		vars[key] = value
+	}
+	defs, err := parseCompose(content, vars, m.Profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", m.ComposeFile, err)
+	}
+
+	s := &stack{
+		services:     map[string]*Service{},
+		containers:   map[string]*Container{},
+		healthchecks: map[string]*composeHealthcheck{},
+	}
+	var add func(name string, dependents []string) error
+	add = func(name string, dependents []string) error {
+		if _, ok := s.services[name]; ok {
+			return nil
+		}
+		if slices.Contains(dependents, name) {
+			return &typederr.ValidationError{
+				Err:  fmt.Errorf("circular dependency: %s -> %s", strings.Join(dependents, " -> "), name),
+				Hint: "remove the circular depends_on of the services",
+			}
+		}
+		def, ok := defs[name]
+		if !ok {
+			return &typederr.ValidationError{
+				Err:  fmt.Errorf("service %s is not defined, or not enabled by the profiles", name),
+				Hint: "check the name of the service and the enabled profiles",
+			}
+		}
+		for _, dep := range def.DependsOn {
+			if err := add(dep, append(dependents, name)); err != nil {
+				return err
+			}
+		}
+
+		ctr, args, err := m.container(ctx, name, def)
+		if err != nil {
+			return err
+		}
+		svc := ctr.WithMountedCache("/compose-logs", logs)
+		for _, dep := range def.DependsOn {
+			svc = svc.WithServiceBinding(dep, s.services[dep])
+		}
+		for _, p := range append(def.Ports, def.Expose...) {
+			svc = svc.WithExposedPort(int(p))
+		}
+
+		s.services[name] = svc.
+			WithExec(
+				append([]string{"sh", "-c", `"$@" 2>&1 | tee /compose-logs/` + name + ".log", "sh"}, args...),
+				ContainerWithExecOpts{SkipEntrypoint: true},
+			).
+			AsService()
+		s.containers[name] = ctr
+		s.healthchecks[name] = def.Healthcheck
+		s.order = append(s.order, name)
+		return nil
+	}
+
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := add(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// container returns the container of the service, pulled or built, and the command it runs: the entrypoint and
+// command of the compose file, or of the image
+func (m *ComposeE2e) container(ctx context.Context, name string, def *composeService) (*Container, []string, error) {
+	var ctr *Container
+	switch {
+	case def.Build != nil:
+		buildArgs := []BuildArg{}
+		for key, value := range def.Build.Args {
+			buildArgs = append(buildArgs, BuildArg{Name: key, Value: value})
+		}
+		// Build contexts are relative to the compose file
+		ctr = m.Source.
+			Directory(path.Join(path.Dir(m.ComposeFile), def.Build.Context)).
+			DockerBuild(DirectoryDockerBuildOpts{Dockerfile: def.Build.Dockerfile, Target: def.Build.Target, BuildArgs: buildArgs})
+	case def.Image != "":
+		ctr = dag.Container().From(def.Image)
+	default:
+		return nil, nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("service %s has neither an image nor a build", name),
+			Hint: "set the image or the build of the service",
+		}
+	}
+	// The services reach their dependencies by name, and the health check the service itself. The environment of the
+	// compose file comes after, it overrides the proxy settings.
+	ctr = m.withProxy(ctr, append([]string{name}, def.DependsOn...)...)
+
+	keys := make([]string, 0, len(def.Environment))
+	for key := range def.Environment {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		ctr = ctr.WithEnvVariable(key, def.Environment[key])
+	}
+	if def.WorkingDir != "" {
+		ctr = ctr.WithWorkdir(def.WorkingDir)
+	}
+
+	entrypoint := []string(def.Entrypoint)
+	if def.Entrypoint == nil {
+		image, err := ctr.Entrypoint(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get entrypoint of %s: %w", name, err)
+		}
+		entrypoint = image
+	}
+	command := []string(def.Command)
+	// Like compose, an entrypoint override drops the command of the image
+	if def.Command == nil && def.Entrypoint == nil {
+		image, err := ctr.DefaultArgs(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get command of %s: %w", name, err)
+		}
+		command = image
+	}
+	args := append(slices.Clone(entrypoint), command...)
+	if len(args) == 0 {
+		return nil, nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("service %s has no command", name),
+			Hint: "set the command of the service",
+		}
+	}
+
+	return ctr, args, nil
+}
+
+// waitHealthy runs the health check of the service until it passes or the timeout elapses, services without health
+// check being healthy once their ports accept connections
+func (s *stack) waitHealthy(ctx context.Context, name string, timeout time.Duration) error {
+	check := s.healthchecks[name]
+	if check == nil || check.Disable || len(check.Test) == 0 || check.Test[0] == "NONE" {
+		return nil
+	}
+
+	var script string
+	switch check.Test[0] {
+	case "CMD":
+		quoted := make([]string, len(check.Test)-1)
+		for i, a := range check.Test[1:] {
+			quoted[i] = shell.Quote(a)
+		}
+		script = strings.Join(quoted, " ")
+	case "CMD-SHELL":
+		script = strings.Join(check.Test[1:], " ")
+	default:
+		return &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported health check test %s", check.Test[0]),
+			Hint: "use a CMD or CMD-SHELL health check",
+		}
+	}
+	script = strings.NewReplacer("localhost", name, "127.0.0.1", name).Replace(script)
+
+	interval := 5 * time.Second
+	if check.Interval != "" {
+		parsed, err := time.ParseDuration(check.Interval)
+		if err != nil {
+			return fmt.Errorf("failed to parse health check interval %s: %w", check.Interval, err)
+		}
+		interval = parsed
+	}
+
+	_, err := s.containers[name].
+		WithServiceBinding(name, s.services[name]).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(
+			`end=$(($(date +%%s) + %d)); until sh -c "$1"; do [ "$(date +%%s)" -lt "$end" ] || exit 1; sleep %d; done`,
+			int(timeout.Seconds()), max(int(interval.Seconds()), 1),
+		), "sh", script}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Sync(ctx)
+
+	return err
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls, the services bound to it
+// are reached without the proxy
+func (m *ComposeE2e) withProxy(c *Container, services ...string) *Container {
+	noProxy := m.NoProxy
+	for _, service := range services {
+		noProxy = strings.TrimPrefix(noProxy+","+service, ",")
+	}
+
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: noProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
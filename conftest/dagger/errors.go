@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the conftest commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"rego_parse_error", "rego_type_error", "rego_compile_error"},
+	AuthHint:       "check the credentials of the policy bundle registry",
+	ValidationHint: "fix the rego policies or the inputs passed to conftest",
+}
+
+// commandError types the error of a conftest command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
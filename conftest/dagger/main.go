@@ -0,0 +1,296 @@
+// This module evaluates Rego policies with conftest against manifests, Terraform plans and Dockerfiles.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/severity"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+// severities are the violation severities, from the most to the least severe
+var severities = severity.Scale{"critical", "high", "medium", "low"}
+
+type Conftest struct {
+	// The Rego policies
+	// +private
+	Policy *Directory
+	// The version of conftest (ex: v0.50.0)
+	// +private
+	Version string
+	// Lowest severity failing the check
+	// +private
+	FailOn string
+	// Policy namespaces to evaluate, all when empty
+	// +private
+	Namespaces []string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Conftest module evaluating the provided policies.
+// Rules may return an object with a severity (ex: deny[{"msg": msg, "severity": "critical"}]),
+// deny and violation rules default to high, warn rules to low.
+func New(
+	// The Rego policies
+	// +required
+	policy *Directory,
+	// The version of conftest
+	// +optional
+	// +default="v0.50.0"
+	version string,
+	// Lowest severity failing the check: critical, high, medium or low
+	// +optional
+	// +default="high"
+	failOn string,
+	// Policy namespaces to evaluate, all when empty
+	// +optional
+	namespaces []string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Conftest, error) {
+	if severities.Rank(failOn) < 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid severity %q, expected one of %s", failOn, strings.Join(severities, ", ")),
+			Hint: "use one of the expected severities",
+		}
+	}
+
+	return &Conftest{
+		Policy:       policy,
+		Version:      version,
+		FailOn:       failOn,
+		Namespaces:   namespaces,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+type PolicyResult struct {
+	// Whether no violation reaches the fail threshold
+	Passed bool
+	// Policy violations and warnings
+	Violations []*Violation
+	// Raw conftest JSON output
+	Report *File
+	// +private
+	FailOn string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Violation struct {
+	// File evaluated
+	File string
+	// Namespace of the policy
+	Namespace string
+	// Severity of the violation: critical, high, medium or low
+	Severity string
+	// Message of the rule
+	Message string
+}
+
+type conftestOutput []struct {
+	Filename  string           `json:"filename"`
+	Namespace string           `json:"namespace"`
+	Failures  []conftestResult `json:"failures"`
+	Warnings  []conftestResult `json:"warnings"`
+}
+
+type conftestResult struct {
+	Msg      string         `json:"msg"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+// Manifests evaluates the policies against rendered Kubernetes manifests.
+//
+// Example usage: dagger call --policy=./policy manifests --dir=./rendered check
+func (m *Conftest) Manifests(
+	ctx context.Context,
+	// Directory of manifests, searched recursively
+	// +required
+	dir *Directory,
+) (result *PolicyResult, err error) {
+	s := m.startSpan(ctx, "Manifests")
+	defer s.End(&err)
+
+	return m.test(ctx, dir, []string{"**/*.yaml", "**/*.yml"}, "")
+}
+
+// TerraformPlan evaluates the policies against a Terraform plan in JSON (terraform show -json).
+//
+// Example usage: dagger call --policy=./policy terraform-plan --plan=./plan.json check
+func (m *Conftest) TerraformPlan(
+	ctx context.Context,
+	// Terraform plan in JSON
+	// +required
+	plan *File,
+) (result *PolicyResult, err error) {
+	s := m.startSpan(ctx, "TerraformPlan")
+	defer s.End(&err)
+
+	return m.test(ctx, dag.Directory().WithFile("plan.json", plan), []string{"plan.json"}, "json")
+}
+
+// Dockerfiles evaluates the policies against the Dockerfiles of a directory.
+//
+// Example usage: dagger call --policy=./policy dockerfiles --dir=. violations
+func (m *Conftest) Dockerfiles(
+	ctx context.Context,
+	// Directory of Dockerfiles, searched recursively
+	// +required
+	dir *Directory,
+) (result *PolicyResult, err error) {
+	s := m.startSpan(ctx, "Dockerfiles")
+	defer s.End(&err)
+
+	return m.test(ctx, dir, []string{"**/Dockerfile", "**/*.Dockerfile", "**/Dockerfile.*"}, "dockerfile")
+}
+
+// Check fails when a violation reaches the fail threshold, and returns the violations count otherwise
+func (r *PolicyResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	counts := map[string]int{}
+	for _, v := range r.Violations {
+		counts[v.Severity]++
+	}
+	summary := fmt.Sprintf("critical=%d high=%d medium=%d low=%d", counts["critical"], counts["high"], counts["medium"], counts["low"])
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("policy violations at or above %s: %s", r.FailOn, summary),
+			Hint: "fix the resources violating the policies, or the policies",
+		}
+	}
+
+	return summary, nil
+}
+
+// test runs conftest on the files of dir matching the patterns
+func (m *Conftest) test(ctx context.Context, dir *Directory, patterns []string, parser string) (*PolicyResult, error) {
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := dir.Glob(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("no file matching %s", strings.Join(patterns, ", ")),
+			Hint: "check the patterns of the files to test",
+		}
+	}
+
+	args := []string{"conftest", "test", "--policy", "/policy", "--output", "json", "--no-fail"}
+	if len(m.Namespaces) == 0 {
+		args = append(args, "--all-namespaces")
+	}
+	for _, ns := range m.Namespaces {
+		args = append(args, "--namespace", ns)
+	}
+	if parser != "" {
+		args = append(args, "--parser", parser)
+	}
+
+	out, err := m.withProxy(dag.Container().From("openpolicyagent/conftest:"+m.Version)).
+		WithDirectory("/policy", m.Policy).
+		WithDirectory("/workspace", dir).
+		WithWorkdir("/workspace").
+		WithExec(append(args, files...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run conftest: %w", commandError(err))
+	}
+
+	var results conftestOutput
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		return nil, fmt.Errorf("failed to parse conftest output: %w", err)
+	}
+
+	passed := true
+	var violations []*Violation
+	for _, r := range results {
+		for _, kind := range []struct {
+			results  []conftestResult
+			severity string
+		}{{r.Failures, "high"}, {r.Warnings, "low"}} {
+			for _, f := range kind.results {
+				severity := kind.severity
+				if s, ok := f.Metadata["severity"].(string); ok && severities.Rank(strings.ToLower(s)) >= 0 {
+					severity = strings.ToLower(s)
+				}
+				if severities.Rank(severity) <= severities.Rank(m.FailOn) {
+					passed = false
+				}
+				violations = append(violations, &Violation{
+					File:      r.Filename,
+					Namespace: r.Namespace,
+					Severity:  severity,
+					Message:   f.Msg,
+				})
+			}
+		}
+	}
+
+	return &PolicyResult{
+		Passed:       passed,
+		Violations:   violations,
+		Report:       dag.Directory().WithNewFile("conftest.json", out).File("conftest.json"),
+		FailOn:       m.FailOn,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Conftest) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the cosign commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"no matching signatures", "no signatures found", "invalid signature"},
+	AuthHint:       "check the registry credentials and the signing key password",
+	ValidationHint: "check the image reference, the key and the identity of the signature",
+}
+
+// commandError types the error of a cosign command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
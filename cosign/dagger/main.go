@@ -0,0 +1,361 @@
+// This module signs and verifies container images and release files with cosign.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"time"
+)
+
+type Cosign struct {
+	// The version of cosign (ex: v2.2.3)
+	// +private
+	Version string
+	// Registry username
+	// +private
+	Username string
+	// Registry password or token
+	// +private
+	Password *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Cosign module pinned to the provided cosign version.
+// Registry credentials are needed to sign or verify private images.
+func New(
+	// The version of cosign
+	// +optional
+	// +default="v2.2.3"
+	version string,
+	// Registry username
+	// +optional
+	username string,
+	// Registry password or token
+	// +optional
+	password *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Cosign {
+	return &Cosign{
+		Version:      version,
+		Username:     username,
+		Password:     password,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// base returns a container with the pinned cosign CLI, authenticated against the registry of ref if credentials are set
+func (m *Cosign) base(ctx context.Context, ref string) (*Container, error) {
+	c := m.withProxy(dag.Container().From("gcr.io/projectsigstore/cosign:"+m.Version)).
+		// Signatures are pushed to and verified against the live registry
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	if ref != "" && m.Password != nil {
+		config, err := dockerConfig(ctx, registryauth.Host(ref), m.Username, m.Password)
+		if err != nil {
+			return nil, err
+		}
+		c = c.
+			WithMountedSecret("/root/.docker/config.json", config).
+			WithEnvVariable("DOCKER_CONFIG", "/root/.docker")
+	}
+
+	return c, nil
+}
+
+// withSigner configures key based signing when a key is provided, keyless signing with the identity token otherwise
+func withSigner(c *Container, args []string, key, keyPassword, identityToken *Secret) (*Container, []string, error) {
+	switch {
+	case key != nil:
+		c = c.WithMountedSecret("/keys/cosign.key", key)
+		if keyPassword != nil {
+			c = c.WithSecretVariable("COSIGN_PASSWORD", keyPassword)
+		} else {
+			c = c.WithEnvVariable("COSIGN_PASSWORD", "")
+		}
+		args = append(args, "--key", "/keys/cosign.key")
+	case identityToken != nil:
+		c = c.WithMountedSecret("/keys/identity-token", identityToken)
+		args = append(args, "--identity-token", "/keys/identity-token")
+	default:
+		return nil, nil, &typederr.AuthError{
+			Err:  fmt.Errorf("either a key or an identity token is required"),
+			Hint: "set the key and its password, or an identity token for keyless signing",
+		}
+	}
+
+	return c, args, nil
+}
+
+// SignImage signs an image with a cosign key, or keyless through Fulcio with an OIDC identity token.
+//
+// Example usage: dagger call --username=bot --password=env:REGISTRY_TOKEN sign-image --ref=ghcr.io/adore-me/app@sha256:... --key=env:COSIGN_KEY
+func (m *Cosign) SignImage(
+	ctx context.Context,
+	// Image reference, preferably by digest
+	// +required
+	ref string,
+	// Cosign private key, omit for keyless signing
+	// +optional
+	key *Secret,
+	// Password of the cosign private key
+	// +optional
+	keyPassword *Secret,
+	// OIDC identity token used for keyless signing (ex: the GitHub Actions ID token)
+	// +optional
+	identityToken *Secret,
+	// Annotations added to the signature (ex: git-sha=abc123)
+	// +optional
+	annotations []string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "SignImage")
+	defer s.End(&err)
+
+	c, err := m.base(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"cosign", "sign", "--yes"}
+	for _, a := range annotations {
+		args = append(args, "--annotations", a)
+	}
+
+	c, args, err = withSigner(c, args, key, keyPassword, identityToken)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := c.
+		WithExec(append(args, ref), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stderr(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign %s: %w", ref, commandError(err))
+	}
+
+	return out, nil
+}
+
+// Verify checks the signature of an image, and its attestations against a policy when provided.
+// Key based signatures are checked with the public key, keyless ones with the certificate identity and issuer.
+//
+// Example usage: dagger call verify --ref=ghcr.io/adore-me/app:1.2.3 --certificate-identity-regexp="^https://github.com/adore-me/" --certificate-oidc-issuer=https://token.actions.githubusercontent.com
+func (m *Cosign) Verify(
+	ctx context.Context,
+	// Image reference
+	// +required
+	ref string,
+	// Cosign public key, omit for keyless signatures
+	// +optional
+	key *File,
+	// Regular expression the keyless signing identity must match
+	// +optional
+	certificateIdentityRegexp string,
+	// OIDC issuer of the keyless signing identity
+	// +optional
+	// +default="https://token.actions.githubusercontent.com"
+	certificateOidcIssuer string,
+	// CUE or Rego policy evaluated against the image attestations
+	// +optional
+	policy *File,
+	// Predicate type of the attestations checked by the policy (ex: spdxjson, cyclonedx, slsaprovenance)
+	// +optional
+	// +default="spdxjson"
+	attestationType string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Verify")
+	defer s.End(&err)
+
+	c, err := m.base(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"cosign", "verify"}
+	if policy != nil {
+		c = c.WithFile("/tmp/policy", policy)
+		args = []string{"cosign", "verify-attestation", "--type", attestationType, "--policy", "/tmp/policy"}
+	}
+
+	if key != nil {
+		c = c.WithFile("/keys/cosign.pub", key)
+		args = append(args, "--key", "/keys/cosign.pub")
+	} else {
+		if certificateIdentityRegexp == "" {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("certificate identity regexp is required to verify keyless signatures"),
+				Hint: "set certificateIdentityRegexp, ex: ^https://github.com/adore-me/",
+			}
+		}
+		args = append(args,
+			"--certificate-identity-regexp", certificateIdentityRegexp,
+			"--certificate-oidc-issuer", certificateOidcIssuer,
+		)
+	}
+
+	_, err = c.
+		WithExec(append(args, ref), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify %s: %w", ref, commandError(err))
+	}
+
+	return fmt.Sprintf("Verified %s", ref), nil
+}
+
+// SignBlob signs a release file and returns the cosign bundle holding the signature (and certificate when keyless).
+//
+// Example usage: dagger call sign-blob --blob=./dist/app.tar.gz --key=env:COSIGN_KEY export --path=./dist/app.tar.gz.bundle
+func (m *Cosign) SignBlob(
+	ctx context.Context,
+	// File to sign
+	// +required
+	blob *File,
+	// Cosign private key, omit for keyless signing
+	// +optional
+	key *Secret,
+	// Password of the cosign private key
+	// +optional
+	keyPassword *Secret,
+	// OIDC identity token used for keyless signing (ex: the GitHub Actions ID token)
+	// +optional
+	identityToken *Secret,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "SignBlob")
+	defer s.End(&err)
+
+	c, err := m.base(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	c, args, err := withSigner(
+		c.WithFile("/tmp/blob", blob).WithDirectory("/out", dag.Directory()),
+		[]string{"cosign", "sign-blob", "--yes", "--bundle", "/out/cosign.bundle"},
+		key, keyPassword, identityToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	f := c.
+		WithExec(append(args, "/tmp/blob"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/out/cosign.bundle")
+	if _, err := f.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sign blob: %w", commandError(err))
+	}
+
+	return f, nil
+}
+
+// VerifyBlob checks a release file against its cosign bundle.
+//
+// Example usage: dagger call verify-blob --blob=./app.tar.gz --bundle=./app.tar.gz.bundle --key=./cosign.pub
+func (m *Cosign) VerifyBlob(
+	ctx context.Context,
+	// Signed file
+	// +required
+	blob *File,
+	// Cosign bundle created by sign-blob
+	// +required
+	bundle *File,
+	// Cosign public key, omit for keyless signatures
+	// +optional
+	key *File,
+	// Regular expression the keyless signing identity must match
+	// +optional
+	certificateIdentityRegexp string,
+	// OIDC issuer of the keyless signing identity
+	// +optional
+	// +default="https://token.actions.githubusercontent.com"
+	certificateOidcIssuer string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "VerifyBlob")
+	defer s.End(&err)
+
+	c, err := m.base(ctx, "")
+	if err != nil {
+		return "", err
+	}
+
+	c = c.WithFile("/tmp/blob", blob).WithFile("/tmp/cosign.bundle", bundle)
+	args := []string{"cosign", "verify-blob", "--bundle", "/tmp/cosign.bundle"}
+	if key != nil {
+		c = c.WithFile("/keys/cosign.pub", key)
+		args = append(args, "--key", "/keys/cosign.pub")
+	} else {
+		if certificateIdentityRegexp == "" {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("certificate identity regexp is required to verify keyless signatures"),
+				Hint: "set certificateIdentityRegexp, ex: ^https://github.com/adore-me/",
+			}
+		}
+		args = append(args,
+			"--certificate-identity-regexp", certificateIdentityRegexp,
+			"--certificate-oidc-issuer", certificateOidcIssuer,
+		)
+	}
+
+	if _, err := c.WithExec(append(args, "/tmp/blob"), ContainerWithExecOpts{SkipEntrypoint: true}).Sync(ctx); err != nil {
+		return "", fmt.Errorf("failed to verify blob: %w", commandError(err))
+	}
+
+	return "Verified blob", nil
+}
+
+// dockerConfig returns a docker config.json authenticating against the registry
+func dockerConfig(ctx context.Context, registry, username string, password *Secret) (*Secret, error) {
+	config, err := registryauth.DockerConfig(ctx, registryauth.Auth{Registry: registry, Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret("docker-config-"+registry, config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Cosign) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxCommentFiles is the number of changed files listed in the comment, the least covered first
+const maxCommentFiles = 50
+
+// Comment posts the coverage on the pull request, in a comment updated on the next runs, and returns the comment URL
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN report --reports=coverage.out comment --pull-request=42
+func (r *CoverageReport) Comment(
+	ctx context.Context,
+	// Number of the pull request
+	// +required
+	pullRequest int,
+	// Identifier of the comment, distinct per pipeline posting on the same pull requests (ex: one per service)
+	// +optional
+	// +default="coverage"
+	id string,
+) (out string, err error) {
+	s := r.startSpan(ctx, "Comment")
+	defer s.End(&err)
+
+	return dag.Gh(r.Token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle}).
+		StickyComment(ctx, r.Source, pullRequest, "coverage:"+id, r.markdown())
+}
+
+// markdown renders the coverage with the changed files and their uncovered lines
+func (r *CoverageReport) markdown() string {
+	status := ":white_check_mark:"
+	if !r.Passed {
+		status = ":x:"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s Coverage\n\n", status)
+	b.WriteString("| | Coverage | Lines | Minimum |\n| --- | --- | --- | --- |\n")
+	fmt.Fprintf(&b, "| Code | %s | %d / %d | %d%% |\n", r.Coverage, r.Covered, r.Lines, r.MinCoverage)
+	fmt.Fprintf(&b, "| Changed lines | %s | %d / %d | %d%% |\n", r.DiffCoverage, r.DiffCovered, r.DiffLines, r.MinDiffCoverage)
+	if len(r.Files) == 0 {
+		b.WriteString("\nNo instrumented line changed.\n")
+		return b.String()
+	}
+
+	// The least covered files come first
+	files := slices.Clone(r.Files)
+	slices.SortStableFunc(files, func(a, b *FileCoverage) int {
+		return cmp.Compare(percent(a.DiffCovered, a.DiffLines), percent(b.DiffCovered, b.DiffLines))
+	})
+
+	b.WriteString("\n<details><summary>Changed files</summary>\n\n| File | Changed lines | Uncovered lines |\n| --- | --- | --- |\n")
+	for i, f := range files {
+		if i == maxCommentFiles {
+			fmt.Fprintf(&b, "\n_%d more files._\n", len(files)-maxCommentFiles)
+			break
+		}
+		fmt.Fprintf(&b, "| `%s` | %.1f%% (%d / %d) | %s |\n",
+			f.Path, percent(f.DiffCovered, f.DiffLines), f.DiffCovered, f.DiffLines, ranges(f.Uncovered))
+	}
+	b.WriteString("\n</details>\n")
+
+	return b.String()
+}
+
+// ranges returns the sorted lines as ranges (ex: 4-7, 12)
+func ranges(lines []int) string {
+	var parts []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		part := strconv.Itoa(lines[i])
+		if j > i {
+			part += "-" + strconv.Itoa(lines[j])
+		}
+		parts = append(parts, part)
+		i = j + 1
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,333 @@
+// This module reads the coverage reports of a pull request (go coverprofile, lcov or clover), computes the coverage
+// of the lines it changes, enforces minimum thresholds, and posts the result as a sticky comment.
+//
+// The changed lines come from the diff of the head against its merge base with the base branch, fetched with the gh
+// module, which also posts the comment.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+)
+
+type Coverage struct {
+	// The head of the pull request, including its .git directory
+	// +private
+	Source *Directory
+	// +private
+	Token *Secret
+	// +private
+	BaseBranch string
+	// +private
+	PathPrefix string
+	// +private
+	MinCoverage int
+	// +private
+	MinDiffCoverage int
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Coverage module for the pull request checked out in source
+func New(
+	// The head of the pull request, including its .git directory
+	// +required
+	source *Directory,
+	// Token allowed to fetch the repository and comment on its pull requests
+	// +required
+	token *Secret,
+	// Branch the pull request targets
+	// +optional
+	// +default="master"
+	baseBranch string,
+	// Prefix removed from the paths of the reports to make them relative to the repository (ex: github.com/adore-me/api/ for a coverprofile, /app/ for lcov)
+	// +optional
+	pathPrefix string,
+	// Minimum coverage of the whole code, in percent
+	// +optional
+	// +default=0
+	minCoverage int,
+	// Minimum coverage of the lines changed by the pull request, in percent
+	// +optional
+	// +default=80
+	minDiffCoverage int,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Coverage {
+	return &Coverage{
+		Source:          source,
+		Token:           token,
+		BaseBranch:      baseBranch,
+		PathPrefix:      pathPrefix,
+		MinCoverage:     minCoverage,
+		MinDiffCoverage: minDiffCoverage,
+		ProxyURL:        proxyUrl,
+		NoProxy:         noProxy,
+		CABundle:        caBundle,
+		OtlpEndpoint:    otlpEndpoint,
+		OtlpHeaders:     otlpHeaders,
+		Traceparent:     traceparent,
+	}
+}
+
+type CoverageReport struct {
+	// Whether the coverage and the diff coverage reach their minimum
+	Passed bool
+	// Instrumented lines of the code
+	Lines int
+	// Covered lines of the code
+	Covered int
+	// Instrumented lines changed by the pull request
+	DiffLines int
+	// Covered lines changed by the pull request
+	DiffCovered int
+	// Coverage of the code (ex: 81.3%)
+	Coverage string
+	// Coverage of the changed lines, 100% when no instrumented line changed
+	DiffCoverage string
+	// Coverage of the files changed by the pull request
+	Files []*FileCoverage
+	// +private
+	MinCoverage int
+	// +private
+	MinDiffCoverage int
+	// +private
+	Source *Directory
+	// +private
+	Token *Secret
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type FileCoverage struct {
+	// Path of the file, relative to the repository
+	Path string
+	// Instrumented lines changed by the pull request
+	DiffLines int
+	// Covered lines changed by the pull request
+	DiffCovered int
+	// Changed lines which are not covered
+	Uncovered []int
+}
+
+// Report merges the coverage reports and computes the coverage of the lines the pull request changes. Changed lines
+// which are not instrumented, like comments or files without code, are ignored.
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN report --reports=coverage.out --reports=web/coverage/lcov.info check
+func (m *Coverage) Report(
+	ctx context.Context,
+	// Coverage reports, lines covered by any of them being covered
+	// +required
+	reports []*File,
+	// Format of the reports: go, lcov or clover, detected from their content when empty
+	// +optional
+	format string,
+) (result *CoverageReport, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	p := profile{}
+	normalize := normalizer(m.PathPrefix)
+	for i, r := range reports {
+		content, err := r.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read coverage report %d: %w", i+1, err)
+		}
+		f := format
+		if f == "" {
+			if f, err = detectFormat(content); err != nil {
+				return nil, fmt.Errorf("failed to read coverage report %d: %w", i+1, err)
+			}
+		}
+
+		switch f {
+		case formatGo:
+			err = parseGo(content, p, normalize)
+		case formatLcov:
+			err = parseLcov(content, p, normalize)
+		case formatClover:
+			err = parseClover(content, p, normalize)
+		default:
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("unsupported format %s, expected %s, %s or %s", f, formatGo, formatLcov, formatClover),
+				Hint: "use the go, lcov or clover format",
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s coverage report %d: %w", f, i+1, err)
+		}
+	}
+
+	changed, err := m.changedLines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CoverageReport{
+		Files:           []*FileCoverage{},
+		MinCoverage:     m.MinCoverage,
+		MinDiffCoverage: m.MinDiffCoverage,
+		Source:          m.Source,
+		Token:           m.Token,
+		ProxyURL:        m.ProxyURL,
+		NoProxy:         m.NoProxy,
+		CABundle:        m.CABundle,
+		OtlpEndpoint:    m.OtlpEndpoint,
+		OtlpHeaders:     m.OtlpHeaders,
+		Traceparent:     m.Traceparent,
+	}
+	for _, lines := range p {
+		for _, covered := range lines {
+			report.Lines++
+			if covered {
+				report.Covered++
+			}
+		}
+	}
+
+	files := make([]string, 0, len(changed))
+	for file := range changed {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		lines, ok := p[file]
+		if !ok {
+			continue
+		}
+		fc := &FileCoverage{Path: file, Uncovered: []int{}}
+		for _, l := range changed[file] {
+			covered, instrumented := lines[l]
+			if !instrumented {
+				continue
+			}
+			fc.DiffLines++
+			if covered {
+				fc.DiffCovered++
+			} else {
+				fc.Uncovered = append(fc.Uncovered, l)
+			}
+		}
+		if fc.DiffLines > 0 {
+			report.DiffLines += fc.DiffLines
+			report.DiffCovered += fc.DiffCovered
+			report.Files = append(report.Files, fc)
+		}
+	}
+
+	coverage, diffCoverage := percent(report.Covered, report.Lines), percent(report.DiffCovered, report.DiffLines)
+	report.Coverage = fmt.Sprintf("%.1f%%", coverage)
+	report.DiffCoverage = fmt.Sprintf("%.1f%%", diffCoverage)
+	report.Passed = coverage >= float64(m.MinCoverage) && diffCoverage >= float64(m.MinDiffCoverage)
+
+	return report, nil
+}
+
+// Check fails when the coverage or the diff coverage is below its minimum, and returns the summary otherwise
+func (r *CoverageReport) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	summary := fmt.Sprintf(
+		"coverage %s (minimum %d%%), diff coverage %s on %d changed lines (minimum %d%%)",
+		r.Coverage, r.MinCoverage, r.DiffCoverage, r.DiffLines, r.MinDiffCoverage,
+	)
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("insufficient coverage: %s", summary),
+			Hint: "add tests covering the code and the changed lines",
+		}
+	}
+
+	return summary, nil
+}
+
+// changedLines returns the lines added or modified in each file since the merge base of the base branch, as listed by
+// the gh module
+func (m *Coverage) changedLines(ctx context.Context) (map[string][]int, error) {
+	files, err := dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		ChangedFiles(ctx, m.Source, GhChangedFilesOpts{Base: m.BaseBranch})
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff against %s: %w", m.BaseBranch, err)
+	}
+
+	changed := map[string][]int{}
+	for _, f := range files {
+		file, err := f.Path(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read changed file: %w", err)
+		}
+		ranges, err := f.Ranges(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read changed lines of %s: %w", file, err)
+		}
+		for _, r := range ranges {
+			start, err := r.Start(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read changed lines of %s: %w", file, err)
+			}
+			end, err := r.End(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read changed lines of %s: %w", file, err)
+			}
+			for l := start; l <= end; l++ {
+				changed[file] = append(changed[file], l)
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// percent returns the ratio of covered lines in percent, 100 when there is no line
+func percent(covered, lines int) float64 {
+	if lines == 0 {
+		return 100
+	}
+
+	return float64(covered) * 100 / float64(lines)
+}
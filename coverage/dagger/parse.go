@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatGo     = "go"
+	formatLcov   = "lcov"
+	formatClover = "clover"
+)
+
+var (
+	// goBlockPattern matches a block of a Go coverprofile: file:startLine.startCol,endLine.endCol statements count
+	goBlockPattern = regexp.MustCompile(`^(.+):(\d+)\.\d+,(\d+)\.\d+ \d+ (\d+)$`)
+)
+
+// profile holds, for each file, whether its instrumented lines are covered
+type profile map[string]map[int]bool
+
+// add records the hit of a line, a line being covered when any report covers it
+func (p profile) add(file string, line int, covered bool) {
+	if p[file] == nil {
+		p[file] = map[int]bool{}
+	}
+	p[file][line] = p[file][line] || covered
+}
+
+// detectFormat returns the format of a coverage report from its content
+func detectFormat(content string) (string, error) {
+	trimmed := strings.TrimSpace(content)
+	switch {
+	case strings.HasPrefix(trimmed, "mode:"):
+		return formatGo, nil
+	case strings.HasPrefix(trimmed, "<?xml") || strings.HasPrefix(trimmed, "<coverage"):
+		return formatClover, nil
+	case strings.HasPrefix(trimmed, "TN:") || strings.HasPrefix(trimmed, "SF:"):
+		return formatLcov, nil
+	}
+
+	return "", &typederr.ValidationError{
+		Err:  fmt.Errorf("unknown coverage format, expected a go coverprofile, lcov or clover report"),
+		Hint: "export the coverage as a go coverprofile, an lcov or a clover report",
+	}
+}
+
+// parseGo reads a Go coverprofile, the lines of a block sharing its hit count
+func parseGo(content string, p profile, normalize func(string) string) error {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		match := goBlockPattern.FindStringSubmatch(line)
+		if match == nil {
+			return fmt.Errorf("unexpected coverprofile line %q", line)
+		}
+		start, _ := strconv.Atoi(match[2])
+		end, _ := strconv.Atoi(match[3])
+		file := normalize(match[1])
+		for l := start; l <= end; l++ {
+			p.add(file, l, match[4] != "0")
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseLcov reads the SF and DA records of an lcov tracefile
+func parseLcov(content string, p profile, normalize func(string) string) error {
+	var file string
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			file = normalize(strings.TrimPrefix(line, "SF:"))
+		case strings.HasPrefix(line, "DA:"):
+			if file == "" {
+				return fmt.Errorf("DA record outside of a source file: %q", line)
+			}
+			// DA:<line>,<hits>[,<checksum>]
+			fields := strings.Split(strings.TrimPrefix(line, "DA:"), ",")
+			if len(fields) < 2 {
+				return fmt.Errorf("unexpected lcov line %q", line)
+			}
+			number, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return fmt.Errorf("unexpected lcov line %q", line)
+			}
+			p.add(file, number, fields[1] != "0")
+		case line == "end_of_record":
+			file = ""
+		}
+	}
+
+	return scanner.Err()
+}
+
+type cloverFile struct {
+	Name  string `xml:"name,attr"`
+	Path  string `xml:"path,attr"`
+	Lines []struct {
+		Num   int    `xml:"num,attr"`
+		Type  string `xml:"type,attr"`
+		Count int    `xml:"count,attr"`
+	} `xml:"line"`
+}
+
+type cloverReport struct {
+	Project struct {
+		Files    []cloverFile `xml:"file"`
+		Packages []struct {
+			Files []cloverFile `xml:"file"`
+		} `xml:"package"`
+	} `xml:"project"`
+}
+
+// parseClover reads the statement and condition lines of a clover report, the method lines counting invocations
+func parseClover(content string, p profile, normalize func(string) string) error {
+	report := &cloverReport{}
+	if err := xml.Unmarshal([]byte(content), report); err != nil {
+		return err
+	}
+
+	files := report.Project.Files
+	for _, pkg := range report.Project.Packages {
+		files = append(files, pkg.Files...)
+	}
+	for _, f := range files {
+		name := f.Path
+		if name == "" {
+			name = f.Name
+		}
+		for _, l := range f.Lines {
+			if l.Type == "method" {
+				continue
+			}
+			p.add(normalize(name), l.Num, l.Count > 0)
+		}
+	}
+
+	return nil
+}
+
+// normalizer returns the function making the paths of the reports relative to the repository
+func normalizer(prefix string) func(string) string {
+	return func(file string) string {
+		file = strings.TrimPrefix(file, prefix)
+		return path.Clean(strings.TrimPrefix(file, "/"))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"time"
+)
+
+// call calls the Datadog API of the site, authenticated with the API key (and the application key when set),
+// and decodes the JSON response into out when not nil
+func (m *Datadog) call(ctx context.Context, method, endpoint string, payload, out any) error {
+	apiKey, err := m.APIKey.Plaintext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://api."+m.Site+"/"+endpoint, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", apiKey)
+	if m.AppKey != nil {
+		appKey, err := m.AppKey.Plaintext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get application key: %w", err)
+		}
+		req.Header.Set("DD-APPLICATION-KEY", appKey)
+	}
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call datadog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return typederr.FromResponse(resp, fmt.Errorf("datadog returned %s: %s", resp.Status, body))
+	}
+
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+// This module posts deployment events, custom metrics and downtimes to Datadog, for deploy correlation.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricTypes maps the metric types to their Datadog v2 intake value
+var metricTypes = map[string]int{"count": 1, "rate": 2, "gauge": 3}
+
+type Datadog struct {
+	// Datadog API key
+	// +private
+	APIKey *Secret
+	// Datadog application key, required for downtimes
+	// +private
+	AppKey *Secret
+	// Datadog site (ex: datadoghq.com, datadoghq.eu)
+	// +private
+	Site string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Datadog module authenticated against the Datadog site
+func New(
+	// Datadog API key
+	// +required
+	apiKey *Secret,
+	// Datadog application key, required for downtimes
+	// +optional
+	appKey *Secret,
+	// Datadog site (ex: datadoghq.com, datadoghq.eu, us5.datadoghq.com)
+	// +optional
+	// +default="datadoghq.com"
+	site string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Datadog {
+	return &Datadog{
+		APIKey:       apiKey,
+		AppKey:       appKey,
+		Site:         site,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// deploymentTags returns the unified service tags of a deployment followed by the extra tags
+func deploymentTags(service, env, version string, tags []string) []string {
+	all := []string{}
+	for _, t := range [][2]string{{"service", service}, {"env", env}, {"version", version}} {
+		if t[1] != "" {
+			all = append(all, t[0]+":"+t[1])
+		}
+	}
+
+	return append(all, tags...)
+}
+
+// DeploymentEvent posts a deployment event, shown as a marker on the dashboards of the service, and returns its URL.
+//
+// Example usage: dagger call --api-key=env:DD_API_KEY deployment-event --service=app --env=production --version=1.2.3 --url=https://github.com/adore-me/app/actions/runs/1
+func (m *Datadog) DeploymentEvent(
+	ctx context.Context,
+	// Name of the deployed service
+	// +required
+	service string,
+	// Environment of the deployment (ex: production)
+	// +required
+	env string,
+	// Deployed version
+	// +required
+	version string,
+	// Title of the event, defaults to "Deployed <service> <version> to <env>"
+	// +optional
+	title string,
+	// Text of the event, in Markdown
+	// +optional
+	text string,
+	// Link to the pipeline run or pull request, appended to the text
+	// +optional
+	url string,
+	// Additional tags (ex: team:platform)
+	// +optional
+	tags []string,
+	// Alert type of the event: info, success, warning or error
+	// +optional
+	// +default="info"
+	alertType string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "DeploymentEvent")
+	defer s.End(&err)
+
+	if title == "" {
+		title = fmt.Sprintf("Deployed %s %s to %s", service, version, env)
+	}
+	if url != "" {
+		text = strings.TrimSpace(text + "\n\n" + url)
+	}
+	// Datadog renders the text as Markdown when wrapped in these markers
+	if text != "" {
+		text = "%%% \n" + text + "\n %%%"
+	}
+
+	var event struct {
+		Event struct {
+			URL string `json:"url"`
+		} `json:"event"`
+	}
+	err = m.call(ctx, http.MethodPost, "api/v1/events", map[string]any{
+		"title":            title,
+		"text":             text,
+		"tags":             deploymentTags(service, env, version, tags),
+		"alert_type":       alertType,
+		"source_type_name": "deployment",
+	}, &event)
+	if err != nil {
+		return "", fmt.Errorf("failed to post deployment event: %w", err)
+	}
+
+	return event.Event.URL, nil
+}
+
+// SubmitMetric submits one point of a custom metric (ex: pipeline duration, bump lag).
+//
+// Example usage: dagger call --api-key=env:DD_API_KEY submit-metric --metric=ci.pipeline.duration --value=192 --tags=pipeline:deploy,service:app
+func (m *Datadog) SubmitMetric(
+	ctx context.Context,
+	// Name of the metric (ex: ci.pipeline.duration)
+	// +required
+	metric string,
+	// Value of the point (ex: 192, 0.5)
+	// +required
+	value string,
+	// Tags of the point (ex: service:app)
+	// +optional
+	tags []string,
+	// Type of the metric: gauge, count or rate
+	// +optional
+	// +default="gauge"
+	metricType string,
+	// Unit of the metric (ex: second, day)
+	// +optional
+	unit string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "SubmitMetric")
+	defer s.End(&err)
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid value %q: %w", value, err),
+			Hint: "use a number as the value of the metric",
+		}
+	}
+
+	t, ok := metricTypes[metricType]
+	if !ok {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid metric type %q, expected gauge, count or rate", metricType),
+			Hint: "use the gauge, count or rate metric type",
+		}
+	}
+
+	series := map[string]any{
+		"metric": metric,
+		"type":   t,
+		"points": []map[string]any{{"timestamp": time.Now().Unix(), "value": v}},
+		"tags":   tags,
+	}
+	if unit != "" {
+		series["unit"] = unit
+	}
+	if err := m.call(ctx, http.MethodPost, "api/v2/series", map[string]any{"series": []any{series}}, nil); err != nil {
+		return "", fmt.Errorf("failed to submit metric %s: %w", metric, err)
+	}
+
+	return fmt.Sprintf("Submitted %s=%s", metric, value), nil
+}
+
+// CreateDowntime mutes the monitors of a service for the duration of a deploy and returns the downtime ID.
+//
+// Example usage: dagger call --api-key=env:DD_API_KEY --app-key=env:DD_APP_KEY create-downtime --service=app --env=production --duration=30m
+func (m *Datadog) CreateDowntime(
+	ctx context.Context,
+	// Name of the deployed service, its monitors tagged service:<service> are muted
+	// +required
+	service string,
+	// Environment of the deployment (ex: production)
+	// +required
+	env string,
+	// How long the monitors stay muted (ex: 30m)
+	// +optional
+	// +default="30m"
+	duration string,
+	// Message of the downtime
+	// +optional
+	message string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "CreateDowntime")
+	defer s.End(&err)
+
+	if m.AppKey == nil {
+		return "", &typederr.AuthError{
+			Err:  fmt.Errorf("an application key is required to create downtimes"),
+			Hint: "set the application key of the module",
+		}
+	}
+
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid duration %q: %w", duration, err),
+			Hint: "use a duration, ex: 30m or 2h",
+		}
+	}
+	if message == "" {
+		message = fmt.Sprintf("Deploying %s to %s", service, env)
+	}
+
+	var downtime struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	err = m.call(ctx, http.MethodPost, "api/v2/downtime", map[string]any{
+		"data": map[string]any{
+			"type": "downtime",
+			"attributes": map[string]any{
+				"scope":              "env:" + env,
+				"monitor_identifier": map[string]any{"monitor_tags": []string{"service:" + service}},
+				"schedule":           map[string]any{"end": time.Now().Add(d).UTC().Format(time.RFC3339)},
+				"message":            message,
+			},
+		},
+	}, &downtime)
+	if err != nil {
+		return "", fmt.Errorf("failed to create downtime for %s: %w", service, err)
+	}
+
+	return downtime.Data.ID, nil
+}
+
+// CancelDowntime cancels a downtime once the deploy is over, unmuting the monitors.
+//
+// Example usage: dagger call --api-key=env:DD_API_KEY --app-key=env:DD_APP_KEY cancel-downtime --id=00000000-0000-0000-0000-000000000000
+func (m *Datadog) CancelDowntime(
+	ctx context.Context,
+	// ID of the downtime, as returned by create-downtime
+	// +required
+	id string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "CancelDowntime")
+	defer s.End(&err)
+
+	if m.AppKey == nil {
+		return "", &typederr.AuthError{
+			Err:  fmt.Errorf("an application key is required to cancel downtimes"),
+			Hint: "set the application key of the module",
+		}
+	}
+
+	if err := m.call(ctx, http.MethodDelete, "api/v2/downtime/"+id, nil, nil); err != nil {
+		return "", fmt.Errorf("failed to cancel downtime %s: %w", id, err)
+	}
+
+	return fmt.Sprintf("Cancelled downtime %s", id), nil
+}
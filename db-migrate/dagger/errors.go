@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the migration commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"dirty database", "no migration found", "validate failed"},
+	AuthHint:       "check the database credentials of the url",
+	ConflictHint:   "another migration holds the lock, run it again once it completes",
+	ValidationHint: "fix the migration files, or force the version of a dirty database",
+}
+
+// commandError types the error of a migration command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
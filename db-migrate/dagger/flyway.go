@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type flywayInfo struct {
+	SchemaVersion string `json:"schemaVersion"`
+	Migrations    []struct {
+		Version  string `json:"version"`
+		State    string `json:"state"`
+		Filepath string `json:"filepath"`
+	} `json:"migrations"`
+}
+
+type flywayValidation struct {
+	ValidationSuccessful bool `json:"validationSuccessful"`
+	InvalidMigrations    []struct {
+		Version      string `json:"version"`
+		Description  string `json:"description"`
+		ErrorDetails struct {
+			ErrorMessage string `json:"errorMessage"`
+		} `json:"errorDetails"`
+	} `json:"invalidMigrations"`
+	ErrorDetails *struct {
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"errorDetails"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// flywayJSON runs a Flyway command with the JSON output and decodes it. The output is decoded on failures too, as
+// Flyway reports failed validations with exit code 1.
+func (m *DbMigrate) flywayJSON(ctx context.Context, v any, args ...string) error {
+	output, exitCode, err := m.run(ctx, append(args, "-outputType=json")...)
+	if err != nil {
+		return err
+	}
+
+	// Warnings of the Java runtime may precede the JSON document on stderr
+	start := strings.Index(output, "{")
+	if start < 0 {
+		return fmt.Errorf("failed to run flyway %s: %s", args[0], output)
+	}
+	if err := json.Unmarshal([]byte(output[start:]), v); err != nil {
+		if exitCode != 0 {
+			return fmt.Errorf("failed to run flyway %s: %s", args[0], output)
+		}
+		return fmt.Errorf("failed to decode flyway %s output: %w", args[0], err)
+	}
+
+	return nil
+}
+
+// flywayPending returns the migrations Flyway would apply, in order, relative to the migrations directory
+func (m *DbMigrate) flywayPending(ctx context.Context) ([]string, error) {
+	info := &flywayInfo{}
+	if err := m.flywayJSON(ctx, info, "info"); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, mig := range info.Migrations {
+		// Outdated repeatable migrations changed since they were applied, and are applied again
+		if mig.State == "Pending" || mig.State == "Outdated" {
+			pending = append(pending, strings.TrimPrefix(mig.Filepath, "/migrations/"))
+		}
+	}
+
+	return pending, nil
+}
+
+// flywayDrift validates the flyway_schema_history table against the migrations, pending migrations aside
+func (m *DbMigrate) flywayDrift(ctx context.Context) (*MigrationDrift, error) {
+	info := &flywayInfo{}
+	if err := m.flywayJSON(ctx, info, "info"); err != nil {
+		return nil, err
+	}
+	validation := &flywayValidation{}
+	if err := m.flywayJSON(ctx, validation, "validate", "-ignoreMigrationPatterns=*:pending"); err != nil {
+		return nil, err
+	}
+	if validation.Error != nil {
+		return nil, fmt.Errorf("failed to validate migrations: %s", validation.Error.Message)
+	}
+
+	drift := &MigrationDrift{
+		Version:      info.SchemaVersion,
+		Drifted:      !validation.ValidationSuccessful,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, mig := range validation.InvalidMigrations {
+		drift.Findings = append(drift.Findings, fmt.Sprintf(
+			"%s %s: %s", mig.Version, mig.Description, mig.ErrorDetails.ErrorMessage,
+		))
+	}
+	if drift.Drifted && len(drift.Findings) == 0 && validation.ErrorDetails != nil {
+		drift.Findings = append(drift.Findings, validation.ErrorDetails.ErrorMessage)
+	}
+
+	return drift, nil
+}
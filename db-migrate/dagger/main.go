@@ -0,0 +1,302 @@
+// This module runs database migrations with golang-migrate or Flyway, previews the SQL they would run, and detects
+// the drift between the migrations and the schema history table of the database.
+//
+// The database is reached through its DSN, or bound as the "db" host when it runs as a Dagger service, such as an
+// ephemeral database for tests.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	toolMigrate = "migrate"
+	toolFlyway  = "flyway"
+)
+
+type DbMigrate struct {
+	// The migrations: golang-migrate <version>_<title>.up.sql files, or Flyway V<version>__<description>.sql files
+	// +private
+	Migrations *Directory
+	// +private
+	Dsn *Secret
+	// +private
+	Database *Service
+	// migrate (golang-migrate) or flyway
+	// +private
+	Tool string
+	// +private
+	MigrateVersion string
+	// +private
+	FlywayVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new DbMigrate module running the migrations against the database
+func New(
+	// Directory of the migrations, flat
+	// +required
+	migrations *Directory,
+	// DSN of the database: a URL for golang-migrate (ex: postgres://user:password@db:5432/app?sslmode=disable), a JDBC
+	// URL with the credentials for Flyway (ex: jdbc:postgresql://db:5432/app?user=user&password=password)
+	// +required
+	dsn *Secret,
+	// Database service, bound as the db host of the DSN (ex: an ephemeral database for tests)
+	// +optional
+	database *Service,
+	// Migration tool: migrate (golang-migrate) or flyway
+	// +optional
+	// +default="migrate"
+	tool string,
+	// The version of golang-migrate
+	// +optional
+	// +default="v4.17.0"
+	migrateVersion string,
+	// The version of Flyway
+	// +optional
+	// +default="10.10.0"
+	flywayVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*DbMigrate, error) {
+	if tool != toolMigrate && tool != toolFlyway {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported tool %s, expected %s or %s", tool, toolMigrate, toolFlyway),
+			Hint: "use the migrate or flyway tool",
+		}
+	}
+
+	return &DbMigrate{
+		Migrations:     migrations,
+		Dsn:            dsn,
+		Database:       database,
+		Tool:           tool,
+		MigrateVersion: migrateVersion,
+		FlywayVersion:  flywayVersion,
+		ProxyURL:       proxyUrl,
+		NoProxy:        noProxy,
+		CABundle:       caBundle,
+		OtlpEndpoint:   otlpEndpoint,
+		OtlpHeaders:    otlpHeaders,
+		Traceparent:    traceparent,
+	}, nil
+}
+
+type MigrationDrift struct {
+	// Whether the schema history table does not match the migrations
+	Drifted bool
+	// Latest version applied to the database, empty when none was
+	Version string
+	// What does not match, one entry per migration
+	Findings []string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// base returns a container of the migration tool with the migrations mounted in /migrations and the DSN set
+func (m *DbMigrate) base() *Container {
+	var c *Container
+	if m.Tool == toolFlyway {
+		c = m.withProxy(dag.Container().From("flyway/flyway:"+m.FlywayVersion), "db").
+			WithSecretVariable("FLYWAY_URL", m.Dsn).
+			WithEnvVariable("FLYWAY_LOCATIONS", "filesystem:/migrations")
+	} else {
+		c = m.withProxy(dag.Container().From("migrate/migrate:"+m.MigrateVersion), "db").
+			WithSecretVariable("DATABASE_URL", m.Dsn)
+	}
+	if m.Database != nil {
+		c = c.WithServiceBinding("db", m.Database)
+	}
+
+	return c.
+		WithDirectory("/migrations", m.Migrations).
+		// The database changes outside of Dagger, never reuse a cached result
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+}
+
+// run runs the migration tool and returns its combined output and exit code
+func (m *DbMigrate) run(ctx context.Context, args ...string) (string, int, error) {
+	if m.Tool == toolFlyway {
+		args = append([]string{"flyway"}, args...)
+	} else {
+		// golang-migrate reads the DSN from its flags only
+		args = append([]string{"migrate", "-path", "/migrations", "-database", `"$DATABASE_URL"`}, args...)
+	}
+
+	// golang-migrate logs to stderr, and both tools exit with 1 on failures whose output is still needed
+	c := m.base().WithExec(
+		[]string{"sh", "-c", strings.Join(args, " ") + " > /tmp/output.log 2>&1; echo $? > /tmp/exit-code"},
+		ContainerWithExecOpts{SkipEntrypoint: true},
+	)
+
+	output, err := c.File("/tmp/output.log").Contents(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s output: %w", m.Tool, commandError(err))
+	}
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s exit code: %w", m.Tool, commandError(err))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse %s exit code: %w", m.Tool, err)
+	}
+
+	return output, code, nil
+}
+
+// Up applies the pending migrations and returns the tool output
+//
+// Example usage: dagger call --migrations=./migrations --dsn=env:DATABASE_URL up
+func (m *DbMigrate) Up(
+	ctx context.Context,
+	// Number of migrations applied, all the pending ones when 0 (golang-migrate only)
+	// +optional
+	steps int,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Up")
+	defer s.End(&err)
+
+	args := []string{"up"}
+	if m.Tool == toolFlyway {
+		if steps > 0 {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("steps is only supported by golang-migrate"),
+				Hint: "migrate by steps with golang-migrate, or to a version with flyway",
+			}
+		}
+		args = []string{"migrate"}
+	} else if steps > 0 {
+		args = append(args, fmt.Sprint(steps))
+	}
+
+	output, exitCode, err := m.run(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("failed to apply migrations: %s", output)
+	}
+
+	return output, nil
+}
+
+// DryRun returns the SQL of the pending migrations, in the order they would be applied, without running them
+//
+// Example usage: dagger call --migrations=./migrations --dsn=env:DATABASE_URL dry-run export --path=pending.sql
+func (m *DbMigrate) DryRun(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "DryRun")
+	defer s.End(&err)
+
+	var pending []string
+	if m.Tool == toolFlyway {
+		pending, err = m.flywayPending(ctx)
+	} else {
+		pending, err = m.migratePending(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	if len(pending) == 0 {
+		b.WriteString("-- No pending migration\n")
+	}
+	for _, name := range pending {
+		sql, err := m.Migrations.File(name).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+		b.WriteString("-- " + name + "\n" + strings.TrimRight(sql, "\n") + "\n\n")
+	}
+
+	return dag.Directory().WithNewFile("dry-run.sql", b.String()).File("dry-run.sql"), nil
+}
+
+// Drift compares the schema history table of the database with the migrations: migrations applied but missing
+// from the directory, changed since they were applied (Flyway only), or failed halfway.
+//
+// Example usage: dagger call --migrations=./migrations --dsn=env:DATABASE_URL drift check
+func (m *DbMigrate) Drift(ctx context.Context) (result *MigrationDrift, err error) {
+	s := m.startSpan(ctx, "Drift")
+	defer s.End(&err)
+
+	if m.Tool == toolFlyway {
+		return m.flywayDrift(ctx)
+	}
+
+	return m.migrateDrift(ctx)
+}
+
+// Check fails when the database drifted from the migrations, and returns the applied version otherwise
+func (r *MigrationDrift) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if r.Drifted {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("database drifted from the migrations:\n- %s", strings.Join(r.Findings, "\n- ")),
+			Hint: "add a migration for the manual changes of the schema, or revert them",
+		}
+	}
+	if r.Version == "" {
+		return "No migration applied", nil
+	}
+
+	return "Database at version " + r.Version + ", in sync with the migrations", nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls, the services bound to it
+// are reached without the proxy
+func (m *DbMigrate) withProxy(c *Container, services ...string) *Container {
+	noProxy := m.NoProxy
+	for _, service := range services {
+		noProxy = strings.TrimPrefix(noProxy+","+service, ",")
+	}
+
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: noProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var migrateFilePattern = regexp.MustCompile(`^(\d+)_.*\.up\.sql$`)
+
+// migrateVersion returns the version recorded in the schema_migrations table, 0 when no migration was applied, and
+// whether its migration failed halfway
+func (m *DbMigrate) migrateVersion(ctx context.Context) (uint64, bool, error) {
+	output, exitCode, err := m.run(ctx, "version")
+	if err != nil {
+		return 0, false, err
+	}
+	output = strings.TrimSpace(output)
+	if exitCode != 0 {
+		if strings.Contains(output, "no migration") {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to read the schema version: %s", output)
+	}
+
+	// The version is printed last, after the logs
+	lines := strings.Split(output, "\n")
+	version, dirty := strings.CutSuffix(lines[len(lines)-1], " (dirty)")
+	v, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse schema version %s: %w", version, err)
+	}
+
+	return v, dirty, nil
+}
+
+// migrateFiles returns the up migrations of the directory by version, and their sorted versions
+func (m *DbMigrate) migrateFiles(ctx context.Context) (map[uint64]string, []uint64, error) {
+	entries, err := m.Migrations.Entries(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	files := map[uint64]string{}
+	var versions []uint64
+	for _, e := range entries {
+		match := migrateFilePattern.FindStringSubmatch(e)
+		if match == nil {
+			continue
+		}
+		v, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse version of migration %s: %w", e, err)
+		}
+		files[v] = e
+		versions = append(versions, v)
+	}
+	slices.Sort(versions)
+
+	return files, versions, nil
+}
+
+// migratePending returns the up migrations newer than the schema version, in order
+func (m *DbMigrate) migratePending(ctx context.Context) ([]string, error) {
+	current, dirty, err := m.migrateVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("migration %d failed halfway, fix the schema and force its version before migrating", current),
+			Hint: "fix the schema and force the version of the failed migration",
+		}
+	}
+
+	files, versions, err := m.migrateFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, v := range versions {
+		if v > current {
+			pending = append(pending, files[v])
+		}
+	}
+
+	return pending, nil
+}
+
+// migrateDrift checks the schema version against the migrations. golang-migrate only records the latest version, so
+// changed migrations are not detected.
+func (m *DbMigrate) migrateDrift(ctx context.Context) (*MigrationDrift, error) {
+	current, dirty, err := m.migrateVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		return &MigrationDrift{
+			OtlpEndpoint: m.OtlpEndpoint,
+			OtlpHeaders:  m.OtlpHeaders,
+			Traceparent:  m.Traceparent,
+		}, nil
+	}
+
+	files, _, err := m.migrateFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := &MigrationDrift{
+		Version:      strconv.FormatUint(current, 10),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	if dirty {
+		drift.Findings = append(drift.Findings, fmt.Sprintf("migration %d failed halfway, the version is marked dirty", current))
+	}
+	if _, ok := files[current]; !ok {
+		drift.Findings = append(drift.Findings, fmt.Sprintf("version %d is applied but has no migration in the directory", current))
+	}
+	drift.Drifted = len(drift.Findings) > 0
+
+	return drift, nil
+}
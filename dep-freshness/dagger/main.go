@@ -0,0 +1,432 @@
+// This module reports how far behind the repositories of an organization are on their dependencies, to run nightly.
+//
+// Every repository listed by the gh module is cloned and scanned for its Go modules, base images and Helm chart
+// dependencies, and the components tracked in a config (ex: Istio) are compared with their latest GitHub release.
+// Each repository gets a score out of 100, published as a dashboard JSON, and the worst ones get an issue.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+	"slices"
+	"strings"
+	"time"
+)
+
+type DepFreshness struct {
+	// +private
+	Token *Secret
+	// +private
+	Org string
+	// +private
+	Topic string
+	// +private
+	Components *File
+	// +private
+	GoVersion string
+	// +private
+	Concurrency int
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new DepFreshness module scanning the repositories of the organization
+func New(
+	// Token allowed to clone the repositories and open issues
+	// +required
+	token *Secret,
+	// Organization owning the repositories
+	// +optional
+	// +default="adore-me"
+	org string,
+	// Only scan the repositories with this topic
+	// +optional
+	topic string,
+	// YAML config of the components tracked against their GitHub releases, in the manifests of a repository:
+	//
+	//	components:
+	//	  - name: istio
+	//	    repo: istio/istio
+	//	    source: adore-me/gitops
+	//	    file: clusters/prod/istio/helmrelease.yaml
+	//	    key: spec.chart.spec.version
+	//
+	// +optional
+	components *File,
+	// Version of the Go image listing the module updates
+	// +optional
+	// +default="1.22"
+	goVersion string,
+	// Number of repositories scanned in parallel
+	// +optional
+	// +default=4
+	concurrency int,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *DepFreshness {
+	return &DepFreshness{
+		Token:        token,
+		Org:          org,
+		Topic:        topic,
+		Components:   components,
+		GoVersion:    goVersion,
+		Concurrency:  concurrency,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type component struct {
+	Name string `yaml:"name"`
+	// GitHub repository publishing the releases (ex: istio/istio)
+	Repo string `yaml:"repo"`
+	// Only consider release tags with this prefix
+	TagPrefix string `yaml:"tagPrefix"`
+	// Repository holding the manifest (ex: adore-me/gitops)
+	Source string `yaml:"source"`
+	// Manifest storing the version, relative to the source repository
+	File string `yaml:"file"`
+	// Dot separated path of the version field in the manifest
+	Key string `yaml:"key"`
+}
+
+type FreshnessReport struct {
+	// Organization of the repositories
+	Org string
+	// Date of the report, in RFC 3339
+	GeneratedAt string
+	// Average score of the repositories, out of 100
+	Score int
+	// Repositories, from the lowest score
+	Repos []*RepoFreshness
+	// Tracked components
+	Components []*Dependency
+	// +private
+	Token *Secret
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type RepoFreshness struct {
+	// Repository, as owner/name
+	Repo string
+	// Score out of 100, minus 15 per major, 5 per minor and 1 per patch version behind
+	Score int
+	// Dependencies, from the most outdated
+	Dependencies []*Dependency
+	// Failures of the scanners, their dependencies are missing from the score
+	Errors []string
+}
+
+type Dependency struct {
+	// go, image, chart or component
+	Kind string
+	// Module path, image repository, chart or component name
+	Name string
+	// File pinning the version, relative to the repository
+	File string
+	// Pinned version
+	Current string
+	// Latest stable version, of the same major for Go modules and of the same variant for images
+	Latest string
+	// current, patch, minor, major, or unknown when the versions are not comparable
+	Lag string
+}
+
+// Report scans the repositories of the organization and the tracked components
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --components=freshness.yaml report dashboard export --path=freshness.json
+func (m *DepFreshness) Report(ctx context.Context) (result *FreshnessReport, err error) {
+	span := m.startSpan(ctx, "Report")
+	defer span.End(&err)
+
+	var components []component
+	if m.Components != nil {
+		content, err := m.Components.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read components: %w", err)
+		}
+		config := &struct {
+			Components []component `yaml:"components"`
+		}{}
+		if err := yaml.Unmarshal([]byte(content), config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal components: %w", err)
+		}
+		for i := range config.Components {
+			c := &config.Components[i]
+			if c.Name == "" || c.Source == "" || c.File == "" || !strings.Contains(c.Repo, "/") {
+				return nil, &typederr.ValidationError{
+					Err:  fmt.Errorf("component %d: name, repo (owner/name), source and file are required", i),
+					Hint: "set the name, repo, source and file of every component",
+				}
+			}
+			if c.Key == "" {
+				c.Key = "spec.chart.spec.version"
+			}
+		}
+		components = config.Components
+	}
+
+	repos, err := m.gh().ListRepos(ctx, m.Org, GhListReposOpts{Topic: m.Topic})
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newScanner(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	report := &FreshnessReport{
+		Org:          m.Org,
+		GeneratedAt:  time.Now().UTC().Format(time.RFC3339),
+		Repos:        make([]*RepoFreshness, len(repos)),
+		Components:   make([]*Dependency, len(components)),
+		Token:        m.Token,
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CABundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(m.Concurrency, 1))
+	for i, repo := range repos {
+		i, repo := i, repo
+		g.Go(func() error {
+			report.Repos[i] = s.scanRepo(gctx, repo)
+			return nil
+		})
+	}
+	for i, c := range components {
+		i, c := i, c
+		g.Go(func() error {
+			d, err := s.component(gctx, c)
+			report.Components[i] = d
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(report.Repos, func(a, b *RepoFreshness) int {
+		return a.Score - b.Score
+	})
+	sortDependencies(report.Components)
+	total := 0
+	for _, r := range report.Repos {
+		total += r.Score
+	}
+	report.Score = 100
+	if len(report.Repos) > 0 {
+		report.Score = total / len(report.Repos)
+	}
+
+	return report, nil
+}
+
+type dashboardDependency struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Current string `json:"current"`
+	Latest  string `json:"latest"`
+	Lag     string `json:"lag"`
+}
+
+type dashboardRepo struct {
+	Repo         string                `json:"repo"`
+	Score        int                   `json:"score"`
+	Dependencies []dashboardDependency `json:"dependencies"`
+	Errors       []string              `json:"errors"`
+}
+
+// Dashboard returns the report as the JSON document of the freshness dashboard
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN report dashboard export --path=freshness.json
+func (r *FreshnessReport) Dashboard(ctx context.Context) (file *File, err error) {
+	s := r.startSpan(ctx, "Dashboard")
+	defer s.End(&err)
+
+	dashboard := struct {
+		Org         string                `json:"org"`
+		GeneratedAt string                `json:"generatedAt"`
+		Score       int                   `json:"score"`
+		Repos       []dashboardRepo       `json:"repos"`
+		Components  []dashboardDependency `json:"components"`
+	}{
+		Org:         r.Org,
+		GeneratedAt: r.GeneratedAt,
+		Score:       r.Score,
+		Repos:       []dashboardRepo{},
+		Components:  dashboardDependencies(r.Components),
+	}
+	for _, repo := range r.Repos {
+		dashboard.Repos = append(dashboard.Repos, dashboardRepo{
+			Repo:         repo.Repo,
+			Score:        repo.Score,
+			Dependencies: dashboardDependencies(repo.Dependencies),
+			Errors:       repo.Errors,
+		})
+	}
+
+	content, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dashboard: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("freshness.json", string(content)).File("freshness.json"), nil
+}
+
+// OpenIssues opens an issue in the repositories with the lowest scores, listing their outdated dependencies, and
+// returns the issue URLs. The open issue of a previous run is updated instead of opening another one.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN report open-issues --worst=5 --max-score=70
+func (r *FreshnessReport) OpenIssues(
+	ctx context.Context,
+	// Number of repositories getting an issue
+	// +optional
+	// +default=5
+	worst int,
+	// Only the repositories scoring at most this get an issue
+	// +optional
+	// +default=70
+	maxScore int,
+) (items []string, err error) {
+	s := r.startSpan(ctx, "OpenIssues")
+	defer s.End(&err)
+
+	const title = "Dependency freshness"
+	gh := dag.Gh(r.Token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+	urls := []string{}
+	for _, repo := range r.Repos {
+		if len(urls) == worst || repo.Score > maxScore {
+			break
+		}
+
+		// The body stays untracked, the timestamp makes sure the calls are never cached
+		dir := dag.Directory().
+			WithNewFile(".freshness/body.md", repo.markdown()).
+			WithNewFile(".freshness/timestamp", time.Now().String())
+		heading := fmt.Sprintf("%s: score %d/100", title, repo.Score)
+
+		existing, err := gh.RunGh(ctx, dir, fmt.Sprintf(
+			"issue list -R %s --state open --search %s --json number,title --jq %s",
+			repo.Repo, shell.Quote("in:title "+title), shell.Quote(fmt.Sprintf(".[] | select(.title | startswith(%q)) | .number", title)),
+		))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the issues of %s: %w", repo.Repo, err)
+		}
+
+		var url string
+		if number, _, _ := strings.Cut(strings.TrimSpace(existing), "\n"); number != "" {
+			if _, err := gh.RunGh(ctx, dir, fmt.Sprintf(
+				"issue edit %s -R %s --title %s --body-file .freshness/body.md", number, repo.Repo, shell.Quote(heading),
+			)); err != nil {
+				return nil, fmt.Errorf("failed to update issue %s of %s: %w", number, repo.Repo, err)
+			}
+			url = fmt.Sprintf("https://github.com/%s/issues/%s", repo.Repo, number)
+		} else {
+			out, err := gh.RunGh(ctx, dir, fmt.Sprintf(
+				"issue create -R %s --title %s --body-file .freshness/body.md", repo.Repo, shell.Quote(heading),
+			))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open an issue in %s: %w", repo.Repo, err)
+			}
+			url = strings.TrimSpace(out)
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// markdown renders the outdated dependencies of the repository for its issue
+func (r *RepoFreshness) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "This repository scores **%d/100** on dependency freshness: each dependency behind its latest version removes 15 points per major, 5 per minor and 1 per patch.\n\n", r.Score)
+	b.WriteString("| Dependency | Kind | File | Current | Latest | Behind |\n| --- | --- | --- | --- | --- | --- |\n")
+	for _, d := range r.Dependencies {
+		if d.Lag == lagCurrent || d.Lag == lagUnknown {
+			continue
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | `%s` | %s | %s | %s |\n", d.Name, d.Kind, d.File, d.Current, d.Latest, d.Lag)
+	}
+	if len(r.Errors) > 0 {
+		b.WriteString("\nSome dependencies could not be scanned:\n\n")
+		for _, e := range r.Errors {
+			fmt.Fprintf(&b, "- %s\n", strings.ReplaceAll(e, "\n", " "))
+		}
+	}
+	b.WriteString("\n_This issue is updated by the nightly freshness report._\n")
+
+	return b.String()
+}
+
+// dashboardDependencies returns the dependencies for the dashboard
+func dashboardDependencies(deps []*Dependency) []dashboardDependency {
+	result := []dashboardDependency{}
+	for _, d := range deps {
+		result = append(result, dashboardDependency{Kind: d.Kind, Name: d.Name, File: d.File, Current: d.Current, Latest: d.Latest, Lag: d.Lag})
+	}
+
+	return result
+}
+
+// gh returns the gh module cloning the repositories through the proxy
+func (m *DepFreshness) gh() *Gh {
+	return dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *DepFreshness) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
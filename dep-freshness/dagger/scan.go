@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kindGo        = "go"
+	kindImage     = "image"
+	kindChart     = "chart"
+	kindComponent = "component"
+)
+
+// scanner scans the repositories, sharing the registry tags and chart indexes it fetched across them
+type scanner struct {
+	m      *DepFreshness
+	client *http.Client
+
+	mu      sync.Mutex
+	tags    map[string][]string
+	indexes map[string]map[string][]string
+}
+
+type goModule struct {
+	Path     string
+	Version  string
+	Main     bool
+	Indirect bool
+	Update   *struct {
+		Version string
+	}
+}
+
+type chartFile struct {
+	Dependencies []struct {
+		Name       string `yaml:"name"`
+		Version    string `yaml:"version"`
+		Repository string `yaml:"repository"`
+	} `yaml:"dependencies"`
+}
+
+type chartIndex struct {
+	Entries map[string][]struct {
+		Version string `yaml:"version"`
+	} `yaml:"entries"`
+}
+
+func newScanner(ctx context.Context, m *DepFreshness) (*scanner, error) {
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	return &scanner{
+		m:       m,
+		client:  client,
+		tags:    map[string][]string{},
+		indexes: map[string]map[string][]string{},
+	}, nil
+}
+
+// checkout returns the default branch of the repository, shallow cloned with the gh module
+func (s *scanner) checkout(ctx context.Context, repo string) (*Directory, error) {
+	// gh reads the repository from the origin remote, the timestamp makes sure the branch is fetched on every run
+	dir := s.m.withProxy(dag.Container().From("alpine/git:2.43.0")).
+		WithExec([]string{"sh", "-c", "git init -q /repo && git -C /repo remote add origin https://github.com/" + repo + ".git"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/repo").
+		WithNewFile(".freshness/timestamp", time.Now().String())
+
+	checkout := s.m.gh().RunGit(dir, "fetch -q --depth=1 origin HEAD && git checkout -q FETCH_HEAD").Directory("/workspace")
+	if _, err := checkout.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to clone %s: %w", repo, err)
+	}
+
+	return checkout, nil
+}
+
+// scanRepo returns the dependencies of the repository: Go modules, base images and chart dependencies. The failures
+// of a scanner are reported in the errors of the repository, the others still run.
+func (s *scanner) scanRepo(ctx context.Context, repo string) *RepoFreshness {
+	result := &RepoFreshness{Repo: repo, Dependencies: []*Dependency{}, Errors: []string{}}
+	checkout, err := s.checkout(ctx, repo)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	for _, scan := range []func(context.Context, *Directory) ([]*Dependency, error){s.goModules, s.baseImages, s.charts} {
+		deps, err := scan(ctx, checkout)
+		result.Dependencies = append(result.Dependencies, deps...)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+	sortDependencies(result.Dependencies)
+	result.Score = score(result.Dependencies)
+
+	return result
+}
+
+// goModules returns the direct requirements of the Go modules, compared with their latest version of the same major
+func (s *scanner) goModules(ctx context.Context, checkout *Directory) ([]*Dependency, error) {
+	files, err := checkout.Glob(ctx, "**/go.mod")
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for go.mod: %w", err)
+	}
+
+	var deps []*Dependency
+	var errs []error
+	for _, f := range files {
+		if strings.Contains(f, "vendor/") || strings.Contains(f, "testdata/") {
+			continue
+		}
+		out, err := s.m.withProxy(dag.Container().From("golang:"+s.m.GoVersion)).
+			WithMountedCache("/go/pkg/mod", dag.CacheVolume("go-mod")).
+			WithDirectory("/src", checkout.Directory(path.Dir(f))).
+			WithWorkdir("/src").
+			WithEnvVariable("GOFLAGS", "-mod=mod").
+			WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+			WithExec([]string{"go", "list", "-m", "-u", "-e", "-json", "all"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+			Stdout(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list the modules of %s: %w", f, err))
+			continue
+		}
+
+		// go list prints a stream of JSON objects
+		decoder := json.NewDecoder(strings.NewReader(out))
+		for {
+			mod := &goModule{}
+			if err := decoder.Decode(mod); err == io.EOF {
+				break
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("failed to decode the modules of %s: %w", f, err))
+				break
+			}
+			if mod.Main || mod.Indirect {
+				continue
+			}
+			latest := mod.Version
+			if mod.Update != nil {
+				latest = mod.Update.Version
+			}
+			deps = append(deps, &Dependency{Kind: kindGo, Name: mod.Path, File: f, Current: mod.Version, Latest: latest, Lag: lag(mod.Version, latest)})
+		}
+	}
+
+	return deps, errors.Join(errs...)
+}
+
+// baseImages returns the base images of the Dockerfiles, compared with the latest tag of the same variant
+func (s *scanner) baseImages(ctx context.Context, checkout *Directory) ([]*Dependency, error) {
+	files, err := checkout.Glob(ctx, "**/*Dockerfile*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for Dockerfiles: %w", err)
+	}
+
+	var deps []*Dependency
+	var errs []error
+	for _, f := range files {
+		content, err := checkout.File(f).Contents(ctx)
+		if err != nil {
+			// Globs also match directories
+			continue
+		}
+		for _, ref := range baseImageRefs(content) {
+			image, tag := splitImage(ref)
+			if tag == "" || tag == "latest" {
+				continue
+			}
+			tags, err := s.imageTags(ctx, image)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to list the tags of %s: %w", image, err))
+				continue
+			}
+			deps = append(deps, taggedDependency(kindImage, image, f, tag, latestTag(tag, tags)))
+		}
+	}
+
+	return deps, errors.Join(errs...)
+}
+
+// charts returns the dependencies of the Helm charts, compared with the latest version of their repository
+func (s *scanner) charts(ctx context.Context, checkout *Directory) ([]*Dependency, error) {
+	files, err := checkout.Glob(ctx, "**/Chart.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for Chart.yaml: %w", err)
+	}
+
+	var deps []*Dependency
+	var errs []error
+	for _, f := range files {
+		content, err := checkout.File(f).Contents(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", f, err))
+			continue
+		}
+		chart := &chartFile{}
+		if err := yaml.Unmarshal([]byte(content), chart); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmarshal %s: %w", f, err))
+			continue
+		}
+
+		for _, d := range chart.Dependencies {
+			var versions []string
+			switch {
+			case strings.HasPrefix(d.Repository, "oci://"):
+				versions, err = s.imageTags(ctx, strings.TrimPrefix(d.Repository, "oci://")+"/"+d.Name)
+			case strings.HasPrefix(d.Repository, "http://"), strings.HasPrefix(d.Repository, "https://"):
+				versions, err = s.chartVersions(ctx, d.Repository, d.Name)
+			default:
+				// Local charts (file://) and repository aliases (@name) are not tracked
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to list the versions of chart %s: %w", d.Name, err))
+				continue
+			}
+			latest := latestVersion(versions)
+			deps = append(deps, &Dependency{Kind: kindChart, Name: d.Name, File: f, Current: d.Version, Latest: latest, Lag: lag(d.Version, latest)})
+		}
+	}
+
+	return deps, errors.Join(errs...)
+}
+
+// component returns the version of a tracked component, compared with its latest GitHub release
+func (s *scanner) component(ctx context.Context, c component) (*Dependency, error) {
+	checkout, err := s.checkout(ctx, c.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, repo, _ := strings.Cut(c.Repo, "/")
+	bumper := dag.VersionBumper(owner, repo, checkout.File(c.File), VersionBumperOpts{
+		Key:       c.Key,
+		TagPrefix: c.TagPrefix,
+		ProxyURL:  s.m.ProxyURL,
+		NoProxy:   s.m.NoProxy,
+		CaBundle:  s.m.CABundle,
+	})
+	current, err := bumper.LocalVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local version of %s: %w", c.Name, err)
+	}
+	latest, err := bumper.LatestVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest version of %s: %w", c.Name, err)
+	}
+
+	return &Dependency{Kind: kindComponent, Name: c.Name, File: c.Source + "/" + c.File, Current: current, Latest: latest, Lag: lag(current, latest)}, nil
+}
+
+// imageTags returns the tags of an image repository, listed once per run
+func (s *scanner) imageTags(ctx context.Context, image string) ([]string, error) {
+	s.mu.Lock()
+	tags, ok := s.tags[image]
+	s.mu.Unlock()
+	if ok {
+		return tags, nil
+	}
+
+	out, err := s.m.withProxy(dag.Container().From("gcr.io/go-containerregistry/crane:debug")).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"crane", "ls", image}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags = strings.Fields(out)
+	s.mu.Lock()
+	s.tags[image] = tags
+	s.mu.Unlock()
+
+	return tags, nil
+}
+
+// chartVersions returns the versions of a chart in the index of its repository, fetched once per run
+func (s *scanner) chartVersions(ctx context.Context, repository, name string) ([]string, error) {
+	s.mu.Lock()
+	index, ok := s.indexes[repository]
+	s.mu.Unlock()
+	if !ok {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(repository, "/")+"/index.yaml", nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the index of %s: %w", repository, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, typederr.FromResponse(resp, fmt.Errorf("failed to get the index of %s: %s", repository, resp.Status))
+		}
+
+		parsed := &chartIndex{}
+		if err := yaml.NewDecoder(resp.Body).Decode(parsed); err != nil {
+			return nil, fmt.Errorf("failed to decode the index of %s: %w", repository, err)
+		}
+		index = map[string][]string{}
+		for chart, entries := range parsed.Entries {
+			for _, e := range entries {
+				index[chart] = append(index[chart], e.Version)
+			}
+		}
+		s.mu.Lock()
+		s.indexes[repository] = index
+		s.mu.Unlock()
+	}
+
+	versions, ok := index[name]
+	if !ok {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("chart %s is not in the index of %s", name, repository),
+			Hint: "check the name of the chart and its repository",
+		}
+	}
+
+	return versions, nil
+}
+
+// baseImageRefs returns the images of the FROM instructions, the stages of the Dockerfile, scratch and the images
+// set by build arguments excluded
+func baseImageRefs(dockerfile string) []string {
+	var refs []string
+	var stages []string
+	scanner := bufio.NewScanner(strings.NewReader(dockerfile))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		args := fields[1:]
+		if strings.HasPrefix(args[0], "--") {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+		ref := args[0]
+		stage := slices.Contains(stages, strings.ToLower(ref))
+		if len(args) >= 3 && strings.EqualFold(args[1], "AS") {
+			stages = append(stages, strings.ToLower(args[2]))
+		}
+		if ref == "scratch" || strings.Contains(ref, "$") || stage {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs
+}
+
+// splitImage splits an image reference into its repository and its tag, the digest dropped
+func splitImage(ref string) (string, string) {
+	ref, _, _ = strings.Cut(ref, "@")
+	// A colon before the last slash is the port of the registry
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+
+	return ref, ""
+}
+
+// taggedDependency returns a dependency pinned to a tag, its lag computed on the versions without their variant
+func taggedDependency(kind, name, file, current, latest string) *Dependency {
+	d := &Dependency{Kind: kind, Name: name, File: file, Current: current, Latest: latest, Lag: lagUnknown}
+	if latest != "" {
+		currentVersion, _, _ := strings.Cut(current, "-")
+		latestVersion, _, _ := strings.Cut(latest, "-")
+		d.Lag = lag(currentVersion, latestVersion)
+	}
+
+	return d
+}
+
+// sortDependencies sorts the dependencies from the most outdated, then by kind and name
+func sortDependencies(deps []*Dependency) {
+	slices.SortStableFunc(deps, func(a, b *Dependency) int {
+		if lagOrder[a.Lag] != lagOrder[b.Lag] {
+			return lagOrder[a.Lag] - lagOrder[b.Lag]
+		}
+		return strings.Compare(a.Kind+a.Name, b.Kind+b.Name)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/Masterminds/semver"
+	"strings"
+)
+
+const (
+	lagCurrent = "current"
+	lagPatch   = "patch"
+	lagMinor   = "minor"
+	lagMajor   = "major"
+	// lagUnknown is a dependency whose versions are not semver, or whose latest version could not be found
+	lagUnknown = "unknown"
+)
+
+// lagPenalties are the points a dependency removes from the score of its repository, out of 100
+var lagPenalties = map[string]int{
+	lagPatch: 1,
+	lagMinor: 5,
+	lagMajor: 15,
+}
+
+// lagOrder sorts the lags from the worst
+var lagOrder = map[string]int{
+	lagMajor:   0,
+	lagMinor:   1,
+	lagPatch:   2,
+	lagUnknown: 3,
+	lagCurrent: 4,
+}
+
+// lag returns how far the current version is behind the latest one
+func lag(current, latest string) string {
+	c, err := semver.NewVersion(current)
+	if err != nil {
+		return lagUnknown
+	}
+	l, err := semver.NewVersion(latest)
+	if err != nil {
+		return lagUnknown
+	}
+
+	switch {
+	case !c.LessThan(l):
+		return lagCurrent
+	case c.Major() != l.Major():
+		return lagMajor
+	case c.Minor() != l.Minor():
+		return lagMinor
+	}
+
+	return lagPatch
+}
+
+// score returns the freshness score of a repository, 100 minus the penalties of its dependencies
+func score(deps []*Dependency) int {
+	score := 100
+	for _, d := range deps {
+		score -= lagPenalties[d.Lag]
+	}
+
+	return max(score, 0)
+}
+
+// latestTag returns the highest stable version among the tags, of the same variant as the current tag: the same suffix
+// after the version (ex: -alpine) and the same precision (ex: 1.22 and 1.22.3 are not compared)
+func latestTag(current string, tags []string) string {
+	version, suffix, _ := strings.Cut(current, "-")
+	precision := strings.Count(version, ".")
+	if _, err := semver.NewVersion(version); err != nil {
+		return ""
+	}
+
+	var latest *semver.Version
+	var latestTag string
+	for _, tag := range tags {
+		v, s, _ := strings.Cut(tag, "-")
+		if s != suffix || strings.Count(v, ".") != precision || strings.HasPrefix(v, "v") != strings.HasPrefix(version, "v") {
+			continue
+		}
+		parsed, err := semver.NewVersion(v)
+		if err != nil || parsed.Prerelease() != "" {
+			continue
+		}
+		if latest == nil || parsed.GreaterThan(latest) {
+			latest, latestTag = parsed, tag
+		}
+	}
+
+	return latestTag
+}
+
+// latestVersion returns the highest stable version among the versions
+func latestVersion(versions []string) string {
+	var latest *semver.Version
+	var latestRaw string
+	for _, raw := range versions {
+		v, err := semver.NewVersion(raw)
+		if err != nil || v.Prerelease() != "" {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest, latestRaw = v, raw
+		}
+	}
+
+	return latestRaw
+}
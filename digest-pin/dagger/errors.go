@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the crane commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check the registry credentials",
+	ValidationHint: "check the image references of the manifests",
+}
+
+// commandError types the error of a crane command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,335 @@
+// This module pins the images of Kubernetes manifests to their digest, enforcing immutable images in GitOps repositories.
+//
+// Tags are resolved against the registries with crane, and rewritten as <image>:<tag>@<digest> so the tag stays readable.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// imageLine matches the image fields of the manifests, capturing the prefix, the quotes, the reference and the rest of the line
+var imageLine = regexp.MustCompile(`^(\s*(?:-\s+)?image:\s*)(["']?)([^\s"'#]+)(["']?)(.*)$`)
+
+type DigestPin struct {
+	// The version of crane (ex: v0.19.1)
+	// +private
+	Version string
+	// Registry the credentials are for (ex: 123456789012.dkr.ecr.us-east-1.amazonaws.com)
+	// +private
+	Registry string
+	// Registry username
+	// +private
+	Username string
+	// Registry password or token
+	// +private
+	Password *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new DigestPin module pinned to the provided crane version.
+// Registry credentials are needed to resolve private images, the other registries are accessed anonymously.
+func New(
+	// The version of crane
+	// +optional
+	// +default="v0.19.1"
+	version string,
+	// Registry the credentials are for (ex: 123456789012.dkr.ecr.us-east-1.amazonaws.com)
+	// +optional
+	registry string,
+	// Registry username
+	// +optional
+	username string,
+	// Registry password or token
+	// +optional
+	password *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *DigestPin {
+	return &DigestPin{
+		Version:      version,
+		Registry:     registry,
+		Username:     username,
+		Password:     password,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type PinResult struct {
+	// Whether every image is pinned to a digest
+	Passed bool
+	// Images referenced by tag only
+	Unpinned []*ImageRef
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type ImageRef struct {
+	// Manifest referencing the image, relative to the manifests directory
+	File string
+	// Line of the image field, starting at 1
+	Line int
+	// Image reference
+	Image string
+}
+
+// Check fails when an image is referenced by tag only, and returns a summary otherwise
+func (r *PinResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, i := range r.Unpinned {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Image))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d images are not pinned to a digest:\n%s", len(r.Unpinned), strings.Join(lines, "\n")),
+			Hint: "pin the images to their digest with the pin function",
+		}
+	}
+
+	return "All images are pinned to a digest", nil
+}
+
+// Verify lists the images of the manifests referenced by tag only.
+//
+// Example usage: dagger call verify --manifests=./clusters check
+func (m *DigestPin) Verify(
+	ctx context.Context,
+	// Directory of the manifests, searched recursively for .yaml and .yml files
+	// +required
+	manifests *Directory,
+	// Image prefixes left unpinned (ex: registry.k8s.io/pause)
+	// +optional
+	exclude []string,
+) (result *PinResult, err error) {
+	s := m.startSpan(ctx, "Verify")
+	defer s.End(&err)
+
+	refs, err := unpinned(ctx, manifests, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PinResult{
+		Passed:       len(refs) == 0,
+		Unpinned:     refs,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Pin resolves the tag of every unpinned image to its digest and returns the manifests rewritten to digest-pinned form.
+//
+// Example usage: dagger call --registry=ghcr.io --username=bot --password=env:GHCR_TOKEN pin --manifests=./clusters export --path=./clusters
+func (m *DigestPin) Pin(
+	ctx context.Context,
+	// Directory of the manifests, searched recursively for .yaml and .yml files
+	// +required
+	manifests *Directory,
+	// Image prefixes left unpinned (ex: registry.k8s.io/pause)
+	// +optional
+	exclude []string,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Pin")
+	defer s.End(&err)
+
+	refs, err := unpinned(ctx, manifests, exclude)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return manifests, nil
+	}
+
+	images := []string{}
+	files := []string{}
+	for _, r := range refs {
+		if !slices.Contains(images, r.Image) {
+			images = append(images, r.Image)
+		}
+		if !slices.Contains(files, r.File) {
+			files = append(files, r.File)
+		}
+	}
+
+	digests, err := m.resolve(ctx, images)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		content, err := manifests.File(f).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f, err)
+		}
+
+		lines := strings.Split(content, "\n")
+		for i, line := range lines {
+			match := imageLine.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			if digest, ok := digests[match[3]]; ok {
+				lines[i] = match[1] + match[2] + match[3] + "@" + digest + match[4] + match[5]
+			}
+		}
+		manifests = manifests.WithNewFile(f, strings.Join(lines, "\n"))
+	}
+
+	return manifests, nil
+}
+
+// resolve returns the digest of every image, by image reference
+func (m *DigestPin) resolve(ctx context.Context, images []string) (map[string]string, error) {
+	c := m.withProxy(dag.Container().From("gcr.io/go-containerregistry/crane/debug:"+m.Version)).
+		// Tags move in the registries, always resolve them again
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	if m.Password != nil {
+		if m.Registry == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("the registry of the credentials is required"),
+				Hint: "set the registry the credentials authenticate against",
+			}
+		}
+		config, err := dockerConfig(ctx, m.Registry, m.Username, m.Password)
+		if err != nil {
+			return nil, err
+		}
+		c = c.
+			WithMountedSecret("/root/.docker/config.json", config).
+			WithEnvVariable("DOCKER_CONFIG", "/root/.docker")
+	}
+
+	out, err := c.
+		WithExec(
+			append([]string{"sh", "-c", `for ref in "$@"; do digest=$(crane digest "$ref") || exit 1; echo "$ref $digest"; done`, "sh"}, images...),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve digests: %w", commandError(err))
+	}
+
+	digests := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		ref, digest, found := strings.Cut(line, " ")
+		if !found || !strings.HasPrefix(digest, "sha256:") {
+			return nil, fmt.Errorf("failed to resolve digest of %s", ref)
+		}
+		digests[ref] = digest
+	}
+
+	return digests, nil
+}
+
+// unpinned returns the images of the manifests referenced by tag only, skipping templated and excluded references
+func unpinned(ctx context.Context, manifests *Directory, exclude []string) ([]*ImageRef, error) {
+	var files []string
+	for _, pattern := range []string{"**/*.yaml", "**/*.yml"} {
+		matches, err := manifests.Glob(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list manifests: %w", err)
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+
+	refs := []*ImageRef{}
+	for _, f := range files {
+		content, err := manifests.File(f).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f, err)
+		}
+
+		for i, line := range strings.Split(content, "\n") {
+			match := imageLine.FindStringSubmatch(line)
+			if match == nil || strings.Contains(match[3], "@") || strings.ContainsAny(match[3], "{}$") || excluded(match[3], exclude) {
+				continue
+			}
+			refs = append(refs, &ImageRef{File: path.Clean(f), Line: i + 1, Image: match[3]})
+		}
+	}
+
+	return refs, nil
+}
+
+// excluded checks if the image starts with one of the excluded prefixes
+func excluded(image string, exclude []string) bool {
+	for _, prefix := range exclude {
+		if strings.HasPrefix(image, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dockerConfig returns a docker config.json authenticating against the registry
+func dockerConfig(ctx context.Context, registry, username string, password *Secret) (*Secret, error) {
+	config, err := registryauth.DockerConfig(ctx, registryauth.Auth{Registry: registry, Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret("docker-config-"+registry, config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *DigestPin) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
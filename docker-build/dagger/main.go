@@ -0,0 +1,380 @@
+// This module builds Dockerfiles with BuildKit, keeping the layer cache in cache volumes, and pushes single or multi-architecture images to a registry.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"strings"
+	"time"
+)
+
+type DockerBuild struct {
+	// The version of BuildKit (ex: v0.13.1)
+	// +private
+	BuildkitVersion string
+	// Registry username
+	// +private
+	Username string
+	// Registry password or token
+	// +private
+	Password *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new DockerBuild module, authenticated on the registry when credentials are provided
+func New(
+	// The version of BuildKit
+	// +optional
+	// +default="v0.13.1"
+	buildkitVersion string,
+	// Registry username
+	// +optional
+	username string,
+	// Registry password or token
+	// +optional
+	password *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *DockerBuild {
+	return &DockerBuild{
+		BuildkitVersion: buildkitVersion,
+		Username:        username,
+		Password:        password,
+		ProxyURL:        proxyUrl,
+		NoProxy:         noProxy,
+		CABundle:        caBundle,
+		OtlpEndpoint:    otlpEndpoint,
+		OtlpHeaders:     otlpHeaders,
+		Traceparent:     traceparent,
+	}
+}
+
+// buildOpts holds the options of a Dockerfile build
+type buildOpts struct {
+	source     *Directory
+	dockerfile string
+	target     string
+	buildArgs  []string
+	secrets    []*Secret
+	secretIds  []string
+	ssh        *Socket
+	cacheKey   string
+	platform   string
+}
+
+// Build builds the Dockerfile and returns the image, ex: to scan it before publishing.
+//
+// Example usage: dagger call build --source=. --build-args=VERSION=1.2.3 --secret-ids=npmrc --secrets=file:$HOME/.npmrc terminal
+func (m *DockerBuild) Build(
+	ctx context.Context,
+	// The build context
+	// +required
+	source *Directory,
+	// Path of the Dockerfile, relative to the build context
+	// +optional
+	// +default="Dockerfile"
+	dockerfile string,
+	// Target build stage
+	// +optional
+	target string,
+	// Build arguments (ex: VERSION=1.2.3)
+	// +optional
+	buildArgs []string,
+	// Build secrets, available to RUN --mount=type=secret,id=<secretId>
+	// +optional
+	secrets []*Secret,
+	// IDs of the build secrets, in the same order as secrets
+	// +optional
+	secretIds []string,
+	// SSH agent socket, available to RUN --mount=type=ssh
+	// +optional
+	ssh *Socket,
+	// Key of the layer cache volume, builds sharing a key share their cache
+	// +optional
+	// +default="default"
+	cacheKey string,
+	// Platform of the image (ex: linux/arm64), defaults to the platform of the engine
+	// +optional
+	platform string,
+) (ctr *Container, err error) {
+	s := m.startSpan(ctx, "Build")
+	defer s.End(&err)
+
+	c, err := m.buildctl(ctx, buildOpts{
+		source:     source,
+		dockerfile: dockerfile,
+		target:     target,
+		buildArgs:  buildArgs,
+		secrets:    secrets,
+		secretIds:  secretIds,
+		ssh:        ssh,
+		cacheKey:   cacheKey,
+		platform:   platform,
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Container(ContainerOpts{Platform: Platform(platform)}).Import(c.File("/tmp/image.tar")), nil
+}
+
+// Publish builds the Dockerfile, pushes the image and returns the pushed reference with its digest.
+//
+// Example usage: dagger call --username=$REGISTRY_USER --password=env:REGISTRY_TOKEN publish --source=. --ref=ghcr.io/adore-me/api:1.2.3
+func (m *DockerBuild) Publish(
+	ctx context.Context,
+	// The build context
+	// +required
+	source *Directory,
+	// The image reference to push (ex: ghcr.io/adore-me/api:1.2.3)
+	// +required
+	ref string,
+	// Path of the Dockerfile, relative to the build context
+	// +optional
+	// +default="Dockerfile"
+	dockerfile string,
+	// Target build stage
+	// +optional
+	target string,
+	// Build arguments (ex: VERSION=1.2.3)
+	// +optional
+	buildArgs []string,
+	// Build secrets, available to RUN --mount=type=secret,id=<secretId>
+	// +optional
+	secrets []*Secret,
+	// IDs of the build secrets, in the same order as secrets
+	// +optional
+	secretIds []string,
+	// SSH agent socket, available to RUN --mount=type=ssh
+	// +optional
+	ssh *Socket,
+	// Key of the layer cache volume, builds sharing a key share their cache
+	// +optional
+	// +default="default"
+	cacheKey string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Publish")
+	defer s.End(&err)
+
+	c, err := m.buildctl(ctx, buildOpts{
+		source:     source,
+		dockerfile: dockerfile,
+		target:     target,
+		buildArgs:  buildArgs,
+		secrets:    secrets,
+		secretIds:  secretIds,
+		ssh:        ssh,
+		cacheKey:   cacheKey,
+	}, ref)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := c.File("/tmp/metadata.json").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to build and push %s: %w", ref, err)
+	}
+
+	var meta struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		return "", fmt.Errorf("failed to parse build metadata: %w", err)
+	}
+
+	name, _, _ := strings.Cut(ref, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	return name + "@" + meta.Digest, nil
+}
+
+// PublishMultiArch builds the Dockerfile for each platform, then pushes the images as a single manifest list and returns the pushed reference with its digest.
+// Each platform is built natively or emulated by the engine, and has its own layer cache volume.
+//
+// Example usage: dagger call --username=$REGISTRY_USER --password=env:REGISTRY_TOKEN publish-multi-arch --source=. --ref=ghcr.io/adore-me/api:1.2.3
+func (m *DockerBuild) PublishMultiArch(
+	ctx context.Context,
+	// The build context
+	// +required
+	source *Directory,
+	// The image reference to push (ex: ghcr.io/adore-me/api:1.2.3)
+	// +required
+	ref string,
+	// Platforms of the manifest list
+	// +optional
+	// +default=["linux/amd64", "linux/arm64"]
+	platforms []string,
+	// Path of the Dockerfile, relative to the build context
+	// +optional
+	// +default="Dockerfile"
+	dockerfile string,
+	// Target build stage
+	// +optional
+	target string,
+	// Build arguments (ex: VERSION=1.2.3)
+	// +optional
+	buildArgs []string,
+	// Build secrets, available to RUN --mount=type=secret,id=<secretId>
+	// +optional
+	secrets []*Secret,
+	// IDs of the build secrets, in the same order as secrets
+	// +optional
+	secretIds []string,
+	// SSH agent socket, available to RUN --mount=type=ssh
+	// +optional
+	ssh *Socket,
+	// Key of the layer cache volumes, builds sharing a key share their cache
+	// +optional
+	// +default="default"
+	cacheKey string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "PublishMultiArch")
+	defer s.End(&err)
+
+	if len(platforms) == 0 {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("at least one platform is required"),
+			Hint: "set at least one platform, ex: linux/amd64",
+		}
+	}
+
+	variants := make([]*Container, 0, len(platforms))
+	for _, platform := range platforms {
+		image, err := m.Build(ctx, source, dockerfile, target, buildArgs, secrets, secretIds, ssh, cacheKey, platform)
+		if err != nil {
+			return "", fmt.Errorf("failed to build %s: %w", platform, err)
+		}
+		variants = append(variants, image)
+	}
+
+	publisher := dag.Container()
+	if m.Password != nil {
+		publisher = publisher.WithRegistryAuth(registryauth.Host(ref), m.Username, m.Password)
+	}
+
+	digest, err := publisher.Publish(ctx, ref, ContainerPublishOpts{PlatformVariants: variants})
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s: %w", ref, commandError(err))
+	}
+
+	return digest, nil
+}
+
+// buildctl returns the container running the build with a daemonless BuildKit.
+// The image is pushed to ref when set, and exported to /tmp/image.tar otherwise.
+func (m *DockerBuild) buildctl(ctx context.Context, opts buildOpts, ref string) (*Container, error) {
+	if len(opts.secrets) != len(opts.secretIds) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("got %d secrets for %d secret ids", len(opts.secrets), len(opts.secretIds)),
+			Hint: "pass one secret per secret id",
+		}
+	}
+
+	// Each platform runs BuildKit on that platform, and keeps its own cache
+	cache := "docker-build-" + opts.cacheKey
+	if opts.platform != "" {
+		cache += "-" + strings.ReplaceAll(opts.platform, "/", "-")
+	}
+
+	c := m.withProxy(dag.Container(ContainerOpts{Platform: Platform(opts.platform)}).From("moby/buildkit:"+m.BuildkitVersion)).
+		WithDirectory("/workspace", opts.source).
+		WithMountedCache("/cache", dag.CacheVolume(cache))
+
+	output := "type=oci,dest=/tmp/image.tar"
+	if ref != "" {
+		output = "type=image,name=" + ref + ",push=true"
+		if m.Password != nil {
+			config, err := dockerConfig(ctx, registryauth.Host(ref), m.Username, m.Password)
+			if err != nil {
+				return nil, err
+			}
+			c = c.WithMountedSecret("/root/.docker/config.json", config)
+		}
+		// Pushes must always hit the registry
+		c = c.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	}
+
+	args := []string{
+		"buildctl-daemonless.sh", "build",
+		"--frontend", "dockerfile.v0",
+		"--local", "context=/workspace",
+		"--local", "dockerfile=" + path.Join("/workspace", path.Dir(opts.dockerfile)),
+		"--opt", "filename=" + path.Base(opts.dockerfile),
+		"--import-cache", "type=local,src=/cache",
+		"--export-cache", "type=local,dest=/cache,mode=max",
+		"--output", output,
+		"--metadata-file", "/tmp/metadata.json",
+	}
+	if opts.target != "" {
+		args = append(args, "--opt", "target="+opts.target)
+	}
+	for _, arg := range opts.buildArgs {
+		args = append(args, "--opt", "build-arg:"+arg)
+	}
+	for i, s := range opts.secrets {
+		c = c.WithMountedSecret("/run/build-secrets/"+opts.secretIds[i], s)
+		args = append(args, "--secret", fmt.Sprintf("id=%s,src=/run/build-secrets/%s", opts.secretIds[i], opts.secretIds[i]))
+	}
+	if opts.ssh != nil {
+		c = c.WithUnixSocket("/tmp/ssh-agent.sock", opts.ssh)
+		args = append(args, "--ssh", "default=/tmp/ssh-agent.sock")
+	}
+
+	return c.WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true, InsecureRootCapabilities: true}), nil
+}
+
+// dockerConfig returns a docker config.json authenticating against the registry
+func dockerConfig(ctx context.Context, registry, username string, password *Secret) (*Secret, error) {
+	config, err := registryauth.DockerConfig(ctx, registryauth.Auth{Registry: registry, Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret("docker-config-"+registry, config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *DockerBuild) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
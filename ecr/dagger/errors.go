@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the aws commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"invalidparameterexception", "lifecyclepolicynotfoundexception", "repositorynotfoundexception"},
+	AuthHint:       "check the AWS credentials and their ECR permissions",
+	ValidationHint: "check the repository name and the lifecycle policy",
+}
+
+// commandError types the error of an aws command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,329 @@
+// This module logs in to AWS ECR, ensures repositories exist, pushes images and applies lifecycle policies.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type Ecr struct {
+	// The AWS region of the registry (ex: eu-west-1)
+	// +private
+	Region string
+	// Access key ID of static credentials
+	// +private
+	AccessKeyID *Secret
+	// Secret access key of static credentials
+	// +private
+	SecretAccessKey *Secret
+	// Session token of temporary credentials
+	// +private
+	SessionToken *Secret
+	// Role assumed with the web identity token (IRSA, CI OIDC)
+	// +private
+	RoleArn string
+	// Web identity token exchanged for the role credentials
+	// +private
+	WebIdentityToken *Secret
+	// The version of the aws CLI image (ex: 2.15.30)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Ecr module authenticated with static credentials or a web identity token (IRSA, CI OIDC)
+func New(
+	// The AWS region of the registry
+	// +required
+	region string,
+	// Access key ID of static credentials
+	// +optional
+	accessKeyId *Secret,
+	// Secret access key of static credentials
+	// +optional
+	secretAccessKey *Secret,
+	// Session token of temporary credentials
+	// +optional
+	sessionToken *Secret,
+	// Role assumed with the web identity token
+	// +optional
+	roleArn string,
+	// Web identity token exchanged for the role credentials (ex: the projected service account token of IRSA)
+	// +optional
+	webIdentityToken *Secret,
+	// The version of the aws CLI image
+	// +optional
+	// +default="2.15.30"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Ecr, error) {
+	if (accessKeyId == nil || secretAccessKey == nil) && (roleArn == "" || webIdentityToken == nil) {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("either accessKeyId and secretAccessKey, or roleArn and webIdentityToken are required"),
+			Hint: "set accessKeyId and secretAccessKey, or roleArn and webIdentityToken",
+		}
+	}
+
+	return &Ecr{
+		Region:           region,
+		AccessKeyID:      accessKeyId,
+		SecretAccessKey:  secretAccessKey,
+		SessionToken:     sessionToken,
+		RoleArn:          roleArn,
+		WebIdentityToken: webIdentityToken,
+		Version:          version,
+		ProxyURL:         proxyUrl,
+		NoProxy:          noProxy,
+		CABundle:         caBundle,
+		OtlpEndpoint:     otlpEndpoint,
+		OtlpHeaders:      otlpHeaders,
+		Traceparent:      traceparent,
+	}, nil
+}
+
+// aws returns an aws CLI container with the credentials.
+// The registry state changes outside of Dagger, so commands are never cached.
+func (m *Ecr) aws() *Container {
+	c := m.withProxy(dag.Container().From("amazon/aws-cli:"+m.Version)).
+		WithEnvVariable("AWS_REGION", m.Region).
+		WithEnvVariable("AWS_PAGER", "").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	if m.AccessKeyID != nil && m.SecretAccessKey != nil {
+		c = c.
+			WithSecretVariable("AWS_ACCESS_KEY_ID", m.AccessKeyID).
+			WithSecretVariable("AWS_SECRET_ACCESS_KEY", m.SecretAccessKey)
+		if m.SessionToken != nil {
+			c = c.WithSecretVariable("AWS_SESSION_TOKEN", m.SessionToken)
+		}
+		return c
+	}
+
+	return c.
+		WithEnvVariable("AWS_ROLE_ARN", m.RoleArn).
+		WithEnvVariable("AWS_ROLE_SESSION_NAME", "dagger").
+		WithMountedSecret("/tmp/web-identity-token", m.WebIdentityToken).
+		WithEnvVariable("AWS_WEB_IDENTITY_TOKEN_FILE", "/tmp/web-identity-token")
+}
+
+// Registry returns the registry host of the account (ex: 123456789012.dkr.ecr.eu-west-1.amazonaws.com)
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY registry
+func (m *Ecr) Registry(ctx context.Context) (out string, err error) {
+	s := m.startSpan(ctx, "Registry")
+	defer s.End(&err)
+
+	account, err := m.aws().
+		WithExec([]string{
+			"aws", "sts", "get-caller-identity", "--query", "Account", "--output", "text",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get aws account: %w", commandError(err))
+	}
+
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", strings.TrimSpace(account), m.Region), nil
+}
+
+// Password returns the ECR auth token (aws ecr get-login-password), valid 12 hours for the AWS user
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY password plaintext | docker login --username AWS --password-stdin $REGISTRY
+func (m *Ecr) Password(ctx context.Context) (result *Secret, err error) {
+	s := m.startSpan(ctx, "Password")
+	defer s.End(&err)
+
+	password, err := m.aws().
+		WithExec([]string{"aws", "ecr", "get-login-password"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ecr login password: %w", commandError(err))
+	}
+
+	return dag.SetSecret("ecr-password-"+m.Region, strings.TrimSpace(password)), nil
+}
+
+// EnsureRepository creates the repository when it does not exist, and returns its URI
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY ensure-repository --repository=shop/api
+func (m *Ecr) EnsureRepository(
+	ctx context.Context,
+	// Name of the repository
+	// +required
+	repository string,
+	// Prevent tags from being overwritten
+	// +optional
+	immutableTags bool,
+	// Scan the images on push
+	// +optional
+	// +default=true
+	scanOnPush bool,
+) (out string, err error) {
+	s := m.startSpan(ctx, "EnsureRepository")
+	defer s.End(&err)
+
+	mutability := "MUTABLE"
+	if immutableTags {
+		mutability = "IMMUTABLE"
+	}
+
+	uri, err := m.aws().
+		WithExec([]string{"sh", "-c", `
+aws ecr describe-repositories --repository-names "$1" --query 'repositories[0].repositoryUri' --output text 2>/dev/null ||
+aws ecr create-repository --repository-name "$1" --image-tag-mutability "$2" \
+  --image-scanning-configuration "scanOnPush=$3" --query 'repository.repositoryUri' --output text`,
+			"sh", repository, mutability, fmt.Sprint(scanOnPush),
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to ensure repository %s: %w", repository, commandError(err))
+	}
+
+	return strings.TrimSpace(uri), nil
+}
+
+// Push publishes the container to the repository, creating the repository first when requested, and returns the image reference with its digest
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY push --container=$(dagger call build) --repository=shop/api --tag=1.2.3
+func (m *Ecr) Push(
+	ctx context.Context,
+	// The container to publish
+	// +required
+	container *Container,
+	// Name of the repository
+	// +required
+	repository string,
+	// Tag of the image
+	// +required
+	tag string,
+	// Create the repository when it does not exist
+	// +optional
+	// +default=true
+	createRepository bool,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Push")
+	defer s.End(&err)
+
+	registry, err := m.Registry(ctx)
+	if err != nil {
+		return "", err
+	}
+	if createRepository {
+		if _, err := m.EnsureRepository(ctx, repository, false, true); err != nil {
+			return "", err
+		}
+	}
+	password, err := m.Password(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := container.
+		WithRegistryAuth(registry, "AWS", password).
+		Publish(ctx, fmt.Sprintf("%s/%s:%s", registry, repository, tag))
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s:%s: %w", repository, tag, commandError(err))
+	}
+
+	return ref, nil
+}
+
+// PutLifecyclePolicy applies a lifecycle policy (JSON) to the repository, or the default policy when none is provided:
+// untagged images expire after untaggedDays and only the last keepLast images are kept.
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY put-lifecycle-policy --repository=shop/api --keep-last=50
+func (m *Ecr) PutLifecyclePolicy(
+	ctx context.Context,
+	// Name of the repository
+	// +required
+	repository string,
+	// The lifecycle policy, overriding the default policy
+	// +optional
+	policy *File,
+	// Number of days after which untagged images expire, in the default policy
+	// +optional
+	// +default=7
+	untaggedDays int,
+	// Number of images kept, in the default policy
+	// +optional
+	// +default=100
+	keepLast int,
+) (result string, err error) {
+	s := m.startSpan(ctx, "PutLifecyclePolicy")
+	defer s.End(&err)
+
+	if policy == nil {
+		policy = dag.Directory().WithNewFile("policy.json", fmt.Sprintf(`{
+  "rules": [
+    {
+      "rulePriority": 1,
+      "description": "Expire untagged images after %[1]d days",
+      "selection": {"tagStatus": "untagged", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": %[1]d},
+      "action": {"type": "expire"}
+    },
+    {
+      "rulePriority": 2,
+      "description": "Keep the last %[2]d images",
+      "selection": {"tagStatus": "any", "countType": "imageCountMoreThan", "countNumber": %[2]d},
+      "action": {"type": "expire"}
+    }
+  ]
+}`, untaggedDays, keepLast)).File("policy.json")
+	}
+
+	out, err := m.aws().
+		WithMountedFile("/tmp/policy.json", policy).
+		WithExec([]string{
+			"aws", "ecr", "put-lifecycle-policy", "--repository-name", repository,
+			"--lifecycle-policy-text", "file:///tmp/policy.json",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to put lifecycle policy of %s: %w", repository, commandError(err))
+	}
+
+	return out, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Ecr) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,273 @@
+// This module boots an ephemeral k3s cluster as a Dagger service, loads images into it, applies manifests and runs e2e tests against it.
+//
+// k3s runs directly as a service, kind is not supported as it needs a Docker daemon.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EphemeralCluster struct {
+	// The version of k3s (ex: v1.29.3-k3s1)
+	// +private
+	K3sVersion string
+	// The version of the kubectl image (ex: 1.29)
+	// +private
+	KubectlVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new EphemeralCluster module pinned to the provided k3s version
+func New(
+	// The version of k3s, i.e. of Kubernetes
+	// +optional
+	// +default="v1.29.3-k3s1"
+	k3sVersion string,
+	// The version of the kubectl image
+	// +optional
+	// +default="1.29"
+	kubectlVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *EphemeralCluster {
+	return &EphemeralCluster{
+		K3sVersion:     k3sVersion,
+		KubectlVersion: kubectlVersion,
+		ProxyURL:       proxyUrl,
+		NoProxy:        noProxy,
+		CABundle:       caBundle,
+		OtlpEndpoint:   otlpEndpoint,
+		OtlpHeaders:    otlpHeaders,
+		Traceparent:    traceparent,
+	}
+}
+
+type E2EResult struct {
+	// Whether the test suite passed
+	Passed bool
+	// Test suite output
+	Output string
+	// Cluster state and pod logs (kubectl cluster-info dump), only collected when the test suite failed
+	Logs *Directory
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// Test boots a cluster with the images loaded, applies the manifests, waits for the deployments to be available and runs the test suite.
+// The test container reaches the API server with the kubeconfig mounted at /tmp/kubeconfig (KUBECONFIG is set).
+//
+// Example usage: dagger call test --manifests=./deploy --images=$(dagger call build) --image-names=shop/api:e2e --tests=$(dagger call e2e-runner) --test-command="go,test,./e2e/..." logs export --path=e2e-logs
+func (m *EphemeralCluster) Test(
+	ctx context.Context,
+	// Manifests applied to the cluster, searched recursively
+	// +required
+	manifests *Directory,
+	// Container running the test suite
+	// +required
+	tests *Container,
+	// Command running the test suite in the tests container
+	// +required
+	testCommand []string,
+	// Images loaded into the cluster, ex: the images built by the pipeline
+	// +optional
+	images []*Container,
+	// Names of the loaded images, in the same order as images (ex: shop/api:e2e). Pods must not use imagePullPolicy: Always
+	// +optional
+	imageNames []string,
+	// Maximum duration to wait for the deployments to be available
+	// +optional
+	// +default="5m"
+	waitTimeout string,
+) (e2EResult *E2EResult, err error) {
+	s := m.startSpan(ctx, "Test")
+	defer s.End(&err)
+
+	if len(images) != len(imageNames) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("got %d images for %d image names", len(images), len(imageNames)),
+			Hint: "pass one name per image",
+		}
+	}
+
+	// A dedicated volume shares the kubeconfig of this cluster only, once the images are loaded
+	config := dag.CacheVolume(fmt.Sprintf("ephemeral-cluster-%d", time.Now().UnixNano()))
+	server := m.server(config, images, imageNames)
+
+	kubectl := m.withProxy(dag.Container().From("bitnami/kubectl:"+m.KubectlVersion), "k3s").
+		WithUser("root").
+		WithServiceBinding("k3s", server).
+		WithMountedCache("/cluster", config).
+		WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+		WithExec([]string{"sh", "-c", `
+until [ -f /cluster/k3s.yaml ]; do sleep 1; done
+sed 's#https://127.0.0.1:6443#https://k3s:6443#' /cluster/k3s.yaml > /tmp/kubeconfig
+until kubectl wait --for=condition=Ready nodes --all --timeout=10s; do sleep 2; done`,
+		}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	_, err = kubectl.
+		WithDirectory("/manifests", manifests).
+		WithExec([]string{"kubectl", "apply", "--recursive", "--filename", "/manifests"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec([]string{
+			"kubectl", "wait", "--for=condition=Available", "deployments", "--all", "--all-namespaces", "--timeout", waitTimeout,
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deploy the manifests: %w", commandError(err))
+	}
+
+	// Failing tests are reported, not returned as an error
+	c := tests.
+		WithServiceBinding("k3s", server).
+		WithFile("/tmp/kubeconfig", kubectl.File("/tmp/kubeconfig")).
+		WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+		WithExec(
+			append([]string{"sh", "-c", `"$@" > /tmp/e2e-output.log 2>&1; echo $? > /tmp/e2e-exit-code`, "sh"}, testCommand...),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	exitCode, err := c.File("/tmp/e2e-exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test exit code: %w", commandError(err))
+	}
+	output, err := c.File("/tmp/e2e-output.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test output: %w", commandError(err))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected test exit code %q", exitCode)
+	}
+
+	result := &E2EResult{
+		Passed:       code == 0,
+		Output:       output,
+		Logs:         dag.Directory(),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	if !result.Passed {
+		result.Logs = kubectl.
+			WithExec([]string{
+				"kubectl", "cluster-info", "dump", "--all-namespaces", "--output-directory", "/tmp/logs",
+			}, ContainerWithExecOpts{SkipEntrypoint: true}).
+			Directory("/tmp/logs")
+	}
+
+	return result, nil
+}
+
+// Check fails when the test suite failed, and returns its output otherwise
+func (r *E2EResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("e2e tests failed:\n%s", r.Output), Hint: "fix the failing e2e tests"}
+	}
+
+	return r.Output, nil
+}
+
+// server returns the k3s server service. The images are imported into containerd before the kubeconfig is published to config,
+// so that clients only start once the images are available.
+func (m *EphemeralCluster) server(config *CacheVolume, images []*Container, imageNames []string) *Service {
+	c := m.withProxy(dag.Container().From("rancher/k3s:"+m.K3sVersion)).
+		WithMountedCache("/cluster", config).
+		WithMountedTemp("/var/lib/kubelet").
+		WithMountedTemp("/var/lib/rancher/k3s").
+		WithMountedTemp("/var/lib/cni").
+		WithMountedTemp("/var/log").
+		WithEntrypoint([]string{})
+
+	for i, image := range images {
+		c = c.
+			WithFile(fmt.Sprintf("/images/%d.tar", i), image.AsTarball()).
+			WithNewFile(fmt.Sprintf("/images/%d.name", i), ContainerWithNewFileOpts{Contents: normalizeImageName(imageNames[i])})
+	}
+
+	return c.
+		WithExposedPort(6443).
+		WithExec([]string{"sh", "-c", `
+rm -f /cluster/k3s.yaml
+k3s server --tls-san=k3s --disable=traefik --disable=metrics-server --write-kubeconfig=/tmp/k3s.yaml &
+pid=$!
+for tar in /images/*.tar; do
+  [ -f "$tar" ] || continue
+  until k3s ctr version >/dev/null 2>&1; do sleep 1; done
+  k3s ctr images import --index-name "$(cat "${tar%.tar}.name")" "$tar"
+done
+until [ -f /tmp/k3s.yaml ]; do sleep 1; done
+cp /tmp/k3s.yaml /cluster/k3s.yaml
+wait $pid`,
+		}, ContainerWithExecOpts{InsecureRootCapabilities: true}).
+		AsService()
+}
+
+// normalizeImageName returns the fully qualified name the kubelet resolves an image name to (ex: shop/api:e2e to docker.io/shop/api:e2e)
+func normalizeImageName(name string) string {
+	host, _, found := strings.Cut(name, "/")
+	if !found {
+		return "docker.io/library/" + name
+	}
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "docker.io/" + name
+	}
+
+	return name
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls, the services bound to it
+// are reached without the proxy
+func (m *EphemeralCluster) withProxy(c *Container, services ...string) *Container {
+	noProxy := m.NoProxy
+	for _, service := range services {
+		noProxy = strings.TrimPrefix(noProxy+","+service, ",")
+	}
+
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: noProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,258 @@
+// This module handles the version management of external-dns and external-secrets-operator.
+//
+// Both charts are bumped together every month: the module finds their HelmReleases in the cluster
+// folders, resolves the latest chart release of each component within its own constraint and
+// rewrites every pinned version.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// component describes where the chart releases of a component are published
+type component struct {
+	Name       string
+	Owner      string
+	Repo       string
+	TagPrefix  string
+	Pattern    string
+	Constraint string
+}
+
+type ExternalDnsSecrets struct {
+	// +private
+	Clusters *Directory
+	// +private
+	ExternalDNSPattern string
+	// +private
+	ExternalDNSConstraint string
+	// +private
+	ExternalSecretsPattern string
+	// +private
+	ExternalSecretsConstraint string
+	// +private
+	Key string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new ExternalDnsSecrets module tracking the external-dns and external-secrets HelmReleases of the cluster folders
+//
+// Example usage: dagger call --clusters=clusters --external-secrets-constraint="<1" report export --path=report.json
+func New(
+	// Directory holding the cluster folders
+	// +required
+	clusters *Directory,
+	// Glob pattern of the external-dns HelmReleases, relative to clusters
+	// +optional
+	// +default="**/external-dns/helmrelease.yaml"
+	externalDnsPattern string,
+	// Semver constraint the latest external-dns chart version must satisfy (ex: "~1.14")
+	// +optional
+	externalDnsConstraint string,
+	// Glob pattern of the external-secrets HelmReleases, relative to clusters
+	// +optional
+	// +default="**/external-secrets/helmrelease.yaml"
+	externalSecretsPattern string,
+	// Semver constraint the latest external-secrets chart version must satisfy (ex: "~0.9")
+	// +optional
+	externalSecretsConstraint string,
+	// Dot separated path of the chart version field in the HelmReleases
+	// +optional
+	// +default="spec.chart.spec.version"
+	key string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *ExternalDnsSecrets {
+	return &ExternalDnsSecrets{
+		Clusters:                  clusters,
+		ExternalDNSPattern:        externalDnsPattern,
+		ExternalDNSConstraint:     externalDnsConstraint,
+		ExternalSecretsPattern:    externalSecretsPattern,
+		ExternalSecretsConstraint: externalSecretsConstraint,
+		Key:                       key,
+		ProxyURL:                  proxyUrl,
+		NoProxy:                   noProxy,
+		CABundle:                  caBundle,
+		CacheTTL:                  cacheTtl,
+		OtlpEndpoint:              otlpEndpoint,
+		OtlpHeaders:               otlpHeaders,
+		Traceparent:               traceparent,
+	}
+}
+
+type PinnedVersion struct {
+	Component      string `json:"component"`
+	Manifest       string `json:"manifest"`
+	CurrentVersion string `json:"currentVersion"`
+	LatestVersion  string `json:"latestVersion"`
+	UpdateNeeded   bool   `json:"updateNeeded"`
+	Constraint     string `json:"constraint"`
+}
+
+// components returns the tracked components with their manifest pattern and constraint
+func (m *ExternalDnsSecrets) components() []component {
+	return []component{
+		{
+			Name:       "external-dns",
+			Owner:      "kubernetes-sigs",
+			Repo:       "external-dns",
+			TagPrefix:  "external-dns-helm-chart-",
+			Pattern:    m.ExternalDNSPattern,
+			Constraint: m.ExternalDNSConstraint,
+		},
+		{
+			Name:       "external-secrets",
+			Owner:      "external-secrets",
+			Repo:       "external-secrets",
+			TagPrefix:  "helm-chart-",
+			Pattern:    m.ExternalSecretsPattern,
+			Constraint: m.ExternalSecretsConstraint,
+		},
+	}
+}
+
+// bumper returns the version-bumper tracking the chart releases of the component against the manifest
+func (m *ExternalDnsSecrets) bumper(c component, manifest string) *VersionBumper {
+	return dag.VersionBumper(c.Owner, c.Repo, m.Clusters.File(manifest), VersionBumperOpts{
+		Key:        m.Key,
+		TagPrefix:  c.TagPrefix,
+		Constraint: c.Constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// PinnedVersions Return the version pinned in every HelmRelease along with the latest version of its component
+//
+// Example usage: dagger call --clusters=clusters pinned-versions
+func (m *ExternalDnsSecrets) PinnedVersions(ctx context.Context) (pinnedVersions []*PinnedVersion, err error) {
+	s := m.startSpan(ctx, "PinnedVersions")
+	defer s.End(&err)
+
+	versions := []*PinnedVersion{}
+	for _, c := range m.components() {
+		manifests, err := m.Clusters.Glob(ctx, c.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find %s manifests: %w", c.Name, err)
+		}
+
+		for _, manifest := range manifests {
+			b := m.bumper(c, manifest)
+			v := &PinnedVersion{Component: c.Name, Manifest: manifest, Constraint: c.Constraint}
+			if v.CurrentVersion, err = b.LocalVersion(ctx); err != nil {
+				return nil, fmt.Errorf("failed to get local version of %s: %w", manifest, err)
+			}
+			if v.LatestVersion, err = b.LatestVersion(ctx); err != nil {
+				return nil, fmt.Errorf("failed to get latest version of %s: %w", c.Name, err)
+			}
+			if v.UpdateNeeded, err = b.IsNewerVersion(ctx); err != nil {
+				return nil, fmt.Errorf("failed to check if newer version of %s: %w", c.Name, err)
+			}
+			versions = append(versions, v)
+		}
+	}
+
+	return versions, nil
+}
+
+// IsNewerVersion Check if any HelmRelease pins an older version than the latest version of its component
+//
+// Example usage: dagger call --clusters=clusters is-newer-version
+func (m *ExternalDnsSecrets) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	versions, err := m.PinnedVersions(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range versions {
+		if v.UpdateNeeded {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// UpdatedClusters Return the cluster folders with every outdated HelmRelease set to the latest version of its component
+//
+// Example usage: dagger call --clusters=clusters updated-clusters export --path=clusters
+func (m *ExternalDnsSecrets) UpdatedClusters(ctx context.Context) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "UpdatedClusters")
+	defer s.End(&err)
+
+	versions, err := m.PinnedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := m.Clusters
+	for _, c := range m.components() {
+		for _, v := range versions {
+			if v.Component == c.Name && v.UpdateNeeded {
+				clusters = clusters.WithFile(v.Manifest, m.bumper(c, v.Manifest).UpdatedManifest())
+			}
+		}
+	}
+
+	return clusters, nil
+}
+
+// Report Generate a JSON report listing the pinned and latest versions of both components in every cluster folder
+//
+// Example usage: dagger call --clusters=clusters report export --path=report.json
+func (m *ExternalDnsSecrets) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	versions, err := m.PinnedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
@@ -0,0 +1,260 @@
+// This module handles the version management of the Flux components installed in the clusters.
+//
+// It reads the Flux version from the header of gotk-components.yaml, tracks the flux2 releases with the
+// version-bumper module and regenerates the components manifest with the flux module at the latest version.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// versionHeader matches the Flux version written by flux install --export and flux bootstrap
+	versionHeader = regexp.MustCompile(`(?m)^# Flux Version: (\S+)`)
+	// componentsHeader matches the components written by flux install --export and flux bootstrap
+	componentsHeader = regexp.MustCompile(`(?m)^# Components: (\S+)`)
+	// defaultComponents are installed by flux install without --components-extra
+	defaultComponents = []string{"source-controller", "kustomize-controller", "helm-controller", "notification-controller"}
+)
+
+type FluxComponents struct {
+	LatestVersion string
+	LocalVersion  string
+	// Components listed in the manifest beyond the default ones (ex: image-reflector-controller)
+	ComponentsExtra []string
+	// +private
+	Manifest *File
+	// +private
+	Namespace string
+	// +private
+	Constraint string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new FluxComponents module comparing the latest flux2 release with the version of the components manifest
+//
+// Example usage: dagger call --manifest=clusters/dev/flux-system/gotk-components.yaml diff
+func New(
+	ctx context.Context,
+	// Components manifest generated by flux install --export or flux bootstrap (gotk-components.yaml)
+	// +required
+	manifest *File,
+	// Namespace the components are installed in
+	// +optional
+	// +default="flux-system"
+	namespace string,
+	// Semver constraint the latest version must satisfy (ex: "~2.2")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*FluxComponents, error) {
+	m := &FluxComponents{
+		Manifest:     manifest,
+		Namespace:    namespace,
+		Constraint:   constraint,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		CacheTTL:     cacheTtl,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+
+	content, err := manifest.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	match := versionHeader.FindStringSubmatch(content)
+	if match == nil {
+		return nil, fmt.Errorf("failed to find the Flux version header in the manifest")
+	}
+	m.LocalVersion = match[1]
+
+	if match := componentsHeader.FindStringSubmatch(content); match != nil {
+		for _, c := range strings.Split(match[1], ",") {
+			if !contains(defaultComponents, c) {
+				m.ComponentsExtra = append(m.ComponentsExtra, c)
+			}
+		}
+	}
+
+	if m.LatestVersion, err = m.bumper().LatestVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+
+	return m, nil
+}
+
+type UpdateReport struct {
+	CurrentVersion  string   `json:"currentVersion"`
+	LatestVersion   string   `json:"latestVersion"`
+	UpdateNeeded    bool     `json:"updateNeeded"`
+	Constraint      string   `json:"constraint"`
+	ComponentsExtra []string `json:"componentsExtra"`
+	// Unified diff between the current and the regenerated components manifest
+	Diff string `json:"diff"`
+}
+
+// bumper returns the version-bumper tracking the flux2 releases.
+// The version lives in a comment of the components manifest, so it is handed over as a ConfigMap like manifest.
+func (m *FluxComponents) bumper() *VersionBumper {
+	manifest := dag.Directory().
+		WithNewFile("flux-version.yaml", fmt.Sprintf("data:\n  version: %q\n", m.LocalVersion)).
+		File("flux-version.yaml")
+
+	return dag.VersionBumper("fluxcd", "flux2", manifest, VersionBumperOpts{
+		Constraint: m.Constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// IsNewerVersion Check if the latest version is newer than the version of the components manifest
+//
+// Example usage: dagger call --manifest=clusters/dev/flux-system/gotk-components.yaml is-newer-version
+func (m *FluxComponents) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	return m.bumper().IsNewerVersion(ctx)
+}
+
+// UpdatedManifest Return the components manifest regenerated with flux install --export at the latest version
+//
+// Example usage: dagger call --manifest=clusters/dev/flux-system/gotk-components.yaml updated-manifest export --path=clusters/dev/flux-system/gotk-components.yaml
+func (m *FluxComponents) UpdatedManifest(ctx context.Context) *File {
+	s := m.startSpan(ctx, "UpdatedManifest")
+	defer s.End(nil)
+
+	return dag.Flux(FluxOpts{Version: m.LatestVersion, ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).Install(FluxInstallOpts{
+		ComponentsExtra: m.ComponentsExtra,
+		Namespace:       m.Namespace,
+	})
+}
+
+// Diff Return the unified diff between the current and the regenerated components manifest, empty when up to date
+//
+// Example usage: dagger call --manifest=clusters/dev/flux-system/gotk-components.yaml diff
+func (m *FluxComponents) Diff(ctx context.Context) (out string, err error) {
+	s := m.startSpan(ctx, "Diff")
+	defer s.End(&err)
+
+	// diff exits with 1 when the files differ and above 1 on errors
+	c := dag.Container().
+		From("alpine:3.19").
+		WithFile("/tmp/current/gotk-components.yaml", m.Manifest).
+		WithFile("/tmp/updated/gotk-components.yaml", m.UpdatedManifest(ctx)).
+		WithWorkdir("/tmp").
+		WithExec(
+			[]string{"sh", "-c", "diff -u current/gotk-components.yaml updated/gotk-components.yaml > /tmp/diff 2> /tmp/stderr; echo $? > /tmp/exit-code"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read diff exit code: %w", commandError(err))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return "", fmt.Errorf("unexpected diff exit code %q", exitCode)
+	}
+	if code > 1 {
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return "", commandFailures.Type(fmt.Errorf("diff failed: %s", strings.TrimSpace(stderr)), stderr)
+	}
+
+	diff, err := c.File("/tmp/diff").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read diff: %w", commandError(err))
+	}
+
+	return diff, nil
+}
+
+// Report Generate a JSON report describing the pending Flux update and the resulting components manifest diff
+//
+// Example usage: dagger call --manifest=clusters/dev/flux-system/gotk-components.yaml report export --path=report.json
+func (m *FluxComponents) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	updateNeeded, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+
+	diff := ""
+	if updateNeeded {
+		if diff, err = m.Diff(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := json.MarshalIndent(&UpdateReport{
+		CurrentVersion:  m.LocalVersion,
+		LatestVersion:   m.LatestVersion,
+		UpdateNeeded:    updateNeeded,
+		Constraint:      m.Constraint,
+		ComponentsExtra: m.ComponentsExtra,
+		Diff:            diff,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
+
+// contains Check if the list contains the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the flux commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"kustomization path not found", "no such file or directory"},
+	AuthHint:       "check the kubeconfig of the cluster and its permissions",
+	ValidationHint: "check the kustomization path and the manifests",
+}
+
+// commandError types the error of a flux command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,208 @@
+// This module wraps the Flux CLI to render, build and reconcile GitOps resources.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Flux struct {
+	// The version of the Flux CLI (ex: v2.2.3)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Flux module pinned to the provided Flux version
+func New(
+	// The version of the Flux CLI, which is also the version of the installed components
+	// +optional
+	// +default="v2.2.3"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Flux {
+	return &Flux{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// base returns a container with the pinned Flux CLI
+func (m *Flux) base() *Container {
+	return m.withProxy(dag.Container().From("ghcr.io/fluxcd/flux-cli:" + m.Version)).
+		WithWorkdir("/workspace")
+}
+
+// withKubeconfig mounts the kubeconfig and disables caching, as the cluster state changes outside of Dagger
+func withKubeconfig(kubeconfig *Secret) WithContainerFunc {
+	return func(c *Container) *Container {
+		return c.
+			WithMountedSecret("/tmp/kubeconfig", kubeconfig).
+			WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+			WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	}
+}
+
+// Install renders the Flux components manifests (flux install --export) for the pinned version.
+//
+// Example usage: dagger call --version=v2.2.3 install export --path=clusters/dev/flux-system/gotk-components.yaml
+func (m *Flux) Install(
+	ctx context.Context,
+	// Extra components to install (ex: image-reflector-controller,image-automation-controller)
+	// +optional
+	componentsExtra []string,
+	// Namespace the components are installed in
+	// +optional
+	// +default="flux-system"
+	namespace string,
+) *File {
+	s := m.startSpan(ctx, "Install")
+	defer s.End(nil)
+
+	args := []string{"flux", "install", "--export", "--namespace", namespace}
+	if len(componentsExtra) > 0 {
+		args = append(args, "--components-extra", strings.Join(componentsExtra, ","))
+	}
+
+	return m.base().
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true, RedirectStdout: "/workspace/gotk-components.yaml"}).
+		File("/workspace/gotk-components.yaml")
+}
+
+// Build renders a Flux Kustomization offline (flux build kustomization --dry-run) and returns the resulting manifests.
+//
+// Example usage: dagger call build --source=. --name=apps --path=./clusters/dev/apps --kustomization-file=./clusters/dev/apps.yaml export --path=apps.yaml
+func (m *Flux) Build(
+	ctx context.Context,
+	// Directory containing the Kustomization sources, usually the repository root
+	// +required
+	source *Directory,
+	// Name of the Flux Kustomization
+	// +required
+	name string,
+	// Path of the kustomize overlay, relative to source
+	// +required
+	path string,
+	// Flux Kustomization manifest, relative to source, providing the build options (substitutions, patches). The dry
+	// run reads them from it instead of the cluster.
+	// +required
+	kustomizationFile string,
+	// Namespace of the Flux Kustomization
+	// +optional
+	// +default="flux-system"
+	namespace string,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Build")
+	defer s.End(&err)
+
+	args := []string{
+		"flux", "build", "kustomization", name, "--namespace", namespace, "--path", path,
+		"--kustomization-file", kustomizationFile, "--dry-run",
+	}
+
+	f := m.base().
+		WithDirectory("/workspace", source).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true, RedirectStdout: "/tmp/build.yaml"}).
+		File("/tmp/build.yaml")
+
+	if _, err := f.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to build kustomization %s: %w", name, commandError(err))
+	}
+
+	return f, nil
+}
+
+// Reconcile triggers the reconciliation of a Flux resource and waits for it to become ready.
+//
+// Example usage: dagger call reconcile --kubeconfig=file:$HOME/.kube/config --kind=kustomization --name=apps --with-source
+func (m *Flux) Reconcile(
+	ctx context.Context,
+	// Kubeconfig giving access to the cluster
+	// +required
+	kubeconfig *Secret,
+	// Kind of the Flux resource (ex: kustomization, helmrelease, source git)
+	// +required
+	kind string,
+	// Name of the Flux resource
+	// +required
+	name string,
+	// Namespace of the Flux resource
+	// +optional
+	// +default="flux-system"
+	namespace string,
+	// Reconcile the source of the resource first
+	// +optional
+	withSource bool,
+	// How long to wait for the resource to become ready
+	// +optional
+	// +default="5m"
+	timeout string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Reconcile")
+	defer s.End(&err)
+
+	args := append([]string{"flux", "reconcile"}, strings.Fields(kind)...)
+	args = append(args, name, "--namespace", namespace, "--timeout", timeout)
+	if withSource {
+		args = append(args, "--with-source")
+	}
+
+	out, err := m.base().
+		With(withKubeconfig(kubeconfig)).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		// The Flux CLI reports its progress on stderr
+		Stderr(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to reconcile %s %s: %w", kind, name, commandError(err))
+	}
+
+	return out, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Flux) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
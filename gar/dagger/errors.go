@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the gcloud commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"invalid_argument", "not_found"},
+	AuthHint:       "check the service account key and its Artifact Registry roles",
+	ValidationHint: "check the repository, the image and the tags",
+}
+
+// commandError types the error of a gcloud command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,380 @@
+// This module pushes images and Helm charts to GCP Artifact Registry, and lists and cleans up image tags.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Gar struct {
+	// The GCP project of the repositories
+	// +private
+	Project string
+	// The location of the repositories (ex: europe-west1)
+	// +private
+	Location string
+	// Service account key or workload identity federation credential configuration
+	// +private
+	Credentials *Secret
+	// OIDC token referenced by the workload identity federation credential configuration
+	// +private
+	OidcToken *Secret
+	// The version of the gcloud CLI image (ex: 470.0.0)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Gar module authenticated with a service account key or a workload identity federation credential configuration
+func New(
+	// The GCP project of the repositories
+	// +required
+	project string,
+	// The location of the repositories
+	// +optional
+	// +default="europe-west1"
+	location string,
+	// Service account key, or workload identity federation credential configuration (external_account)
+	// +required
+	credentials *Secret,
+	// OIDC token of the workload identity federation, mounted at /tmp/oidc-token: set credential_source.file to this path in the credential configuration
+	// +optional
+	oidcToken *Secret,
+	// The version of the gcloud CLI image
+	// +optional
+	// +default="470.0.0"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Gar {
+	return &Gar{
+		Project:      project,
+		Location:     location,
+		Credentials:  credentials,
+		OidcToken:    oidcToken,
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type imageVersion struct {
+	Package    string `json:"package"`
+	Version    string `json:"version"`
+	Tags       any    `json:"tags"`
+	UpdateTime string `json:"updateTime"`
+}
+
+// gcloud returns an authenticated gcloud CLI container.
+// The registry state changes outside of Dagger, so commands are never cached.
+func (m *Gar) gcloud() *Container {
+	c := m.withProxy(dag.Container().From("gcr.io/google.com/cloudsdktool/google-cloud-cli:"+m.Version+"-alpine")).
+		WithMountedSecret("/tmp/credentials.json", m.Credentials).
+		WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", "/tmp/credentials.json").
+		WithEnvVariable("CLOUDSDK_CORE_PROJECT", m.Project).
+		WithEnvVariable("CLOUDSDK_CORE_DISABLE_PROMPTS", "1")
+
+	if m.OidcToken != nil {
+		c = c.WithMountedSecret("/tmp/oidc-token", m.OidcToken)
+	}
+
+	return c.
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"gcloud", "auth", "login", "--cred-file=/tmp/credentials.json"}, ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// Registry returns the Docker registry host of the location (ex: europe-west1-docker.pkg.dev)
+func (m *Gar) Registry(ctx context.Context) string {
+	s := m.startSpan(ctx, "Registry")
+	defer s.End(nil)
+
+	return m.registry()
+}
+
+// registry returns the Docker registry host of the location, for the other functions
+func (m *Gar) registry() string {
+	return m.Location + "-docker.pkg.dev"
+}
+
+// AccessToken returns a short lived access token, usable as the password of the oauth2accesstoken user
+//
+// Example usage: dagger call --project=shop-prod --credentials=file:./sa.json access-token plaintext | docker login --username oauth2accesstoken --password-stdin europe-west1-docker.pkg.dev
+func (m *Gar) AccessToken(ctx context.Context) (result *Secret, err error) {
+	s := m.startSpan(ctx, "AccessToken")
+	defer s.End(&err)
+
+	token, err := m.gcloud().
+		WithExec([]string{"gcloud", "auth", "print-access-token"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", commandError(err))
+	}
+
+	return dag.SetSecret("gar-access-token-"+m.Project, strings.TrimSpace(token)), nil
+}
+
+// Push publishes the container to the repository and returns the image reference with its digest
+//
+// Example usage: dagger call --project=shop-prod --credentials=file:./sa.json push --container=$(dagger call build) --repository=docker --image=api --tag=1.2.3
+func (m *Gar) Push(
+	ctx context.Context,
+	// The container to publish
+	// +required
+	container *Container,
+	// Name of the Artifact Registry repository
+	// +required
+	repository string,
+	// Name of the image in the repository
+	// +required
+	image string,
+	// Tag of the image
+	// +required
+	tag string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Push")
+	defer s.End(&err)
+
+	token, err := m.AccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := container.
+		WithRegistryAuth(m.registry(), "oauth2accesstoken", token).
+		Publish(ctx, fmt.Sprintf("%s:%s", m.imagePath(repository, image), tag))
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s:%s: %w", image, tag, commandError(err))
+	}
+
+	return ref, nil
+}
+
+// PushChart pushes a packaged Helm chart to the repository
+//
+// Example usage: dagger call --project=shop-prod --credentials=file:./sa.json push-chart --pkg=./api-1.2.3.tgz --repository=charts
+func (m *Gar) PushChart(
+	ctx context.Context,
+	// Chart archive created by helm package
+	// +required
+	pkg *File,
+	// Name of the Artifact Registry repository
+	// +required
+	repository string,
+	// The version of the helm image
+	// +optional
+	// +default="3.14.2"
+	helmVersion string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "PushChart")
+	defer s.End(&err)
+
+	token, err := m.AccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := m.withProxy(dag.Container().From("alpine/helm:"+helmVersion)).
+		WithFile("/tmp/chart.tgz", pkg).
+		WithSecretVariable("REGISTRY_PASSWORD", token).
+		// Pushes must always hit the registry
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(
+			[]string{"sh", "-c", strings.Join([]string{
+				"echo \"$REGISTRY_PASSWORD\" | helm registry login", m.registry(), "--username oauth2accesstoken --password-stdin",
+				"&&", "helm push /tmp/chart.tgz", "oci://" + m.registry() + "/" + m.Project + "/" + repository,
+			}, " ")},
+			ContainerWithExecOpts{SkipEntrypoint: true, RedirectStderr: "/tmp/push.log"},
+		).
+		File("/tmp/push.log").
+		Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to push chart: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// ListTags returns the tags of an image
+//
+// Example usage: dagger call --project=shop-prod --credentials=file:./sa.json list-tags --repository=docker --image=api
+func (m *Gar) ListTags(
+	ctx context.Context,
+	// Name of the Artifact Registry repository
+	// +required
+	repository string,
+	// Name of the image in the repository
+	// +required
+	image string,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "ListTags")
+	defer s.End(&err)
+
+	out, err := m.gcloud().
+		WithExec([]string{
+			"gcloud", "artifacts", "docker", "tags", "list", m.imagePath(repository, image), "--format=value(tag)",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags of %s: %w", image, commandError(err))
+	}
+
+	var tags []string
+	for _, line := range strings.Split(out, "\n") {
+		if tag := strings.TrimSpace(line); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// Cleanup deletes the versions of an image beyond the keepLast most recent ones, except the versions with a tag matching keepTags.
+// Returns the deleted versions, or the versions which would be deleted when dryRun is set.
+//
+// Example usage: dagger call --project=shop-prod --credentials=file:./sa.json cleanup --repository=docker --image=api --keep-last=30 --keep-tags='^v?[0-9]+\.[0-9]+\.[0-9]+$' --dry-run=false
+func (m *Gar) Cleanup(
+	ctx context.Context,
+	// Name of the Artifact Registry repository
+	// +required
+	repository string,
+	// Name of the image in the repository
+	// +required
+	image string,
+	// Number of most recent versions kept
+	// +optional
+	// +default=20
+	keepLast int,
+	// Regular expression of the tags never deleted (ex: release tags)
+	// +optional
+	keepTags string,
+	// Only list the versions which would be deleted
+	// +optional
+	// +default=true
+	dryRun bool,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "Cleanup")
+	defer s.End(&err)
+
+	var keep *regexp.Regexp
+	if keepTags != "" {
+		var err error
+		if keep, err = regexp.Compile(keepTags); err != nil {
+			return nil, fmt.Errorf("failed to parse keepTags: %w", err)
+		}
+	}
+
+	c := m.gcloud()
+	out, err := c.
+		WithExec([]string{
+			"gcloud", "artifacts", "docker", "images", "list", m.imagePath(repository, image),
+			"--include-tags", "--sort-by=~UPDATE_TIME", "--format=json",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of %s: %w", image, commandError(err))
+	}
+
+	var versions []imageVersion
+	if err := json.Unmarshal([]byte(out), &versions); err != nil {
+		return nil, fmt.Errorf("failed to parse versions of %s: %w", image, err)
+	}
+
+	var deleted []string
+	for i, img := range versions {
+		if i < keepLast || hasTag(img.Tags, keep) {
+			continue
+		}
+
+		ref := img.Package + "@" + img.Version
+		if !dryRun {
+			_, err := c.
+				WithExec([]string{
+					"gcloud", "artifacts", "docker", "images", "delete", ref, "--delete-tags", "--quiet",
+				}, ContainerWithExecOpts{SkipEntrypoint: true}).
+				Sync(ctx)
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete %s: %w", ref, commandError(err))
+			}
+		}
+		deleted = append(deleted, ref)
+	}
+
+	return deleted, nil
+}
+
+// imagePath returns the path of an image (ex: europe-west1-docker.pkg.dev/shop-prod/docker/api)
+func (m *Gar) imagePath(repository, image string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", m.registry(), m.Project, repository, image)
+}
+
+// hasTag returns whether one of the tags matches keep. gcloud returns tags either as a list or as a comma separated string.
+func hasTag(tags any, keep *regexp.Regexp) bool {
+	if keep == nil {
+		return false
+	}
+
+	var list []string
+	switch t := tags.(type) {
+	case string:
+		list = strings.Split(t, ",")
+	case []any:
+		for _, tag := range t {
+			list = append(list, fmt.Sprint(tag))
+		}
+	}
+	for _, tag := range list {
+		if tag = strings.TrimSpace(tag); tag != "" && keep.MatchString(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Gar) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
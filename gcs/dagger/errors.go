@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the gcloud storage commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"notfound", "no urls matched"},
+	AuthHint:       "check the service account key and its Storage roles",
+	ValidationHint: "check the bucket and the object paths",
+}
+
+// commandError types the error of a gcloud storage command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
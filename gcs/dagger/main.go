@@ -0,0 +1,222 @@
+// This module archives pipeline artifacts to Google Cloud Storage, downloads them back, and shares them with
+// time-limited signed URLs (ex: test or coverage reports linked from pull request comments).
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type Gcs struct {
+	// Service account key
+	// +private
+	Credentials *Secret
+	// The version of the gcloud CLI image (ex: 470.0.0)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Gcs module authenticated with a service account key
+func New(
+	// Service account key, whose private key also signs the URLs
+	// +required
+	credentials *Secret,
+	// The version of the gcloud CLI image
+	// +optional
+	// +default="470.0.0"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Gcs {
+	return &Gcs{
+		Credentials:  credentials,
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// gcloud returns an authenticated gcloud CLI container.
+// The buckets change outside of Dagger, so commands are never cached.
+func (m *Gcs) gcloud() *Container {
+	return m.withProxy(dag.Container().From("gcr.io/google.com/cloudsdktool/google-cloud-cli:"+m.Version+"-alpine")).
+		WithMountedSecret("/tmp/credentials.json", m.Credentials).
+		WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", "/tmp/credentials.json").
+		WithEnvVariable("CLOUDSDK_CORE_DISABLE_PROMPTS", "1").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"gcloud", "auth", "login", "--cred-file=/tmp/credentials.json"}, ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// Upload uploads the files of the directory under the prefix, with their content type detected from their extension,
+// and returns their URIs. Files already uploaded with the same content are skipped.
+//
+// Example usage: dagger call --credentials=file:./sa.json upload --dir=./coverage --bucket=ci-reports --prefix=shop/api/pr-42
+func (m *Gcs) Upload(
+	ctx context.Context,
+	// Directory of the files uploaded
+	// +required
+	dir *Directory,
+	// Name of the bucket
+	// +required
+	bucket string,
+	// Prefix of the object names, the directory is uploaded at the bucket root when empty (ex: shop/api/pr-42)
+	// +optional
+	prefix string,
+	// Cache-Control metadata of the objects (ex: no-store for reports updated in place)
+	// +optional
+	cacheControl string,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "Upload")
+	defer s.End(&err)
+
+	out, err := m.withProxy(dag.Container().From("alpine:3.19")).
+		WithDirectory("/upload", dir).
+		WithWorkdir("/upload").
+		WithExec([]string{"find", ".", "-type", "f"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", commandError(err))
+	}
+
+	var uris []string
+	for _, f := range strings.Split(strings.TrimSpace(out), "\n") {
+		if f = strings.TrimPrefix(f, "./"); f != "" {
+			uris = append(uris, m.uri(bucket, prefix, f))
+		}
+	}
+	if len(uris) == 0 {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("no file to upload"), Hint: "pass the files or the directory to upload"}
+	}
+
+	args := []string{"gcloud", "storage", "rsync", "/upload", m.uri(bucket, prefix, ""), "--recursive"}
+	if cacheControl != "" {
+		args = append(args, "--cache-control", cacheControl)
+	}
+	_, err = m.gcloud().
+		WithDirectory("/upload", dir).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload to %s: %w", m.uri(bucket, prefix, ""), commandError(err))
+	}
+
+	return uris, nil
+}
+
+// Download downloads the objects under the prefix, and returns them with their names relative to the prefix
+//
+// Example usage: dagger call --credentials=file:./sa.json download --bucket=ci-reports --prefix=shop/api/pr-42 export --path=reports
+func (m *Gcs) Download(
+	ctx context.Context,
+	// Name of the bucket
+	// +required
+	bucket string,
+	// Prefix of the object names, the whole bucket is downloaded when empty (ex: shop/api/pr-42)
+	// +optional
+	prefix string,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Download")
+	defer s.End(&err)
+
+	out := m.gcloud().
+		WithExec([]string{"mkdir", "-p", "/download"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec([]string{"gcloud", "storage", "rsync", m.uri(bucket, prefix, ""), "/download", "--recursive"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/download")
+	if _, err := out.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", m.uri(bucket, prefix, ""), commandError(err))
+	}
+
+	return out, nil
+}
+
+// SignedUrl returns a URL granting read access to the object until it expires, signed with the service account key.
+// Each object needs its own URL: pages linking to other objects, such as HTML reports with assets, only load when the
+// assets are inlined.
+//
+// Example usage: dagger call --credentials=file:./sa.json signed-url --bucket=ci-reports --object=shop/api/pr-42/coverage.html --duration=72h
+func (m *Gcs) SignedUrl(
+	ctx context.Context,
+	// Name of the bucket
+	// +required
+	bucket string,
+	// Name of the object (ex: shop/api/pr-42/coverage.html)
+	// +required
+	object string,
+	// Validity of the URL, at most 7 days (ex: 30m, 12h, 7d)
+	// +optional
+	// +default="24h"
+	duration string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "SignedUrl")
+	defer s.End(&err)
+
+	url, err := m.gcloud().
+		WithExec([]string{
+			"gcloud", "storage", "sign-url", m.uri(bucket, "", object),
+			"--private-key-file=/tmp/credentials.json", "--duration=" + duration, "--format=value(signed_url)",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign url of %s: %w", m.uri(bucket, "", object), commandError(err))
+	}
+
+	return strings.TrimSpace(url), nil
+}
+
+// uri returns the gs:// URI of the object under the prefix
+func (m *Gcs) uri(bucket, prefix, object string) string {
+	name := strings.Trim(prefix, "/")
+	if object != "" {
+		name = strings.TrimPrefix(name+"/"+object, "/")
+	}
+
+	return "gs://" + bucket + "/" + name
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Gcs) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StickyComment posts a comment on a pull request and returns its URL. The comment is updated in place by the next
+// calls with the same id, it is found by the hidden marker its body starts with.
+//
+// Example usage: dagger call --token=env:TOKEN sticky-comment --repo-dir=. --pull-request=42 --id=coverage --body="### Coverage"
+func (m *Gh) StickyComment(
+	ctx context.Context,
+	// RepoDir of the GitHub repo, with its .git directory
+	// +required
+	repoDir *Directory,
+	// Number of the pull request
+	// +required
+	pullRequest int,
+	// Identifier of the comment, distinct per pipeline posting on the same pull requests (ex: coverage:api)
+	// +required
+	id string,
+	// Markdown body of the comment
+	// +required
+	body string,
+	// Only update the existing comment, none is created and an empty URL is returned when the pull request has none
+	// +optional
+	updateOnly bool,
+) (url string, err error) {
+	s := m.startSpan(ctx, "StickyComment", "pull_request="+strconv.Itoa(pullRequest), "id="+id)
+	defer s.End(&err)
+
+	marker := "<!-- " + id + " -->"
+	// The body stays untracked, the timestamp makes sure the calls are never cached
+	dir := repoDir.
+		WithNewFile(".gh/comment.md", marker+"\n"+body).
+		WithNewFile(".gh/timestamp", time.Now().String())
+
+	existing, err := m.RunGh(ctx, dir, fmt.Sprintf(
+		"api repos/{owner}/{repo}/issues/%d/comments --paginate --jq %s",
+		pullRequest, shell.Quote(fmt.Sprintf(".[] | select(.body | startswith(%q)) | .id", marker)),
+	), "2.47.0")
+	if err != nil {
+		return "", fmt.Errorf("failed to list the comments of pull request %d: %w", pullRequest, err)
+	}
+	if commentID, _, _ := strings.Cut(strings.TrimSpace(existing), "\n"); commentID != "" {
+		url, err := m.RunGh(ctx, dir, fmt.Sprintf(
+			"api --method PATCH repos/{owner}/{repo}/issues/comments/%s -F body=@.gh/comment.md --jq .html_url",
+			commentID,
+		), "2.47.0")
+		if err != nil {
+			return "", fmt.Errorf("failed to update comment %s: %w", commentID, err)
+		}
+		return strings.TrimSpace(url), nil
+	}
+
+	if updateOnly {
+		return "", nil
+	}
+	url, err = m.RunGh(ctx, dir, fmt.Sprintf("pr comment %d --body-file .gh/comment.md", pullRequest), "2.47.0")
+	if err != nil {
+		return "", fmt.Errorf("failed to comment on pull request %d: %w", pullRequest, err)
+	}
+
+	return strings.TrimSpace(url), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hunkPattern matches the header of a hunk, capturing the first line of the new version
+var hunkPattern = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+type ChangedFile struct {
+	// Path of the file in the repository, its former path when it is deleted
+	Path string
+	// Lines added or modified in the new version of the file, none for deleted files
+	Ranges []*LineRange
+}
+
+type LineRange struct {
+	// First line of the range
+	Start int
+	// Last line of the range, included
+	End int
+}
+
+// ChangedFiles lists the files changed by a pull request, or since the merge base of the base branch when no pull
+// request is given, with their added or modified lines
+//
+// Example usage: dagger call --token=env:TOKEN changed-files --repo-dir=. --pull-request=42
+func (m *Gh) ChangedFiles(
+	ctx context.Context,
+	// RepoDir of the GitHub repo, with its .git directory
+	// +required
+	repoDir *Directory,
+	// Number of the pull request whose files are listed, the changes since the base branch are listed when 0
+	// +optional
+	pullRequest int,
+	// Branch the changes are compared to, fetched from origin, defaults to the base branch of the module
+	// +optional
+	base string,
+) (files []*ChangedFile, err error) {
+	if base == "" {
+		base = m.BaseBranch
+	}
+	s := m.startSpan(ctx, "ChangedFiles", "pull_request="+strconv.Itoa(pullRequest), "base="+base)
+	defer s.End(&err)
+
+	// The pull request and the base branch move outside of Dagger, the timestamp makes sure they are never cached
+	dir := repoDir.WithNewFile(".gh/timestamp", time.Now().String())
+
+	var diff string
+	if pullRequest > 0 {
+		if diff, err = m.RunGh(ctx, dir, fmt.Sprintf("pr diff %d --color=never", pullRequest), "2.47.0"); err != nil {
+			return nil, fmt.Errorf("failed to diff pull request %d: %w", pullRequest, err)
+		}
+	} else {
+		// Shallow clones lack the common history, the tip of the base branch is used instead of the merge base
+		ctr, err := m.RunGit(ctx, dir, fmt.Sprintf(
+			`fetch origin %s && git diff --no-color --no-ext-diff --src-prefix=a/ --dst-prefix=b/ -U0 "$(git merge-base FETCH_HEAD HEAD || echo FETCH_HEAD)" HEAD > /tmp/changes.diff`,
+			shell.Quote(base),
+		), "2.43.0", "", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff against %s: %w", base, err)
+		}
+		if diff, err = ctr.File("/tmp/changes.diff").Contents(ctx); err != nil {
+			return nil, fmt.Errorf("failed to read diff against %s: %w", base, err)
+		}
+	}
+
+	return parseDiff(diff), nil
+}
+
+// parseDiff returns the files of a unified diff with the ranges of their added or modified lines, whatever the number
+// of context lines of the diff
+func parseDiff(diff string) []*ChangedFile {
+	files := []*ChangedFile{}
+	var file *ChangedFile
+	// Line of the new version the next line of the hunk is at, 0 outside of the hunks
+	line := 0
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text()
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			// Binary files have no ---/+++ lines, their path comes from the header
+			file = &ChangedFile{Ranges: []*LineRange{}}
+			if i := strings.LastIndex(text, " b/"); i >= 0 {
+				file.Path = text[i+3:]
+			}
+			files = append(files, file)
+			line = 0
+		case file == nil:
+			// Lines before the first file, such as the headers of the commits
+		case line == 0 && strings.HasPrefix(text, "--- a/"):
+			file.Path = strings.TrimPrefix(text, "--- a/")
+		case line == 0 && strings.HasPrefix(text, "+++ b/"):
+			file.Path = strings.TrimPrefix(text, "+++ b/")
+		case strings.HasPrefix(text, "@@"):
+			if match := hunkPattern.FindStringSubmatch(text); match != nil {
+				line, _ = strconv.Atoi(match[1])
+			}
+		case line > 0 && strings.HasPrefix(text, "+"):
+			file.add(line)
+			line++
+		case line > 0 && strings.HasPrefix(text, " "):
+			line++
+		}
+	}
+
+	return files
+}
+
+// add adds the line to the ranges of the file, extending the last range when it follows it
+func (f *ChangedFile) add(line int) {
+	if n := len(f.Ranges); n > 0 && f.Ranges[n-1].End == line-1 {
+		f.Ranges[n-1].End = line
+		return
+	}
+	f.Ranges = append(f.Ranges, &LineRange{Start: line, End: line})
+}
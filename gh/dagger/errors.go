@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+// commandError types the error of a git or gh command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	output := strings.ToLower(execErr.Stderr + execErr.Stdout)
+	has := func(patterns ...string) bool {
+		for _, p := range patterns {
+			if strings.Contains(output, p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("rate limit exceeded", "secondary rate limit"):
+		return &typederr.RateLimitError{Err: err, Hint: "retry once the rate limit resets, gh api rate_limit shows when"}
+	case has("authentication failed", "bad credentials", "http 401", "requires authentication", "could not read username",
+		"permission to", "resource not accessible by integration", "http 403"):
+		return &typederr.AuthError{Err: err, Hint: "check that the token is valid and has the contents and pull requests permissions on the repository"}
+	case has("[rejected]", "non-fast-forward", "fetch first", "already exists", "merge conflict", "not mergeable", "http 409"):
+		return &typederr.ConflictError{Err: err, Hint: "pull the latest changes of the base branch and run the command again"}
+	case has("unknown command", "unknown flag", "unknown option", "is not a git command", "http 422"):
+		return &typederr.ValidationError{Err: err, Hint: "check the command and its arguments"}
+	}
+
+	return err
+}
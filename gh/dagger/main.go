@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"gopkg.in/ini.v1"
+	"slices"
 	"strings"
+	"time"
 )
 
 type Gh struct {
@@ -14,6 +16,27 @@ type Gh struct {
 	// The token to authenticate with GitHub
 	// +private
 	Token *Secret
+	// HTTP(S) proxy URL of the git and gh commands
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the git and gh commands
+	// +private
+	CABundle *File
+	// Digest-pinned images of the git and gh commands
+	// +private
+	Pins []string
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
 }
 
 // New creates a new GitHub module with the provided inputs
@@ -25,10 +48,38 @@ func New(
 	// The token to authenticate with GitHub
 	// +required
 	token *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// Digest-pinned image references of the git and gh commands, used instead of resolving their tag (ex: alpine/git:2.43.0@sha256:...)
+	// +optional
+	pins []string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
 ) *Gh {
 	return &Gh{
-		BaseBranch: baseBranch,
-		Token:      token,
+		BaseBranch:   baseBranch,
+		Token:        token,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		Pins:         pins,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
 	}
 }
 
@@ -47,27 +98,39 @@ func (m *Gh) RunGit(
 	// +optional
 	// +default="2.43.0"
 	version string,
-	// user email
+	// user email, defaults to the common git identity
 	// +optional
-	// +default="action@github.com"
 	userEmail string,
-	// user name
+	// user name, defaults to the common git identity
 	// +optional
-	// +default="GitHub Action"
 	userName string,
-) (*Container, error) {
-	tk, err := m.Token.Plaintext(ctx)
-	if err != nil {
-		return &Container{}, fmt.Errorf("failed to get auth token: %w", err)
+) (ctr *Container, err error) {
+	s := m.startSpan(ctx, "RunGit", "command=git "+subcommand(cmd), "version="+version)
+	defer s.End(&err)
+
+	defaults := m.common().Defaults()
+	if userEmail == "" {
+		email, err := defaults.GitUserEmail(ctx)
+		if err != nil {
+			return &Container{}, fmt.Errorf("failed to get default user email: %w", err)
+		}
+		userEmail = email
+	}
+	if userName == "" {
+		name, err := defaults.GitUserName(ctx)
+		if err != nil {
+			return &Container{}, fmt.Errorf("failed to get default user name: %w", err)
+		}
+		userName = name
 	}
 
 	owner, repo, err := m.extractRepoOwnerAndName(ctx, repoDir)
 	if err != nil {
 		return &Container{}, fmt.Errorf("failed to extract repo owner and name: %w", err)
 	}
+	s.SetAttribute("repo", owner+"/"+repo)
 
-	c, err := dag.Container().
-		From("alpine/git:"+version).
+	c, err := m.withProxy(m.common().Image("alpine/git:"+version)).
 		WithDirectory("/workspace", repoDir, ContainerWithDirectoryOpts{}).
 		WithSecretVariable("GITHUB_TOKEN", m.Token).
 		WithWorkdir("/workspace").
@@ -83,9 +146,16 @@ func (m *Gh) RunGit(
 			}, " ")},
 			ContainerWithExecOpts{SkipEntrypoint: true},
 		).
+		// The token is read from the secret variable by a credential helper, so it never appears in a command line,
+		// an error or the .git/config of the returned workspace
+		WithExec(
+			[]string{"git", "config", "--global", "credential.https://github.com.helper",
+				`!f() { test "$1" = get && echo username=x-access-token && echo "password=${GITHUB_TOKEN}"; }; f`},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
 		WithExec(
 			[]string{"sh", "-c", strings.Join([]string{
-				"git", "remote set-url origin https://" + tk + ":x-oauth-basic@github.com/" + owner + "/" + repo + ".git",
+				"git", "remote set-url origin https://github.com/" + owner + "/" + repo + ".git",
 			}, " ")},
 			ContainerWithExecOpts{SkipEntrypoint: true},
 		).
@@ -94,7 +164,7 @@ func (m *Gh) RunGit(
 			ContainerWithExecOpts{SkipEntrypoint: true},
 		).Sync(ctx)
 	if err != nil {
-		return &Container{}, fmt.Errorf("failed to run git command: %w", err)
+		return &Container{}, fmt.Errorf("failed to run git command: %w", commandError(err))
 	}
 
 	return c, nil
@@ -143,9 +213,14 @@ func (m *Gh) RunGh(
 	// +optional
 	// +default="2.47.0"
 	version string,
-) (string, error) {
-	c, err := dag.Container().
-		From("maniator/gh:v"+version).
+) (stdout string, err error) {
+	s := m.startSpan(ctx, "RunGh", "command=gh "+subcommand(cmd), "version="+version)
+	defer s.End(&err)
+	if owner, repo, err := m.extractRepoOwnerAndName(ctx, repoPath); err == nil {
+		s.SetAttribute("repo", owner+"/"+repo)
+	}
+
+	c, err := m.withProxy(m.common().Image("maniator/gh:v"+version)).
 		WithDirectory("/workspace", repoPath, ContainerWithDirectoryOpts{}).
 		WithSecretVariable("GITHUB_TOKEN", m.Token).
 		WithWorkdir("/workspace").
@@ -154,12 +229,103 @@ func (m *Gh) RunGh(
 			ContainerWithExecOpts{SkipEntrypoint: true},
 		).Sync(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to run git command: %w", err)
+		return "", fmt.Errorf("failed to run gh command: %w", commandError(err))
 	}
 
 	return c.Stdout(ctx)
 }
 
+// ListRepos lists the repositories of an organization or a user, as owner/name sorted by name, archived and forked
+// repositories excluded.
+//
+// Example usage: dagger call --token=env:TOKEN list-repos --owner=adore-me --topic=kubernetes
+func (m *Gh) ListRepos(
+	ctx context.Context,
+	// Organization or user owning the repositories
+	// +required
+	owner string,
+	// Only list the repositories with this topic
+	// +optional
+	topic string,
+	// Maximum number of repositories listed
+	// +optional
+	// +default=1000
+	limit int,
+) (repos []string, err error) {
+	s := m.startSpan(ctx, "ListRepos", "owner="+owner, "topic="+topic)
+	defer s.End(&err)
+
+	cmd := fmt.Sprintf("repo list %s --no-archived --source --limit %d --json nameWithOwner --jq '.[].nameWithOwner'", owner, limit)
+	if topic != "" {
+		cmd += " --topic " + topic
+	}
+
+	// The listing does not target a repository, the timestamp makes sure it is never cached
+	out, err := m.RunGh(ctx, dag.Directory().WithNewFile(".list-repos/timestamp", time.Now().String()), cmd, "2.47.0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories of %s: %w", owner, err)
+	}
+
+	repos = strings.Fields(out)
+	slices.Sort(repos)
+
+	return repos, nil
+}
+
+// SetSecret sets a GitHub Actions secret of a repository, or of one of its environments. The value is mounted as a
+// secret, it never appears in the command or the cache.
+//
+// Example usage: dagger call --token=env:TOKEN set-secret --repo=adore-me/api --name=API_KEY --value=env:API_KEY --environment=production
+func (m *Gh) SetSecret(
+	ctx context.Context,
+	// Repository, as owner/name
+	// +required
+	repo string,
+	// Name of the secret
+	// +required
+	name string,
+	// Value of the secret
+	// +required
+	value *Secret,
+	// Environment of the repository holding the secret, the repository secrets when empty
+	// +optional
+	environment string,
+	// version of the Github CLI
+	// +optional
+	// +default="2.47.0"
+	version string,
+) (err error) {
+	s := m.startSpan(ctx, "SetSecret", "repo="+repo, "version="+version)
+	defer s.End(&err)
+
+	// The secret changes outside of Dagger, the timestamp makes sure it is always set
+	_, err = m.withProxy(m.common().Image("maniator/gh:v"+version)).
+		WithSecretVariable("GITHUB_TOKEN", m.Token).
+		WithMountedSecret("/tmp/secret-value", value).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(
+			[]string{"sh", "-c", `gh secret set "$1" -R "$2" ${3:+--env "$3"} < /tmp/secret-value`, "sh", name, repo, environment},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set secret %s of %s: %w", name, repo, commandError(err))
+	}
+
+	return nil
+}
+
+// common returns the common module, resolving the images to the pinned digests
+func (m *Gh) common() *Common {
+	return dag.Common(CommonOpts{Pins: m.Pins})
+}
+
+// withProxy applies the proxy settings and CA bundle to a container reaching GitHub
+func (m *Gh) withProxy(c *Container) *Container {
+	return m.common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
+
 func extractRepoOwnerAndNameSSH(url string) (string, string) {
 	// Remove the .git extension
 	url = strings.TrimSuffix(url, ".git")
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"github.com/adore-me/daggerverse/common/pkg/tracing"
+	"strings"
+)
+
+// startSpan starts the span of a function, with attributes as key=value pairs
+func (m *Gh) startSpan(ctx context.Context, name string, attributes ...string) *tracing.Span {
+	return tracing.Start(ctx, "gh", name, m.exportSpan, append([]string{"base_branch=" + m.BaseBranch}, attributes...)...)
+}
+
+// exportSpan exports the span of a function with the common module, when an OTLP endpoint is configured
+func (m *Gh) exportSpan(ctx context.Context, record string) error {
+	if m.OtlpEndpoint == "" {
+		return nil
+	}
+
+	_, err := dag.Common().
+		Telemetry(m.OtlpEndpoint, CommonTelemetryOpts{Headers: m.OtlpHeaders, Traceparent: m.Traceparent}).
+		Export(ctx, record)
+	return err
+}
+
+// subcommand returns the first word of a command, recorded instead of its arguments
+func subcommand(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,508 @@
+// This module provides the GitLab equivalent of the gh module: git commands authenticated with a token,
+// merge requests, pipelines and releases through the glab CLI.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type Gitlab struct {
+	// The base branch of the repository (ex: main, master)
+	// +private
+	BaseBranch string
+	// The token to authenticate with GitLab
+	// +private
+	Token *Secret
+	// The GitLab host (ex: gitlab.com, gitlab.internal)
+	// +private
+	Host string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new GitLab module with the provided inputs
+func New(
+	// The base branch of the repository (ex: main, master)
+	// +optional
+	// +default="master"
+	baseBranch string,
+	// The token to authenticate with GitLab, with the api and write_repository scopes
+	// +required
+	token *Secret,
+	// The GitLab host
+	// +optional
+	// +default="gitlab.com"
+	host string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Gitlab {
+	return &Gitlab{
+		BaseBranch:   baseBranch,
+		Token:        token,
+		Host:         host,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// remoteURL is the shell expression of the token authenticated URL of the origin remote.
+// The project path is taken from the current URL, so nested groups and SSH remotes are supported.
+const remoteURL = `"https://oauth2:${GITLAB_TOKEN}@${GITLAB_HOST}/$(git remote get-url origin | sed -E 's#^(https?://[^/]+/|[^@]+@[^:]+:)##')"`
+
+// Clone clones a GitLab project, with its .git directory and without the token in its remote URL.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN clone --project=adore-me/platform/infra export --path=./infra
+func (m *Gitlab) Clone(
+	ctx context.Context,
+	// Path of the project, including its groups (ex: adore-me/platform/infra)
+	// +required
+	project string,
+	// Branch to check out, defaults to the base branch
+	// +optional
+	branch string,
+	// version of the git image
+	// +optional
+	// +default="2.43.0"
+	version string,
+) *Directory {
+	s := m.startSpan(ctx, "Clone")
+	defer s.End(nil)
+
+	if branch == "" {
+		branch = m.BaseBranch
+	}
+
+	return m.withProxy(dag.Container().From("alpine/git:"+version)).
+		WithSecretVariable("GITLAB_TOKEN", m.Token).
+		WithEnvVariable("GITLAB_HOST", m.Host).
+		// The remote branch moves outside of Dagger, always fetch it again
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(
+			[]string{"sh", "-c", strings.Join([]string{
+				`git clone --branch "$0" "https://oauth2:${GITLAB_TOKEN}@${GITLAB_HOST}/$1.git" /workspace`,
+				`&& git -C /workspace remote set-url origin "https://${GITLAB_HOST}/$1.git"`,
+			}, " "), branch, project},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Directory("/workspace")
+}
+
+// RunGit runs a command using the git CLI, with the origin remote authenticated with the token.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN run-git --repo-dir=. --cmd="push origin HEAD:my-branch"
+func (m *Gitlab) RunGit(
+	ctx context.Context,
+	// RepoDir of the GitLab repo
+	// +required
+	repoDir *Directory,
+	// command to run
+	// +required
+	cmd string,
+	// version of the git image
+	// +optional
+	// +default="2.43.0"
+	version string,
+	// user email
+	// +optional
+	// +default="gitlab-ci@adore-me.com"
+	userEmail string,
+	// user name
+	// +optional
+	// +default="GitLab CI"
+	userName string,
+) (ctr *Container, err error) {
+	s := m.startSpan(ctx, "RunGit")
+	defer s.End(&err)
+
+	c, err := m.git(repoDir, version, userEmail, userName).
+		WithExec(
+			[]string{"sh", "-c", "git " + cmd},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git command: %w", commandError(err))
+	}
+
+	return c, nil
+}
+
+// git returns a container with the git identity configured and the origin remote of the repo authenticated with the token
+func (m *Gitlab) git(repoDir *Directory, version, userEmail, userName string) *Container {
+	return m.withProxy(dag.Container().From("alpine/git:"+version)).
+		WithDirectory("/workspace", repoDir).
+		WithSecretVariable("GITLAB_TOKEN", m.Token).
+		WithEnvVariable("GITLAB_HOST", m.Host).
+		WithWorkdir("/workspace").
+		WithExec(
+			[]string{"git", "config", "--global", "user.email", userEmail},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithExec(
+			[]string{"git", "config", "--global", "user.name", userName},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithExec(
+			[]string{"sh", "-c", "git remote set-url origin " + remoteURL},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+}
+
+// CommitAndPush commits the changes of the repo on a branch and pushes it, returning the repo at the pushed commit.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN commit-and-push --repo-dir=. --branch=bump/cert-manager --message="Bump cert-manager"
+func (m *Gitlab) CommitAndPush(
+	ctx context.Context,
+	// RepoDir of the GitLab repo, including the changes to commit
+	// +required
+	repoDir *Directory,
+	// Branch the commit is pushed to, created from the current commit when missing
+	// +required
+	branch string,
+	// Commit message
+	// +required
+	message string,
+	// Paths to commit, relative to the repo, all changes when empty
+	// +optional
+	paths []string,
+	// Force push the branch, replacing its previous commits
+	// +optional
+	force bool,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "CommitAndPush")
+	defer s.End(&err)
+
+	add := "-A"
+	if len(paths) > 0 {
+		add = "--"
+		for _, p := range paths {
+			add += " " + shell.Quote(p)
+		}
+	}
+	push := "push"
+	if force {
+		push += " --force"
+	}
+
+	c, err := m.git(repoDir, "2.43.0", "gitlab-ci@adore-me.com", "GitLab CI").
+		// Pushes must always hit the remote
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(
+			[]string{"sh", "-c", fmt.Sprintf(
+				"git checkout -B %s && git add %s && git commit -m %s && git %s origin HEAD:%s",
+				shell.Quote(branch), add, shell.Quote(message), push, shell.Quote(branch),
+			)},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to push %s: %w", branch, commandError(err))
+	}
+
+	return c.Directory("/workspace"), nil
+}
+
+// glab returns a container with the glab CLI authenticated against the host, the repo mounted in /workspace
+func (m *Gitlab) glab(repoDir *Directory, version string) *Container {
+	return m.withProxy(dag.Container().From("registry.gitlab.com/gitlab-org/cli:v"+version)).
+		WithDirectory("/workspace", repoDir).
+		WithSecretVariable("GITLAB_TOKEN", m.Token).
+		WithEnvVariable("GITLAB_HOST", m.Host).
+		// Merge requests, pipelines and releases change outside of Dagger
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithWorkdir("/workspace")
+}
+
+// RunGlab runs a command using the glab CLI.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN run-glab --repo-dir=. --cmd="mr list"
+func (m *Gitlab) RunGlab(
+	ctx context.Context,
+	// RepoDir of the GitLab repo
+	// +required
+	repoDir *Directory,
+	// command to run
+	// +required
+	cmd string,
+	// version of the glab CLI
+	// +optional
+	// +default="1.39.0"
+	version string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "RunGlab")
+	defer s.End(&err)
+
+	out, err := m.glab(repoDir, version).
+		WithExec([]string{"sh", "-c", "glab " + cmd}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run glab command: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// CreateMergeRequest opens a merge request from an already pushed branch and returns its URL.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN create-merge-request --repo-dir=. --source-branch=bump/cert-manager --title="Bump cert-manager"
+func (m *Gitlab) CreateMergeRequest(
+	ctx context.Context,
+	// RepoDir of the GitLab repo
+	// +required
+	repoDir *Directory,
+	// Branch holding the changes
+	// +required
+	sourceBranch string,
+	// Title of the merge request
+	// +required
+	title string,
+	// Description of the merge request
+	// +optional
+	description string,
+	// Branch the merge request targets, defaults to the base branch
+	// +optional
+	targetBranch string,
+	// Labels of the merge request
+	// +optional
+	labels []string,
+	// Delete the source branch once merged
+	// +optional
+	// +default=true
+	removeSourceBranch bool,
+	// version of the glab CLI
+	// +optional
+	// +default="1.39.0"
+	version string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "CreateMergeRequest")
+	defer s.End(&err)
+
+	if targetBranch == "" {
+		targetBranch = m.BaseBranch
+	}
+
+	args := []string{
+		"glab", "mr", "create", "--yes",
+		"--source-branch", sourceBranch,
+		"--target-branch", targetBranch,
+		"--title", title,
+		"--description", description,
+	}
+	if len(labels) > 0 {
+		args = append(args, "--label", strings.Join(labels, ","))
+	}
+	if removeSourceBranch {
+		args = append(args, "--remove-source-branch")
+	}
+
+	out, err := m.glab(repoDir, version).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create merge request from %s: %w", sourceBranch, commandError(err))
+	}
+
+	return lastLine(out), nil
+}
+
+// MergeMergeRequest merges a merge request, or sets it to merge once its pipeline succeeds.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN merge-merge-request --repo-dir=. --id=42 --squash
+func (m *Gitlab) MergeMergeRequest(
+	ctx context.Context,
+	// RepoDir of the GitLab repo
+	// +required
+	repoDir *Directory,
+	// ID or branch of the merge request
+	// +required
+	id string,
+	// Squash the commits of the merge request
+	// +optional
+	squash bool,
+	// Merge once the pipeline succeeds instead of right away
+	// +optional
+	// +default=true
+	whenPipelineSucceeds bool,
+	// version of the glab CLI
+	// +optional
+	// +default="1.39.0"
+	version string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "MergeMergeRequest")
+	defer s.End(&err)
+
+	args := []string{"glab", "mr", "merge", id, "--yes", fmt.Sprintf("--when-pipeline-succeeds=%t", whenPipelineSucceeds)}
+	if squash {
+		args = append(args, "--squash")
+	}
+
+	out, err := m.glab(repoDir, version).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to merge merge request %s: %w", id, commandError(err))
+	}
+
+	return out, nil
+}
+
+// TriggerPipeline runs a pipeline on a branch or tag with the provided variables.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN trigger-pipeline --repo-dir=. --ref=master --variables=DEPLOY_ENV=staging
+func (m *Gitlab) TriggerPipeline(
+	ctx context.Context,
+	// RepoDir of the GitLab repo
+	// +required
+	repoDir *Directory,
+	// Branch or tag to run the pipeline on, defaults to the base branch
+	// +optional
+	ref string,
+	// Pipeline variables (ex: DEPLOY_ENV=staging)
+	// +optional
+	variables []string,
+	// version of the glab CLI
+	// +optional
+	// +default="1.39.0"
+	version string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "TriggerPipeline")
+	defer s.End(&err)
+
+	if ref == "" {
+		ref = m.BaseBranch
+	}
+
+	args := []string{"glab", "ci", "run", "--branch", ref}
+	for _, v := range variables {
+		key, value, found := strings.Cut(v, "=")
+		if !found {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid variable %q, expected KEY=VALUE", v),
+				Hint: "pass the variables as KEY=VALUE",
+			}
+		}
+		args = append(args, "--variables", key+":"+value)
+	}
+
+	out, err := m.glab(repoDir, version).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to trigger pipeline on %s: %w", ref, commandError(err))
+	}
+
+	return out, nil
+}
+
+// CreateRelease creates a release, and its tag when missing, with the provided notes and assets.
+//
+// Example usage: dagger call --token=env:GITLAB_TOKEN create-release --repo-dir=. --tag=v1.2.3 --notes="Bug fixes" --assets=./dist/app.tar.gz
+func (m *Gitlab) CreateRelease(
+	ctx context.Context,
+	// RepoDir of the GitLab repo
+	// +required
+	repoDir *Directory,
+	// Tag of the release
+	// +required
+	tag string,
+	// Name of the release, defaults to the tag
+	// +optional
+	name string,
+	// Release notes, in Markdown
+	// +optional
+	notes string,
+	// Files uploaded with the release
+	// +optional
+	assets []*File,
+	// Commit or branch the tag is created from when it does not exist, defaults to the base branch
+	// +optional
+	ref string,
+	// version of the glab CLI
+	// +optional
+	// +default="1.39.0"
+	version string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "CreateRelease")
+	defer s.End(&err)
+
+	if name == "" {
+		name = tag
+	}
+	if ref == "" {
+		ref = m.BaseBranch
+	}
+
+	c := m.glab(repoDir, version).WithNewFile("/tmp/release/notes.md", ContainerWithNewFileOpts{Contents: notes})
+	args := []string{"glab", "release", "create", tag, "--name", name, "--notes-file", "/tmp/release/notes.md", "--ref", ref}
+	for i, asset := range assets {
+		fileName, err := asset.Name(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get name of asset %d: %w", i, err)
+		}
+		p := "/tmp/release/assets/" + fileName
+		c = c.WithFile(p, asset)
+		args = append(args, p)
+	}
+
+	out, err := c.
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create release %s: %w", tag, commandError(err))
+	}
+
+	return out, nil
+}
+
+// lastLine returns the last non empty line of the output, where glab prints the URL of the created resource
+func lastLine(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Gitlab) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
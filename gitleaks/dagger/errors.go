@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the gitleaks commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"leaks found"},
+	AuthHint:       "check the credentials of the repository",
+	ValidationHint: "remove the leaked secrets and rotate them, or allowlist the false positives in .gitleaks.toml",
+}
+
+// commandError types the error of a gitleaks command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
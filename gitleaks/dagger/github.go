@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"strings"
+	"time"
+)
+
+// maxAnnotations is the number of annotations GitHub accepts per check run request
+const maxAnnotations = 50
+
+type annotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+}
+
+// markdown returns the leaks as a Markdown table, without the secrets
+func (r *ScanResult) markdown() string {
+	var b strings.Builder
+	b.WriteString("| File | Rule | Commit | Fingerprint |\n| --- | --- | --- | --- |\n")
+	for _, l := range r.Leaks {
+		fmt.Fprintf(&b, "| `%s:%d` | %s | %.12s | `%s` |\n", l.File, l.StartLine, l.RuleID, l.Commit, l.Fingerprint)
+	}
+	b.WriteString("\nRotate the leaked secrets, then remove them from the history. " +
+		"False positives are skipped once their fingerprint is added to `.gitleaksignore`.\n")
+
+	return b.String()
+}
+
+// PublishCheckRun publishes the scan as a completed check run of the commit, failing and annotating the leaks, and returns its URL
+//
+// Example usage: dagger call scan --source=. --base-ref=origin/master publish-check-run --repo=. --token=env:GITHUB_TOKEN --sha=$GITHUB_SHA
+func (r *ScanResult) PublishCheckRun(
+	ctx context.Context,
+	// The repository, including its .git directory, its origin remote selects the GitHub repository
+	// +required
+	repo *Directory,
+	// Token allowed to write check runs (ex: the GitHub App token of the workflow)
+	// +required
+	token *Secret,
+	// Commit the check run is attached to
+	// +required
+	sha string,
+	// Name of the check run
+	// +optional
+	// +default="gitleaks"
+	name string,
+) (result string, err error) {
+	s := r.startSpan(ctx, "PublishCheckRun")
+	defer s.End(&err)
+
+	conclusion := "success"
+	summary := "No leaked secret."
+	if !r.Passed {
+		conclusion = "failure"
+		summary = r.markdown()
+	}
+	output := map[string]any{
+		"title":   fmt.Sprintf("%d leaked secrets", len(r.Leaks)),
+		"summary": summary,
+	}
+
+	// GitHub accepts 50 annotations per request: the check run is created with the first ones, and updated with the others
+	annotations := []annotation{}
+	for _, l := range r.Leaks {
+		annotations = append(annotations, annotation{
+			Path:            l.File,
+			StartLine:       max(l.StartLine, 1),
+			EndLine:         max(l.EndLine, l.StartLine, 1),
+			AnnotationLevel: "failure",
+			Title:           l.RuleID,
+			Message:         l.Description + ", rotate the secret before removing it",
+		})
+	}
+	chunks := [][]annotation{}
+	for start := 0; start < len(annotations); start += maxAnnotations {
+		chunks = append(chunks, annotations[start:min(start+maxAnnotations, len(annotations))])
+	}
+	if len(chunks) == 0 {
+		chunks = append(chunks, []annotation{})
+	}
+
+	gh := dag.Gh(token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+	var id, url string
+	for i, chunk := range chunks {
+		output["annotations"] = chunk
+		payload := map[string]any{"output": output}
+		cmd := fmt.Sprintf("api -X PATCH repos/{owner}/{repo}/check-runs/%s --input .check-run/payload.json --jq '.id,.html_url'", id)
+		if i == 0 {
+			payload["name"] = name
+			payload["head_sha"] = sha
+			payload["status"] = "completed"
+			payload["conclusion"] = conclusion
+			cmd = "api -X POST repos/{owner}/{repo}/check-runs --input .check-run/payload.json --jq '.id,.html_url'"
+		}
+
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal check run: %w", err)
+		}
+		// The payload stays untracked, its timestamp makes sure the call is never cached
+		dir := repo.
+			WithNewFile(".check-run/payload.json", string(content)).
+			WithNewFile(".check-run/timestamp", time.Now().String())
+
+		out, err := gh.RunGh(ctx, dir, cmd)
+		if err != nil {
+			return "", fmt.Errorf("failed to publish check run %s: %w", name, err)
+		}
+		fields := strings.Fields(out)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("unexpected check run response: %s", out)
+		}
+		id, url = fields[0], fields[1]
+	}
+
+	return url, nil
+}
+
+// OpenIssue opens a GitHub issue listing the confirmed leaks, or comments on the open issue with the same title, and
+// returns its URL. Nothing is opened without leaks.
+//
+// Example usage: dagger call scan --source=. open-issue --repo=. --token=env:GITHUB_TOKEN --labels=security
+func (r *ScanResult) OpenIssue(
+	ctx context.Context,
+	// The repository the issue is opened in, including its .git directory
+	// +required
+	repo *Directory,
+	// Token allowed to open issues
+	// +required
+	token *Secret,
+	// Title of the issue
+	// +optional
+	// +default="Leaked secrets detected by gitleaks"
+	title string,
+	// Labels of the issue, which must exist in the repository
+	// +optional
+	labels []string,
+) (out string, err error) {
+	s := r.startSpan(ctx, "OpenIssue")
+	defer s.End(&err)
+
+	if r.Passed {
+		return "No leaked secret", nil
+	}
+
+	body := fmt.Sprintf("gitleaks found %d secrets", len(r.Leaks))
+	if r.LogOpts != "" {
+		body += " in " + r.LogOpts
+	}
+	body += ":\n\n" + r.markdown()
+
+	// The body stays untracked, its timestamp makes sure the calls are never cached
+	dir := repo.
+		WithNewFile(".gitleaks/body.md", body).
+		WithNewFile(".gitleaks/timestamp", time.Now().String())
+	gh := dag.Gh(token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+
+	existing, err := gh.RunGh(ctx, dir, fmt.Sprintf(
+		"issue list --state open --search %s --json title,url --jq %s",
+		shell.Quote("in:title "+title), shell.Quote(fmt.Sprintf(".[] | select(.title == %q) | .url", title)),
+	))
+	if err != nil {
+		return "", fmt.Errorf("failed to search leak issues: %w", err)
+	}
+	if url := strings.TrimSpace(existing); url != "" {
+		url, _, _ = strings.Cut(url, "\n")
+		if _, err := gh.RunGh(ctx, dir, "issue comment "+shell.Quote(url)+" --body-file .gitleaks/body.md"); err != nil {
+			return "", fmt.Errorf("failed to comment on %s: %w", url, err)
+		}
+		return url, nil
+	}
+
+	cmd := "issue create --title " + shell.Quote(title) + " --body-file .gitleaks/body.md"
+	for _, l := range labels {
+		cmd += " --label " + shell.Quote(l)
+	}
+	url, err := gh.RunGh(ctx, dir, cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to open leak issue: %w", err)
+	}
+
+	return strings.TrimSpace(url), nil
+}
@@ -0,0 +1,254 @@
+// This module scans repositories for leaked secrets with gitleaks, over the full git history or only the commits
+// of a change.
+//
+// Leaks fail GitHub checks and open issues with the gh module. Findings marked as false positives in the
+// .gitleaksignore file of the repository are skipped, the remaining ones are confirmed leaks.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+type Gitleaks struct {
+	// The version of gitleaks (ex: v8.18.2)
+	// +private
+	Version string
+	// gitleaks config, replacing the default rules
+	// +private
+	Config *File
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Gitleaks module pinned to the provided gitleaks version
+func New(
+	// The version of gitleaks
+	// +optional
+	// +default="v8.18.2"
+	version string,
+	// gitleaks config (.gitleaks.toml), replacing the default rules. The config of the repository applies when omitted.
+	// +optional
+	config *File,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Gitleaks {
+	return &Gitleaks{
+		Version:      version,
+		Config:       config,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ScanResult struct {
+	// Whether no leak was found
+	Passed bool
+	Leaks  []*Leak
+	// SARIF report, suitable for GitHub code scanning
+	Sarif *File
+	// Range of commits scanned, empty for the full history
+	// +private
+	LogOpts string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Leak struct {
+	// ID of the gitleaks rule (ex: aws-access-token)
+	RuleID      string
+	Description string
+	// File holding the secret, relative to the repository
+	File      string
+	StartLine int
+	EndLine   int
+	// Commit introducing the secret, empty in no-git mode
+	Commit string
+	Author string
+	Date   string
+	// Redacted match of the secret
+	Match string
+	// Fingerprint to add to .gitleaksignore when the leak is a false positive
+	Fingerprint string
+}
+
+type gitleaksFinding struct {
+	RuleID      string `json:"RuleID"`
+	Description string `json:"Description"`
+	File        string `json:"File"`
+	StartLine   int    `json:"StartLine"`
+	EndLine     int    `json:"EndLine"`
+	Commit      string `json:"Commit"`
+	Author      string `json:"Author"`
+	Date        string `json:"Date"`
+	Match       string `json:"Match"`
+	Fingerprint string `json:"Fingerprint"`
+}
+
+// Scan scans the repository for secrets, over its full history, the commits since the base ref, or only its files.
+//
+// Example usage: dagger call scan --source=. --base-ref=origin/master check
+func (m *Gitleaks) Scan(
+	ctx context.Context,
+	// The repository, including its .git directory unless noGit is set
+	// +required
+	source *Directory,
+	// Only scan the commits since this ref (ex: origin/master), the full history is scanned when empty
+	// +optional
+	baseRef string,
+	// Scan the files of the directory instead of the git history
+	// +optional
+	noGit bool,
+) (scanResult *ScanResult, err error) {
+	s := m.startSpan(ctx, "Scan")
+	defer s.End(&err)
+
+	c := m.withProxy(dag.Container().From("zricethezav/gitleaks:"+m.Version)).
+		WithDirectory("/workspace", source).
+		WithWorkdir("/workspace").
+		// The repository is mounted with another owner than the container user
+		WithExec([]string{"git", "config", "--global", "--add", "safe.directory", "/workspace"}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	args := []string{"gitleaks", "detect", "--source", ".", "--redact", "--exit-code", "0", "--no-banner"}
+	if m.Config != nil {
+		c = c.WithFile("/tmp/gitleaks.toml", m.Config)
+		args = append(args, "--config", "/tmp/gitleaks.toml")
+	}
+	logOpts := ""
+	switch {
+	case noGit:
+		args = append(args, "--no-git")
+	case baseRef != "":
+		logOpts = baseRef + "..HEAD"
+		args = append(args, "--log-opts", logOpts)
+	}
+
+	report, err := c.
+		WithExec(append(args, "--report-format", "json", "--report-path", "/tmp/report.json"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/tmp/report.json").
+		Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run gitleaks: %w", commandError(err))
+	}
+
+	var findings []gitleaksFinding
+	if err := json.Unmarshal([]byte(report), &findings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal gitleaks report: %w", err)
+	}
+
+	result := &ScanResult{
+		Passed:       len(findings) == 0,
+		Leaks:        []*Leak{},
+		LogOpts:      logOpts,
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CABundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, f := range findings {
+		result.Leaks = append(result.Leaks, &Leak{
+			RuleID:      f.RuleID,
+			Description: f.Description,
+			File:        f.File,
+			StartLine:   f.StartLine,
+			EndLine:     f.EndLine,
+			Commit:      f.Commit,
+			Author:      f.Author,
+			Date:        f.Date,
+			Match:       f.Match,
+			Fingerprint: f.Fingerprint,
+		})
+	}
+	result.Sarif = c.
+		WithExec(append(args, "--report-format", "sarif", "--report-path", "/tmp/report.sarif"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/tmp/report.sarif")
+
+	return result, nil
+}
+
+// Check fails when a leak was found, and returns a summary otherwise
+func (r *ScanResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, l := range r.Leaks {
+			lines = append(lines, describe(l))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d leaked secrets:\n%s", len(r.Leaks), strings.Join(lines, "\n")),
+			Hint: "remove the leaked secrets and rotate them, or allowlist the false positives in .gitleaks.toml",
+		}
+	}
+
+	return "No leaked secret", nil
+}
+
+// describe returns the leak as file:line: rule (commit), without the secret
+func describe(l *Leak) string {
+	s := fmt.Sprintf("%s:%d: %s", l.File, l.StartLine, l.RuleID)
+	if l.Commit != "" {
+		s += fmt.Sprintf(" (commit %.12s by %s)", l.Commit, l.Author)
+	}
+
+	return s
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Gitleaks) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
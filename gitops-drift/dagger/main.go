@@ -0,0 +1,322 @@
+// This module detects the drift between a GitOps repository and the live clusters, with flux diff kustomization.
+//
+// It is meant to run on a schedule, once per cluster: the Flux Kustomizations of the cluster are discovered,
+// diffed against the repository, and the drifted ones reported. A GitHub issue can be opened with the gh module.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"slices"
+	"strings"
+	"time"
+)
+
+type GitopsDrift struct {
+	// The GitOps repository the clusters are reconciled from
+	// +private
+	Source *Directory
+	// The version of the Flux CLI (ex: v2.2.3)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new GitopsDrift module comparing the repository with the clusters
+func New(
+	// The GitOps repository the clusters are reconciled from
+	// +required
+	source *Directory,
+	// The version of the Flux CLI
+	// +optional
+	// +default="v2.2.3"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *GitopsDrift {
+	return &GitopsDrift{
+		Source:       source,
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ClusterDrift struct {
+	// Name of the cluster
+	Cluster string
+	// Whether at least one Kustomization drifted
+	Drifted        bool
+	Kustomizations []*KustomizationDrift
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type KustomizationDrift struct {
+	Namespace string
+	Name      string
+	// Path of the Kustomization, relative to the repository
+	Path    string
+	Drifted bool
+	// Output of flux diff, listing the drifted objects and their diff
+	Diff string
+}
+
+type kustomizations struct {
+	Items []struct {
+		Metadata struct {
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			Path      string `json:"path"`
+			Suspend   bool   `json:"suspend"`
+			SourceRef struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"sourceRef"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// Detect diffs every Kustomization of the cluster reconciled from the repository source against the repository.
+//
+// Example usage: dagger call --source=. detect --cluster=prod --kubeconfig=file:$HOME/.kube/config report export --path=drift-prod.md
+func (m *GitopsDrift) Detect(
+	ctx context.Context,
+	// Name of the cluster, used in the report
+	// +required
+	cluster string,
+	// Kubeconfig giving read access to the cluster
+	// +required
+	kubeconfig *Secret,
+	// Name of the GitRepository the Kustomizations of the repository are reconciled from
+	// +optional
+	// +default="flux-system"
+	sourceName string,
+	// Kustomizations skipped, as namespace/name (ex: flux-system/flux-system)
+	// +optional
+	exclude []string,
+) (result *ClusterDrift, err error) {
+	s := m.startSpan(ctx, "Detect")
+	defer s.End(&err)
+
+	// The cluster state changes outside of Dagger, so commands are never cached
+	c := m.withProxy(dag.Container().From("ghcr.io/fluxcd/flux-cli:"+m.Version)).
+		WithMountedSecret("/tmp/kubeconfig", kubeconfig).
+		WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithDirectory("/workspace", m.Source).
+		WithWorkdir("/workspace")
+
+	out, err := c.
+		WithExec([]string{
+			"kubectl", "get", "kustomizations.kustomize.toolkit.fluxcd.io", "--all-namespaces", "--output", "json",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list kustomizations of %s: %w", cluster, commandError(err))
+	}
+
+	var listed kustomizations
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kustomizations of %s: %w", cluster, err)
+	}
+
+	drift := &ClusterDrift{
+		Cluster:        cluster,
+		Kustomizations: []*KustomizationDrift{},
+		ProxyURL:       m.ProxyURL,
+		NoProxy:        m.NoProxy,
+		CABundle:       m.CABundle,
+		OtlpEndpoint:   m.OtlpEndpoint,
+		OtlpHeaders:    m.OtlpHeaders,
+		Traceparent:    m.Traceparent,
+	}
+	for _, k := range listed.Items {
+		id := k.Metadata.Namespace + "/" + k.Metadata.Name
+		if k.Spec.Suspend || k.Spec.SourceRef.Kind != "GitRepository" || k.Spec.SourceRef.Name != sourceName || slices.Contains(exclude, id) {
+			continue
+		}
+
+		kd := &KustomizationDrift{Namespace: k.Metadata.Namespace, Name: k.Metadata.Name, Path: k.Spec.Path}
+		// flux diff exits with 1 both on drift and on errors, drift is told apart by its output
+		diff := c.WithExec([]string{
+			"sh", "-c", `flux diff kustomization "$1" --namespace "$2" --path "./$3" --progress-bar=false > /tmp/diff 2> /tmp/stderr; echo $? > /tmp/exit-code`,
+			"sh", kd.Name, kd.Namespace, strings.TrimPrefix(kd.Path, "./"),
+		}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+		exitCode, err := diff.File("/tmp/exit-code").Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %s on %s: %w", id, cluster, commandError(err))
+		}
+		output, err := diff.File("/tmp/diff").Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read diff of %s on %s: %w", id, cluster, commandError(err))
+		}
+
+		switch code := strings.TrimSpace(exitCode); {
+		case code == "0":
+		case code == "1" && strings.TrimSpace(output) != "":
+			kd.Drifted = true
+			kd.Diff = output
+			drift.Drifted = true
+		default:
+			stderr, _ := diff.File("/tmp/stderr").Contents(ctx)
+			return nil, commandFailures.Type(fmt.Errorf("failed to diff %s on %s, exited with %s: %s", id, cluster, code, stderr), stderr)
+		}
+
+		drift.Kustomizations = append(drift.Kustomizations, kd)
+	}
+
+	return drift, nil
+}
+
+// markdown returns the drift report of the cluster in Markdown
+func (r *ClusterDrift) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# GitOps drift of %s\n\n", r.Cluster)
+	if !r.Drifted {
+		fmt.Fprintf(&b, "No drift in the %d Kustomizations.\n", len(r.Kustomizations))
+		return b.String()
+	}
+
+	b.WriteString("| Kustomization | Path | Drifted |\n| --- | --- | --- |\n")
+	for _, k := range r.Kustomizations {
+		drifted := "no"
+		if k.Drifted {
+			drifted = "**yes**"
+		}
+		fmt.Fprintf(&b, "| %s/%s | `%s` | %s |\n", k.Namespace, k.Name, k.Path, drifted)
+	}
+	for _, k := range r.Kustomizations {
+		if k.Drifted {
+			fmt.Fprintf(&b, "\n## %s/%s\n\n```diff\n%s\n```\n", k.Namespace, k.Name, strings.TrimSpace(k.Diff))
+		}
+	}
+
+	return b.String()
+}
+
+// Report returns the drift report of the cluster as a Markdown file
+//
+// Example usage: dagger call --source=. detect --cluster=prod --kubeconfig=file:$HOME/.kube/config report export --path=drift-prod.md
+func (r *ClusterDrift) Report(ctx context.Context) *File {
+	s := r.startSpan(ctx, "Report")
+	defer s.End(nil)
+
+	return dag.Directory().WithNewFile("drift-"+r.Cluster+".md", r.markdown()).File("drift-" + r.Cluster + ".md")
+}
+
+// OpenIssue opens a GitHub issue with the drift report when drift was detected, or comments on the open issue of
+// the cluster, and returns its URL. Nothing is opened without drift.
+//
+// Example usage: dagger call --source=. detect --cluster=prod --kubeconfig=file:$HOME/.kube/config open-issue --repo=. --token=env:GITHUB_TOKEN
+func (r *ClusterDrift) OpenIssue(
+	ctx context.Context,
+	// The repository the issue is opened in, including its .git directory
+	// +required
+	repo *Directory,
+	// Token allowed to open issues
+	// +required
+	token *Secret,
+	// Labels of the issue, which must exist in the repository
+	// +optional
+	labels []string,
+) (out string, err error) {
+	s := r.startSpan(ctx, "OpenIssue")
+	defer s.End(&err)
+
+	if !r.Drifted {
+		return fmt.Sprintf("No drift on %s", r.Cluster), nil
+	}
+
+	title := "GitOps drift detected on " + r.Cluster
+	// The report stays untracked, its timestamp makes sure the calls are never cached
+	dir := repo.
+		WithNewFile(".drift/body.md", r.markdown()).
+		WithNewFile(".drift/timestamp", time.Now().String())
+	gh := dag.Gh(token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+
+	existing, err := gh.RunGh(ctx, dir, fmt.Sprintf(
+		"issue list --state open --search %s --json title,url --jq %s",
+		shell.Quote("in:title "+title), shell.Quote(fmt.Sprintf(".[] | select(.title == %q) | .url", title)),
+	))
+	if err != nil {
+		return "", fmt.Errorf("failed to search drift issues: %w", err)
+	}
+	if url := strings.TrimSpace(existing); url != "" {
+		url, _, _ = strings.Cut(url, "\n")
+		if _, err := gh.RunGh(ctx, dir, "issue comment "+shell.Quote(url)+" --body-file .drift/body.md"); err != nil {
+			return "", fmt.Errorf("failed to comment on %s: %w", url, err)
+		}
+		return url, nil
+	}
+
+	cmd := "issue create --title " + shell.Quote(title) + " --body-file .drift/body.md"
+	for _, l := range labels {
+		cmd += " --label " + shell.Quote(l)
+	}
+	url, err := gh.RunGh(ctx, dir, cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to open drift issue: %w", err)
+	}
+
+	return strings.TrimSpace(url), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *GitopsDrift) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
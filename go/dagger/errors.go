@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the go commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"build failed", "undefined:", "cannot use"},
+	AuthHint:       "check the GOPRIVATE credentials of the private modules",
+	ValidationHint: "fix the code reported by the go tool",
+}
+
+// commandError types the error of a go command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,292 @@
+// This module builds, tests, lints and vulnerability-checks Go modules, caching the module and build caches.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type Go struct {
+	// The version of Go (ex: 1.22.1)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Go module pinned to the provided Go version
+func New(
+	// The version of Go
+	// +optional
+	// +default="1.22.1"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Go {
+	return &Go{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type TestResult struct {
+	// go test output
+	Output string
+	// Coverage profile
+	Coverage *File
+	// Total coverage of the statements (ex: 81.3%)
+	CoverageTotal string
+}
+
+// base returns a Go container with the sources and the module and build caches
+func (m *Go) base(source *Directory) *Container {
+	return m.withProxy(dag.Container().From("golang:"+m.Version)).
+		With(withGoCaches).
+		WithDirectory("/src", source).
+		WithWorkdir("/src")
+}
+
+// withGoCaches mounts the module and build caches, shared by every Go version
+func withGoCaches(c *Container) *Container {
+	return c.
+		WithMountedCache("/go/pkg/mod", dag.CacheVolume("go-mod")).
+		WithEnvVariable("GOMODCACHE", "/go/pkg/mod").
+		WithMountedCache("/root/.cache/go-build", dag.CacheVolume("go-build")).
+		WithEnvVariable("GOCACHE", "/root/.cache/go-build")
+}
+
+// Test runs the tests with a coverage profile, and the race detector unless disabled.
+//
+// Example usage: dagger call test --source=. coverage export --path=coverage.out
+func (m *Go) Test(
+	ctx context.Context,
+	// The Go module
+	// +required
+	source *Directory,
+	// Packages to test
+	// +optional
+	// +default=["./..."]
+	packages []string,
+	// Enable the race detector
+	// +optional
+	// +default=true
+	race bool,
+	// Run only the tests matching the regular expression
+	// +optional
+	run string,
+) (result *TestResult, err error) {
+	s := m.startSpan(ctx, "Test")
+	defer s.End(&err)
+
+	args := []string{"go", "test", "-coverprofile=/tmp/coverage.out", "-covermode=atomic"}
+	if race {
+		args = append(args, "-race")
+	}
+	if run != "" {
+		args = append(args, "-run", run)
+	}
+	args = append(args, packages...)
+
+	c := m.base(source).
+		WithEnvVariable("CGO_ENABLED", "1").
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	output, err := c.Stdout(ctx)
+	if err != nil {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("go test failed: %w", err), Hint: "fix the failing tests"}
+	}
+
+	cover, err := c.
+		WithExec([]string{"go", "tool", "cover", "-func=/tmp/coverage.out"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute coverage: %w", commandError(err))
+	}
+
+	total := ""
+	lines := strings.Split(strings.TrimSpace(cover), "\n")
+	if fields := strings.Fields(lines[len(lines)-1]); len(fields) > 0 && fields[0] == "total:" {
+		total = fields[len(fields)-1]
+	}
+
+	return &TestResult{
+		Output:        output,
+		Coverage:      c.File("/tmp/coverage.out"),
+		CoverageTotal: total,
+	}, nil
+}
+
+// Lint runs golangci-lint, with the configuration of the sources when present.
+//
+// Example usage: dagger call lint --source=.
+func (m *Go) Lint(
+	ctx context.Context,
+	// The Go module
+	// +required
+	source *Directory,
+	// The version of golangci-lint
+	// +optional
+	// +default="v1.57.2"
+	version string,
+	// Timeout of the analysis
+	// +optional
+	// +default="5m"
+	timeout string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Lint")
+	defer s.End(&err)
+
+	out, err := m.withProxy(dag.Container().From("golangci/golangci-lint:"+version)).
+		With(withGoCaches).
+		WithMountedCache("/root/.cache/golangci-lint", dag.CacheVolume("golangci-lint")).
+		WithDirectory("/src", source).
+		WithWorkdir("/src").
+		WithExec([]string{"golangci-lint", "run", "--timeout", timeout, "./..."}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("golangci-lint found issues: %w", err),
+			Hint: "fix the issues reported by golangci-lint",
+		}
+	}
+
+	return out, nil
+}
+
+// Build cross-compiles the packages for each platform, returning a directory with one <os>_<arch> directory per platform.
+//
+// Example usage: dagger call build --source=. --packages=./cmd/... --platforms=linux/amd64,linux/arm64,darwin/arm64 export --path=dist
+func (m *Go) Build(
+	ctx context.Context,
+	// The Go module
+	// +required
+	source *Directory,
+	// Packages to build
+	// +optional
+	// +default=["./..."]
+	packages []string,
+	// Platforms to build for (GOOS/GOARCH)
+	// +optional
+	// +default=["linux/amd64", "linux/arm64"]
+	platforms []string,
+	// Linker flags (ex: -s -w -X main.version=1.2.3)
+	// +optional
+	ldflags string,
+	// Enable cgo
+	// +optional
+	cgo bool,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Build")
+	defer s.End(&err)
+
+	cgoEnabled := "0"
+	if cgo {
+		cgoEnabled = "1"
+	}
+
+	dist := dag.Directory()
+	for _, platform := range platforms {
+		goos, goarch, ok := strings.Cut(platform, "/")
+		if !ok {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid platform %q, expected GOOS/GOARCH", platform),
+				Hint: "use a GOOS/GOARCH platform, ex: linux/amd64",
+			}
+		}
+		out := goos + "_" + goarch
+
+		args := []string{"go", "build", "-trimpath", "-o", "/dist/" + out + "/"}
+		if ldflags != "" {
+			args = append(args, "-ldflags", ldflags)
+		}
+		args = append(args, packages...)
+
+		dist = dist.WithDirectory(out, m.base(source).
+			WithEnvVariable("GOOS", goos).
+			WithEnvVariable("GOARCH", goarch).
+			WithEnvVariable("CGO_ENABLED", cgoEnabled).
+			WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+			Directory("/dist/"+out))
+	}
+
+	return dist, nil
+}
+
+// Vulncheck reports the known vulnerabilities affecting the code of the module with govulncheck.
+//
+// Example usage: dagger call vulncheck --source=.
+func (m *Go) Vulncheck(
+	ctx context.Context,
+	// The Go module
+	// +required
+	source *Directory,
+	// The version of govulncheck
+	// +optional
+	// +default="v1.0.4"
+	version string,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Vulncheck")
+	defer s.End(&err)
+
+	out, err := m.base(source).
+		WithExec([]string{"go", "install", "golang.org/x/vuln/cmd/govulncheck@" + version}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		// New vulnerabilities are published daily, recheck at least once a day
+		WithEnvVariable("CACHE_BUSTER", time.Now().Truncate(24*time.Hour).String()).
+		WithExec([]string{"govulncheck", "./..."}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("govulncheck found vulnerabilities: %w", err),
+			Hint: "upgrade the vulnerable modules reported by govulncheck",
+		}
+	}
+
+	return out, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Go) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxAnnotations is the number of annotations GitHub accepts per check run request
+const maxAnnotations = 50
+
+type annotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+}
+
+// annotations returns the findings as GitHub check run annotations
+func (r *LintResult) annotations() []annotation {
+	annotations := []annotation{}
+	for _, f := range r.Findings {
+		level := "notice"
+		switch f.Level {
+		case "error":
+			level = "failure"
+		case "warning":
+			level = "warning"
+		}
+		line := max(f.Line, 1)
+		annotations = append(annotations, annotation{
+			Path:            f.File,
+			StartLine:       line,
+			EndLine:         line,
+			AnnotationLevel: level,
+			Title:           f.Code,
+			Message:         f.Message,
+		})
+	}
+
+	return annotations
+}
+
+// Annotations returns the findings as a JSON array of GitHub check run annotations
+//
+// Example usage: dagger call lint --source=. annotations export --path=annotations.json
+func (r *LintResult) Annotations(ctx context.Context) (file *File, err error) {
+	s := r.startSpan(ctx, "Annotations")
+	defer s.End(&err)
+
+	content, err := json.MarshalIndent(r.annotations(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal annotations: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("annotations.json", string(content)).File("annotations.json"), nil
+}
+
+// PublishCheckRun publishes the findings as a completed check run of the commit, annotating the Dockerfiles, and returns its URL
+//
+// Example usage: dagger call lint --source=. publish-check-run --repo=. --token=env:GITHUB_TOKEN --sha=$GITHUB_SHA
+func (r *LintResult) PublishCheckRun(
+	ctx context.Context,
+	// The repository, including its .git directory, its origin remote selects the GitHub repository
+	// +required
+	repo *Directory,
+	// Token allowed to write check runs (ex: the GitHub App token of the workflow)
+	// +required
+	token *Secret,
+	// Commit the check run is attached to
+	// +required
+	sha string,
+	// Name of the check run
+	// +optional
+	// +default="hadolint"
+	name string,
+) (result string, err error) {
+	s := r.startSpan(ctx, "PublishCheckRun")
+	defer s.End(&err)
+
+	conclusion := "success"
+	if !r.Passed {
+		conclusion = "failure"
+	}
+	output := map[string]any{
+		"title":   fmt.Sprintf("%d findings", len(r.Findings)),
+		"summary": fmt.Sprintf("hadolint reported %d findings, failing at or above %s.", len(r.Findings), r.FailureThreshold),
+	}
+
+	// GitHub accepts 50 annotations per request: the check run is created with the first ones, and updated with the others
+	annotations := r.annotations()
+	chunks := [][]annotation{}
+	for start := 0; start < len(annotations); start += maxAnnotations {
+		chunks = append(chunks, annotations[start:min(start+maxAnnotations, len(annotations))])
+	}
+	if len(chunks) == 0 {
+		chunks = append(chunks, []annotation{})
+	}
+
+	gh := dag.Gh(token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+	var id, url string
+	for i, chunk := range chunks {
+		output["annotations"] = chunk
+		payload := map[string]any{"output": output}
+		cmd := fmt.Sprintf("api -X PATCH repos/{owner}/{repo}/check-runs/%s --input .check-run/payload.json --jq '.id,.html_url'", id)
+		if i == 0 {
+			payload["name"] = name
+			payload["head_sha"] = sha
+			payload["status"] = "completed"
+			payload["conclusion"] = conclusion
+			cmd = "api -X POST repos/{owner}/{repo}/check-runs --input .check-run/payload.json --jq '.id,.html_url'"
+		}
+
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal check run: %w", err)
+		}
+		// The payload stays untracked, its timestamp makes sure the call is never cached
+		dir := repo.
+			WithNewFile(".check-run/payload.json", string(content)).
+			WithNewFile(".check-run/timestamp", time.Now().String())
+
+		out, err := gh.RunGh(ctx, dir, cmd)
+		if err != nil {
+			return "", fmt.Errorf("failed to publish check run %s: %w", name, err)
+		}
+		fields := strings.Fields(out)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("unexpected check run response: %s", out)
+		}
+		id, url = fields[0], fields[1]
+	}
+
+	return url, nil
+}
@@ -0,0 +1,263 @@
+// This module lints Dockerfiles with hadolint, enforcing the same Dockerfile hygiene across the repositories.
+//
+// Findings are returned as SARIF for GitHub code scanning, and as GitHub check run annotations published
+// with the gh module.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+	"strings"
+)
+
+// levels are hadolint levels, from the most to the least severe
+var levels = []string{"error", "warning", "info", "style"}
+
+// defaultPatterns match the usual Dockerfile names
+var defaultPatterns = []string{"**/Dockerfile", "**/Dockerfile.*", "**/*.Dockerfile"}
+
+type Hadolint struct {
+	// The version of hadolint (ex: v2.12.0)
+	// +private
+	Version string
+	// Shared hadolint config
+	// +private
+	Config *File
+	// Level at or above which the lint fails
+	// +private
+	FailureThreshold string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Hadolint module pinned to the provided hadolint version, linting with the shared config
+func New(
+	// The version of hadolint
+	// +optional
+	// +default="v2.12.0"
+	version string,
+	// Shared hadolint config (.hadolint.yaml), defaults to the config of every linted repository when present
+	// +optional
+	config *File,
+	// Level at or above which the lint fails: error, warning, info or style
+	// +optional
+	// +default="warning"
+	failureThreshold string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Hadolint, error) {
+	if !slices.Contains(levels, failureThreshold) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid failure threshold %q, expected one of %s", failureThreshold, strings.Join(levels, ", ")),
+			Hint: "use one of the expected failure thresholds",
+		}
+	}
+
+	return &Hadolint{
+		Version:          version,
+		Config:           config,
+		FailureThreshold: failureThreshold,
+		ProxyURL:         proxyUrl,
+		NoProxy:          noProxy,
+		CABundle:         caBundle,
+		OtlpEndpoint:     otlpEndpoint,
+		OtlpHeaders:      otlpHeaders,
+		Traceparent:      traceparent,
+	}, nil
+}
+
+type LintResult struct {
+	// Whether no finding reaches the failure threshold
+	Passed   bool
+	Findings []*Finding
+	// SARIF report, suitable for GitHub code scanning
+	Sarif *File
+	// +private
+	FailureThreshold string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Finding struct {
+	// Dockerfile, relative to the linted directory
+	File   string
+	Line   int
+	Column int
+	// Rule code (ex: DL3008, SC2086)
+	Code string
+	// error, warning, info or style
+	Level   string
+	Message string
+}
+
+type hadolintFinding struct {
+	Code    string `json:"code"`
+	Column  int    `json:"column"`
+	File    string `json:"file"`
+	Level   string `json:"level"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// Lint runs hadolint over the Dockerfiles of the directory.
+//
+// Example usage: dagger call --config=./.hadolint.yaml lint --source=. check
+func (m *Hadolint) Lint(
+	ctx context.Context,
+	// Directory holding the Dockerfiles
+	// +required
+	source *Directory,
+	// Glob patterns of the Dockerfiles, defaults to Dockerfile, Dockerfile.* and *.Dockerfile at any depth
+	// +optional
+	patterns []string,
+) (lintResult *LintResult, err error) {
+	s := m.startSpan(ctx, "Lint")
+	defer s.End(&err)
+
+	if len(patterns) == 0 {
+		patterns = defaultPatterns
+	}
+
+	files := []string{}
+	for _, p := range patterns {
+		matches, err := source.Glob(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list dockerfiles: %w", err)
+		}
+		for _, f := range matches {
+			if !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	slices.Sort(files)
+
+	result := &LintResult{
+		Passed:           true,
+		Findings:         []*Finding{},
+		FailureThreshold: m.FailureThreshold,
+		ProxyURL:         m.ProxyURL,
+		NoProxy:          m.NoProxy,
+		CABundle:         m.CABundle,
+		OtlpEndpoint:     m.OtlpEndpoint,
+		OtlpHeaders:      m.OtlpHeaders,
+		Traceparent:      m.Traceparent,
+	}
+	if len(files) == 0 {
+		result.Sarif = dag.Directory().WithNewFile("hadolint.sarif", `{"version":"2.1.0","runs":[]}`).File("hadolint.sarif")
+		return result, nil
+	}
+
+	c := m.withProxy(dag.Container().From("hadolint/hadolint:"+m.Version+"-alpine")).
+		WithDirectory("/workspace", source).
+		WithWorkdir("/workspace")
+	args := []string{"hadolint", "--no-fail"}
+	if m.Config != nil {
+		c = c.WithFile("/tmp/hadolint.yaml", m.Config)
+		args = append(args, "--config", "/tmp/hadolint.yaml")
+	}
+
+	out, err := c.
+		WithExec(append(append(args, "--format", "json"), files...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run hadolint: %w", commandError(err))
+	}
+
+	var findings []hadolintFinding
+	if err := json.Unmarshal([]byte(out), &findings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hadolint output: %w", err)
+	}
+	threshold := slices.Index(levels, m.FailureThreshold)
+	for _, f := range findings {
+		result.Findings = append(result.Findings, &Finding{
+			File:    f.File,
+			Line:    f.Line,
+			Column:  f.Column,
+			Code:    f.Code,
+			Level:   f.Level,
+			Message: f.Message,
+		})
+		if i := slices.Index(levels, f.Level); i >= 0 && i <= threshold {
+			result.Passed = false
+		}
+	}
+
+	script := strings.Join(args, " ") + ` --format sarif "$@" > /tmp/hadolint.sarif`
+	result.Sarif = c.
+		WithExec(append([]string{"sh", "-c", script, "sh"}, files...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/tmp/hadolint.sarif")
+
+	return result, nil
+}
+
+// Check fails when a finding reaches the failure threshold, and returns the number of findings otherwise
+func (r *LintResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, f := range r.Findings {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s %s: %s", f.File, f.Line, f.Level, f.Code, f.Message))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("findings at or above %s:\n%s", r.FailureThreshold, strings.Join(lines, "\n")),
+			Hint: "fix the Dockerfile instructions or ignore their rules in .hadolint.yaml",
+		}
+	}
+
+	return fmt.Sprintf("%d findings below %s", len(r.Findings), r.FailureThreshold), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Hadolint) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
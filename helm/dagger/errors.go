@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the helm commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"chart.yaml file is missing", "template: ", "execution error"},
+	AuthHint:       "check the credentials of the chart registry",
+	ValidationHint: "fix the chart templates and values reported by helm",
+}
+
+// commandError types the error of a helm command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
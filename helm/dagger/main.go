@@ -0,0 +1,270 @@
+// This module lints, renders, packages and publishes Helm charts.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Helm struct {
+	// The version of helm (ex: 3.14.2)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Helm module pinned to the provided helm version
+func New(
+	// The version of helm
+	// +optional
+	// +default="3.14.2"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Helm {
+	return &Helm{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// base returns a container with the pinned helm CLI and the chart mounted in /chart
+func (m *Helm) base(chart *Directory) *Container {
+	return m.withProxy(dag.Container().From("alpine/helm:"+m.Version)).
+		WithDirectory("/chart", chart).
+		WithWorkdir("/chart")
+}
+
+// withValues mounts the values files in order and returns the matching --values flags.
+// Later files override earlier ones, so per-environment overrides must come last.
+func withValues(c *Container, valuesFiles []*File) (*Container, []string) {
+	var args []string
+	for i, f := range valuesFiles {
+		p := fmt.Sprintf("/values/%02d.yaml", i)
+		c = c.WithFile(p, f)
+		args = append(args, "--values", p)
+	}
+
+	return c, args
+}
+
+// Lint runs helm lint against the chart.
+//
+// Example usage: dagger call lint --chart=./charts/my-chart --values-files=./charts/my-chart/values-prod.yaml
+func (m *Helm) Lint(
+	ctx context.Context,
+	// Directory of the chart
+	// +required
+	chart *Directory,
+	// Values files, later files override earlier ones
+	// +optional
+	valuesFiles []*File,
+	// Fail on lint warnings
+	// +optional
+	strict bool,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Lint")
+	defer s.End(&err)
+
+	c, values := withValues(m.base(chart), valuesFiles)
+
+	args := append([]string{"helm", "lint", ".", "--with-subcharts"}, values...)
+	if strict {
+		args = append(args, "--strict")
+	}
+
+	out, err := c.
+		WithExec([]string{"helm", "dependency", "update"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to lint chart: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// Template renders the chart manifests with the provided values.
+//
+// Example usage: dagger call template --chart=./charts/my-chart --values-files=values.yaml,values-prod.yaml --set=image.tag=1.2.3 export --path=manifests.yaml
+func (m *Helm) Template(
+	ctx context.Context,
+	// Directory of the chart
+	// +required
+	chart *Directory,
+	// Name of the release
+	// +optional
+	// +default="release"
+	releaseName string,
+	// Namespace of the release
+	// +optional
+	// +default="default"
+	namespace string,
+	// Values files, later files override earlier ones (ex: values.yaml,values-prod.yaml)
+	// +optional
+	valuesFiles []*File,
+	// Values set on the command line, applied after the values files (ex: image.tag=1.2.3)
+	// +optional
+	set []string,
+) (file *File, err error) {
+	span := m.startSpan(ctx, "Template")
+	defer span.End(&err)
+
+	c, values := withValues(m.base(chart), valuesFiles)
+
+	args := append([]string{"helm", "template", releaseName, ".", "--namespace", namespace}, values...)
+	for _, s := range set {
+		args = append(args, "--set", s)
+	}
+
+	f := c.
+		WithExec([]string{"helm", "dependency", "update"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true, RedirectStdout: "/tmp/manifests.yaml"}).
+		File("/tmp/manifests.yaml")
+	if _, err := f.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to template chart: %w", commandError(err))
+	}
+
+	return f, nil
+}
+
+// Package packages the chart into a versioned archive.
+//
+// Example usage: dagger call package --chart=./charts/my-chart --version=1.2.3 export --path=.
+func (m *Helm) Package(
+	ctx context.Context,
+	// Directory of the chart
+	// +required
+	chart *Directory,
+	// Version of the chart, defaults to the one in Chart.yaml
+	// +optional
+	version string,
+	// Version of the application, defaults to the one in Chart.yaml
+	// +optional
+	appVersion string,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Package")
+	defer s.End(&err)
+
+	args := []string{"helm", "package", ".", "--destination", "/tmp/package"}
+	if version != "" {
+		args = append(args, "--version", version)
+	}
+	if appVersion != "" {
+		args = append(args, "--app-version", appVersion)
+	}
+
+	out := m.base(chart).
+		WithExec([]string{"helm", "dependency", "update"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/tmp/package")
+
+	entries, err := out.Entries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to package chart: %w", commandError(err))
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("failed to package chart: expected one archive, got %v", entries)
+	}
+
+	return out.File(entries[0]), nil
+}
+
+// Push publishes a packaged chart to an OCI registry and returns the helm push output (including the digest).
+//
+// Example usage: dagger call push --pkg=./my-chart-1.2.3.tgz --registry=oci://ghcr.io/adore-me/charts --username=bot --password=env:REGISTRY_TOKEN
+func (m *Helm) Push(
+	ctx context.Context,
+	// Chart archive created by package
+	// +required
+	pkg *File,
+	// OCI registry and repository prefix (ex: oci://ghcr.io/adore-me/charts)
+	// +required
+	registry string,
+	// Registry username
+	// +required
+	username string,
+	// Registry password or token
+	// +required
+	password *Secret,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Push")
+	defer s.End(&err)
+
+	u, err := url.Parse(registry)
+	if err != nil || u.Scheme != "oci" {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid registry %q, expected oci://<host>/<path>", registry),
+			Hint: "use an oci://<host>/<path> registry",
+		}
+	}
+
+	out, err := m.withProxy(dag.Container().From("alpine/helm:"+m.Version)).
+		WithFile("/tmp/chart.tgz", pkg).
+		WithSecretVariable("REGISTRY_PASSWORD", password).
+		// Pushes must always hit the registry
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(
+			[]string{"sh", "-c", strings.Join([]string{
+				"echo \"$REGISTRY_PASSWORD\" | helm registry login", u.Host, "--username", username, "--password-stdin",
+				"&&", "helm push /tmp/chart.tgz", registry,
+			}, " ")},
+			ContainerWithExecOpts{SkipEntrypoint: true, RedirectStderr: "/tmp/push.log"},
+		).
+		File("/tmp/push.log").
+		Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to push chart: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Helm) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
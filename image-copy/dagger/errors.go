@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the crane or cosign commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"digest mismatch"},
+	AuthHint:       "check the credentials of the source and destination registries",
+	ValidationHint: "check the source and destination image references",
+}
+
+// commandError types the error of a crane or cosign command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
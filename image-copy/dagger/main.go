@@ -0,0 +1,211 @@
+// This module copies and promotes images between registries, preserving their digest along with their
+// cosign signatures, attestations and SBOMs.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type ImageCopy struct {
+	// The version of crane (ex: v0.19.1)
+	// +private
+	CraneVersion string
+	// The version of cosign (ex: v2.2.3)
+	// +private
+	CosignVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new ImageCopy module pinned to the provided crane and cosign versions
+func New(
+	// The version of crane, used to copy images without their signatures and to check digests
+	// +optional
+	// +default="v0.19.1"
+	craneVersion string,
+	// The version of cosign, used to copy images with their signatures and attestations
+	// +optional
+	// +default="v2.2.3"
+	cosignVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *ImageCopy {
+	return &ImageCopy{
+		CraneVersion:  craneVersion,
+		CosignVersion: cosignVersion,
+		ProxyURL:      proxyUrl,
+		NoProxy:       noProxy,
+		CABundle:      caBundle,
+		OtlpEndpoint:  otlpEndpoint,
+		OtlpHeaders:   otlpHeaders,
+		Traceparent:   traceparent,
+	}
+}
+
+// Copy copies the src image to dst and returns dst pinned to its digest, which is checked to match the src digest.
+// Signatures, attestations and SBOMs attached with cosign are copied along unless disabled.
+//
+// Example usage: dagger call copy --src=123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.2.3 --src-username=AWS --src-password=env:STAGING_ECR_PASSWORD --dst=210987654321.dkr.ecr.us-east-1.amazonaws.com/app:1.2.3 --dst-username=AWS --dst-password=env:PROD_ECR_PASSWORD
+func (m *ImageCopy) Copy(
+	ctx context.Context,
+	// Source image reference
+	// +required
+	src string,
+	// Destination image reference
+	// +required
+	dst string,
+	// Source registry username
+	// +optional
+	srcUsername string,
+	// Source registry password or token
+	// +optional
+	srcPassword *Secret,
+	// Destination registry username
+	// +optional
+	dstUsername string,
+	// Destination registry password or token
+	// +optional
+	dstPassword *Secret,
+	// Copy the cosign signatures, attestations and SBOMs of the image
+	// +optional
+	// +default=true
+	signatures bool,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Copy")
+	defer s.End(&err)
+
+	var auths []registryauth.Auth
+	if srcPassword != nil {
+		auths = append(auths, registryauth.Auth{Registry: registryauth.Host(src), Username: srcUsername, Password: srcPassword})
+	}
+	if dstPassword != nil {
+		auths = append(auths, registryauth.Auth{Registry: registryauth.Host(dst), Username: dstUsername, Password: dstPassword})
+	}
+
+	config, err := dockerConfig(ctx, auths)
+	if err != nil {
+		return "", err
+	}
+
+	srcDigest, err := m.digest(ctx, config, src)
+	if err != nil {
+		return "", err
+	}
+
+	c := m.withProxy(dag.Container().From("gcr.io/go-containerregistry/crane:"+m.CraneVersion)).
+		WithExec([]string{"crane", "copy", src, dst}, ContainerWithExecOpts{SkipEntrypoint: true})
+	if signatures {
+		c = m.withProxy(dag.Container().From("gcr.io/projectsigstore/cosign:"+m.CosignVersion)).
+			WithExec([]string{"cosign", "copy", "--force", src, dst}, ContainerWithExecOpts{SkipEntrypoint: true})
+	}
+
+	_, err = withDockerConfig(c, config).Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s to %s: %w", src, dst, commandError(err))
+	}
+
+	dstDigest, err := m.digest(ctx, config, dst)
+	if err != nil {
+		return "", err
+	}
+	if dstDigest != srcDigest {
+		return "", &typederr.ConflictError{
+			Err:  fmt.Errorf("digest of %s is %s, expected %s", dst, dstDigest, srcDigest),
+			Hint: "the source image changed during the copy, copy it again",
+		}
+	}
+
+	ref, _, _ := strings.Cut(dst, "@")
+
+	return ref + "@" + dstDigest, nil
+}
+
+// digest resolves the digest of the image
+func (m *ImageCopy) digest(ctx context.Context, config *Secret, ref string) (string, error) {
+	c := m.withProxy(dag.Container().From("gcr.io/go-containerregistry/crane:" + m.CraneVersion))
+
+	// Tags move in the registries, withDockerConfig makes sure they are always resolved again
+	out, err := withDockerConfig(c, config).
+		WithExec([]string{"crane", "digest", ref}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest of %s: %w", ref, commandError(err))
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// withDockerConfig mounts the docker config when set. Copies always hit the registries, so they are never cached.
+func withDockerConfig(c *Container, config *Secret) *Container {
+	c = c.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	if config == nil {
+		return c
+	}
+
+	return c.
+		WithMountedSecret("/root/.docker/config.json", config).
+		WithEnvVariable("DOCKER_CONFIG", "/root/.docker")
+}
+
+// dockerConfig returns a docker config.json authenticating against the registries, nil without credentials
+func dockerConfig(ctx context.Context, auths []registryauth.Auth) (*Secret, error) {
+	if len(auths) == 0 {
+		return nil, nil
+	}
+
+	config, err := registryauth.DockerConfig(ctx, auths...)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{}
+	for _, a := range auths {
+		hosts = append(hosts, a.Registry)
+	}
+
+	return dag.SetSecret("docker-config-"+strings.Join(hosts, "-"), config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *ImageCopy) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+)
+
+// get GET the endpoint and return the response body
+func (m *IngressNginx) get(ctx context.Context, endpoint string) (string, error) {
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", typederr.FromResponse(resp, fmt.Errorf("failed to get %s: unexpected status %s", endpoint, resp.Status))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return string(body), nil
+}
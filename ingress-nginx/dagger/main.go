@@ -0,0 +1,349 @@
+// This module handles the version management of the ingress-nginx Helm chart.
+//
+// It relies on the version-bumper module to track the chart releases, maps each chart version to its
+// controller version and only proposes the versions supporting the Kubernetes version of the cluster.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strings"
+)
+
+// chartTagPrefix is the prefix of the chart release tags, the controller releases are tagged controller-v*
+const chartTagPrefix = "helm-chart-"
+
+// compatibilityRow matches the rows of the supported versions table of the ingress-nginx README:
+// | Supported | Ingress-NGINX version | k8s supported version | Alpine Version | Nginx Version | Helm Chart Version |
+var compatibilityRow = regexp.MustCompile(`^\|[^|]*\|\s*\**v?([0-9.]+)\**\s*\|([^|]*)\|[^|]*\|[^|]*\|\s*([0-9.]+)\*?\s*\|`)
+
+type IngressNginx struct {
+	LatestVersion string
+	LocalVersion  string
+	// Controller version of the latest chart version
+	LatestControllerVersion string
+	// +private
+	Manifest *File
+	// +private
+	Key string
+	// +private
+	Constraint string
+	// +private
+	KubernetesVersion string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new IngressNginx module comparing the latest chart release supporting the Kubernetes version with the version pinned in the HelmRelease
+//
+// Example usage: dagger call --manifest=clusters/dev/ingress-nginx/helmrelease.yaml --kubernetes-version=1.28 report export --path=report.json
+func New(
+	ctx context.Context,
+	// HelmRelease storing the current chart version
+	// +required
+	manifest *File,
+	// Kubernetes version of the cluster (ex: 1.28), the latest chart supporting it is proposed
+	// +required
+	kubernetesVersion string,
+	// Dot separated path of the chart version field in the manifest
+	// +optional
+	// +default="spec.chart.spec.version"
+	key string,
+	// Semver constraint the latest chart version must satisfy (ex: "~4.10")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*IngressNginx, error) {
+	m := &IngressNginx{
+		Manifest:          manifest,
+		Key:               key,
+		Constraint:        constraint,
+		KubernetesVersion: kubernetesVersion,
+		ProxyURL:          proxyUrl,
+		NoProxy:           noProxy,
+		CABundle:          caBundle,
+		CacheTTL:          cacheTtl,
+		OtlpEndpoint:      otlpEndpoint,
+		OtlpHeaders:       otlpHeaders,
+		Traceparent:       traceparent,
+	}
+
+	var err error
+	if m.LocalVersion, err = m.bumper(m.Constraint).LocalVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get local version: %w", err)
+	}
+	if err := m.setLatestVersion(ctx); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type UpdateReport struct {
+	CurrentVersion           string `json:"currentVersion"`
+	LatestVersion            string `json:"latestVersion"`
+	UpdateNeeded             bool   `json:"updateNeeded"`
+	Constraint               string `json:"constraint"`
+	KubernetesVersion        string `json:"kubernetesVersion"`
+	CurrentControllerVersion string `json:"currentControllerVersion"`
+	LatestControllerVersion  string `json:"latestControllerVersion"`
+	// Kubernetes versions supported by the latest controller version
+	SupportedKubernetesVersions []string `json:"supportedKubernetesVersions"`
+}
+
+type compatibility struct {
+	controller string
+	chart      string
+	kubernetes []string
+}
+
+// bumper returns the version-bumper tracking the chart releases matching the constraint
+func (m *IngressNginx) bumper(constraint string) *VersionBumper {
+	return dag.VersionBumper("kubernetes", "ingress-nginx", m.Manifest, VersionBumperOpts{
+		Key:        m.Key,
+		TagPrefix:  chartTagPrefix,
+		Constraint: constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// setLatestVersion Get the latest chart version whose controller supports the Kubernetes version.
+// When the latest chart does not, the newest supporting chart of the compatibility table is used as an upper bound.
+func (m *IngressNginx) setLatestVersion(ctx context.Context) error {
+	latest, err := m.bumper(m.Constraint).LatestVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get latest version: %w", err)
+	}
+
+	controller, err := m.controllerVersion(ctx, latest)
+	if err != nil {
+		return err
+	}
+
+	table, err := m.compatibilityTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !supports(table, controller, m.KubernetesVersion) {
+		var bound *semver.Version
+		for _, row := range table {
+			v, err := semver.NewVersion(row.chart)
+			if err != nil || !contains(row.kubernetes, m.KubernetesVersion) {
+				continue
+			}
+			if bound == nil || v.GreaterThan(bound) {
+				bound = v
+			}
+		}
+		if bound == nil {
+			return &typederr.ValidationError{
+				Err:  fmt.Errorf("no ingress-nginx chart supports Kubernetes %s", m.KubernetesVersion),
+				Hint: "check the Kubernetes version of the cluster",
+			}
+		}
+
+		constraint := "<=" + bound.String()
+		if m.Constraint != "" {
+			constraint = m.Constraint + ", " + constraint
+		}
+		if latest, err = m.bumper(constraint).LatestVersion(ctx); err != nil {
+			return fmt.Errorf("failed to get latest version supporting Kubernetes %s: %w", m.KubernetesVersion, err)
+		}
+		if controller, err = m.controllerVersion(ctx, latest); err != nil {
+			return err
+		}
+	}
+
+	m.LatestVersion = latest
+	m.LatestControllerVersion = controller
+
+	return nil
+}
+
+// controllerVersion Get the controller version (appVersion) of a chart version
+func (m *IngressNginx) controllerVersion(ctx context.Context, chartVersion string) (string, error) {
+	content, err := m.get(ctx, fmt.Sprintf(
+		"https://raw.githubusercontent.com/kubernetes/ingress-nginx/%s%s/charts/ingress-nginx/Chart.yaml",
+		chartTagPrefix, chartVersion,
+	))
+	if err != nil {
+		return "", fmt.Errorf("failed to get chart %s: %w", chartVersion, err)
+	}
+
+	var chart struct {
+		AppVersion string `yaml:"appVersion"`
+	}
+	if err := yaml.Unmarshal([]byte(content), &chart); err != nil {
+		return "", fmt.Errorf("failed to parse chart %s: %w", chartVersion, err)
+	}
+
+	return strings.TrimPrefix(chart.AppVersion, "v"), nil
+}
+
+// compatibilityTable Parse the supported versions table of the ingress-nginx README
+func (m *IngressNginx) compatibilityTable(ctx context.Context) ([]compatibility, error) {
+	readme, err := m.get(ctx, "https://raw.githubusercontent.com/kubernetes/ingress-nginx/main/README.md")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the compatibility table: %w", err)
+	}
+
+	var table []compatibility
+	for _, line := range strings.Split(readme, "\n") {
+		match := compatibilityRow.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		row := compatibility{controller: match[1], chart: match[3]}
+		for _, v := range strings.Split(match[2], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				row.kubernetes = append(row.kubernetes, v)
+			}
+		}
+		table = append(table, row)
+	}
+	if len(table) == 0 {
+		return nil, fmt.Errorf("failed to find the compatibility table in the ingress-nginx README")
+	}
+
+	return table, nil
+}
+
+// IsNewerVersion Check if the latest chart version supporting the Kubernetes version is newer than the local version
+//
+// Example usage: dagger call --manifest=clusters/dev/ingress-nginx/helmrelease.yaml --kubernetes-version=1.28 is-newer-version
+func (m *IngressNginx) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	return latestVersion.GreaterThan(localVersion), nil
+}
+
+// UpdatedManifest Return the HelmRelease with the chart version set to the latest version supporting the Kubernetes version
+//
+// Example usage: dagger call --manifest=clusters/dev/ingress-nginx/helmrelease.yaml --kubernetes-version=1.28 updated-manifest export --path=clusters/dev/ingress-nginx/helmrelease.yaml
+func (m *IngressNginx) UpdatedManifest(ctx context.Context) *File {
+	s := m.startSpan(ctx, "UpdatedManifest")
+	defer s.End(nil)
+
+	return m.bumper("=" + m.LatestVersion).UpdatedManifest()
+}
+
+// Report Generate a JSON report describing the pending ingress-nginx update and its controller versions
+//
+// Example usage: dagger call --manifest=clusters/dev/ingress-nginx/helmrelease.yaml --kubernetes-version=1.28 report export --path=report.json
+func (m *IngressNginx) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	updateNeeded, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+
+	current, err := m.controllerVersion(ctx, m.LocalVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := m.compatibilityTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	supported := []string{}
+	for _, row := range table {
+		if row.controller == m.LatestControllerVersion {
+			supported = row.kubernetes
+		}
+	}
+
+	content, err := json.MarshalIndent(&UpdateReport{
+		CurrentVersion:              m.LocalVersion,
+		LatestVersion:               m.LatestVersion,
+		UpdateNeeded:                updateNeeded,
+		Constraint:                  m.Constraint,
+		KubernetesVersion:           m.KubernetesVersion,
+		CurrentControllerVersion:    current,
+		LatestControllerVersion:     m.LatestControllerVersion,
+		SupportedKubernetesVersions: supported,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
+
+// supports Check if the compatibility table lists the Kubernetes version for the controller version
+func supports(table []compatibility, controller, kubernetesVersion string) bool {
+	for _, row := range table {
+		if row.controller == controller {
+			return contains(row.kubernetes, kubernetesVersion)
+		}
+	}
+
+	return false
+}
+
+// contains Check if the list contains the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+)
+
+type BatchResult struct {
+	// Changed manifests only, at their path relative to the input directory
+	Changes *Directory
+	// JSON summary of the version changes, by manifest path
+	Summary *File
+}
+
+type batchChange struct {
+	Path            string `json:"path"`
+	PreviousVersion string `json:"previousVersion"`
+	Version         string `json:"version"`
+}
+
+// BatchUpdate Update every manifest matching the pattern in one pass, returning only the changed files and a summary
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml batch-update --dir=. --pattern="clusters/*/istio-version.yaml" changes export --path=.
+func (m *Istio) BatchUpdate(
+	ctx context.Context,
+	// Directory holding the manifests, usually the repository root
+	// +required
+	dir *Directory,
+	// Glob pattern of the manifests to update, relative to dir
+	// +optional
+	// +default="clusters/*/istio-version.yaml"
+	pattern string,
+	// version of kubeconform used to validate the updated manifests
+	// +optional
+	// +default="v0.6.4"
+	kubeconformVersion string,
+	// Record the previous version, update time and author as adore-me.com/* annotations
+	// +optional
+	annotate bool,
+	// Author recorded in the adore-me.com/updated-by annotation
+	// +optional
+	// +default="dagger"
+	updatedBy string,
+) (result *BatchResult, err error) {
+	s := m.startSpan(ctx, "BatchUpdate")
+	defer s.End(&err)
+
+	paths, err := dir.Glob(ctx, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifests: %w", err)
+	}
+
+	changes := dag.Directory()
+	summary := []batchChange{}
+	for _, path := range paths {
+		content, err := dir.File(path).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		versionPath, err := m.versionPath(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		localVersion, err := yamlpath.Get(content, versionPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in %s: %w", versionPath, path, err)
+		}
+
+		updateNeeded, err := m.updateNeeded(localVersion)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !updateNeeded {
+			continue
+		}
+
+		newContent, err := m.rewriteManifest(ctx, content, localVersion, kubeconformVersion, annotate, updatedBy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		changes = changes.WithNewFile(path, newContent)
+		summary = append(summary, batchChange{Path: path, PreviousVersion: localVersion, Version: m.LatestVersion})
+	}
+
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal summary: %w", err)
+	}
+
+	return &BatchResult{
+		Changes: changes,
+		Summary: dag.Directory().WithNewFile("summary.json", string(content)).File("summary.json"),
+	}, nil
+}
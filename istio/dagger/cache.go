@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+)
+
+// releases Return the Istio releases, kept in the cache of the engine for the cache TTL so the calls and runs in between
+// reuse them
+func (m *Istio) releases(ctx context.Context) ([]ghrelease.Release, error) {
+	client, err := m.github(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache := m.common().Cache("github-releases/istio/istio", CommonCacheOpts{TTL: m.CacheTTL})
+
+	return client.Cached(ctx, cache, "istio", "istio")
+}
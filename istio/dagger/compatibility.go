@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+type k8sRange struct {
+	Min string
+	Max string
+}
+
+// k8sCompatibility is Istio's supported Kubernetes versions matrix, by Istio minor
+// (see https://istio.io/latest/docs/releases/supported-releases/#support-status-of-istio-releases)
+var k8sCompatibility = map[string]k8sRange{
+	"1.14": {Min: "1.21", Max: "1.24"},
+	"1.15": {Min: "1.22", Max: "1.25"},
+	"1.16": {Min: "1.22", Max: "1.25"},
+	"1.17": {Min: "1.23", Max: "1.26"},
+	"1.18": {Min: "1.24", Max: "1.27"},
+	"1.19": {Min: "1.25", Max: "1.28"},
+	"1.20": {Min: "1.25", Max: "1.29"},
+	"1.21": {Min: "1.26", Max: "1.29"},
+	"1.22": {Min: "1.27", Max: "1.30"},
+	"1.23": {Min: "1.28", Max: "1.31"},
+	"1.24": {Min: "1.28", Max: "1.31"},
+	"1.25": {Min: "1.29", Max: "1.32"},
+	"1.26": {Min: "1.29", Max: "1.33"},
+}
+
+// K8sCompatibility Check that the proposed Istio version supports the Kubernetes version of the cluster
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml k8s-compatibility --kubernetes-version=1.29
+func (m *Istio) K8sCompatibility(
+	ctx context.Context,
+	// Kubernetes version of the cluster (ex: 1.29, v1.29.3-eks-adc7111)
+	// +required
+	kubernetesVersion string,
+) (compatibility string, err error) {
+	s := m.startSpan(ctx, "K8sCompatibility")
+	defer s.End(&err)
+
+	istioVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	k8sVersion, err := semver.NewVersion(kubernetesVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse kubernetes version: %w", err)
+	}
+
+	minor := fmt.Sprintf("%d.%d", istioVersion.Major(), istioVersion.Minor())
+	supported, ok := k8sCompatibility[minor]
+	if !ok {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("no Kubernetes compatibility data for Istio %s", minor),
+			Hint: "check the Istio version against the support status page",
+		}
+	}
+
+	// Only the Kubernetes minor matters, the bounds are major.minor versions
+	k8sMinor, err := semver.NewVersion(fmt.Sprintf("%d.%d", k8sVersion.Major(), k8sVersion.Minor()))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse kubernetes version: %w", err)
+	}
+
+	if k8sMinor.LessThan(semver.MustParse(supported.Min)) || k8sMinor.GreaterThan(semver.MustParse(supported.Max)) {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("istio %s supports Kubernetes %s to %s, cluster runs %s", m.LatestVersion, supported.Min, supported.Max, kubernetesVersion),
+			Hint: "upgrade the cluster first, or hold Istio back with a constraint",
+		}
+	}
+
+	return fmt.Sprintf("Istio %s supports Kubernetes %s (supported range %s to %s)", m.LatestVersion, kubernetesVersion, supported.Min, supported.Max), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"strings"
+)
+
+// componentKeys Parse the components option into a map of manifest paths to component names
+func (m *Istio) componentKeys() (map[string]string, error) {
+	keys := make(map[string]string, len(m.Components))
+	for _, c := range m.Components {
+		key, name, ok := strings.Cut(c, "=")
+		if !ok || key == "" || name == "" {
+			return nil, &typederr.ValidationError{Err: fmt.Errorf("invalid component %q", c), Hint: "list components as key=name, ex: cniVersion=istio-cni"}
+		}
+		if m.SourceKind == sourceConfigMap {
+			key = "data." + key
+		}
+		keys[key] = name
+	}
+
+	return keys, nil
+}
+
+// componentVersions Read the version pinned for each configured component, by component name
+func (m *Istio) componentVersions(ctx context.Context) (map[string]string, error) {
+	keys, err := m.componentKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	content, err := m.ConfigMap.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	versions := make(map[string]string, len(keys))
+	for key, name := range keys {
+		version, err := yamlpath.Get(content, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		versions[name] = version
+	}
+
+	return versions, nil
+}
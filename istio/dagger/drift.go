@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+// imageVariants are the suffixes of the istiod image tags flavouring the same version (ex: 1.20.0-distroless)
+var imageVariants = []string{"-distroless", "-debug"}
+
+// ClusterDrift Compare the version pinned in the ConfigMap with the istiod version running in the cluster
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml cluster-drift --kubeconfig=file:$HOME/.kube/config
+func (m *Istio) ClusterDrift(
+	ctx context.Context,
+	// Kubeconfig giving read access to the cluster
+	// +required
+	kubeconfig *Secret,
+	// Namespace of the Istio control plane
+	// +optional
+	// +default="istio-system"
+	namespace string,
+	// Name of the istiod deployment
+	// +optional
+	// +default="istiod"
+	deployment string,
+	// Version of the kubectl image
+	// +optional
+	// +default="1.29"
+	kubectlVersion string,
+	// Return an error instead of a message when drift is detected
+	// +optional
+	failOnDrift bool,
+) (drift string, err error) {
+	s := m.startSpan(ctx, "ClusterDrift")
+	defer s.End(&err)
+
+	// The API server of private clusters is usually listed in noProxy
+	kubectl := m.withProxy(m.common().Image("bitnami/kubectl:"+kubectlVersion)).
+		WithMountedSecret("/tmp/kubeconfig", kubeconfig).
+		WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+		// The cluster state changes outside of Dagger, never reuse a cached result
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	// Reading the deployment is safe to retry on API server hiccups
+	image, err := m.common().Retry(kubectl, []string{
+		"kubectl", "--namespace", namespace, "get", "deployment", deployment,
+		"--output", "jsonpath={.spec.template.spec.containers[0].image}",
+	}).Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get istiod image: %w", err)
+	}
+
+	clusterVersion := imageTag(strings.TrimSpace(image))
+	if clusterVersion == "" {
+		return "", fmt.Errorf("failed to extract version from istiod image %q", image)
+	}
+
+	if sameVersion(clusterVersion, m.LocalVersion) {
+		return fmt.Sprintf("No drift. Cluster and ConfigMap are both at %s", m.LocalVersion), nil
+	}
+
+	msg := fmt.Sprintf("Drift detected. ConfigMap pins %s but cluster runs %s", m.LocalVersion, clusterVersion)
+	if failOnDrift {
+		return "", &typederr.ConflictError{Err: errors.New(msg), Hint: "let Flux reconcile the cluster, or pin the version the cluster runs in the ConfigMap"}
+	}
+
+	return msg, nil
+}
+
+// imageTag Extract the tag of an image reference (ex: docker.io/istio/pilot:1.20.0@sha256:... -> 1.20.0)
+func imageTag(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+
+	return image[i+1:]
+}
+
+// sameVersion Check if two versions are the same once normalized: without leading v nor image variant, compared as semver
+func sameVersion(a, b string) bool {
+	a, b = normalizeVersion(a), normalizeVersion(b)
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	return va.Equal(vb)
+}
+
+// normalizeVersion Strip the leading v and the image variant of a version (ex: v1.20.0-distroless -> 1.20.0)
+func normalizeVersion(version string) string {
+	version = strings.TrimPrefix(version, "v")
+	for _, variant := range imageVariants {
+		version = strings.TrimSuffix(version, variant)
+	}
+
+	return version
+}
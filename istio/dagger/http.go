@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"net/http"
+	"time"
+)
+
+// httpClient returns an HTTP client that honors the configured proxy, CA bundle and timeout
+func (m *Istio) httpClient(ctx context.Context) (*http.Client, error) {
+	timeout := time.Duration(0)
+	if m.HTTPTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(m.HTTPTimeout); err != nil {
+			return nil, fmt.Errorf("failed to parse http timeout: %w", err)
+		}
+	}
+
+	return egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, timeout)
+}
+
+// github Return the client of the GitHub API and raw contents, retrying with the configured backoff
+func (m *Istio) github(ctx context.Context) (*ghrelease.Client, error) {
+	client, err := m.httpClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	backoff := time.Duration(0)
+	if m.Backoff != "" {
+		if backoff, err = time.ParseDuration(m.Backoff); err != nil {
+			return nil, fmt.Errorf("failed to parse backoff: %w", err)
+		}
+	}
+
+	return &ghrelease.Client{HTTP: client, Retries: m.Retries, Backoff: backoff}, nil
+}
+
+// common Return the common module, resolving the images to the pinned digests
+func (m *Istio) common() *Common {
+	return dag.Common(CommonOpts{Pins: m.Pins})
+}
+
+// withProxy Forward the configured proxy and CA bundle to a container making outbound calls
+func (m *Istio) withProxy(c *Container) *Container {
+	return m.common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
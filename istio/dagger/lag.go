@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// CheckMinorLag Fail when the local version is more than maxMinorLag minors behind the newest upstream release.
+// Unlike is-newer-version, the failure is meant to page someone when upgrades have stalled.
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml check-minor-lag --max-minor-lag=2
+func (m *Istio) CheckMinorLag(
+	ctx context.Context,
+	// Number of minors the local version may lag behind the newest release
+	// +optional
+	// +default=2
+	maxMinorLag int,
+) (status string, err error) {
+	s := m.startSpan(ctx, "CheckMinorLag")
+	defer s.End(&err)
+
+	lag, newest, err := m.minorLag(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if lag > maxMinorLag {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("istio %s is %d minors behind %s, more than the allowed %d", m.LocalVersion, lag, newest, maxMinorLag),
+			Hint: "upgrade Istio one minor at a time, the minors out of the supported window get no security fixes",
+		}
+	}
+
+	return fmt.Sprintf("Istio %s is %d minors behind %s", m.LocalVersion, lag, newest), nil
+}
+
+// minorLag Count the minors between the local version and the newest stable release, ignoring the constraint
+func (m *Istio) minorLag(ctx context.Context) (int, string, error) {
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	releases, err := m.releases(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+
+	newest := localVersion
+	for _, r := range releases {
+		v, err := semver.NewVersion(r.TagName)
+		if err != nil || v.Prerelease() != "" {
+			continue
+		}
+		if v.GreaterThan(newest) {
+			newest = v
+		}
+	}
+
+	if newest.Major() != localVersion.Major() {
+		return 0, "", fmt.Errorf("cannot compute minor lag across major versions (%s, %s)", m.LocalVersion, newest.Original())
+	}
+
+	return int(newest.Minor() - localVersion.Minor()), newest.Original(), nil
+}
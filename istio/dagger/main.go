@@ -3,103 +3,240 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Masterminds/semver"
-	"gopkg.in/yaml.v2"
-	"io"
-	"net/http"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Istio struct {
+	// Latest eligible version, or the target version when one is pinned
 	LatestVersion string
 	LocalVersion  string
 	// +private
 	ConfigMap *File
+	// +private
+	SourceKind string
+	// +private
+	ImageName string
+	// +private
+	Hub string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	Pins []string
+	// +private
+	Constraint string
+	// +private
+	MinReleaseAge string
+	// +private
+	TargetVersion string
+	// +private
+	Components []string
+	// +private
+	CacheTTL string
+	// +private
+	HTTPTimeout string
+	// +private
+	Retries int
+	// +private
+	Backoff string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
 }
 
 // New creates a new Istio module with the provided ConfigMap file and Directory
 //
 // Example usage: dagger call --cm-path=clusters/dev/istio-version.yaml --dir=. is-new-version
 func New(
+	ctx context.Context,
 	// ConfigMap (that stores istio current version) file path. Should be relative to the dir parameter.
+	// A HelmRelease or Kustomization can be provided instead, see sourceKind.
 	// +required
 	ConfigMap *File,
-) *Istio {
+	// Kind of resource pinning the version: ConfigMap (data.version), HelmRelease (spec.chart.spec.version), Kustomization (images newTag) or IstioOperator (spec.tag)
+	// +optional
+	// +default="ConfigMap"
+	sourceKind string,
+	// Image whose newTag pins the version when sourceKind is Kustomization
+	// +optional
+	// +default="docker.io/istio/pilot"
+	imageName string,
+	// Registry set as spec.hub when sourceKind is IstioOperator (ex: our internal mirror of docker.io/istio)
+	// +optional
+	hub string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// Digest-pinned image references of the kubectl and kubeconform commands, used instead of resolving their tag (ex: bitnami/kubectl:1.29@sha256:...)
+	// +optional
+	pins []string,
+	// Semver constraint the latest version must satisfy (ex: "~1.20", ">=1.20, <1.22")
+	// +optional
+	constraint string,
+	// Only consider releases published at least this long ago (ex: 7d, 36h)
+	// +optional
+	minReleaseAge string,
+	// Version to upgrade (or roll back) to instead of the latest release. It must still satisfy the constraint and policies.
+	// +optional
+	targetVersion string,
+	// ConfigMap data keys (full dot paths for other source kinds) pinning other Istio components, kept on the same version (ex: cniVersion=istio-cni,gatewayVersion=gateway)
+	// +optional
+	components []string,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// Timeout of each GitHub API call (ex: 30s, 1m)
+	// +optional
+	// +default="30s"
+	httpTimeout string,
+	// Number of retries of a failed GitHub API call
+	// +optional
+	// +default=3
+	retries int,
+	// Initial delay between retries, doubled after each attempt (ex: 2s)
+	// +optional
+	// +default="2s"
+	backoff string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Istio, error) {
 	i := &Istio{}
 	i.ConfigMap = ConfigMap
-	if err := i.setLocalVersion(); err != nil {
-		panic(err)
+	i.SourceKind = sourceKind
+	i.ImageName = imageName
+	i.Hub = hub
+	i.ProxyURL = proxyUrl
+	i.NoProxy = noProxy
+	i.CABundle = caBundle
+	i.Pins = pins
+	i.Constraint = constraint
+	i.MinReleaseAge = minReleaseAge
+	i.TargetVersion = targetVersion
+	i.Components = components
+	i.CacheTTL = cacheTtl
+	i.HTTPTimeout = httpTimeout
+	i.Retries = retries
+	i.Backoff = backoff
+	i.OtlpEndpoint = otlpEndpoint
+	i.OtlpHeaders = otlpHeaders
+	i.Traceparent = traceparent
+	if err := i.setLocalVersion(ctx); err != nil {
+		return nil, err
 	}
-	if err := i.setLatestVersion(); err != nil {
-		panic(err)
+	if err := i.setLatestVersion(ctx); err != nil {
+		return nil, err
 	}
 
-	return i
+	return i, nil
 }
 
-type Release struct {
-	TagName string `json:"tag_name"`
-	Name    string `json:"name"`
-}
+// setLatestVersion Get the latest Istio version, matching the constraint and policies if any, from GitHub.
+// When a target version is pinned, it is used instead once it passes the same checks.
+func (m *Istio) setLatestVersion(ctx context.Context) error {
+	minAge, err := parseAge(m.MinReleaseAge)
+	if err != nil {
+		return &typederr.ValidationError{Err: fmt.Errorf("failed to parse min release age: %w", err), Hint: "use a duration or a number of days, ex: 36h or 7d"}
+	}
+	selection := ghrelease.Selection{Constraint: m.Constraint, MinAge: minAge}
+	if err := selection.Validate(); err != nil {
+		return err
+	}
 
-type IstioVersionCm struct {
-	APIVersion string `yaml:"apiVersion"`
-	Kind       string `yaml:"kind"`
-	Metadata   struct {
-		Name        string `yaml:"name"`
-		Namespace   string `yaml:"namespace"`
-		Annotations struct {
-			KustomizeToolkitFluxcdIoSsa string `yaml:"kustomize.toolkit.fluxcd.io/ssa"`
-		} `yaml:"annotations"`
-	} `yaml:"metadata"`
-	Data struct {
-		Version string `yaml:"version"`
-	} `yaml:"data"`
-}
+	if m.TargetVersion != "" {
+		client, err := m.github(ctx)
+		if err != nil {
+			return err
+		}
+		release, err := client.Get(ctx, "istio", "istio", m.TargetVersion)
+		if err != nil {
+			return err
+		}
+		if err := selection.Check(release); err != nil {
+			return &typederr.ValidationError{
+				Err:  fmt.Errorf("target version %s is not eligible (constraint %q, min release age %q): %w", m.TargetVersion, m.Constraint, m.MinReleaseAge, err),
+				Hint: "pin a stable target version satisfying the constraint and min release age",
+			}
+		}
+		m.LatestVersion = release.TagName
 
-// setLatestVersion Get the latest Istio version from GitHub
-func (m *Istio) setLatestVersion() error {
-	owner := "istio" // Replace with the repository owner's username
-	repo := "istio"  // Replace with the repository name
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/latest", owner, repo)
+		return nil
+	}
 
-	resp, err := http.Get(url)
+	releases, err := m.releases(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get latest version: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	_, latest, err := selection.Latest(releases)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return err
 	}
+	m.LatestVersion = latest
 
-	var release Release
-	if err := json.Unmarshal(body, &release); err != nil {
-		return fmt.Errorf("failed to unmarshal json: %w", err)
-	}
+	return nil
+}
 
-	m.LatestVersion = release.TagName
+// parseAge Parse a duration, additionally accepting a number of days (ex: 7d)
+func parseAge(age string) (time.Duration, error) {
+	if age == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(age, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
 
-	return nil
+	return time.ParseDuration(age)
 }
 
 // setLocalVersion Get the local Istio version from the provided ConfigMap file
-func (m *Istio) setLocalVersion() error {
-	ctx := context.Background()
-
+func (m *Istio) setLocalVersion(ctx context.Context) error {
 	content, err := m.ConfigMap.Contents(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to read file contents: %w", err)
 	}
 
-	iVersion := &IstioVersionCm{}
-	if err := yaml.Unmarshal([]byte(content), iVersion); err != nil {
-		return fmt.Errorf("failed to unmarshal yaml: %w", err)
+	path, err := m.versionPath(content)
+	if err != nil {
+		return err
+	}
+
+	version, err := yamlpath.Get(content, path)
+	if err != nil {
+		return &typederr.ValidationError{Err: fmt.Errorf("failed to read %s: %w", path, err), Hint: "pin the version at " + path + " or set the sourceKind of the manifest"}
 	}
 
-	m.LocalVersion = iVersion.Data.Version
+	m.LocalVersion = version
 
 	return nil
 }
@@ -107,7 +244,10 @@ func (m *Istio) setLocalVersion() error {
 // IsNewerVersion Check if the latest Istio version is newer than the local version
 //
 // Example usage: dagger call --config-map=clusters/dev/istio-version.yaml is-new-version
-func (m *Istio) IsNewerVersion() (bool, error) {
+func (m *Istio) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
 	latestVersion, err := semver.NewVersion(m.LatestVersion)
 	if err != nil {
 		return false, fmt.Errorf("failed to parse latest version: %w", err)
@@ -115,7 +255,7 @@ func (m *Istio) IsNewerVersion() (bool, error) {
 
 	localVersion, err := semver.NewVersion(m.LocalVersion)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse local version: %w", err)
+		return false, &typederr.ValidationError{Err: fmt.Errorf("failed to parse local version: %w", err), Hint: "pin a semver version in the manifest, ex: 1.20.3"}
 	}
 
 	result := latestVersion.Compare(localVersion)
@@ -127,35 +267,103 @@ func (m *Istio) IsNewerVersion() (bool, error) {
 	return false, nil
 }
 
-// ReturnUpdatedCm Update the version in the ConfigMap file
+// updateNeeded Check if a manifest pinning localVersion must be rewritten: a newer version is available, or the pinned target differs from it
+func (m *Istio) updateNeeded(localVersion string) (bool, error) {
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	version, err := semver.NewVersion(localVersion)
+	if err != nil {
+		return false, &typederr.ValidationError{Err: fmt.Errorf("failed to parse local version: %w", err), Hint: "pin a semver version in the manifest, ex: 1.20.3"}
+	}
+
+	if m.TargetVersion != "" {
+		return !latestVersion.Equal(version), nil
+	}
+
+	return latestVersion.GreaterThan(version), nil
+}
+
+// ReturnUpdatedCm Update the version in the ConfigMap (or HelmRelease/Kustomization) file. The result is validated with kubeconform.
 //
 // Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml update-version-cm
-func (m *Istio) ReturnUpdatedCm() (string, error) {
-	isNewerVersion, err := m.IsNewerVersion()
+func (m *Istio) ReturnUpdatedCm(
+	ctx context.Context,
+	// version of kubeconform used to validate the updated ConfigMap
+	// +optional
+	// +default="v0.6.4"
+	kubeconformVersion string,
+	// Record the previous version, update time and author as adore-me.com/* annotations
+	// +optional
+	annotate bool,
+	// Author recorded in the adore-me.com/updated-by annotation
+	// +optional
+	// +default="dagger"
+	updatedBy string,
+) (manifest string, err error) {
+	s := m.startSpan(ctx, "ReturnUpdatedCm")
+	defer s.End(&err)
+
+	updateNeeded, err := m.updateNeeded(m.LocalVersion)
 	if err != nil {
-		return "", fmt.Errorf("failed to check if newer version: %w", err)
+		return "", fmt.Errorf("failed to check if update needed: %w", err)
 	}
-	if !isNewerVersion {
+	if !updateNeeded {
 		return fmt.Sprintf("No update needed. Latest version is %s", m.LatestVersion), nil
 	}
 
-	ctx := context.Background()
 	content, err := m.ConfigMap.Contents(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to read file contents: %w", err)
 	}
 
-	iVersion := &IstioVersionCm{}
-	if err := yaml.Unmarshal([]byte(content), iVersion); err != nil {
-		return "", fmt.Errorf("failed to unmarshal yaml: %w", err)
+	return m.rewriteManifest(ctx, content, m.LocalVersion, kubeconformVersion, annotate, updatedBy)
+}
+
+// rewriteManifest Set the latest version on the manifest and its components, then annotate and validate the result
+func (m *Istio) rewriteManifest(ctx context.Context, content, localVersion, kubeconformVersion string, annotate bool, updatedBy string) (string, error) {
+	path, err := m.versionPath(content)
+	if err != nil {
+		return "", err
 	}
 
-	iVersion.Data.Version = m.LatestVersion
+	values := map[string]string{path: m.LatestVersion}
+	components, err := m.componentKeys()
+	if err != nil {
+		return "", err
+	}
+	// Istio components are released together, keep them aligned on the same version
+	for key := range components {
+		values[key] = m.LatestVersion
+	}
 
-	newContent, err := yaml.Marshal(iVersion)
+	newContent, err := yamlpath.SetValues(content, values)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal yaml: %w", err)
+		return "", err
+	}
+
+	if m.SourceKind == sourceIstioOperator && m.Hub != "" {
+		if newContent, err = yamlpath.Upsert(newContent, "spec.hub", m.Hub); err != nil {
+			return "", err
+		}
+	}
+
+	if annotate {
+		newContent, err = yamlpath.SetAnnotations(newContent, map[string]string{
+			"adore-me.com/previous-version": localVersion,
+			"adore-me.com/updated-at":       time.Now().UTC().Format(time.RFC3339),
+			"adore-me.com/updated-by":       updatedBy,
+		})
+		if err != nil {
+			return "", &typederr.ValidationError{Err: err, Hint: "make metadata and metadata.annotations maps in the manifest"}
+		}
+	}
+
+	if err := m.validateManifest(ctx, newContent, kubeconformVersion); err != nil {
+		return "", err
 	}
 
-	return string(newContent), nil
+	return newContent, nil
 }
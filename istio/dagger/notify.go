@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Notify Post a message to a Slack or Teams incoming webhook when a newer Istio version is available
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml notify --webhook=env:SLACK_WEBHOOK
+func (m *Istio) Notify(
+	ctx context.Context,
+	// Incoming webhook URL of the chat channel
+	// +required
+	webhook *Secret,
+	// Channel to post to instead of the webhook default (Slack only)
+	// +optional
+	channelOverride string,
+	// URL of the pull request carrying the update, if any
+	// +optional
+	prUrl string,
+) (message string, err error) {
+	s := m.startSpan(ctx, "Notify")
+	defer s.End(&err)
+
+	updateNeeded, err := m.updateNeeded(m.LocalVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if update needed: %w", err)
+	}
+	if !updateNeeded {
+		return fmt.Sprintf("No notification sent. Latest version is %s", m.LatestVersion), nil
+	}
+
+	releases, err := m.releases(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{fmt.Sprintf("New Istio version available: %s → %s", m.LocalVersion, m.LatestVersion)}
+	for _, r := range releases {
+		if r.TagName == m.LatestVersion {
+			lines = append(lines, "Release notes: "+r.HTMLURL)
+			break
+		}
+	}
+	if prUrl != "" {
+		lines = append(lines, "Pull request: "+prUrl)
+	}
+	text := strings.Join(lines, "\n")
+
+	// The slack module keeps the webhook URL, the credential of the channel, out of its errors
+	return dag.Slack(SlackOpts{
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CaBundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}).PostMessage(ctx, webhook, text, SlackPostMessageOpts{Channel: channelOverride})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"sort"
+)
+
+// VersionPatch Return a strategic merge patch setting only the Istio version, for use in a Kustomization patches list
+//
+// Example usage: dagger call --config-map=./clusters/base/istio-version.yaml version-patch export --path=./clusters/dev/istio-version-patch.yaml
+func (m *Istio) VersionPatch(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "VersionPatch")
+	defer s.End(&err)
+
+	if m.SourceKind == sourceKustomization {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("version patches are not supported for %s sources", sourceKustomization),
+			Hint: "track the version in a ConfigMap or a HelmRelease to patch it",
+		}
+	}
+
+	content, err := m.ConfigMap.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	// Patches target the resource by its identity, carry it over from the base manifest
+	paths := []string{"apiVersion", "kind", "metadata.name"}
+	values := map[string]string{}
+	for _, path := range paths {
+		value, err := yamlpath.Get(content, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		values[path] = value
+	}
+	if namespace, err := yamlpath.Get(content, "metadata.namespace"); err == nil {
+		paths = append(paths, "metadata.namespace")
+		values["metadata.namespace"] = namespace
+	}
+
+	versionPath, err := m.versionPath(content)
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, versionPath)
+	values[versionPath] = m.LatestVersion
+
+	components, err := m.componentKeys()
+	if err != nil {
+		return nil, err
+	}
+	componentPaths := make([]string, 0, len(components))
+	for path := range components {
+		componentPaths = append(componentPaths, path)
+		values[path] = m.LatestVersion
+	}
+	sort.Strings(componentPaths)
+	paths = append(paths, componentPaths...)
+
+	patch, err := yamlpath.Build(paths, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Directory().WithNewFile("istio-version-patch.yaml", patch).File("istio-version-patch.yaml"), nil
+}
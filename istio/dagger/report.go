@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"regexp"
+	"strings"
+)
+
+// supportedMinors is the number of Istio minor releases supported upstream at any time
+const supportedMinors = 3
+
+var cvePattern = regexp.MustCompile(`CVE-\d{4}-\d+`)
+
+type UpdateReport struct {
+	CurrentVersion  string `json:"currentVersion"`
+	LatestVersion   string `json:"latestVersion"`
+	UpdateNeeded    bool   `json:"updateNeeded"`
+	Constraint      string `json:"constraint"`
+	EOL             bool   `json:"eol"`
+	SecurityUrgency string `json:"securityUrgency"`
+	// Number of minors between the current version and the newest upstream release
+	MinorLag int `json:"minorLag"`
+	// Version currently pinned for each additional component, by component name
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// Report Generate a JSON report describing the pending Istio update
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml report export --path=report.json
+func (m *Istio) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	report, err := m.buildReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
+
+// buildReport Gather the update status of the local version against the upstream releases
+func (m *Istio) buildReport(ctx context.Context) (*UpdateReport, error) {
+	updateNeeded, err := m.updateNeeded(m.LocalVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if update needed: %w", err)
+	}
+
+	releases, err := m.releases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	components, err := m.componentVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lag, _, err := m.minorLag(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpdateReport{
+		CurrentVersion:  m.LocalVersion,
+		LatestVersion:   m.LatestVersion,
+		UpdateNeeded:    updateNeeded,
+		Constraint:      m.Constraint,
+		EOL:             isEndOfLife(localVersion, releases),
+		SecurityUrgency: securityUrgency(localVersion, latestVersion, releases),
+		MinorLag:        lag,
+		Components:      components,
+	}, nil
+}
+
+// isEndOfLife Check if the version's minor is out of the upstream supported window, made of the supportedMinors newest
+// minors released, whatever their major
+func isEndOfLife(version *semver.Version, releases []ghrelease.Release) bool {
+	newer := map[string]bool{}
+	for _, r := range releases {
+		v, err := semver.NewVersion(r.TagName)
+		if err != nil || v.Prerelease() != "" {
+			continue
+		}
+		if v.Major() > version.Major() || v.Major() == version.Major() && v.Minor() > version.Minor() {
+			newer[fmt.Sprintf("%d.%d", v.Major(), v.Minor())] = true
+		}
+	}
+
+	return len(newer) >= supportedMinors
+}
+
+// securityUrgency Rate the security fixes shipped after the current version, up to the target version.
+// Returns "high" when a CVE is referenced, "low" when security fixes are mentioned and "none" otherwise.
+func securityUrgency(current, target *semver.Version, releases []ghrelease.Release) string {
+	urgency := "none"
+	for _, r := range releases {
+		v, err := semver.NewVersion(r.TagName)
+		if err != nil || !v.GreaterThan(current) || v.GreaterThan(target) {
+			continue
+		}
+		if cvePattern.MatchString(r.Body) {
+			return "high"
+		}
+		if strings.Contains(strings.ToLower(r.Body), "security") {
+			urgency = "low"
+		}
+	}
+
+	return urgency
+}
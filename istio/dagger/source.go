@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"strings"
+)
+
+const (
+	sourceConfigMap     = "ConfigMap"
+	sourceHelmRelease   = "HelmRelease"
+	sourceKustomization = "Kustomization"
+	sourceIstioOperator = "IstioOperator"
+)
+
+// versionPath Resolve the path of the Istio version in the source manifest
+func (m *Istio) versionPath(content string) (string, error) {
+	// kustomization.yaml files may omit their kind
+	if kind, _ := yamlpath.Get(content, "kind"); kind != "" && kind != m.SourceKind {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("expected a %s manifest, got %s", m.SourceKind, kind), Hint: "set sourceKind to " + kind}
+	}
+
+	switch m.SourceKind {
+	case sourceConfigMap:
+		return "data.version", nil
+	case sourceHelmRelease:
+		return "spec.chart.spec.version", nil
+	case sourceIstioOperator:
+		return "spec.tag", nil
+	case sourceKustomization:
+		images := "images"
+		if apiVersion, _ := yamlpath.Get(content, "apiVersion"); strings.HasPrefix(apiVersion, "kustomize.toolkit.fluxcd.io/") {
+			images = "spec.images"
+		}
+
+		names, err := yamlpath.ListValues(content, images, "name")
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", images, err)
+		}
+		for i, name := range names {
+			if name == m.ImageName {
+				return fmt.Sprintf("%s.%d.newTag", images, i), nil
+			}
+		}
+
+		return "", &typederr.ValidationError{Err: fmt.Errorf("image %s not found in %s", m.ImageName, images), Hint: "set imageName to the image pinning the Istio version"}
+	}
+
+	return "", &typederr.ValidationError{
+		Err:  fmt.Errorf("unsupported source kind %q", m.SourceKind),
+		Hint: fmt.Sprintf("set sourceKind to %s, %s, %s or %s", sourceConfigMap, sourceHelmRelease, sourceKustomization, sourceIstioOperator),
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"sort"
+	"strings"
+)
+
+const (
+	areaTraffic      = "Traffic management"
+	areaSecurity     = "Security"
+	areaTelemetry    = "Telemetry"
+	areaDeprecations = "Deprecations and removals"
+	areaOther        = "Other changes"
+)
+
+// summaryAreas is the order of the sections in the upgrade summary
+var summaryAreas = []string{areaDeprecations, areaSecurity, areaTraffic, areaTelemetry, areaOther}
+
+// areaKeywords classifies the notes of patch releases that are not grouped by area upstream
+var areaKeywords = map[string][]string{
+	areaTraffic:   {"traffic", "routing", "gateway", "virtualservice", "destinationrule", "serviceentry", "sidecar", "ambient", "waypoint"},
+	areaSecurity:  {"security", "cve-", "mtls", "certificate", "authorization", "authentication", "jwt"},
+	areaTelemetry: {"telemetry", "metric", "tracing", "access log", "prometheus"},
+}
+
+// UpgradeSummary Summarize the upstream release notes between the local and the latest version as Markdown, grouped by change area
+//
+// Example usage: dagger call --config-map=./clusters/dev/istio-version.yaml upgrade-summary
+func (m *Istio) UpgradeSummary(ctx context.Context) (summary string, err error) {
+	s := m.startSpan(ctx, "UpgradeSummary")
+	defer s.End(&err)
+
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	releases, err := m.releases(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var versions []*semver.Version
+	for _, r := range releases {
+		v, err := semver.NewVersion(r.TagName)
+		if err != nil || v.Prerelease() != "" || !v.GreaterThan(localVersion) || v.GreaterThan(latestVersion) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Sort(semver.Collection(versions))
+
+	client, err := m.github(ctx)
+	if err != nil {
+		return "", err
+	}
+	notes := map[string][]string{}
+	var missing []string
+	for _, v := range versions {
+		content, err := client.Fetch(ctx, releaseNotesURL(v))
+		if err != nil {
+			missing = append(missing, v.Original())
+			continue
+		}
+		for area, items := range groupReleaseNotes(string(content)) {
+			for _, item := range items {
+				notes[area] = append(notes[area], fmt.Sprintf("%s (%s)", item, v.Original()))
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Istio upgrade %s → %s\n", m.LocalVersion, m.LatestVersion)
+	if len(versions) == 0 {
+		b.WriteString("\nNo release between the local and the latest version.\n")
+	}
+	for _, area := range summaryAreas {
+		if len(notes[area]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n### %s\n\n", area)
+		if area == areaDeprecations {
+			b.WriteString("> [!WARNING]\n> These changes may require action before upgrading.\n\n")
+		}
+		for _, item := range notes[area] {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(&b, "\nRelease notes could not be fetched for: %s\n", strings.Join(missing, ", "))
+	}
+
+	return b.String(), nil
+}
+
+// releaseNotesURL Return the location of the release notes sources on istio.io.
+// Minor releases publish their notes in a dedicated change-notes page.
+func releaseNotesURL(v *semver.Version) string {
+	minor := fmt.Sprintf("%d.%d", v.Major(), v.Minor())
+	page := fmt.Sprintf("announcing-%s/index.md", v.Original())
+	if v.Patch() == 0 {
+		page = fmt.Sprintf("announcing-%s/change-notes/index.md", minor)
+	}
+
+	return fmt.Sprintf("https://raw.githubusercontent.com/istio/istio.io/master/content/en/news/releases/%s.x/%s", minor, page)
+}
+
+// groupReleaseNotes Group the bullet items of a release notes page by change area
+func groupReleaseNotes(content string) map[string][]string {
+	groups := map[string][]string{}
+	heading := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "## ") {
+			heading = strings.ToLower(strings.TrimPrefix(line, "## "))
+			continue
+		}
+		if !strings.HasPrefix(line, "- ") {
+			continue
+		}
+
+		item := strings.TrimPrefix(line, "- ")
+		area := noteArea(heading, item)
+		groups[area] = append(groups[area], item)
+	}
+
+	return groups
+}
+
+// noteArea Classify a release note item using its section heading, falling back to keywords
+func noteArea(heading, item string) string {
+	lower := strings.ToLower(item)
+	if strings.Contains(item, "**Deprecated**") || strings.Contains(item, "**Removed**") || strings.Contains(lower, "deprecat") {
+		return areaDeprecations
+	}
+
+	for _, area := range []string{areaTraffic, areaSecurity, areaTelemetry} {
+		if strings.Contains(heading, strings.ToLower(area)) {
+			return area
+		}
+	}
+
+	for _, area := range []string{areaSecurity, areaTraffic, areaTelemetry} {
+		for _, keyword := range areaKeywords[area] {
+			if strings.Contains(lower, keyword) {
+				return area
+			}
+		}
+	}
+
+	return areaOther
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"github.com/adore-me/daggerverse/common/pkg/tracing"
+)
+
+// startSpan Start the span of a function, recording the repository and versions it works on
+func (m *Istio) startSpan(ctx context.Context, name string) *tracing.Span {
+	return tracing.Start(ctx, "istio", name, m.exportSpan,
+		"repo=istio/istio",
+		"version="+m.LocalVersion,
+		"latest_version="+m.LatestVersion,
+		"source_kind="+m.SourceKind,
+	)
+}
+
+// exportSpan Export the span of a function with the common module, when an OTLP endpoint is configured
+func (m *Istio) exportSpan(ctx context.Context, record string) error {
+	if m.OtlpEndpoint == "" {
+		return nil
+	}
+
+	_, err := dag.Common().
+		Telemetry(m.OtlpEndpoint, CommonTelemetryOpts{Headers: m.OtlpHeaders, Traceparent: m.Traceparent}).
+		Export(ctx, record)
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// crdSchemaLocation resolves the schemas of custom resources such as Flux HelmRelease or Kustomization
+const crdSchemaLocation = "https://raw.githubusercontent.com/datreeio/CRDs-catalog/main/{{.Group}}/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json"
+
+// validateManifest Check that the manifest is still a valid Kubernetes object using kubeconform
+func (m *Istio) validateManifest(ctx context.Context, manifest string, kubeconformVersion string) error {
+	args := []string{
+		"/kubeconform", "-strict", "-summary",
+		"-schema-location", "default",
+		"-schema-location", crdSchemaLocation,
+	}
+	if m.SourceKind == sourceKustomization {
+		// kustomization.yaml files are not Kubernetes objects and have no published schema
+		args = append(args, "-ignore-missing-schemas")
+	}
+
+	_, err := m.withProxy(
+		m.common().Image("ghcr.io/yannh/kubeconform:"+kubeconformVersion+"-alpine"),
+	).
+		WithNewFile("/workspace/manifest.yaml", ContainerWithNewFileOpts{Contents: manifest}).
+		WithExec(
+			append(args, "/workspace/manifest.yaml"),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).Sync(ctx)
+	if err != nil {
+		return &typederr.ValidationError{Err: fmt.Errorf("updated manifest failed kubeconform validation: %w", err), Hint: "fix the fields reported by kubeconform in the manifest"}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type transitions struct {
+	Transitions []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		To   struct {
+			Name string `json:"name"`
+		} `json:"to"`
+	} `json:"transitions"`
+}
+
+// call calls the Jira REST API, authenticated with the token, and decodes the JSON response into out when not nil
+func (m *Jira) call(ctx context.Context, method, endpoint string, payload, out any) error {
+	token, err := m.Token.Plaintext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get api token: %w", err)
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(m.BaseURL, "/")+"/rest/api/2/"+endpoint, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	// Jira Cloud pairs the API token with the account email, Jira Data Center uses personal access tokens
+	if m.Email != "" {
+		req.SetBasicAuth(m.Email, token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call jira: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return typederr.FromResponse(resp, fmt.Errorf("jira returned %s: %s", resp.Status, body))
+	}
+
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+// This module creates, comments, transitions and links Jira issues, so pipelines can keep tickets up to date.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Jira struct {
+	// URL of the Jira instance (ex: https://adore-me.atlassian.net)
+	// +private
+	BaseURL string
+	// Email of the account owning the API token, empty for personal access tokens
+	// +private
+	Email string
+	// API token, or personal access token on Jira Data Center
+	// +private
+	Token *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Jira module authenticated against the Jira instance
+func New(
+	// URL of the Jira instance (ex: https://adore-me.atlassian.net)
+	// +required
+	baseUrl string,
+	// Email of the account owning the API token, empty for personal access tokens
+	// +optional
+	email string,
+	// API token, or personal access token on Jira Data Center
+	// +required
+	token *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Jira {
+	return &Jira{
+		BaseURL:      baseUrl,
+		Email:        email,
+		Token:        token,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// CreateIssue creates an issue and returns its key.
+//
+// Example usage: dagger call --base-url=https://adore-me.atlassian.net --email=bot@adore-me.com --token=env:JIRA_TOKEN create-issue --project=OPS --summary="Deploy app 1.2.3"
+func (m *Jira) CreateIssue(
+	ctx context.Context,
+	// Key of the project (ex: OPS)
+	// +required
+	project string,
+	// Summary of the issue
+	// +required
+	summary string,
+	// Description of the issue, in Jira wiki markup
+	// +optional
+	description string,
+	// Type of the issue (ex: Task, Bug, Incident)
+	// +optional
+	// +default="Task"
+	issueType string,
+	// Labels of the issue
+	// +optional
+	labels []string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "CreateIssue")
+	defer s.End(&err)
+
+	fields := map[string]any{
+		"project":     map[string]string{"key": project},
+		"summary":     summary,
+		"description": description,
+		"issuetype":   map[string]string{"name": issueType},
+	}
+	if len(labels) > 0 {
+		fields["labels"] = labels
+	}
+
+	var issue struct {
+		Key string `json:"key"`
+	}
+	if err := m.call(ctx, http.MethodPost, "issue", map[string]any{"fields": fields}, &issue); err != nil {
+		return "", fmt.Errorf("failed to create issue in %s: %w", project, err)
+	}
+
+	return issue.Key, nil
+}
+
+// Comment adds a comment to an issue and returns the comment ID.
+//
+// Example usage: dagger call --base-url=https://adore-me.atlassian.net --email=bot@adore-me.com --token=env:JIRA_TOKEN comment --key=OPS-42 --body="Deployed to production"
+func (m *Jira) Comment(
+	ctx context.Context,
+	// Key of the issue (ex: OPS-42)
+	// +required
+	key string,
+	// Comment, in Jira wiki markup
+	// +required
+	body string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Comment")
+	defer s.End(&err)
+
+	var comment struct {
+		ID string `json:"id"`
+	}
+	if err := m.call(ctx, http.MethodPost, "issue/"+url.PathEscape(key)+"/comment", map[string]string{"body": body}, &comment); err != nil {
+		return "", fmt.Errorf("failed to comment on %s: %w", key, err)
+	}
+
+	return comment.ID, nil
+}
+
+// TransitionIssue moves an issue through the workflow, by transition or target status name (ex: Released).
+//
+// Example usage: dagger call --base-url=https://adore-me.atlassian.net --email=bot@adore-me.com --token=env:JIRA_TOKEN transition-issue --key=OPS-42 --transition=Released
+func (m *Jira) TransitionIssue(
+	ctx context.Context,
+	// Key of the issue (ex: OPS-42)
+	// +required
+	key string,
+	// Name of the transition, or of the status it leads to (ex: Released)
+	// +required
+	transition string,
+	// Comment added along with the transition, in Jira wiki markup
+	// +optional
+	comment string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "TransitionIssue")
+	defer s.End(&err)
+
+	var available transitions
+	if err := m.call(ctx, http.MethodGet, "issue/"+url.PathEscape(key)+"/transitions", nil, &available); err != nil {
+		return "", fmt.Errorf("failed to get transitions of %s: %w", key, err)
+	}
+
+	id := ""
+	names := []string{}
+	for _, t := range available.Transitions {
+		if strings.EqualFold(t.Name, transition) || strings.EqualFold(t.To.Name, transition) {
+			id = t.ID
+			break
+		}
+		names = append(names, t.Name)
+	}
+	if id == "" {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("transition %q is not available for %s, expected one of %s", transition, key, strings.Join(names, ", ")),
+			Hint: "use one of the available transitions",
+		}
+	}
+
+	payload := map[string]any{"transition": map[string]string{"id": id}}
+	if comment != "" {
+		payload["update"] = map[string]any{
+			"comment": []map[string]any{{"add": map[string]string{"body": comment}}},
+		}
+	}
+	if err := m.call(ctx, http.MethodPost, "issue/"+url.PathEscape(key)+"/transitions", payload, nil); err != nil {
+		return "", fmt.Errorf("failed to transition %s: %w", key, err)
+	}
+
+	return fmt.Sprintf("%s moved to %s", key, transition), nil
+}
+
+// LinkToPR adds a link to a pull request in the issue, updating the existing link to the same URL if any.
+//
+// Example usage: dagger call --base-url=https://adore-me.atlassian.net --email=bot@adore-me.com --token=env:JIRA_TOKEN link-to-pr --key=OPS-42 --pr-url=https://github.com/adore-me/app/pull/7
+func (m *Jira) LinkToPR(
+	ctx context.Context,
+	// Key of the issue (ex: OPS-42)
+	// +required
+	key string,
+	// URL of the pull request
+	// +required
+	prUrl string,
+	// Title of the link, defaults to the URL
+	// +optional
+	title string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "LinkToPR")
+	defer s.End(&err)
+
+	if title == "" {
+		title = prUrl
+	}
+
+	payload := map[string]any{
+		// The global ID makes the link idempotent: linking the same pull request twice updates it
+		"globalId":     prUrl,
+		"relationship": "pull request",
+		"object": map[string]any{
+			"url":   prUrl,
+			"title": title,
+		},
+	}
+	if err := m.call(ctx, http.MethodPost, "issue/"+url.PathEscape(key)+"/remotelink", payload, nil); err != nil {
+		return "", fmt.Errorf("failed to link %s to %s: %w", key, prUrl, err)
+	}
+
+	return fmt.Sprintf("%s linked to %s", key, prUrl), nil
+}
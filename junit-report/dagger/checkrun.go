@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// maxAnnotations is the number of annotations GitHub accepts per check run request
+	maxAnnotations = 50
+	// maxSummary is the length GitHub accepts for the summary of a check run
+	maxSummary = 65535
+)
+
+type annotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+}
+
+// annotations returns the failed tests recording their file as GitHub check run annotations
+func (s *TestSummary) annotations() []annotation {
+	annotations := []annotation{}
+	for _, f := range s.Failures {
+		if f.File == "" {
+			continue
+		}
+		line := max(f.Line, 1)
+		annotations = append(annotations, annotation{
+			Path:            f.File,
+			StartLine:       line,
+			EndLine:         line,
+			AnnotationLevel: "failure",
+			Title:           f.Name,
+			Message:         f.Message,
+		})
+	}
+
+	return annotations
+}
+
+// PublishCheckRun publishes the summary as a completed check run of the commit, annotating the failed tests which
+// record their file, and returns its URL
+//
+// Example usage: dagger call --reports=./unit-reports summary publish-check-run --repo=. --token=env:GITHUB_TOKEN --sha=$GITHUB_SHA
+func (s *TestSummary) PublishCheckRun(
+	ctx context.Context,
+	// The repository, including its .git directory, its origin remote selects the GitHub repository
+	// +required
+	repo *Directory,
+	// Token allowed to write check runs (ex: the GitHub App token of the workflow)
+	// +required
+	token *Secret,
+	// Commit the check run is attached to
+	// +required
+	sha string,
+	// Name of the check run
+	// +optional
+	// +default="tests"
+	name string,
+) (result string, err error) {
+	span := s.startSpan(ctx, "PublishCheckRun")
+	defer span.End(&err)
+
+	conclusion := "success"
+	if s.Failed > 0 {
+		conclusion = "failure"
+	}
+	summary := s.Markdown(ctx)
+	if len(summary) > maxSummary {
+		const truncated = "\n\n_Summary truncated._"
+		summary = strings.ToValidUTF8(summary[:maxSummary-len(truncated)], "") + truncated
+	}
+	output := map[string]any{
+		"title":   fmt.Sprintf("%d passed, %d failed, %d flaky", s.Passed, s.Failed, len(s.Flaky)),
+		"summary": summary,
+	}
+
+	// GitHub accepts 50 annotations per request: the check run is created with the first ones, and updated with the others
+	annotations := s.annotations()
+	chunks := [][]annotation{}
+	for start := 0; start < len(annotations); start += maxAnnotations {
+		chunks = append(chunks, annotations[start:min(start+maxAnnotations, len(annotations))])
+	}
+	if len(chunks) == 0 {
+		chunks = append(chunks, []annotation{})
+	}
+
+	gh := dag.Gh(token, GhOpts{ProxyURL: s.ProxyURL, NoProxy: s.NoProxy, CaBundle: s.CABundle})
+	var id, url string
+	for i, chunk := range chunks {
+		output["annotations"] = chunk
+		payload := map[string]any{"output": output}
+		cmd := fmt.Sprintf("api -X PATCH repos/{owner}/{repo}/check-runs/%s --input .check-run/payload.json --jq '.id,.html_url'", id)
+		if i == 0 {
+			payload["name"] = name
+			payload["head_sha"] = sha
+			payload["status"] = "completed"
+			payload["conclusion"] = conclusion
+			cmd = "api -X POST repos/{owner}/{repo}/check-runs --input .check-run/payload.json --jq '.id,.html_url'"
+		}
+
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal check run: %w", err)
+		}
+		// The payload stays untracked, its timestamp makes sure the call is never cached
+		dir := repo.
+			WithNewFile(".check-run/payload.json", string(content)).
+			WithNewFile(".check-run/timestamp", time.Now().String())
+
+		out, err := gh.RunGh(ctx, dir, cmd)
+		if err != nil {
+			return "", fmt.Errorf("failed to publish check run %s: %w", name, err)
+		}
+		fields := strings.Fields(out)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("unexpected check run response: %s", out)
+		}
+		id, url = fields[0], fields[1]
+	}
+
+	return url, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+type history struct {
+	Runs []historyRun `json:"runs"`
+}
+
+type historyRun struct {
+	// ID of the pipeline run (ex: the GitHub Actions run ID)
+	ID string `json:"id"`
+	// Date of the run, in RFC 3339
+	Date string `json:"date"`
+	// Outcome of each test, by test key
+	Results map[string]string `json:"results"`
+}
+
+// pastRuns returns the runs of the history, oldest first, an empty history when none was provided
+func (m *JunitReport) pastRuns(ctx context.Context) ([]historyRun, error) {
+	if m.Previous == nil {
+		return nil, nil
+	}
+	content, err := m.Previous.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	h := &history{}
+	if err := json.Unmarshal([]byte(content), h); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal history: %w", err)
+	}
+
+	return h.Runs, nil
+}
+
+// flakyTests returns the tests of the current run which are flaky over the runs: they failed on some runs and passed
+// on others, or passed on a retry. The tests failing the most come first.
+func flakyTests(runs []historyRun, current map[string]string) []*FlakyTest {
+	var flaky []*FlakyTest
+	for key := range current {
+		test := &FlakyTest{Name: key}
+		passed, flip := false, false
+		for _, run := range runs {
+			switch run.Results[key] {
+			case statusPassed:
+				test.Runs++
+				passed = true
+			case statusFailed:
+				test.Runs++
+				test.Failures++
+			case statusFlaky:
+				test.Runs++
+				test.Failures++
+				flip = true
+			}
+		}
+		if flip || (passed && test.Failures > 0) {
+			flaky = append(flaky, test)
+		}
+	}
+
+	slices.SortFunc(flaky, func(a, b *FlakyTest) int {
+		if a.Failures != b.Failures {
+			return b.Failures - a.Failures
+		}
+		if a.Name < b.Name {
+			return -1
+		}
+		return 1
+	})
+
+	return flaky
+}
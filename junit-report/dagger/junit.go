@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	statusPassed  = "passed"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+	// statusFlaky is a test which failed then passed on a retry of the same run
+	statusFlaky = "flaky"
+)
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr,omitempty"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	XMLName   xml.Name     `xml:"testsuite"`
+	Name      string       `xml:"name,attr"`
+	Tests     int          `xml:"tests,attr"`
+	Failures  int          `xml:"failures,attr"`
+	Errors    int          `xml:"errors,attr"`
+	Skipped   int          `xml:"skipped,attr"`
+	Time      string       `xml:"time,attr"`
+	Timestamp string       `xml:"timestamp,attr,omitempty"`
+	Cases     []junitCase  `xml:"testcase"`
+	Suites    []junitSuite `xml:"testsuite"`
+}
+
+type junitCase struct {
+	Name      string       `xml:"name,attr"`
+	Classname string       `xml:"classname,attr"`
+	Time      string       `xml:"time,attr"`
+	File      string       `xml:"file,attr,omitempty"`
+	Line      int          `xml:"line,attr,omitempty"`
+	Failure   *junitResult `xml:"failure"`
+	Error     *junitResult `xml:"error"`
+	Skipped   *junitResult `xml:"skipped"`
+	// Surefire records the failed attempts of a test which passed on a rerun
+	FlakyFailures []junitResult `xml:"flakyFailure"`
+	FlakyErrors   []junitResult `xml:"flakyError"`
+	SystemOut     string        `xml:"system-out,omitempty"`
+	SystemErr     string        `xml:"system-err,omitempty"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJunit returns the test suites of a JUnit XML report, written with a testsuites or a testsuite root. Nested
+// suites are flattened.
+func parseJunit(content string) ([]junitSuite, error) {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("no testsuites or testsuite element"),
+				Hint: "pass reports in the JUnit XML format",
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var suites []junitSuite
+		switch start.Name.Local {
+		case "testsuites":
+			root := &junitSuites{}
+			if err := decoder.DecodeElement(root, &start); err != nil {
+				return nil, err
+			}
+			suites = root.Suites
+		case "testsuite":
+			suite := junitSuite{}
+			if err := decoder.DecodeElement(&suite, &start); err != nil {
+				return nil, err
+			}
+			suites = []junitSuite{suite}
+		default:
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("unexpected root element %s", start.Name.Local),
+				Hint: "pass reports in the JUnit XML format",
+			}
+		}
+
+		return flatten(suites), nil
+	}
+}
+
+// flatten returns the suites and their nested suites, with their counts computed from their test cases
+func flatten(suites []junitSuite) []junitSuite {
+	var flat []junitSuite
+	for _, s := range suites {
+		nested := s.Suites
+		s.Suites = nil
+		if len(s.Cases) > 0 {
+			flat = append(flat, count(s))
+		}
+		flat = append(flat, flatten(nested)...)
+	}
+
+	return flat
+}
+
+// count sets the counts and the time of the suite from its test cases, reporters disagreeing on their meaning
+func count(s junitSuite) junitSuite {
+	s.Tests, s.Failures, s.Errors, s.Skipped = len(s.Cases), 0, 0, 0
+	var seconds float64
+	for _, c := range s.Cases {
+		switch {
+		case c.Error != nil:
+			s.Errors++
+		case c.Failure != nil:
+			s.Failures++
+		case c.Skipped != nil:
+			s.Skipped++
+		}
+		seconds += parseSeconds(c.Time)
+	}
+	if parseSeconds(s.Time) < seconds {
+		s.Time = strconv.FormatFloat(seconds, 'f', 3, 64)
+	}
+
+	return s
+}
+
+// parseSeconds parses a JUnit time, some reporters writing thousands separators, and 0 when it is missing
+func parseSeconds(value string) float64 {
+	seconds, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64)
+	if err != nil {
+		return 0
+	}
+
+	return seconds
+}
+
+// status returns the outcome of the test case
+func (c *junitCase) status() string {
+	switch {
+	case c.Failure != nil || c.Error != nil:
+		return statusFailed
+	case c.Skipped != nil:
+		return statusSkipped
+	case len(c.FlakyFailures) > 0 || len(c.FlakyErrors) > 0:
+		return statusFlaky
+	}
+
+	return statusPassed
+}
+
+// key identifies the test case across reports and runs
+func (c *junitCase) key(suite string) string {
+	classname := c.Classname
+	if classname == "" {
+		classname = suite
+	}
+
+	return classname + " > " + c.Name
+}
+
+// failure returns the failure or the error of the test case
+func (c *junitCase) failure() *junitResult {
+	if c.Failure != nil {
+		return c.Failure
+	}
+
+	return c.Error
+}
@@ -0,0 +1,380 @@
+// This module aggregates the JUnit XML reports of the pipeline steps: it merges them, computes the totals and the
+// flaky tests against the history of the previous runs, and publishes the summary as a GitHub check run.
+//
+// The history is a JSON file the pipeline stores between runs (ex: in a bucket or an artifact), updated by History.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JunitReport struct {
+	// Directories of the JUnit XML reports, one per pipeline step
+	// +private
+	Reports []*Directory
+	// Glob selecting the reports in the directories
+	// +private
+	Pattern string
+	// History of the previous runs
+	// +private
+	Previous *File
+	// Number of runs kept in the history, the current one included
+	// +private
+	HistorySize int
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new JunitReport module aggregating the reports of the directories
+func New(
+	// Directories of the JUnit XML reports, one per pipeline step
+	// +required
+	reports []*Directory,
+	// Glob selecting the reports in the directories
+	// +optional
+	// +default="**/*.xml"
+	pattern string,
+	// JSON history of the previous runs, as returned by History
+	// +optional
+	history *File,
+	// Number of runs kept in the history and used for the flaky tests, the current one included
+	// +optional
+	// +default=30
+	historySize int,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*JunitReport, error) {
+	if historySize < 1 {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("historySize must be at least 1"), Hint: "set historySize to 1 or more"}
+	}
+
+	return &JunitReport{
+		Reports:      reports,
+		Pattern:      pattern,
+		Previous:     history,
+		HistorySize:  historySize,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+type TestSummary struct {
+	// Number of distinct tests, a test repeated across reports or retries counting once
+	Total int
+	// Number of passed tests, the flaky ones included
+	Passed int
+	// Number of failed tests
+	Failed int
+	// Number of skipped tests
+	Skipped int
+	// Sum of the suite durations (ex: 1m42.5s)
+	Duration string
+	// Failed tests
+	Failures []*TestFailure
+	// Flaky tests of the current run, over the history
+	Flaky []*FlakyTest
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type TestFailure struct {
+	// Test key: classname > name
+	Name string
+	// Failure message
+	Message string
+	// File of the test, when the reporter records it
+	File string
+	// Line of the test in its file
+	Line int
+}
+
+type FlakyTest struct {
+	// Test key: classname > name
+	Name string
+	// Number of runs of the test in the history, the current one included
+	Runs int
+	// Number of those runs it failed, or passed on a retry
+	Failures int
+}
+
+// Merge merges the reports into a single JUnit XML report, with the counts of the suites computed from their tests
+//
+// Example usage: dagger call --reports=./unit-reports --reports=./e2e-reports merge export --path=junit.xml
+func (m *JunitReport) Merge(ctx context.Context) (file *File, err error) {
+	span := m.startSpan(ctx, "Merge")
+	defer span.End(&err)
+
+	suites, err := m.suites(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &junitSuites{Name: "merged", Suites: suites}
+	var seconds float64
+	for _, s := range suites {
+		merged.Tests += s.Tests
+		merged.Failures += s.Failures
+		merged.Errors += s.Errors
+		merged.Skipped += s.Skipped
+		seconds += parseSeconds(s.Time)
+	}
+	merged.Time = strconv.FormatFloat(seconds, 'f', 3, 64)
+
+	content, err := xml.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal merged report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("junit.xml", xml.Header+string(content)+"\n").File("junit.xml"), nil
+}
+
+// Summary returns the totals, the failed tests and the flaky tests of the reports. A test is flaky when it passed on a
+// retry, or when it both passed and failed over the runs of the history.
+//
+// Example usage: dagger call --reports=./unit-reports --reports=./e2e-reports --history=./history.json summary check
+func (m *JunitReport) Summary(ctx context.Context) (result *TestSummary, err error) {
+	span := m.startSpan(ctx, "Summary")
+	defer span.End(&err)
+
+	suites, err := m.suites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := m.pastRuns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &TestSummary{
+		Failures:     []*TestFailure{},
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CABundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	results := results(suites)
+	failures := map[string]*TestFailure{}
+	var seconds float64
+	for _, s := range suites {
+		seconds += parseSeconds(s.Time)
+		for _, c := range s.Cases {
+			key := c.key(s.Name)
+			if results[key] != statusFailed || failures[key] != nil {
+				continue
+			}
+			failure := &TestFailure{Name: key, File: c.File, Line: c.Line}
+			if f := c.failure(); f != nil {
+				failure.Message = f.Message
+				if failure.Message == "" {
+					failure.Message = strings.TrimSpace(f.Text)
+				}
+			}
+			failures[key] = failure
+			summary.Failures = append(summary.Failures, failure)
+		}
+	}
+	for _, status := range results {
+		summary.Total++
+		switch status {
+		case statusPassed, statusFlaky:
+			summary.Passed++
+		case statusFailed:
+			summary.Failed++
+		case statusSkipped:
+			summary.Skipped++
+		}
+	}
+	summary.Duration = time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+
+	window := append(runs[max(len(runs)-m.HistorySize+1, 0):], historyRun{Results: results})
+	summary.Flaky = flakyTests(window, results)
+
+	return summary, nil
+}
+
+// History returns the history with the results of the current run appended, keeping the last historySize runs.
+// Store it for the next run, which passes it back as history.
+//
+// Example usage: dagger call --reports=./unit-reports --history=./history.json history --run-id=$GITHUB_RUN_ID export --path=history.json
+func (m *JunitReport) History(
+	ctx context.Context,
+	// ID of the pipeline run (ex: the GitHub Actions run ID)
+	// +required
+	runId string,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "History")
+	defer s.End(&err)
+
+	suites, err := m.suites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := m.pastRuns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	runs = append(runs, historyRun{ID: runId, Date: time.Now().UTC().Format(time.RFC3339), Results: results(suites)})
+	content, err := json.MarshalIndent(&history{Runs: runs[max(len(runs)-m.HistorySize, 0):]}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal history: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("history.json", string(content)).File("history.json"), nil
+}
+
+// Check fails when a test failed, and returns the summary otherwise
+func (s *TestSummary) Check(ctx context.Context) (out string, err error) {
+	span := s.startSpan(ctx, "Check")
+	defer span.End(&err)
+
+	if s.Failed > 0 {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d tests failed:\n%s", s.Failed, s.Markdown(ctx)),
+			Hint: "fix the failing tests",
+		}
+	}
+
+	return s.Markdown(ctx), nil
+}
+
+// Markdown returns the summary in Markdown, with the failed and the flaky tests
+func (s *TestSummary) Markdown(ctx context.Context) string {
+	span := s.startSpan(ctx, "Markdown")
+	defer span.End(nil)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%d tests**: %d passed, %d failed, %d skipped, %d flaky in %s\n", s.Total, s.Passed, s.Failed, s.Skipped, len(s.Flaky), s.Duration)
+	if len(s.Failures) > 0 {
+		b.WriteString("\n### Failed tests\n\n")
+		for _, f := range s.Failures {
+			// The first line of the message is enough for the summary
+			message, _, _ := strings.Cut(f.Message, "\n")
+			fmt.Fprintf(&b, "- `%s`: %s\n", f.Name, message)
+		}
+	}
+	if len(s.Flaky) > 0 {
+		b.WriteString("\n### Flaky tests\n\n| Test | Failed runs |\n| --- | --- |\n")
+		for _, f := range s.Flaky {
+			fmt.Fprintf(&b, "| `%s` | %d / %d |\n", f.Name, f.Failures, f.Runs)
+		}
+	}
+
+	return b.String()
+}
+
+// suites returns the suites of every report matching the pattern in the directories
+func (m *JunitReport) suites(ctx context.Context) ([]junitSuite, error) {
+	var suites []junitSuite
+	for _, dir := range m.Reports {
+		files, err := dir.Glob(ctx, m.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look for reports: %w", err)
+		}
+		for _, f := range files {
+			content, err := dir.File(f).Contents(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read report %s: %w", f, err)
+			}
+			parsed, err := parseJunit(content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse report %s: %w", f, err)
+			}
+			suites = append(suites, parsed...)
+		}
+	}
+	if len(suites) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("no test suite found in the reports matching %s", m.Pattern),
+			Hint: "check the pattern of the reports",
+		}
+	}
+
+	return suites, nil
+}
+
+// results returns the outcome of each test. A test repeated across the reports, by retries or by steps running it
+// again, is flaky when it both failed and passed.
+func results(suites []junitSuite) map[string]string {
+	statuses := map[string][]string{}
+	for _, s := range suites {
+		for _, c := range s.Cases {
+			key := c.key(s.Name)
+			statuses[key] = append(statuses[key], c.status())
+		}
+	}
+
+	results := map[string]string{}
+	for key, s := range statuses {
+		failed := slices.Contains(s, statusFailed)
+		passed := slices.Contains(s, statusPassed) || slices.Contains(s, statusFlaky)
+		switch {
+		case failed && passed, slices.Contains(s, statusFlaky):
+			results[key] = statusFlaky
+		case failed:
+			results[key] = statusFailed
+		case passed:
+			results[key] = statusPassed
+		default:
+			results[key] = statusSkipped
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the k6 commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"thresholds on metrics", "have been crossed"},
+	ValidationHint: "check the load test script and its thresholds",
+}
+
+// commandError types the error of a k6 command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,219 @@
+// This module runs k6 load tests against a URL or a Dagger service, and exports the summary and an HTML report.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type K6 struct {
+	// The version of k6 (ex: 0.50.0)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new K6 module pinned to the provided k6 version
+func New(
+	// The version of k6
+	// +optional
+	// +default="0.50.0"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *K6 {
+	return &K6{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type LoadTestResult struct {
+	// Whether every threshold passed
+	Passed bool
+	// End of test summary in JSON
+	Summary *File
+	// HTML report of the web dashboard
+	Report *File
+	// k6 output
+	Output string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// Run runs a k6 script against the target. The script reads the target from __ENV.TARGET_URL.
+// A target service is bound as the "target" host, and TARGET_URL defaults to http://target:<port>.
+//
+// Example usage: dagger call run --scripts=./perf --script=smoke.js --target-url=https://staging.example.com check
+func (m *K6) Run(
+	ctx context.Context,
+	// Directory of the k6 scripts
+	// +required
+	scripts *Directory,
+	// Path of the script to run, relative to scripts
+	// +optional
+	// +default="script.js"
+	script string,
+	// URL of the target, exposed to the script as TARGET_URL
+	// +optional
+	targetUrl string,
+	// Service to test, bound as the target host
+	// +optional
+	target *Service,
+	// Port of the target service
+	// +optional
+	// +default=80
+	targetPort int,
+	// Number of virtual users, overriding the script options
+	// +optional
+	vus int,
+	// Duration of the test (ex: 30s), overriding the script options
+	// +optional
+	duration string,
+	// Extra environment variables exposed to the script (ex: API_KEY=xxx)
+	// +optional
+	env []string,
+) (result *LoadTestResult, err error) {
+	s := m.startSpan(ctx, "Run")
+	defer s.End(&err)
+
+	if targetUrl == "" && target == nil {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("either targetUrl or target is required"),
+			Hint: "set targetUrl, or the target service",
+		}
+	}
+
+	c := m.withProxy(dag.Container().From("grafana/k6:"+m.Version), "target").
+		WithDirectory("/scripts", scripts).
+		WithWorkdir("/scripts").
+		WithEnvVariable("K6_WEB_DASHBOARD", "true").
+		WithEnvVariable("K6_WEB_DASHBOARD_EXPORT", "/tmp/report.html").
+		// The target changes outside of Dagger, never reuse a cached result
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	if target != nil {
+		c = c.WithServiceBinding("target", target)
+		if targetUrl == "" {
+			targetUrl = "http://target:" + strconv.Itoa(targetPort)
+		}
+	}
+	c = c.WithEnvVariable("TARGET_URL", targetUrl)
+
+	args := []string{"k6", "run", "--summary-export", "/tmp/summary.json"}
+	if vus > 0 {
+		args = append(args, "--vus", strconv.Itoa(vus))
+	}
+	if duration != "" {
+		args = append(args, "--duration", duration)
+	}
+	for _, e := range env {
+		args = append(args, "--env", e)
+	}
+	args = append(args, script)
+
+	// k6 exits with 99 when a threshold fails, the summary and the report are still written
+	c = c.WithExec(
+		append([]string{"sh", "-c", `"$@" > /tmp/output.log 2>&1; echo $? > /tmp/exit-code`, "sh"}, args...),
+		ContainerWithExecOpts{SkipEntrypoint: true},
+	)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read k6 exit code: %w", commandError(err))
+	}
+	output, err := c.File("/tmp/output.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read k6 output: %w", commandError(err))
+	}
+
+	switch strings.TrimSpace(exitCode) {
+	case "0", "99":
+	default:
+		return nil, commandFailures.Type(fmt.Errorf("k6 failed with exit code %s: %s", strings.TrimSpace(exitCode), output), output)
+	}
+
+	return &LoadTestResult{
+		Passed:       strings.TrimSpace(exitCode) == "0",
+		Summary:      c.File("/tmp/summary.json"),
+		Report:       c.File("/tmp/report.html"),
+		Output:       output,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when a threshold failed, and returns the k6 output otherwise
+func (r *LoadTestResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("k6 thresholds failed:\n%s", r.Output),
+			Hint: "fix the service or the thresholds crossed by the load test",
+		}
+	}
+
+	return r.Output, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls, the services bound to it
+// are reached without the proxy
+func (m *K6) withProxy(c *Container, services ...string) *Container {
+	noProxy := m.NoProxy
+	for _, service := range services {
+		noProxy = strings.TrimPrefix(noProxy+","+service, ",")
+	}
+
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: noProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
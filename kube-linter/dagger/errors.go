@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the kube-linter commands from their output
+var commandFailures = typederr.Command{
+	ValidationHint: "fix the manifests reported by kube-linter or exclude the checks in its config",
+}
+
+// commandError types the error of a kube-linter command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
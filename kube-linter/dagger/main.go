@@ -0,0 +1,291 @@
+// This module checks rendered Kubernetes manifests against best practices with kube-linter, and scores every workload.
+//
+// The score of a workload is the percentage of enabled checks it passes: resource requests and limits, probes,
+// securityContext and the other kube-linter checks enabled by the config.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type KubeLinter struct {
+	// The version of kube-linter (ex: v0.6.8)
+	// +private
+	Version string
+	// kube-linter config, selecting and configuring the checks
+	// +private
+	Config *File
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new KubeLinter module pinned to the provided kube-linter version
+func New(
+	// The version of kube-linter
+	// +optional
+	// +default="v0.6.8"
+	version string,
+	// kube-linter config (.kube-linter.yaml), selecting and configuring the checks. The default checks run when omitted.
+	// +optional
+	config *File,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *KubeLinter {
+	return &KubeLinter{
+		Version:      version,
+		Config:       config,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type LintResult struct {
+	// Whether no gating check failed and every workload reaches the minimum score
+	Passed bool
+	// Checks enabled for the run
+	Checks    []string
+	Workloads []*Workload
+	Findings  []*Finding
+	// Raw kube-linter JSON report
+	Report *File
+	// +private
+	Reasons []string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Workload struct {
+	// Manifest of the workload, relative to the manifests directory
+	File      string
+	Kind      string
+	Namespace string
+	Name      string
+	// Percentage of the enabled checks passed by the workload
+	Score int
+	// Checks failed by the workload
+	Failed []string
+}
+
+type Finding struct {
+	// Manifest of the object, relative to the manifests directory
+	File        string
+	Kind        string
+	Namespace   string
+	Name        string
+	Check       string
+	Message     string
+	Remediation string
+}
+
+type kubeLinterReport struct {
+	Checks []struct {
+		Name string `json:"name"`
+	} `json:"Checks"`
+	Reports []struct {
+		Diagnostic struct {
+			Message string `json:"Message"`
+		} `json:"Diagnostic"`
+		Check       string `json:"Check"`
+		Remediation string `json:"Remediation"`
+		Object      struct {
+			Metadata struct {
+				FilePath string `json:"FilePath"`
+			} `json:"Metadata"`
+			K8sObject struct {
+				Namespace        string `json:"Namespace"`
+				Name             string `json:"Name"`
+				GroupVersionKind struct {
+					Kind string `json:"Kind"`
+				} `json:"GroupVersionKind"`
+			} `json:"K8sObject"`
+		} `json:"Object"`
+	} `json:"Reports"`
+}
+
+// Lint runs kube-linter over the manifests and scores the workloads reported by at least one check.
+//
+// Example usage: dagger call --config=./.kube-linter.yaml lint --manifests=./rendered --fail-on=unset-memory-requirements,no-liveness-probe check
+func (m *KubeLinter) Lint(
+	ctx context.Context,
+	// Directory of rendered manifests, searched recursively
+	// +required
+	manifests *Directory,
+	// Checks failing the lint when reported, every enabled check when empty
+	// +optional
+	failOn []string,
+	// Score under which a workload fails the lint, 0 to only gate on the checks
+	// +optional
+	minScore int,
+) (lintResult *LintResult, err error) {
+	s := m.startSpan(ctx, "Lint")
+	defer s.End(&err)
+
+	c := m.withProxy(dag.Container().From("stackrox/kube-linter:"+m.Version+"-alpine")).
+		WithDirectory("/workspace", manifests).
+		WithWorkdir("/workspace")
+	args := "kube-linter lint --format json"
+	if m.Config != nil {
+		c = c.WithFile("/tmp/kube-linter.yaml", m.Config)
+		args += " --config /tmp/kube-linter.yaml"
+	}
+
+	// kube-linter exits with 1 on findings, keep the report instead of failing the exec
+	c = c.WithExec([]string{
+		"sh", "-c", args + " . > /tmp/report.json 2> /tmp/stderr; echo $? > /tmp/exit-code",
+	}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run kube-linter: %w", commandError(err))
+	}
+	if code := strings.TrimSpace(exitCode); code != "0" && code != "1" {
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return nil, commandFailures.Type(fmt.Errorf("kube-linter exited with %s: %s", code, stderr), stderr)
+	}
+
+	report := c.File("/tmp/report.json")
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kube-linter report: %w", commandError(err))
+	}
+
+	var parsed kubeLinterReport
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kube-linter report: %w", err)
+	}
+
+	result := &LintResult{
+		Passed:       true,
+		Checks:       []string{},
+		Workloads:    []*Workload{},
+		Findings:     []*Finding{},
+		Report:       report,
+		Reasons:      []string{},
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, check := range parsed.Checks {
+		result.Checks = append(result.Checks, check.Name)
+	}
+
+	workloads := map[string]*Workload{}
+	for _, r := range parsed.Reports {
+		o := r.Object.K8sObject
+		f := &Finding{
+			File:        strings.TrimPrefix(r.Object.Metadata.FilePath, "./"),
+			Kind:        o.GroupVersionKind.Kind,
+			Namespace:   o.Namespace,
+			Name:        o.Name,
+			Check:       r.Check,
+			Message:     r.Diagnostic.Message,
+			Remediation: r.Remediation,
+		}
+		result.Findings = append(result.Findings, f)
+
+		if len(failOn) == 0 || slices.Contains(failOn, f.Check) {
+			result.Passed = false
+			result.Reasons = append(result.Reasons, fmt.Sprintf("%s: %s %s/%s: %s: %s", f.File, f.Kind, f.Namespace, f.Name, f.Check, f.Message))
+		}
+
+		key := strings.Join([]string{f.File, f.Kind, f.Namespace, f.Name}, "/")
+		w, ok := workloads[key]
+		if !ok {
+			w = &Workload{File: f.File, Kind: f.Kind, Namespace: f.Namespace, Name: f.Name, Failed: []string{}}
+			workloads[key] = w
+			result.Workloads = append(result.Workloads, w)
+		}
+		if !slices.Contains(w.Failed, f.Check) {
+			w.Failed = append(w.Failed, f.Check)
+		}
+	}
+
+	for _, w := range result.Workloads {
+		w.Score = 100
+		if len(result.Checks) > 0 {
+			w.Score = 100 * max(len(result.Checks)-len(w.Failed), 0) / len(result.Checks)
+		}
+		if w.Score < minScore {
+			result.Passed = false
+			result.Reasons = append(result.Reasons, fmt.Sprintf("%s: %s %s/%s: score %d under %d", w.File, w.Kind, w.Namespace, w.Name, w.Score, minScore))
+		}
+	}
+	sort.SliceStable(result.Workloads, func(a, b int) bool {
+		return result.Workloads[a].Score < result.Workloads[b].Score
+	})
+
+	return result, nil
+}
+
+// Check fails when a gating check failed or a workload is under the minimum score, and returns the lowest scores otherwise
+func (r *LintResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d best practices violations:\n%s", len(r.Reasons), strings.Join(r.Reasons, "\n")),
+			Hint: "fix the manifests reported by kube-linter or exclude the checks in its config",
+		}
+	}
+
+	lines := []string{fmt.Sprintf("%d findings over %d checks", len(r.Findings), len(r.Checks))}
+	for _, w := range r.Workloads {
+		lines = append(lines, fmt.Sprintf("%d %s %s/%s (%s)", w.Score, w.Kind, w.Namespace, w.Name, strings.Join(w.Failed, ",")))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *KubeLinter) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
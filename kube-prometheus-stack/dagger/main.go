@@ -0,0 +1,235 @@
+// This module handles the version management of the kube-prometheus-stack Helm chart.
+//
+// It relies on the version-bumper module to track the chart releases, and flags the bumps changing
+// the CRDs: Helm never upgrades CRDs, they must be applied manually before merging.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"strings"
+)
+
+const (
+	// chartTagPrefix is the prefix of the chart release tags of the prometheus-community/helm-charts repository
+	chartTagPrefix = "kube-prometheus-stack-"
+	// crdsPath is the directory of the CRDs in the repository
+	crdsPath = "charts/kube-prometheus-stack/charts/crds/"
+)
+
+type KubePrometheusStack struct {
+	LatestVersion string
+	LocalVersion  string
+	// +private
+	Manifest *File
+	// +private
+	Key string
+	// +private
+	Constraint string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new KubePrometheusStack module comparing the latest chart release with the version pinned in the HelmRelease
+//
+// Example usage: dagger call --manifest=clusters/dev/monitoring/helmrelease.yaml report export --path=report.json
+func New(
+	ctx context.Context,
+	// HelmRelease storing the current chart version
+	// +required
+	manifest *File,
+	// Dot separated path of the chart version field in the manifest
+	// +optional
+	// +default="spec.chart.spec.version"
+	key string,
+	// Semver constraint the latest chart version must satisfy (ex: "<59")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*KubePrometheusStack, error) {
+	m := &KubePrometheusStack{
+		Manifest:     manifest,
+		Key:          key,
+		Constraint:   constraint,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		CacheTTL:     cacheTtl,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+
+	var err error
+	if m.LocalVersion, err = m.bumper().LocalVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get local version: %w", err)
+	}
+	if m.LatestVersion, err = m.bumper().LatestVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+
+	return m, nil
+}
+
+type UpdateReport struct {
+	CurrentVersion string `json:"currentVersion"`
+	LatestVersion  string `json:"latestVersion"`
+	UpdateNeeded   bool   `json:"updateNeeded"`
+	Constraint     string `json:"constraint"`
+	// Whether the bump crosses a major version, whose upgrade notes usually require manual steps
+	MajorBump bool `json:"majorBump"`
+	// CRD files changed between the current and the latest version
+	CRDChanges []string `json:"crdChanges"`
+	// Whether the CRDs must be applied manually before merging the bump
+	RequiresManualStep bool `json:"requiresManualStep"`
+	// Link to the upgrade notes of the chart
+	UpgradeNotes string `json:"upgradeNotes"`
+}
+
+// bumper returns the version-bumper tracking the chart releases
+func (m *KubePrometheusStack) bumper() *VersionBumper {
+	return dag.VersionBumper("prometheus-community", "helm-charts", m.Manifest, VersionBumperOpts{
+		Key:        m.Key,
+		TagPrefix:  chartTagPrefix,
+		Constraint: m.Constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// IsNewerVersion Check if the latest version is newer than the local version
+//
+// Example usage: dagger call --manifest=clusters/dev/monitoring/helmrelease.yaml is-newer-version
+func (m *KubePrometheusStack) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	return m.bumper().IsNewerVersion(ctx)
+}
+
+// UpdatedManifest Return the HelmRelease with the chart version set to the latest version
+//
+// Example usage: dagger call --manifest=clusters/dev/monitoring/helmrelease.yaml updated-manifest export --path=clusters/dev/monitoring/helmrelease.yaml
+func (m *KubePrometheusStack) UpdatedManifest(ctx context.Context) *File {
+	s := m.startSpan(ctx, "UpdatedManifest")
+	defer s.End(nil)
+
+	return m.bumper().UpdatedManifest()
+}
+
+// CrdChanges Return the CRD files changed between the local and the latest chart versions
+//
+// Example usage: dagger call --manifest=clusters/dev/monitoring/helmrelease.yaml crd-changes
+func (m *KubePrometheusStack) CrdChanges(ctx context.Context) (items []string, err error) {
+	s := m.startSpan(ctx, "CrdChanges")
+	defer s.End(&err)
+
+	content, err := m.get(ctx, fmt.Sprintf(
+		"https://api.github.com/repos/prometheus-community/helm-charts/compare/%s%s...%s%s",
+		chartTagPrefix, m.LocalVersion, chartTagPrefix, m.LatestVersion,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s with %s: %w", m.LocalVersion, m.LatestVersion, err)
+	}
+
+	var comparison struct {
+		Files []struct {
+			Filename string `json:"filename"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(content), &comparison); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json: %w", err)
+	}
+
+	changes := []string{}
+	for _, f := range comparison.Files {
+		if strings.HasPrefix(f.Filename, crdsPath) {
+			changes = append(changes, strings.TrimPrefix(f.Filename, crdsPath))
+		}
+	}
+
+	return changes, nil
+}
+
+// Report Generate a JSON report describing the pending kube-prometheus-stack update, marking the bumps requiring a manual CRD apply
+//
+// Example usage: dagger call --manifest=clusters/dev/monitoring/helmrelease.yaml report export --path=report.json
+func (m *KubePrometheusStack) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	updateNeeded, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	changes := []string{}
+	if updateNeeded {
+		if changes, err = m.CrdChanges(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := json.MarshalIndent(&UpdateReport{
+		CurrentVersion:     m.LocalVersion,
+		LatestVersion:      m.LatestVersion,
+		UpdateNeeded:       updateNeeded,
+		Constraint:         m.Constraint,
+		MajorBump:          latestVersion.Major() > localVersion.Major(),
+		CRDChanges:         changes,
+		RequiresManualStep: len(changes) > 0,
+		UpgradeNotes:       "https://github.com/prometheus-community/helm-charts/tree/main/charts/kube-prometheus-stack#upgrading-chart",
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
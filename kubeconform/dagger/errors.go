@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the kubeconform commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"could not find schema"},
+	AuthHint:       "check the credentials of the schema location",
+	ValidationHint: "check the Kubernetes version and the schema locations",
+}
+
+// commandError types the error of a kubeconform command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,227 @@
+// This module validates Kubernetes manifests against their JSON schemas with kubeconform.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+type Kubeconform struct {
+	// The version of kubeconform (ex: v0.6.4)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Kubeconform module pinned to the provided kubeconform version
+func New(
+	// The version of kubeconform
+	// +optional
+	// +default="v0.6.4"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Kubeconform {
+	return &Kubeconform{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ValidationResult struct {
+	// Whether every resource is valid
+	Passed bool
+	// Resources that failed validation
+	Violations []*Violation
+	// Raw kubeconform JSON output
+	Report *File
+}
+
+type Violation struct {
+	File    string
+	Kind    string
+	Name    string
+	Status  string
+	Message string
+}
+
+type kubeconformOutput struct {
+	Resources []struct {
+		Filename string `json:"filename"`
+		Kind     string `json:"kind"`
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		Status   string `json:"status"`
+		Msg      string `json:"msg"`
+	} `json:"resources"`
+}
+
+// Validate checks every manifest of the directory and returns the per-file violations.
+// Custom resources are resolved through the schema locations, the datree CRDs catalog by default.
+//
+// Example usage: dagger call validate --manifests=./rendered passed
+func (m *Kubeconform) Validate(
+	ctx context.Context,
+	// Directory of manifests, searched recursively
+	// +required
+	manifests *Directory,
+	// Schema locations passed to kubeconform, in order
+	// +optional
+	// +default=["default", "https://raw.githubusercontent.com/datreeio/CRDs-catalog/main/{{.Group}}/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json"]
+	schemaLocations []string,
+	// Kubernetes version to validate against (ex: 1.29.0)
+	// +optional
+	// +default="master"
+	kubernetesVersion string,
+	// Reject unknown fields
+	// +optional
+	// +default=true
+	strict bool,
+	// Accept resources without a known schema instead of failing
+	// +optional
+	ignoreMissingSchemas bool,
+	// Kinds to skip (ex: Secret,SealedSecret)
+	// +optional
+	skip []string,
+) (validationResult *ValidationResult, err error) {
+	s := m.startSpan(ctx, "Validate")
+	defer s.End(&err)
+
+	args := []string{"/kubeconform", "-output", "json", "-kubernetes-version", kubernetesVersion}
+	for _, location := range schemaLocations {
+		args = append(args, "-schema-location", "'"+location+"'")
+	}
+	if strict {
+		args = append(args, "-strict")
+	}
+	if ignoreMissingSchemas {
+		args = append(args, "-ignore-missing-schemas")
+	}
+	if len(skip) > 0 {
+		args = append(args, "-skip", strings.Join(skip, ","))
+	}
+	args = append(args, "/workspace")
+
+	// kubeconform exits with 1 on invalid resources, keep the report instead of failing the exec
+	report := m.withProxy(dag.Container().From("ghcr.io/yannh/kubeconform:"+m.Version+"-alpine")).
+		WithDirectory("/workspace", manifests).
+		WithExec(
+			[]string{"sh", "-c", strings.Join(args, " ") + " > /tmp/report.json || true"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		File("/tmp/report.json")
+
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run kubeconform: %w", commandError(err))
+	}
+
+	var output kubeconformOutput
+	if err := json.Unmarshal([]byte(content), &output); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kubeconform output: %w", err)
+	}
+
+	result := &ValidationResult{Passed: true, Report: report}
+	for _, r := range output.Resources {
+		if r.Status != "statusInvalid" && r.Status != "statusError" {
+			continue
+		}
+		result.Passed = false
+		result.Violations = append(result.Violations, &Violation{
+			File:    strings.TrimPrefix(r.Filename, "/workspace/"),
+			Kind:    r.Kind,
+			Name:    r.Name,
+			Status:  strings.TrimPrefix(r.Status, "status"),
+			Message: r.Msg,
+		})
+	}
+
+	return result, nil
+}
+
+// Check validates the manifests like validate and fails when any resource is invalid.
+//
+// Example usage: dagger call check --manifests=./rendered
+func (m *Kubeconform) Check(
+	ctx context.Context,
+	// Directory of manifests, searched recursively
+	// +required
+	manifests *Directory,
+	// Schema locations passed to kubeconform, in order
+	// +optional
+	// +default=["default", "https://raw.githubusercontent.com/datreeio/CRDs-catalog/main/{{.Group}}/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json"]
+	schemaLocations []string,
+	// Kubernetes version to validate against (ex: 1.29.0)
+	// +optional
+	// +default="master"
+	kubernetesVersion string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	result, err := m.Validate(ctx, manifests, schemaLocations, kubernetesVersion, true, false, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if !result.Passed {
+		lines := make([]string, 0, len(result.Violations))
+		for _, v := range result.Violations {
+			lines = append(lines, fmt.Sprintf("%s: %s %s: %s", v.File, v.Kind, v.Name, v.Message))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d invalid resources:\n%s", len(result.Violations), strings.Join(lines, "\n")),
+			Hint: "fix the resources reported against their schemas",
+		}
+	}
+
+	return "All resources are valid", nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Kubeconform) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
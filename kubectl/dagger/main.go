@@ -0,0 +1,330 @@
+// This module diffs and applies manifests to a cluster and waits for rollouts with a pinned kubectl.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Kubectl struct {
+	// Kubeconfig giving access to the cluster
+	// +private
+	Kubeconfig *Secret
+	// The version of the kubectl image (ex: 1.29)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Kubectl module for the cluster of the provided kubeconfig
+func New(
+	// Kubeconfig giving access to the cluster
+	// +required
+	kubeconfig *Secret,
+	// The version of the kubectl image
+	// +optional
+	// +default="1.29"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Kubectl {
+	return &Kubectl{
+		Kubeconfig:   kubeconfig,
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type DiffResult struct {
+	// Whether the manifests differ from the cluster state
+	HasChanges bool
+	// Unified diff between the cluster state and the manifests
+	Diff string
+}
+
+type ApplyResult struct {
+	// Resources applied or pruned
+	Resources []*Resource
+	// Full kubectl output
+	Output string
+}
+
+type Resource struct {
+	// Kind of the resource, with its API group (ex: deployment.apps)
+	Kind string
+	// Name of the resource
+	Name string
+	// Action taken by kubectl (ex: created, configured, unchanged, serverside-applied, pruned)
+	Action string
+}
+
+type RolloutResult struct {
+	// Whether the rollout completed within the timeout
+	Ready bool
+	// kubectl rollout status output, or the error when the rollout did not complete
+	Message string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// base returns a kubectl container with the kubeconfig mounted.
+// The cluster state changes outside of Dagger, so commands are never cached.
+func (m *Kubectl) base() *Container {
+	return m.withProxy(dag.Container().From("bitnami/kubectl:"+m.Version)).
+		WithMountedSecret("/tmp/kubeconfig", m.Kubeconfig).
+		WithEnvVariable("KUBECONFIG", "/tmp/kubeconfig").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithWorkdir("/workspace")
+}
+
+// Diff compares the manifests of dir (recursively) with the cluster state.
+//
+// Example usage: dagger call --kubeconfig=file:$HOME/.kube/config diff --dir=./manifests diff
+func (m *Kubectl) Diff(
+	ctx context.Context,
+	// Directory of the manifests
+	// +required
+	dir *Directory,
+	// Compare using server-side apply
+	// +optional
+	serverSide bool,
+) (result *DiffResult, err error) {
+	s := m.startSpan(ctx, "Diff")
+	defer s.End(&err)
+
+	args := []string{"kubectl", "diff", "--recursive", "--filename", "/workspace"}
+	if serverSide {
+		args = append(args, "--server-side")
+	}
+
+	// kubectl diff exits with 1 when there are differences and above 1 on errors
+	c := m.base().
+		WithDirectory("/workspace", dir).
+		WithExec(
+			[]string{"sh", "-c", strings.Join(args, " ") + " > /tmp/diff 2> /tmp/stderr; echo $? > /tmp/exit-code"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubectl exit code: %w", commandError(err))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected kubectl exit code %q", exitCode)
+	}
+	if code > 1 {
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return nil, commandFailures.Type(fmt.Errorf("kubectl diff failed: %s", strings.TrimSpace(stderr)), stderr)
+	}
+
+	diff, err := c.File("/tmp/diff").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubectl diff: %w", commandError(err))
+	}
+
+	return &DiffResult{
+		HasChanges: code == 1,
+		Diff:       diff,
+	}, nil
+}
+
+// Apply applies the manifests of dir (recursively), optionally pruning the resources of the selector no longer in dir.
+//
+// Example usage: dagger call --kubeconfig=file:$HOME/.kube/config apply --dir=./manifests --server-side --prune --selector=app.kubernetes.io/part-of=shop resources
+func (m *Kubectl) Apply(
+	ctx context.Context,
+	// Directory of the manifests
+	// +required
+	dir *Directory,
+	// Delete the resources matching selector which are not in dir anymore
+	// +optional
+	prune bool,
+	// Apply using server-side apply, taking ownership of conflicting fields
+	// +optional
+	serverSide bool,
+	// Label selector of the resources managed by dir, required by prune
+	// +optional
+	selector string,
+	// Field manager used by server-side apply
+	// +optional
+	// +default="dagger"
+	fieldManager string,
+) (result *ApplyResult, err error) {
+	s := m.startSpan(ctx, "Apply")
+	defer s.End(&err)
+
+	args := []string{"kubectl", "apply", "--recursive", "--filename", "/workspace"}
+	if serverSide {
+		args = append(args, "--server-side", "--force-conflicts", "--field-manager", fieldManager)
+	}
+	if prune {
+		if selector == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("prune requires a selector, to avoid deleting resources not managed by dir"),
+				Hint: "set a selector matching the resources of the directory",
+			}
+		}
+		args = append(args, "--prune")
+	}
+	if selector != "" {
+		args = append(args, "--selector", selector)
+	}
+
+	out, err := m.base().
+		WithDirectory("/workspace", dir).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kubectl apply failed: %w", commandError(err))
+	}
+
+	return &ApplyResult{
+		Resources: parseApplyOutput(out),
+		Output:    out,
+	}, nil
+}
+
+// WaitForRollout waits for the rollout of a deployment, statefulset or daemonset to complete.
+//
+// Example usage: dagger call --kubeconfig=file:$HOME/.kube/config wait-for-rollout --name=api --namespace=shop ready
+func (m *Kubectl) WaitForRollout(
+	ctx context.Context,
+	// Kind of the workload (deployment, statefulset or daemonset)
+	// +optional
+	// +default="deployment"
+	kind string,
+	// Name of the workload
+	// +required
+	name string,
+	// Namespace of the workload
+	// +optional
+	// +default="default"
+	namespace string,
+	// Maximum duration to wait for
+	// +optional
+	// +default="5m"
+	timeout string,
+) (result *RolloutResult, err error) {
+	s := m.startSpan(ctx, "WaitForRollout")
+	defer s.End(&err)
+
+	out, err := m.base().
+		WithExec([]string{
+			"kubectl", "rollout", "status", kind + "/" + name,
+			"--namespace", namespace, "--timeout", timeout,
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		var execErr *ExecError
+		if errors.As(err, &execErr) {
+			return &RolloutResult{
+				Ready:        false,
+				Message:      strings.TrimSpace(execErr.Stderr),
+				OtlpEndpoint: m.OtlpEndpoint,
+				OtlpHeaders:  m.OtlpHeaders,
+				Traceparent:  m.Traceparent,
+			}, nil
+		}
+		return nil, fmt.Errorf("failed to wait for %s/%s rollout: %w", kind, name, commandError(err))
+	}
+
+	return &RolloutResult{
+		Ready:        true,
+		Message:      strings.TrimSpace(out),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when the rollout did not complete, and returns the rollout status otherwise
+func (r *RolloutResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Ready {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("rollout did not complete: %s", r.Message),
+			Hint: "check the events and the pods of the workload, or raise the timeout",
+		}
+	}
+
+	return r.Message, nil
+}
+
+// parseApplyOutput parses the kubectl apply lines (ex: deployment.apps/api configured) into resources
+func parseApplyOutput(out string) []*Resource {
+	var resources []*Resource
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kind, name, ok := strings.Cut(fields[0], "/")
+		if !ok {
+			continue
+		}
+		resources = append(resources, &Resource{
+			Kind:   kind,
+			Name:   name,
+			Action: strings.Join(fields[1:], " "),
+		})
+	}
+
+	return resources
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Kubectl) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the kustomize commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"accumulating resources", "no such file or directory", "missing resource"},
+	AuthHint:       "check the credentials of the remote bases",
+	ValidationHint: "fix the kustomization and the resources it references",
+}
+
+// commandError types the error of a kustomize command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
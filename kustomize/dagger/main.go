@@ -0,0 +1,202 @@
+// This module renders and validates kustomize overlays with a pinned kustomize version.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"strings"
+)
+
+type Kustomize struct {
+	// The version of kustomize (ex: v5.3.0)
+	// +private
+	Version string
+	// The version of helm used to inflate helm charts (ex: 3.14.2)
+	// +private
+	HelmVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Kustomize module pinned to the provided kustomize and helm versions
+func New(
+	// The version of kustomize
+	// +optional
+	// +default="v5.3.0"
+	version string,
+	// The version of helm used by helmCharts generators
+	// +optional
+	// +default="3.14.2"
+	helmVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Kustomize {
+	return &Kustomize{
+		Version:      version,
+		HelmVersion:  helmVersion,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// base returns a container with the pinned kustomize and helm binaries and the sources mounted in /workspace
+func (m *Kustomize) base(ctx context.Context, dir *Directory) (*Container, error) {
+	platform, err := dag.DefaultPlatform(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default platform: %w", err)
+	}
+	arch := path.Base(string(platform))
+
+	url := fmt.Sprintf(
+		"https://github.com/kubernetes-sigs/kustomize/releases/download/kustomize%%2F%s/kustomize_%s_linux_%s.tar.gz",
+		m.Version, m.Version, arch,
+	)
+
+	return m.withProxy(dag.Container().From("alpine/helm:"+m.HelmVersion)).
+		WithMountedFile("/tmp/kustomize.tar.gz", dag.HTTP(url)).
+		WithExec(
+			[]string{"tar", "-xzf", "/tmp/kustomize.tar.gz", "-C", "/usr/local/bin", "kustomize"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithDirectory("/workspace", dir).
+		WithWorkdir("/workspace"), nil
+}
+
+// Build renders an overlay (kustomize build) and returns the resulting manifests.
+// Components referenced by the overlay are resolved from dir, helm charts are inflated when enableHelm is set.
+//
+// Example usage: dagger call build --dir=. --overlay=clusters/dev export --path=dev.yaml
+func (m *Kustomize) Build(
+	ctx context.Context,
+	// Directory containing the overlay and its bases, usually the repository root
+	// +required
+	dir *Directory,
+	// Path of the overlay, relative to dir
+	// +required
+	overlay string,
+	// Inflate helmCharts generators
+	// +optional
+	// +default=true
+	enableHelm bool,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Build")
+	defer s.End(&err)
+
+	c, err := m.base(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f := c.WithExec(m.buildArgs(overlay, "/tmp/build.yaml", enableHelm), ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/tmp/build.yaml")
+	if _, err := f.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to build overlay %s: %w", overlay, commandError(err))
+	}
+
+	return f, nil
+}
+
+// BuildAll renders every overlay matching the pattern and returns a directory with one <overlay>.yaml file per overlay.
+//
+// Example usage: dagger call build-all --dir=. --pattern="clusters/*/kustomization.yaml" export --path=rendered
+func (m *Kustomize) BuildAll(
+	ctx context.Context,
+	// Directory containing the overlays and their bases, usually the repository root
+	// +required
+	dir *Directory,
+	// Glob pattern of the kustomization files of the overlays, relative to dir
+	// +optional
+	// +default="**/overlays/*/kustomization.yaml"
+	pattern string,
+	// Inflate helmCharts generators
+	// +optional
+	// +default=true
+	enableHelm bool,
+) (result *Directory, err error) {
+	s := m.startSpan(ctx, "BuildAll")
+	defer s.End(&err)
+
+	files, err := dir.Glob(ctx, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list overlays: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("no overlay matches %s", pattern), Hint: "check the pattern of the overlays"}
+	}
+
+	c, err := m.base(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		overlay := path.Dir(f)
+		c = c.WithExec(
+			m.buildArgs(overlay, path.Join("/tmp/rendered", overlay+".yaml"), enableHelm),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+	}
+
+	out := c.Directory("/tmp/rendered")
+	if _, err := out.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to build overlays: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// buildArgs returns the kustomize build command writing the overlay to output
+func (m *Kustomize) buildArgs(overlay, output string, enableHelm bool) []string {
+	// kustomize does not create the parent directories of the output file
+	script := []string{"mkdir -p " + path.Dir(output), "&&", "kustomize build", overlay, "--output", output}
+	if enableHelm {
+		script = append(script, "--enable-helm", "--helm-command", "helm")
+	}
+
+	return []string{"sh", "-c", strings.Join(script, " ")}
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Kustomize) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
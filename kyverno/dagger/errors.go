@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the kyverno commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"policy validation error"},
+	ValidationHint: "fix the resources failing the policies, or the policies",
+}
+
+// commandError types the error of a kyverno command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,412 @@
+// This module runs the cluster Kyverno policies against manifests, reporting which resources production admission
+// would block or mutate, and runs the kyverno test suites of the policies.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"path"
+	"strings"
+)
+
+type Kyverno struct {
+	// The version of the kyverno CLI (ex: v1.12.1)
+	// +private
+	Version string
+	// The cluster policy set
+	// +private
+	Policies *Directory
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Kyverno module pinned to the provided kyverno CLI version, applying the cluster policy set
+func New(
+	// The version of the kyverno CLI
+	// +optional
+	// +default="v1.12.1"
+	version string,
+	// The cluster policy set: ClusterPolicy and Policy manifests, along with their kyverno-test.yaml suites
+	// +required
+	policies *Directory,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Kyverno {
+	return &Kyverno{
+		Version:      version,
+		Policies:     policies,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ApplyResult struct {
+	// Whether no resource would be blocked and every rule could be applied
+	Passed bool
+	// Resources failing a validate rule of an enforced policy, rejected by admission in production
+	Blocked []*Outcome
+	// Resources failing a validate rule of an audited policy, admitted with a policy report entry
+	Audited []*Outcome
+	// Resources changed by a mutate rule
+	Mutated []*Outcome
+	// Rules that could not be applied
+	Errors []*Outcome
+	// Raw policy report
+	Report *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Outcome struct {
+	Policy    string
+	Rule      string
+	Kind      string
+	Namespace string
+	Name      string
+	Message   string
+}
+
+type TestResult struct {
+	// Whether every test of the suites passed
+	Passed bool
+	// Output of kyverno test
+	Output string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// policy is the part of a ClusterPolicy or Policy the outcomes are classified with
+type policy struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		ValidationFailureAction string `yaml:"validationFailureAction"`
+		Rules                   []struct {
+			Name     string `yaml:"name"`
+			Mutate   any    `yaml:"mutate"`
+			Validate *struct {
+				FailureAction string `yaml:"failureAction"`
+			} `yaml:"validate"`
+		} `yaml:"rules"`
+	} `yaml:"spec"`
+}
+
+type policyReport struct {
+	Results []struct {
+		Policy    string `yaml:"policy"`
+		Rule      string `yaml:"rule"`
+		Result    string `yaml:"result"`
+		Message   string `yaml:"message"`
+		Resources []struct {
+			Kind      string `yaml:"kind"`
+			Namespace string `yaml:"namespace"`
+			Name      string `yaml:"name"`
+		} `yaml:"resources"`
+	} `yaml:"results"`
+}
+
+// rule is how a policy rule affects admission
+type rule struct {
+	mutate  bool
+	enforce bool
+}
+
+// base returns a container with the pinned kyverno CLI and the policies mounted in /policies
+func (m *Kyverno) base(ctx context.Context) (*Container, error) {
+	platform, err := dag.DefaultPlatform(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default platform: %w", err)
+	}
+	arch := path.Base(string(platform))
+	if arch == "amd64" {
+		arch = "x86_64"
+	}
+
+	url := fmt.Sprintf(
+		"https://github.com/kyverno/kyverno/releases/download/%s/kyverno-cli_%s_linux_%s.tar.gz",
+		m.Version, m.Version, arch,
+	)
+
+	return m.withProxy(dag.Container().From("alpine:3.19")).
+		WithMountedFile("/tmp/kyverno.tar.gz", dag.HTTP(url)).
+		WithExec(
+			[]string{"tar", "-xzf", "/tmp/kyverno.tar.gz", "-C", "/usr/local/bin", "kyverno"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithDirectory("/policies", m.Policies), nil
+}
+
+// rules returns how every rule of the policy set affects admission, by policy and rule name
+func (m *Kyverno) rules(ctx context.Context) (map[string]rule, error) {
+	rules := map[string]rule{}
+	for _, pattern := range []string{"**/*.yaml", "**/*.yml"} {
+		files, err := m.Policies.Glob(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list policies: %w", err)
+		}
+
+		for _, f := range files {
+			content, err := m.Policies.File(f).Contents(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", f, err)
+			}
+
+			decoder := yaml.NewDecoder(strings.NewReader(content))
+			for {
+				var p policy
+				if err := decoder.Decode(&p); err != nil {
+					// Files that are not policies (ex: test suites, values) are skipped
+					break
+				}
+				if p.Kind != "ClusterPolicy" && p.Kind != "Policy" {
+					continue
+				}
+				for _, r := range p.Spec.Rules {
+					action := p.Spec.ValidationFailureAction
+					if r.Validate != nil && r.Validate.FailureAction != "" {
+						action = r.Validate.FailureAction
+					}
+					rules[p.Metadata.Name+"/"+r.Name] = rule{
+						mutate:  r.Mutate != nil,
+						enforce: strings.EqualFold(action, "enforce"),
+					}
+				}
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// Apply applies the policy set to the manifests and classifies the outcome for every resource.
+//
+// Example usage: dagger call --policies=./policies apply --manifests=./rendered check
+func (m *Kyverno) Apply(
+	ctx context.Context,
+	// Directory of manifests, searched recursively
+	// +required
+	manifests *Directory,
+	// Values of the policy variables (ex: request.operation=CREATE)
+	// +optional
+	setValues []string,
+) (applyResult *ApplyResult, err error) {
+	s := m.startSpan(ctx, "Apply")
+	defer s.End(&err)
+
+	rules, err := m.rules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := m.base(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := "kyverno apply /policies --resource /workspace --policy-report"
+	if len(setValues) > 0 {
+		args += " --set " + shell.Quote(strings.Join(setValues, ","))
+	}
+
+	// kyverno exits with 1 on policy failures, keep the report instead of failing the exec
+	c = c.
+		WithDirectory("/workspace", manifests).
+		WithExec([]string{
+			"sh", "-c", args + " > /tmp/output 2> /tmp/stderr; echo $? > /tmp/exit-code",
+		}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run kyverno apply: %w", commandError(err))
+	}
+	if code := strings.TrimSpace(exitCode); code != "0" && code != "1" {
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return nil, commandFailures.Type(fmt.Errorf("kyverno apply exited with %s: %s", code, stderr), stderr)
+	}
+
+	output, err := c.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kyverno apply output: %w", commandError(err))
+	}
+
+	// The policy report is printed after the summary of the applied rules
+	start := strings.Index(output, "apiVersion:")
+	if start < 0 {
+		return nil, fmt.Errorf("no policy report in kyverno apply output: %s", output)
+	}
+	var report policyReport
+	if err := yaml.Unmarshal([]byte(output[start:]), &report); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal policy report: %w", err)
+	}
+
+	result := &ApplyResult{
+		Passed:       true,
+		Blocked:      []*Outcome{},
+		Audited:      []*Outcome{},
+		Mutated:      []*Outcome{},
+		Errors:       []*Outcome{},
+		Report:       dag.Directory().WithNewFile("policy-report.yaml", output[start:]).File("policy-report.yaml"),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, r := range report.Results {
+		kind := rules[r.Policy+"/"+r.Rule]
+		for _, res := range r.Resources {
+			o := &Outcome{Policy: r.Policy, Rule: r.Rule, Kind: res.Kind, Namespace: res.Namespace, Name: res.Name, Message: r.Message}
+			switch {
+			case r.Result == "error":
+				result.Errors = append(result.Errors, o)
+				result.Passed = false
+			case r.Result == "pass" && kind.mutate:
+				result.Mutated = append(result.Mutated, o)
+			case r.Result == "fail" && kind.enforce:
+				result.Blocked = append(result.Blocked, o)
+				result.Passed = false
+			case r.Result == "fail" || r.Result == "warn":
+				result.Audited = append(result.Audited, o)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Check fails when a resource would be blocked or a rule could not be applied, and returns a summary otherwise
+func (r *ApplyResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, o := range r.Blocked {
+			lines = append(lines, "blocked: "+describe(o))
+		}
+		for _, o := range r.Errors {
+			lines = append(lines, "error: "+describe(o))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d resources blocked, %d errors:\n%s", len(r.Blocked), len(r.Errors), strings.Join(lines, "\n")),
+			Hint: "fix the resources blocked by the policies, or the policies",
+		}
+	}
+
+	return fmt.Sprintf("No resource blocked, %d audit violations, %d mutations", len(r.Audited), len(r.Mutated)), nil
+}
+
+// describe returns the outcome as policy/rule: kind namespace/name: message
+func describe(o *Outcome) string {
+	return fmt.Sprintf("%s/%s: %s %s/%s: %s", o.Policy, o.Rule, o.Kind, o.Namespace, o.Name, o.Message)
+}
+
+// Test runs the kyverno test suites (kyverno-test.yaml) of the policy set.
+//
+// Example usage: dagger call --policies=./policies test check
+func (m *Kyverno) Test(
+	ctx context.Context,
+	// Directory of the test suites, relative to the policy set
+	// +optional
+	// +default="."
+	dir string,
+) (result *TestResult, err error) {
+	s := m.startSpan(ctx, "Test")
+	defer s.End(&err)
+
+	c, err := m.base(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c = c.
+		WithWorkdir("/policies").
+		WithExec([]string{
+			"sh", "-c", "kyverno test " + shell.Quote(dir) + " > /tmp/output 2>&1; echo $? > /tmp/exit-code",
+		}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run kyverno test: %w", commandError(err))
+	}
+	output, err := c.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kyverno test output: %w", commandError(err))
+	}
+
+	return &TestResult{
+		Passed:       strings.TrimSpace(exitCode) == "0",
+		Output:       output,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when a test failed, and returns the output of kyverno test otherwise
+func (r *TestResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("kyverno tests failed:\n%s", r.Output),
+			Hint: "fix the kyverno tests or the policies",
+		}
+	}
+
+	return r.Output, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Kyverno) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
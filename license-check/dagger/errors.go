@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the license inventory commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check the credentials of the private registries",
+	ValidationHint: "check the lockfiles of the dependencies",
+}
+
+// commandError types the error of a license inventory command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,275 @@
+// This module inventories the licenses of the go, npm and composer dependencies of a source directory, and checks them
+// against the allow and deny lists of a license policy file.
+//
+// Dependencies and their licenses are resolved with syft from the lockfiles, fetching the licenses missing from the
+// lockfiles (go modules, npm packages) from the package registries.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type LicenseCheck struct {
+	// License policy file
+	// +private
+	Policy *File
+	// The version of syft (ex: v1.1.0)
+	// +private
+	SyftVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new LicenseCheck module enforcing the license policy file.
+//
+// The policy file is YAML: allow and deny list SPDX license IDs or glob patterns (ex: GPL-*), exceptions list packages
+// accepted whatever their licenses along with a reason, and failOnUnknown also fails on unapproved or missing licenses.
+func New(
+	// License policy file
+	// +required
+	policy *File,
+	// The version of syft
+	// +optional
+	// +default="v1.1.0"
+	syftVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *LicenseCheck {
+	return &LicenseCheck{
+		Policy:       policy,
+		SyftVersion:  syftVersion,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type LicenseResult struct {
+	// Whether no dependency has a denied license, nor an unknown one when the policy fails on unknown licenses
+	Passed   bool
+	Packages []*Package
+	Allowed  int
+	Denied   int
+	Unknown  int
+	// JSON report of the packages and their status
+	Report *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Package struct {
+	Name    string
+	Version string
+	// go-module, npm or php-composer
+	Ecosystem string
+	// Licenses as SPDX expressions, empty when not found
+	Licenses []string
+	// allowed, denied or unknown
+	Status string
+	// Why the package got its status (ex: denied license, policy exception)
+	Reason string
+}
+
+type syftOutput struct {
+	Artifacts []struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		Type     string `json:"type"`
+		Licenses []struct {
+			Value          string `json:"value"`
+			SpdxExpression string `json:"spdxExpression"`
+		} `json:"licenses"`
+	} `json:"artifacts"`
+}
+
+// Scan inventories the dependency licenses of the source directory and checks them against the policy.
+//
+// Example usage: dagger call --policy=./license-policy.yaml scan --source=. check
+func (m *LicenseCheck) Scan(
+	ctx context.Context,
+	// Source directory, with its lockfiles (go.sum, package-lock.json, composer.lock)
+	// +required
+	source *Directory,
+	// Ecosystems checked, as syft package types
+	// +optional
+	// +default=["go-module", "npm", "php-composer"]
+	ecosystems []string,
+) (licenseResult *LicenseResult, err error) {
+	s := m.startSpan(ctx, "Scan")
+	defer s.End(&err)
+
+	content, err := m.Policy.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", commandError(err))
+	}
+	policy, err := parsePolicy(content)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := m.withProxy(dag.Container().From("anchore/syft:"+m.SyftVersion)).
+		WithEnvVariable("SYFT_GOLANG_SEARCH_REMOTE_LICENSES", "true").
+		WithEnvVariable("SYFT_JAVASCRIPT_SEARCH_REMOTE_LICENSES", "true").
+		WithDirectory("/src", source).
+		WithExec([]string{"/syft", "scan", "dir:/src", "--output", "syft-json"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inventory dependencies: %w", commandError(err))
+	}
+
+	var inventory syftOutput
+	if err := json.Unmarshal([]byte(out), &inventory); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal syft output: %w", err)
+	}
+
+	result := &LicenseResult{
+		Passed:       true,
+		Packages:     []*Package{},
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, a := range inventory.Artifacts {
+		// The module of the source directory itself is not a dependency
+		if !slices.Contains(ecosystems, a.Type) || a.Version == "(devel)" {
+			continue
+		}
+
+		p := &Package{Name: a.Name, Version: a.Version, Ecosystem: a.Type, Licenses: []string{}}
+		for _, l := range a.Licenses {
+			license := l.SpdxExpression
+			if license == "" {
+				license = l.Value
+			}
+			if license != "" && !slices.Contains(p.Licenses, license) {
+				p.Licenses = append(p.Licenses, license)
+			}
+		}
+		evaluate(policy, p)
+
+		switch p.Status {
+		case "allowed":
+			result.Allowed++
+		case "denied":
+			result.Denied++
+			result.Passed = false
+		default:
+			result.Unknown++
+			if policy.FailOnUnknown {
+				result.Passed = false
+			}
+		}
+		result.Packages = append(result.Packages, p)
+	}
+	sort.SliceStable(result.Packages, func(a, b int) bool {
+		pa, pb := result.Packages[a], result.Packages[b]
+		return pa.Ecosystem+"/"+pa.Name < pb.Ecosystem+"/"+pb.Name
+	})
+
+	report, err := json.MarshalIndent(result.Packages, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+	result.Report = dag.Directory().WithNewFile("licenses.json", string(report)).File("licenses.json")
+
+	return result, nil
+}
+
+// evaluate sets the status of the package: every license must be allowed, and a single denied license denies it
+func evaluate(policy *policy, p *Package) {
+	for _, e := range policy.Exceptions {
+		if e.Package == p.Name {
+			p.Status, p.Reason = "allowed", "policy exception: "+e.Reason
+			return
+		}
+	}
+	if len(p.Licenses) == 0 {
+		p.Status, p.Reason = "unknown", "no license found"
+		return
+	}
+
+	p.Status, p.Reason = "allowed", "allowed licenses"
+	for _, l := range p.Licenses {
+		switch policy.status(l) {
+		case "denied":
+			p.Status, p.Reason = "denied", "denied license "+l
+			return
+		case "unknown":
+			p.Status, p.Reason = "unknown", "unapproved license "+l
+		}
+	}
+}
+
+// Check fails when the policy is violated, and returns the license counts otherwise
+func (r *LicenseResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	summary := fmt.Sprintf("allowed=%d denied=%d unknown=%d", r.Allowed, r.Denied, r.Unknown)
+	if !r.Passed {
+		lines := []string{}
+		for _, p := range r.Packages {
+			if p.Status != "allowed" {
+				lines = append(lines, fmt.Sprintf("%s %s@%s: %s (%s)", p.Status, p.Name, p.Version, p.Reason, strings.Join(p.Licenses, ", ")))
+			}
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("license policy violated, %s:\n%s", summary, strings.Join(lines, "\n")),
+			Hint: "replace the dependencies with denied licenses, or allow their license in the policy",
+		}
+	}
+
+	return summary, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *LicenseCheck) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"path"
+	"strings"
+)
+
+// policy is the license policy file, listing SPDX license IDs or glob patterns (ex: GPL-*)
+type policy struct {
+	// Licenses accepted, every other license is unapproved
+	Allow []string `yaml:"allow"`
+	// Licenses refused, failing the check
+	Deny []string `yaml:"deny"`
+	// Packages accepted whatever their licenses, with the reason of the exception
+	Exceptions []struct {
+		Package string `yaml:"package"`
+		Reason  string `yaml:"reason"`
+	} `yaml:"exceptions"`
+	// Fail on packages with an unknown or unapproved license, instead of only reporting them
+	FailOnUnknown bool `yaml:"failOnUnknown"`
+}
+
+// parsePolicy parses the policy file
+func parsePolicy(content string) (*policy, error) {
+	p := &policy{}
+	if err := yaml.Unmarshal([]byte(content), p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal policy: %w", err)
+	}
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid license pattern %q: %w", pattern, err),
+				Hint: "fix the license patterns of the policy",
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// matches checks if the license matches one of the patterns, case insensitively
+func matches(license string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(license)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// status returns the status of a license or SPDX expression: allowed, denied or unknown.
+// OR alternatives take the best status, AND terms the worst one.
+func (p *policy) status(expression string) string {
+	expression = strings.TrimSpace(strings.Trim(strings.TrimSpace(expression), "()"))
+	rank := map[string]int{"allowed": 0, "unknown": 1, "denied": 2}
+
+	if alternatives := strings.Split(expression, " OR "); len(alternatives) > 1 {
+		best := "denied"
+		for _, a := range alternatives {
+			if s := p.status(a); rank[s] < rank[best] {
+				best = s
+			}
+		}
+		return best
+	}
+	if terms := strings.Split(expression, " AND "); len(terms) > 1 {
+		worst := "allowed"
+		for _, t := range terms {
+			if s := p.status(t); rank[s] > rank[worst] {
+				worst = s
+			}
+		}
+		return worst
+	}
+
+	// License exceptions (ex: GPL-2.0-only WITH Classpath-exception-2.0) are matched in full first
+	license, _, _ := strings.Cut(expression, " WITH ")
+	switch {
+	case matches(expression, p.Deny), !matches(expression, p.Allow) && matches(license, p.Deny):
+		return "denied"
+	case matches(expression, p.Allow), matches(license, p.Allow):
+		return "allowed"
+	}
+
+	return "unknown"
+}
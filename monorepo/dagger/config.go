@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strings"
+)
+
+// Config maps the paths of the monorepo to the pipelines of its sub-projects, read from a YAML file:
+//
+//	global:
+//	  - go.work
+//	  - .github/workflows/**
+//	projects:
+//	  - name: api
+//	    paths: [services/api/**, libs/common/**]
+//	    pipelines:
+//	      test: call -m ./services/api test --source=.
+//	      deploy: call -m ./services/api deploy --source=. --env=dev
+type Config struct {
+	// Paths affecting every project when changed
+	Global   []string  `yaml:"global"`
+	Projects []Project `yaml:"projects"`
+}
+
+type Project struct {
+	Name string `yaml:"name"`
+	// Glob patterns of the files of the project, ** matching any number of directories
+	Paths []string `yaml:"paths"`
+	// dagger CLI arguments of the pipelines of the project, by stage (ex: build, test, deploy)
+	Pipelines map[string]string `yaml:"pipelines"`
+}
+
+// parseConfig Parse and validate the monorepo configuration
+func parseConfig(content string) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal([]byte(content), config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if len(config.Projects) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("config does not list any project"),
+			Hint: "list the projects of the config, see the README for its format",
+		}
+	}
+
+	names := map[string]bool{}
+	for i, p := range config.Projects {
+		if p.Name == "" || len(p.Paths) == 0 {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("project %d: name and paths are required", i),
+				Hint: "set the name and the paths of every project of the config",
+			}
+		}
+		if names[p.Name] {
+			return nil, &typederr.ValidationError{Err: fmt.Errorf("project %s is listed twice", p.Name), Hint: "list every project once"}
+		}
+		names[p.Name] = true
+	}
+
+	return config, nil
+}
+
+// globRegexp Convert a glob pattern to a regular expression: ** matches any number of directories, * and ? match
+// within a path segment
+func globRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.MustCompile(b.String())
+}
+
+// matching Return the files matching one of the patterns
+func matching(files, patterns []string) []string {
+	matched := []string{}
+	for _, f := range files {
+		for _, p := range patterns {
+			if globRegexp(p).MatchString(f) {
+				matched = append(matched, f)
+				break
+			}
+		}
+	}
+
+	return matched
+}
@@ -0,0 +1,443 @@
+// This module runs the pipelines of the sub-projects of a monorepo affected by a change.
+//
+// The changed files are the git diff against the base branch, or the files of a GitHub pull request, listed with the
+// gh module. A YAML config maps the paths of every sub-project to its pipelines, which are dagger CLI calls of the
+// modules of the monorepo. The pipelines of the affected projects run in parallel, and their results are aggregated
+// into one status.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"golang.org/x/sync/errgroup"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputLines is the number of lines of a pipeline output kept in its result
+const outputLines = 50
+
+type Monorepo struct {
+	// +private
+	Source *Directory
+	// +private
+	Config string
+	// +private
+	Token *Secret
+	// +private
+	DaggerVersion string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new Monorepo module for the source repository and its pipelines config
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN run --stage=test --base=master check
+func New(
+	// Repository of the monorepo, including its .git directory
+	// +required
+	source *Directory,
+	// Path of the YAML config mapping the paths to the pipelines, relative to source
+	// +optional
+	// +default="pipelines.yaml"
+	config string,
+	// GitHub token, required to list the changed files
+	// +optional
+	token *Secret,
+	// Version of the dagger CLI running the pipelines, which should match the engine
+	// +optional
+	// +default="v0.11.1"
+	daggerVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Monorepo {
+	return &Monorepo{
+		Source:        source,
+		Config:        config,
+		Token:         token,
+		DaggerVersion: daggerVersion,
+		ProxyURL:      proxyUrl,
+		NoProxy:       noProxy,
+		CABundle:      caBundle,
+		OtlpEndpoint:  otlpEndpoint,
+		OtlpHeaders:   otlpHeaders,
+		Traceparent:   traceparent,
+	}
+}
+
+type AffectedProject struct {
+	Name string
+	// Changed files of the project, including the changed global paths
+	Files []string
+}
+
+type RunResult struct {
+	// Whether every pipeline passed
+	Passed  bool
+	Stage   string
+	Results []*PipelineResult
+	// Affected projects without pipeline for the stage
+	Skipped []string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type PipelineResult struct {
+	Project string
+	// dagger CLI arguments of the pipeline
+	Command  string
+	Passed   bool
+	ExitCode int
+	// Last lines of the pipeline output
+	Output   string
+	Duration string
+}
+
+// config Read the config from the source directory
+func (m *Monorepo) config(ctx context.Context) (*Config, error) {
+	content, err := m.Source.File(m.Config).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", m.Config, err)
+	}
+
+	return parseConfig(content)
+}
+
+// ChangedFiles Return the files changed since the merge base of the base branch, or the files of the pull request
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN changed-files --pull-request=42
+func (m *Monorepo) ChangedFiles(
+	ctx context.Context,
+	// Branch the changes are compared to, fetched from origin (ex: master, main)
+	// +optional
+	// +default="master"
+	base string,
+	// Number of the GitHub pull request whose files are listed instead of the git diff
+	// +optional
+	pullRequest int,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "ChangedFiles")
+	defer s.End(&err)
+
+	if m.Token == nil {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("a GitHub token is required to list the changed files"),
+			Hint: "set the token to list the changed files of the pull request",
+		}
+	}
+	changed, err := dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		ChangedFiles(ctx, m.Source, GhChangedFilesOpts{PullRequest: pullRequest, Base: base})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed files: %w", err)
+	}
+
+	files := make([]string, 0, len(changed))
+	for _, f := range changed {
+		file, err := f.Path(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read changed file: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// Affected Return the projects affected by the changed files, in config order
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN affected --base=master
+func (m *Monorepo) Affected(
+	ctx context.Context,
+	// Branch the changes are compared to, fetched from origin (ex: master, main)
+	// +optional
+	// +default="master"
+	base string,
+	// Number of the GitHub pull request whose files are listed instead of the git diff
+	// +optional
+	pullRequest int,
+) (affectedProjects []*AffectedProject, err error) {
+	s := m.startSpan(ctx, "Affected")
+	defer s.End(&err)
+
+	config, err := m.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := m.ChangedFiles(ctx, base, pullRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return affected(config, files), nil
+}
+
+// affected Return the projects owning a changed file, every project when a global path changed
+func affected(config *Config, files []string) []*AffectedProject {
+	projects := []*AffectedProject{}
+	for _, p := range config.Projects {
+		changed := matching(files, append(append([]string{}, p.Paths...), config.Global...))
+		if len(changed) > 0 {
+			projects = append(projects, &AffectedProject{Name: p.Name, Files: changed})
+		}
+	}
+
+	return projects
+}
+
+// Run Run the pipelines of the stage of the affected projects in parallel, and aggregate their results
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN run --stage=test --base=master --concurrency=8 report
+func (m *Monorepo) Run(
+	ctx context.Context,
+	// Stage of the pipelines to run (ex: build, test, deploy)
+	// +required
+	stage string,
+	// Branch the changes are compared to, fetched from origin (ex: master, main)
+	// +optional
+	// +default="master"
+	base string,
+	// Number of the GitHub pull request whose files are listed instead of the git diff
+	// +optional
+	pullRequest int,
+	// Run the pipelines of every project, affected or not
+	// +optional
+	all bool,
+	// Maximum number of pipelines running at once
+	// +optional
+	// +default=4
+	concurrency int,
+) (runResult *RunResult, err error) {
+	s := m.startSpan(ctx, "Run")
+	defer s.End(&err)
+
+	config, err := m.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	if all {
+		for _, p := range config.Projects {
+			names = append(names, p.Name)
+		}
+	} else {
+		files, err := m.ChangedFiles(ctx, base, pullRequest)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range affected(config, files) {
+			names = append(names, p.Name)
+		}
+	}
+
+	result := &RunResult{
+		Passed:       true,
+		Stage:        stage,
+		Results:      []*PipelineResult{},
+		Skipped:      []string{},
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, p := range config.Projects {
+		if !contains(names, p.Name) {
+			continue
+		}
+		if cmd, ok := p.Pipelines[stage]; ok {
+			result.Results = append(result.Results, &PipelineResult{Project: p.Name, Command: cmd})
+		} else {
+			result.Skipped = append(result.Skipped, p.Name)
+		}
+	}
+	if len(result.Results) == 0 {
+		return result, nil
+	}
+
+	cli, err := m.cli(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(concurrency, 1))
+	for _, r := range result.Results {
+		r := r
+		g.Go(func() error {
+			return m.run(gctx, cli, r)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range result.Results {
+		if !r.Passed {
+			result.Passed = false
+		}
+	}
+
+	return result, nil
+}
+
+// cli returns a container with the pinned dagger CLI and the source mounted in /workspace
+func (m *Monorepo) cli(ctx context.Context) (*Container, error) {
+	platform, err := dag.DefaultPlatform(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default platform: %w", err)
+	}
+	arch := path.Base(string(platform))
+
+	url := fmt.Sprintf(
+		"https://dl.dagger.io/dagger/releases/%s/dagger_%s_linux_%s.tar.gz",
+		strings.TrimPrefix(m.DaggerVersion, "v"), m.DaggerVersion, arch,
+	)
+
+	return m.withProxy(dag.Container().From("alpine:3.19")).
+		WithMountedFile("/tmp/dagger.tar.gz", dag.HTTP(url)).
+		WithExec(
+			[]string{"tar", "-xzf", "/tmp/dagger.tar.gz", "-C", "/usr/local/bin", "dagger"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithDirectory("/workspace", m.Source).
+		WithWorkdir("/workspace"), nil
+}
+
+// run runs the pipeline with the dagger CLI connected to the current engine, and records its result
+func (m *Monorepo) run(ctx context.Context, cli *Container, r *PipelineResult) error {
+	start := time.Now()
+
+	// Pipelines may deploy, they always run again. The modules they call still reuse the engine cache.
+	c := cli.
+		WithEnvVariable("CACHE_BUSTER", start.String()).
+		WithExec(
+			[]string{"sh", "-c", "dagger --progress=plain " + r.Command + " > /tmp/output 2>&1; echo $? > /tmp/exit-code"},
+			ContainerWithExecOpts{SkipEntrypoint: true, ExperimentalPrivilegedNesting: true},
+		)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to run pipeline of %s: %w", r.Project, commandError(err))
+	}
+	output, err := c.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read output of %s: %w", r.Project, commandError(err))
+	}
+
+	if r.ExitCode, err = strconv.Atoi(strings.TrimSpace(exitCode)); err != nil {
+		return fmt.Errorf("failed to parse exit code of %s: %w", r.Project, err)
+	}
+	r.Passed = r.ExitCode == 0
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	r.Output = strings.Join(lines[max(len(lines)-outputLines, 0):], "\n")
+	r.Duration = time.Since(start).Round(time.Second).String()
+
+	return nil
+}
+
+// Report Return the results of the pipelines as Markdown
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN run --stage=test report
+func (r *RunResult) Report(ctx context.Context) string {
+	s := r.startSpan(ctx, "Report")
+	defer s.End(nil)
+
+	var b strings.Builder
+	status := "passed"
+	if !r.Passed {
+		status = "failed"
+	}
+	fmt.Fprintf(&b, "## %s %s\n\n", r.Stage, status)
+	if len(r.Results) == 0 {
+		b.WriteString("No affected project.\n")
+	} else {
+		b.WriteString("| Project | Pipeline | Result | Duration |\n| --- | --- | --- | --- |\n")
+		for _, p := range r.Results {
+			result := "passed"
+			if !p.Passed {
+				result = fmt.Sprintf("failed (exit code %d)", p.ExitCode)
+			}
+			fmt.Fprintf(&b, "| %s | `%s` | %s | %s |\n", p.Project, p.Command, result, p.Duration)
+		}
+	}
+	if len(r.Skipped) > 0 {
+		sort.Strings(r.Skipped)
+		fmt.Fprintf(&b, "\nAffected without %s pipeline: %s\n", r.Stage, strings.Join(r.Skipped, ", "))
+	}
+
+	return b.String()
+}
+
+// Check Fail when a pipeline failed, with its output, and return the report otherwise
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN run --stage=test check
+func (r *RunResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		failures := []string{}
+		for _, p := range r.Results {
+			if !p.Passed {
+				failures = append(failures, fmt.Sprintf("%s (exit code %d):\n%s", p.Project, p.ExitCode, p.Output))
+			}
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d %s pipelines failed:\n\n%s", len(failures), r.Stage, strings.Join(failures, "\n\n")),
+			Hint: "fix the failing pipelines of the sub-projects",
+		}
+	}
+
+	return r.Report(ctx), nil
+}
+
+// contains checks if the value is in the list
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Monorepo) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// graphql runs the NerdGraph query with its variables, and decodes its data into out
+func (m *Newrelic) graphql(ctx context.Context, query string, variables map[string]any, out any) error {
+	apiKey, err := m.APIKey.Plaintext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err = m.call(ctx, http.MethodPost, graphqlURLs[m.Region], map[string]string{"API-Key": apiKey}, map[string]any{
+		"query":     query,
+		"variables": variables,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	// NerdGraph answers 200 with the errors of the query
+	if len(resp.Errors) > 0 {
+		var messages []string
+		for _, e := range resp.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("new relic returned errors: %s", strings.Join(messages, ", "))
+	}
+	if err := json.Unmarshal(resp.Data, out); err != nil {
+		return fmt.Errorf("failed to parse response data: %w", err)
+	}
+
+	return nil
+}
+
+// grafana calls the Grafana HTTP API, authenticated with the service account token
+func (m *Newrelic) grafana(ctx context.Context, method, endpoint string, payload any) error {
+	token, err := m.GrafanaToken.Plaintext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get grafana token: %w", err)
+	}
+
+	return m.call(ctx, method, m.GrafanaURL+"/"+endpoint, map[string]string{"Authorization": "Bearer " + token}, payload, nil)
+}
+
+// call sends the JSON payload with the headers, and decodes the JSON response into out when not nil
+func (m *Newrelic) call(ctx context.Context, method, url string, headers map[string]string, payload, out any) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return typederr.FromResponse(resp, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, body))
+	}
+
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
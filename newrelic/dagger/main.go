@@ -0,0 +1,246 @@
+// This module records deployment markers in New Relic, and optionally Grafana annotations, when a deploy finishes,
+// so performance regressions can be correlated with releases.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// graphqlURLs are the NerdGraph endpoints of the New Relic regions
+var graphqlURLs = map[string]string{
+	"us": "https://api.newrelic.com/graphql",
+	"eu": "https://api.eu.newrelic.com/graphql",
+}
+
+type Newrelic struct {
+	// New Relic user API key
+	// +private
+	APIKey *Secret
+	// New Relic region of the account: us or eu
+	// +private
+	Region string
+	// URL of the Grafana instance annotated
+	// +private
+	GrafanaURL string
+	// Grafana service account token, allowed to write annotations
+	// +private
+	GrafanaToken *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Newrelic module authenticated with a user API key, and with a Grafana service account token when
+// Grafana is annotated too
+func New(
+	// New Relic user API key (NRAK-...)
+	// +required
+	apiKey *Secret,
+	// New Relic region of the account: us or eu
+	// +optional
+	// +default="us"
+	region string,
+	// URL of the Grafana instance annotated with the deployments, none when empty (ex: https://grafana.example.com)
+	// +optional
+	grafanaUrl string,
+	// Grafana service account token, allowed to write annotations
+	// +optional
+	grafanaToken *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Newrelic, error) {
+	if _, ok := graphqlURLs[region]; !ok {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported region %s, expected us or eu", region),
+			Hint: "use the us or eu region",
+		}
+	}
+	if grafanaUrl != "" && grafanaToken == nil {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("grafanaToken is required to annotate %s", grafanaUrl),
+			Hint: "set grafanaToken to annotate the Grafana dashboards",
+		}
+	}
+
+	return &Newrelic{
+		APIKey:       apiKey,
+		Region:       region,
+		GrafanaURL:   strings.TrimSuffix(grafanaUrl, "/"),
+		GrafanaToken: grafanaToken,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+// Deployment records a deployment marker on the New Relic entity of the service, and a Grafana annotation when Grafana
+// is set, and returns the ID of the marker. The entity is looked up by name among the APM applications when its GUID
+// is not provided.
+//
+// Example usage: dagger call --api-key=env:NEW_RELIC_API_KEY deployment --service=shop-api --version=1.2.3 --commit=$(git rev-parse HEAD) --actor=$GITHUB_ACTOR
+func (m *Newrelic) Deployment(
+	ctx context.Context,
+	// Name of the deployed service, as the New Relic entity name
+	// +required
+	service string,
+	// Deployed version
+	// +required
+	version string,
+	// Commit of the deployed version
+	// +optional
+	commit string,
+	// Who triggered the deployment (ex: the GitHub actor)
+	// +optional
+	actor string,
+	// Description of the deployment, defaults to "Deployed <service> <version>"
+	// +optional
+	description string,
+	// Changelog of the version, or a link to it
+	// +optional
+	changelog string,
+	// GUID of the New Relic entity, looked up from the service name when empty
+	// +optional
+	entityGuid string,
+	// UID of the Grafana dashboard annotated, the annotation is global to the organization when empty
+	// +optional
+	dashboardUid string,
+	// Tags of the Grafana annotation, besides deployment and the service name (ex: env:production)
+	// +optional
+	tags []string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Deployment")
+	defer s.End(&err)
+
+	if description == "" {
+		description = fmt.Sprintf("Deployed %s %s", service, version)
+	}
+	if entityGuid == "" {
+		guid, err := m.entityGuid(ctx, service)
+		if err != nil {
+			return "", err
+		}
+		entityGuid = guid
+	}
+
+	now := time.Now()
+	deployment := map[string]any{
+		"entityGuid":     entityGuid,
+		"version":        version,
+		"description":    description,
+		"deploymentType": "BASIC",
+		"timestamp":      now.UnixMilli(),
+	}
+	for key, value := range map[string]string{"commit": commit, "user": actor, "changelog": changelog} {
+		if value != "" {
+			deployment[key] = value
+		}
+	}
+
+	var created struct {
+		ChangeTrackingCreateDeployment struct {
+			DeploymentID string `json:"deploymentId"`
+		} `json:"changeTrackingCreateDeployment"`
+	}
+	err = m.graphql(ctx, `mutation($deployment: ChangeTrackingDeploymentInput!) {
+  changeTrackingCreateDeployment(deployment: $deployment) { deploymentId }
+}`, map[string]any{"deployment": deployment}, &created)
+	if err != nil {
+		return "", fmt.Errorf("failed to record deployment of %s: %w", service, err)
+	}
+
+	if m.GrafanaURL != "" {
+		text := description
+		if commit != "" {
+			text += " (" + commit + ")"
+		}
+		if actor != "" {
+			text += " by " + actor
+		}
+		annotation := map[string]any{
+			"time": now.UnixMilli(),
+			"tags": append([]string{"deployment", service}, tags...),
+			"text": text,
+		}
+		if dashboardUid != "" {
+			annotation["dashboardUID"] = dashboardUid
+		}
+		if err := m.grafana(ctx, http.MethodPost, "api/annotations", annotation); err != nil {
+			return "", fmt.Errorf("failed to annotate grafana: %w", err)
+		}
+	}
+
+	return created.ChangeTrackingCreateDeployment.DeploymentID, nil
+}
+
+// entityGuid returns the GUID of the APM application named after the service
+func (m *Newrelic) entityGuid(ctx context.Context, service string) (string, error) {
+	var found struct {
+		Actor struct {
+			EntitySearch struct {
+				Results struct {
+					Entities []struct {
+						Guid string `json:"guid"`
+						Name string `json:"name"`
+					} `json:"entities"`
+				} `json:"results"`
+			} `json:"entitySearch"`
+		} `json:"actor"`
+	}
+	err := m.graphql(ctx, `query($query: String!) {
+  actor { entitySearch(query: $query) { results { entities { guid name } } } }
+}`, map[string]any{"query": fmt.Sprintf("domain = 'APM' AND type = 'APPLICATION' AND name = '%s'", strings.ReplaceAll(service, "'", `\'`))}, &found)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up entity %s: %w", service, err)
+	}
+
+	// The search also matches names containing the service name
+	for _, e := range found.Actor.EntitySearch.Results.Entities {
+		if e.Name == service {
+			return e.Guid, nil
+		}
+	}
+
+	return "", &typederr.ValidationError{
+		Err:  fmt.Errorf("no APM application named %s, set entityGuid", service),
+		Hint: "set entityGuid, or the name of the APM application",
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the package manager commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"npm err! code eresolve", "err_pnpm_outdated_lockfile", "frozen-lockfile"},
+	AuthHint:       "check the registry token of the private packages",
+	ValidationHint: "update the lockfile to match package.json, or fix the failing scripts",
+}
+
+// commandError types the error of a package manager command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,297 @@
+// This module installs, builds and tests Node.js projects with npm, yarn or pnpm, caching the dependencies per lockfile.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+)
+
+// lockfiles maps the lockfile of each package manager to the manager
+var lockfiles = []struct {
+	file    string
+	manager string
+}{
+	{"pnpm-lock.yaml", "pnpm"},
+	{"yarn.lock", "yarn"},
+	{"package-lock.json", "npm"},
+}
+
+type Node struct {
+	// The version of Node.js (ex: 20.12)
+	// +private
+	Version string
+	// The package manager: npm, yarn or pnpm, detected from the lockfile when empty
+	// +private
+	PackageManager string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Node module pinned to the provided Node.js version
+func New(
+	// The version of Node.js
+	// +optional
+	// +default="20.12"
+	version string,
+	// The package manager: npm, yarn or pnpm, detected from the lockfile when empty
+	// +optional
+	packageManager string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Node {
+	return &Node{
+		Version:        version,
+		PackageManager: packageManager,
+		ProxyURL:       proxyUrl,
+		NoProxy:        noProxy,
+		CABundle:       caBundle,
+		OtlpEndpoint:   otlpEndpoint,
+		OtlpHeaders:    otlpHeaders,
+		Traceparent:    traceparent,
+	}
+}
+
+type TestResult struct {
+	// Whether every test passed
+	Passed bool
+	// JUnit XML report
+	Junit *File
+	// Test output
+	Output string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// Install installs the dependencies from the lockfile and returns the sources with their node_modules.
+//
+// Example usage: dagger call install --source=. export --path=.
+func (m *Node) Install(
+	ctx context.Context,
+	// The project sources, including package.json and the lockfile
+	// +required
+	source *Directory,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Install")
+	defer s.End(&err)
+
+	c, _, err := m.withDependencies(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Directory("/app"), nil
+}
+
+// Build runs the build script and returns its output directory.
+//
+// Example usage: dagger call build --source=. --output=dist export --path=dist
+func (m *Node) Build(
+	ctx context.Context,
+	// The project sources, including package.json and the lockfile
+	// +required
+	source *Directory,
+	// Script of package.json building the project
+	// +optional
+	// +default="build"
+	script string,
+	// Output directory of the build, relative to the sources
+	// +optional
+	// +default="dist"
+	output string,
+	// Environment variables of the build (ex: NODE_ENV=production)
+	// +optional
+	env []string,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Build")
+	defer s.End(&err)
+
+	c, manager, err := m.withDependencies(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		c = c.WithEnvVariable(name, value)
+	}
+
+	return c.
+		WithExec([]string{manager, "run", script}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory(output), nil
+}
+
+// Test runs the test script and returns its JUnit report, also when tests fail.
+// The test runner must write a JUnit report to junitFile: JEST_JUNIT_OUTPUT_FILE and MOCHA_FILE are set for jest-junit and mocha-junit-reporter.
+//
+// Example usage: dagger call test --source=. junit export --path=junit.xml
+func (m *Node) Test(
+	ctx context.Context,
+	// The project sources, including package.json and the lockfile
+	// +required
+	source *Directory,
+	// Script of package.json running the tests
+	// +optional
+	// +default="test"
+	script string,
+	// Path of the JUnit report written by the test runner, relative to the sources
+	// +optional
+	// +default="junit.xml"
+	junitFile string,
+) (result *TestResult, err error) {
+	s := m.startSpan(ctx, "Test")
+	defer s.End(&err)
+
+	c, manager, err := m.withDependencies(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing tests are reported, not returned as an error
+	c = c.
+		WithEnvVariable("CI", "true").
+		WithEnvVariable("JEST_JUNIT_OUTPUT_FILE", "/app/"+junitFile).
+		WithEnvVariable("MOCHA_FILE", "/app/"+junitFile).
+		WithExec(
+			[]string{"sh", "-c", `"$@" > /tmp/output.log 2>&1; echo $? > /tmp/exit-code`, "sh", manager, "run", script},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test exit code: %w", commandError(err))
+	}
+	output, err := c.File("/tmp/output.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test output: %w", commandError(err))
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected test exit code %q", exitCode)
+	}
+
+	return &TestResult{
+		Passed:       code == 0,
+		Junit:        c.File(junitFile),
+		Output:       output,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when a test failed, and returns the test output otherwise
+func (r *TestResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("tests failed:\n%s", r.Output), Hint: "fix the failing tests"}
+	}
+
+	return r.Output, nil
+}
+
+// withDependencies returns a Node.js container with the sources and their dependencies installed, and the package manager used.
+// The package manager store is cached in a volume keyed by the lockfile, so that a lockfile change starts from a clean store.
+func (m *Node) withDependencies(ctx context.Context, source *Directory) (*Container, string, error) {
+	manager, lockfile := m.PackageManager, ""
+	for _, l := range lockfiles {
+		entries, err := source.Glob(ctx, l.file)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look for %s: %w", l.file, err)
+		}
+		if len(entries) > 0 && (manager == "" || manager == l.manager) {
+			manager, lockfile = l.manager, l.file
+			break
+		}
+	}
+	if lockfile == "" {
+		return nil, "", &typederr.ValidationError{
+			Err:  fmt.Errorf("no lockfile found for %s, expected one of pnpm-lock.yaml, yarn.lock or package-lock.json", orAny(manager)),
+			Hint: "commit the lockfile of the package manager",
+		}
+	}
+
+	lock, err := source.File(lockfile).Contents(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", lockfile, commandError(err))
+	}
+	sum := sha256.Sum256([]byte(lock))
+	cache := dag.CacheVolume(fmt.Sprintf("node-%s-%x", manager, sum[:6]))
+
+	c := m.withProxy(dag.Container().From("node:"+m.Version)).
+		WithExec([]string{"corepack", "enable"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithDirectory("/app", source).
+		WithWorkdir("/app")
+
+	var install []string
+	switch manager {
+	case "npm":
+		c = c.WithMountedCache("/root/.npm", cache)
+		install = []string{"npm", "ci"}
+	case "yarn":
+		c = c.WithMountedCache("/root/.cache/yarn", cache).WithEnvVariable("YARN_CACHE_FOLDER", "/root/.cache/yarn")
+		install = []string{"yarn", "install", "--frozen-lockfile"}
+	case "pnpm":
+		c = c.WithMountedCache("/root/.local/share/pnpm/store", cache).WithEnvVariable("npm_config_store_dir", "/root/.local/share/pnpm/store")
+		install = []string{"pnpm", "install", "--frozen-lockfile"}
+	}
+
+	return c.WithExec(install, ContainerWithExecOpts{SkipEntrypoint: true}), manager, nil
+}
+
+// orAny returns the package manager, or "any package manager" when empty
+func orAny(manager string) string {
+	if manager == "" {
+		return "any package manager"
+	}
+
+	return manager
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Node) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
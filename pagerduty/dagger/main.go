@@ -0,0 +1,323 @@
+// This module sends PagerDuty Change Events, so on-call sees recent deploys and urgent upgrades during incidents.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// changeEventsURL is the endpoint of the PagerDuty Events API v2 change events
+const changeEventsURL = "https://events.pagerduty.com/v2/change/enqueue"
+
+// urgencies are the security urgencies of the istio report, from the least to the most urgent
+var urgencies = []string{"none", "low", "high"}
+
+type Pagerduty struct {
+	// Integration key of the service the change events are attached to
+	// +private
+	RoutingKey *Secret
+	// Default source of the change events (ex: the repository or pipeline name)
+	// +private
+	Source string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Pagerduty module sending change events to the service of the integration key
+func New(
+	// Integration key of the PagerDuty service, from its Change Events integration
+	// +required
+	routingKey *Secret,
+	// Default source of the change events (ex: the repository or pipeline name)
+	// +optional
+	// +default="dagger"
+	source string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Pagerduty {
+	return &Pagerduty{
+		RoutingKey:   routingKey,
+		Source:       source,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type changeEvent struct {
+	RoutingKey string       `json:"routing_key"`
+	Payload    eventPayload `json:"payload"`
+	Links      []eventLink  `json:"links,omitempty"`
+}
+
+type eventPayload struct {
+	Summary       string            `json:"summary"`
+	Timestamp     string            `json:"timestamp"`
+	Source        string            `json:"source"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type eventLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+// ChangeEvent sends a change event with custom details and links.
+//
+// Example usage: dagger call --routing-key=env:PD_ROUTING_KEY change-event --summary="Rotated database credentials" --details=env=production --links=https://github.com/adore-me/app/actions/runs/1
+func (m *Pagerduty) ChangeEvent(
+	ctx context.Context,
+	// Summary of the change, shown in the incident timeline
+	// +required
+	summary string,
+	// Source of the change, defaults to the module source
+	// +optional
+	source string,
+	// Custom details of the change (ex: env=production)
+	// +optional
+	details []string,
+	// Links giving context on the change (ex: the pull request or report URL)
+	// +optional
+	links []string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "ChangeEvent")
+	defer s.End(&err)
+
+	custom := map[string]string{}
+	for _, d := range details {
+		key, value, found := strings.Cut(d, "=")
+		if !found {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid detail %q, expected KEY=VALUE", d),
+				Hint: "pass the details as KEY=VALUE",
+			}
+		}
+		custom[key] = value
+	}
+
+	var eventLinks []eventLink
+	for _, l := range links {
+		eventLinks = append(eventLinks, eventLink{Href: l, Text: l})
+	}
+
+	return m.send(ctx, summary, source, custom, eventLinks)
+}
+
+// DeployEvent sends the change event of a deploy, linking the pull request, the pipeline run and the report.
+//
+// Example usage: dagger call --routing-key=env:PD_ROUTING_KEY deploy-event --service=app --env=production --version=1.2.3 --pr-url=https://github.com/adore-me/app/pull/42
+func (m *Pagerduty) DeployEvent(
+	ctx context.Context,
+	// Name of the deployed service
+	// +required
+	service string,
+	// Environment of the deployment (ex: production)
+	// +required
+	env string,
+	// Deployed version
+	// +required
+	version string,
+	// URL of the pull request carrying the change
+	// +optional
+	prUrl string,
+	// URL of the pipeline run
+	// +optional
+	runUrl string,
+	// URL of the report produced by the pipeline
+	// +optional
+	reportUrl string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "DeployEvent")
+	defer s.End(&err)
+
+	return m.send(
+		ctx,
+		fmt.Sprintf("Deployed %s %s to %s", service, version, env),
+		"",
+		map[string]string{"service": service, "env": env, "version": version},
+		links(prUrl, runUrl, reportUrl),
+	)
+}
+
+// IstioUpgrade sends a change event when the report of the istio module rates the pending upgrade as security urgent.
+//
+// Example usage: dagger call --routing-key=env:PD_ROUTING_KEY istio-upgrade --report=./report.json --pr-url=https://github.com/adore-me/infra/pull/7
+func (m *Pagerduty) IstioUpgrade(
+	ctx context.Context,
+	// JSON report generated by the istio module
+	// +required
+	report *File,
+	// Security urgency at or above which the event is sent: low or high
+	// +optional
+	// +default="high"
+	minUrgency string,
+	// URL of the pull request carrying the upgrade
+	// +optional
+	prUrl string,
+	// URL where the report is published
+	// +optional
+	reportUrl string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "IstioUpgrade")
+	defer s.End(&err)
+
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read report: %w", err)
+	}
+
+	var parsed struct {
+		CurrentVersion  string `json:"currentVersion"`
+		LatestVersion   string `json:"latestVersion"`
+		UpdateNeeded    bool   `json:"updateNeeded"`
+		EOL             bool   `json:"eol"`
+		SecurityUrgency string `json:"securityUrgency"`
+	}
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return "", fmt.Errorf("failed to unmarshal report: %w", err)
+	}
+
+	threshold := urgencyRank(minUrgency)
+	if threshold < 1 {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid urgency %q, expected low or high", minUrgency),
+			Hint: "use the low or high urgency",
+		}
+	}
+	if !parsed.UpdateNeeded || urgencyRank(parsed.SecurityUrgency) < threshold {
+		return fmt.Sprintf("No change event sent. Security urgency is %s", parsed.SecurityUrgency), nil
+	}
+
+	return m.send(
+		ctx,
+		fmt.Sprintf("Security urgent Istio upgrade: %s → %s", parsed.CurrentVersion, parsed.LatestVersion),
+		"",
+		map[string]string{
+			"currentVersion":  parsed.CurrentVersion,
+			"latestVersion":   parsed.LatestVersion,
+			"securityUrgency": parsed.SecurityUrgency,
+			"eol":             fmt.Sprint(parsed.EOL),
+		},
+		links(prUrl, "", reportUrl),
+	)
+}
+
+// links returns the links of the provided URLs, skipping the empty ones
+func links(prUrl, runUrl, reportUrl string) []eventLink {
+	var l []eventLink
+	for _, link := range []eventLink{{prUrl, "Pull request"}, {runUrl, "Pipeline run"}, {reportUrl, "Report"}} {
+		if link.Href != "" {
+			l = append(l, link)
+		}
+	}
+
+	return l
+}
+
+// urgencyRank returns the index of the urgency in urgencies, or -1 when unknown
+func urgencyRank(urgency string) int {
+	for i, u := range urgencies {
+		if u == strings.ToLower(urgency) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// send enqueues the change event
+func (m *Pagerduty) send(ctx context.Context, summary, source string, details map[string]string, links []eventLink) (string, error) {
+	if source == "" {
+		source = m.Source
+	}
+
+	key, err := m.RoutingKey.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get routing key: %w", err)
+	}
+
+	payload, err := json.Marshal(changeEvent{
+		RoutingKey: key,
+		Payload: eventPayload{
+			Summary:       summary,
+			Timestamp:     time.Now().UTC().Format(time.RFC3339),
+			Source:        source,
+			CustomDetails: details,
+		},
+		Links: links,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal change event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, changeEventsURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send change event: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", typederr.FromResponse(resp, fmt.Errorf("failed to send change event: unexpected status %s: %s", resp.Status, body))
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	kindBundle    = "bundle"
+	kindImage     = "image"
+	kindBenchmark = "benchmark"
+)
+
+// sizePattern matches a size with an optional unit (ex: 250KB, 1.5 MiB, 1024)
+var sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([KMG]i?B|B)?$`)
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
+
+// budgetFile is the budget file, listing the budgets of the bundles, images and benchmarks
+type budgetFile struct {
+	Bundles    []bundleBudget    `yaml:"bundles"`
+	Images     []imageBudget     `yaml:"images"`
+	Benchmarks []benchmarkBudget `yaml:"benchmarks"`
+}
+
+type bundleBudget struct {
+	Name string `yaml:"name"`
+	// Glob of the files of the bundle in the build outputs, their sizes are summed
+	Path    string `yaml:"path"`
+	MaxSize string `yaml:"maxSize"`
+	// Whether the gzipped size is compared, as served by the CDN
+	Gzip bool `yaml:"gzip"`
+}
+
+type imageBudget struct {
+	Name    string `yaml:"name"`
+	MaxSize string `yaml:"maxSize"`
+}
+
+type benchmarkBudget struct {
+	Name string `yaml:"name"`
+	// Maximum value, for the metrics where lower is better (ex: startup time)
+	Max *float64 `yaml:"max"`
+	// Minimum value, for the metrics where higher is better (ex: requests per second)
+	Min  *float64 `yaml:"min"`
+	Unit string   `yaml:"unit"`
+}
+
+// parseBudgets parses and validates the budget file
+func parseBudgets(content string) (*budgetFile, error) {
+	budgets := &budgetFile{}
+	if err := yaml.Unmarshal([]byte(content), budgets); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal budget file: %w", err)
+	}
+
+	for _, b := range budgets.Bundles {
+		if b.Name == "" || b.Path == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("bundle budgets require a name and a path"),
+				Hint: "set the name and the path of every bundle budget",
+			}
+		}
+		if _, err := parseSize(b.MaxSize); err != nil {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid maxSize of bundle %s: %w", b.Name, err),
+				Hint: "use a size as maxSize, ex: 250KB or 1.5MiB",
+			}
+		}
+	}
+	for _, i := range budgets.Images {
+		if i.Name == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("image budgets require a name"),
+				Hint: "set the name of every image budget",
+			}
+		}
+		if _, err := parseSize(i.MaxSize); err != nil {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid maxSize of image %s: %w", i.Name, err),
+				Hint: "use a size as maxSize, ex: 250KB or 1.5MiB",
+			}
+		}
+	}
+	for _, b := range budgets.Benchmarks {
+		if b.Name == "" || (b.Max == nil && b.Min == nil) {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("benchmark budgets require a name, and a max or a min"),
+				Hint: "set the name and the max or the min of every benchmark budget",
+			}
+		}
+	}
+
+	return budgets, nil
+}
+
+// parseSize returns the number of bytes of a size
+func parseSize(size string) (float64, error) {
+	match := sizePattern.FindStringSubmatch(strings.TrimSpace(size))
+	if match == nil {
+		return 0, &typederr.ValidationError{
+			Err:  fmt.Errorf("unexpected size %q, expected a number of B, KB, MB, GB, KiB, MiB or GiB", size),
+			Hint: "use a size as maxSize, ex: 250KB or 1.5MiB",
+		}
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, &typederr.ValidationError{
+			Err:  fmt.Errorf("unexpected size %q: %w", size, err),
+			Hint: "use a size as maxSize, ex: 250KB or 1.5MiB",
+		}
+	}
+
+	return value * sizeUnits[match[2]], nil
+}
+
+// formatSize returns a size in the most readable decimal unit
+func formatSize(bytes float64) string {
+	abs := math.Abs(bytes)
+	switch {
+	case abs >= 1e9:
+		return fmt.Sprintf("%.2f GB", bytes/1e9)
+	case abs >= 1e6:
+		return fmt.Sprintf("%.2f MB", bytes/1e6)
+	case abs >= 1e3:
+		return fmt.Sprintf("%.1f KB", bytes/1e3)
+	}
+
+	return fmt.Sprintf("%.0f B", bytes)
+}
+
+// formatValue returns a measured value, sizes in a readable unit and benchmarks with their unit
+func formatValue(kind string, value float64, unit string) string {
+	if kind != kindBenchmark {
+		return formatSize(value)
+	}
+
+	return strings.TrimSpace(strconv.FormatFloat(value, 'f', -1, 64) + " " + unit)
+}
+
+// formatDelta returns the change from the baseline, with its percentage
+func formatDelta(kind string, value, baseline float64, unit string) string {
+	sign := "+"
+	if value < baseline {
+		sign = "-"
+	}
+	delta := sign + formatValue(kind, math.Abs(value-baseline), unit)
+	if baseline == 0 {
+		return delta
+	}
+
+	return fmt.Sprintf("%s (%s%.1f%%)", delta, sign, math.Abs(value-baseline)*100/baseline)
+}
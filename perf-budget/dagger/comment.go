@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Markdown returns the results in a Markdown table, the exceeded budgets first
+func (r *BudgetReport) Markdown(ctx context.Context) string {
+	s := r.startSpan(ctx, "Markdown")
+	defer s.End(nil)
+
+	var b strings.Builder
+	if r.Passed {
+		fmt.Fprintf(&b, "All the %d performance budgets are met.\n\n", len(r.Results))
+	} else {
+		exceeded := 0
+		for _, result := range r.Results {
+			if result.Exceeded {
+				exceeded++
+			}
+		}
+		fmt.Fprintf(&b, "%d of the %d performance budgets are exceeded.\n\n", exceeded, len(r.Results))
+	}
+
+	b.WriteString("| | Budget | Kind | Value | Limit | Delta |\n| --- | --- | --- | --- | --- | --- |\n")
+	for _, exceeded := range []bool{true, false} {
+		for _, result := range r.Results {
+			if result.Exceeded != exceeded {
+				continue
+			}
+			status := ":white_check_mark:"
+			if exceeded {
+				status = ":x:"
+			}
+			delta := result.Delta
+			if delta == "" {
+				delta = "-"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n", status, result.Name, result.Kind, result.Value, result.Budget, delta)
+		}
+	}
+
+	return b.String()
+}
+
+// Comment posts the results on the pull request when a budget is exceeded, in a comment updated on the next runs, and
+// returns the comment URL. Once the budgets are met again, the existing comment is updated to say so.
+//
+// Example usage: dagger call --budgets=perf-budget.yaml compare --build=./dist comment --repo=. --token=env:GITHUB_TOKEN --pull-request=42
+func (r *BudgetReport) Comment(
+	ctx context.Context,
+	// The repository, including its .git directory, its origin remote selects the GitHub repository
+	// +required
+	repo *Directory,
+	// Token allowed to comment on the pull requests
+	// +required
+	token *Secret,
+	// Number of the pull request
+	// +required
+	pullRequest int,
+	// Identifier of the comment, distinct per pipeline posting on the same pull requests (ex: one per app)
+	// +optional
+	// +default="perf-budget"
+	id string,
+) (out string, err error) {
+	s := r.startSpan(ctx, "Comment")
+	defer s.End(&err)
+
+	url, err := dag.Gh(token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle}).
+		StickyComment(ctx, repo, pullRequest, "perf-budget:"+id, "### Performance budgets\n\n"+r.Markdown(ctx), GhStickyCommentOpts{
+			UpdateOnly: r.Passed,
+		})
+	if err != nil {
+		return "", err
+	}
+	if url == "" {
+		return "All the performance budgets are met", nil
+	}
+
+	return url, nil
+}
@@ -0,0 +1,337 @@
+// This module compares the build outputs against the performance budgets of a budget file: bundle sizes, image sizes
+// and benchmark results. It fails the pipeline and comments the deltas on the pull request when a budget is exceeded.
+//
+// The budget file is YAML:
+//
+//	bundles:
+//	  - name: app
+//	    path: assets/**/*.js
+//	    maxSize: 250KB
+//	    gzip: true
+//	images:
+//	  - name: api
+//	    maxSize: 300MB
+//	benchmarks:
+//	  - name: startup
+//	    max: 1500
+//	    unit: ms
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+)
+
+type PerfBudget struct {
+	// The budget file
+	// +private
+	Budgets *File
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new PerfBudget module checking the budgets of the budget file
+func New(
+	// The budget file, in YAML
+	// +required
+	budgets *File,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *PerfBudget {
+	return &PerfBudget{
+		Budgets:      budgets,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type BudgetReport struct {
+	// Whether every measured value is within its budget
+	Passed bool
+	// Measured values, in the order of the budget file
+	Results []*BudgetResult
+	// Measured values in JSON, the baseline of the next runs
+	Values *File
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type BudgetResult struct {
+	// bundle, image or benchmark
+	Kind string
+	// Name of the budget
+	Name string
+	// Measured value (ex: 231.4 KB)
+	Value string
+	// Budget of the value (ex: <= 250.0 KB)
+	Budget string
+	// Change from the baseline (ex: +12.1 KB (+5.5%)), empty without baseline
+	Delta string
+	// Whether the value exceeds its budget
+	Exceeded bool
+}
+
+// Compare measures the build outputs and compares them against their budgets. The budgets of the outputs which are
+// not provided are skipped, so each pipeline step compares its own outputs.
+// Image sizes are the sizes of their tarball, with compressed layers.
+//
+// Example usage: dagger call --budgets=perf-budget.yaml compare --build=./dist --benchmarks=startup.json --baseline=base-values.json check
+func (m *PerfBudget) Compare(
+	ctx context.Context,
+	// Build outputs the bundle paths are relative to
+	// +optional
+	build *Directory,
+	// Images compared against the image budgets
+	// +optional
+	images []*Container,
+	// Names of the images in the budget file, in the order of images
+	// +optional
+	imageNames []string,
+	// Benchmark results, a JSON object of the values by benchmark name (ex: {"startup": 1234})
+	// +optional
+	benchmarks *File,
+	// Values of a previous run, as exported from Values (ex: from the base branch), to report the deltas
+	// +optional
+	baseline *File,
+) (budgetReport *BudgetReport, err error) {
+	s := m.startSpan(ctx, "Compare")
+	defer s.End(&err)
+
+	if len(images) != len(imageNames) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("expected one name per image, got %d images and %d names", len(images), len(imageNames)),
+			Hint: "pass one name per image",
+		}
+	}
+	content, err := m.Budgets.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read budget file: %w", err)
+	}
+	budgets, err := parseBudgets(content)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range imageNames {
+		if !slices.ContainsFunc(budgets.Images, func(i imageBudget) bool { return i.Name == name }) {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("image %s has no budget", name),
+				Hint: "add a budget for the image, or drop it from the compared images",
+			}
+		}
+	}
+	previous := map[string]float64{}
+	if baseline != nil {
+		if err := readJSON(ctx, baseline, &previous); err != nil {
+			return nil, fmt.Errorf("failed to read baseline: %w", err)
+		}
+	}
+
+	report := &BudgetReport{
+		Passed:       true,
+		Results:      []*BudgetResult{},
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CABundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	values := map[string]float64{}
+	add := func(kind, name string, value, limit float64, max bool, unit string) {
+		result := &BudgetResult{Kind: kind, Name: name, Value: formatValue(kind, value, unit)}
+		if max {
+			result.Budget = "<= " + formatValue(kind, limit, unit)
+			result.Exceeded = value > limit
+		} else {
+			result.Budget = ">= " + formatValue(kind, limit, unit)
+			result.Exceeded = value < limit
+		}
+		key := kind + "/" + name
+		if base, ok := previous[key]; ok {
+			result.Delta = formatDelta(kind, value, base, unit)
+		}
+		values[key] = value
+		report.Passed = report.Passed && !result.Exceeded
+		report.Results = append(report.Results, result)
+	}
+
+	if build != nil {
+		for _, b := range budgets.Bundles {
+			size, err := bundleSize(ctx, build, b.Path, b.Gzip)
+			if err != nil {
+				return nil, fmt.Errorf("failed to measure bundle %s: %w", b.Name, err)
+			}
+			limit, _ := parseSize(b.MaxSize)
+			add(kindBundle, b.Name, size, limit, true, "")
+		}
+	}
+
+	for _, i := range budgets.Images {
+		index := slices.Index(imageNames, i.Name)
+		if index < 0 {
+			continue
+		}
+		size, err := images[index].AsTarball().Size(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure image %s: %w", i.Name, err)
+		}
+		limit, _ := parseSize(i.MaxSize)
+		add(kindImage, i.Name, float64(size), limit, true, "")
+	}
+
+	if benchmarks != nil {
+		results := map[string]float64{}
+		if err := readJSON(ctx, benchmarks, &results); err != nil {
+			return nil, fmt.Errorf("failed to read benchmark results: %w", err)
+		}
+		for _, b := range budgets.Benchmarks {
+			value, ok := results[b.Name]
+			if !ok {
+				return nil, &typederr.ValidationError{
+					Err:  fmt.Errorf("benchmark %s is missing from the results", b.Name),
+					Hint: "check the names of the benchmarks against the results",
+				}
+			}
+			if b.Max != nil {
+				add(kindBenchmark, b.Name, value, *b.Max, true, b.Unit)
+			}
+			if b.Min != nil {
+				add(kindBenchmark, b.Name, value, *b.Min, false, b.Unit)
+			}
+		}
+	}
+
+	if len(report.Results) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("no budget was compared, provide the build, the images or the benchmarks"),
+			Hint: "pass the build, the images or the benchmarks to compare",
+		}
+	}
+	encoded, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal values: %w", err)
+	}
+	report.Values = dag.Directory().WithNewFile("perf-values.json", string(encoded)).File("perf-values.json")
+
+	return report, nil
+}
+
+// Check fails when a budget is exceeded, and returns the summary otherwise
+func (r *BudgetReport) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("performance budgets exceeded:\n%s", r.Markdown(ctx)),
+			Hint: "reduce the sizes and durations over budget, or raise the budgets",
+		}
+	}
+
+	return r.Markdown(ctx), nil
+}
+
+// bundleSize returns the summed size of the files of the build matching the glob, gzipped when requested
+func bundleSize(ctx context.Context, build *Directory, pattern string, compressed bool) (float64, error) {
+	files, err := build.Glob(ctx, pattern)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look for %s: %w", pattern, err)
+	}
+
+	var total float64
+	matched := 0
+	for _, f := range files {
+		file := build.File(f)
+		if !compressed {
+			size, err := file.Size(ctx)
+			if err != nil {
+				// Globs also match directories, which are not part of the bundle
+				continue
+			}
+			total += float64(size)
+			matched++
+			continue
+		}
+
+		content, err := file.Contents(ctx)
+		if err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if _, err := w.Write([]byte(content)); err != nil {
+			return 0, fmt.Errorf("failed to compress %s: %w", f, err)
+		}
+		if err := w.Close(); err != nil {
+			return 0, fmt.Errorf("failed to compress %s: %w", f, err)
+		}
+		total += float64(buf.Len())
+		matched++
+	}
+	if matched == 0 {
+		return 0, &typederr.ValidationError{Err: fmt.Errorf("no file matches %s", pattern), Hint: "check the path of the bundle budget"}
+	}
+
+	return total, nil
+}
+
+// readJSON decodes a JSON file
+func readJSON(ctx context.Context, file *File, v any) error {
+	content, err := file.Contents(ctx)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(content), v)
+}
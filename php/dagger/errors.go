@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the composer or php tool commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"your requirements could not be resolved", "lock file is not up to date"},
+	AuthHint:       "check the composer auth.json of the private packages",
+	ValidationHint: "update composer.lock, or fix the failing tests and analysis",
+}
+
+// commandError types the error of a composer or php tool command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,283 @@
+// This module installs composer dependencies, runs phpunit and static analysis for PHP applications.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strconv"
+	"strings"
+)
+
+type Php struct {
+	// The version of PHP (ex: 8.3)
+	// +private
+	Version string
+	// The version of composer (ex: 2.7)
+	// +private
+	ComposerVersion string
+	// PHP extensions installed on top of the official image
+	// +private
+	Extensions []string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Php module pinned to the provided PHP and composer versions
+func New(
+	// The version of PHP
+	// +optional
+	// +default="8.3"
+	version string,
+	// The version of composer
+	// +optional
+	// +default="2.7"
+	composerVersion string,
+	// PHP extensions installed on top of the official image (ex: intl, pdo_mysql, redis)
+	// +optional
+	// +default=["zip"]
+	extensions []string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Php {
+	return &Php{
+		Version:         version,
+		ComposerVersion: composerVersion,
+		Extensions:      extensions,
+		ProxyURL:        proxyUrl,
+		NoProxy:         noProxy,
+		CABundle:        caBundle,
+		OtlpEndpoint:    otlpEndpoint,
+		OtlpHeaders:     otlpHeaders,
+		Traceparent:     traceparent,
+	}
+}
+
+type TestResult struct {
+	// Whether every test passed
+	Passed bool
+	// JUnit XML report
+	Junit *File
+	// phpunit output
+	Output string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// base returns a PHP container with composer, the extensions and the composer cache
+func (m *Php) base() *Container {
+	c := m.withProxy(dag.Container().From("php:"+m.Version+"-cli")).
+		WithFile("/usr/bin/composer", m.withProxy(dag.Container().From("composer:"+m.ComposerVersion)).File("/usr/bin/composer")).
+		WithFile(
+			"/usr/bin/install-php-extensions",
+			m.withProxy(dag.Container().From("mlocati/php-extension-installer:2")).File("/usr/bin/install-php-extensions"),
+		).
+		WithExec([]string{"sh", "-c", "apt-get update && apt-get install -y --no-install-recommends git unzip"}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	if len(m.Extensions) > 0 {
+		c = c.WithExec(append([]string{"install-php-extensions"}, m.Extensions...), ContainerWithExecOpts{SkipEntrypoint: true})
+	}
+
+	return c.
+		WithMountedCache("/root/.composer/cache", dag.CacheVolume("composer")).
+		WithEnvVariable("COMPOSER_CACHE_DIR", "/root/.composer/cache").
+		WithEnvVariable("COMPOSER_ALLOW_SUPERUSER", "1")
+}
+
+// withDependencies returns the container with the sources and their composer dependencies installed
+func (m *Php) withDependencies(source *Directory, noDev bool) *Container {
+	args := []string{"composer", "install", "--no-interaction", "--no-progress", "--prefer-dist"}
+	if noDev {
+		args = append(args, "--no-dev", "--optimize-autoloader")
+	}
+
+	return m.base().
+		WithDirectory("/app", source).
+		WithWorkdir("/app").
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// Install installs the composer dependencies and returns the sources with their vendor directory.
+//
+// Example usage: dagger call install --source=. --no-dev export --path=build
+func (m *Php) Install(
+	ctx context.Context,
+	// The application sources, including composer.json and composer.lock
+	// +required
+	source *Directory,
+	// Skip the development dependencies and optimize the autoloader, for production builds
+	// +optional
+	noDev bool,
+) *Directory {
+	s := m.startSpan(ctx, "Install")
+	defer s.End(nil)
+
+	return m.withDependencies(source, noDev).Directory("/app")
+}
+
+// Test runs phpunit and returns its JUnit report, also when tests fail.
+//
+// Example usage: dagger call test --source=. junit export --path=junit.xml
+func (m *Php) Test(
+	ctx context.Context,
+	// The application sources, including composer.json and composer.lock
+	// +required
+	source *Directory,
+	// phpunit configuration, relative to the sources. Defaults to phpunit.xml(.dist)
+	// +optional
+	configuration string,
+	// Test suite to run
+	// +optional
+	testsuite string,
+) (result *TestResult, err error) {
+	s := m.startSpan(ctx, "Test")
+	defer s.End(&err)
+
+	args := []string{"vendor/bin/phpunit", "--log-junit", "/tmp/junit.xml"}
+	if configuration != "" {
+		args = append(args, "--configuration", configuration)
+	}
+	if testsuite != "" {
+		args = append(args, "--testsuite", testsuite)
+	}
+
+	// Failing tests are reported, not returned as an error
+	c := m.withDependencies(source, false).
+		WithExec(
+			append([]string{"sh", "-c", `"$@" > /tmp/output.log 2>&1; echo $? > /tmp/exit-code`, "sh"}, args...),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read phpunit exit code: %w", commandError(err))
+	}
+	output, err := c.File("/tmp/output.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read phpunit output: %w", commandError(err))
+	}
+
+	// phpunit exits with 1 on test failures and 2 on errors (ex: invalid configuration)
+	code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected phpunit exit code %q", exitCode)
+	}
+	if code > 1 {
+		return nil, commandFailures.Type(fmt.Errorf("phpunit failed with exit code %d: %s", code, output), output)
+	}
+
+	return &TestResult{
+		Passed:       code == 0,
+		Junit:        c.File("/tmp/junit.xml"),
+		Output:       output,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when a test failed, and returns the phpunit output otherwise
+func (r *TestResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("phpunit tests failed:\n%s", r.Output), Hint: "fix the failing tests"}
+	}
+
+	return r.Output, nil
+}
+
+// Analyze runs phpstan or psalm, installed as a development dependency, with the configuration of the sources.
+//
+// Example usage: dagger call analyze --source=. --tool=phpstan --level=6
+func (m *Php) Analyze(
+	ctx context.Context,
+	// The application sources, including composer.json and composer.lock
+	// +required
+	source *Directory,
+	// The analyzer: phpstan or psalm
+	// +optional
+	// +default="phpstan"
+	tool string,
+	// Rule level, overriding the configuration (0 to 9 for phpstan, 1 to 8 for psalm)
+	// +optional
+	level int,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Analyze")
+	defer s.End(&err)
+
+	var args []string
+	switch tool {
+	case "phpstan":
+		args = []string{"vendor/bin/phpstan", "analyse", "--no-progress", "--no-interaction", "--memory-limit=1G"}
+		if level > 0 {
+			args = append(args, "--level", strconv.Itoa(level))
+		}
+	case "psalm":
+		args = []string{"vendor/bin/psalm", "--no-progress", "--output-format=compact"}
+		if level > 0 {
+			args = append(args, "--error-level="+strconv.Itoa(level))
+		}
+	default:
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported tool %q, expected phpstan or psalm", tool),
+			Hint: "use the phpstan or psalm tool",
+		}
+	}
+
+	out, err := m.withDependencies(source, false).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%s found issues: %w", tool, err),
+			Hint: "fix the issues reported by the static analysis",
+		}
+	}
+
+	return out, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Php) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,316 @@
+// This module runs Playwright suites against a URL or an app served from its build, sharded across parallel
+// containers, and returns the merged HTML report with the traces and videos of the failed specs.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"golang.org/x/sync/errgroup"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Playwright struct {
+	// The version of Playwright (ex: 1.43.1), matching the @playwright/test version of the suites
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Playwright module pinned to the provided Playwright version
+func New(
+	// The version of Playwright, matching the @playwright/test version of the suites
+	// +optional
+	// +default="1.43.1"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Playwright {
+	return &Playwright{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type PlaywrightResult struct {
+	// Whether every spec passed on every shard
+	Passed bool
+	// Playwright output of each shard
+	Output string
+	// HTML report merged from the shards
+	Report *Directory
+	// Traces, videos and screenshots of the failed specs, in a shard-<n> directory per shard
+	Artifacts *Directory
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// Test runs the Playwright suites of the project against the target, split in shards running in parallel.
+// The suites read the target from process.env.BASE_URL, set use.baseURL from it in playwright.config.
+// An app is served as the "app" host, and BASE_URL defaults to http://app:<port>.
+// Traces are kept for the failed specs, set use.video to retain-on-failure in playwright.config to keep their videos.
+//
+// Example usage: dagger call test --source=./e2e --app=./dist --shards=4 artifacts export --path=playwright-artifacts
+func (m *Playwright) Test(
+	ctx context.Context,
+	// Project of the suites, with its package.json, lockfile and playwright.config
+	// +required
+	source *Directory,
+	// URL of the target, exposed to the suites as BASE_URL
+	// +optional
+	targetUrl string,
+	// Build of the app to test, served as the app host
+	// +optional
+	app *Directory,
+	// Command serving the app from its build directory, static files are served when empty (ex: node,server.js)
+	// +optional
+	appCommand []string,
+	// Image running the app command
+	// +optional
+	// +default="node:20-alpine"
+	appImage string,
+	// Port the app listens on
+	// +optional
+	// +default=3000
+	appPort int,
+	// Number of shards running in parallel
+	// +optional
+	// +default=1
+	shards int,
+	// Projects of playwright.config to run, all when empty (ex: chromium)
+	// +optional
+	projects []string,
+	// Only run the specs matching this regular expression
+	// +optional
+	grep string,
+	// Command installing the dependencies of the project
+	// +optional
+	// +default=["npm", "ci"]
+	installCommand []string,
+	// Extra environment variables exposed to the suites (ex: API_KEY=xxx)
+	// +optional
+	env []string,
+) (playwrightResult *PlaywrightResult, err error) {
+	s := m.startSpan(ctx, "Test")
+	defer s.End(&err)
+
+	if targetUrl == "" && app == nil {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("either targetUrl or app is required"),
+			Hint: "set targetUrl, or the app to serve",
+		}
+	}
+	if shards < 1 {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("shards must be at least 1"), Hint: "set shards to 1 or more"}
+	}
+
+	c := m.container().
+		WithDirectory("/e2e", source).
+		WithWorkdir("/e2e").
+		WithExec(installCommand, ContainerWithExecOpts{SkipEntrypoint: true}).
+		// Installs the browsers of the project version into the cache, a no-op once they are cached
+		WithExec([]string{"npx", "playwright", "install"}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	if app != nil {
+		c = c.WithServiceBinding("app", serve(app, appCommand, appImage, appPort))
+		if targetUrl == "" {
+			targetUrl = "http://app:" + strconv.Itoa(appPort)
+		}
+	}
+	c = c.WithEnvVariable("BASE_URL", targetUrl)
+	for _, e := range env {
+		key, value, _ := strings.Cut(e, "=")
+		c = c.WithEnvVariable(key, value)
+	}
+	// The target changes outside of Dagger, never reuse a cached result
+	c = c.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	args := []string{"npx", "playwright", "test", "--reporter=list,blob", "--output=/tmp/test-results", "--trace=retain-on-failure"}
+	for _, p := range projects {
+		args = append(args, "--project="+p)
+	}
+	if grep != "" {
+		args = append(args, "--grep="+grep)
+	}
+
+	runs := make([]*shardRun, shards)
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range runs {
+		i := i
+		g.Go(func() error {
+			run, err := runShard(gctx, c, args, i+1, shards)
+			runs[i] = run
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	result := &PlaywrightResult{
+		Passed:       true,
+		Artifacts:    dag.Directory(),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	blobs := dag.Directory()
+	var outputs []string
+	for i, run := range runs {
+		result.Passed = result.Passed && run.passed
+		outputs = append(outputs, fmt.Sprintf("--- shard %d/%d ---\n%s", i+1, shards, run.output))
+		blobs = blobs.WithDirectory(".", run.container.Directory("/e2e/blob-report"))
+		if !run.passed {
+			result.Artifacts = result.Artifacts.WithDirectory(fmt.Sprintf("shard-%d", i+1), run.container.Directory("/tmp/test-results"))
+		}
+	}
+	result.Output = strings.Join(outputs, "\n")
+
+	result.Report = c.
+		WithDirectory("/tmp/blobs", blobs).
+		WithEnvVariable("PLAYWRIGHT_HTML_REPORT", "/tmp/html-report").
+		WithExec([]string{"npx", "playwright", "merge-reports", "--reporter=html", "/tmp/blobs"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/tmp/html-report")
+
+	return result, nil
+}
+
+// Check fails when a spec failed, and returns the Playwright output otherwise
+func (r *PlaywrightResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("playwright specs failed:\n%s", r.Output), Hint: "fix the failing specs"}
+	}
+
+	return r.Output, nil
+}
+
+// container returns the Playwright image, with the system dependencies of the browsers, and the browsers and npm
+// caches mounted
+func (m *Playwright) container() *Container {
+	return m.withProxy(dag.Container().From("mcr.microsoft.com/playwright:v"+m.Version+"-jammy"), "app").
+		WithMountedCache("/root/.cache/ms-playwright", dag.CacheVolume("playwright-browsers")).
+		WithEnvVariable("PLAYWRIGHT_BROWSERS_PATH", "/root/.cache/ms-playwright").
+		WithMountedCache("/root/.npm", dag.CacheVolume("playwright-npm")).
+		WithEnvVariable("CI", "true")
+}
+
+type shardRun struct {
+	container *Container
+	passed    bool
+	output    string
+}
+
+// runShard runs a shard of the suites, reporting failed specs in the result rather than as an error
+func runShard(ctx context.Context, c *Container, args []string, shard int, shards int) (*shardRun, error) {
+	// Shards run concurrently, never append to the shared arguments
+	args = append(slices.Clone(args), fmt.Sprintf("--shard=%d/%d", shard, shards))
+	// Playwright exits with 1 when a spec fails, the blob report and the artifacts are still written
+	c = c.WithExec(
+		append([]string{"sh", "-c", `"$@" > /tmp/output.log 2>&1; echo $? > /tmp/exit-code`, "sh"}, args...),
+		ContainerWithExecOpts{SkipEntrypoint: true},
+	)
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playwright exit code of shard %d: %w", shard, commandError(err))
+	}
+	output, err := c.File("/tmp/output.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read playwright output of shard %d: %w", shard, commandError(err))
+	}
+
+	switch strings.TrimSpace(exitCode) {
+	case "0", "1":
+	default:
+		return nil, commandFailures.Type(fmt.Errorf("playwright failed with exit code %s on shard %d: %s", strings.TrimSpace(exitCode), shard, output), output)
+	}
+
+	// The directories are missing when no spec ran, or none kept an artifact
+	return &shardRun{
+		container: c.WithExec([]string{"mkdir", "-p", "/tmp/test-results", "/e2e/blob-report"}, ContainerWithExecOpts{SkipEntrypoint: true}),
+		passed:    strings.TrimSpace(exitCode) == "0",
+		output:    output,
+	}, nil
+}
+
+// serve returns the service of the app, running the app command or serving the build as static files
+func serve(app *Directory, command []string, image string, port int) *Service {
+	if len(command) == 0 {
+		return dag.Container().
+			From("busybox:1.36").
+			WithDirectory("/app", app).
+			WithExposedPort(port).
+			WithExec([]string{"httpd", "-f", "-p", strconv.Itoa(port), "-h", "/app"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+			AsService()
+	}
+
+	return dag.Container().
+		From(image).
+		WithDirectory("/app", app).
+		WithWorkdir("/app").
+		WithEnvVariable("PORT", strconv.Itoa(port)).
+		WithExposedPort(port).
+		WithExec(command, ContainerWithExecOpts{SkipEntrypoint: true}).
+		AsService()
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls, the services bound to it
+// are reached without the proxy
+func (m *Playwright) withProxy(c *Container, services ...string) *Container {
+	noProxy := m.NoProxy
+	for _, service := range services {
+		noProxy = strings.TrimPrefix(noProxy+","+service, ",")
+	}
+
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: noProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
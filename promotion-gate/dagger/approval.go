@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Approval struct {
+	// Whether the promotion was approved
+	Approved bool
+	// approved, rejected or timed-out
+	Status string
+	// comment or deployment
+	Method string
+	// GitHub login of the reviewer
+	Approver string
+	// Comment of the reviewer
+	Comment string
+	// URL of the comment or of the workflow run reviewed
+	URL string
+	// Date of the review, in RFC 3339
+	At string
+}
+
+// Approve waits for the approval of the promotion and records it on the report. With the comment method, the promotion
+// is approved by a comment on the issue starting with the command, the target environment and the beginning of the
+// digest (ex: /promote prod 3f2a9c1b7d4e), and rejected by the same comment with /reject. With the deployment method,
+// it is the review of the workflow run deploying to the target environment.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repo=adore-me/api --image=ghcr.io/adore-me/api@sha256:... verify --sha=abc123 approve --issue=42 --approvers=alice,bob check
+func (r *GateReport) Approve(
+	ctx context.Context,
+	// How the approval is given: comment or deployment
+	// +optional
+	// +default="comment"
+	method string,
+	// Issue or pull request of the repository receiving the approval comments
+	// +optional
+	issue int,
+	// Workflow run waiting on the deployment review of the target environment
+	// +optional
+	runId int,
+	// GitHub logins allowed to approve, defaults to the owners, members and collaborators of the repository
+	// +optional
+	approvers []string,
+	// Command approving the promotion in a comment
+	// +optional
+	// +default="/promote"
+	command string,
+	// How long to wait for the approval
+	// +optional
+	// +default="1h"
+	timeout string,
+	// How often the approval is polled
+	// +optional
+	// +default="30s"
+	interval string,
+) (result *GateReport, err error) {
+	s := r.startSpan(ctx, "Approve")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("verifications of %s failed, the promotion cannot be approved:\n%s", r.Image, r.Markdown(ctx)),
+			Hint: "fix the failed verifications of the image before requesting the approval",
+		}
+	}
+	wait, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeout: %w", err)
+	}
+	every, err := time.ParseDuration(interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse interval: %w", err)
+	}
+
+	var poll func(context.Context) (*Approval, error)
+	switch method {
+	case "comment":
+		if issue == 0 {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("issue is required with the comment method"),
+				Hint: "set issue with the comment method",
+			}
+		}
+		// The reviewers are told which comment approves this digest
+		body := fmt.Sprintf("%s\nComment `%s %s %s` to approve the promotion, or `/reject %s %s` to reject it.\n",
+			r.Markdown(ctx), command, r.To, r.shortDigest(), r.To, r.shortDigest())
+		if _, err := r.gh(ctx, fmt.Sprintf("issue comment %d --repo %s --body %s", issue, shell.Quote(r.Repo), shell.Quote(body))); err != nil {
+			return nil, fmt.Errorf("failed to request the approval on issue %d: %w", issue, err)
+		}
+		poll = func(ctx context.Context) (*Approval, error) {
+			return r.commentApproval(ctx, issue, approvers, command)
+		}
+	case "deployment":
+		if runId == 0 {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("runId is required with the deployment method"),
+				Hint: "set runId with the deployment method",
+			}
+		}
+		poll = func(ctx context.Context) (*Approval, error) {
+			return r.deploymentApproval(ctx, runId, approvers)
+		}
+	default:
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported method %q, expected comment or deployment", method),
+			Hint: "use the comment or deployment method",
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		approval, err := poll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if approval != nil {
+			r.Approval = approval
+			return r, nil
+		}
+
+		if time.Now().Add(every).After(deadline) {
+			r.Approval = &Approval{Status: "timed-out", Method: method}
+			return r, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(every):
+		}
+	}
+}
+
+type issueComment struct {
+	Body              string    `json:"body"`
+	URL               string    `json:"html_url"`
+	CreatedAt         time.Time `json:"created_at"`
+	AuthorAssociation string    `json:"author_association"`
+	User              struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// commentApproval returns the first approval or rejection commented on the issue for the digest, nil when none yet
+func (r *GateReport) commentApproval(ctx context.Context, issue int, approvers []string, command string) (*Approval, error) {
+	out, err := r.gh(ctx, fmt.Sprintf("api %s --paginate --jq '.[]'", shell.Quote(fmt.Sprintf("repos/%s/issues/%d/comments?per_page=100", r.Repo, issue))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the comments of issue %d: %w", issue, err)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for decoder.More() {
+		var c issueComment
+		if err := decoder.Decode(&c); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal comment: %w", err)
+		}
+		if !allowed(c.User.Login, c.AuthorAssociation, approvers) {
+			continue
+		}
+
+		line, _, _ := strings.Cut(strings.TrimSpace(c.Body), "\n")
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != r.To || len(fields[2]) < 7 || !strings.HasPrefix(r.digest(), fields[2]) {
+			continue
+		}
+		approval := &Approval{Method: "comment", Approver: c.User.Login, Comment: strings.TrimSpace(c.Body), URL: c.URL, At: c.CreatedAt.UTC().Format(time.RFC3339)}
+		switch fields[0] {
+		case command:
+			approval.Approved, approval.Status = true, "approved"
+			return approval, nil
+		case "/reject":
+			approval.Status = "rejected"
+			return approval, nil
+		}
+	}
+
+	return nil, nil
+}
+
+type deploymentEnvironment struct {
+	Name string `json:"name"`
+}
+
+type deploymentReview struct {
+	State        string                  `json:"state"`
+	Comment      string                  `json:"comment"`
+	Environments []deploymentEnvironment `json:"environments"`
+	User         struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// deploymentApproval returns the review of the target environment on the workflow run, nil when not reviewed yet
+func (r *GateReport) deploymentApproval(ctx context.Context, runId int, approvers []string) (*Approval, error) {
+	out, err := r.gh(ctx, fmt.Sprintf("api %s", shell.Quote(fmt.Sprintf("repos/%s/actions/runs/%d/approvals", r.Repo, runId))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the reviews of workflow run %d: %w", runId, err)
+	}
+	var reviews []deploymentReview
+	if err := json.Unmarshal([]byte(out), &reviews); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reviews: %w", err)
+	}
+
+	for _, review := range reviews {
+		if !slices.ContainsFunc(review.Environments, func(e deploymentEnvironment) bool { return e.Name == r.To }) {
+			continue
+		}
+		// GitHub already restricts the reviewers to the required ones of the environment
+		if len(approvers) > 0 && !slices.Contains(approvers, review.User.Login) {
+			continue
+		}
+
+		return &Approval{
+			Approved: review.State == "approved",
+			Status:   review.State,
+			Method:   "deployment",
+			Approver: review.User.Login,
+			Comment:  review.Comment,
+			URL:      fmt.Sprintf("https://github.com/%s/actions/runs/%d", r.Repo, runId),
+			At:       time.Now().UTC().Format(time.RFC3339),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// allowed returns whether the commenter may approve the promotion
+func allowed(login, association string, approvers []string) bool {
+	if len(approvers) > 0 {
+		return slices.Contains(approvers, login)
+	}
+
+	return association == "OWNER" || association == "MEMBER" || association == "COLLABORATOR"
+}
+
+// digest returns the hex digest of the image
+func (r *GateReport) digest() string {
+	_, digest, _ := strings.Cut(r.Image, "@sha256:")
+
+	return digest
+}
+
+// shortDigest returns the beginning of the digest of the image, enough to identify it in a comment
+func (r *GateReport) shortDigest() string {
+	return r.digest()[:12]
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the gate check commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"no matching signatures"},
+	AuthHint:       "check the registry credentials",
+	ValidationHint: "sign and scan the image before promoting it",
+}
+
+// commandError types the error of a gate check command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,362 @@
+// This module gates the promotion of an image between environments (ex: staging to prod): the image digest must pass
+// the required checks of its commit, its signature and its vulnerability scan, and be approved, before it is copied to
+// the registry of the target environment and bumped in the GitOps repository.
+//
+// The gate is chained: verify returns the gate report, approve records the approval on it, from a GitHub deployment
+// review or an issue comment command, and promote refuses to run unless both passed.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type PromotionGate struct {
+	// +private
+	Token *Secret
+	// +private
+	Repo string
+	// +private
+	Image string
+	// +private
+	From string
+	// +private
+	To string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new PromotionGate module promoting the image between the environments
+func New(
+	// Token allowed to read the checks and the approvals of the repository, and to open pull requests in the GitOps
+	// repository
+	// +required
+	token *Secret,
+	// Repository building the image, as owner/name
+	// +required
+	repo string,
+	// Image promoted, pinned to its digest (ex: ghcr.io/adore-me/api@sha256:...)
+	// +required
+	image string,
+	// Environment the image is promoted from
+	// +optional
+	// +default="staging"
+	from string,
+	// Environment the image is promoted to
+	// +optional
+	// +default="prod"
+	to string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*PromotionGate, error) {
+	if _, digest, _ := strings.Cut(image, "@sha256:"); len(digest) != 64 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("image %s must be pinned to its digest", image),
+			Hint: "reference the image by its digest, ex: registry/app@sha256:...",
+		}
+	}
+
+	return &PromotionGate{
+		Token:        token,
+		Repo:         repo,
+		Image:        image,
+		From:         from,
+		To:           to,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+type GateReport struct {
+	// Image promoted, pinned to its digest
+	Image string
+	// Environment the image is promoted from
+	From string
+	// Environment the image is promoted to
+	To string
+	// Whether every verification passed
+	Passed bool
+	// Verifications of the image
+	Verifications []*Verification
+	// Approval of the promotion, empty until approve records it
+	Approval *Approval
+	// +private
+	Token *Secret
+	// +private
+	Repo string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Verification struct {
+	// check, signature or scan
+	Kind string
+	// Name of the check, or of the verification
+	Name string
+	// Whether the check succeeded or the verification passed
+	Passed bool
+	// Conclusion of the check, or output of the verification
+	Details string
+}
+
+// Verify verifies the image: the required checks of its commit must have succeeded, its signature must be valid and its
+// vulnerability scan must not reach the severity threshold. Every verification runs, the report lists the failing ones.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repo=adore-me/api --image=ghcr.io/adore-me/api@sha256:... verify --sha=abc123 --checks=build,test --certificate-identity-regexp="^https://github.com/adore-me/" check
+func (m *PromotionGate) Verify(
+	ctx context.Context,
+	// Commit the image was built from
+	// +required
+	sha string,
+	// Check runs of the commit that must have succeeded (ex: build, test)
+	// +optional
+	checks []string,
+	// Cosign public key, omit for keyless signatures
+	// +optional
+	publicKey *File,
+	// Regular expression the keyless signing identity must match
+	// +optional
+	certificateIdentityRegexp string,
+	// OIDC issuer of the keyless signing identity
+	// +optional
+	// +default="https://token.actions.githubusercontent.com"
+	certificateOidcIssuer string,
+	// Skip the signature verification, for the images not signed yet
+	// +optional
+	skipSignature bool,
+	// Severity at or above which the scan fails: CRITICAL, HIGH, MEDIUM, LOW or UNKNOWN
+	// +optional
+	// +default="CRITICAL"
+	severity string,
+	// Skip the vulnerability scan
+	// +optional
+	skipScan bool,
+	// Registry username, for private images
+	// +optional
+	username string,
+	// Registry password or token, for private images
+	// +optional
+	password *Secret,
+) (result *GateReport, err error) {
+	s := m.startSpan(ctx, "Verify")
+	defer s.End(&err)
+
+	report := &GateReport{
+		Image:         m.Image,
+		From:          m.From,
+		To:            m.To,
+		Verifications: []*Verification{},
+		Token:         m.Token,
+		Repo:          m.Repo,
+		ProxyURL:      m.ProxyURL,
+		NoProxy:       m.NoProxy,
+		CABundle:      m.CABundle,
+		OtlpEndpoint:  m.OtlpEndpoint,
+		OtlpHeaders:   m.OtlpHeaders,
+		Traceparent:   m.Traceparent,
+	}
+
+	if len(checks) > 0 {
+		verifications, err := report.checks(ctx, sha, checks)
+		if err != nil {
+			return nil, err
+		}
+		report.Verifications = append(report.Verifications, verifications...)
+	}
+
+	if !skipSignature {
+		v := &Verification{Kind: "signature", Name: "cosign"}
+		out, err := dag.Cosign(CosignOpts{
+			Username: username,
+			Password: password,
+			ProxyURL: m.ProxyURL,
+			NoProxy:  m.NoProxy,
+			CaBundle: m.CABundle,
+		}).Verify(ctx, m.Image, CosignVerifyOpts{
+			Key:                       publicKey,
+			CertificateIdentityRegexp: certificateIdentityRegexp,
+			CertificateOidcIssuer:     certificateOidcIssuer,
+		})
+		v.Passed, v.Details = err == nil, out
+		if err != nil {
+			v.Details = err.Error()
+		}
+		report.Verifications = append(report.Verifications, v)
+	}
+
+	if !skipScan {
+		v := &Verification{Kind: "scan", Name: "trivy"}
+		trivy := dag.Trivy(TrivyOpts{FailOn: severity, ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+		out, err := trivy.ScanImage(m.Image, TrivyScanImageOpts{Username: username, Password: password}).Check(ctx)
+		v.Passed, v.Details = err == nil, out
+		if err != nil {
+			v.Details = err.Error()
+		}
+		report.Verifications = append(report.Verifications, v)
+	}
+
+	report.Passed = true
+	for _, v := range report.Verifications {
+		report.Passed = report.Passed && v.Passed
+	}
+
+	return report, nil
+}
+
+// checks returns the verification of every required check run of the commit, from its latest run
+func (r *GateReport) checks(ctx context.Context, sha string, checks []string) ([]*Verification, error) {
+	out, err := r.gh(ctx, fmt.Sprintf(
+		"api %s --paginate --jq %s",
+		shell.Quote(fmt.Sprintf("repos/%s/commits/%s/check-runs?filter=latest&per_page=100", r.Repo, sha)),
+		shell.Quote(`.check_runs[] | [.name, .status, (.conclusion // "")] | @tsv`),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the check runs of %s: %w", sha, err)
+	}
+
+	conclusions := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		if _, ok := conclusions[fields[0]]; ok {
+			continue
+		}
+		conclusions[fields[0]] = fields[2]
+		if fields[1] != "completed" {
+			conclusions[fields[0]] = fields[1]
+		}
+	}
+
+	verifications := []*Verification{}
+	for _, name := range checks {
+		conclusion, ok := conclusions[name]
+		if !ok {
+			conclusion = "missing"
+		}
+		verifications = append(verifications, &Verification{
+			Kind:    "check",
+			Name:    name,
+			Passed:  conclusion == "success" || conclusion == "neutral" || conclusion == "skipped",
+			Details: conclusion,
+		})
+	}
+
+	return verifications, nil
+}
+
+// Markdown returns the verifications and the approval of the promotion as Markdown
+func (r *GateReport) Markdown(ctx context.Context) string {
+	s := r.startSpan(ctx, "Markdown")
+	defer s.End(nil)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Promotion of `%s` from %s to %s\n\n", r.Image, r.From, r.To)
+	b.WriteString("| | Kind | Name | Details |\n| --- | --- | --- | --- |\n")
+	for _, v := range r.Verifications {
+		status := ":white_check_mark:"
+		if !v.Passed {
+			status = ":x:"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", status, v.Kind, v.Name, strings.ReplaceAll(strings.TrimSpace(v.Details), "\n", " "))
+	}
+
+	switch {
+	case r.Approval == nil:
+		b.WriteString("\nApproval: pending\n")
+	case r.Approval.Approved:
+		fmt.Fprintf(&b, "\nApproval: approved by @%s via %s (%s)\n", r.Approval.Approver, r.Approval.Method, r.Approval.URL)
+	default:
+		fmt.Fprintf(&b, "\nApproval: %s by @%s via %s (%s)\n", r.Approval.Status, r.Approval.Approver, r.Approval.Method, r.Approval.URL)
+	}
+
+	return b.String()
+}
+
+// Check fails when a verification failed or the promotion was not approved, and returns the report otherwise
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repo=adore-me/api --image=ghcr.io/adore-me/api@sha256:... verify --sha=abc123 check
+func (r *GateReport) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("verifications of %s failed:\n%s", r.Image, r.Markdown(ctx)),
+			Hint: "fix the failed verifications of the image",
+		}
+	}
+	if r.Approval != nil && !r.Approval.Approved {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("promotion of %s was not approved:\n%s", r.Image, r.Markdown(ctx)),
+			Hint: "get the promotion approved",
+		}
+	}
+
+	return r.Markdown(ctx), nil
+}
+
+// gh runs a gh command outside of any repository, every command must select its repository
+func (r *GateReport) gh(ctx context.Context, cmd string) (string, error) {
+	// The timestamp makes sure the call is never cached
+	dir := dag.Directory().WithNewFile(".promotion-gate/timestamp", time.Now().String())
+
+	return r.github().RunGh(ctx, dir, cmd)
+}
+
+// github returns the gh module authenticated with the token, through the proxy of the gate
+func (r *GateReport) github() *Gh {
+	return dag.Gh(r.Token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle})
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (r *GateReport) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle}).
+		Apply(c)
+}
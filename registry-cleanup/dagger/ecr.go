@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"time"
+)
+
+type ecrImages struct {
+	ImageDetails []struct {
+		ImageDigest   string   `json:"imageDigest"`
+		ImageTags     []string `json:"imageTags"`
+		ImagePushedAt string   `json:"imagePushedAt"`
+	} `json:"imageDetails"`
+}
+
+type ecrDeletion struct {
+	Failures []struct {
+		ImageID struct {
+			ImageDigest string `json:"imageDigest"`
+		} `json:"imageId"`
+		FailureCode   string `json:"failureCode"`
+		FailureReason string `json:"failureReason"`
+	} `json:"failures"`
+}
+
+// Ecr applies the retention rules to an AWS ECR repository, authenticated with static credentials or a web identity token
+//
+// Example usage: dagger call --dry-run=false ecr --region=eu-west-1 --repository=api --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY summary
+func (m *RegistryCleanup) Ecr(
+	ctx context.Context,
+	// The AWS region of the registry
+	// +required
+	region string,
+	// Name of the repository (ex: shop/api)
+	// +required
+	repository string,
+	// Access key ID of static credentials
+	// +optional
+	accessKeyId *Secret,
+	// Secret access key of static credentials
+	// +optional
+	secretAccessKey *Secret,
+	// Session token of temporary credentials
+	// +optional
+	sessionToken *Secret,
+	// Role assumed with the web identity token
+	// +optional
+	roleArn string,
+	// Web identity token exchanged for the role credentials
+	// +optional
+	webIdentityToken *Secret,
+	// The version of the aws CLI image
+	// +optional
+	// +default="2.15.30"
+	version string,
+) (result *CleanupReport, err error) {
+	s := m.startSpan(ctx, "Ecr")
+	defer s.End(&err)
+
+	if (accessKeyId == nil || secretAccessKey == nil) && (roleArn == "" || webIdentityToken == nil) {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("either static credentials or a role and a web identity token are required"),
+			Hint: "set the static credentials, or a role and a web identity token",
+		}
+	}
+
+	// The registry state changes outside of Dagger, so commands are never cached
+	c := m.withProxy(dag.Container().From("amazon/aws-cli:"+version)).
+		WithEnvVariable("AWS_REGION", region).
+		WithEnvVariable("AWS_PAGER", "").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	if accessKeyId != nil && secretAccessKey != nil {
+		c = c.
+			WithSecretVariable("AWS_ACCESS_KEY_ID", accessKeyId).
+			WithSecretVariable("AWS_SECRET_ACCESS_KEY", secretAccessKey)
+		if sessionToken != nil {
+			c = c.WithSecretVariable("AWS_SESSION_TOKEN", sessionToken)
+		}
+	} else {
+		c = c.
+			WithEnvVariable("AWS_ROLE_ARN", roleArn).
+			WithEnvVariable("AWS_ROLE_SESSION_NAME", "dagger").
+			WithMountedSecret("/tmp/web-identity-token", webIdentityToken).
+			WithEnvVariable("AWS_WEB_IDENTITY_TOKEN_FILE", "/tmp/web-identity-token")
+	}
+
+	out, err := c.
+		WithExec([]string{
+			"aws", "ecr", "describe-images", "--repository-name", repository, "--output", "json",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images of %s: %w", repository, err)
+	}
+
+	var listed ecrImages
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal images of %s: %w", repository, err)
+	}
+	images := []*Image{}
+	for _, i := range listed.ImageDetails {
+		images = append(images, &Image{Digest: i.ImageDigest, Tags: i.ImageTags, PushedAt: i.ImagePushedAt})
+	}
+
+	report, err := m.retain(repository, images)
+	if err != nil {
+		return nil, err
+	}
+	if m.DryRun {
+		return report, nil
+	}
+
+	// batch-delete-image accepts up to 100 images per call
+	all := digests(report.Deleted)
+	for start := 0; start < len(all); start += 100 {
+		cmd := []string{"aws", "ecr", "batch-delete-image", "--repository-name", repository, "--output", "json", "--image-ids"}
+		for _, d := range all[start:min(start+100, len(all))] {
+			cmd = append(cmd, "imageDigest="+d)
+		}
+
+		out, err := c.WithExec(cmd, ContainerWithExecOpts{SkipEntrypoint: true}).Stdout(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete images of %s: %w", repository, err)
+		}
+
+		var deleted ecrDeletion
+		if err := json.Unmarshal([]byte(out), &deleted); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal deleted images of %s: %w", repository, err)
+		}
+		if len(deleted.Failures) > 0 {
+			f := deleted.Failures[0]
+			return nil, fmt.Errorf("failed to delete %d images of %s, first %s: %s: %s",
+				len(deleted.Failures), repository, f.ImageID.ImageDigest, f.FailureCode, f.FailureReason)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type garImage struct {
+	Version    string `json:"version"`
+	Tags       any    `json:"tags"`
+	CreateTime string `json:"createTime"`
+}
+
+// tags returns the tags of the image, which gcloud prints as a list or a comma separated string depending on its version
+func (i garImage) tags() []string {
+	tags := []string{}
+	switch t := i.Tags.(type) {
+	case string:
+		for _, tag := range strings.Split(t, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	case []any:
+		for _, tag := range t {
+			if s, ok := tag.(string); ok {
+				tags = append(tags, s)
+			}
+		}
+	}
+
+	return tags
+}
+
+// Gar applies the retention rules to a GCP Artifact Registry image, authenticated with a service account key or a workload identity federation credential configuration
+//
+// Example usage: dagger call --dry-run=false gar --image=europe-west1-docker.pkg.dev/shop-prod/docker/api --credentials=file:./sa.json summary
+func (m *RegistryCleanup) Gar(
+	ctx context.Context,
+	// Path of the image (ex: europe-west1-docker.pkg.dev/shop-prod/docker/api)
+	// +required
+	image string,
+	// Service account key, or workload identity federation credential configuration (external_account)
+	// +required
+	credentials *Secret,
+	// OIDC token of the workload identity federation, mounted at /tmp/oidc-token: set credential_source.file to this path in the credential configuration
+	// +optional
+	oidcToken *Secret,
+	// The version of the gcloud CLI image
+	// +optional
+	// +default="470.0.0"
+	version string,
+) (result *CleanupReport, err error) {
+	s := m.startSpan(ctx, "Gar")
+	defer s.End(&err)
+
+	parts := strings.Split(image, "/")
+	if len(parts) < 4 || !strings.HasSuffix(parts[0], "-docker.pkg.dev") {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid image %q, expected LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE", image),
+			Hint: "use a LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE image",
+		}
+	}
+
+	c := m.withProxy(dag.Container().From("gcr.io/google.com/cloudsdktool/google-cloud-cli:"+version+"-alpine")).
+		WithMountedSecret("/tmp/credentials.json", credentials).
+		WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", "/tmp/credentials.json").
+		WithEnvVariable("CLOUDSDK_CORE_PROJECT", parts[1]).
+		WithEnvVariable("CLOUDSDK_CORE_DISABLE_PROMPTS", "1")
+	if oidcToken != nil {
+		c = c.WithMountedSecret("/tmp/oidc-token", oidcToken)
+	}
+	// The registry state changes outside of Dagger, so commands are never cached
+	c = c.
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"gcloud", "auth", "login", "--cred-file=/tmp/credentials.json"}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	out, err := c.
+		WithExec([]string{
+			"gcloud", "artifacts", "docker", "images", "list", image, "--include-tags", "--format=json",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images of %s: %w", image, err)
+	}
+
+	var listed []garImage
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal images of %s: %w", image, err)
+	}
+	images := []*Image{}
+	for _, i := range listed {
+		images = append(images, &Image{Digest: i.Version, Tags: i.tags(), PushedAt: i.CreateTime})
+	}
+
+	report, err := m.retain(image, images)
+	if err != nil {
+		return nil, err
+	}
+	if m.DryRun || len(report.Deleted) == 0 {
+		return report, nil
+	}
+
+	refs := []string{}
+	for _, d := range digests(report.Deleted) {
+		refs = append(refs, image+"@"+d)
+	}
+	_, err = c.
+		WithExec(append([]string{
+			"sh", "-c", `for ref in "$@"; do gcloud artifacts docker images delete "$ref" --delete-tags --quiet || exit 1; done`, "sh",
+		}, refs...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete images of %s: %w", image, err)
+	}
+
+	return report, nil
+}
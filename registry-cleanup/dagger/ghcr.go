@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type ghcrVersion struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	Metadata  struct {
+		Container struct {
+			Tags []string `json:"tags"`
+		} `json:"container"`
+	} `json:"metadata"`
+}
+
+// Ghcr applies the retention rules to a GitHub Container Registry package, authenticated with a token allowed to read and delete packages
+//
+// Example usage: dagger call --dry-run=false ghcr --owner=adore-me --name=api --token=env:GITHUB_TOKEN summary
+func (m *RegistryCleanup) Ghcr(
+	ctx context.Context,
+	// Organization or user owning the package
+	// +required
+	owner string,
+	// Name of the package (ex: api, shop/api)
+	// +required
+	name string,
+	// Token with the read:packages and delete:packages scopes
+	// +required
+	token *Secret,
+	// Whether the owner is a user account instead of an organization
+	// +optional
+	user bool,
+) (result *CleanupReport, err error) {
+	s := m.startSpan(ctx, "Ghcr")
+	defer s.End(&err)
+
+	endpoint := "orgs/"
+	if user {
+		endpoint = "users/"
+	}
+	endpoint += url.PathEscape(owner) + "/packages/container/" + url.PathEscape(name) + "/versions"
+
+	images := []*Image{}
+	ids := map[string]int64{}
+	for page := 1; ; page++ {
+		var versions []ghcrVersion
+		if err := m.ghcr(ctx, token, http.MethodGet, fmt.Sprintf("%s?per_page=100&page=%d", endpoint, page), &versions); err != nil {
+			return nil, fmt.Errorf("failed to list versions of %s/%s: %w", owner, name, err)
+		}
+		for _, v := range versions {
+			images = append(images, &Image{Digest: v.Name, Tags: v.Metadata.Container.Tags, PushedAt: v.CreatedAt})
+			ids[v.Name] = v.ID
+		}
+		if len(versions) < 100 {
+			break
+		}
+	}
+
+	report, err := m.retain("ghcr.io/"+owner+"/"+name, images)
+	if err != nil {
+		return nil, err
+	}
+	if m.DryRun {
+		return report, nil
+	}
+
+	for _, d := range digests(report.Deleted) {
+		if err := m.ghcr(ctx, token, http.MethodDelete, fmt.Sprintf("%s/%d", endpoint, ids[d]), nil); err != nil {
+			return nil, fmt.Errorf("failed to delete %s of %s/%s: %w", d, owner, name, err)
+		}
+	}
+
+	return report, nil
+}
+
+// ghcr calls the GitHub packages API, authenticated with the token, and decodes the JSON response into out when not nil
+func (m *RegistryCleanup) ghcr(ctx context.Context, token *Secret, method, endpoint string, out any) error {
+	plaintext, err := token.Plaintext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.github.com/"+endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+plaintext)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call github: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return typederr.FromResponse(resp, fmt.Errorf("github returned %s: %s", resp.Status, body))
+	}
+
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
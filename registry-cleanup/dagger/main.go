@@ -0,0 +1,296 @@
+// This module cleans up the image tags of AWS ECR, GCP Artifact Registry and GitHub Container Registry repositories.
+//
+// The same retention rules apply to every registry: release tags are kept, the last images of every branch are kept
+// and the older ones deleted, untagged images are deleted once older than the max age. Images whose tags match no rule
+// (ex: latest) are kept. Runs are dry by default, and return a report of the kept and deleted images either way.
+//
+// The registries list the platform manifests of multi-arch images as untagged: set untaggedMaxAge to 0 on
+// repositories holding multi-arch images, so untagged images are never deleted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type RegistryCleanup struct {
+	// Number of images kept per branch
+	// +private
+	KeepLast int
+	// Regular expression matching the branch tags, capturing the branch name
+	// +private
+	BranchPattern string
+	// Regular expression matching the release tags, always kept
+	// +private
+	ReleasePattern string
+	// Age in days after which untagged images are deleted, 0 to keep them
+	// +private
+	UntaggedMaxAge int
+	// List the images to delete without deleting them
+	// +private
+	DryRun bool
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new RegistryCleanup module applying the retention rules
+//
+// Example usage: dagger call --keep-last=5 --dry-run=false ghcr --owner=adore-me --name=api --token=env:GITHUB_TOKEN report export --path=report.json
+func New(
+	// Number of images kept per branch
+	// +optional
+	// +default=10
+	keepLast int,
+	// Regular expression matching the branch tags, its first group capturing the branch name (ex: main-3f2a1bc)
+	// +optional
+	// +default="^(.+)-[0-9a-f]{7,40}$"
+	branchPattern string,
+	// Regular expression matching the release tags, always kept (ex: v1.2.3)
+	// +optional
+	// +default="^v?[0-9]+[.][0-9]+[.][0-9]+$"
+	releasePattern string,
+	// Age in days after which untagged images are deleted, 0 to keep them
+	// +optional
+	// +default=7
+	untaggedMaxAge int,
+	// List the images to delete without deleting them
+	// +optional
+	// +default=true
+	dryRun bool,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*RegistryCleanup, error) {
+	branch, err := regexp.Compile(branchPattern)
+	if err != nil {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid branch pattern: %w", err),
+			Hint: "fix the regular expression of the branch pattern",
+		}
+	}
+	if branch.NumSubexp() < 1 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("branch pattern %q must capture the branch name", branchPattern),
+			Hint: "add a group capturing the branch name to the branch pattern",
+		}
+	}
+	if _, err := regexp.Compile(releasePattern); err != nil {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid release pattern: %w", err),
+			Hint: "fix the regular expression of the release pattern",
+		}
+	}
+	if keepLast < 1 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("keep last must be at least 1, got %d", keepLast),
+			Hint: "set keepLast to 1 or more",
+		}
+	}
+
+	return &RegistryCleanup{
+		KeepLast:       keepLast,
+		BranchPattern:  branchPattern,
+		ReleasePattern: releasePattern,
+		UntaggedMaxAge: untaggedMaxAge,
+		DryRun:         dryRun,
+		ProxyURL:       proxyUrl,
+		NoProxy:        noProxy,
+		CABundle:       caBundle,
+		OtlpEndpoint:   otlpEndpoint,
+		OtlpHeaders:    otlpHeaders,
+		Traceparent:    traceparent,
+	}, nil
+}
+
+type Image struct {
+	// Digest of the image manifest
+	Digest string
+	Tags   []string
+	// When the image was pushed, RFC 3339 formatted
+	PushedAt string
+	// Retention rule that kept or deleted the image
+	Reason string
+}
+
+type CleanupReport struct {
+	// Repository cleaned up
+	Repository string
+	// Whether the deleted images were only listed
+	DryRun  bool
+	Kept    []*Image
+	Deleted []*Image
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// Report returns the report as a JSON file
+//
+// Example usage: dagger call ecr --region=eu-west-1 --repository=api --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY report export --path=report.json
+func (r *CleanupReport) Report(ctx context.Context) (file *File, err error) {
+	s := r.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
+
+// Summary returns one line per deleted image, and the number of kept images
+func (r *CleanupReport) Summary(ctx context.Context) string {
+	s := r.startSpan(ctx, "Summary")
+	defer s.End(nil)
+
+	verb := "Deleted"
+	if r.DryRun {
+		verb = "Would delete"
+	}
+
+	lines := []string{}
+	for _, i := range r.Deleted {
+		lines = append(lines, fmt.Sprintf("%s %s %s (%s)", verb, i.Digest, strings.Join(i.Tags, ","), i.Reason))
+	}
+	lines = append(lines, fmt.Sprintf("%s: %d images kept, %d deleted", r.Repository, len(r.Kept), len(r.Deleted)))
+
+	return strings.Join(lines, "\n")
+}
+
+// retain splits the images into the kept and deleted ones, applying the retention rules from the newest image to the oldest
+func (m *RegistryCleanup) retain(repository string, images []*Image) (*CleanupReport, error) {
+	branch := regexp.MustCompile(m.BranchPattern)
+	release := regexp.MustCompile(m.ReleasePattern)
+
+	pushed := map[*Image]time.Time{}
+	for _, i := range images {
+		t, err := time.Parse(time.RFC3339, i.PushedAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid push date of %s: %w", i.Digest, err)
+		}
+		pushed[i] = t
+	}
+	sort.SliceStable(images, func(a, b int) bool {
+		return pushed[images[a]].After(pushed[images[b]])
+	})
+
+	report := &CleanupReport{
+		Repository:   repository,
+		DryRun:       m.DryRun,
+		Kept:         []*Image{},
+		Deleted:      []*Image{},
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	maxAge := time.Duration(m.UntaggedMaxAge) * 24 * time.Hour
+	perBranch := map[string]int{}
+	for _, i := range images {
+		keep := true
+		switch name, tag := branchOf(branch, i.Tags); {
+		case len(i.Tags) == 0 && m.UntaggedMaxAge > 0 && time.Since(pushed[i]) > maxAge:
+			keep, i.Reason = false, fmt.Sprintf("untagged, older than %d days", m.UntaggedMaxAge)
+		case len(i.Tags) == 0:
+			i.Reason = "untagged"
+		case matchesAny(release, i.Tags):
+			i.Reason = "release tag"
+		case tag == "":
+			i.Reason = "tags matching no rule"
+		default:
+			perBranch[name]++
+			if perBranch[name] > m.KeepLast {
+				keep, i.Reason = false, fmt.Sprintf("older than the last %d images of branch %s", m.KeepLast, name)
+			} else {
+				i.Reason = fmt.Sprintf("one of the last %d images of branch %s", m.KeepLast, name)
+			}
+		}
+
+		if keep {
+			report.Kept = append(report.Kept, i)
+		} else {
+			report.Deleted = append(report.Deleted, i)
+		}
+	}
+
+	return report, nil
+}
+
+// branchOf returns the branch name and the tag of the first tag matching the branch pattern
+func branchOf(branch *regexp.Regexp, tags []string) (string, string) {
+	for _, t := range tags {
+		if match := branch.FindStringSubmatch(t); match != nil {
+			return match[1], t
+		}
+	}
+
+	return "", ""
+}
+
+// matchesAny checks if one of the tags matches the pattern
+func matchesAny(pattern *regexp.Regexp, tags []string) bool {
+	for _, t := range tags {
+		if pattern.MatchString(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// digests returns the digests of the images
+func digests(images []*Image) []string {
+	d := []string{}
+	for _, i := range images {
+		d = append(d, i.Digest)
+	}
+
+	return d
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *RegistryCleanup) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,334 @@
+// This module aggregates the changes merged across many repositories into one release notes document,
+// used for the weekly platform release announcement.
+//
+// Changes are collected with the gh module: merged pull requests for a time window, or the commits
+// between two tags when a tag range is given for a repository.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// conventionalTitle matches conventional commit titles (ex: feat(api)!: add endpoint)
+var conventionalTitle = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!?):\s*(.+)$`)
+
+type ReleaseNotes struct {
+	// The token to authenticate with GitHub
+	// +private
+	Token *Secret
+	// The repositories, as owner/name
+	// +private
+	Repos []string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new ReleaseNotes module collecting the changes of the repositories
+func New(
+	// The token to authenticate with GitHub, with read access to the repositories
+	// +required
+	token *Secret,
+	// The repositories, as owner/name (ex: adore-me/infra,adore-me/daggerverse)
+	// +required
+	repos []string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*ReleaseNotes, error) {
+	for _, r := range repos {
+		if _, _, found := strings.Cut(r, "/"); !found {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid repository %q, expected owner/name", r),
+				Hint: "pass the repositories as owner/name",
+			}
+		}
+	}
+
+	return &ReleaseNotes{
+		Token:        token,
+		Repos:        repos,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+type RepoChanges struct {
+	// Repository, as owner/name
+	Repo string
+	// Range the changes were collected for (ex: 2024-04-01..2024-04-08, v1.2.0...v1.3.0)
+	Range   string
+	Changes []*Change
+}
+
+type Change struct {
+	// Title of the pull request, or subject of the commit
+	Title string
+	// Link to the pull request or commit
+	URL    string
+	Author string
+	// Conventional commit type of the title (ex: feat, fix), empty when not conventional
+	Type     string
+	Breaking bool
+}
+
+// Collect returns the changes merged in every repository, over the time window or, for the repositories
+// listed in tagRanges, between two tags.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repos=adore-me/infra,adore-me/daggerverse collect --since=2024-04-01
+func (m *ReleaseNotes) Collect(
+	ctx context.Context,
+	// Start of the time window, as YYYY-MM-DD, defaults to 7 days before until
+	// +optional
+	since string,
+	// End of the time window, as YYYY-MM-DD, defaults to today
+	// +optional
+	until string,
+	// Tag ranges overriding the time window, as owner/name=from...to (ex: adore-me/infra=v1.2.0...v1.3.0)
+	// +optional
+	tagRanges []string,
+) (repoChangess []*RepoChanges, err error) {
+	s := m.startSpan(ctx, "Collect")
+	defer s.End(&err)
+
+	since, until, err = window(since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := map[string]string{}
+	for _, r := range tagRanges {
+		repo, tags, found := strings.Cut(r, "=")
+		if !found || !strings.Contains(tags, "...") {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid tag range %q, expected owner/name=from...to", r),
+				Hint: "pass the tag ranges as owner/name=from...to",
+			}
+		}
+		ranges[repo] = tags
+	}
+
+	gh := dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+	all := []*RepoChanges{}
+	for _, repo := range m.Repos {
+		var changes *RepoChanges
+		if tags, ok := ranges[repo]; ok {
+			changes, err = compareTags(ctx, gh, repo, tags)
+		} else {
+			changes, err = mergedPullRequests(ctx, gh, repo, since, until)
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, changes)
+	}
+
+	return all, nil
+}
+
+// Render renders the collected changes as one Markdown document, grouped by repository and change type.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repos=adore-me/infra,adore-me/daggerverse render --title="Platform release 2024-15" export --path=release-notes.md
+func (m *ReleaseNotes) Render(
+	ctx context.Context,
+	// Title of the document
+	// +optional
+	// +default="Platform release"
+	title string,
+	// Start of the time window, as YYYY-MM-DD, defaults to 7 days before until
+	// +optional
+	since string,
+	// End of the time window, as YYYY-MM-DD, defaults to today
+	// +optional
+	until string,
+	// Tag ranges overriding the time window, as owner/name=from...to (ex: adore-me/infra=v1.2.0...v1.3.0)
+	// +optional
+	tagRanges []string,
+	// Include the repositories without any change
+	// +optional
+	includeEmpty bool,
+) (file *File, err error) {
+	span := m.startSpan(ctx, "Render")
+	defer span.End(&err)
+
+	all, err := m.Collect(ctx, since, until, tagRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := []struct {
+		title string
+		match func(*Change) bool
+	}{
+		{"Breaking Changes", func(c *Change) bool { return c.Breaking }},
+		{"Features", func(c *Change) bool { return !c.Breaking && c.Type == "feat" }},
+		{"Bug Fixes", func(c *Change) bool { return !c.Breaking && c.Type == "fix" }},
+		{"Other Changes", func(c *Change) bool { return !c.Breaking && c.Type != "feat" && c.Type != "fix" }},
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", title)
+	for _, repo := range all {
+		if len(repo.Changes) == 0 && !includeEmpty {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s (%s)\n", repo.Repo, repo.Range)
+		if len(repo.Changes) == 0 {
+			b.WriteString("\nNo changes.\n")
+			continue
+		}
+		for _, s := range sections {
+			var lines []string
+			for _, c := range repo.Changes {
+				if s.match(c) {
+					lines = append(lines, fmt.Sprintf("* %s ([link](%s)) @%s", c.Title, c.URL, c.Author))
+				}
+			}
+			if len(lines) > 0 {
+				fmt.Fprintf(&b, "\n### %s\n\n%s\n", s.title, strings.Join(lines, "\n"))
+			}
+		}
+	}
+
+	return dag.Directory().WithNewFile("release-notes.md", b.String()).File("release-notes.md"), nil
+}
+
+// window returns the time window as YYYY-MM-DD dates, defaulting to the last 7 days
+func window(since, until string) (string, string, error) {
+	end := time.Now()
+	if until != "" {
+		var err error
+		if end, err = time.Parse(time.DateOnly, until); err != nil {
+			return "", "", &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid until %q, expected YYYY-MM-DD: %w", until, err),
+				Hint: "use a YYYY-MM-DD date",
+			}
+		}
+	}
+	start := end.AddDate(0, 0, -7)
+	if since != "" {
+		var err error
+		if start, err = time.Parse(time.DateOnly, since); err != nil {
+			return "", "", &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid since %q, expected YYYY-MM-DD: %w", since, err),
+				Hint: "use a YYYY-MM-DD date",
+			}
+		}
+	}
+
+	return start.Format(time.DateOnly), end.Format(time.DateOnly), nil
+}
+
+// mergedPullRequests returns the pull requests of the repository merged within the time window
+func mergedPullRequests(ctx context.Context, gh *Gh, repo, since, until string) (*RepoChanges, error) {
+	out, err := gh.RunGh(ctx, dag.Directory(), fmt.Sprintf(
+		"pr list --repo %s --state merged --search 'merged:%s..%s' --json title,url,author --limit 500",
+		repo, since, until,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pull requests of %s: %w", repo, err)
+	}
+
+	var prs []struct {
+		Title  string `json:"title"`
+		URL    string `json:"url"`
+		Author struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}
+	if err := json.Unmarshal([]byte(out), &prs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pull requests of %s: %w", repo, err)
+	}
+
+	changes := &RepoChanges{Repo: repo, Range: since + ".." + until, Changes: []*Change{}}
+	for _, pr := range prs {
+		changes.Changes = append(changes.Changes, newChange(pr.Title, pr.URL, pr.Author.Login))
+	}
+
+	return changes, nil
+}
+
+// compareTags returns the commits of the repository between two tags (from...to)
+func compareTags(ctx context.Context, gh *Gh, repo, tags string) (*RepoChanges, error) {
+	out, err := gh.RunGh(ctx, dag.Directory(), fmt.Sprintf(
+		"api repos/%s/compare/%s --paginate --jq '.commits[] | {sha, url: .html_url, message: .commit.message, author: .author.login}'",
+		repo, tags,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s of %s: %w", tags, repo, err)
+	}
+
+	changes := &RepoChanges{Repo: repo, Range: tags, Changes: []*Change{}}
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for decoder.More() {
+		var commit struct {
+			URL     string `json:"url"`
+			Message string `json:"message"`
+			Author  string `json:"author"`
+		}
+		if err := decoder.Decode(&commit); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal commits of %s: %w", repo, err)
+		}
+		subject, _, _ := strings.Cut(commit.Message, "\n")
+		change := newChange(subject, commit.URL, commit.Author)
+		change.Breaking = change.Breaking || strings.Contains(commit.Message, "BREAKING CHANGE")
+		changes.Changes = append(changes.Changes, change)
+	}
+
+	return changes, nil
+}
+
+// newChange returns the change of a title, parsing its conventional commit type when any
+func newChange(title, url, author string) *Change {
+	c := &Change{Title: title, URL: url, Author: author}
+	if match := conventionalTitle.FindStringSubmatch(title); match != nil {
+		c.Type = strings.ToLower(match[1])
+		c.Breaking = match[3] == "!"
+		c.Title = match[4]
+		if match[2] != "" {
+			c.Title = "**" + match[2] + ":** " + match[4]
+		}
+	}
+
+	return c
+}
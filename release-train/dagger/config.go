@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strings"
+)
+
+// Config is the release train, read from a YAML file:
+//
+//	release:
+//	  repo: adore-me/lib-a
+//	  bump: minor
+//	  workflows: [release]
+//	dependents:
+//	  - repo: adore-me/service-b
+//	    file: go.mod
+//	    pattern: 'github.com/adore-me/lib-a v(\S+)'
+//	  - repo: adore-me/service-c
+//	    file: package.json
+//	    pattern: '"@adore-me/lib-a": "\^?([^"]+)"'
+type Config struct {
+	Release    Release     `yaml:"release"`
+	Dependents []Dependent `yaml:"dependents"`
+}
+
+type Release struct {
+	// GitHub repository released first (ex: adore-me/lib-a)
+	Repo string `yaml:"repo"`
+	// Part of the latest released version to bump: major, minor or patch
+	Bump string `yaml:"bump"`
+	// Prefix of the release tags, stripped from the propagated version
+	TagPrefix string `yaml:"tagPrefix"`
+	// Branch the release is tagged from, defaults to the default branch of the repository
+	Branch string `yaml:"branch"`
+	// Names of the workflows triggered by the release which must succeed before propagating it, all of them when empty
+	Workflows []string `yaml:"workflows"`
+}
+
+type Dependent struct {
+	// GitHub repository consuming the released version (ex: adore-me/service-b)
+	Repo string `yaml:"repo"`
+	// File pinning the version, relative to the repository
+	File string `yaml:"file"`
+	// Regular expression matching the pinned version, its first group being the version
+	Pattern string `yaml:"pattern"`
+	// Branch the pull request is opened against, defaults to the default branch of the repository
+	BaseBranch string `yaml:"baseBranch"`
+}
+
+// parseConfig Parse and validate the release train configuration
+func parseConfig(content string) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal([]byte(content), config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if _, _, found := strings.Cut(config.Release.Repo, "/"); !found {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("release: invalid repo %q, expected owner/name", config.Release.Repo),
+			Hint: "set the repo of the release as owner/name",
+		}
+	}
+	if config.Release.Bump == "" {
+		config.Release.Bump = "minor"
+	}
+	if b := config.Release.Bump; b != "major" && b != "minor" && b != "patch" {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("release: invalid bump %q, expected major, minor or patch", b),
+			Hint: "use the major, minor or patch bump",
+		}
+	}
+	if config.Release.TagPrefix == "" {
+		config.Release.TagPrefix = "v"
+	}
+	if len(config.Dependents) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("config does not list any dependent"),
+			Hint: "list the dependents of the config, see the README for its format",
+		}
+	}
+
+	for i, d := range config.Dependents {
+		if _, _, found := strings.Cut(d.Repo, "/"); !found {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("dependent %d: invalid repo %q, expected owner/name", i, d.Repo),
+				Hint: "set the repo of the dependent as owner/name",
+			}
+		}
+		if d.File == "" || d.Pattern == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("dependent %s: file and pattern are required", d.Repo),
+				Hint: "set the file and the pattern of the dependent",
+			}
+		}
+		re, err := regexp.Compile(d.Pattern)
+		if err != nil {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("dependent %s: invalid pattern: %w", d.Repo, err),
+				Hint: "fix the regular expression of the dependent pattern",
+			}
+		}
+		if re.NumSubexp() < 1 {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("dependent %s: pattern %q has no group matching the version", d.Repo, d.Pattern),
+				Hint: "add a group matching the version to the dependent pattern",
+			}
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the release commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check that the token is valid and has the contents and actions permissions",
+	ValidationHint: "check the repository and the workflows of the release",
+}
+
+// commandError types the error of a release command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the render commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"accumulating resources", "template: "},
+	AuthHint:       "check the credentials of the remote bases and charts",
+	ValidationHint: "fix the overlays and charts of the pull request",
+}
+
+// commandError types the error of a render command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
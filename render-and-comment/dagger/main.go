@@ -0,0 +1,443 @@
+// This module renders the manifests of a GitOps pull request for its base and head, and posts their diff as a
+// collapsed sticky comment, so reviewers see the effective cluster change rather than the template edits.
+//
+// Kustomize overlays are built with the kustomize module and Helm charts templated with the helm module. The comment
+// is created on the first run and updated on the next pushes, with the gh module.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	kindKustomize = "kustomize"
+	kindHelm      = "helm"
+
+	// maxCommentLength is the maximum length of the comment body, GitHub allows 65536 characters and the gh module
+	// prefixes the body with the marker of the sticky comment
+	maxCommentLength = 65536 - 256
+)
+
+type RenderAndComment struct {
+	// The head of the pull request, including its .git directory
+	// +private
+	Source *Directory
+	// The base of the pull request, fetched from the base branch when not provided
+	// +private
+	Base *Directory
+	// +private
+	BaseBranch string
+	// +private
+	Token *Secret
+	// +private
+	Overlays string
+	// +private
+	Charts []string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new RenderAndComment module diffing the rendered manifests of a pull request
+func New(
+	// The head of the pull request, including its .git directory
+	// +required
+	source *Directory,
+	// Token allowed to fetch the repository and comment on its pull requests
+	// +required
+	token *Secret,
+	// The base of the pull request, the merge base with baseBranch is fetched when not provided
+	// +optional
+	base *Directory,
+	// Branch the pull request targets
+	// +optional
+	// +default="master"
+	baseBranch string,
+	// Glob pattern of the kustomization files of the overlays rendered
+	// +optional
+	// +default="**/overlays/*/kustomization.yaml"
+	overlays string,
+	// Directories of the Helm charts rendered with their default values (ex: charts/api)
+	// +optional
+	charts []string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *RenderAndComment {
+	return &RenderAndComment{
+		Source:       source,
+		Token:        token,
+		Base:         base,
+		BaseBranch:   baseBranch,
+		Overlays:     overlays,
+		Charts:       charts,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type RenderDiff struct {
+	// Whether the rendered manifests of at least one overlay or chart changed
+	Changed bool
+	Targets []*TargetDiff
+	// +private
+	Source *Directory
+	// +private
+	Token *Secret
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type TargetDiff struct {
+	// Path of the overlay or chart, relative to the repository
+	Path string
+	// kustomize or helm
+	Kind string
+	// added, removed, modified or unchanged
+	Status string
+	// Unified diff of the rendered manifests, from base to head. Secret values are replaced by their digest.
+	Diff string
+}
+
+type target struct {
+	path string
+	kind string
+}
+
+// Diff renders the overlays and charts of the base and head of the pull request, and diffs them.
+// Overlays and charts only found in one of them are diffed against an empty rendering.
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN diff report export --path=render-diff.md
+func (m *RenderAndComment) Diff(ctx context.Context) (renderDiff *RenderDiff, err error) {
+	s := m.startSpan(ctx, "Diff")
+	defer s.End(&err)
+
+	base, err := m.baseTree(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	baseTargets, err := m.targets(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	headTargets, err := m.targets(ctx, m.Source)
+	if err != nil {
+		return nil, err
+	}
+	all := append(slices.Clone(headTargets), baseTargets...)
+	slices.SortFunc(all, func(a, b target) int { return strings.Compare(a.path, b.path) })
+	all = slices.Compact(all)
+
+	ctr := m.withProxy(dag.Container().From("alpine:3.19")).WithWorkdir("/render")
+	for i, t := range all {
+		before, err := m.render(ctx, base, t, slices.Contains(baseTargets, t))
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s on %s: %w", t.path, m.baseName(), err)
+		}
+		after, err := m.render(ctx, m.Source, t, slices.Contains(headTargets, t))
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s on the head: %w", t.path, err)
+		}
+
+		// diff exits with 1 when the files differ
+		name := fmt.Sprintf("%03d", i)
+		ctr = ctr.
+			WithNewFile("base/"+name+".yaml", ContainerWithNewFileOpts{Contents: before}).
+			WithNewFile("head/"+name+".yaml", ContainerWithNewFileOpts{Contents: after}).
+			WithExec(
+				[]string{"sh", "-c", fmt.Sprintf(
+					"mkdir -p diffs && diff -u -L %s -L %s base/%s.yaml head/%s.yaml > diffs/%s.diff || [ $? -eq 1 ]",
+					shell.Quote("base/"+t.path), shell.Quote("head/"+t.path), name, name, name,
+				)},
+				ContainerWithExecOpts{SkipEntrypoint: true},
+			)
+	}
+
+	result := &RenderDiff{
+		Source:       m.Source,
+		Token:        m.Token,
+		ProxyURL:     m.ProxyURL,
+		NoProxy:      m.NoProxy,
+		CABundle:     m.CABundle,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for i, t := range all {
+		diff, err := ctr.File(fmt.Sprintf("diffs/%03d.diff", i)).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %s: %w", t.path, commandError(err))
+		}
+
+		status := "unchanged"
+		switch {
+		case !slices.Contains(baseTargets, t):
+			status = "added"
+		case !slices.Contains(headTargets, t):
+			status = "removed"
+		case diff != "":
+			status = "modified"
+		}
+		result.Changed = result.Changed || diff != ""
+		result.Targets = append(result.Targets, &TargetDiff{Path: t.path, Kind: t.kind, Status: status, Diff: diff})
+	}
+
+	return result, nil
+}
+
+// baseTree returns the sources of the base of the pull request: the merge base of the head and the base branch, or
+// the tip of the base branch on shallow clones lacking their common history
+func (m *RenderAndComment) baseTree(ctx context.Context) (*Directory, error) {
+	if m.Base != nil {
+		return m.Base, nil
+	}
+
+	// The timestamp makes sure the base branch is fetched on every run, it is not part of the archive
+	dir := m.Source.WithNewFile(".render/timestamp", time.Now().String())
+	base := dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).RunGit(dir, fmt.Sprintf(
+		`fetch origin %s && mkdir -p /tmp/base && git archive "$(git merge-base FETCH_HEAD HEAD || echo FETCH_HEAD)" | tar -x -C /tmp/base`,
+		m.BaseBranch,
+	)).Directory("/tmp/base")
+	if _, err := base.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", m.baseName(), commandError(err))
+	}
+
+	return base, nil
+}
+
+// baseName returns how the base is named in messages
+func (m *RenderAndComment) baseName() string {
+	if m.Base != nil {
+		return "the base"
+	}
+
+	return m.BaseBranch
+}
+
+// targets returns the overlays and charts found in the sources, sorted by path
+func (m *RenderAndComment) targets(ctx context.Context, dir *Directory) ([]target, error) {
+	files, err := dir.Glob(ctx, m.Overlays)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list overlays: %w", err)
+	}
+
+	var targets []target
+	for _, f := range files {
+		targets = append(targets, target{path: path.Dir(f), kind: kindKustomize})
+	}
+	for _, c := range m.Charts {
+		c = path.Clean(c)
+		found, err := dir.Glob(ctx, path.Join(c, "Chart.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up chart %s: %w", c, err)
+		}
+		if len(found) > 0 {
+			targets = append(targets, target{path: c, kind: kindHelm})
+		}
+	}
+	slices.SortFunc(targets, func(a, b target) int { return strings.Compare(a.path, b.path) })
+
+	return targets, nil
+}
+
+// render returns the manifests of the overlay or chart with their secret values redacted, empty when the sources do
+// not contain it
+func (m *RenderAndComment) render(ctx context.Context, dir *Directory, t target, found bool) (string, error) {
+	if !found {
+		return "", nil
+	}
+
+	var f *File
+	switch t.kind {
+	case kindKustomize:
+		f = dag.Kustomize(KustomizeOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).Build(dir, t.path)
+	case kindHelm:
+		f = dag.Helm(HelmOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).Template(dir.Directory(t.path), HelmTemplateOpts{ReleaseName: path.Base(t.path)})
+	}
+
+	manifests, err := f.Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return redactSecrets(manifests)
+}
+
+// Report returns the diff as a Markdown file, in full
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN diff report export --path=render-diff.md
+func (r *RenderDiff) Report(ctx context.Context) *File {
+	s := r.startSpan(ctx, "Report")
+	defer s.End(nil)
+
+	return dag.Directory().WithNewFile("render-diff.md", r.markdown(0)).File("render-diff.md")
+}
+
+// Comment posts the diff on the pull request, in a comment updated on the next runs, and returns the comment URL.
+// No comment is created while the rendered manifests are unchanged. Diffs are truncated to fit in the comment.
+//
+// Example usage: dagger call --source=. --token=env:GITHUB_TOKEN diff comment --pull-request=42
+func (r *RenderDiff) Comment(
+	ctx context.Context,
+	// Number of the pull request
+	// +required
+	pullRequest int,
+	// Identifier of the comment, distinct per pipeline posting on the same pull requests (ex: one per cluster)
+	// +optional
+	// +default="manifests"
+	id string,
+) (out string, err error) {
+	s := r.startSpan(ctx, "Comment")
+	defer s.End(&err)
+
+	url, err := dag.Gh(r.Token, GhOpts{ProxyURL: r.ProxyURL, NoProxy: r.NoProxy, CaBundle: r.CABundle}).
+		StickyComment(ctx, r.Source, pullRequest, "render-and-comment:"+id, r.markdown(maxCommentLength), GhStickyCommentOpts{
+			UpdateOnly: !r.Changed,
+		})
+	if err != nil {
+		return "", err
+	}
+	if url == "" {
+		return "No change to the rendered manifests", nil
+	}
+
+	return url, nil
+}
+
+// markdown renders the diff, one collapsed section per changed overlay or chart. When limit is set, the diffs are
+// truncated so that the body fits in limit characters.
+func (r *RenderDiff) markdown(limit int) string {
+	var changed []*TargetDiff
+	for _, t := range r.Targets {
+		if t.Diff != "" {
+			changed = append(changed, t)
+		}
+	}
+
+	header := "### Rendered manifests\n\n"
+	if len(changed) == 0 {
+		return header + fmt.Sprintf("No change to the rendered manifests of the %d overlays and charts.\n", len(r.Targets))
+	}
+	header += fmt.Sprintf("%d of the %d overlays and charts change the rendered manifests.\n\n", len(changed), len(r.Targets))
+
+	const footer = "````\n\n</details>\n\n"
+	summaries := make([]string, len(changed))
+	for i, t := range changed {
+		added, removed := diffStat(t.Diff)
+		summaries[i] = fmt.Sprintf(
+			"<details><summary><code>%s</code> (%s, %s, +%d -%d)</summary>\n\n````diff\n",
+			t.Path, t.Kind, t.Status, added, removed,
+		)
+	}
+
+	// Every diff gets the same share of what is left once the sections are written
+	budget := -1
+	if limit > 0 {
+		budget = limit - len(header)
+		for _, s := range summaries {
+			budget -= len(s) + len(footer)
+		}
+		budget /= len(changed)
+	}
+
+	var b strings.Builder
+	b.WriteString(header)
+	for i, t := range changed {
+		b.WriteString(summaries[i] + truncate(t.Diff, budget) + footer)
+	}
+
+	return b.String()
+}
+
+// diffStat returns the number of added and removed lines of a unified diff
+func diffStat(diff string) (added, removed int) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+
+	return added, removed
+}
+
+// truncate cuts the diff on a line boundary to fit in budget characters, a negative budget keeps it whole
+func truncate(diff string, budget int) string {
+	const notice = "... truncated, export the report for the full diff\n"
+	if budget < 0 || len(diff) <= budget {
+		return diff
+	}
+	if budget < len(notice) {
+		return ""
+	}
+
+	cut := diff[:budget-len(notice)]
+	if i := strings.LastIndex(cut, "\n"); i >= 0 {
+		cut = cut[:i+1]
+	} else {
+		cut = ""
+	}
+
+	return cut + notice
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *RenderAndComment) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
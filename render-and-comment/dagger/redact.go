@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strings"
+)
+
+// redactSecrets replaces the values of the Secrets data and stringData by their digest, so the diff shows which keys
+// changed without publishing them in the pull request
+func redactSecrets(manifests string) (string, error) {
+	var docs []string
+	dec := yaml.NewDecoder(strings.NewReader(manifests))
+	for {
+		doc := &yaml.Node{}
+		err := dec.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to unmarshal manifests: %w", err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+
+		root := doc.Content[0]
+		if kind := mappingValue(root, "kind"); kind != nil && kind.Value == "Secret" {
+			for _, key := range []string{"data", "stringData"} {
+				values := mappingValue(root, key)
+				if values == nil || values.Kind != yaml.MappingNode {
+					continue
+				}
+				for i := 1; i < len(values.Content); i += 2 {
+					sum := sha256.Sum256([]byte(values.Content[i].Value))
+					values.Content[i].SetString(fmt.Sprintf("<redacted sha256:%x>", sum[:6]))
+				}
+			}
+		}
+
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc); err != nil {
+			return "", fmt.Errorf("failed to marshal manifests: %w", err)
+		}
+		docs = append(docs, buf.String())
+	}
+
+	return strings.Join(docs, "---\n"), nil
+}
+
+// mappingValue returns the value of a key of a YAML mapping, nil when the key is missing
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the build commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"dockerfile parse error", "error building image"},
+	AuthHint:       "check the registry credentials and their push permission",
+	ValidationHint: "fix the Dockerfile or the build arguments",
+}
+
+// commandError types the error of a build command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,373 @@
+// This module builds Dockerfiles without privileges with kaniko or buildah, with the same functions as the docker-build module.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"strings"
+	"time"
+)
+
+type RootlessBuild struct {
+	// The builder: kaniko or buildah
+	// +private
+	Builder string
+	// The version of the builder image (ex: v1.22.0 for kaniko, v1.35.3 for buildah)
+	// +private
+	Version string
+	// Registry username
+	// +private
+	Username string
+	// Registry password or token
+	// +private
+	Password *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new RootlessBuild module for the provided builder, authenticated on the registry when credentials are provided
+func New(
+	// The builder: kaniko or buildah
+	// +optional
+	// +default="kaniko"
+	builder string,
+	// The version of the builder image, defaults to v1.22.0 for kaniko and v1.35.3 for buildah
+	// +optional
+	version string,
+	// Registry username
+	// +optional
+	username string,
+	// Registry password or token
+	// +optional
+	password *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*RootlessBuild, error) {
+	switch builder {
+	case "kaniko":
+		if version == "" {
+			version = "v1.22.0"
+		}
+	case "buildah":
+		if version == "" {
+			version = "v1.35.3"
+		}
+	default:
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported builder %q, expected kaniko or buildah", builder),
+			Hint: "use the kaniko or buildah builder",
+		}
+	}
+
+	return &RootlessBuild{
+		Builder:      builder,
+		Version:      version,
+		Username:     username,
+		Password:     password,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+// buildOpts holds the options of a Dockerfile build
+type buildOpts struct {
+	source     *Directory
+	dockerfile string
+	target     string
+	buildArgs  []string
+	secrets    []*Secret
+	secretIds  []string
+	ssh        *Socket
+	cacheKey   string
+}
+
+// Build builds the Dockerfile and returns the image, ex: to scan it before publishing.
+//
+// Example usage: dagger call --builder=buildah build --source=. --build-args=VERSION=1.2.3 terminal
+func (m *RootlessBuild) Build(
+	ctx context.Context,
+	// The build context
+	// +required
+	source *Directory,
+	// Path of the Dockerfile, relative to the build context
+	// +optional
+	// +default="Dockerfile"
+	dockerfile string,
+	// Target build stage
+	// +optional
+	target string,
+	// Build arguments (ex: VERSION=1.2.3)
+	// +optional
+	buildArgs []string,
+	// Build secrets, available to RUN --mount=type=secret,id=<secretId> (buildah only)
+	// +optional
+	secrets []*Secret,
+	// IDs of the build secrets, in the same order as secrets
+	// +optional
+	secretIds []string,
+	// SSH agent socket, available to RUN --mount=type=ssh (buildah only)
+	// +optional
+	ssh *Socket,
+	// Key of the layer cache volume, builds sharing a key share their cache
+	// +optional
+	// +default="default"
+	cacheKey string,
+) (ctr *Container, err error) {
+	s := m.startSpan(ctx, "Build")
+	defer s.End(&err)
+
+	c, err := m.build(ctx, buildOpts{
+		source:     source,
+		dockerfile: dockerfile,
+		target:     target,
+		buildArgs:  buildArgs,
+		secrets:    secrets,
+		secretIds:  secretIds,
+		ssh:        ssh,
+		cacheKey:   cacheKey,
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Container().Import(c.File("/tmp/image.tar")), nil
+}
+
+// Publish builds the Dockerfile, pushes the image and returns the pushed reference with its digest.
+//
+// Example usage: dagger call --builder=kaniko --username=$REGISTRY_USER --password=env:REGISTRY_TOKEN publish --source=. --ref=ghcr.io/adore-me/api:1.2.3
+func (m *RootlessBuild) Publish(
+	ctx context.Context,
+	// The build context
+	// +required
+	source *Directory,
+	// The image reference to push (ex: ghcr.io/adore-me/api:1.2.3)
+	// +required
+	ref string,
+	// Path of the Dockerfile, relative to the build context
+	// +optional
+	// +default="Dockerfile"
+	dockerfile string,
+	// Target build stage
+	// +optional
+	target string,
+	// Build arguments (ex: VERSION=1.2.3)
+	// +optional
+	buildArgs []string,
+	// Build secrets, available to RUN --mount=type=secret,id=<secretId> (buildah only)
+	// +optional
+	secrets []*Secret,
+	// IDs of the build secrets, in the same order as secrets
+	// +optional
+	secretIds []string,
+	// SSH agent socket, available to RUN --mount=type=ssh (buildah only)
+	// +optional
+	ssh *Socket,
+	// Key of the layer cache volume, builds sharing a key share their cache
+	// +optional
+	// +default="default"
+	cacheKey string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Publish")
+	defer s.End(&err)
+
+	c, err := m.build(ctx, buildOpts{
+		source:     source,
+		dockerfile: dockerfile,
+		target:     target,
+		buildArgs:  buildArgs,
+		secrets:    secrets,
+		secretIds:  secretIds,
+		ssh:        ssh,
+		cacheKey:   cacheKey,
+	}, ref)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := c.File("/tmp/digest").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to build and push %s: %w", ref, commandError(err))
+	}
+
+	name, _, _ := strings.Cut(ref, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	return name + "@" + strings.TrimSpace(digest), nil
+}
+
+// build returns the container running the build with the configured builder.
+// The image is pushed to ref when set, and exported to /tmp/image.tar otherwise.
+func (m *RootlessBuild) build(ctx context.Context, opts buildOpts, ref string) (*Container, error) {
+	if len(opts.secrets) != len(opts.secretIds) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("got %d secrets for %d secret ids", len(opts.secrets), len(opts.secretIds)),
+			Hint: "pass one secret per secret id",
+		}
+	}
+
+	var config *Secret
+	if ref != "" && m.Password != nil {
+		var err error
+		if config, err = dockerConfig(ctx, registryauth.Host(ref), m.Username, m.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Builder == "buildah" {
+		return m.buildah(opts, ref, config), nil
+	}
+
+	if len(opts.secrets) > 0 || opts.ssh != nil {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("kaniko does not support build secrets nor SSH forwarding, use the buildah builder"),
+			Hint: "build with buildah to mount secrets or forward SSH",
+		}
+	}
+
+	return m.kaniko(opts, ref, config), nil
+}
+
+// kaniko returns the container running the build with the kaniko executor
+func (m *RootlessBuild) kaniko(opts buildOpts, ref string, config *Secret) *Container {
+	c := m.withProxy(dag.Container().From("gcr.io/kaniko-project/executor:"+m.Version+"-debug")).
+		WithDirectory("/workspace", opts.source).
+		WithMountedCache("/cache", dag.CacheVolume("rootless-build-kaniko-"+opts.cacheKey))
+
+	args := []string{
+		"/kaniko/executor",
+		"--context", "dir:///workspace",
+		"--dockerfile", path.Join("/workspace", opts.dockerfile),
+		"--cache=true", "--cache-dir", "/cache",
+	}
+	if opts.target != "" {
+		args = append(args, "--target", opts.target)
+	}
+	for _, arg := range opts.buildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+
+	if ref == "" {
+		args = append(args, "--no-push", "--destination", "image:latest", "--tar-path", "/tmp/image.tar")
+	} else {
+		if config != nil {
+			c = c.WithMountedSecret("/kaniko/.docker/config.json", config)
+		}
+		// Pushes must always hit the registry
+		c = c.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+		args = append(args, "--destination", ref, "--digest-file", "/tmp/digest")
+	}
+
+	return c.WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// buildah returns the container running the build with buildah, using the chroot isolation and the vfs storage driver to run unprivileged
+func (m *RootlessBuild) buildah(opts buildOpts, ref string, config *Secret) *Container {
+	c := m.withProxy(dag.Container().From("quay.io/buildah/stable:"+m.Version)).
+		WithDirectory("/workspace", opts.source).
+		WithMountedCache("/var/lib/containers", dag.CacheVolume("rootless-build-buildah-"+opts.cacheKey)).
+		WithEnvVariable("BUILDAH_ISOLATION", "chroot").
+		WithEnvVariable("STORAGE_DRIVER", "vfs")
+
+	tag := ref
+	if tag == "" {
+		tag = "localhost/image:latest"
+	}
+
+	args := []string{
+		"buildah", "build", "--layers",
+		"--file", path.Join("/workspace", opts.dockerfile),
+		"--tag", tag,
+	}
+	if opts.target != "" {
+		args = append(args, "--target", opts.target)
+	}
+	for _, arg := range opts.buildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+	for i, s := range opts.secrets {
+		c = c.WithMountedSecret("/run/build-secrets/"+opts.secretIds[i], s)
+		args = append(args, "--secret", fmt.Sprintf("id=%s,src=/run/build-secrets/%s", opts.secretIds[i], opts.secretIds[i]))
+	}
+	if opts.ssh != nil {
+		c = c.WithUnixSocket("/tmp/ssh-agent.sock", opts.ssh)
+		args = append(args, "--ssh", "default=/tmp/ssh-agent.sock")
+	}
+	args = append(args, "/workspace")
+
+	if ref == "" {
+		return c.
+			WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+			WithExec([]string{"buildah", "push", tag, "oci-archive:/tmp/image.tar"}, ContainerWithExecOpts{SkipEntrypoint: true})
+	}
+
+	push := []string{"buildah", "push", "--digestfile", "/tmp/digest"}
+	if config != nil {
+		c = c.WithMountedSecret("/tmp/auth.json", config)
+		push = append(push, "--authfile", "/tmp/auth.json")
+	}
+
+	return c.
+		// Pushes must always hit the registry
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec(append(push, ref), ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// dockerConfig returns a docker config.json authenticating against the registry
+func dockerConfig(ctx context.Context, registry, username string, password *Secret) (*Secret, error) {
+	config, err := registryauth.DockerConfig(ctx, registryauth.Auth{Registry: registry, Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret("docker-config-"+registry, config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *RootlessBuild) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
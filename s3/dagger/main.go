@@ -0,0 +1,313 @@
+// This module archives pipeline artifacts (reports, SBOMs, builds) to AWS S3 and downloads them back, with the aws CLI.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// contentTypes completes the types known by the mime package with the artifacts pipelines usually archive
+var contentTypes = map[string]string{
+	".csv":   "text/csv; charset=utf-8",
+	".gz":    "application/gzip",
+	".log":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".sarif": "application/sarif+json",
+	".tar":   "application/x-tar",
+	".tgz":   "application/gzip",
+	".txt":   "text/plain; charset=utf-8",
+	".yaml":  "application/yaml",
+	".yml":   "application/yaml",
+	".zip":   "application/zip",
+}
+
+type S3 struct {
+	// The AWS region of the buckets (ex: eu-west-1)
+	// +private
+	Region string
+	// Access key ID of static credentials
+	// +private
+	AccessKeyID *Secret
+	// Secret access key of static credentials
+	// +private
+	SecretAccessKey *Secret
+	// Session token of temporary credentials
+	// +private
+	SessionToken *Secret
+	// Role assumed with the web identity token (IRSA, CI OIDC)
+	// +private
+	RoleArn string
+	// Web identity token exchanged for the role credentials
+	// +private
+	WebIdentityToken *Secret
+	// The version of the aws CLI image (ex: 2.15.30)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new S3 module authenticated with static credentials or a web identity token (IRSA, CI OIDC)
+func New(
+	// The AWS region of the buckets
+	// +required
+	region string,
+	// Access key ID of static credentials
+	// +optional
+	accessKeyId *Secret,
+	// Secret access key of static credentials
+	// +optional
+	secretAccessKey *Secret,
+	// Session token of temporary credentials
+	// +optional
+	sessionToken *Secret,
+	// Role assumed with the web identity token
+	// +optional
+	roleArn string,
+	// Web identity token exchanged for the role credentials (ex: the projected service account token of IRSA)
+	// +optional
+	webIdentityToken *Secret,
+	// The version of the aws CLI image
+	// +optional
+	// +default="2.15.30"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*S3, error) {
+	if (accessKeyId == nil || secretAccessKey == nil) && (roleArn == "" || webIdentityToken == nil) {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("either accessKeyId and secretAccessKey, or roleArn and webIdentityToken are required"),
+			Hint: "set accessKeyId and secretAccessKey, or roleArn and webIdentityToken",
+		}
+	}
+
+	return &S3{
+		Region:           region,
+		AccessKeyID:      accessKeyId,
+		SecretAccessKey:  secretAccessKey,
+		SessionToken:     sessionToken,
+		RoleArn:          roleArn,
+		WebIdentityToken: webIdentityToken,
+		Version:          version,
+		ProxyURL:         proxyUrl,
+		NoProxy:          noProxy,
+		CABundle:         caBundle,
+		OtlpEndpoint:     otlpEndpoint,
+		OtlpHeaders:      otlpHeaders,
+		Traceparent:      traceparent,
+	}, nil
+}
+
+// aws returns an aws CLI container with the credentials.
+// The buckets change outside of Dagger, so commands are never cached.
+func (m *S3) aws() *Container {
+	c := m.withProxy(dag.Container().From("amazon/aws-cli:"+m.Version)).
+		WithEnvVariable("AWS_REGION", m.Region).
+		WithEnvVariable("AWS_PAGER", "").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	if m.AccessKeyID != nil && m.SecretAccessKey != nil {
+		c = c.
+			WithSecretVariable("AWS_ACCESS_KEY_ID", m.AccessKeyID).
+			WithSecretVariable("AWS_SECRET_ACCESS_KEY", m.SecretAccessKey)
+		if m.SessionToken != nil {
+			c = c.WithSecretVariable("AWS_SESSION_TOKEN", m.SessionToken)
+		}
+		return c
+	}
+
+	return c.
+		WithEnvVariable("AWS_ROLE_ARN", m.RoleArn).
+		WithEnvVariable("AWS_ROLE_SESSION_NAME", "dagger").
+		WithMountedSecret("/tmp/web-identity-token", m.WebIdentityToken).
+		WithEnvVariable("AWS_WEB_IDENTITY_TOKEN_FILE", "/tmp/web-identity-token")
+}
+
+// Upload uploads the files of the directory under the prefix, with their content type detected from their extension,
+// and returns their URIs. Objects are encrypted with the KMS key when set, and tagged with the retention, for the
+// lifecycle rules of the bucket to expire them.
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY upload --dir=./reports --bucket=ci-artifacts --prefix=shop/api/1.2.3 --retention=90d
+func (m *S3) Upload(
+	ctx context.Context,
+	// Directory of the files uploaded
+	// +required
+	dir *Directory,
+	// Name of the bucket
+	// +required
+	bucket string,
+	// Prefix of the object keys, the directory is uploaded at the bucket root when empty (ex: shop/api/1.2.3)
+	// +optional
+	prefix string,
+	// ID or ARN of the KMS key encrypting the objects (SSE-KMS), the bucket default encryption applies when empty
+	// +optional
+	kmsKeyId string,
+	// Value of the retention tag of the objects, matched by the lifecycle rules of the bucket (ex: 90d)
+	// +optional
+	retention string,
+	// Extra tags of the objects (ex: pipeline=release)
+	// +optional
+	tags []string,
+) (items []string, err error) {
+	s := m.startSpan(ctx, "Upload")
+	defer s.End(&err)
+
+	out, err := m.withProxy(dag.Container().From("alpine:3.19")).
+		WithDirectory("/upload", dir).
+		WithWorkdir("/upload").
+		WithExec([]string{"find", ".", "-type", "f"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", commandError(err))
+	}
+
+	var files []string
+	for _, f := range strings.Split(strings.TrimSpace(out), "\n") {
+		if f = strings.TrimPrefix(f, "./"); f != "" {
+			files = append(files, f+"\t"+contentType(f))
+		}
+	}
+	if len(files) == 0 {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("no file to upload"), Hint: "pass the files or the directory to upload"}
+	}
+
+	var opts []string
+	if kmsKeyId != "" {
+		opts = append(opts, "--server-side-encryption", "aws:kms", "--ssekms-key-id", kmsKeyId)
+	}
+	tagging := url.Values{}
+	if retention != "" {
+		tagging.Set("retention", retention)
+	}
+	for _, t := range tags {
+		key, value, _ := strings.Cut(t, "=")
+		tagging.Set(key, value)
+	}
+	if len(tagging) > 0 {
+		opts = append(opts, "--tagging", tagging.Encode())
+	}
+
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+
+	uris, err := m.aws().
+		WithDirectory("/upload", dir).
+		WithNewFile("/tmp/files.tsv", ContainerWithNewFileOpts{Contents: strings.Join(files, "\n") + "\n"}).
+		WithExec(append([]string{"sh", "-c", `
+bucket="$1"
+prefix="$2"
+shift 2
+while IFS="$(printf '\t')" read -r file type; do
+  aws s3api put-object --bucket "$bucket" --key "$prefix$file" --body "/upload/$file" --content-type "$type" "$@" > /dev/null || exit 1
+  echo "s3://$bucket/$prefix$file"
+done < /tmp/files.tsv`,
+			"sh", bucket, prefix,
+		}, opts...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload to s3://%s/%s: %w", bucket, prefix, commandError(err))
+	}
+
+	return strings.Split(strings.TrimSpace(uris), "\n"), nil
+}
+
+// Download downloads the objects under the prefix, and returns them with their keys relative to the prefix.
+// Objects encrypted with SSE-KMS are decrypted when the credentials are allowed to use the key.
+//
+// Example usage: dagger call --region=eu-west-1 --access-key-id=env:AWS_ACCESS_KEY_ID --secret-access-key=env:AWS_SECRET_ACCESS_KEY download --bucket=ci-artifacts --prefix=shop/api/1.2.3 export --path=artifacts
+func (m *S3) Download(
+	ctx context.Context,
+	// Name of the bucket
+	// +required
+	bucket string,
+	// Prefix of the object keys, the whole bucket is downloaded when empty (ex: shop/api/1.2.3)
+	// +optional
+	prefix string,
+	// Glob patterns of the keys downloaded, relative to the prefix (ex: *.json)
+	// +optional
+	include []string,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Download")
+	defer s.End(&err)
+
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+
+	args := []string{"aws", "s3", "cp", "s3://" + bucket + "/" + prefix, "/download", "--recursive", "--only-show-errors"}
+	if len(include) > 0 {
+		args = append(args, "--exclude", "*")
+		for _, i := range include {
+			args = append(args, "--include", i)
+		}
+	}
+
+	out := m.aws().
+		WithExec([]string{"mkdir", "-p", "/download"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/download")
+	if _, err := out.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to download s3://%s/%s: %w", bucket, prefix, commandError(err))
+	}
+
+	return out, nil
+}
+
+// contentType returns the content type of a file from its extension, application/octet-stream when unknown
+func contentType(file string) string {
+	ext := strings.ToLower(path.Ext(file))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+
+	return "application/octet-stream"
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *S3) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,248 @@
+// This module generates SBOMs with syft and attaches them to images as cosign attestations.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"time"
+)
+
+// attestationTypes maps syft output formats to cosign predicate types
+var attestationTypes = map[string]string{
+	"spdx-json":      "spdxjson",
+	"cyclonedx-json": "cyclonedx",
+}
+
+type Sbom struct {
+	// The version of syft (ex: v1.1.0)
+	// +private
+	SyftVersion string
+	// The version of cosign (ex: v2.2.3)
+	// +private
+	CosignVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Sbom module pinned to the provided syft and cosign versions
+func New(
+	// The version of syft
+	// +optional
+	// +default="v1.1.0"
+	syftVersion string,
+	// The version of cosign, used to attach attestations
+	// +optional
+	// +default="v2.2.3"
+	cosignVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Sbom {
+	return &Sbom{
+		SyftVersion:   syftVersion,
+		CosignVersion: cosignVersion,
+		ProxyURL:      proxyUrl,
+		NoProxy:       noProxy,
+		CABundle:      caBundle,
+		OtlpEndpoint:  otlpEndpoint,
+		OtlpHeaders:   otlpHeaders,
+		Traceparent:   traceparent,
+	}
+}
+
+// syft returns a container with the pinned syft CLI and an output directory
+func (m *Sbom) syft() *Container {
+	return m.withProxy(dag.Container().From("anchore/syft:"+m.SyftVersion)).
+		WithDirectory("/out", dag.Directory())
+}
+
+// generate runs syft against the source and returns the SBOM file
+func generate(ctx context.Context, c *Container, source, format string) (*File, error) {
+	if _, ok := attestationTypes[format]; !ok {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported format %q, expected spdx-json or cyclonedx-json", format),
+			Hint: "use the spdx-json or cyclonedx-json format",
+		}
+	}
+
+	f := c.
+		WithExec([]string{"/syft", "scan", source, "--output", format + "=/out/sbom.json"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/out/sbom.json")
+	if _, err := f.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to generate sbom for %s: %w", source, commandError(err))
+	}
+
+	return f, nil
+}
+
+// Image generates the SBOM of a container image pulled from its registry.
+//
+// Example usage: dagger call image --ref=ghcr.io/adore-me/app:1.2.3 --format=cyclonedx-json export --path=sbom.json
+func (m *Sbom) Image(
+	ctx context.Context,
+	// Image reference (ex: ghcr.io/adore-me/app:1.2.3)
+	// +required
+	ref string,
+	// SBOM format: spdx-json or cyclonedx-json
+	// +optional
+	// +default="spdx-json"
+	format string,
+	// Registry username, for private images
+	// +optional
+	username string,
+	// Registry password or token, for private images
+	// +optional
+	password *Secret,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Image")
+	defer s.End(&err)
+
+	c := m.syft()
+	if password != nil {
+		c = c.
+			WithEnvVariable("SYFT_REGISTRY_AUTH_AUTHORITY", registryauth.Authority(registryauth.Host(ref))).
+			WithEnvVariable("SYFT_REGISTRY_AUTH_USERNAME", username).
+			WithSecretVariable("SYFT_REGISTRY_AUTH_PASSWORD", password)
+	}
+
+	return generate(ctx, c, "registry:"+ref, format)
+}
+
+// Dir generates the SBOM of a source directory from its dependency manifests and lockfiles.
+//
+// Example usage: dagger call dir --dir=. export --path=sbom.spdx.json
+func (m *Sbom) Dir(
+	ctx context.Context,
+	// Source directory
+	// +required
+	dir *Directory,
+	// SBOM format: spdx-json or cyclonedx-json
+	// +optional
+	// +default="spdx-json"
+	format string,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Dir")
+	defer s.End(&err)
+
+	return generate(ctx, m.syft().WithDirectory("/src", dir), "dir:/src", format)
+}
+
+// Attest signs the SBOM with the cosign key and attaches it to the image as an attestation.
+//
+// Example usage: dagger call attest --ref=ghcr.io/adore-me/app@sha256:... --sbom=sbom.json --key=env:COSIGN_KEY --key-password=env:COSIGN_PASSWORD --username=bot --password=env:REGISTRY_TOKEN
+func (m *Sbom) Attest(
+	ctx context.Context,
+	// Image reference, preferably by digest
+	// +required
+	ref string,
+	// SBOM generated by image
+	// +required
+	sbom *File,
+	// Format of the SBOM: spdx-json or cyclonedx-json
+	// +optional
+	// +default="spdx-json"
+	format string,
+	// Cosign private key
+	// +required
+	key *Secret,
+	// Password of the cosign private key
+	// +optional
+	keyPassword *Secret,
+	// Registry username
+	// +required
+	username string,
+	// Registry password or token
+	// +required
+	password *Secret,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Attest")
+	defer s.End(&err)
+
+	predicateType, ok := attestationTypes[format]
+	if !ok {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported format %q, expected spdx-json or cyclonedx-json", format),
+			Hint: "use the spdx-json or cyclonedx-json format",
+		}
+	}
+
+	config, err := dockerConfig(ctx, registryauth.Host(ref), username, password)
+	if err != nil {
+		return "", err
+	}
+
+	c := m.withProxy(dag.Container().From("gcr.io/projectsigstore/cosign:"+m.CosignVersion)).
+		WithMountedSecret("/root/.docker/config.json", config).
+		WithEnvVariable("DOCKER_CONFIG", "/root/.docker").
+		WithMountedSecret("/keys/cosign.key", key).
+		WithFile("/tmp/sbom.json", sbom).
+		// Attestations must always be pushed
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	if keyPassword != nil {
+		c = c.WithSecretVariable("COSIGN_PASSWORD", keyPassword)
+	} else {
+		c = c.WithEnvVariable("COSIGN_PASSWORD", "")
+	}
+
+	out, err := c.
+		WithExec([]string{
+			"cosign", "attest", "--yes", "--key", "/keys/cosign.key",
+			"--type", predicateType, "--predicate", "/tmp/sbom.json", ref,
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stderr(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to attest %s: %w", ref, commandError(err))
+	}
+
+	return out, nil
+}
+
+// dockerConfig returns a docker config.json authenticating against the registry
+func dockerConfig(ctx context.Context, registry, username string, password *Secret) (*Secret, error) {
+	config, err := registryauth.DockerConfig(ctx, registryauth.Auth{Registry: registry, Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret("docker-config-"+registry, config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Sbom) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
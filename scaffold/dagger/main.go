@@ -0,0 +1,341 @@
+// This module generates the skeleton of a new module of the daggerverse, following its conventions: the constructor
+// taking the secrets as Secret, the pinned images, the typed results with a Check function, the dagger.json wiring and
+// the end-to-end cases of the tests module.
+//
+// The skeleton is added to the daggerverse repository, to export over it, instead of copy-pasting an existing module.
+// Run dagger develop in the new module afterwards to generate its client.
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"go/format"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// engineVersion is the Dagger engine of the modules of the daggerverse
+const engineVersion = "v0.11.1"
+
+// namePattern matches the module names, in kebab case
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+//go:embed templates
+var templates embed.FS
+
+type Scaffold struct {
+	// +private
+	Source *Directory
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new Scaffold module adding the modules to the daggerverse repository
+func New(
+	// Root of the daggerverse repository
+	// +required
+	source *Directory,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Scaffold {
+	return &Scaffold{
+		Source:       source,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// module holds the values of the templates
+type module struct {
+	// Name of the module, in kebab case (ex: cert-manager)
+	Name string
+	// Name of the module type, in camel case (ex: CertManager)
+	Type        string
+	Description string
+	// GitHub repository releasing the component of a bumper
+	Owner string
+	Repo  string
+	// Chart of the HelmRelease fixture of a bumper
+	Chart string
+	// Default version field of the manifest of a bumper
+	Key string
+	// Pinned image of a module
+	Image   string
+	Version string
+	// Whether the releases of a bumper were recorded by the scaffold, its cases then expect them
+	Recorded bool
+}
+
+type dependency struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// NewBumper adds a module handling the version management of a component released on GitHub, on top of the
+// version-bumper module, with its HelmRelease fixture and its end-to-end cases
+//
+// Example usage: dagger call --source=. new-bumper --name=cert-manager --owner=cert-manager export --path=.
+func (m *Scaffold) NewBumper(
+	ctx context.Context,
+	// Name of the module, in kebab case (ex: cert-manager)
+	// +required
+	name string,
+	// GitHub owner of the releases of the component
+	// +required
+	owner string,
+	// GitHub repository of the releases of the component, defaults to the name
+	// +optional
+	repo string,
+	// Chart of the HelmRelease fixture, defaults to the name
+	// +optional
+	chart string,
+	// Dot separated path of the version field in the manifest
+	// +optional
+	// +default="spec.chart.spec.version"
+	key string,
+	// What the module manages, in its doc comment, defaults to the name
+	// +optional
+	description string,
+) (result *Directory, err error) {
+	s := m.startSpan(ctx, "NewBumper")
+	defer s.End(&err)
+
+	mod := &module{Name: name, Owner: owner, Repo: repo, Chart: chart, Key: key, Description: description}
+	if mod.Repo == "" {
+		mod.Repo = name
+	}
+	if mod.Chart == "" {
+		mod.Chart = name
+	}
+	if mod.Description == "" {
+		mod.Description = name
+	}
+
+	dir := m.Source
+	recording := fmt.Sprintf("tests/fixtures/api/api.github.com/repos/%s/%s/releases.json", mod.Owner, mod.Repo)
+	recorded, err := m.Source.Glob(ctx, recording)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for the recorded releases: %w", err)
+	}
+	// The releases of another module tracking the same repository are kept, the cases cannot expect their versions
+	if len(recorded) == 0 {
+		content, err := render("releases.json.tmpl", mod)
+		if err != nil {
+			return nil, err
+		}
+		dir = dir.WithNewFile(recording, content)
+		mod.Recorded = true
+	}
+	fixture, err := render("helmrelease.yaml.tmpl", mod)
+	if err != nil {
+		return nil, err
+	}
+	dir = dir.WithNewFile(path.Join("tests/fixtures", name, "helmrelease.yaml"), fixture)
+
+	return m.generate(ctx, dir, mod, "bumper", []string{"common", "version-bumper"})
+}
+
+// NewModule adds a module running its commands in a pinned image, with a typed result and its end-to-end cases
+//
+// Example usage: dagger call --source=. new-module --name=yamlfmt --description="formats YAML files with yamlfmt" --image=ghcr.io/google/yamlfmt --version=0.11.0 export --path=.
+func (m *Scaffold) NewModule(
+	ctx context.Context,
+	// Name of the module, in kebab case (ex: shell-lint)
+	// +required
+	name string,
+	// What the module does, completing "This module" in its doc comment (ex: lints shell scripts with shellcheck)
+	// +required
+	description string,
+	// Image running the commands, without tag
+	// +required
+	image string,
+	// Version of the image, pinned as the default of the constructor
+	// +required
+	version string,
+	// Modules of the daggerverse the module depends on, besides the common module it always depends on
+	// +optional
+	dependencies []string,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "NewModule")
+	defer s.End(&err)
+
+	if version == "" || version == "latest" || strings.Contains(image, ":") {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("the image must be pinned with the version rather than a tag in the image"),
+			Hint: "set the version apart from the image, ex: --image=alpine/helm --version=3.14.2",
+		}
+	}
+
+	mod := &module{Name: name, Description: strings.TrimSuffix(description, "."), Image: image, Version: version}
+	// The containers of the module get the proxy settings, and its functions export their spans, with the common module
+	if !slices.Contains(dependencies, "common") {
+		dependencies = append(dependencies, "common")
+		slices.Sort(dependencies)
+	}
+
+	return m.generate(ctx, m.Source, mod, "module", dependencies)
+}
+
+// generate adds the module to the directory, and its cases to the tests module. The templates of the kind are
+// <kind>.go.tmpl for the main.go of the module and <kind>-cases.tmpl for its cases, telemetry.go.tmpl renders the
+// spans of its functions.
+func (m *Scaffold) generate(ctx context.Context, dir *Directory, mod *module, kind string, dependencies []string) (*Directory, error) {
+	if !namePattern.MatchString(mod.Name) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("name %q must be in kebab case (ex: cert-manager)", mod.Name),
+			Hint: "name the module in kebab case, ex: cert-manager",
+		}
+	}
+	mod.Type = typeName(mod.Name)
+
+	modules, err := m.Source.Glob(ctx, "*/dagger.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the modules: %w", err)
+	}
+	if slices.Contains(modules, mod.Name+"/dagger.json") {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("module %s already exists", mod.Name), Hint: "pick the name of a new module"}
+	}
+	deps := []dependency{}
+	for _, dep := range dependencies {
+		if !slices.Contains(modules, dep+"/dagger.json") {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("dependency %s is not a module of the daggerverse", dep),
+				Hint: "depend on the modules of the daggerverse only",
+			}
+		}
+		deps = append(deps, dependency{Name: dep, Source: "../" + dep})
+	}
+
+	config, err := json.MarshalIndent(struct {
+		Name          string       `json:"name"`
+		SDK           string       `json:"sdk"`
+		Dependencies  []dependency `json:"dependencies,omitempty"`
+		Source        string       `json:"source"`
+		EngineVersion string       `json:"engineVersion"`
+	}{
+		Name:          mod.Name,
+		SDK:           "go",
+		Dependencies:  deps,
+		Source:        "dagger",
+		EngineVersion: engineVersion,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dagger.json: %w", err)
+	}
+
+	source, err := render(kind+".go.tmpl", mod)
+	if err != nil {
+		return nil, err
+	}
+	if source, err = gofmt("main.go", source); err != nil {
+		return nil, err
+	}
+	telemetry, err := render("telemetry.go.tmpl", mod)
+	if err != nil {
+		return nil, err
+	}
+	if telemetry, err = gofmt("telemetry.go", telemetry); err != nil {
+		return nil, err
+	}
+	goMod, err := render("go.mod.tmpl", mod)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{
+		"dagger.json":         string(config) + "\n",
+		"dagger/main.go":      source,
+		"dagger/telemetry.go": telemetry,
+		"dagger/go.mod":       goMod,
+	}
+	// The dot files are not embedded, their templates are named without the dot
+	for file, name := range map[string]string{"dagger/go.sum": "go.sum", "dagger/.gitignore": "gitignore", "dagger/.gitattributes": "gitattributes"} {
+		content, err := templates.ReadFile("templates/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template %s: %w", name, err)
+		}
+		files[file] = string(content)
+	}
+	for file, content := range files {
+		dir = dir.WithNewFile(path.Join(mod.Name, file), content)
+	}
+
+	cases, err := m.cases(ctx, mod, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return dir.WithNewFile("tests/dagger/cases.go", cases), nil
+}
+
+// cases returns the cases.go of the tests module with the cases of the module appended
+func (m *Scaffold) cases(ctx context.Context, mod *module, kind string) (string, error) {
+	content, err := m.Source.File("tests/dagger/cases.go").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the cases of the tests module: %w", err)
+	}
+	added, err := render(kind+"-cases.tmpl", mod)
+	if err != nil {
+		return "", err
+	}
+
+	// The cases slice closes the file
+	end := strings.LastIndex(content, "\n}\n")
+	if end < 0 {
+		return "", fmt.Errorf("failed to find the end of the cases of the tests module")
+	}
+
+	return gofmt("cases.go", content[:end+1]+added+content[end+1:])
+}
+
+// render executes the template with the values of the module
+func render(name string, mod *module) (string, error) {
+	t, err := template.ParseFS(templates, "templates/"+name)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %w", name, err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, mod); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", name, err)
+	}
+
+	return b.String(), nil
+}
+
+// gofmt formats the generated Go source
+func gofmt(name, source string) (string, error) {
+	formatted, err := format.Source([]byte(source))
+	if err != nil {
+		return "", fmt.Errorf("failed to format %s: %w", name, err)
+	}
+
+	return string(formatted), nil
+}
+
+// typeName returns the name Dagger gives to the type of the module, in camel case (ex: cert-manager is CertManager)
+func typeName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "-") {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+)
+
+// github implements the backend with the gh module
+type github struct {
+	*Scm
+}
+
+func (b *github) gh() *Gh {
+	return dag.Gh(b.Token, GhOpts{BaseBranch: b.BaseBranch, ProxyURL: b.ProxyURL, NoProxy: b.NoProxy, CaBundle: b.CABundle})
+}
+
+func (b *github) git(repo *Directory, cmd string) *Container {
+	return b.gh().RunGit(repo, cmd)
+}
+
+func (b *github) openPullRequest(ctx context.Context, repo *Directory, branch, base, title, body string) (string, error) {
+	out, err := b.gh().RunGh(ctx, withTimestamp(repo).WithNewFile(".git/dagger-body.md", body), fmt.Sprintf(
+		"pr create --repo %s --head %s --base %s --title %s --body-file .git/dagger-body.md",
+		shell.Quote(b.Repository), shell.Quote(branch), shell.Quote(base), shell.Quote(title),
+	))
+	if err != nil {
+		return "", err
+	}
+
+	return lastLine(out), nil
+}
+
+func (b *github) comment(ctx context.Context, repo *Directory, number int, body string) error {
+	_, err := b.gh().RunGh(ctx, withTimestamp(repo).WithNewFile(".git/dagger-body.md", body), fmt.Sprintf(
+		"pr comment %d --repo %s --body-file .git/dagger-body.md",
+		number, shell.Quote(b.Repository),
+	))
+
+	return err
+}
@@ -0,0 +1,290 @@
+// This module is a thin SCM abstraction: branches, commits, pull requests and comments with one set of
+// functions, whether the repository lives on GitHub or on Bitbucket Cloud.
+//
+// GitHub calls go through the gh module, Bitbucket calls through git and the Bitbucket REST API.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+// backend is implemented by every supported SCM provider
+type backend interface {
+	// git runs a git command in the repo, with the origin remote authenticated with the token
+	git(repo *Directory, cmd string) *Container
+	// openPullRequest opens a pull request from branch into base and returns its URL
+	openPullRequest(ctx context.Context, repo *Directory, branch, base, title, body string) (string, error)
+	// comment adds a comment to a pull request
+	comment(ctx context.Context, repo *Directory, number int, body string) error
+}
+
+type Scm struct {
+	// The SCM provider hosting the repository: github or bitbucket
+	// +private
+	Provider string
+	// The token to authenticate with the provider
+	// +private
+	Token *Secret
+	// The repository, as owner/name on GitHub or workspace/slug on Bitbucket
+	// +private
+	Repository string
+	// The base branch of the repository (ex: main, master)
+	// +private
+	BaseBranch string
+	// The username paired with the token on Bitbucket, x-token-auth for repository and workspace access tokens
+	// +private
+	Username string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Scm module targeting the repository on the provider
+//
+// Example usage: dagger call --provider=bitbucket --token=env:BITBUCKET_TOKEN --repository=adore-me/infra open-pull-request --repo=. --branch=bump/cert-manager --title="Bump cert-manager"
+func New(
+	// The SCM provider hosting the repository: github or bitbucket
+	// +optional
+	// +default="github"
+	provider string,
+	// The token to authenticate with the provider
+	// +required
+	token *Secret,
+	// The repository, as owner/name on GitHub or workspace/slug on Bitbucket
+	// +required
+	repository string,
+	// The base branch of the repository (ex: main, master)
+	// +optional
+	// +default="master"
+	baseBranch string,
+	// The username paired with the token on Bitbucket, x-token-auth for repository and workspace access tokens
+	// +optional
+	// +default="x-token-auth"
+	username string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Scm, error) {
+	if provider != "github" && provider != "bitbucket" {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported provider %q, expected github or bitbucket", provider),
+			Hint: "use the github or bitbucket provider",
+		}
+	}
+	if _, _, found := strings.Cut(repository, "/"); !found {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid repository %q, expected owner/name", repository),
+			Hint: "pass the repository as owner/name",
+		}
+	}
+
+	return &Scm{
+		Provider:     provider,
+		Token:        token,
+		Repository:   repository,
+		BaseBranch:   baseBranch,
+		Username:     username,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+// backend returns the implementation of the configured provider
+func (m *Scm) backend() backend {
+	if m.Provider == "bitbucket" {
+		return &bitbucket{m}
+	}
+
+	return &github{m}
+}
+
+// CreateBranch pushes a new branch pointing at the current commit of the repo.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repository=adore-me/infra create-branch --repo=. --branch=bump/cert-manager
+func (m *Scm) CreateBranch(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+	// Name of the branch
+	// +required
+	branch string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "CreateBranch")
+	defer s.End(&err)
+
+	_, err = m.backend().git(withTimestamp(repo), fmt.Sprintf("push origin HEAD:refs/heads/%s", shell.Quote(branch))).Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create branch %s: %w", branch, err)
+	}
+
+	return branch, nil
+}
+
+// CommitFiles writes the files into the repo, commits them on the branch and pushes it, returning the repo at the pushed commit.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repository=adore-me/infra commit-files --repo=. --branch=bump/cert-manager --message="Bump cert-manager" --files=./changes
+func (m *Scm) CommitFiles(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+	// Branch the commit is pushed to, created from the current commit when missing
+	// +required
+	branch string,
+	// Commit message
+	// +required
+	message string,
+	// Files to commit, at their path in the repo
+	// +required
+	files *Directory,
+	// Force push the branch, replacing its previous commits
+	// +optional
+	force bool,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "CommitFiles")
+	defer s.End(&err)
+
+	paths, err := files.Glob(ctx, "**")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	add := []string{}
+	for _, p := range paths {
+		add = append(add, shell.Quote(p))
+	}
+	push := "push"
+	if force {
+		push += " --force"
+	}
+
+	c, err := m.backend().git(withTimestamp(repo.WithDirectory(".", files)), fmt.Sprintf(
+		"checkout -B %s && git add -- %s && git commit -m %s && git %s origin HEAD:refs/heads/%s",
+		shell.Quote(branch), strings.Join(add, " "), shell.Quote(message), push, shell.Quote(branch),
+	)).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to push %s: %w", branch, err)
+	}
+
+	return c.Directory("/workspace"), nil
+}
+
+// OpenPullRequest opens a pull request from an already pushed branch and returns its URL.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repository=adore-me/infra open-pull-request --repo=. --branch=bump/cert-manager --title="Bump cert-manager"
+func (m *Scm) OpenPullRequest(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+	// Branch holding the changes
+	// +required
+	branch string,
+	// Title of the pull request
+	// +required
+	title string,
+	// Description of the pull request, in Markdown
+	// +optional
+	body string,
+	// Branch the pull request targets, defaults to the base branch
+	// +optional
+	base string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "OpenPullRequest")
+	defer s.End(&err)
+
+	if base == "" {
+		base = m.BaseBranch
+	}
+
+	url, err := m.backend().openPullRequest(ctx, repo, branch, base, title, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to open pull request from %s: %w", branch, err)
+	}
+
+	return url, nil
+}
+
+// Comment adds a comment to a pull request.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --repository=adore-me/infra comment --repo=. --number=42 --body="Plan attached"
+func (m *Scm) Comment(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+	// Number of the pull request
+	// +required
+	number int,
+	// Comment, in Markdown
+	// +required
+	body string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Comment")
+	defer s.End(&err)
+
+	if err := m.backend().comment(ctx, repo, number, body); err != nil {
+		return "", fmt.Errorf("failed to comment on pull request %d: %w", number, err)
+	}
+
+	return fmt.Sprintf("Commented on pull request %d", number), nil
+}
+
+// withTimestamp adds an untracked timestamp to the repo, so pushes and API calls are never cached
+func withTimestamp(repo *Directory) *Directory {
+	return repo.WithNewFile(".git/dagger-timestamp", time.Now().String())
+}
+
+// lastLine returns the last non empty line of the output, where the CLIs print the URL of the created resource
+func lastLine(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Scm) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the rotation commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check the credentials of the secret store and the consumers",
+	ValidationHint: "check the secret store path and the consumers of the credential",
+}
+
+// commandError types the error of a rotation command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,360 @@
+// This module rotates a credential end-to-end: the new value is generated, or fetched from Vault or AWS Secrets
+// Manager, then written to the GitHub Actions secrets of the repositories and environments, and to the SOPS encrypted
+// files of the GitOps repositories, through a pull request per repository.
+//
+// When a step fails, the steps already done are rolled back: the pull requests are closed and the GitHub secrets get
+// their previous value back, when it is provided.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+)
+
+type SecretRotation struct {
+	// +private
+	Token *Secret
+	// +private
+	Name string
+	// +private
+	Previous *Secret
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new SecretRotation module rotating the named credential
+func New(
+	// Token allowed to set the secrets and open the pull requests of the repositories
+	// +required
+	token *Secret,
+	// Name of the credential, also the name of the GitHub secrets (ex: API_KEY)
+	// +required
+	name string,
+	// Current value of the credential, restored on the GitHub secrets on rollback, which cannot be read back from GitHub
+	// +optional
+	previous *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *SecretRotation {
+	return &SecretRotation{
+		Token:        token,
+		Name:         name,
+		Previous:     previous,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type RotationResult struct {
+	// Whether every step succeeded
+	Rotated bool
+	// Whether the steps done before a failure were rolled back
+	RolledBack bool
+	// Steps, in their order
+	Steps []*RotationStep
+	// Pull requests updating the SOPS files, still open when the rotation succeeded
+	PullRequests []string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type RotationStep struct {
+	// Repository, environment (owner/name:environment) or SOPS files updated by the step
+	Target string
+	// secret or sops
+	Action string
+	// done, failed, rolled back or rollback failed
+	Status string
+	// Error of the step or of its rollback
+	Error string
+}
+
+const (
+	statusDone           = "done"
+	statusFailed         = "failed"
+	statusRolledBack     = "rolled back"
+	statusRollbackFailed = "rollback failed"
+)
+
+// Rotate gets the new value of the credential and writes it to the targets: the SOPS files first, through a pull request
+// per repository, then the GitHub secrets. The first failure stops the rotation and rolls back the steps already done.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --name=API_KEY --previous=env:API_KEY rotate --repos=adore-me/api --sops-files="adore-me/gitops:apps/api/secret.enc.yaml#stringData.API_KEY" --age-key=env:SOPS_AGE_KEY check
+func (m *SecretRotation) Rotate(
+	ctx context.Context,
+	// Source of the new value: random, vault or aws
+	// +optional
+	// +default="random"
+	source string,
+	// Length of a random value
+	// +optional
+	// +default=32
+	length int,
+	// Characters of a random value: alphanumeric, hex or base64url
+	// +optional
+	// +default="alphanumeric"
+	charset string,
+	// Address of the Vault server (ex: https://vault.internal:8200)
+	// +optional
+	vaultAddress string,
+	// Token authenticating with Vault
+	// +optional
+	vaultToken *Secret,
+	// Path of the Vault secret, relative to the KV mount (ex: apps/api)
+	// +optional
+	vaultPath string,
+	// Key of the value in the Vault secret
+	// +optional
+	vaultKey string,
+	// Mount path of the KV secrets engine
+	// +optional
+	// +default="secret"
+	vaultMount string,
+	// The AWS region of the Secrets Manager secret
+	// +optional
+	awsRegion string,
+	// Name or ARN of the Secrets Manager secret
+	// +optional
+	awsSecretId string,
+	// Key of the value when the Secrets Manager secret is a JSON object, the whole secret string otherwise
+	// +optional
+	awsJsonKey string,
+	// Staging label of the Secrets Manager version, AWSPENDING when the rotation function of the secret created it
+	// +optional
+	// +default="AWSCURRENT"
+	awsVersionStage string,
+	// Access key ID of static AWS credentials
+	// +optional
+	awsAccessKeyId *Secret,
+	// Secret access key of static AWS credentials
+	// +optional
+	awsSecretAccessKey *Secret,
+	// Role assumed with the web identity token
+	// +optional
+	awsRoleArn string,
+	// Web identity token exchanged for the role credentials (ex: the projected service account token of IRSA)
+	// +optional
+	awsWebIdentityToken *Secret,
+	// Repositories getting the value as an Actions secret, as owner/name
+	// +optional
+	repos []string,
+	// Environments getting the value as an Actions secret, as owner/name:environment
+	// +optional
+	environments []string,
+	// SOPS encrypted YAML files getting the value, as owner/name:path#key, the key being the dot separated path of the
+	// value in the decrypted file (ex: adore-me/gitops:apps/api/secret.enc.yaml#stringData.API_KEY). Values under a
+	// data mapping (ex: data.API_KEY) are base64 encoded, as in Kubernetes secrets. The files are encrypted again with
+	// the .sops.yaml at the root of their repository.
+	// +optional
+	sopsFiles []string,
+	// Age private key decrypting the SOPS files
+	// +optional
+	ageKey *Secret,
+	// Prefix of the branches of the pull requests
+	// +optional
+	// +default="rotate/"
+	branchPrefix string,
+) (rotationResult *RotationResult, err error) {
+	s := m.startSpan(ctx, "Rotate")
+	defer s.End(&err)
+
+	if len(repos) == 0 && len(environments) == 0 && len(sopsFiles) == 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("at least one of repos, environments or sopsFiles is required"),
+			Hint: "set the repos, environments or sopsFiles receiving the credential",
+		}
+	}
+	for _, env := range environments {
+		if repo, name, _ := strings.Cut(env, ":"); !strings.Contains(repo, "/") || name == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("environment %q is not formatted as owner/name:environment", env),
+				Hint: "pass the environments as owner/name:environment",
+			}
+		}
+	}
+	files, err := parseSopsFiles(sopsFiles)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 && ageKey == nil {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("ageKey is required to update the SOPS files"),
+			Hint: "set ageKey to update the SOPS files",
+		}
+	}
+
+	// Nothing is changed yet when the value cannot be fetched, there is nothing to roll back
+	var value *Secret
+	switch source {
+	case "random":
+		value, err = m.random(length, charset)
+	case "vault":
+		value, err = m.vault(ctx, vaultAddress, vaultToken, vaultPath, vaultKey, vaultMount)
+	case "aws":
+		value, err = m.aws(ctx, awsSecretsManager{
+			Region:           awsRegion,
+			SecretID:         awsSecretId,
+			JSONKey:          awsJsonKey,
+			VersionStage:     awsVersionStage,
+			AccessKeyID:      awsAccessKeyId,
+			SecretAccessKey:  awsSecretAccessKey,
+			RoleArn:          awsRoleArn,
+			WebIdentityToken: awsWebIdentityToken,
+		})
+	default:
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported source %q, expected random, vault or aws", source),
+			Hint: "use the random, vault or aws source",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rotation{result: &RotationResult{
+		Steps:        []*RotationStep{},
+		PullRequests: []string{},
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}}
+	gh := dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+
+	for _, repo := range sortedRepos(files) {
+		url, err := m.updateSopsFiles(ctx, repo, files[repo], value, ageKey, branchPrefix)
+		if err != nil {
+			return r.fail(repo, "sops", err)
+		}
+		r.result.PullRequests = append(r.result.PullRequests, url)
+		r.done(repo, "sops", func() error {
+			_, err := gh.RunGh(ctx, untracked(), "pr close "+url+" --delete-branch --comment "+shell.Quote("The rotation of "+m.Name+" failed, it was rolled back."))
+			return err
+		})
+	}
+
+	targets := []string{}
+	targets = append(targets, repos...)
+	targets = append(targets, environments...)
+	for _, target := range targets {
+		repo, env, _ := strings.Cut(target, ":")
+		if _, err := gh.SetSecret(ctx, repo, m.Name, value, GhSetSecretOpts{Environment: env}); err != nil {
+			return r.fail(target, "secret", err)
+		}
+		r.done(target, "secret", func() error {
+			if m.Previous == nil {
+				return fmt.Errorf("no previous value to restore")
+			}
+			_, err := gh.SetSecret(ctx, repo, m.Name, m.Previous, GhSetSecretOpts{Environment: env})
+			return err
+		})
+	}
+
+	r.result.Rotated = true
+
+	return r.result, nil
+}
+
+// Check returns an error listing the steps when the rotation failed
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN --name=API_KEY rotate --repos=adore-me/api check
+func (r *RotationResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	var b strings.Builder
+	for _, step := range r.Steps {
+		fmt.Fprintf(&b, "%s %s: %s", step.Action, step.Target, step.Status)
+		if step.Error != "" {
+			fmt.Fprintf(&b, " (%s)", step.Error)
+		}
+		b.WriteString("\n")
+	}
+	for _, url := range r.PullRequests {
+		fmt.Fprintf(&b, "pull request: %s\n", url)
+	}
+
+	if !r.Rotated {
+		if r.RolledBack {
+			return "", fmt.Errorf("rotation failed and was rolled back:\n%s", b.String())
+		}
+		return "", fmt.Errorf("rotation failed and was partially rolled back:\n%s", b.String())
+	}
+
+	return b.String(), nil
+}
+
+// rotation records the steps of a rotation and how to undo them
+type rotation struct {
+	result *RotationResult
+	undo   []func() error
+}
+
+// done records a successful step and its rollback
+func (r *rotation) done(target, action string, undo func() error) {
+	r.result.Steps = append(r.result.Steps, &RotationStep{Target: target, Action: action, Status: statusDone})
+	r.undo = append(r.undo, undo)
+}
+
+// fail records the failed step and rolls back the done ones, from the last. The result is returned without error for
+// the caller to see what was rolled back, Check fails on it.
+func (r *rotation) fail(target, action string, err error) (*RotationResult, error) {
+	done := r.result.Steps
+	r.result.Steps = append(r.result.Steps, &RotationStep{Target: target, Action: action, Status: statusFailed, Error: err.Error()})
+
+	r.result.RolledBack = true
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			done[i].Status = statusRollbackFailed
+			done[i].Error = err.Error()
+			r.result.RolledBack = false
+			continue
+		}
+		done[i].Status = statusRolledBack
+	}
+
+	return r.result, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *SecretRotation) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
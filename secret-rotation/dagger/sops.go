@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+type sopsFile struct {
+	// Path of the file, relative to the repository
+	Path string
+	// Dot separated path of the value in the decrypted file
+	Key string
+}
+
+// parseSopsFiles returns the SOPS files per repository, from their owner/name:path#key notation
+func parseSopsFiles(specs []string) (map[string][]sopsFile, error) {
+	files := map[string][]sopsFile{}
+	for _, spec := range specs {
+		repo, rest, _ := strings.Cut(spec, ":")
+		file, key, _ := strings.Cut(rest, "#")
+		if !strings.Contains(repo, "/") || file == "" || key == "" {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("SOPS file %q is not formatted as owner/name:path#key", spec),
+				Hint: "pass the SOPS files as owner/name:path#key",
+			}
+		}
+		files[repo] = append(files[repo], sopsFile{Path: strings.TrimPrefix(file, "/"), Key: key})
+	}
+
+	return files, nil
+}
+
+// sortedRepos returns the repositories of the SOPS files by name, for the steps to run in a stable order
+func sortedRepos(files map[string][]sopsFile) []string {
+	repos := make([]string, 0, len(files))
+	for repo := range files {
+		repos = append(repos, repo)
+	}
+	slices.Sort(repos)
+
+	return repos
+}
+
+// untracked returns an empty directory for the gh commands not targeting a repository, the timestamp makes sure they
+// are never cached
+func untracked() *Directory {
+	return dag.Directory().WithNewFile(".rotation/timestamp", time.Now().String())
+}
+
+// updateSopsFiles writes the value to the SOPS files of the repository, encrypted again with its .sops.yaml, and opens
+// a pull request with them. It returns the pull request URL.
+func (m *SecretRotation) updateSopsFiles(ctx context.Context, repo string, files []sopsFile, value, ageKey *Secret, branchPrefix string) (string, error) {
+	gh := dag.Gh(m.Token, GhOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+	// gh reads the repository from the origin remote, the timestamp makes sure the branch is fetched on every run
+	dir := m.withProxy(dag.Container().From("alpine/git:2.43.0")).
+		WithExec([]string{"sh", "-c", "git init -q /repo && git -C /repo remote add origin https://github.com/" + repo + ".git"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/repo").
+		WithNewFile(".rotation/timestamp", time.Now().String())
+	checkout := gh.RunGit(dir, "fetch -q --depth=1 origin HEAD && git checkout -q FETCH_HEAD").Directory("/workspace")
+	if _, err := checkout.Sync(ctx); err != nil {
+		return "", fmt.Errorf("failed to clone %s: %w", repo, commandError(err))
+	}
+	base, err := gh.RunGh(ctx, checkout, "repo view --json defaultBranchRef --jq .defaultBranchRef.name")
+	if err != nil {
+		return "", fmt.Errorf("failed to get the default branch of %s: %w", repo, err)
+	}
+
+	plain, err := value.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the new value: %w", err)
+	}
+	sops := dag.Sops(SopsOpts{ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+	config := checkout.File(".sops.yaml")
+	if _, err := config.Sync(ctx); err != nil {
+		return "", fmt.Errorf("failed to find the .sops.yaml of %s: %w", repo, commandError(err))
+	}
+
+	paths := []string{}
+	for _, file := range files {
+		decrypted, err := sops.Decrypt(checkout.File(file.Path), ageKey).Contents(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt %s of %s: %w", file.Path, repo, commandError(err))
+		}
+		updated, err := setValue(decrypted, file.Key, plain)
+		if err != nil {
+			return "", fmt.Errorf("failed to update %s of %s: %w", file.Path, repo, err)
+		}
+
+		name := path.Base(file.Path)
+		encrypted := sops.Encrypt(dag.Directory().WithNewFile(name, updated).File(name), SopsEncryptOpts{Config: config, Filename: file.Path})
+		checkout = checkout.WithFile(file.Path, encrypted)
+		paths = append(paths, shell.Quote(file.Path))
+	}
+
+	branch := fmt.Sprintf("%s%s-%d", branchPrefix, strings.ToLower(strings.ReplaceAll(m.Name, "_", "-")), time.Now().Unix())
+	title := "Rotate " + m.Name
+	body := fmt.Sprintf("Rotates `%s` in the SOPS encrypted files:\n\n", m.Name)
+	for _, file := range files {
+		body += fmt.Sprintf("- `%s` (`%s`)\n", file.Path, file.Key)
+	}
+	body += "\nThe GitHub secrets are updated by the same rotation, merge this pull request to roll out the new value.\n"
+
+	pushed := gh.RunGit(
+		checkout.WithNewFile(".rotation/body.md", body),
+		fmt.Sprintf("checkout -q -B %s && git add %s && git commit -q -m %s && git push -q --force origin HEAD:%s", branch, strings.Join(paths, " "), shell.Quote(title), branch),
+	).Directory("/workspace")
+	if _, err := pushed.Sync(ctx); err != nil {
+		return "", fmt.Errorf("failed to push branch %s to %s: %w", branch, repo, commandError(err))
+	}
+
+	url, err := gh.RunGh(ctx, pushed, fmt.Sprintf(
+		"pr create --base %s --head %s --title %s --body-file .rotation/body.md", strings.TrimSpace(base), branch, shell.Quote(title),
+	))
+	if err != nil {
+		return "", fmt.Errorf("failed to open a pull request in %s: %w", repo, err)
+	}
+
+	return strings.TrimSpace(url), nil
+}
+
+// setValue sets the value at the dot separated key of the YAML document, which must exist, keeping the rest of the
+// document. Values under a data mapping are base64 encoded, as in Kubernetes secrets.
+func setValue(content, key, value string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return "", fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return "", fmt.Errorf("empty document")
+	}
+
+	node := doc.Content[0]
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if node.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("%s is not a mapping", strings.Join(parts[:i], "."))
+		}
+		var next *yaml.Node
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == part {
+				next = node.Content[j+1]
+				break
+			}
+		}
+		if next == nil {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("key %s not found", strings.Join(parts[:i+1], ".")),
+				Hint: "check the key of the SOPS file",
+			}
+		}
+		node = next
+	}
+	if node.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("key %s is not a scalar", key)
+	}
+
+	if len(parts) > 1 && parts[len(parts)-2] == "data" {
+		value = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	node.Value = value
+	node.Tag = "!!str"
+	node.Style = 0
+
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return "", fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	return b.String(), nil
+}
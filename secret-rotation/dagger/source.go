@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// charsets are the characters of the random values
+var charsets = map[string]string{
+	"alphanumeric": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"hex":          "0123456789abcdef",
+	"base64url":    "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_",
+}
+
+// random returns a random value drawn uniformly from the charset with crypto/rand
+func (m *SecretRotation) random(length int, charset string) (*Secret, error) {
+	chars, ok := charsets[charset]
+	if !ok {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported charset %q, expected alphanumeric, hex or base64url", charset),
+			Hint: "use the alphanumeric, hex or base64url charset",
+		}
+	}
+	if length < 16 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("length must be at least 16, got %d", length),
+			Hint: "set length to 16 or more",
+		}
+	}
+
+	value := make([]byte, length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate a random value: %w", err)
+		}
+		value[i] = chars[n.Int64()]
+	}
+
+	return m.secret(string(value)), nil
+}
+
+// vault returns the value of a key of a Vault KV secret, read with the vault module
+func (m *SecretRotation) vault(ctx context.Context, address string, token *Secret, path, key, mount string) (*Secret, error) {
+	if address == "" || token == nil || path == "" || key == "" {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("vaultAddress, vaultToken, vaultPath and vaultKey are required with the vault source"),
+			Hint: "set vaultAddress, vaultToken, vaultPath and vaultKey",
+		}
+	}
+
+	value := dag.Vault(address, VaultOpts{
+		AuthMethod: "token",
+		Token:      token,
+		KvMount:    mount,
+		CaBundle:   m.CABundle,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+	}).GetSecret(path, key)
+	// The secret is read lazily, reading it now fails the rotation before any change
+	if _, err := value.Plaintext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read %s#%s from Vault: %w", path, key, err)
+	}
+
+	return value, nil
+}
+
+type awsSecretsManager struct {
+	Region           string
+	SecretID         string
+	JSONKey          string
+	VersionStage     string
+	AccessKeyID      *Secret
+	SecretAccessKey  *Secret
+	RoleArn          string
+	WebIdentityToken *Secret
+}
+
+// aws returns the value of a Secrets Manager secret, authenticated with static credentials or a web identity token
+func (m *SecretRotation) aws(ctx context.Context, sm awsSecretsManager) (*Secret, error) {
+	if sm.Region == "" || sm.SecretID == "" {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("awsRegion and awsSecretId are required with the aws source"),
+			Hint: "set awsRegion and awsSecretId",
+		}
+	}
+	if (sm.AccessKeyID == nil || sm.SecretAccessKey == nil) && (sm.RoleArn == "" || sm.WebIdentityToken == nil) {
+		return nil, &typederr.AuthError{
+			Err:  fmt.Errorf("either awsAccessKeyId and awsSecretAccessKey, or awsRoleArn and awsWebIdentityToken are required with the aws source"),
+			Hint: "set awsAccessKeyId and awsSecretAccessKey, or awsRoleArn and awsWebIdentityToken",
+		}
+	}
+
+	// The secret changes outside of Dagger, so the command is never cached
+	c := m.withProxy(dag.Container().From("amazon/aws-cli:2.15.30")).
+		WithEnvVariable("AWS_REGION", sm.Region).
+		WithEnvVariable("AWS_PAGER", "").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	if sm.AccessKeyID != nil && sm.SecretAccessKey != nil {
+		c = c.
+			WithSecretVariable("AWS_ACCESS_KEY_ID", sm.AccessKeyID).
+			WithSecretVariable("AWS_SECRET_ACCESS_KEY", sm.SecretAccessKey)
+	} else {
+		c = c.
+			WithEnvVariable("AWS_ROLE_ARN", sm.RoleArn).
+			WithEnvVariable("AWS_ROLE_SESSION_NAME", "dagger").
+			WithMountedSecret("/tmp/web-identity-token", sm.WebIdentityToken).
+			WithEnvVariable("AWS_WEB_IDENTITY_TOKEN_FILE", "/tmp/web-identity-token")
+	}
+
+	out, err := c.
+		WithExec([]string{
+			"aws", "secretsmanager", "get-secret-value",
+			"--secret-id", sm.SecretID,
+			"--version-stage", sm.VersionStage,
+			"--query", "SecretString",
+			"--output", "text",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s from Secrets Manager: %w", sm.SecretID, commandError(err))
+	}
+	value := strings.TrimSuffix(out, "\n")
+
+	if sm.JSONKey != "" {
+		values := map[string]any{}
+		if err := json.Unmarshal([]byte(value), &values); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal secret %s: %w", sm.SecretID, err)
+		}
+		v, ok := values[sm.JSONKey].(string)
+		if !ok {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("secret %s has no string key %s", sm.SecretID, sm.JSONKey),
+				Hint: "check the JSON key of the secret",
+			}
+		}
+		value = v
+	}
+	if value == "" {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("secret %s is empty", sm.SecretID),
+			Hint: "store the credential in the secret before rotating it",
+		}
+	}
+
+	return m.secret(value), nil
+}
+
+// secret returns the value as a Dagger secret, named after the credential and the time of the rotation
+func (m *SecretRotation) secret(value string) *Secret {
+	return dag.SetSecret(fmt.Sprintf("rotation-%s-%d", m.Name, time.Now().UnixNano()), value)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the git commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"tag already exists"},
+	AuthHint:       "check that the token is valid and has the contents permission",
+	ConflictHint:   "pull the latest changes of the release branch and run the command again",
+	ValidationHint: "check the conventional commits and the tag format",
+}
+
+// commandError types the error of a git command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,388 @@
+// This module releases a repository from its conventional commits: next version, changelog, tag, GitHub release and artifacts.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type SemanticRelease struct {
+	// The token to authenticate with GitHub
+	// +private
+	Token *Secret
+	// The release branch (ex: main, master)
+	// +private
+	Branch string
+	// Prefix of the release tags (ex: v)
+	// +private
+	TagPrefix string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new SemanticRelease module releasing from the provided branch
+func New(
+	// The token to authenticate with GitHub
+	// +required
+	token *Secret,
+	// The release branch (ex: main, master)
+	// +optional
+	// +default="master"
+	branch string,
+	// Prefix of the release tags
+	// +optional
+	// +default="v"
+	tagPrefix string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *SemanticRelease {
+	return &SemanticRelease{
+		Token:        token,
+		Branch:       branch,
+		TagPrefix:    tagPrefix,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type Commit struct {
+	// Hash of the commit
+	Hash string
+	// Type of the conventional commit (ex: feat, fix)
+	Type string
+	// Scope of the conventional commit
+	Scope string
+	// Description of the commit
+	Subject string
+	// Whether the commit introduces a breaking change
+	Breaking bool
+}
+
+type NextRelease struct {
+	// The last released version, empty for the first release
+	LastVersion string
+	// The next version, empty when no commit triggers a release
+	Version string
+	// The next tag (ex: v1.2.0)
+	Tag string
+	// Kind of bump: major, minor, patch or none
+	Bump string
+	// Commits since the last release
+	Commits []*Commit
+	// Release notes in Markdown
+	Notes string
+}
+
+var commitRe = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!)?: (.+)$`)
+
+// Next computes the next release from the conventional commits since the last release tag.
+// The repository must contain its .git directory with the full history and the tags.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN next --repo=. version
+func (m *SemanticRelease) Next(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+) (result *NextRelease, err error) {
+	s := m.startSpan(ctx, "Next")
+	defer s.End(&err)
+
+	c := m.withProxy(dag.Container().From("alpine/git:2.43.0")).
+		WithDirectory("/workspace", repo).
+		WithWorkdir("/workspace")
+
+	lastTag, err := c.
+		WithExec([]string{
+			"sh", "-c", "git describe --tags --abbrev=0 --match '" + m.TagPrefix + "[0-9]*' 2>/dev/null || true",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last release tag: %w", commandError(err))
+	}
+	lastTag = strings.TrimSpace(lastTag)
+
+	rangeArg := "HEAD"
+	if lastTag != "" {
+		rangeArg = lastTag + "..HEAD"
+	}
+	log, err := c.
+		WithExec([]string{
+			"git", "log", rangeArg, "--no-merges", "--format=%H%x1f%s%x1f%b%x1e",
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commits since %s: %w", lastTag, commandError(err))
+	}
+
+	next := &NextRelease{
+		Bump:    "none",
+		Commits: parseCommits(log),
+	}
+
+	last := semver.MustParse("0.0.0")
+	if lastTag != "" {
+		if last, err = semver.NewVersion(strings.TrimPrefix(lastTag, m.TagPrefix)); err != nil {
+			return nil, fmt.Errorf("failed to parse last release tag %s: %w", lastTag, err)
+		}
+		next.LastVersion = last.String()
+	}
+
+	for _, c := range next.Commits {
+		switch {
+		case c.Breaking:
+			next.Bump = "major"
+		case c.Type == "feat" && next.Bump != "major":
+			next.Bump = "minor"
+		case (c.Type == "fix" || c.Type == "perf") && next.Bump == "none":
+			next.Bump = "patch"
+		}
+	}
+
+	var version semver.Version
+	switch next.Bump {
+	case "none":
+		return next, nil
+	case "major":
+		version = last.IncMajor()
+	case "minor":
+		version = last.IncMinor()
+	case "patch":
+		version = last.IncPatch()
+	}
+	next.Version = version.String()
+	next.Tag = m.TagPrefix + next.Version
+	next.Notes = releaseNotes(next, time.Now())
+
+	return next, nil
+}
+
+// Changelog returns the CHANGELOG.md of the repository with the notes of the next release prepended
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN changelog --repo=. export --path=CHANGELOG.md
+func (m *SemanticRelease) Changelog(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Changelog")
+	defer s.End(&err)
+
+	next, err := m.Next(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	changelog, err := updatedChangelog(ctx, repo, next)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Directory().WithNewFile("CHANGELOG.md", changelog).File("CHANGELOG.md"), nil
+}
+
+// Release commits the updated changelog, creates and pushes the tag, and creates the GitHub release with the artifacts.
+// Returns the released tag, or an empty string when no commit triggers a release.
+//
+// Example usage: dagger call --token=env:GITHUB_TOKEN release --repo=. --artifacts=./dist/app-linux-amd64,./dist/app-darwin-arm64
+func (m *SemanticRelease) Release(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+	// Files attached to the GitHub release
+	// +optional
+	artifacts []*File,
+	// Compute the release without pushing anything
+	// +optional
+	dryRun bool,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Release")
+	defer s.End(&err)
+
+	next, err := m.Next(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+	if next.Version == "" || dryRun {
+		return next.Tag, nil
+	}
+
+	changelog, err := updatedChangelog(ctx, repo, next)
+	if err != nil {
+		return "", err
+	}
+
+	assets := dag.Directory()
+	for i, artifact := range artifacts {
+		name, err := artifact.Name(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get name of artifact %d: %w", i, err)
+		}
+		assets = assets.WithFile(name, artifact)
+	}
+
+	// Only CHANGELOG.md is committed, the .release directory stays untracked.
+	// Its timestamp makes sure the push and the release are never cached.
+	dir := repo.
+		WithNewFile("CHANGELOG.md", changelog).
+		WithNewFile(".release/notes.md", next.Notes).
+		WithDirectory(".release/assets", assets).
+		WithNewFile(".release/timestamp", time.Now().String())
+
+	gh := dag.Gh(m.Token, GhOpts{BaseBranch: m.Branch, ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+
+	pushed, err := gh.RunGit(dir, fmt.Sprintf(
+		"add CHANGELOG.md && git commit -m 'chore(release): %s [skip ci]' && git tag -a %s -m %s && git push origin HEAD:%s %s",
+		next.Tag, next.Tag, next.Tag, m.Branch, next.Tag,
+	)).Directory("/workspace").Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to push release %s: %w", next.Tag, commandError(err))
+	}
+
+	cmd := fmt.Sprintf("release create %s --title %s --notes-file .release/notes.md --verify-tag", next.Tag, next.Tag)
+	if len(artifacts) > 0 {
+		cmd += " .release/assets/*"
+	}
+	if _, err := gh.RunGh(ctx, pushed, cmd); err != nil {
+		return "", fmt.Errorf("failed to create GitHub release %s: %w", next.Tag, err)
+	}
+
+	return next.Tag, nil
+}
+
+// parseCommits parses the git log records (hash, subject and body separated by \x1f) into conventional commits, ignoring the others
+func parseCommits(log string) []*Commit {
+	var commits []*Commit
+	for _, record := range strings.Split(log, "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x1f")
+		if len(fields) < 2 {
+			continue
+		}
+
+		match := commitRe.FindStringSubmatch(fields[1])
+		if match == nil {
+			continue
+		}
+
+		body := ""
+		if len(fields) > 2 {
+			body = fields[2]
+		}
+		commits = append(commits, &Commit{
+			Hash:     fields[0],
+			Type:     strings.ToLower(match[1]),
+			Scope:    match[2],
+			Subject:  match[4],
+			Breaking: match[3] == "!" || strings.Contains(body, "BREAKING CHANGE"),
+		})
+	}
+
+	return commits
+}
+
+// releaseNotes renders the Markdown notes of the release, grouping the commits by type
+func releaseNotes(next *NextRelease, date time.Time) string {
+	sections := []struct {
+		title string
+		match func(*Commit) bool
+	}{
+		{"Breaking Changes", func(c *Commit) bool { return c.Breaking }},
+		{"Features", func(c *Commit) bool { return !c.Breaking && c.Type == "feat" }},
+		{"Bug Fixes", func(c *Commit) bool { return !c.Breaking && c.Type == "fix" }},
+		{"Performance Improvements", func(c *Commit) bool { return !c.Breaking && c.Type == "perf" }},
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s (%s)\n", next.Tag, date.Format("2006-01-02"))
+	for _, s := range sections {
+		var lines []string
+		for _, c := range next.Commits {
+			if !s.match(c) {
+				continue
+			}
+			line := "* "
+			if c.Scope != "" {
+				line += "**" + c.Scope + ":** "
+			}
+			lines = append(lines, line+c.Subject+" ("+c.Hash[:min(7, len(c.Hash))]+")")
+		}
+		if len(lines) > 0 {
+			fmt.Fprintf(&b, "\n### %s\n\n%s\n", s.title, strings.Join(lines, "\n"))
+		}
+	}
+
+	return b.String()
+}
+
+// updatedChangelog returns the CHANGELOG.md of the repository with the release notes prepended
+func updatedChangelog(ctx context.Context, repo *Directory, next *NextRelease) (string, error) {
+	entries, err := repo.Glob(ctx, "CHANGELOG.md")
+	if err != nil {
+		return "", fmt.Errorf("failed to look for CHANGELOG.md: %w", err)
+	}
+
+	existing := "# Changelog\n"
+	if len(entries) > 0 {
+		if existing, err = repo.File("CHANGELOG.md").Contents(ctx); err != nil {
+			return "", fmt.Errorf("failed to read CHANGELOG.md: %w", err)
+		}
+	}
+
+	// Keep the title on top, the latest release goes right below it
+	title, rest := "", existing
+	if strings.HasPrefix(existing, "# ") {
+		title, rest, _ = strings.Cut(existing, "\n")
+		title += "\n\n"
+	}
+
+	return title + next.Notes + "\n" + strings.TrimLeft(rest, "\n"), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *SemanticRelease) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
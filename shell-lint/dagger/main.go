@@ -0,0 +1,431 @@
+// This module lints shell scripts with shellcheck and checks their formatting with shfmt.
+//
+// The formatted scripts can be returned as a directory, or pushed with the gh module as an auto-fix pull request.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"slices"
+	"strings"
+	"time"
+)
+
+// severities are shellcheck severities, from the most to the least severe
+var severities = []string{"error", "warning", "info", "style"}
+
+type ShellLint struct {
+	// The version of shellcheck (ex: v0.10.0)
+	// +private
+	ShellcheckVersion string
+	// The version of shfmt (ex: v3.8.0)
+	// +private
+	ShfmtVersion string
+	// Formatting flags of shfmt, the .editorconfig of the scripts applies when empty
+	// +private
+	ShfmtFlags []string
+	// Severity at or above which a shellcheck finding fails the lint
+	// +private
+	Severity string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new ShellLint module pinned to the provided shellcheck and shfmt versions
+func New(
+	// The version of shellcheck
+	// +optional
+	// +default="v0.10.0"
+	shellcheckVersion string,
+	// The version of shfmt
+	// +optional
+	// +default="v3.8.0"
+	shfmtVersion string,
+	// Formatting flags of shfmt (ex: -i,2,-ci), the .editorconfig of the scripts applies when empty
+	// +optional
+	shfmtFlags []string,
+	// Severity at or above which a shellcheck finding fails the lint: error, warning, info or style
+	// +optional
+	// +default="warning"
+	severity string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*ShellLint, error) {
+	if !slices.Contains(severities, severity) {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid severity %q, expected one of %s", severity, strings.Join(severities, ", ")),
+			Hint: "use one of the expected severities",
+		}
+	}
+
+	return &ShellLint{
+		ShellcheckVersion: shellcheckVersion,
+		ShfmtVersion:      shfmtVersion,
+		ShfmtFlags:        shfmtFlags,
+		Severity:          severity,
+		ProxyURL:          proxyUrl,
+		NoProxy:           noProxy,
+		CABundle:          caBundle,
+		OtlpEndpoint:      otlpEndpoint,
+		OtlpHeaders:       otlpHeaders,
+		Traceparent:       traceparent,
+	}, nil
+}
+
+type LintResult struct {
+	// Whether no shellcheck finding reaches the severity and every script is formatted
+	Passed   bool
+	Findings []*Finding
+	// Scripts that shfmt would reformat
+	Unformatted []string
+	// Unified diff of the shfmt formatting
+	Diff *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Finding struct {
+	// Script, relative to the linted directory
+	File      string
+	Line      int
+	EndLine   int
+	Column    int
+	EndColumn int
+	// shellcheck code, without the SC prefix (ex: 2086)
+	Code int
+	// error, warning, info or style
+	Level   string
+	Message string
+}
+
+type shellcheckOutput struct {
+	Comments []struct {
+		File      string `json:"file"`
+		Line      int    `json:"line"`
+		EndLine   int    `json:"endLine"`
+		Column    int    `json:"column"`
+		EndColumn int    `json:"endColumn"`
+		Level     string `json:"level"`
+		Code      int    `json:"code"`
+		Message   string `json:"message"`
+	} `json:"comments"`
+}
+
+// scripts returns the scripts of the directory matching the patterns, and not the ignore patterns
+func scripts(ctx context.Context, source *Directory, patterns, ignore []string) ([]string, error) {
+	filtered := dag.Directory().WithDirectory(".", source, DirectoryWithDirectoryOpts{Include: patterns, Exclude: ignore})
+
+	files := []string{}
+	for _, p := range patterns {
+		matches, err := filtered.Glob(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list scripts: %w", err)
+		}
+		for _, f := range matches {
+			if !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	slices.Sort(files)
+
+	return files, nil
+}
+
+// shfmt returns a shfmt container running in the directory
+func (m *ShellLint) shfmt(source *Directory) *Container {
+	return m.withProxy(dag.Container().From("mvdan/shfmt:"+m.ShfmtVersion+"-alpine")).
+		WithDirectory("/workspace", source).
+		WithWorkdir("/workspace")
+}
+
+// Lint runs shellcheck and shfmt --diff over the scripts of the directory.
+//
+// Example usage: dagger call lint --source=. check
+func (m *ShellLint) Lint(
+	ctx context.Context,
+	// Directory holding the scripts
+	// +required
+	source *Directory,
+	// Glob patterns of the scripts
+	// +optional
+	// +default=["**/*.sh", "**/*.bash"]
+	patterns []string,
+	// Glob patterns of the scripts skipped (ex: vendored scripts)
+	// +optional
+	ignore []string,
+) (lintResult *LintResult, err error) {
+	s := m.startSpan(ctx, "Lint")
+	defer s.End(&err)
+
+	files, err := scripts(ctx, source, patterns, ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LintResult{
+		Passed:       true,
+		Findings:     []*Finding{},
+		Unformatted:  []string{},
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	if len(files) == 0 {
+		result.Diff = dag.Directory().WithNewFile("shfmt.diff", "").File("shfmt.diff")
+		return result, nil
+	}
+
+	// Both tools exit with 1 on findings, keep their output instead of failing the exec
+	sc := m.withProxy(dag.Container().From("koalaman/shellcheck-alpine:"+m.ShellcheckVersion)).
+		WithDirectory("/workspace", source).
+		WithWorkdir("/workspace").
+		WithExec(append([]string{
+			"sh", "-c", `shellcheck --format=json1 --external-sources "$@" > /tmp/output 2> /tmp/stderr; echo $? > /tmp/exit-code`, "sh",
+		}, files...), ContainerWithExecOpts{SkipEntrypoint: true})
+	out, err := output(ctx, sc, "shellcheck")
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed shellcheckOutput
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal shellcheck output: %w", err)
+	}
+	threshold := slices.Index(severities, m.Severity)
+	for _, c := range parsed.Comments {
+		result.Findings = append(result.Findings, &Finding{
+			File:      c.File,
+			Line:      c.Line,
+			EndLine:   c.EndLine,
+			Column:    c.Column,
+			EndColumn: c.EndColumn,
+			Code:      c.Code,
+			Level:     c.Level,
+			Message:   c.Message,
+		})
+		if i := slices.Index(severities, c.Level); i >= 0 && i <= threshold {
+			result.Passed = false
+		}
+	}
+
+	flags := strings.Join(m.ShfmtFlags, " ")
+	sf := m.shfmt(source).
+		WithExec(append([]string{
+			"sh", "-c", `shfmt ` + flags + ` --diff "$@" > /tmp/output 2> /tmp/stderr; echo $? > /tmp/exit-code`, "sh",
+		}, files...), ContainerWithExecOpts{SkipEntrypoint: true})
+	if _, err := output(ctx, sf, "shfmt"); err != nil {
+		return nil, err
+	}
+	result.Diff = sf.File("/tmp/output")
+
+	unformatted, err := m.shfmt(source).
+		WithExec(append([]string{
+			"sh", "-c", `shfmt ` + flags + ` --list "$@" || true`, "sh",
+		}, files...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unformatted scripts: %w", commandError(err))
+	}
+	for _, f := range strings.Fields(unformatted) {
+		result.Unformatted = append(result.Unformatted, f)
+		result.Passed = false
+	}
+
+	return result, nil
+}
+
+// output returns the output of a linter run with the exit code pattern, failing on exit codes other than 0 and 1
+func output(ctx context.Context, c *Container, linter string) (string, error) {
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", linter, err)
+	}
+	if code := strings.TrimSpace(exitCode); code != "0" && code != "1" {
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return "", commandFailures.Type(fmt.Errorf("%s exited with %s: %s", linter, code, stderr), stderr)
+	}
+
+	out, err := c.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s output: %w", linter, err)
+	}
+
+	return out, nil
+}
+
+// Check fails when a shellcheck finding reaches the severity or a script is not formatted, and returns the number of findings otherwise
+func (r *LintResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, f := range r.Findings {
+			lines = append(lines, fmt.Sprintf("%s:%d:%d: %s SC%d: %s", f.File, f.Line, f.Column, f.Level, f.Code, f.Message))
+		}
+		for _, f := range r.Unformatted {
+			lines = append(lines, fmt.Sprintf("%s: not formatted with shfmt", f))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d findings, %d unformatted scripts:\n%s", len(r.Findings), len(r.Unformatted), strings.Join(lines, "\n")),
+			Hint: "fix the scripts reported by shellcheck and shfmt",
+		}
+	}
+
+	return fmt.Sprintf("%d findings below the severity, all scripts formatted", len(r.Findings)), nil
+}
+
+// Format returns the directory with its scripts formatted by shfmt.
+//
+// Example usage: dagger call format --source=. export --path=.
+func (m *ShellLint) Format(
+	ctx context.Context,
+	// Directory holding the scripts
+	// +required
+	source *Directory,
+	// Glob patterns of the scripts
+	// +optional
+	// +default=["**/*.sh", "**/*.bash"]
+	patterns []string,
+	// Glob patterns of the scripts skipped (ex: vendored scripts)
+	// +optional
+	ignore []string,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "Format")
+	defer s.End(&err)
+
+	files, err := scripts(ctx, source, patterns, ignore)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return source, nil
+	}
+
+	formatted := m.shfmt(source).
+		WithExec(append([]string{
+			"sh", "-c", `shfmt ` + strings.Join(m.ShfmtFlags, " ") + ` --write "$@"`, "sh",
+		}, files...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/workspace")
+
+	return source.WithDirectory(".", formatted, DirectoryWithDirectoryOpts{Include: files}), nil
+}
+
+// OpenFixPullRequest pushes the scripts formatted by shfmt to a branch and opens a pull request with the gh module, returning its URL.
+// Nothing is pushed when every script is already formatted.
+//
+// Example usage: dagger call open-fix-pull-request --repo=. --token=env:GITHUB_TOKEN
+func (m *ShellLint) OpenFixPullRequest(
+	ctx context.Context,
+	// The repository, including its .git directory
+	// +required
+	repo *Directory,
+	// Token allowed to push branches and open pull requests
+	// +required
+	token *Secret,
+	// Glob patterns of the scripts
+	// +optional
+	// +default=["**/*.sh", "**/*.bash"]
+	patterns []string,
+	// Glob patterns of the scripts skipped (ex: vendored scripts)
+	// +optional
+	ignore []string,
+	// Branch the formatted scripts are pushed to
+	// +optional
+	// +default="shfmt/auto-fix"
+	branch string,
+	// Branch the pull request targets
+	// +optional
+	// +default="master"
+	baseBranch string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "OpenFixPullRequest")
+	defer s.End(&err)
+
+	result, err := m.Lint(ctx, repo, patterns, ignore)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Unformatted) == 0 {
+		return "All scripts are already formatted", nil
+	}
+
+	formatted, err := m.Format(ctx, repo, patterns, ignore)
+	if err != nil {
+		return "", err
+	}
+
+	// Only the scripts are committed, the .shfmt directory stays untracked.
+	// Its timestamp makes sure the push and the pull request are never cached.
+	title := "style: format shell scripts with shfmt"
+	body := "Formatted with shfmt " + m.ShfmtVersion + ":\n\n- `" + strings.Join(result.Unformatted, "`\n- `") + "`\n"
+	formatted = formatted.
+		WithNewFile(".shfmt/body.md", body).
+		WithNewFile(".shfmt/timestamp", time.Now().String())
+
+	gh := dag.Gh(token, GhOpts{BaseBranch: baseBranch, ProxyURL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle})
+
+	pushed, err := gh.RunGit(formatted, fmt.Sprintf(
+		"checkout -B %s && git add %s && git commit -m '%s' && git push --force origin HEAD:%s",
+		branch, strings.Join(result.Unformatted, " "), title, branch,
+	)).Directory("/workspace").Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s: %w", branch, commandError(err))
+	}
+
+	url, err := gh.RunGh(ctx, pushed, fmt.Sprintf(
+		"pr create --base %s --head %s --title '%s' --body-file .shfmt/body.md",
+		baseBranch, branch, title,
+	))
+	if err != nil {
+		return "", fmt.Errorf("failed to open pull request for %s: %w", branch, err)
+	}
+
+	return strings.TrimSpace(url), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *ShellLint) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,276 @@
+// This module posts messages and pipeline results to Slack incoming webhooks.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type Slack struct {
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new Slack module posting through the provided proxy
+func New(
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Slack {
+	return &Slack{
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type message struct {
+	Text    string            `json:"text"`
+	Channel string            `json:"channel,omitempty"`
+	Blocks  []json.RawMessage `json:"blocks,omitempty"`
+}
+
+// PostMessage posts a plain text message (Slack mrkdwn is supported).
+//
+// Example usage: dagger call post-message --webhook=env:SLACK_WEBHOOK --text="Deploy done"
+func (m *Slack) PostMessage(
+	ctx context.Context,
+	// Incoming webhook URL
+	// +required
+	webhook *Secret,
+	// Channel to post to instead of the webhook default
+	// +optional
+	channel string,
+	// Text of the message
+	// +required
+	text string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "PostMessage")
+	defer s.End(&err)
+
+	return m.post(ctx, webhook, message{Text: text, Channel: channel})
+}
+
+// PostBlocks posts a Block Kit message, from a JSON file holding the blocks array.
+//
+// Example usage: dagger call post-blocks --webhook=env:SLACK_WEBHOOK --blocks=./blocks.json --text="Deploy done"
+func (m *Slack) PostBlocks(
+	ctx context.Context,
+	// Incoming webhook URL
+	// +required
+	webhook *Secret,
+	// Channel to post to instead of the webhook default
+	// +optional
+	channel string,
+	// JSON file holding the blocks array
+	// +required
+	blocks *File,
+	// Fallback text shown in notifications
+	// +optional
+	text string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "PostBlocks")
+	defer s.End(&err)
+
+	content, err := blocks.Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read blocks: %w", err)
+	}
+
+	var parsed []json.RawMessage
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return "", fmt.Errorf("failed to unmarshal blocks: %w", err)
+	}
+
+	return m.post(ctx, webhook, message{Text: text, Channel: channel, Blocks: parsed})
+}
+
+// FormatPipelineResult returns the Block Kit blocks describing a pipeline result, to be posted with post-blocks.
+//
+// Example usage: dagger call format-pipeline-result --name=deploy --status=success --duration=3m12s --url=https://github.com/adore-me/app/actions/runs/1 export --path=blocks.json
+func (m *Slack) FormatPipelineResult(
+	ctx context.Context,
+	// Name of the pipeline
+	// +required
+	name string,
+	// Status of the pipeline: success or failure
+	// +required
+	status string,
+	// Duration of the pipeline (ex: 3m12s)
+	// +optional
+	duration string,
+	// Link to the pipeline run
+	// +optional
+	url string,
+	// Additional links or facts, one per line (ex: "PR: https://github.com/adore-me/app/pull/42")
+	// +optional
+	details []string,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "FormatPipelineResult")
+	defer s.End(&err)
+
+	content, err := json.MarshalIndent(pipelineBlocks(name, status, duration, url, details), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal blocks: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("blocks.json", string(content)).File("blocks.json"), nil
+}
+
+// PostPipelineResult formats and posts a pipeline result in one call.
+//
+// Example usage: dagger call post-pipeline-result --webhook=env:SLACK_WEBHOOK --name=deploy --status=failure --url=https://github.com/adore-me/app/actions/runs/1
+func (m *Slack) PostPipelineResult(
+	ctx context.Context,
+	// Incoming webhook URL
+	// +required
+	webhook *Secret,
+	// Channel to post to instead of the webhook default
+	// +optional
+	channel string,
+	// Name of the pipeline
+	// +required
+	name string,
+	// Status of the pipeline: success or failure
+	// +required
+	status string,
+	// Duration of the pipeline (ex: 3m12s)
+	// +optional
+	duration string,
+	// Link to the pipeline run
+	// +optional
+	url string,
+	// Additional links or facts, one per line
+	// +optional
+	details []string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "PostPipelineResult")
+	defer s.End(&err)
+
+	var blocks []json.RawMessage
+	for _, b := range pipelineBlocks(name, status, duration, url, details) {
+		raw, err := json.Marshal(b)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal blocks: %w", err)
+		}
+		blocks = append(blocks, raw)
+	}
+
+	return m.post(ctx, webhook, message{Text: statusTitle(name, status), Channel: channel, Blocks: blocks})
+}
+
+// pipelineBlocks builds a header section followed by the pipeline facts
+func pipelineBlocks(name, status, duration, url string, details []string) []map[string]any {
+	facts := []string{}
+	if duration != "" {
+		facts = append(facts, "*Duration:* "+duration)
+	}
+	if url != "" {
+		facts = append(facts, fmt.Sprintf("*Run:* <%s|details>", url))
+	}
+	facts = append(facts, details...)
+
+	blocks := []map[string]any{{
+		"type": "section",
+		"text": map[string]string{"type": "mrkdwn", "text": "*" + statusTitle(name, status) + "*"},
+	}}
+	if len(facts) > 0 {
+		blocks = append(blocks, map[string]any{
+			"type": "context",
+			"elements": []map[string]string{
+				{"type": "mrkdwn", "text": strings.Join(facts, "\n")},
+			},
+		})
+	}
+
+	return blocks
+}
+
+// statusTitle returns a one line summary of the pipeline status
+func statusTitle(name, status string) string {
+	switch strings.ToLower(status) {
+	case "success", "succeeded", "passed":
+		return fmt.Sprintf(":white_check_mark: %s succeeded", name)
+	case "failure", "failed", "error":
+		return fmt.Sprintf(":x: %s failed", name)
+	}
+
+	return fmt.Sprintf(":information_source: %s: %s", name, status)
+}
+
+// post sends the message to the webhook
+func (m *Slack) post(ctx context.Context, webhook *Secret, msg message) (string, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	url, err := webhook.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get webhook url: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", egress.WithoutURL(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	// The webhook URL is the credential of the channel, the errors of the client quote it
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to post message: %w", egress.WithoutURL(err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", typederr.FromResponse(resp, fmt.Errorf("failed to post message: unexpected status %s: %s", resp.Status, body))
+	}
+
+	return msg.Text, nil
+}
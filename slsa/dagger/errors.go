@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the cosign commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check the registry credentials and the signing key password",
+	ValidationHint: "check the subject digests and the builder identity",
+}
+
+// commandError types the error of a cosign command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
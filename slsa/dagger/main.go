@@ -0,0 +1,411 @@
+// This module generates SLSA v1 provenance for the images and release artifacts built with Dagger, signs it with
+// cosign and attaches it to them.
+//
+// Images get the provenance as a cosign attestation pushed next to them. Release artifacts get an in-toto statement
+// listing them as subjects, along with its cosign bundle, to publish as release assets.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/registryauth"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+// predicateType is the SLSA provenance v1 predicate type
+const predicateType = "https://slsa.dev/provenance/v1"
+
+type Slsa struct {
+	// URL of the source repository (ex: https://github.com/adore-me/api)
+	// +private
+	SourceRepo string
+	// Git ref the artifacts were built from (ex: refs/tags/v1.2.3)
+	// +private
+	SourceRef string
+	// Git commit the artifacts were built from
+	// +private
+	SourceCommit string
+	// ID of the builder (ex: https://github.com/adore-me/infra/.github/workflows/build.yaml@refs/heads/master)
+	// +private
+	BuilderID string
+	// Type of the build, defining how the external parameters are interpreted
+	// +private
+	BuildType string
+	// ID of the build run (ex: the URL of the CI run)
+	// +private
+	InvocationID string
+	// Build inputs other than the source, as uri@algorithm:digest
+	// +private
+	Materials []string
+	// When the build started, RFC 3339 formatted
+	// +private
+	StartedOn string
+	// The version of cosign (ex: v2.2.3)
+	// +private
+	CosignVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Slsa module describing the build of the source commit
+//
+// Example usage: dagger call --source-repo=https://github.com/adore-me/api --source-ref=refs/tags/v1.2.3 --source-commit=$GITHUB_SHA --builder-id=$BUILDER_ID provenance export --path=provenance.json
+func New(
+	// URL of the source repository (ex: https://github.com/adore-me/api)
+	// +required
+	sourceRepo string,
+	// Git ref the artifacts were built from (ex: refs/tags/v1.2.3)
+	// +required
+	sourceRef string,
+	// Git commit the artifacts were built from
+	// +required
+	sourceCommit string,
+	// ID of the builder (ex: https://github.com/adore-me/infra/.github/workflows/build.yaml@refs/heads/master)
+	// +required
+	builderId string,
+	// Type of the build, defining how the external parameters are interpreted
+	// +optional
+	// +default="https://github.com/adore-me/daggerverse/slsa@v1"
+	buildType string,
+	// ID of the build run (ex: the URL of the CI run)
+	// +optional
+	invocationId string,
+	// Build inputs other than the source, as uri@algorithm:digest (ex: docker.io/library/golang@sha256:...)
+	// +optional
+	materials []string,
+	// When the build started, RFC 3339 formatted
+	// +optional
+	startedOn string,
+	// The version of cosign
+	// +optional
+	// +default="v2.2.3"
+	cosignVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Slsa, error) {
+	for _, material := range materials {
+		if _, err := parseMaterial(material); err != nil {
+			return nil, err
+		}
+	}
+	if startedOn != "" {
+		if _, err := time.Parse(time.RFC3339, startedOn); err != nil {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid started on %q, expected RFC 3339: %w", startedOn, err),
+				Hint: "use an RFC 3339 date, ex: 2024-03-01T12:00:00Z",
+			}
+		}
+	}
+
+	return &Slsa{
+		SourceRepo:    sourceRepo,
+		SourceRef:     sourceRef,
+		SourceCommit:  sourceCommit,
+		BuilderID:     builderId,
+		BuildType:     buildType,
+		InvocationID:  invocationId,
+		Materials:     materials,
+		StartedOn:     startedOn,
+		CosignVersion: cosignVersion,
+		ProxyURL:      proxyUrl,
+		NoProxy:       noProxy,
+		CABundle:      caBundle,
+		OtlpEndpoint:  otlpEndpoint,
+		OtlpHeaders:   otlpHeaders,
+		Traceparent:   traceparent,
+	}, nil
+}
+
+type resourceDescriptor struct {
+	URI    string            `json:"uri,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// parseMaterial parses a material given as uri@algorithm:digest
+func parseMaterial(material string) (resourceDescriptor, error) {
+	i := strings.LastIndex(material, "@")
+	if i < 0 {
+		return resourceDescriptor{}, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid material %q, expected uri@algorithm:digest", material),
+			Hint: "pass the materials as uri@algorithm:digest",
+		}
+	}
+	algorithm, digest, found := strings.Cut(material[i+1:], ":")
+	if !found || algorithm == "" || digest == "" {
+		return resourceDescriptor{}, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid material %q, expected uri@algorithm:digest", material),
+			Hint: "pass the materials as uri@algorithm:digest",
+		}
+	}
+
+	return resourceDescriptor{URI: material[:i], Digest: map[string]string{algorithm: digest}}, nil
+}
+
+// predicate returns the SLSA provenance v1 predicate of the build
+func (m *Slsa) predicate() map[string]any {
+	dependencies := []resourceDescriptor{{
+		URI:    "git+" + m.SourceRepo + "@" + m.SourceRef,
+		Digest: map[string]string{"gitCommit": m.SourceCommit},
+	}}
+	for _, material := range m.Materials {
+		d, _ := parseMaterial(material)
+		dependencies = append(dependencies, d)
+	}
+
+	metadata := map[string]string{"finishedOn": time.Now().UTC().Format(time.RFC3339)}
+	if m.InvocationID != "" {
+		metadata["invocationId"] = m.InvocationID
+	}
+	if m.StartedOn != "" {
+		metadata["startedOn"] = m.StartedOn
+	}
+
+	return map[string]any{
+		"buildDefinition": map[string]any{
+			"buildType": m.BuildType,
+			"externalParameters": map[string]string{
+				"repository": m.SourceRepo,
+				"ref":        m.SourceRef,
+			},
+			"resolvedDependencies": dependencies,
+		},
+		"runDetails": map[string]any{
+			"builder":  map[string]string{"id": m.BuilderID},
+			"metadata": metadata,
+		},
+	}
+}
+
+// Provenance returns the SLSA provenance v1 predicate of the build, unsigned
+//
+// Example usage: dagger call --source-repo=https://github.com/adore-me/api --source-ref=refs/tags/v1.2.3 --source-commit=$GITHUB_SHA --builder-id=$BUILDER_ID provenance export --path=provenance.json
+func (m *Slsa) Provenance(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Provenance")
+	defer s.End(&err)
+
+	content, err := json.MarshalIndent(m.predicate(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("provenance.json", string(content)).File("provenance.json"), nil
+}
+
+// AttestImage signs the provenance and attaches it to the image as a cosign attestation.
+//
+// Example usage: dagger call --source-repo=https://github.com/adore-me/api --source-ref=refs/tags/v1.2.3 --source-commit=$GITHUB_SHA --builder-id=$BUILDER_ID attest-image --ref=ghcr.io/adore-me/api@sha256:... --key=env:COSIGN_KEY --username=bot --password=env:REGISTRY_TOKEN
+func (m *Slsa) AttestImage(
+	ctx context.Context,
+	// Image reference, by digest
+	// +required
+	ref string,
+	// Cosign private key, omit for keyless signing
+	// +optional
+	key *Secret,
+	// Password of the cosign private key
+	// +optional
+	keyPassword *Secret,
+	// OIDC identity token used for keyless signing (ex: the GitHub Actions ID token)
+	// +optional
+	identityToken *Secret,
+	// Registry username
+	// +required
+	username string,
+	// Registry password or token
+	// +required
+	password *Secret,
+) (out string, err error) {
+	s := m.startSpan(ctx, "AttestImage")
+	defer s.End(&err)
+
+	if !strings.Contains(ref, "@sha256:") {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("image %q must be referenced by digest, provenance is bound to one image", ref),
+			Hint: "reference the image by its digest, ex: registry/app@sha256:...",
+		}
+	}
+
+	provenance, err := m.Provenance(ctx)
+	if err != nil {
+		return "", err
+	}
+	config, err := dockerConfig(ctx, registryauth.Host(ref), username, password)
+	if err != nil {
+		return "", err
+	}
+
+	c, args, err := withSigner(
+		m.cosign().
+			WithMountedSecret("/root/.docker/config.json", config).
+			WithEnvVariable("DOCKER_CONFIG", "/root/.docker").
+			WithFile("/tmp/provenance.json", provenance),
+		[]string{"cosign", "attest", "--yes", "--type", "slsaprovenance1", "--predicate", "/tmp/provenance.json"},
+		key, keyPassword, identityToken,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := c.WithExec(append(args, ref), ContainerWithExecOpts{SkipEntrypoint: true}).Sync(ctx); err != nil {
+		return "", fmt.Errorf("failed to attest %s: %w", ref, commandError(err))
+	}
+
+	return fmt.Sprintf("Attested provenance of %s", ref), nil
+}
+
+// AttestArtifacts returns a signed in-toto statement of the provenance, listing every file of the directory as a subject:
+// provenance.intoto.json and its cosign bundle provenance.intoto.json.bundle.
+//
+// Example usage: dagger call --source-repo=https://github.com/adore-me/cli --source-ref=refs/tags/v1.2.3 --source-commit=$GITHUB_SHA --builder-id=$BUILDER_ID attest-artifacts --artifacts=./dist --key=env:COSIGN_KEY export --path=./dist
+func (m *Slsa) AttestArtifacts(
+	ctx context.Context,
+	// Release artifacts, at the root of the directory
+	// +required
+	artifacts *Directory,
+	// Cosign private key, omit for keyless signing
+	// +optional
+	key *Secret,
+	// Password of the cosign private key
+	// +optional
+	keyPassword *Secret,
+	// OIDC identity token used for keyless signing (ex: the GitHub Actions ID token)
+	// +optional
+	identityToken *Secret,
+) (dir *Directory, err error) {
+	s := m.startSpan(ctx, "AttestArtifacts")
+	defer s.End(&err)
+
+	out, err := m.withProxy(dag.Container().From("alpine:3.19")).
+		WithDirectory("/artifacts", artifacts).
+		WithWorkdir("/artifacts").
+		WithExec([]string{"sh", "-c", "find . -maxdepth 1 -type f | sort | xargs -r sha256sum"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash artifacts: %w", commandError(err))
+	}
+
+	subjects := []resourceDescriptor{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		digest, name, found := strings.Cut(line, "  ")
+		if !found {
+			continue
+		}
+		subjects = append(subjects, resourceDescriptor{Name: strings.TrimPrefix(name, "./"), Digest: map[string]string{"sha256": digest}})
+	}
+	if len(subjects) == 0 {
+		return nil, &typederr.ValidationError{Err: fmt.Errorf("no artifact to attest"), Hint: "pass the artifacts to attest"}
+	}
+
+	statement, err := json.MarshalIndent(map[string]any{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"subject":       subjects,
+		"predicateType": predicateType,
+		"predicate":     m.predicate(),
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal statement: %w", err)
+	}
+
+	c, args, err := withSigner(
+		m.cosign().
+			WithNewFile("/out/provenance.intoto.json", ContainerWithNewFileOpts{Contents: string(statement)}),
+		[]string{"cosign", "sign-blob", "--yes", "--bundle", "/out/provenance.intoto.json.bundle"},
+		key, keyPassword, identityToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := c.
+		WithExec(append(args, "/out/provenance.intoto.json"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/out")
+	if _, err := signed.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sign statement: %w", commandError(err))
+	}
+
+	return signed, nil
+}
+
+// cosign returns a container with the pinned cosign CLI
+func (m *Slsa) cosign() *Container {
+	return m.withProxy(dag.Container().From("gcr.io/projectsigstore/cosign:"+m.CosignVersion)).
+		// Signatures are pushed to the live registry and transparency log
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+}
+
+// withSigner configures key based signing when a key is provided, keyless signing with the identity token otherwise
+func withSigner(c *Container, args []string, key, keyPassword, identityToken *Secret) (*Container, []string, error) {
+	switch {
+	case key != nil:
+		c = c.WithMountedSecret("/keys/cosign.key", key)
+		if keyPassword != nil {
+			c = c.WithSecretVariable("COSIGN_PASSWORD", keyPassword)
+		} else {
+			c = c.WithEnvVariable("COSIGN_PASSWORD", "")
+		}
+		args = append(args, "--key", "/keys/cosign.key")
+	case identityToken != nil:
+		c = c.WithMountedSecret("/keys/identity-token", identityToken)
+		args = append(args, "--identity-token", "/keys/identity-token")
+	default:
+		return nil, nil, &typederr.AuthError{
+			Err:  fmt.Errorf("either a key or an identity token is required"),
+			Hint: "set the key and its password, or an identity token for keyless signing",
+		}
+	}
+
+	return c, args, nil
+}
+
+// dockerConfig returns a docker config.json authenticating against the registry
+func dockerConfig(ctx context.Context, registry, username string, password *Secret) (*Secret, error) {
+	config, err := registryauth.DockerConfig(ctx, registryauth.Auth{Registry: registry, Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret("docker-config-"+registry, config), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Slsa) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the snyk commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"missing node_modules", "could not detect supported target files"},
+	AuthHint:       "check that the snyk token is valid and belongs to the organization",
+	ValidationHint: "check the target files and the manifests of the project",
+}
+
+// commandError types the error of a snyk command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,334 @@
+// This module tests container images and open-source dependencies with snyk test, and monitors them with snyk monitor.
+//
+// The JSON results are returned as a File, for the platform security dashboard to ingest, and counted by severity to
+// gate builds.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/severity"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+// severities are Snyk severities, from the most to the least severe
+var severities = severity.Scale{"critical", "high", "medium", "low"}
+
+type Snyk struct {
+	// Snyk API token
+	// +private
+	Token *Secret
+	// Snyk organization of the projects
+	// +private
+	Org string
+	// Severity at or above which a test fails (ex: high), empty to never fail
+	// +private
+	FailOn string
+	// Tags of the monitored projects
+	// +private
+	ProjectTags []string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Snyk module authenticated with the API token
+func New(
+	// Snyk API token, or service account token
+	// +required
+	token *Secret,
+	// Snyk organization ID or slug of the projects, defaults to the organization of the token
+	// +optional
+	org string,
+	// Severity at or above which a test fails: critical, high, medium or low. Empty to never fail.
+	// +optional
+	// +default="high"
+	failOn string,
+	// Tags of the monitored projects (ex: team=platform,component=api)
+	// +optional
+	projectTags []string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Snyk, error) {
+	failOn = strings.ToLower(failOn)
+	if failOn != "" && severities.Rank(failOn) < 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid severity %q, expected one of %s", failOn, strings.Join(severities, ", ")),
+			Hint: "use one of the expected severities",
+		}
+	}
+	for _, t := range projectTags {
+		if !strings.Contains(t, "=") {
+			return nil, &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid project tag %q, expected KEY=VALUE", t),
+				Hint: "pass the project tags as KEY=VALUE",
+			}
+		}
+	}
+
+	return &Snyk{
+		Token:        token,
+		Org:          org,
+		FailOn:       failOn,
+		ProjectTags:  projectTags,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+type TestResult struct {
+	// snyk test JSON results
+	Report   *File
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	// Whether no vulnerability reaches the fail threshold
+	Passed bool
+	// +private
+	FailOn string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type snykReport struct {
+	Vulnerabilities []struct {
+		Severity string `json:"severity"`
+	} `json:"vulnerabilities"`
+	// Vulnerabilities of the applications found in container images
+	Applications []struct {
+		Vulnerabilities []struct {
+			Severity string `json:"severity"`
+		} `json:"vulnerabilities"`
+	} `json:"applications"`
+}
+
+// base returns a container of the Snyk CLI image with the token and organization
+func (m *Snyk) base(image string) *Container {
+	c := m.withProxy(dag.Container().From(image)).
+		WithSecretVariable("SNYK_TOKEN", m.Token).
+		// New vulnerabilities are published continuously, never reuse a cached result
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	if m.Org != "" {
+		c = c.WithEnvVariable("SNYK_CFG_ORG", m.Org)
+	}
+
+	return c
+}
+
+// TestDeps tests the open-source dependencies of the directory, and monitors them when requested. The image must
+// provide the package manager of the projects (ex: snyk/snyk:golang-1.21, snyk/snyk:maven-3-jdk-17).
+//
+// Example usage: dagger call --token=env:SNYK_TOKEN test-deps --dir=. --image=snyk/snyk:node-20 check
+func (m *Snyk) TestDeps(
+	ctx context.Context,
+	// Directory of the projects
+	// +required
+	dir *Directory,
+	// Snyk CLI image with the package manager of the projects
+	// +optional
+	// +default="snyk/snyk:node-20"
+	image string,
+	// Test every project found in the directory, the project at its root only otherwise
+	// +optional
+	// +default=true
+	allProjects bool,
+	// Record a snapshot of the dependencies in Snyk, for new vulnerabilities to be reported
+	// +optional
+	monitor bool,
+) (result *TestResult, err error) {
+	s := m.startSpan(ctx, "TestDeps")
+	defer s.End(&err)
+
+	c := m.base(image).
+		WithDirectory("/workspace", dir).
+		WithWorkdir("/workspace")
+
+	var args []string
+	if allProjects {
+		args = append(args, "--all-projects")
+	}
+
+	return m.test(ctx, c, "", args, monitor)
+}
+
+// TestContainer tests a container image from a registry, its OS packages and the applications it embeds, and monitors
+// it when requested.
+//
+// Example usage: dagger call --token=env:SNYK_TOKEN test-container --ref=ghcr.io/adore-me/app:1.2.3 report export --path=snyk.json
+func (m *Snyk) TestContainer(
+	ctx context.Context,
+	// Image reference (ex: ghcr.io/adore-me/app:1.2.3)
+	// +required
+	ref string,
+	// Dockerfile of the image, for base image upgrade advice
+	// +optional
+	dockerfile *File,
+	// Registry username, for private images
+	// +optional
+	username string,
+	// Registry password or token, for private images
+	// +optional
+	password *Secret,
+	// Record a snapshot of the image in Snyk, for new vulnerabilities to be reported
+	// +optional
+	monitor bool,
+) (result *TestResult, err error) {
+	s := m.startSpan(ctx, "TestContainer")
+	defer s.End(&err)
+
+	c := m.base("snyk/snyk:alpine")
+	args := []string{shell.Quote(ref)}
+	if dockerfile != nil {
+		c = c.WithMountedFile("/tmp/Dockerfile", dockerfile)
+		args = append(args, "--file=/tmp/Dockerfile")
+	}
+	if password != nil {
+		c = c.
+			WithEnvVariable("SNYK_REGISTRY_USERNAME", username).
+			WithSecretVariable("SNYK_REGISTRY_PASSWORD", password)
+		args = append(args, `--username="$SNYK_REGISTRY_USERNAME"`, `--password="$SNYK_REGISTRY_PASSWORD"`)
+	}
+
+	return m.test(ctx, c, "container", args, monitor)
+}
+
+// test runs snyk [product] test, then snyk [product] monitor when requested, and counts the vulnerabilities of the
+// JSON results. args are the arguments shared by test and monitor, expanded by sh.
+func (m *Snyk) test(ctx context.Context, c *Container, product string, args []string, monitor bool) (*TestResult, error) {
+	cmd := strings.TrimSpace("snyk " + product)
+	testArgs := append([]string{cmd, "test"}, args...)
+
+	// snyk test exits with 1 when vulnerabilities are found, 2 on failures and 3 when no project is supported
+	c = c.WithExec(
+		[]string{"sh", "-c", strings.Join(testArgs, " ") + ` --json-file-output=/tmp/report.json > /tmp/output.log 2>&1; code=$?
+[ $code -le 1 ] || { cat /tmp/output.log; exit $code; }`},
+		ContainerWithExecOpts{SkipEntrypoint: true},
+	)
+
+	if monitor {
+		monitorArgs := append([]string{cmd, "monitor"}, args...)
+		if len(m.ProjectTags) > 0 {
+			monitorArgs = append(monitorArgs, "--project-tags="+shell.Quote(strings.Join(m.ProjectTags, ",")))
+		}
+		c = c.WithExec([]string{"sh", "-c", strings.Join(monitorArgs, " ")}, ContainerWithExecOpts{SkipEntrypoint: true})
+	}
+
+	report := c.File("/tmp/report.json")
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to test with snyk: %w", commandError(err))
+	}
+
+	// --all-projects returns one result per project
+	var parsed []snykReport
+	if strings.HasPrefix(strings.TrimSpace(content), "[") {
+		err = json.Unmarshal([]byte(content), &parsed)
+	} else {
+		parsed = make([]snykReport, 1)
+		err = json.Unmarshal([]byte(content), &parsed[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snyk results: %w", err)
+	}
+
+	counts := map[string]int{}
+	for _, r := range parsed {
+		for _, v := range r.Vulnerabilities {
+			counts[v.Severity]++
+		}
+		for _, a := range r.Applications {
+			for _, v := range a.Vulnerabilities {
+				counts[v.Severity]++
+			}
+		}
+	}
+
+	passed := true
+	if m.FailOn != "" {
+		for _, severity := range severities[:severities.Rank(m.FailOn)+1] {
+			if counts[severity] > 0 {
+				passed = false
+			}
+		}
+	}
+
+	return &TestResult{
+		Report:       report,
+		Critical:     counts["critical"],
+		High:         counts["high"],
+		Medium:       counts["medium"],
+		Low:          counts["low"],
+		Passed:       passed,
+		FailOn:       m.FailOn,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when a vulnerability reaches the fail threshold, and returns the severity counts otherwise
+func (r *TestResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	summary := fmt.Sprintf("critical=%d high=%d medium=%d low=%d", r.Critical, r.High, r.Medium, r.Low)
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("vulnerabilities at or above %s: %s", r.FailOn, summary),
+			Hint: "fix the vulnerabilities or ignore them in the .snyk policy",
+		}
+	}
+
+	return summary, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Snyk) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
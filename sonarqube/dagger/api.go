@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"time"
+)
+
+type ceTask struct {
+	Task struct {
+		Status       string `json:"status"`
+		AnalysisID   string `json:"analysisId"`
+		ComponentKey string `json:"componentKey"`
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"task"`
+}
+
+type projectStatus struct {
+	ProjectStatus struct {
+		Status     string `json:"status"`
+		Conditions []struct {
+			Status         string `json:"status"`
+			MetricKey      string `json:"metricKey"`
+			Comparator     string `json:"comparator"`
+			ErrorThreshold string `json:"errorThreshold"`
+			ActualValue    string `json:"actualValue"`
+		} `json:"conditions"`
+	} `json:"projectStatus"`
+}
+
+// get calls the SonarQube web API, authenticated with the token, and decodes the JSON response into out
+func (m *Sonarqube) get(ctx context.Context, token, endpoint string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.HostURL+"/"+endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.SetBasicAuth(token, "")
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call sonarqube: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return typederr.FromResponse(resp, fmt.Errorf("sonarqube returned %s: %s", resp.Status, body))
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
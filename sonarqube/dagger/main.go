@@ -0,0 +1,294 @@
+// This module runs sonar-scanner against a SonarQube server and waits for the quality gate of the analysis.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type Sonarqube struct {
+	// The SonarQube server (ex: https://sonarqube.example.com)
+	// +private
+	HostURL string
+	// Token of a SonarQube user allowed to analyze the projects
+	// +private
+	Token *Secret
+	// The version of the sonar-scanner-cli image (ex: 5.0.1)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Sonarqube module authenticated on the provided server
+func New(
+	// The SonarQube server (ex: https://sonarqube.example.com)
+	// +required
+	hostUrl string,
+	// Token of a SonarQube user allowed to analyze the projects
+	// +required
+	token *Secret,
+	// The version of the sonar-scanner-cli image
+	// +optional
+	// +default="5.0.1"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Sonarqube {
+	return &Sonarqube{
+		HostURL:      strings.TrimSuffix(hostUrl, "/"),
+		Token:        token,
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+type ScanResult struct {
+	// Key of the project
+	ProjectKey string
+	// ID of the background task processing the analysis, to pass to waitForQualityGate
+	TaskID string
+	// Link to the analysis in SonarQube
+	DashboardURL string
+}
+
+type QualityGate struct {
+	// Status of the quality gate: OK, WARN or ERROR
+	Status string
+	// Failed conditions (ex: new_coverage LT 80: 72.5)
+	FailedConditions []string
+	// Link to the analysis in SonarQube
+	DashboardURL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// Scan analyzes the sources and returns the background task of the analysis.
+// The pull request parameters enable the pull request decoration, the branch enables the branch analysis.
+//
+// Example usage: dagger call --host-url=https://sonarqube.example.com --token=env:SONAR_TOKEN scan --source=. --project-key=shop-api --pull-request-key=42 --pull-request-branch=feat/cart --pull-request-base=master task-id
+func (m *Sonarqube) Scan(
+	ctx context.Context,
+	// The sources, including sonar-project.properties when present
+	// +required
+	source *Directory,
+	// Key of the project, defaults to sonar.projectKey of sonar-project.properties
+	// +optional
+	projectKey string,
+	// Branch analyzed, for branch analysis
+	// +optional
+	branch string,
+	// Number of the pull request, for pull request decoration
+	// +optional
+	pullRequestKey string,
+	// Head branch of the pull request
+	// +optional
+	pullRequestBranch string,
+	// Base branch of the pull request
+	// +optional
+	pullRequestBase string,
+	// Extra analysis parameters (ex: sonar.go.coverage.reportPaths=coverage.out)
+	// +optional
+	properties []string,
+) (result *ScanResult, err error) {
+	s := m.startSpan(ctx, "Scan")
+	defer s.End(&err)
+
+	args := []string{"sonar-scanner", "-Dsonar.host.url=" + m.HostURL}
+	for _, param := range [][2]string{
+		{"sonar.projectKey", projectKey},
+		{"sonar.branch.name", branch},
+		{"sonar.pullrequest.key", pullRequestKey},
+		{"sonar.pullrequest.branch", pullRequestBranch},
+		{"sonar.pullrequest.base", pullRequestBase},
+	} {
+		if param[1] != "" {
+			args = append(args, "-D"+param[0]+"="+param[1])
+		}
+	}
+	for _, p := range properties {
+		args = append(args, "-D"+p)
+	}
+
+	report, err := m.withProxy(dag.Container().From("sonarsource/sonar-scanner-cli:"+m.Version)).
+		WithDirectory("/usr/src", source).
+		WithWorkdir("/usr/src").
+		WithSecretVariable("SONAR_TOKEN", m.Token).
+		WithMountedCache("/opt/sonar-scanner/.sonar/cache", dag.CacheVolume("sonar-scanner")).
+		// Every analysis must reach the server
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		File(".scannerwork/report-task.txt").
+		Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run sonar-scanner: %w", err)
+	}
+
+	task := parseProperties(report)
+
+	return &ScanResult{
+		ProjectKey:   task["projectKey"],
+		TaskID:       task["ceTaskId"],
+		DashboardURL: task["dashboardUrl"],
+	}, nil
+}
+
+// WaitForQualityGate waits for the background task of an analysis to complete, and returns the quality gate of the analysis.
+//
+// Example usage: dagger call --host-url=https://sonarqube.example.com --token=env:SONAR_TOKEN wait-for-quality-gate --task-id=AY1x check
+func (m *Sonarqube) WaitForQualityGate(
+	ctx context.Context,
+	// ID of the background task returned by scan
+	// +required
+	taskId string,
+	// Maximum duration to wait for
+	// +optional
+	// +default="5m"
+	timeout string,
+	// Interval between two polls
+	// +optional
+	// +default="5s"
+	pollInterval string,
+) (result *QualityGate, err error) {
+	s := m.startSpan(ctx, "WaitForQualityGate")
+	defer s.End(&err)
+
+	wait, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeout: %w", err)
+	}
+	interval, err := time.ParseDuration(pollInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse poll interval: %w", err)
+	}
+
+	token, err := m.Token.Plaintext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sonarqube token: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	var task ceTask
+	for {
+		if err := m.get(ctx, token, "api/ce/task?id="+taskId, &task); err != nil {
+			return nil, fmt.Errorf("failed to get task %s: %w", taskId, err)
+		}
+		if task.Task.Status != "PENDING" && task.Task.Status != "IN_PROGRESS" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, &typederr.ConflictError{
+				Err:  fmt.Errorf("task %s still %s after %s", taskId, task.Task.Status, timeout),
+				Hint: "the analysis is still running, raise the timeout or check the task again later",
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	if task.Task.Status != "SUCCESS" {
+		return nil, fmt.Errorf("task %s ended with status %s: %s", taskId, task.Task.Status, task.Task.ErrorMessage)
+	}
+
+	var status projectStatus
+	if err := m.get(ctx, token, "api/qualitygates/project_status?analysisId="+task.Task.AnalysisID, &status); err != nil {
+		return nil, fmt.Errorf("failed to get quality gate of analysis %s: %w", task.Task.AnalysisID, err)
+	}
+
+	gate := &QualityGate{
+		Status:       status.ProjectStatus.Status,
+		DashboardURL: fmt.Sprintf("%s/dashboard?id=%s", m.HostURL, task.Task.ComponentKey),
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, c := range status.ProjectStatus.Conditions {
+		if c.Status == "ERROR" {
+			gate.FailedConditions = append(gate.FailedConditions, fmt.Sprintf("%s %s %s: %s", c.MetricKey, c.Comparator, c.ErrorThreshold, c.ActualValue))
+		}
+	}
+
+	return gate, nil
+}
+
+// Check fails when the quality gate failed, and returns its status otherwise
+func (g *QualityGate) Check(ctx context.Context) (out string, err error) {
+	s := g.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if g.Status == "ERROR" {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("quality gate failed (%s): %s", g.DashboardURL, strings.Join(g.FailedConditions, ", ")),
+			Hint: "fix the conditions failing the quality gate",
+		}
+	}
+
+	return fmt.Sprintf("quality gate %s: %s", g.Status, g.DashboardURL), nil
+}
+
+// parseProperties parses a key=value properties file, such as report-task.txt
+func parseProperties(content string) map[string]string {
+	props := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && !strings.HasPrefix(key, "#") {
+			props[key] = value
+		}
+	}
+
+	return props
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Sonarqube) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
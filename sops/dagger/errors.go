@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the sops commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"no matching creation rules", "failed to get the data key", "mac mismatch"},
+	AuthHint:       "check the age key of the file recipients",
+	ValidationHint: "check the creation rules of .sops.yaml and the recipients of the file",
+}
+
+// commandError types the error of a sops command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
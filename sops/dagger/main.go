@@ -0,0 +1,224 @@
+// This module encrypts, decrypts and rotates the keys of SOPS encrypted files with age keys, honoring .sops.yaml.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"strings"
+)
+
+type Sops struct {
+	// The version of sops (ex: v3.8.1)
+	// +private
+	Version string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Sops module pinned to the provided sops version
+func New(
+	// The version of sops
+	// +optional
+	// +default="v3.8.1"
+	version string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Sops {
+	return &Sops{
+		Version:      version,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// base returns a sops container, with the age key mounted when provided
+func (m *Sops) base(ageKey *Secret) *Container {
+	c := m.withProxy(dag.Container().From("ghcr.io/getsops/sops:" + m.Version + "-alpine")).
+		WithWorkdir("/workspace")
+
+	if ageKey != nil {
+		c = c.
+			WithMountedSecret("/tmp/age.key", ageKey).
+			WithEnvVariable("SOPS_AGE_KEY_FILE", "/tmp/age.key")
+	}
+
+	return c
+}
+
+// Decrypt decrypts a SOPS encrypted file. The file format is inferred from its extension.
+//
+// Example usage: dagger call decrypt --file=./clusters/dev/secrets.enc.yaml --age-key=file:$HOME/.config/sops/age/keys.txt export --path=secrets.yaml
+func (m *Sops) Decrypt(
+	ctx context.Context,
+	// The encrypted file
+	// +required
+	file *File,
+	// age private key able to decrypt the file
+	// +required
+	ageKey *Secret,
+) (result *File, err error) {
+	s := m.startSpan(ctx, "Decrypt")
+	defer s.End(&err)
+
+	name, err := file.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file name: %w", err)
+	}
+
+	out, err := m.base(ageKey).
+		WithFile("/workspace/"+name, file).
+		WithExec([]string{"sops", "--decrypt", name}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, commandError(err))
+	}
+
+	return dag.Directory().WithNewFile(name, out).File(name), nil
+}
+
+// Encrypt encrypts a file with the creation rule of config matching its path, or with the provided age recipients.
+//
+// Example usage: dagger call encrypt --file=./secrets.yaml --config=./.sops.yaml --filename=clusters/dev/secrets.enc.yaml export --path=clusters/dev/secrets.enc.yaml
+func (m *Sops) Encrypt(
+	ctx context.Context,
+	// The plain file
+	// +required
+	file *File,
+	// The .sops.yaml configuration holding the creation rules
+	// +optional
+	config *File,
+	// Path of the file in the repository, matched against the path_regex of the creation rules. Defaults to the file name
+	// +optional
+	filename string,
+	// Comma separated age recipients, overriding the creation rules
+	// +optional
+	ageRecipients string,
+	// Regular expression of the keys to encrypt, overriding the creation rules (ex: ^(data|stringData)$)
+	// +optional
+	encryptedRegex string,
+) (result *File, err error) {
+	s := m.startSpan(ctx, "Encrypt")
+	defer s.End(&err)
+
+	if config == nil && ageRecipients == "" {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("either config or ageRecipients is required"),
+			Hint: "set the .sops.yaml config, or the age recipients",
+		}
+	}
+
+	if filename == "" {
+		name, err := file.Name(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file name: %w", err)
+		}
+		filename = name
+	}
+	filename = strings.TrimPrefix(filename, "/")
+
+	c := m.base(nil).WithFile("/workspace/"+filename, file)
+	if config != nil {
+		c = c.WithFile("/workspace/.sops.yaml", config)
+	}
+
+	args := []string{"sops", "--encrypt"}
+	if ageRecipients != "" {
+		args = append(args, "--age", ageRecipients)
+	}
+	if encryptedRegex != "" {
+		args = append(args, "--encrypted-regex", encryptedRegex)
+	}
+	args = append(args, filename)
+
+	out, err := c.
+		WithExec(args, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s: %w", filename, commandError(err))
+	}
+
+	name := path.Base(filename)
+
+	return dag.Directory().WithNewFile(name, out).File(name), nil
+}
+
+// UpdateKeys re-encrypts the data key of every SOPS encrypted file of dir for the recipients of its .sops.yaml creation rule,
+// and optionally rotates the data keys. Returns dir with the updated files.
+//
+// Example usage: dagger call update-keys --dir=. --age-key=file:$HOME/.config/sops/age/keys.txt --rotate export --path=.
+func (m *Sops) UpdateKeys(
+	ctx context.Context,
+	// Directory holding the .sops.yaml configuration and the encrypted files, usually the repository root
+	// +required
+	dir *Directory,
+	// age private key able to decrypt the files
+	// +required
+	ageKey *Secret,
+	// Also rotate the data keys, re-encrypting the values
+	// +optional
+	rotate bool,
+) *Directory {
+	s := m.startSpan(ctx, "UpdateKeys")
+	defer s.End(nil)
+
+	script := `find . -path ./.git -prune -o -type f ! -name .sops.yaml -print | while read -r f; do
+  grep -qE '^sops:|"sops": *\{|^sops_mac=|^\[sops\]' "$f" || continue
+  echo "updating $f"
+  sops updatekeys --yes "$f"`
+	if rotate {
+		script += `
+  sops --rotate --in-place "$f"`
+	}
+	script += `
+done`
+
+	return m.base(ageKey).
+		WithDirectory("/workspace", dir).
+		WithExec([]string{"sh", "-ec", script}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/workspace")
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Sops) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the trivy config commands from their output
+var commandFailures = typederr.Command{
+	AuthHint:       "check the credentials of the private module registries",
+	ValidationHint: "check the root modules and the trivy options",
+}
+
+// commandError types the error of a trivy config command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,351 @@
+// This module scans Terraform root modules for security misconfigurations with trivy config, the successor of tfsec.
+//
+// Modules are resolved with terraform init and variables read from the variable files, so findings reflect the
+// effective configuration. Findings are mapped to the file and lines of the resources, and gate terraform plan
+// pipelines on their own severity threshold, apart from the generic IaC scanners.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/severity"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"strings"
+)
+
+// severities are Trivy severities, from the most to the least severe
+var severities = severity.Scale{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+type TerraformSecurity struct {
+	// The Terraform sources
+	// +private
+	Source *Directory
+	// The directory of the root module, relative to the sources
+	// +private
+	Workdir string
+	// Variable files, relative to the root module
+	// +private
+	VarFiles []string
+	// Severity at or above which a scan fails (ex: HIGH), empty to never fail
+	// +private
+	FailOn string
+	// The version of Trivy (ex: 0.50.1)
+	// +private
+	TrivyVersion string
+	// The version of Terraform resolving the modules (ex: 1.7.5)
+	// +private
+	TerraformVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new TerraformSecurity module for the root module in the provided sources
+func New(
+	// The Terraform sources, usually the repository root so that local modules resolve
+	// +required
+	source *Directory,
+	// The directory of the root module, relative to source
+	// +optional
+	// +default="."
+	workdir string,
+	// Variable files evaluated by the scan, relative to the root module (ex: env/prod.tfvars)
+	// +optional
+	varFiles []string,
+	// Severity at or above which a scan fails: CRITICAL, HIGH, MEDIUM, LOW or UNKNOWN. Empty to never fail.
+	// +optional
+	// +default="HIGH"
+	failOn string,
+	// The version of Trivy
+	// +optional
+	// +default="0.50.1"
+	trivyVersion string,
+	// The version of Terraform resolving the modules
+	// +optional
+	// +default="1.7.5"
+	terraformVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*TerraformSecurity, error) {
+	failOn = strings.ToUpper(failOn)
+	if failOn != "" && severities.Rank(failOn) < 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid severity %q, expected one of %s", failOn, strings.Join(severities, ", ")),
+			Hint: "use one of the expected severities",
+		}
+	}
+
+	return &TerraformSecurity{
+		Source:           source,
+		Workdir:          strings.Trim(workdir, "/"),
+		VarFiles:         varFiles,
+		FailOn:           failOn,
+		TrivyVersion:     trivyVersion,
+		TerraformVersion: terraformVersion,
+		ProxyURL:         proxyUrl,
+		NoProxy:          noProxy,
+		CABundle:         caBundle,
+		OtlpEndpoint:     otlpEndpoint,
+		OtlpHeaders:      otlpHeaders,
+		Traceparent:      traceparent,
+	}, nil
+}
+
+type ScanResult struct {
+	// Whether no finding reaches the fail threshold
+	Passed   bool
+	Findings []*Finding
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	Unknown  int
+	// Trivy JSON report
+	Report *File
+	// SARIF report, suitable for GitHub code scanning
+	Sarif *File
+	// +private
+	FailOn string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Finding struct {
+	// ID of the check (ex: AVD-AWS-0086)
+	ID       string
+	Severity string
+	Title    string
+	// What failed, on the resource
+	Message    string
+	Resolution string
+	// File of the resource relative to the sources, or the plan for plan scans
+	File      string
+	StartLine int
+	EndLine   int
+	// Address of the resource (ex: aws_s3_bucket.artifacts)
+	Resource string
+	// Documentation of the check
+	URL string
+}
+
+type trivyReport struct {
+	Results []struct {
+		Target            string `json:"Target"`
+		Misconfigurations []struct {
+			ID            string `json:"ID"`
+			Title         string `json:"Title"`
+			Message       string `json:"Message"`
+			Resolution    string `json:"Resolution"`
+			Severity      string `json:"Severity"`
+			PrimaryURL    string `json:"PrimaryURL"`
+			Status        string `json:"Status"`
+			CauseMetadata struct {
+				Resource  string `json:"Resource"`
+				StartLine int    `json:"StartLine"`
+				EndLine   int    `json:"EndLine"`
+			} `json:"CauseMetadata"`
+		} `json:"Misconfigurations"`
+	} `json:"Results"`
+}
+
+// trivy returns a container with the pinned Trivy CLI and a persistent checks cache
+func (m *TerraformSecurity) trivy() *Container {
+	return m.withProxy(dag.Container().From("aquasec/trivy:"+m.TrivyVersion)).
+		WithMountedCache("/root/.cache/trivy", dag.CacheVolume("trivy-cache"))
+}
+
+// Scan scans the root module with its resolved modules and variable files. Findings in remote modules are only
+// reported when includeRemoteModules is set, as they are fixed upstream.
+//
+// Example usage: dagger call --source=. --workdir=stacks/network --var-files=env/prod.tfvars scan check
+func (m *TerraformSecurity) Scan(
+	ctx context.Context,
+	// Report the findings of the modules downloaded from registries and git
+	// +optional
+	includeRemoteModules bool,
+) (result *ScanResult, err error) {
+	s := m.startSpan(ctx, "Scan")
+	defer s.End(&err)
+
+	// terraform init downloads the remote modules in .terraform/modules, where trivy resolves them
+	resolved := m.withProxy(dag.Container().From("hashicorp/terraform:"+m.TerraformVersion)).
+		WithDirectory("/workspace", m.Source).
+		WithWorkdir(path.Join("/workspace", m.Workdir)).
+		WithExec(
+			[]string{"terraform", "init", "-input=false", "-backend=false", "-get=true"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Directory("/workspace")
+
+	args := []string{"trivy", "config", "--misconfig-scanners", "terraform"}
+	for _, f := range m.VarFiles {
+		args = append(args, "--tf-vars", f)
+	}
+	if !includeRemoteModules {
+		args = append(args, "--tf-exclude-downloaded-modules")
+	}
+	c := m.trivy().
+		WithDirectory("/workspace", resolved).
+		WithWorkdir(path.Join("/workspace", m.Workdir))
+
+	return m.scan(ctx, c, args, ".", m.Workdir)
+}
+
+// ScanPlan scans a plan in JSON (terraform show -json), which holds the values known once planned, such as the
+// attributes computed from data sources. Findings refer to the resources of the plan.
+//
+// Example usage: dagger call --source=. scan-plan --plan=./tfplan.json check
+func (m *TerraformSecurity) ScanPlan(
+	ctx context.Context,
+	// Plan in JSON, from terraform show -json
+	// +required
+	plan *File,
+) (result *ScanResult, err error) {
+	s := m.startSpan(ctx, "ScanPlan")
+	defer s.End(&err)
+
+	c := m.trivy().
+		WithMountedFile("/workspace/tfplan.json", plan).
+		WithWorkdir("/workspace")
+
+	return m.scan(ctx, c, []string{"trivy", "config"}, "tfplan.json", "")
+}
+
+// scan runs the trivy config scan of the target, converts its JSON report to SARIF, and maps the failed checks to the
+// files of the sources under prefix
+func (m *TerraformSecurity) scan(ctx context.Context, c *Container, args []string, target, prefix string) (*ScanResult, error) {
+	c = c.
+		WithExec(
+			append(args, "--format", "json", "--output", "/tmp/report.json", target),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithExec(
+			[]string{"trivy", "convert", "--format", "sarif", "--output", "/tmp/report.sarif", "/tmp/report.json"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	report := c.File("/tmp/report.json")
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan: %w", commandError(err))
+	}
+
+	var parsed trivyReport
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trivy report: %w", err)
+	}
+
+	result := &ScanResult{
+		Findings:     []*Finding{},
+		Report:       report,
+		Sarif:        c.File("/tmp/report.sarif"),
+		FailOn:       m.FailOn,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	counts := map[string]int{}
+	for _, r := range parsed.Results {
+		for _, mc := range r.Misconfigurations {
+			if mc.Status != "FAIL" {
+				continue
+			}
+			counts[mc.Severity]++
+			result.Findings = append(result.Findings, &Finding{
+				ID:         mc.ID,
+				Severity:   mc.Severity,
+				Title:      mc.Title,
+				Message:    mc.Message,
+				Resolution: mc.Resolution,
+				File:       path.Join(prefix, r.Target),
+				StartLine:  mc.CauseMetadata.StartLine,
+				EndLine:    mc.CauseMetadata.EndLine,
+				Resource:   mc.CauseMetadata.Resource,
+				URL:        mc.PrimaryURL,
+			})
+		}
+	}
+
+	result.Passed = true
+	if m.FailOn != "" {
+		for _, severity := range severities[:severities.Rank(m.FailOn)+1] {
+			if counts[severity] > 0 {
+				result.Passed = false
+			}
+		}
+	}
+	result.Critical = counts["CRITICAL"]
+	result.High = counts["HIGH"]
+	result.Medium = counts["MEDIUM"]
+	result.Low = counts["LOW"]
+	result.Unknown = counts["UNKNOWN"]
+
+	return result, nil
+}
+
+// Check fails when a finding reaches the fail threshold, listing the findings at or above it, and returns the
+// severity counts otherwise
+func (r *ScanResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	summary := fmt.Sprintf("critical=%d high=%d medium=%d low=%d unknown=%d", r.Critical, r.High, r.Medium, r.Low, r.Unknown)
+	if !r.Passed {
+		lines := []string{}
+		for _, f := range r.Findings {
+			if severities.Rank(f.Severity) <= severities.Rank(r.FailOn) {
+				lines = append(lines, fmt.Sprintf("%s:%d: %s %s %s (%s)", f.File, f.StartLine, f.Severity, f.ID, f.Message, f.Resource))
+			}
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("findings at or above %s: %s\n%s", r.FailOn, summary, strings.Join(lines, "\n")),
+			Hint: "fix the misconfigurations or ignore them with trivy:ignore comments",
+		}
+	}
+
+	return summary, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *TerraformSecurity) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
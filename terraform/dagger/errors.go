@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the terraform commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"error: invalid", "error: unsupported argument", "error: missing required argument", "error: reference to undeclared"},
+	AuthHint:       "check the cloud credentials and the state backend permissions",
+	ConflictHint:   "another run holds the state lock, run it again once it completes or force-unlock a stale lock",
+	ValidationHint: "fix the configuration reported by terraform",
+}
+
+// commandError types the error of a terraform command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
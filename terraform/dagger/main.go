@@ -0,0 +1,285 @@
+// This module formats, validates, plans and applies Terraform configurations with remote state.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+type Terraform struct {
+	// The version of Terraform (ex: 1.7.5)
+	// +private
+	Version string
+	// The Terraform sources
+	// +private
+	Source *Directory
+	// The directory of the root module, relative to the sources
+	// +private
+	Workdir string
+	// Backend configuration file passed to terraform init
+	// +private
+	BackendConfig *Secret
+	// Dotenv file with the provider and backend credentials
+	// +private
+	Credentials *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Terraform module for the root module in the provided sources
+func New(
+	// The Terraform sources, usually the repository root so that local modules resolve
+	// +required
+	source *Directory,
+	// The directory of the root module, relative to source
+	// +optional
+	// +default="."
+	workdir string,
+	// The version of Terraform
+	// +optional
+	// +default="1.7.5"
+	version string,
+	// Backend configuration file (ex: bucket, key and region of the S3 backend)
+	// +optional
+	backendConfig *Secret,
+	// Dotenv file with the provider and backend credentials (ex: AWS_ACCESS_KEY_ID=...), exported before each command
+	// +optional
+	credentials *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Terraform {
+	return &Terraform{
+		Version:       version,
+		Source:        source,
+		Workdir:       workdir,
+		BackendConfig: backendConfig,
+		Credentials:   credentials,
+		ProxyURL:      proxyUrl,
+		NoProxy:       noProxy,
+		CABundle:      caBundle,
+		OtlpEndpoint:  otlpEndpoint,
+		OtlpHeaders:   otlpHeaders,
+		Traceparent:   traceparent,
+	}
+}
+
+type PlanResult struct {
+	// Binary plan, to be passed to apply
+	Plan *File
+	// Human readable plan (terraform show)
+	Summary string
+	// Whether the plan contains changes
+	HasChanges bool
+}
+
+// base returns a container with the pinned Terraform CLI, the sources, the secrets and a shared plugin cache
+func (m *Terraform) base() *Container {
+	c := m.withProxy(dag.Container().From("hashicorp/terraform:"+m.Version)).
+		WithMountedCache("/root/.terraform.d/plugin-cache", dag.CacheVolume("terraform-plugins")).
+		WithEnvVariable("TF_PLUGIN_CACHE_DIR", "/root/.terraform.d/plugin-cache").
+		WithEnvVariable("TF_IN_AUTOMATION", "true").
+		WithDirectory("/workspace", m.Source).
+		WithWorkdir("/workspace/" + strings.TrimPrefix(m.Workdir, "/"))
+
+	if m.BackendConfig != nil {
+		c = c.WithMountedSecret("/secrets/backend.hcl", m.BackendConfig)
+	}
+	if m.Credentials != nil {
+		c = c.WithMountedSecret("/secrets/credentials.env", m.Credentials)
+	}
+
+	return c
+}
+
+// withInit runs terraform init, against the remote backend unless backend is false.
+// The remote state changes outside of Dagger, so commands using it are never cached.
+func (m *Terraform) withInit(c *Container, backend bool) *Container {
+	args := []string{"terraform", "init", "-input=false"}
+	if !backend {
+		args = append(args, "-backend=false")
+	} else {
+		c = c.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+		if m.BackendConfig != nil {
+			args = append(args, "-backend-config=/secrets/backend.hcl")
+		}
+	}
+
+	return c.WithExec(sh(args...), ContainerWithExecOpts{SkipEntrypoint: true})
+}
+
+// Fmt checks the formatting of the sources and returns the diff of the files to reformat.
+//
+// Example usage: dagger call --source=. fmt
+func (m *Terraform) Fmt(ctx context.Context) (result string, err error) {
+	s := m.startSpan(ctx, "Fmt")
+	defer s.End(&err)
+
+	out, err := m.base().
+		WithExec(sh("terraform", "fmt", "-check", "-recursive", "-diff"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("terraform fmt found unformatted files: %w", err),
+			Hint: "run terraform fmt on the reported files",
+		}
+	}
+
+	return out, nil
+}
+
+// Validate checks the configuration is valid, without accessing the remote state.
+//
+// Example usage: dagger call --source=. --workdir=stacks/network validate
+func (m *Terraform) Validate(ctx context.Context) (result string, err error) {
+	s := m.startSpan(ctx, "Validate")
+	defer s.End(&err)
+
+	out, err := m.withInit(m.base(), false).
+		WithExec(sh("terraform", "validate", "-no-color"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("terraform validate failed: %w", err),
+			Hint: "fix the configuration reported by terraform validate",
+		}
+	}
+
+	return out, nil
+}
+
+// Plan computes the changes against the remote state, returning the binary plan and its human readable summary.
+//
+// Example usage: dagger call --source=. --backend-config=file:./backend.hcl --credentials=file:./.env plan summary
+func (m *Terraform) Plan(
+	ctx context.Context,
+	// Input variables (ex: env=prod)
+	// +optional
+	vars []string,
+	// Variable files, relative to the root module
+	// +optional
+	varFiles []string,
+	// Plan the destruction of every resource
+	// +optional
+	destroy bool,
+) (result *PlanResult, err error) {
+	s := m.startSpan(ctx, "Plan")
+	defer s.End(&err)
+
+	args := []string{"terraform", "plan", "-input=false", "-no-color", "-out=/tmp/tfplan"}
+	for _, v := range vars {
+		args = append(args, "-var", v)
+	}
+	for _, f := range varFiles {
+		args = append(args, "-var-file", f)
+	}
+	if destroy {
+		args = append(args, "-destroy")
+	}
+
+	c := m.withInit(m.base(), true).
+		WithExec(sh(args...), ContainerWithExecOpts{SkipEntrypoint: true})
+
+	summary, err := c.
+		WithExec(sh("terraform", "show", "-no-color", "/tmp/tfplan"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("terraform plan failed: %w", commandError(err))
+	}
+
+	return &PlanResult{
+		Plan:       c.File("/tmp/tfplan"),
+		Summary:    summary,
+		HasChanges: !strings.Contains(summary, "No changes."),
+	}, nil
+}
+
+// Apply applies a plan created by plan. The approve flag must be set explicitly, so that a pipeline cannot apply by mistake.
+//
+// Example usage: dagger call --source=. --backend-config=file:./backend.hcl --credentials=file:./.env apply --plan=./tfplan --approve
+func (m *Terraform) Apply(
+	ctx context.Context,
+	// Binary plan created by plan, from the same sources
+	// +required
+	plan *File,
+	// Explicit approval of the plan
+	// +optional
+	approve bool,
+) (result string, err error) {
+	s := m.startSpan(ctx, "Apply")
+	defer s.End(&err)
+
+	if !approve {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("refusing to apply without explicit approval, set --approve once the plan has been reviewed"),
+			Hint: "set approve once the plan is reviewed",
+		}
+	}
+
+	out, err := m.withInit(m.base(), true).
+		WithFile("/tmp/tfplan", plan).
+		WithExec(sh("terraform", "apply", "-input=false", "-no-color", "/tmp/tfplan"), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("terraform apply failed: %w", commandError(err))
+	}
+
+	return out, nil
+}
+
+// sh wraps a command so that it runs with the credentials dotenv file exported, when mounted
+func sh(args ...string) []string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shell.Quote(a)
+	}
+
+	return []string{"sh", "-c", strings.Join([]string{
+		"set -a;",
+		"[ -f /secrets/credentials.env ] && . /secrets/credentials.env;",
+		"set +a;",
+		"exec", strings.Join(quoted, " "),
+	}, " ")}
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Terraform) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,434 @@
+// This module runs terragrunt run-all plan and apply across a live directory hierarchy and reports the result of each stack.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/shell"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Terragrunt struct {
+	// The version of Terraform (ex: 1.7.5)
+	// +private
+	TerraformVersion string
+	// The version of terragrunt (ex: v0.55.18)
+	// +private
+	Version string
+	// The live sources, including the terragrunt.hcl root configuration
+	// +private
+	Source *Directory
+	// Dotenv file with the provider and backend credentials
+	// +private
+	Credentials *Secret
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Terragrunt module for the provided live sources
+func New(
+	// The live sources, usually the repository root
+	// +required
+	source *Directory,
+	// The version of terragrunt
+	// +optional
+	// +default="v0.55.18"
+	version string,
+	// The version of Terraform
+	// +optional
+	// +default="1.7.5"
+	terraformVersion string,
+	// Dotenv file with the provider and backend credentials (ex: AWS_ACCESS_KEY_ID=...), exported before each command
+	// +optional
+	credentials *Secret,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Terragrunt {
+	return &Terragrunt{
+		TerraformVersion: terraformVersion,
+		Version:          version,
+		Source:           source,
+		Credentials:      credentials,
+		ProxyURL:         proxyUrl,
+		NoProxy:          noProxy,
+		CABundle:         caBundle,
+		OtlpEndpoint:     otlpEndpoint,
+		OtlpHeaders:      otlpHeaders,
+		Traceparent:      traceparent,
+	}
+}
+
+type RunAllResult struct {
+	// Command run across the stacks (plan or apply)
+	Command string
+	// Result of each stack, in dependency order
+	Stacks []*StackResult
+	// JSON report of the stacks
+	Report *File
+	// Full terragrunt output
+	Output string
+	// Whether every stack succeeded
+	Passed bool
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type StackResult struct {
+	// Path of the stack, relative to the sources
+	Path string `json:"path"`
+	// Dependency group, stacks of a group run in parallel once the previous groups are done
+	Group int `json:"group"`
+	// Status of the stack: changes, unchanged, applied or failed
+	Status string `json:"status"`
+	// Plan summary line (ex: Plan: 1 to add, 0 to change, 0 to destroy.)
+	Summary string `json:"summary"`
+}
+
+// runAllOpts holds the stack selection and ordering controls shared by plan and apply
+type runAllOpts struct {
+	workdir                    string
+	parallelism                int
+	includeDirs                []string
+	excludeDirs                []string
+	ignoreExternalDependencies bool
+}
+
+var planSummaryRe = regexp.MustCompile(`(?m)^(Plan: .*|No changes\..*)$`)
+
+// base returns a container with the pinned Terraform and terragrunt binaries, the sources, the credentials and a shared plugin cache
+func (m *Terragrunt) base(ctx context.Context, workdir string) (*Container, error) {
+	platform, err := dag.DefaultPlatform(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default platform: %w", err)
+	}
+	arch := path.Base(string(platform))
+
+	url := fmt.Sprintf(
+		"https://github.com/gruntwork-io/terragrunt/releases/download/%s/terragrunt_linux_%s",
+		m.Version, arch,
+	)
+
+	c := m.withProxy(dag.Container().From("hashicorp/terraform:"+m.TerraformVersion)).
+		WithFile("/usr/local/bin/terragrunt", dag.HTTP(url), ContainerWithFileOpts{Permissions: 0755}).
+		WithMountedCache("/root/.terraform.d/plugin-cache", dag.CacheVolume("terraform-plugins")).
+		WithEnvVariable("TF_PLUGIN_CACHE_DIR", "/root/.terraform.d/plugin-cache").
+		WithEnvVariable("TF_IN_AUTOMATION", "true").
+		WithEnvVariable("TERRAGRUNT_NON_INTERACTIVE", "true").
+		WithDirectory("/workspace", m.Source).
+		WithWorkdir(path.Join("/workspace", workdir))
+
+	if m.Credentials != nil {
+		c = c.WithMountedSecret("/secrets/credentials.env", m.Credentials)
+	}
+
+	return c, nil
+}
+
+// Plan runs terragrunt run-all plan and returns the plan summary of each stack.
+//
+// Example usage: dagger call --source=. --credentials=file:./.env plan --workdir=live/prod --parallelism=4 stacks
+func (m *Terragrunt) Plan(
+	ctx context.Context,
+	// Directory of the hierarchy to plan, relative to the sources
+	// +optional
+	// +default="."
+	workdir string,
+	// Maximum number of stacks run in parallel, 0 for no limit
+	// +optional
+	parallelism int,
+	// Only run the stacks in these directories (glob patterns, relative to workdir)
+	// +optional
+	includeDirs []string,
+	// Skip the stacks in these directories (glob patterns, relative to workdir)
+	// +optional
+	excludeDirs []string,
+	// Do not run the dependencies located outside of workdir
+	// +optional
+	ignoreExternalDependencies bool,
+) (result *RunAllResult, err error) {
+	s := m.startSpan(ctx, "Plan")
+	defer s.End(&err)
+
+	return m.runAll(ctx, "plan", runAllOpts{
+		workdir:                    workdir,
+		parallelism:                parallelism,
+		includeDirs:                includeDirs,
+		excludeDirs:                excludeDirs,
+		ignoreExternalDependencies: ignoreExternalDependencies,
+	})
+}
+
+// Apply runs terragrunt run-all apply in dependency order. The approve flag must be set explicitly, so that a pipeline cannot apply by mistake.
+//
+// Example usage: dagger call --source=. --credentials=file:./.env apply --workdir=live/prod --approve report export --path=apply.json
+func (m *Terragrunt) Apply(
+	ctx context.Context,
+	// Directory of the hierarchy to apply, relative to the sources
+	// +optional
+	// +default="."
+	workdir string,
+	// Maximum number of stacks run in parallel, 0 for no limit
+	// +optional
+	parallelism int,
+	// Only run the stacks in these directories (glob patterns, relative to workdir)
+	// +optional
+	includeDirs []string,
+	// Skip the stacks in these directories (glob patterns, relative to workdir)
+	// +optional
+	excludeDirs []string,
+	// Do not run the dependencies located outside of workdir
+	// +optional
+	ignoreExternalDependencies bool,
+	// Explicit approval of the changes
+	// +optional
+	approve bool,
+) (result *RunAllResult, err error) {
+	s := m.startSpan(ctx, "Apply")
+	defer s.End(&err)
+
+	if !approve {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("refusing to apply without explicit approval, set --approve once the plan has been reviewed"),
+			Hint: "set approve once the plans are reviewed",
+		}
+	}
+
+	return m.runAll(ctx, "apply", runAllOpts{
+		workdir:                    workdir,
+		parallelism:                parallelism,
+		includeDirs:                includeDirs,
+		excludeDirs:                excludeDirs,
+		ignoreExternalDependencies: ignoreExternalDependencies,
+	})
+}
+
+// Check fails when a stack failed, and returns the status of each stack otherwise
+func (r *RunAllResult) Check(ctx context.Context) (out string, err error) {
+	span := r.startSpan(ctx, "Check")
+	defer span.End(&err)
+
+	var lines []string
+	for _, s := range r.Stacks {
+		lines = append(lines, fmt.Sprintf("%s: %s %s", s.Path, s.Status, s.Summary))
+	}
+	summary := strings.Join(lines, "\n")
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("terragrunt run-all %s failed:\n%s", r.Command, summary),
+			Hint: "fix the failing stacks",
+		}
+	}
+
+	return summary, nil
+}
+
+// runAll runs the command across the stacks and builds the per-stack result.
+// The remote state changes outside of Dagger, so the run is never cached.
+func (m *Terragrunt) runAll(ctx context.Context, command string, opts runAllOpts) (*RunAllResult, error) {
+	c, err := m.base(ctx, opts.workdir)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags []string
+	if opts.parallelism > 0 {
+		flags = append(flags, "--terragrunt-parallelism", strconv.Itoa(opts.parallelism))
+	}
+	for _, d := range opts.includeDirs {
+		flags = append(flags, "--terragrunt-include-dir", d)
+	}
+	for _, d := range opts.excludeDirs {
+		flags = append(flags, "--terragrunt-exclude-dir", d)
+	}
+	if opts.ignoreExternalDependencies {
+		flags = append(flags, "--terragrunt-ignore-external-dependencies")
+	}
+
+	groupsOut, err := c.
+		WithExec(sh(append([]string{"terragrunt", "output-module-groups"}, flags...)...), ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list terragrunt stacks: %w", commandError(err))
+	}
+	stacks, err := parseGroups(groupsOut)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"terragrunt", "run-all", command}
+	args = append(args, flags...)
+	args = append(args, "-input=false", "-no-color")
+	if command == "plan" {
+		args = append(args, "-out=tfplan")
+	} else {
+		args = append(args, "-auto-approve")
+	}
+
+	// Keep going on failure so that the stacks which did run are reported
+	c = c.
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec(
+			[]string{"sh", "-c", script(args...) + " > /tmp/run-all.log 2>&1; echo $? > /tmp/exit-code"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	output, err := c.File("/tmp/run-all.log").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terragrunt output: %w", commandError(err))
+	}
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terragrunt exit code: %w", commandError(err))
+	}
+
+	for _, s := range stacks {
+		switch {
+		case strings.Contains(output, "Module /workspace/"+s.Path+" has finished with an error"):
+			s.Status = "failed"
+		case command == "apply":
+			s.Status = "applied"
+		default:
+			show, err := c.
+				WithWorkdir(path.Join("/workspace", s.Path)).
+				WithExec(
+					[]string{"sh", "-c", script("terragrunt", "show", "-no-color", "tfplan") + " 2>/dev/null || true"},
+					ContainerWithExecOpts{SkipEntrypoint: true},
+				).
+				Stdout(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to show the plan of %s: %w", s.Path, commandError(err))
+			}
+			s.Summary = planSummaryRe.FindString(show)
+			switch {
+			case strings.HasPrefix(s.Summary, "Plan:"):
+				s.Status = "changes"
+			case s.Summary != "":
+				s.Status = "unchanged"
+			default:
+				s.Status = "failed"
+			}
+		}
+	}
+
+	passed := strings.TrimSpace(exitCode) == "0"
+	for _, s := range stacks {
+		if s.Status == "failed" {
+			passed = false
+		}
+	}
+
+	report, err := json.MarshalIndent(map[string]any{
+		"command": command,
+		"passed":  passed,
+		"stacks":  stacks,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return &RunAllResult{
+		Command:      command,
+		Stacks:       stacks,
+		Report:       dag.Directory().WithNewFile("report.json", string(report)).File("report.json"),
+		Output:       output,
+		Passed:       passed,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// parseGroups parses the output of terragrunt output-module-groups ({"Group 1": ["/workspace/..."]}) into stacks in dependency order
+func parseGroups(out string) ([]*StackResult, error) {
+	var groups map[string][]string
+	if err := json.Unmarshal([]byte(out), &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse terragrunt module groups: %w", err)
+	}
+
+	var stacks []*StackResult
+	for name, paths := range groups {
+		group, err := strconv.Atoi(strings.TrimPrefix(name, "Group "))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected terragrunt module group %q", name)
+		}
+		for _, p := range paths {
+			stacks = append(stacks, &StackResult{
+				Path:  strings.TrimPrefix(p, "/workspace/"),
+				Group: group,
+			})
+		}
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].Group != stacks[j].Group {
+			return stacks[i].Group < stacks[j].Group
+		}
+		return stacks[i].Path < stacks[j].Path
+	})
+
+	return stacks, nil
+}
+
+// sh wraps a command so that it runs with the credentials dotenv file exported, when mounted
+func sh(args ...string) []string {
+	return []string{"sh", "-c", script(args...)}
+}
+
+// script returns the shell script running the quoted command with the credentials dotenv file exported
+func script(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shell.Quote(a)
+	}
+
+	return "set -a; [ -f /secrets/credentials.env ] && . /secrets/credentials.env; set +a; " + strings.Join(quoted, " ")
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Terragrunt) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
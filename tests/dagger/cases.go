@@ -0,0 +1,95 @@
+package main
+
+// testCase is a dagger call of a sibling module. Its arguments may reference:
+//   - {fixtures}: the fixtures directory, with the committed fixture repository in {fixtures}/repo
+//   - {proxy}: the URL of the proxy replaying the recorded API responses
+//   - {ca}: the CA bundle trusted to reach the replay proxy
+type testCase struct {
+	Name string
+	// Module directory, relative to the root of the daggerverse
+	Module string
+	// Arguments of dagger call
+	Args string
+	// Substring expected in the output
+	Expect string
+	// Whether the call is expected to fail
+	ExpectError bool
+}
+
+// cases are the end-to-end cases, grouped by module
+var cases = []testCase{
+	{
+		Name:   "defaults git identity",
+		Module: "common",
+		Args:   "defaults git-user-email",
+		Expect: "action@github.com",
+	},
+	{
+		Name:        "retry gives up after the attempts",
+		Module:      "common",
+		Args:        "retry --ctr=alpine:3.19 --args=false --attempts=2 --backoff=1s stdout",
+		Expect:      "attempt 1/2 failed",
+		ExpectError: true,
+	},
+	{
+		Name:   "classify a typed error",
+		Module: "common",
+		Args:   `classify --message="failed to get releases: unexpected status 429 (code: RATE_LIMITED, hint: retry later)" retryable`,
+		Expect: "true",
+	},
+	{
+		Name:   "run-git on the fixture repository",
+		Module: "gh",
+		Args:   `--token=env:GITHUB_TOKEN run-git --repo-dir={fixtures}/repo --cmd="rev-parse --abbrev-ref HEAD" stdout`,
+		Expect: "master",
+	},
+	{
+		Name:   "run-git reads the history",
+		Module: "gh",
+		Args:   `--token=env:GITHUB_TOKEN run-git --repo-dir={fixtures}/repo --cmd="log -1 --format=%s" stdout`,
+		Expect: "Initial fixture commit",
+	},
+	{
+		Name:   "local version of the ConfigMap",
+		Module: "istio",
+		Args:   "--config-map={fixtures}/istio/configmap.yaml --proxy-url={proxy} --ca-bundle={ca} local-version",
+		Expect: "1.20.3",
+	},
+	{
+		Name:   "latest version skips prereleases",
+		Module: "istio",
+		Args:   "--config-map={fixtures}/istio/configmap.yaml --proxy-url={proxy} --ca-bundle={ca} latest-version",
+		Expect: "1.21.1",
+	},
+	{
+		Name:   "latest version within the constraint",
+		Module: "istio",
+		Args:   "--config-map={fixtures}/istio/configmap.yaml --proxy-url={proxy} --ca-bundle={ca} --constraint=~1.20 latest-version",
+		Expect: "1.20.5",
+	},
+	{
+		Name:   "newer version available",
+		Module: "istio",
+		Args:   "--config-map={fixtures}/istio/configmap.yaml --proxy-url={proxy} --ca-bundle={ca} is-newer-version",
+		Expect: "true",
+	},
+	{
+		Name:        "invalid constraint is a validation error",
+		Module:      "istio",
+		Args:        "--config-map={fixtures}/istio/configmap.yaml --proxy-url={proxy} --ca-bundle={ca} --constraint=not-a-constraint latest-version",
+		Expect:      "(code: VALIDATION",
+		ExpectError: true,
+	},
+	{
+		Name:   "latest release of the tracked repository",
+		Module: "version-bumper",
+		Args:   "--owner=cert-manager --repo=cert-manager --manifest={fixtures}/cert-manager/helmrelease.yaml --key=spec.chart.spec.version --proxy-url={proxy} --ca-bundle={ca} latest-version",
+		Expect: "v1.14.4",
+	},
+	{
+		Name:   "updated manifest pins the latest release",
+		Module: "version-bumper",
+		Args:   "--owner=cert-manager --repo=cert-manager --manifest={fixtures}/cert-manager/helmrelease.yaml --key=spec.chart.spec.version --proxy-url={proxy} --ca-bundle={ca} return-updated-manifest",
+		Expect: "version: v1.14.4",
+	},
+}
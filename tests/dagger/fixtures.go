@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// fixtures returns the fixtures directory of the module, with the fixture repository committed and the CA of the
+// replay proxy
+func (m *Tests) fixtures(ca *Directory) *Directory {
+	fixtures := m.Source.Directory("tests/fixtures")
+
+	// Directories cannot hold a .git directory in the source tree, the fixture repository is committed here.
+	// Its origin remote names the GitHub repository for the gh module, which never reaches it.
+	repo := dag.Container().
+		From("alpine/git:2.43.0").
+		WithDirectory("/repo", fixtures.Directory("repo")).
+		WithWorkdir("/repo").
+		WithExec([]string{"sh", "-c", `git init -q -b master . && git add -A && ` +
+			`git -c user.email=tests@adore-me.com -c user.name=tests commit -q -m "Initial fixture commit" && ` +
+			`git remote add origin https://github.com/adore-me/fixture.git`,
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/repo")
+
+	return fixtures.
+		WithDirectory("repo", repo).
+		WithFile("ca.pem", ca.File("cert.pem"))
+}
+
+// ca returns a self-signed CA, as cert.pem and as mitmproxy-ca.pem bundling its key for the replay proxy
+func (m *Tests) ca() *Directory {
+	return dag.Container().
+		From("alpine:3.19").
+		WithExec([]string{"apk", "add", "--no-cache", "openssl"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithWorkdir("/ca").
+		WithExec([]string{"sh", "-c", `openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj "/CN=daggerverse tests" ` +
+			`-addext basicConstraints=critical,CA:TRUE -addext keyUsage=critical,keyCertSign,cRLSign ` +
+			`-keyout key.pem -out cert.pem && cat key.pem cert.pem > mitmproxy-ca.pem`,
+		}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		Directory("/ca")
+}
+
+// replay starts the proxy answering the API calls with the recorded responses, and returns its URL
+func (m *Tests) replay(ctx context.Context, ca *Directory) (string, error) {
+	svc := dag.Container().
+		From("mitmproxy/mitmproxy:"+m.MitmproxyVersion).
+		WithDirectory("/fixtures", m.Source.Directory("tests/fixtures")).
+		WithFile("/ca/mitmproxy-ca.pem", ca.File("mitmproxy-ca.pem")).
+		WithExposedPort(8080).
+		WithExec(
+			[]string{"mitmdump", "--listen-port", "8080", "--set", "confdir=/ca", "--scripts", "/fixtures/replay.py"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		AsService()
+
+	svc, err := svc.Start(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to start replay proxy: %w", err)
+	}
+	endpoint, err := svc.Endpoint(ctx, ServiceEndpointOpts{Scheme: "http"})
+	if err != nil {
+		return "", fmt.Errorf("failed to get replay proxy endpoint: %w", err)
+	}
+
+	return endpoint, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+type junitTestsuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Time     string            `xml:"time,attr"`
+	Suites   []*junitTestsuite `xml:"testsuite"`
+}
+
+type junitTestsuite struct {
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Cases    []*junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junit renders the results as a JUnit XML report, with a test suite per module
+func junit(results []*CaseResult) (string, error) {
+	report := &junitTestsuites{Name: "daggerverse"}
+	suites := map[string]*junitTestsuite{}
+	durations := map[string]time.Duration{}
+	var total time.Duration
+
+	for _, r := range results {
+		suite, ok := suites[r.Module]
+		if !ok {
+			suite = &junitTestsuite{Name: r.Module}
+			suites[r.Module] = suite
+			report.Suites = append(report.Suites, suite)
+		}
+
+		tc := &junitTestcase{
+			Name:      r.Name,
+			Classname: r.Module,
+			Time:      seconds(r.Duration),
+			SystemOut: r.Output,
+		}
+		if !r.Passed {
+			tc.Failure = &junitFailure{Message: r.Failure, Text: r.Command + "\n\n" + r.Output}
+			suite.Failures++
+			report.Failures++
+		}
+		suite.Cases = append(suite.Cases, tc)
+		suite.Tests++
+		report.Tests++
+		durations[r.Module] += r.Duration
+		total += r.Duration
+	}
+
+	for _, suite := range report.Suites {
+		suite.Time = seconds(durations[suite.Name])
+	}
+	report.Time = seconds(total)
+
+	out, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to render JUnit report: %w", err)
+	}
+
+	return xml.Header + string(out) + "\n", nil
+}
+
+// seconds formats the duration as JUnit expects it
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
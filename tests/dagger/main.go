@@ -0,0 +1,220 @@
+// This module tests the other modules of the daggerverse end-to-end, calling their public functions with the dagger
+// CLI against fixture repositories.
+//
+// GitHub API calls go through a proxy replaying the responses recorded in the fixtures, so the cases run offline and
+// always see the same releases. The results are reported as JUnit, for the CI test reports.
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sync/errgroup"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// outputLines is the number of lines of a case output kept in its result
+const outputLines = 30
+
+type Tests struct {
+	// +private
+	Source *Directory
+	// +private
+	DaggerVersion string
+	// +private
+	MitmproxyVersion string
+}
+
+// New creates a new Tests module for the daggerverse repository
+func New(
+	// Root of the daggerverse repository
+	// +required
+	source *Directory,
+	// Version of the dagger CLI calling the modules, which should match the engine
+	// +optional
+	// +default="v0.11.1"
+	daggerVersion string,
+	// Version of mitmproxy replaying the recorded API responses
+	// +optional
+	// +default="10.2.4"
+	mitmproxyVersion string,
+) *Tests {
+	return &Tests{
+		Source:           source,
+		DaggerVersion:    daggerVersion,
+		MitmproxyVersion: mitmproxyVersion,
+	}
+}
+
+type Suite struct {
+	// Whether every case passed
+	Passed bool
+	Cases  []*CaseResult
+	// JUnit XML report of the cases
+	Junit *File
+}
+
+type CaseResult struct {
+	Module string
+	Name   string
+	// dagger CLI command of the case
+	Command string
+	Passed  bool
+	// Why the case failed
+	Failure string
+	// Last lines of the output
+	Output   string
+	Duration time.Duration
+}
+
+// Run runs the cases of the modules in parallel, all of them by default
+//
+// Example usage: dagger call --source=. run --modules=gh,istio junit export --path=junit.xml
+func (m *Tests) Run(
+	ctx context.Context,
+	// Modules whose cases run, all when empty
+	// +optional
+	modules []string,
+	// Maximum number of cases running at once
+	// +optional
+	// +default=4
+	concurrency int,
+) (*Suite, error) {
+	suite := &Suite{Passed: true, Cases: []*CaseResult{}}
+	selected := []testCase{}
+	for _, c := range cases {
+		if len(modules) == 0 || slices.Contains(modules, c.Module) {
+			selected = append(selected, c)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no case for modules %s", strings.Join(modules, ", "))
+	}
+
+	ca := m.ca()
+	proxy, err := m.replay(ctx, ca)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := m.cli(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cli = cli.
+		WithDirectory("/fixtures", m.fixtures(ca)).
+		WithSecretVariable("GITHUB_TOKEN", dag.SetSecret("tests-github-token", "fixture-token"))
+
+	replacer := strings.NewReplacer("{fixtures}", "/fixtures", "{proxy}", proxy, "{ca}", "/fixtures/ca.pem")
+	for _, c := range selected {
+		suite.Cases = append(suite.Cases, &CaseResult{
+			Module:  c.Module,
+			Name:    c.Name,
+			Command: "dagger --progress=plain call -m ./" + c.Module + " " + replacer.Replace(c.Args),
+		})
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(concurrency, 1))
+	for i, r := range suite.Cases {
+		c, r := selected[i], r
+		g.Go(func() error {
+			return run(gctx, cli, c, r)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range suite.Cases {
+		if !r.Passed {
+			suite.Passed = false
+		}
+	}
+	report, err := junit(suite.Cases)
+	if err != nil {
+		return nil, err
+	}
+	suite.Junit = dag.Directory().WithNewFile("junit.xml", report).File("junit.xml")
+
+	return suite, nil
+}
+
+// cli returns a container with the pinned dagger CLI and the daggerverse mounted in /daggerverse
+func (m *Tests) cli(ctx context.Context) (*Container, error) {
+	platform, err := dag.DefaultPlatform(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default platform: %w", err)
+	}
+	arch := path.Base(string(platform))
+
+	url := fmt.Sprintf(
+		"https://dl.dagger.io/dagger/releases/%s/dagger_%s_linux_%s.tar.gz",
+		strings.TrimPrefix(m.DaggerVersion, "v"), m.DaggerVersion, arch,
+	)
+
+	return dag.Container().
+		From("alpine:3.19").
+		WithMountedFile("/tmp/dagger.tar.gz", dag.HTTP(url)).
+		WithExec(
+			[]string{"tar", "-xzf", "/tmp/dagger.tar.gz", "-C", "/usr/local/bin", "dagger"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithDirectory("/daggerverse", m.Source).
+		WithWorkdir("/daggerverse"), nil
+}
+
+// run runs the case with the dagger CLI connected to the current engine, and records its result
+func run(ctx context.Context, cli *Container, c testCase, r *CaseResult) error {
+	start := time.Now()
+
+	// The modules under test change with the source, only their own calls are cached
+	ctr := cli.
+		WithEnvVariable("CACHE_BUSTER", start.String()).
+		WithExec(
+			[]string{"sh", "-c", r.Command + " > /tmp/output 2>&1; echo $? > /tmp/exit-code"},
+			ContainerWithExecOpts{SkipEntrypoint: true, ExperimentalPrivilegedNesting: true},
+		)
+
+	exitCode, err := ctr.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to run case %s/%s: %w", c.Module, c.Name, err)
+	}
+	output, err := ctr.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read output of case %s/%s: %w", c.Module, c.Name, err)
+	}
+	r.Duration = time.Since(start)
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	r.Output = strings.Join(lines[max(len(lines)-outputLines, 0):], "\n")
+
+	failed := strings.TrimSpace(exitCode) != "0"
+	switch {
+	case failed && !c.ExpectError:
+		r.Failure = "exit code " + strings.TrimSpace(exitCode)
+	case !failed && c.ExpectError:
+		r.Failure = "expected the call to fail"
+	case !strings.Contains(output, c.Expect):
+		r.Failure = fmt.Sprintf("output does not contain %q", c.Expect)
+	default:
+		r.Passed = true
+	}
+
+	return nil
+}
+
+// Check fails when a case failed, with its output, and returns the number of cases otherwise
+func (s *Suite) Check() (string, error) {
+	if !s.Passed {
+		failures := []string{}
+		for _, r := range s.Cases {
+			if !r.Passed {
+				failures = append(failures, fmt.Sprintf("%s/%s: %s\n%s\n%s", r.Module, r.Name, r.Failure, r.Command, r.Output))
+			}
+		}
+		return "", fmt.Errorf("%d of %d cases failed:\n\n%s", len(failures), len(s.Cases), strings.Join(failures, "\n\n"))
+	}
+
+	return fmt.Sprintf("%d cases passed", len(s.Cases)), nil
+}
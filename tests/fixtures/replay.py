@@ -0,0 +1,19 @@
+# mitmproxy addon answering every request with its recorded response, so the cases never reach the real APIs.
+# The response of https://<host>/<path>?<query> is recorded in api/<host>/<path>.json, the query is ignored.
+import os
+
+from mitmproxy import http
+
+RECORDINGS = os.path.join(os.path.dirname(os.path.abspath(__file__)), "api")
+
+
+def request(flow: http.HTTPFlow) -> None:
+    path = os.path.normpath(os.path.join(RECORDINGS, flow.request.host, flow.request.path.split("?")[0].lstrip("/")))
+    if path.startswith(RECORDINGS) and os.path.isfile(path + ".json"):
+        with open(path + ".json", "rb") as f:
+            flow.response = http.Response.make(200, f.read(), {"Content-Type": "application/json"})
+        return
+
+    flow.response = http.Response.make(
+        404, b'{"message": "no recorded response for ' + flow.request.pretty_url.encode() + b'"}', {"Content-Type": "application/json"}
+    )
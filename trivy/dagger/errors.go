@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the trivy commands from their output
+var commandFailures = typederr.Command{
+	Invalid:        []string{"unable to find the specified image", "no such image"},
+	AuthHint:       "check the registry credentials of the scanned image",
+	ValidationHint: "check the image reference, the path and the scan options",
+}
+
+// commandError types the error of a trivy command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
@@ -0,0 +1,268 @@
+// This module scans container images and source directories for vulnerabilities with Trivy.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/severity"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"strings"
+	"time"
+)
+
+// severities are Trivy severities, from the most to the least severe
+var severities = severity.Scale{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+type Trivy struct {
+	// The version of Trivy (ex: 0.50.1)
+	// +private
+	Version string
+	// Severity at or above which a scan fails (ex: HIGH), empty to never fail
+	// +private
+	FailOn string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Trivy module pinned to the provided Trivy version
+func New(
+	// The version of Trivy
+	// +optional
+	// +default="0.50.1"
+	version string,
+	// Severity at or above which a scan fails: CRITICAL, HIGH, MEDIUM, LOW or UNKNOWN. Empty to never fail.
+	// +optional
+	// +default="CRITICAL"
+	failOn string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Trivy, error) {
+	failOn = strings.ToUpper(failOn)
+	if failOn != "" && severities.Rank(failOn) < 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid severity %q, expected one of %s", failOn, strings.Join(severities, ", ")),
+			Hint: "use one of the expected severities",
+		}
+	}
+
+	return &Trivy{
+		Version:      version,
+		FailOn:       failOn,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}, nil
+}
+
+type ScanResult struct {
+	// Trivy JSON report
+	Report *File
+	// SARIF report, suitable for GitHub code scanning
+	Sarif    *File
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	Unknown  int
+	// Whether no finding reaches the fail threshold
+	Passed bool
+	// +private
+	FailOn string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			Severity string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+		Misconfigurations []struct {
+			Severity string `json:"Severity"`
+		} `json:"Misconfigurations"`
+		Secrets []struct {
+			Severity string `json:"Severity"`
+		} `json:"Secrets"`
+	} `json:"Results"`
+}
+
+// base returns a container with the pinned Trivy CLI and a persistent vulnerability database cache
+func (m *Trivy) base() *Container {
+	return m.withProxy(dag.Container().From("aquasec/trivy:"+m.Version)).
+		WithMountedCache("/root/.cache/trivy", dag.CacheVolume("trivy-cache")).
+		// New vulnerabilities are published daily, rescan at least once a day
+		WithEnvVariable("CACHE_BUSTER", time.Now().Truncate(24*time.Hour).String())
+}
+
+// ScanImage scans a container image from a registry.
+//
+// Example usage: dagger call --fail-on=HIGH scan-image --ref=alpine:3.19 check
+func (m *Trivy) ScanImage(
+	ctx context.Context,
+	// Image reference (ex: ghcr.io/adore-me/app:1.2.3)
+	// +required
+	ref string,
+	// Registry username, for private images
+	// +optional
+	username string,
+	// Registry password or token, for private images
+	// +optional
+	password *Secret,
+) (result *ScanResult, err error) {
+	s := m.startSpan(ctx, "ScanImage")
+	defer s.End(&err)
+
+	c := m.base()
+	if password != nil {
+		c = c.
+			WithEnvVariable("TRIVY_USERNAME", username).
+			WithSecretVariable("TRIVY_PASSWORD", password)
+	}
+
+	return m.scan(ctx, c, []string{"image", ref})
+}
+
+// ScanDir scans a source directory for vulnerable dependencies, misconfigurations and secrets.
+//
+// Example usage: dagger call scan-dir --dir=. sarif export --path=trivy.sarif
+func (m *Trivy) ScanDir(
+	ctx context.Context,
+	// Directory to scan
+	// +required
+	dir *Directory,
+	// Scanners to enable
+	// +optional
+	// +default="vuln,misconfig,secret"
+	scanners string,
+) (result *ScanResult, err error) {
+	s := m.startSpan(ctx, "ScanDir")
+	defer s.End(&err)
+
+	c := m.base().WithDirectory("/workspace", dir)
+
+	return m.scan(ctx, c, []string{"filesystem", "--scanners", scanners, "/workspace"})
+}
+
+// scan runs a Trivy scan and converts its JSON report to SARIF and severity counts
+func (m *Trivy) scan(ctx context.Context, c *Container, args []string) (*ScanResult, error) {
+	c = c.
+		WithExec(
+			append(append([]string{"trivy"}, args...), "--format", "json", "--output", "/tmp/report.json"),
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		WithExec(
+			[]string{"trivy", "convert", "--format", "sarif", "--output", "/tmp/report.sarif", "/tmp/report.json"},
+			ContainerWithExecOpts{SkipEntrypoint: true},
+		)
+
+	report := c.File("/tmp/report.json")
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan: %w", commandError(err))
+	}
+
+	var parsed trivyReport
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trivy report: %w", err)
+	}
+
+	counts := map[string]int{}
+	for _, r := range parsed.Results {
+		for _, v := range r.Vulnerabilities {
+			counts[v.Severity]++
+		}
+		for _, v := range r.Misconfigurations {
+			counts[v.Severity]++
+		}
+		for _, v := range r.Secrets {
+			counts[v.Severity]++
+		}
+	}
+
+	passed := true
+	if m.FailOn != "" {
+		for _, severity := range severities[:severities.Rank(m.FailOn)+1] {
+			if counts[severity] > 0 {
+				passed = false
+			}
+		}
+	}
+
+	return &ScanResult{
+		Report:       report,
+		Sarif:        c.File("/tmp/report.sarif"),
+		Critical:     counts["CRITICAL"],
+		High:         counts["HIGH"],
+		Medium:       counts["MEDIUM"],
+		Low:          counts["LOW"],
+		Unknown:      counts["UNKNOWN"],
+		Passed:       passed,
+		FailOn:       m.FailOn,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}, nil
+}
+
+// Check fails when a finding reaches the fail threshold, and returns the severity counts otherwise
+func (r *ScanResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	summary := fmt.Sprintf("critical=%d high=%d medium=%d low=%d unknown=%d", r.Critical, r.High, r.Medium, r.Low, r.Unknown)
+	if !r.Passed {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("findings at or above %s: %s", r.FailOn, summary),
+			Hint: "fix the vulnerabilities or ignore them in .trivyignore",
+		}
+	}
+
+	return summary, nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *Trivy) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
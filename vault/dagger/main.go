@@ -0,0 +1,292 @@
+// This module authenticates to HashiCorp Vault and fetches secrets into pipelines as Dagger secrets, never exposing them as plain environment variables.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"text/template"
+)
+
+type Vault struct {
+	// The Vault address (ex: https://vault.example.com:8200)
+	// +private
+	Address string
+	// The Vault enterprise namespace
+	// +private
+	Namespace string
+	// CA bundle used to verify the Vault certificate
+	// +private
+	CABundle *File
+	// Token obtained from the auth method
+	// +private
+	Token *Secret
+	// Mount path of the KV secrets engine
+	// +private
+	KvMount string
+	// Version of the KV secrets engine (1 or 2)
+	// +private
+	KvVersion int
+	// HTTP(S) proxy URL of the Vault calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New authenticates to Vault with the provided auth method (approle, kubernetes, jwt or token)
+func New(
+	ctx context.Context,
+	// The Vault address (ex: https://vault.example.com:8200)
+	// +required
+	address string,
+	// The auth method: approle, kubernetes, jwt or token
+	// +optional
+	// +default="approle"
+	authMethod string,
+	// Mount path of the auth method, defaults to the auth method name
+	// +optional
+	authMount string,
+	// Role of the kubernetes and jwt auth methods
+	// +optional
+	role string,
+	// Role ID of the approle auth method
+	// +optional
+	roleId string,
+	// Secret ID of the approle auth method
+	// +optional
+	secretId *Secret,
+	// JWT of the kubernetes (service account token) and jwt (ex: CI OIDC token) auth methods
+	// +optional
+	jwt *Secret,
+	// Token of the token auth method
+	// +optional
+	token *Secret,
+	// The Vault enterprise namespace
+	// +optional
+	namespace string,
+	// CA bundle used to verify the Vault certificate
+	// +optional
+	caBundle *File,
+	// Mount path of the KV secrets engine
+	// +optional
+	// +default="secret"
+	kvMount string,
+	// Version of the KV secrets engine (1 or 2)
+	// +optional
+	// +default=2
+	kvVersion int,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Vault, error) {
+	m := &Vault{
+		Address:      address,
+		Namespace:    namespace,
+		CABundle:     caBundle,
+		KvMount:      kvMount,
+		KvVersion:    kvVersion,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+
+	if authMount == "" {
+		authMount = authMethod
+	}
+
+	var (
+		body map[string]string
+		err  error
+	)
+	switch authMethod {
+	case "token":
+		if token == nil {
+			return nil, &typederr.AuthError{
+				Err:  fmt.Errorf("the token auth method requires a token"),
+				Hint: "set the token of the token auth method",
+			}
+		}
+		m.Token = token
+		return m, nil
+	case "approle":
+		if roleId == "" || secretId == nil {
+			return nil, &typederr.AuthError{
+				Err:  fmt.Errorf("the approle auth method requires a roleId and a secretId"),
+				Hint: "set the roleId and secretId of the approle auth method",
+			}
+		}
+		sid, err := secretId.Plaintext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret id: %w", err)
+		}
+		body = map[string]string{"role_id": roleId, "secret_id": sid}
+	case "kubernetes", "jwt":
+		if role == "" || jwt == nil {
+			return nil, &typederr.AuthError{
+				Err:  fmt.Errorf("the %s auth method requires a role and a jwt", authMethod),
+				Hint: "set the role and the jwt of the auth method",
+			}
+		}
+		t, err := jwt.Plaintext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get jwt: %w", err)
+		}
+		body = map[string]string{"role": role, "jwt": t}
+	default:
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported auth method %q, expected approle, kubernetes, jwt or token", authMethod),
+			Hint: "use the approle, kubernetes, jwt or token auth method",
+		}
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err = m.request(ctx, "POST", "auth/"+authMount+"/login", body, "", &resp); err != nil {
+		return nil, fmt.Errorf("failed to login with %s: %w", authMethod, err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("failed to login with %s: no client token returned", authMethod)
+	}
+
+	m.Token = dag.SetSecret(fmt.Sprintf("vault-token-%x", sha256.Sum256([]byte(resp.Auth.ClientToken))), resp.Auth.ClientToken)
+
+	return m, nil
+}
+
+// GetSecret returns a key of a KV secret as a Dagger secret.
+//
+// Example usage: dagger call --address=https://vault.example.com:8200 --role-id=$ROLE_ID --secret-id=env:SECRET_ID get-secret --path=shop/api --key=password plaintext
+func (m *Vault) GetSecret(
+	ctx context.Context,
+	// Path of the secret, relative to the KV mount (ex: shop/api)
+	// +required
+	path string,
+	// Key of the value in the secret
+	// +required
+	key string,
+) (result *Secret, err error) {
+	s := m.startSpan(ctx, "GetSecret")
+	defer s.End(&err)
+
+	value, err := m.read(ctx, path, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.SetSecret(fmt.Sprintf("vault-%s/%s#%s", m.KvMount, path, key), value), nil
+}
+
+// RenderTemplate renders a Go template with the secret function, ex: {{ secret "shop/api" "password" }}.
+// The rendered file holds the secret values in plain text, mount it as a secret rather than exporting it.
+//
+// Example usage: dagger call --address=https://vault.example.com:8200 --auth-method=jwt --role=ci --jwt=env:CI_JOB_JWT render-template --tmpl=./deploy/values.tmpl.yaml
+func (m *Vault) RenderTemplate(
+	ctx context.Context,
+	// The template
+	// +required
+	tmpl *File,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "RenderTemplate")
+	defer s.End(&err)
+
+	name, err := tmpl.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get template name: %w", err)
+	}
+	content, err := tmpl.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+
+	t, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"secret": func(path, key string) (string, error) {
+			return m.read(ctx, path, key)
+		},
+	}).Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, nil); err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+
+	return dag.Directory().WithNewFile(name, buf.String()).File(name), nil
+}
+
+// read returns a key of a KV secret
+func (m *Vault) read(ctx context.Context, path, key string) (string, error) {
+	token, err := m.Token.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get vault token: %w", err)
+	}
+
+	var (
+		data map[string]any
+		v1   struct {
+			Data map[string]any `json:"data"`
+		}
+		v2 struct {
+			Data struct {
+				Data map[string]any `json:"data"`
+			} `json:"data"`
+		}
+	)
+	switch m.KvVersion {
+	case 1:
+		err = m.request(ctx, "GET", m.KvMount+"/"+path, nil, token, &v1)
+		data = v1.Data
+	case 2:
+		err = m.request(ctx, "GET", m.KvMount+"/data/"+path, nil, token, &v2)
+		data = v2.Data.Data
+	default:
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("unsupported KV version %d, expected 1 or 2", m.KvVersion),
+			Hint: "set kvVersion to 1 or 2",
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", &typederr.ValidationError{Err: fmt.Errorf("key %q not found in %s", key, path), Hint: "check the key of the secret"}
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+)
+
+// github Return the client of the GitHub API and raw contents through the configured proxy
+func (m *Velero) github(ctx context.Context) (*ghrelease.Client, error) {
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	return &ghrelease.Client{HTTP: client}, nil
+}
@@ -0,0 +1,351 @@
+// This module handles the version management of Velero and its AWS provider plugin.
+//
+// It relies on the version-bumper module to track the Velero releases, and only emits an update when
+// a release of velero-plugin-for-aws is compatible with the proposed Velero version, bumping both together.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"regexp"
+	"strings"
+)
+
+// compatibilityRow matches the rows of the compatibility table of the velero-plugin-for-aws README:
+// | Plugin Version | Velero Version |
+var compatibilityRow = regexp.MustCompile(`^\|\s*v?(\d+\.\d+)\.x\s*\|\s*v?(\d+\.\d+)\.x\s*\|`)
+
+type Velero struct {
+	LatestVersion string
+	LocalVersion  string
+	// Latest AWS plugin version compatible with the latest Velero version
+	LatestPluginVersion string
+	// AWS plugin version pinned in the manifest
+	LocalPluginVersion string
+	// +private
+	Manifest *File
+	// +private
+	Key string
+	// +private
+	PluginKey string
+	// +private
+	Constraint string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new Velero module comparing the latest Velero release, and its compatible AWS plugin, with the versions pinned in the HelmRelease
+//
+// Example usage: dagger call --manifest=clusters/dev/velero/helmrelease.yaml report export --path=report.json
+func New(
+	ctx context.Context,
+	// HelmRelease storing the current Velero and AWS plugin versions
+	// +required
+	manifest *File,
+	// Dot separated path of the Velero image tag in the manifest
+	// +optional
+	// +default="spec.values.image.tag"
+	key string,
+	// Dot separated path of the AWS plugin image in the manifest (ex: velero/velero-plugin-for-aws:v1.9.0)
+	// +optional
+	// +default="spec.values.initContainers.0.image"
+	pluginKey string,
+	// Semver constraint the latest Velero version must satisfy (ex: "~1.13")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*Velero, error) {
+	m := &Velero{
+		Manifest:     manifest,
+		Key:          key,
+		PluginKey:    pluginKey,
+		Constraint:   constraint,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		CacheTTL:     cacheTtl,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+
+	var err error
+	if m.LocalVersion, err = m.bumper().LocalVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get local version: %w", err)
+	}
+	if m.LatestVersion, err = m.bumper().LatestVersion(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+	if err := m.setPluginVersions(ctx); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type UpdateReport struct {
+	CurrentVersion       string `json:"currentVersion"`
+	LatestVersion        string `json:"latestVersion"`
+	UpdateNeeded         bool   `json:"updateNeeded"`
+	Constraint           string `json:"constraint"`
+	CurrentPluginVersion string `json:"currentPluginVersion"`
+	LatestPluginVersion  string `json:"latestPluginVersion"`
+	// Whether the currently pinned plugin is compatible with the latest Velero version
+	CurrentPluginCompatible bool `json:"currentPluginCompatible"`
+}
+
+type compatibility struct {
+	plugin string
+	velero string
+}
+
+// bumper returns the version-bumper tracking the Velero releases
+func (m *Velero) bumper() *VersionBumper {
+	return dag.VersionBumper("vmware-tanzu", "velero", m.Manifest, VersionBumperOpts{
+		Key:        m.Key,
+		Constraint: m.Constraint,
+		ProxyURL:   m.ProxyURL,
+		NoProxy:    m.NoProxy,
+		CaBundle:   m.CABundle,
+		CacheTTL:   m.CacheTTL,
+	})
+}
+
+// setPluginVersions Get the pinned AWS plugin version and the latest one compatible with the latest Velero version
+func (m *Velero) setPluginVersions(ctx context.Context) error {
+	content, err := m.Manifest.Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	image, err := yamlpath.Get(content, m.PluginKey)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", m.PluginKey, err)
+	}
+	if m.LocalPluginVersion = imageTag(image); m.LocalPluginVersion == "" {
+		return fmt.Errorf("failed to extract version from plugin image %q", image)
+	}
+
+	table, err := m.compatibilityTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	minor, err := minorVersion(m.LatestVersion)
+	if err != nil {
+		return fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	var constraints []string
+	for _, row := range table {
+		if row.velero == minor {
+			constraints = append(constraints, "~"+row.plugin)
+		}
+	}
+	if len(constraints) == 0 {
+		return &typederr.ValidationError{
+			Err:  fmt.Errorf("no velero-plugin-for-aws release is compatible with Velero %s", m.LatestVersion),
+			Hint: "check the Velero version against the compatibility table of velero-plugin-for-aws",
+		}
+	}
+
+	client, err := m.github(ctx)
+	if err != nil {
+		return err
+	}
+	releases, err := client.List(ctx, "vmware-tanzu", "velero-plugin-for-aws")
+	if err != nil {
+		return fmt.Errorf("failed to get plugin releases: %w", err)
+	}
+
+	if _, m.LatestPluginVersion, err = (ghrelease.Selection{Constraint: strings.Join(constraints, " || ")}).Latest(releases); err != nil {
+		return fmt.Errorf("failed to select the velero-plugin-for-aws release required by Velero %s: %w", m.LatestVersion, err)
+	}
+
+	return nil
+}
+
+// compatibilityTable Parse the compatibility table of the velero-plugin-for-aws README
+func (m *Velero) compatibilityTable(ctx context.Context) ([]compatibility, error) {
+	client, err := m.github(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readme, err := client.Fetch(ctx, "https://raw.githubusercontent.com/vmware-tanzu/velero-plugin-for-aws/main/README.md")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the compatibility table: %w", err)
+	}
+
+	var table []compatibility
+	for _, line := range strings.Split(string(readme), "\n") {
+		if match := compatibilityRow.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			table = append(table, compatibility{plugin: match[1], velero: match[2]})
+		}
+	}
+	if len(table) == 0 {
+		return nil, fmt.Errorf("failed to find the compatibility table in the velero-plugin-for-aws README")
+	}
+
+	return table, nil
+}
+
+// IsNewerVersion Check if the latest Velero version or its compatible AWS plugin version is newer than the local ones
+//
+// Example usage: dagger call --manifest=clusters/dev/velero/helmrelease.yaml is-newer-version
+func (m *Velero) IsNewerVersion(ctx context.Context) (ok bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	newer, err := m.bumper().IsNewerVersion(ctx)
+	if err != nil || newer {
+		return newer, err
+	}
+
+	return m.LatestPluginVersion != m.LocalPluginVersion, nil
+}
+
+// UpdatedManifest Return the HelmRelease with the Velero version and the AWS plugin image set to the latest compatible versions
+//
+// Example usage: dagger call --manifest=clusters/dev/velero/helmrelease.yaml updated-manifest export --path=clusters/dev/velero/helmrelease.yaml
+func (m *Velero) UpdatedManifest(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "UpdatedManifest")
+	defer s.End(&err)
+
+	manifest := m.bumper().UpdatedManifest()
+	if m.LatestPluginVersion == m.LocalPluginVersion {
+		return manifest, nil
+	}
+
+	content, err := manifest.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	image, err := yamlpath.Get(content, m.PluginKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", m.PluginKey, err)
+	}
+
+	// The digest of the pinned tag is dropped, it does not match the new tag
+	ref, _, _ := strings.Cut(image, "@")
+	newContent, err := yamlpath.Set(content, m.PluginKey, ref[:strings.LastIndex(ref, ":")]+":"+m.LatestPluginVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set %s: %w", m.PluginKey, err)
+	}
+
+	name, err := m.Manifest.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file name: %w", err)
+	}
+
+	return dag.Directory().WithNewFile(name, newContent).File(name), nil
+}
+
+// Report Generate a JSON report describing the pending Velero update and the AWS plugin version it requires
+//
+// Example usage: dagger call --manifest=clusters/dev/velero/helmrelease.yaml report export --path=report.json
+func (m *Velero) Report(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "Report")
+	defer s.End(&err)
+
+	updateNeeded, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+
+	table, err := m.compatibilityTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	veleroMinor, err := minorVersion(m.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	pluginMinor, err := minorVersion(m.LocalPluginVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse local plugin version: %w", err)
+	}
+
+	compatible := false
+	for _, row := range table {
+		if row.velero == veleroMinor && row.plugin == pluginMinor {
+			compatible = true
+		}
+	}
+
+	content, err := json.MarshalIndent(&UpdateReport{
+		CurrentVersion:          m.LocalVersion,
+		LatestVersion:           m.LatestVersion,
+		UpdateNeeded:            updateNeeded,
+		Constraint:              m.Constraint,
+		CurrentPluginVersion:    m.LocalPluginVersion,
+		LatestPluginVersion:     m.LatestPluginVersion,
+		CurrentPluginCompatible: compatible,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	return dag.Directory().WithNewFile("report.json", string(content)).File("report.json"), nil
+}
+
+// minorVersion Return the major.minor part of a version (ex: v1.13.1 -> 1.13)
+func minorVersion(version string) (string, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d.%d", v.Major(), v.Minor()), nil
+}
+
+// imageTag Extract the tag of an image reference (ex: velero/velero-plugin-for-aws:v1.9.0@sha256:... -> v1.9.0)
+func imageTag(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+
+	return image[i+1:]
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"time"
+)
+
+// releases Return the published releases of the repository, kept in the cache of the engine for the cache TTL so the
+// calls and runs in between reuse them
+func (m *VersionBumper) releases(ctx context.Context) ([]ghrelease.Release, error) {
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+	backoff := time.Duration(0)
+	if m.Backoff != "" {
+		if backoff, err = time.ParseDuration(m.Backoff); err != nil {
+			return nil, &typederr.ValidationError{Err: fmt.Errorf("failed to parse backoff: %w", err), Hint: "use a duration, ex: 2s"}
+		}
+	}
+	cache := dag.Common().Cache(fmt.Sprintf("github-releases/%s/%s", m.Owner, m.Repo), CommonCacheOpts{TTL: m.CacheTTL})
+
+	return (&ghrelease.Client{HTTP: client, Retries: m.Retries, Backoff: backoff}).Cached(ctx, cache, m.Owner, m.Repo)
+}
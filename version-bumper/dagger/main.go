@@ -0,0 +1,306 @@
+// This module handles the version management of components released on GitHub.
+//
+// It fetches the latest release of a GitHub repository, compares it against the
+// version pinned in a YAML manifest and rewrites that manifest when needed.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterminds/semver"
+	"github.com/adore-me/daggerverse/common/pkg/ghrelease"
+	"github.com/adore-me/daggerverse/common/pkg/yamlpath"
+	"sort"
+	"strings"
+)
+
+type VersionBumper struct {
+	LatestVersion string
+	LocalVersion  string
+	// +private
+	Owner string
+	// +private
+	Repo string
+	// +private
+	Manifest *File
+	// +private
+	Key string
+	// +private
+	TagPrefix string
+	// +private
+	Constraint string
+	// +private
+	ProxyURL string
+	// +private
+	NoProxy string
+	// +private
+	CABundle *File
+	// +private
+	CacheTTL string
+	// +private
+	Retries int
+	// +private
+	Backoff string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+// New creates a new VersionBumper module tracking the releases of owner/repo against the version stored at key in the manifest
+//
+// Example usage: dagger call --owner=cert-manager --repo=cert-manager --manifest=clusters/dev/cert-manager.yaml --key=spec.chart.spec.version is-newer-version
+func New(
+	ctx context.Context,
+	// Owner of the GitHub repository publishing the releases (ex: cert-manager)
+	// +required
+	owner string,
+	// Name of the GitHub repository publishing the releases (ex: cert-manager)
+	// +required
+	repo string,
+	// YAML manifest storing the current version
+	// +required
+	manifest *File,
+	// Dot separated path of the version field in the manifest (ex: data.version, spec.chart.spec.version)
+	// +optional
+	// +default="data.version"
+	key string,
+	// Only consider release tags with this prefix, stripped before parsing the version (ex: controller-)
+	// +optional
+	tagPrefix string,
+	// Semver constraint the latest version must satisfy (ex: "~1.14", ">=1.14, <1.16")
+	// +optional
+	constraint string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// How long the fetched releases are reused before querying GitHub again (ex: 10m, 1h)
+	// +optional
+	// +default="10m"
+	cacheTtl string,
+	// Number of retries of a failed GitHub API call
+	// +optional
+	// +default=3
+	retries int,
+	// Initial delay between retries, doubled after each attempt (ex: 2s)
+	// +optional
+	// +default="2s"
+	backoff string,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*VersionBumper, error) {
+	b := &VersionBumper{
+		Owner:        owner,
+		Repo:         repo,
+		Manifest:     manifest,
+		Key:          key,
+		TagPrefix:    tagPrefix,
+		Constraint:   constraint,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		CacheTTL:     cacheTtl,
+		Retries:      retries,
+		Backoff:      backoff,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+	if err := b.setLocalVersion(ctx); err != nil {
+		return nil, err
+	}
+	if err := b.setLatestVersion(ctx); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// setLocalVersion Get the local version from the provided manifest
+func (m *VersionBumper) setLocalVersion(ctx context.Context) error {
+	content, err := m.Manifest.Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	version, err := yamlpath.Get(content, m.Key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", m.Key, err)
+	}
+
+	m.LocalVersion = version
+
+	return nil
+}
+
+// setLatestVersion Get the latest version, matching the constraint if any, from GitHub
+func (m *VersionBumper) setLatestVersion(ctx context.Context) error {
+	releases, err := m.releases(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, latest, err := ghrelease.Selection{TagPrefix: m.TagPrefix, Constraint: m.Constraint}.Latest(releases)
+	if err != nil {
+		return fmt.Errorf("failed to select the latest release of %s/%s: %w", m.Owner, m.Repo, err)
+	}
+	m.LatestVersion = latest
+
+	return nil
+}
+
+// parseTag Parse a release tag as a semantic version, excluding tags without the configured prefix
+func (m *VersionBumper) parseTag(tag string) (*semver.Version, error) {
+	if !strings.HasPrefix(tag, m.TagPrefix) {
+		return nil, fmt.Errorf("tag %q does not have prefix %q", tag, m.TagPrefix)
+	}
+
+	return semver.NewVersion(strings.TrimPrefix(tag, m.TagPrefix))
+}
+
+// IsNewerVersion Check if the latest version is newer than the local version
+//
+// Example usage: dagger call --owner=cert-manager --repo=cert-manager --manifest=clusters/dev/cert-manager.yaml is-newer-version
+func (m *VersionBumper) IsNewerVersion(ctx context.Context) (newer bool, err error) {
+	s := m.startSpan(ctx, "IsNewerVersion")
+	defer s.End(&err)
+
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	return latestVersion.GreaterThan(localVersion), nil
+}
+
+// UpdatedManifest Return the manifest with the version field set to the latest version
+//
+// Example usage: dagger call --owner=cert-manager --repo=cert-manager --manifest=clusters/dev/cert-manager.yaml updated-manifest export --path=clusters/dev/cert-manager.yaml
+func (m *VersionBumper) UpdatedManifest(ctx context.Context) (file *File, err error) {
+	s := m.startSpan(ctx, "UpdatedManifest")
+	defer s.End(&err)
+
+	isNewerVersion, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if newer version: %w", err)
+	}
+	if !isNewerVersion {
+		return m.Manifest, nil
+	}
+
+	content, err := m.Manifest.Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	newContent, err := yamlpath.Set(content, m.Key, m.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set %s: %w", m.Key, err)
+	}
+
+	name, err := m.Manifest.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file name: %w", err)
+	}
+
+	return dag.Directory().WithNewFile(name, newContent).File(name), nil
+}
+
+// ReturnUpdatedManifest Return the content of the manifest with the version field set to the latest version
+//
+// Example usage: dagger call --owner=cert-manager --repo=cert-manager --manifest=clusters/dev/cert-manager.yaml return-updated-manifest
+func (m *VersionBumper) ReturnUpdatedManifest(ctx context.Context) (out string, err error) {
+	s := m.startSpan(ctx, "ReturnUpdatedManifest")
+	defer s.End(&err)
+
+	isNewerVersion, err := m.IsNewerVersion(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if newer version: %w", err)
+	}
+	if !isNewerVersion {
+		return fmt.Sprintf("No update needed. Latest version is %s", m.LatestVersion), nil
+	}
+
+	f, err := m.UpdatedManifest(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return f.Contents(ctx)
+}
+
+// PendingReleaseNotes Return the notes of the releases newer than the local version, up to the latest version, newest first
+//
+// Example usage: dagger call --owner=cert-manager --repo=cert-manager --manifest=clusters/dev/cert-manager.yaml pending-release-notes
+func (m *VersionBumper) PendingReleaseNotes(ctx context.Context) (out string, err error) {
+	s := m.startSpan(ctx, "PendingReleaseNotes")
+	defer s.End(&err)
+
+	releases, err := m.pendingReleases(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, r := range releases {
+		fmt.Fprintf(&b, "## %s\n\n%s\n\n", r.TagName, strings.TrimSpace(r.Body))
+	}
+
+	return b.String(), nil
+}
+
+// pendingReleases Return the releases newer than the local version, up to the latest version, newest first
+func (m *VersionBumper) pendingReleases(ctx context.Context) ([]ghrelease.Release, error) {
+	releases, err := m.releases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	localVersion, err := semver.NewVersion(m.LocalVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse local version: %w", err)
+	}
+
+	latestVersion, err := semver.NewVersion(m.LatestVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse latest version: %w", err)
+	}
+
+	var pending []ghrelease.Release
+	for _, r := range releases {
+		v, err := m.parseTag(r.TagName)
+		if err != nil || v.Prerelease() != "" {
+			continue
+		}
+		if v.GreaterThan(localVersion) && !v.GreaterThan(latestVersion) {
+			pending = append(pending, r)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		vi, _ := m.parseTag(pending[i].TagName)
+		vj, _ := m.parseTag(pending[j].TagName)
+		return vi.GreaterThan(vj)
+	})
+
+	return pending, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+)
+
+// commandFailures types the failures of the grype or osv-scanner commands from their output
+var commandFailures = typederr.Command{
+	ValidationHint: "check the lockfiles and the SBOM passed to the scanners",
+}
+
+// commandError types the error of a grype or osv-scanner command from its output, with the typed errors of common/pkg,
+// and returns it unchanged otherwise
+func commandError(err error) error {
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		return err
+	}
+
+	return commandFailures.Type(err, execErr.Stderr+execErr.Stdout)
+}
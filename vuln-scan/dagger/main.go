@@ -0,0 +1,408 @@
+// This module scans lockfiles and SBOMs for vulnerable dependencies with grype and osv-scanner.
+//
+// Findings of both scanners are merged: a vulnerability reported under several IDs (CVE, GHSA, GO-...) for the same
+// package version is a single finding. Findings marked as not affecting the project in OpenVEX documents, or ignored
+// by the ignore file, are suppressed. The remaining ones are exported as SARIF and counted by severity to gate builds.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/severity"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"sort"
+	"strings"
+	"time"
+)
+
+// severities are finding severities, from the most to the least severe
+var severities = severity.Scale{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+type VulnScan struct {
+	// The version of grype (ex: v0.77.0)
+	// +private
+	GrypeVersion string
+	// The version of osv-scanner (ex: v1.7.2)
+	// +private
+	OsvScannerVersion string
+	// Severity at or above which a scan fails (ex: HIGH), empty to never fail
+	// +private
+	FailOn string
+	// OpenVEX documents
+	// +private
+	Vex []*File
+	// Ignore file
+	// +private
+	IgnoreFile *File
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new VulnScan module pinned to the provided grype and osv-scanner versions
+func New(
+	// The version of grype
+	// +optional
+	// +default="v0.77.0"
+	grypeVersion string,
+	// The version of osv-scanner
+	// +optional
+	// +default="v1.7.2"
+	osvScannerVersion string,
+	// Severity at or above which a scan fails: CRITICAL, HIGH, MEDIUM, LOW or UNKNOWN. Empty to never fail.
+	// +optional
+	// +default="CRITICAL"
+	failOn string,
+	// OpenVEX documents, suppressing the vulnerabilities stated not_affected or fixed
+	// +optional
+	vex []*File,
+	// YAML ignore file, listing the vulnerabilities to suppress under ignore: with their id, and optionally the package,
+	// the reason and the expiration date (YYYY-MM-DD) after which they are reported again
+	// +optional
+	ignoreFile *File,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) (*VulnScan, error) {
+	failOn = strings.ToUpper(failOn)
+	if failOn != "" && severities.Rank(failOn) < 0 {
+		return nil, &typederr.ValidationError{
+			Err:  fmt.Errorf("invalid severity %q, expected one of %s", failOn, strings.Join(severities, ", ")),
+			Hint: "use one of the expected severities",
+		}
+	}
+
+	return &VulnScan{
+		GrypeVersion:      grypeVersion,
+		OsvScannerVersion: osvScannerVersion,
+		FailOn:            failOn,
+		Vex:               vex,
+		IgnoreFile:        ignoreFile,
+		ProxyURL:          proxyUrl,
+		NoProxy:           noProxy,
+		CABundle:          caBundle,
+		OtlpEndpoint:      otlpEndpoint,
+		OtlpHeaders:       otlpHeaders,
+		Traceparent:       traceparent,
+	}, nil
+}
+
+type ScanResult struct {
+	// Findings not suppressed, from the most to the least severe
+	Findings []*Finding
+	// Findings suppressed by VEX statements or the ignore file
+	Suppressed []*Finding
+	// SARIF report of the findings, suitable for GitHub code scanning
+	Sarif *File
+	// JSON report of the findings and the suppressed ones
+	Report   *File
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	Unknown  int
+	// Whether no finding reaches the fail threshold
+	Passed bool
+	// +private
+	FailOn string
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Finding struct {
+	// Preferred ID of the vulnerability: its CVE when it has one
+	ID string
+	// Every ID of the vulnerability, including ID
+	Aliases   []string
+	Package   string
+	Version   string
+	Ecosystem string
+	// CRITICAL, HIGH, MEDIUM, LOW or UNKNOWN
+	Severity string
+	// Version fixing the vulnerability, empty when not fixed
+	FixedVersion string
+	Summary      string
+	// Lockfiles or SBOMs the package was found in
+	Locations []string
+	// Scanners reporting the vulnerability: grype, osv-scanner
+	Scanners []string
+	// Why the finding was suppressed, empty when reported
+	Suppression string
+}
+
+// ScanDir scans the lockfiles of a source directory (go.sum, package-lock.json, composer.lock...).
+//
+// Example usage: dagger call --fail-on=HIGH --ignore-file=.vuln-ignore.yaml scan-dir --dir=. check
+func (m *VulnScan) ScanDir(
+	ctx context.Context,
+	// Directory to scan
+	// +required
+	dir *Directory,
+) (scanResult *ScanResult, err error) {
+	s := m.startSpan(ctx, "ScanDir")
+	defer s.End(&err)
+
+	grype, err := m.grype(ctx, func(c *Container) (*Container, string) {
+		return c.WithDirectory("/src", dir), "dir:/src"
+	})
+	if err != nil {
+		return nil, err
+	}
+	osv, err := m.osvScanner(ctx, func(c *Container) (*Container, []string) {
+		return c.WithDirectory("/src", dir), []string{"--recursive", "/src"}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.result(ctx, append(grype, osv...))
+}
+
+// ScanSbom scans an SPDX or CycloneDX SBOM, such as the ones generated by the sbom module. osv-scanner requires the
+// file to be named after its format (ex: sbom.spdx.json, bom.cdx.json).
+//
+// Example usage: dagger call scan-sbom --sbom=app.spdx.json sarif export --path=vulns.sarif
+func (m *VulnScan) ScanSbom(
+	ctx context.Context,
+	// SBOM to scan
+	// +required
+	sbom *File,
+) (scanResult *ScanResult, err error) {
+	s := m.startSpan(ctx, "ScanSbom")
+	defer s.End(&err)
+
+	name, err := sbom.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sbom name: %w", err)
+	}
+	path := "/sbom/" + name
+
+	grype, err := m.grype(ctx, func(c *Container) (*Container, string) {
+		return c.WithFile(path, sbom), "sbom:" + path
+	})
+	if err != nil {
+		return nil, err
+	}
+	osv, err := m.osvScanner(ctx, func(c *Container) (*Container, []string) {
+		return c.WithFile(path, sbom), []string{"--sbom", path}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.result(ctx, append(grype, osv...))
+}
+
+// result merges and suppresses the findings of the scanners, then counts them by severity
+func (m *VulnScan) result(ctx context.Context, findings []*Finding) (*ScanResult, error) {
+	suppressions, err := m.suppressions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ScanResult{
+		Findings:     []*Finding{},
+		Suppressed:   []*Finding{},
+		Passed:       true,
+		FailOn:       m.FailOn,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	counts := map[string]int{}
+	for _, f := range merge(findings) {
+		if f.Suppression = suppressions.match(f); f.Suppression != "" {
+			result.Suppressed = append(result.Suppressed, f)
+			continue
+		}
+		result.Findings = append(result.Findings, f)
+		counts[f.Severity]++
+		if m.FailOn != "" && severities.Rank(f.Severity) <= severities.Rank(m.FailOn) {
+			result.Passed = false
+		}
+	}
+	result.Critical = counts["CRITICAL"]
+	result.High = counts["HIGH"]
+	result.Medium = counts["MEDIUM"]
+	result.Low = counts["LOW"]
+	result.Unknown = counts["UNKNOWN"]
+
+	sarif, err := result.sarif()
+	if err != nil {
+		return nil, err
+	}
+	report, err := json.MarshalIndent(map[string]any{"findings": result.Findings, "suppressed": result.Suppressed}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal report: %w", err)
+	}
+	dir := dag.Directory().
+		WithNewFile("vulns.sarif", sarif).
+		WithNewFile("vulns.json", string(report))
+	result.Sarif = dir.File("vulns.sarif")
+	result.Report = dir.File("vulns.json")
+
+	return result, nil
+}
+
+// merge merges the findings of the same package version sharing a vulnerability ID, and sorts them by severity
+func merge(findings []*Finding) []*Finding {
+	merged := []*Finding{}
+	for _, f := range findings {
+		var into *Finding
+		for _, m := range merged {
+			if m.Ecosystem == f.Ecosystem && strings.EqualFold(m.Package, f.Package) && m.Version == f.Version && overlaps(m.Aliases, f.Aliases) {
+				into = m
+				break
+			}
+		}
+		if into == nil {
+			merged = append(merged, f)
+			continue
+		}
+
+		into.Aliases = union(into.Aliases, f.Aliases)
+		into.Locations = union(into.Locations, f.Locations)
+		into.Scanners = union(into.Scanners, f.Scanners)
+		// UNKNOWN ranks last, a known severity always wins
+		if severities.Rank(f.Severity) < severities.Rank(into.Severity) {
+			into.Severity = f.Severity
+		}
+		if into.FixedVersion == "" {
+			into.FixedVersion = f.FixedVersion
+		}
+		if into.Summary == "" {
+			into.Summary = f.Summary
+		}
+	}
+
+	for _, f := range merged {
+		f.ID = preferredID(f.Aliases)
+	}
+	sort.SliceStable(merged, func(a, b int) bool {
+		if ra, rb := severities.Rank(merged[a].Severity), severities.Rank(merged[b].Severity); ra != rb {
+			return ra < rb
+		}
+		return merged[a].Package+merged[a].ID < merged[b].Package+merged[b].ID
+	})
+
+	return merged
+}
+
+// preferredID returns the CVE of the aliases, then their GHSA, then the first one
+func preferredID(aliases []string) string {
+	for _, prefix := range []string{"CVE-", "GHSA-"} {
+		for _, a := range aliases {
+			if strings.HasPrefix(a, prefix) {
+				return a
+			}
+		}
+	}
+	if len(aliases) == 0 {
+		return ""
+	}
+
+	return aliases[0]
+}
+
+// overlaps checks if both lists share a value
+func overlaps(a, b []string) bool {
+	for _, v := range a {
+		for _, w := range b {
+			if v == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// union appends the values of b missing from a
+func union(a, b []string) []string {
+	for _, v := range b {
+		if !overlaps(a, []string{v}) {
+			a = append(a, v)
+		}
+	}
+
+	return a
+}
+
+// Check fails when a finding reaches the fail threshold, and returns the severity counts otherwise
+func (r *ScanResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	summary := fmt.Sprintf("critical=%d high=%d medium=%d low=%d unknown=%d suppressed=%d", r.Critical, r.High, r.Medium, r.Low, r.Unknown, len(r.Suppressed))
+	if !r.Passed {
+		lines := []string{}
+		for _, f := range r.Findings {
+			if severities.Rank(f.Severity) <= severities.Rank(r.FailOn) {
+				lines = append(lines, describe(f))
+			}
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("findings at or above %s: %s\n%s", r.FailOn, summary, strings.Join(lines, "\n")),
+			Hint: "upgrade the vulnerable dependencies or suppress the findings",
+		}
+	}
+
+	return summary, nil
+}
+
+// describe returns the finding as severity id package@version (fixed in version)
+func describe(f *Finding) string {
+	s := fmt.Sprintf("%s %s %s@%s", f.Severity, f.ID, f.Package, f.Version)
+	if f.FixedVersion != "" {
+		s += " (fixed in " + f.FixedVersion + ")"
+	}
+
+	return s
+}
+
+// cacheBuster changes daily, new vulnerabilities are published daily
+func cacheBuster() string {
+	return time.Now().Truncate(24 * time.Hour).String()
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *VulnScan) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// securitySeverities are the GitHub code scanning security-severity scores of the severities
+var securitySeverities = map[string]string{
+	"CRITICAL": "9.5",
+	"HIGH":     "8.0",
+	"MEDIUM":   "5.5",
+	"LOW":      "2.0",
+	"UNKNOWN":  "0.0",
+}
+
+// sarif returns the findings as a SARIF report, a rule per vulnerability and a result per finding and location
+func (r *ScanResult) sarif() (string, error) {
+	rules := []map[string]any{}
+	results := []map[string]any{}
+	seen := map[string]bool{}
+	for _, f := range r.Findings {
+		if !seen[f.ID] {
+			seen[f.ID] = true
+			rules = append(rules, map[string]any{
+				"id":               f.ID,
+				"shortDescription": map[string]string{"text": f.ID + " in " + f.Package},
+				"fullDescription":  map[string]string{"text": f.Summary},
+				"helpUri":          "https://osv.dev/vulnerability/" + f.ID,
+				"properties": map[string]any{
+					"security-severity": securitySeverities[f.Severity],
+					"tags":              append([]string{"security", "vulnerability"}, f.Aliases...),
+				},
+			})
+		}
+
+		level := "note"
+		switch f.Severity {
+		case "CRITICAL", "HIGH":
+			level = "error"
+		case "MEDIUM":
+			level = "warning"
+		}
+		message := fmt.Sprintf("%s %s is affected by %s (%s)", f.Package, f.Version, f.ID, f.Severity)
+		if f.FixedVersion != "" {
+			message += ", fixed in " + f.FixedVersion
+		}
+		for _, l := range f.Locations {
+			results = append(results, map[string]any{
+				"ruleId":  f.ID,
+				"level":   level,
+				"message": map[string]string{"text": message},
+				"locations": []map[string]any{{
+					"physicalLocation": map[string]any{
+						"artifactLocation": map[string]string{"uri": l},
+						"region":           map[string]int{"startLine": 1},
+					},
+				}},
+			})
+		}
+	}
+
+	report, err := json.MarshalIndent(map[string]any{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []map[string]any{{
+			"tool": map[string]any{
+				"driver": map[string]any{
+					"name":           "vuln-scan",
+					"informationUri": "https://osv.dev",
+					"rules":          rules,
+				},
+			},
+			"results": results,
+		}},
+	}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal sarif report: %w", err)
+	}
+
+	return string(report), nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ecosystems maps grype package types to OSV ecosystems, so findings of both scanners share their ecosystem
+var ecosystems = map[string]string{
+	"go-module":    "Go",
+	"npm":          "npm",
+	"php-composer": "Packagist",
+	"python":       "PyPI",
+	"java-archive": "Maven",
+	"gem":          "RubyGems",
+	"rust-crate":   "crates.io",
+}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID          string `json:"id"`
+			Severity    string `json:"severity"`
+			Description string `json:"description"`
+			Fix         struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		RelatedVulnerabilities []struct {
+			ID string `json:"id"`
+		} `json:"relatedVulnerabilities"`
+		Artifact struct {
+			Name      string `json:"name"`
+			Version   string `json:"version"`
+			Type      string `json:"type"`
+			Locations []struct {
+				Path string `json:"path"`
+			} `json:"locations"`
+		} `json:"artifact"`
+	} `json:"matches"`
+}
+
+type osvReport struct {
+	Results []struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Packages []struct {
+			Package struct {
+				Name      string `json:"name"`
+				Version   string `json:"version"`
+				Ecosystem string `json:"ecosystem"`
+			} `json:"package"`
+			Vulnerabilities []struct {
+				ID       string `json:"id"`
+				Summary  string `json:"summary"`
+				Affected []struct {
+					Ranges []struct {
+						Events []struct {
+							Fixed string `json:"fixed"`
+						} `json:"events"`
+					} `json:"ranges"`
+				} `json:"affected"`
+			} `json:"vulnerabilities"`
+			// Groups gather the IDs of the same vulnerability
+			Groups []struct {
+				IDs         []string `json:"ids"`
+				Aliases     []string `json:"aliases"`
+				MaxSeverity string   `json:"max_severity"`
+			} `json:"groups"`
+		} `json:"packages"`
+	} `json:"results"`
+}
+
+// grype scans the target mounted by the mount function, and returns its findings
+func (m *VulnScan) grype(ctx context.Context, mount func(*Container) (*Container, string)) ([]*Finding, error) {
+	c, target := mount(m.withProxy(dag.Container().From("anchore/grype:"+m.GrypeVersion)).
+		WithMountedCache("/grype-db", dag.CacheVolume("grype-db")).
+		WithEnvVariable("GRYPE_DB_CACHE_DIR", "/grype-db").
+		WithEnvVariable("CACHE_BUSTER", cacheBuster()))
+
+	out, err := c.
+		WithExec([]string{"/grype", target, "--output", "json", "--file", "/tmp/grype.json"}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		File("/tmp/grype.json").
+		Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run grype: %w", commandError(err))
+	}
+
+	var report grypeReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal grype report: %w", err)
+	}
+
+	findings := []*Finding{}
+	for _, match := range report.Matches {
+		v, a := match.Vulnerability, match.Artifact
+		f := &Finding{
+			Aliases:   []string{v.ID},
+			Package:   a.Name,
+			Version:   a.Version,
+			Ecosystem: ecosystem(a.Type),
+			Severity:  normalizeSeverity(v.Severity),
+			Summary:   v.Description,
+			Locations: []string{},
+			Scanners:  []string{"grype"},
+		}
+		for _, r := range match.RelatedVulnerabilities {
+			f.Aliases = union(f.Aliases, []string{r.ID})
+		}
+		if len(v.Fix.Versions) > 0 {
+			f.FixedVersion = v.Fix.Versions[0]
+		}
+		for _, l := range a.Locations {
+			f.Locations = union(f.Locations, []string{relative(l.Path)})
+		}
+		findings = append(findings, f)
+	}
+
+	return findings, nil
+}
+
+// osvScanner scans the target mounted by the mount function, and returns its findings
+func (m *VulnScan) osvScanner(ctx context.Context, mount func(*Container) (*Container, []string)) ([]*Finding, error) {
+	c, args := mount(m.withProxy(dag.Container().From("ghcr.io/google/osv-scanner:"+m.OsvScannerVersion)).
+		WithEnvVariable("CACHE_BUSTER", cacheBuster()))
+
+	// osv-scanner exits with 1 when vulnerabilities are found, and 128 when no package is found
+	c = c.WithExec(append([]string{
+		"sh", "-c", "/osv-scanner --format json \"$@\" > /tmp/output 2> /tmp/stderr; echo $? > /tmp/exit-code", "sh",
+	}, args...), ContainerWithExecOpts{SkipEntrypoint: true})
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run osv-scanner: %w", commandError(err))
+	}
+	switch strings.TrimSpace(exitCode) {
+	case "0", "1":
+	case "128":
+		return []*Finding{}, nil
+	default:
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return nil, commandFailures.Type(fmt.Errorf("osv-scanner failed with exit code %s: %s", strings.TrimSpace(exitCode), stderr), stderr)
+	}
+
+	out, err := c.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read osv-scanner output: %w", commandError(err))
+	}
+	var report osvReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal osv-scanner report: %w", err)
+	}
+
+	findings := []*Finding{}
+	for _, r := range report.Results {
+		for _, p := range r.Packages {
+			for _, g := range p.Groups {
+				f := &Finding{
+					Aliases:   union(append([]string{}, g.IDs...), g.Aliases),
+					Package:   p.Package.Name,
+					Version:   p.Package.Version,
+					Ecosystem: p.Package.Ecosystem,
+					Severity:  normalizeSeverity(g.MaxSeverity),
+					Locations: []string{relative(r.Source.Path)},
+					Scanners:  []string{"osv-scanner"},
+				}
+				for _, v := range p.Vulnerabilities {
+					if !overlaps(f.Aliases, []string{v.ID}) {
+						continue
+					}
+					if f.Summary == "" {
+						f.Summary = v.Summary
+					}
+					for _, a := range v.Affected {
+						for _, r := range a.Ranges {
+							for _, e := range r.Events {
+								if f.FixedVersion == "" && e.Fixed != "" {
+									f.FixedVersion = e.Fixed
+								}
+							}
+						}
+					}
+				}
+				findings = append(findings, f)
+			}
+		}
+	}
+
+	return findings, nil
+}
+
+// ecosystem returns the OSV ecosystem of a grype package type
+func ecosystem(packageType string) string {
+	if e, ok := ecosystems[packageType]; ok {
+		return e
+	}
+
+	return packageType
+}
+
+// normalizeSeverity normalizes a grype severity or an OSV CVSS score
+func normalizeSeverity(value string) string {
+	if score, err := strconv.ParseFloat(value, 64); err == nil {
+		switch {
+		case score >= 9:
+			return "CRITICAL"
+		case score >= 7:
+			return "HIGH"
+		case score >= 4:
+			return "MEDIUM"
+		case score > 0:
+			return "LOW"
+		}
+		return "UNKNOWN"
+	}
+
+	switch s := strings.ToUpper(value); s {
+	case "CRITICAL", "HIGH", "MEDIUM", "LOW":
+		return s
+	case "MODERATE":
+		return "MEDIUM"
+	case "NEGLIGIBLE":
+		return "LOW"
+	}
+
+	return "UNKNOWN"
+}
+
+// relative returns the path relative to the scanned directory
+func relative(path string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, "/src"), "/")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// suppressions are the VEX statements and ignore rules suppressing findings
+type suppressions struct {
+	statements []vexStatement
+	ignores    []ignoreRule
+}
+
+// vexStatement is an OpenVEX statement, its vulnerability and products are strings (v0.0.x) or objects (v0.2)
+type vexStatement struct {
+	Vulnerability json.RawMessage   `json:"vulnerability"`
+	Products      []json.RawMessage `json:"products"`
+	Status        string            `json:"status"`
+	Justification string            `json:"justification"`
+}
+
+type ignoreRule struct {
+	ID      string `yaml:"id"`
+	Package string `yaml:"package"`
+	Reason  string `yaml:"reason"`
+	Expires string `yaml:"expires"`
+}
+
+// suppressions parses the VEX documents and the ignore file
+func (m *VulnScan) suppressions(ctx context.Context) (*suppressions, error) {
+	s := &suppressions{}
+	for _, f := range m.Vex {
+		content, err := f.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vex document: %w", err)
+		}
+		var doc struct {
+			Statements []vexStatement `json:"statements"`
+		}
+		if err := json.Unmarshal([]byte(content), &doc); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vex document: %w", err)
+		}
+		s.statements = append(s.statements, doc.Statements...)
+	}
+
+	if m.IgnoreFile != nil {
+		content, err := m.IgnoreFile.Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ignore file: %w", err)
+		}
+		var file struct {
+			Ignore []ignoreRule `yaml:"ignore"`
+		}
+		if err := yaml.Unmarshal([]byte(content), &file); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ignore file: %w", err)
+		}
+		for _, r := range file.Ignore {
+			if r.Expires != "" {
+				if _, err := time.Parse(time.DateOnly, r.Expires); err != nil {
+					return nil, &typederr.ValidationError{
+						Err:  fmt.Errorf("invalid expiration date of %s: %w", r.ID, err),
+						Hint: "use a YYYY-MM-DD expiration date",
+					}
+				}
+			}
+		}
+		s.ignores = file.Ignore
+	}
+
+	return s, nil
+}
+
+// match returns why the finding is suppressed, or an empty string when it is reported
+func (s *suppressions) match(f *Finding) string {
+	for _, st := range s.statements {
+		if st.Status != "not_affected" && st.Status != "fixed" {
+			continue
+		}
+		if !overlaps(f.Aliases, vexIDs(st.Vulnerability)) || !affects(st.Products, f) {
+			continue
+		}
+		reason := "vex: " + st.Status
+		if st.Justification != "" {
+			reason += " (" + st.Justification + ")"
+		}
+		return reason
+	}
+
+	today := time.Now().Format(time.DateOnly)
+	for _, r := range s.ignores {
+		if !overlaps(f.Aliases, []string{r.ID}) || (r.Package != "" && !strings.EqualFold(r.Package, f.Package)) {
+			continue
+		}
+		// Expired rules report the vulnerability again, dates compare as strings
+		if r.Expires != "" && r.Expires < today {
+			continue
+		}
+		reason := "ignored"
+		if r.Reason != "" {
+			reason += ": " + r.Reason
+		}
+		return reason
+	}
+
+	return ""
+}
+
+// vexIDs returns the name and aliases of a VEX vulnerability
+func vexIDs(raw json.RawMessage) []string {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return []string{name}
+	}
+	var v struct {
+		Name    string   `json:"name"`
+		Aliases []string `json:"aliases"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return []string{}
+	}
+
+	return append([]string{v.Name}, v.Aliases...)
+}
+
+// affects checks if the finding package is one of the subcomponents of the VEX products, given as purls. The products
+// are the scanned project, statements without subcomponents apply to every package.
+func affects(products []json.RawMessage, f *Finding) bool {
+	subcomponents := []string{}
+	for _, raw := range products {
+		var product struct {
+			Subcomponents []struct {
+				ID string `json:"@id"`
+			} `json:"subcomponents"`
+		}
+		// v0.0.x products are plain purls, without subcomponents
+		if err := json.Unmarshal(raw, &product); err != nil {
+			continue
+		}
+		for _, sc := range product.Subcomponents {
+			subcomponents = append(subcomponents, sc.ID)
+		}
+	}
+	if len(subcomponents) == 0 {
+		return true
+	}
+
+	for _, purl := range subcomponents {
+		// pkg:type/namespace/name@version?qualifiers, the version is optional
+		purl, _, _ = strings.Cut(strings.TrimPrefix(purl, "pkg:"), "?")
+		_, name, _ := strings.Cut(purl, "/")
+		name, version, _ := strings.Cut(name, "@")
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		if strings.EqualFold(name, f.Package) && (version == "" || version == f.Version) {
+			return true
+		}
+	}
+
+	return false
+}
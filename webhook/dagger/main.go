@@ -0,0 +1,290 @@
+// This module posts JSON payloads rendered from Go templates to arbitrary webhooks (MS Teams, Opsgenie, event buses).
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/egress"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type Webhook struct {
+	// Number of retries of a failed call
+	// +private
+	Retries int
+	// Initial delay between retries, doubled after each attempt
+	// +private
+	Backoff string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new Webhook module with the provided retry policy
+func New(
+	// Number of retries of a failed call (network errors, 429 and 5xx responses)
+	// +optional
+	// +default=3
+	retries int,
+	// Initial delay between retries, doubled after each attempt (ex: 2s)
+	// +optional
+	// +default="2s"
+	backoff string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *Webhook {
+	return &Webhook{
+		Retries:      retries,
+		Backoff:      backoff,
+		ProxyURL:     proxyUrl,
+		NoProxy:      noProxy,
+		CABundle:     caBundle,
+		OtlpEndpoint: otlpEndpoint,
+		OtlpHeaders:  otlpHeaders,
+		Traceparent:  traceparent,
+	}
+}
+
+// Render renders the payload template with the provided variables and checks the result is valid JSON.
+//
+// Variables are available as {{ .vars.name }}, the data file as {{ .data }}. The json function JSON encodes a value.
+//
+// Example usage: dagger call render --template=./teams.json.tmpl --vars=status=success,url=https://... export --path=payload.json
+func (m *Webhook) Render(
+	ctx context.Context,
+	// Go template of the JSON payload
+	// +required
+	template *File,
+	// Template variables (ex: status=success)
+	// +optional
+	vars []string,
+	// JSON document exposed to the template as .data (ex: a report generated by another module)
+	// +optional
+	data *File,
+) (file *File, err error) {
+	s := m.startSpan(ctx, "Render")
+	defer s.End(&err)
+
+	payload, err := render(ctx, template, vars, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Directory().WithNewFile("payload.json", payload).File("payload.json"), nil
+}
+
+// Post renders the payload template and sends it to the webhook, retrying transient failures.
+//
+// Example usage: dagger call post --url=env:TEAMS_WEBHOOK --template=./teams.json.tmpl --vars=status=success
+func (m *Webhook) Post(
+	ctx context.Context,
+	// Webhook URL, a secret as it often embeds a token
+	// +required
+	url *Secret,
+	// Go template of the JSON payload
+	// +required
+	template *File,
+	// Template variables (ex: status=success)
+	// +optional
+	vars []string,
+	// JSON document exposed to the template as .data
+	// +optional
+	data *File,
+	// Additional non secret headers (ex: X-Source=dagger)
+	// +optional
+	headers []string,
+	// Name of the authentication header (ex: Authorization)
+	// +optional
+	// +default="Authorization"
+	authHeader string,
+	// Value of the authentication header (ex: "GenieKey xxx", "Bearer xxx")
+	// +optional
+	authValue *Secret,
+	// HTTP method
+	// +optional
+	// +default="POST"
+	method string,
+) (out string, err error) {
+	s := m.startSpan(ctx, "Post")
+	defer s.End(&err)
+
+	payload, err := render(ctx, template, vars, data)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, err := url.Plaintext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get webhook url: %w", err)
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, "=")
+		if !ok {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid header %q, expected <name>=<value>", h),
+				Hint: "pass the headers as <name>=<value>",
+			}
+		}
+		header.Set(name, value)
+	}
+	if authValue != nil {
+		value, err := authValue.Plaintext(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get auth header value: %w", err)
+		}
+		header.Set(authHeader, value)
+	}
+
+	backoff := time.Duration(0)
+	if m.Backoff != "" {
+		if backoff, err = time.ParseDuration(m.Backoff); err != nil {
+			return "", fmt.Errorf("failed to parse backoff: %w", err)
+		}
+	}
+
+	client, err := egress.Client(ctx, m.ProxyURL, m.NoProxy, m.CABundle, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create http client: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		body, retryable, err := send(ctx, client, method, endpoint, header, payload)
+		if err == nil {
+			return body, nil
+		}
+		if !retryable || attempt >= m.Retries {
+			return "", fmt.Errorf("failed to post payload: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff << attempt):
+		}
+	}
+}
+
+// render executes the template against the variables and data, and validates the JSON output
+func render(ctx context.Context, tmpl *File, vars []string, data *File) (string, error) {
+	source, err := tmpl.Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read template: %w", err)
+	}
+
+	t, err := template.New("payload").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	values := map[string]string{}
+	for _, v := range vars {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return "", &typederr.ValidationError{
+				Err:  fmt.Errorf("invalid variable %q, expected <name>=<value>", v),
+				Hint: "pass the variables as <name>=<value>",
+			}
+		}
+		values[name] = value
+	}
+
+	input := map[string]any{"vars": values}
+	if data != nil {
+		content, err := data.Contents(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to read data: %w", err)
+		}
+		var parsed any
+		if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+			return "", fmt.Errorf("failed to unmarshal data: %w", err)
+		}
+		input["data"] = parsed
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, input); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("rendered payload is not valid JSON:\n%s", buf.String()),
+			Hint: "fix the payload template",
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// send performs one call, reporting whether a failure is worth retrying
+func send(ctx context.Context, client *http.Client, method, endpoint string, header http.Header, payload string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, strings.NewReader(payload))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create request: %w", egress.WithoutURL(err))
+	}
+	req.Header = header.Clone()
+
+	// The URL often embeds a token, the errors of the client quote it
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", true, egress.WithoutURL(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", true, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return "", retryable, typederr.FromResponse(resp, fmt.Errorf("unexpected status %s: %s", resp.Status, body))
+	}
+
+	return string(body), false, nil
+}
@@ -0,0 +1,325 @@
+// This module lints the YAML of GitOps repositories before Flux applies it: formatting with yamllint and the shared
+// ruleset, and Kubernetes schemas with the kubeconform module.
+//
+// Findings of both linters are returned per file, in one result.
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/adore-me/daggerverse/common/pkg/typederr"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sharedRuleset is the yamllint config shared by the GitOps repositories
+const sharedRuleset = `extends: default
+rules:
+  document-start: disable
+  comments:
+    min-spaces-from-content: 1
+  indentation:
+    spaces: 2
+    indent-sequences: consistent
+  line-length:
+    max: 200
+    level: warning
+  truthy:
+    check-keys: false
+`
+
+// parsableLine matches the parsable output of yamllint (ex: ./apps/api.yaml:3:1: [error] wrong indentation (indentation))
+var parsableLine = regexp.MustCompile(`^(?:\./)?(.+):(\d+):(\d+): \[(\w+)\] (.+?)(?: \(([\w-]+)\))?$`)
+
+type YamlLint struct {
+	// The version of yamllint (ex: 1.35.1)
+	// +private
+	Version string
+	// yamllint config replacing the shared ruleset
+	// +private
+	Config *File
+	// The version of kubeconform (ex: v0.6.4)
+	// +private
+	KubeconformVersion string
+	// HTTP(S) proxy URL of the outbound calls
+	// +private
+	ProxyURL string
+	// Hosts reached without the proxy
+	// +private
+	NoProxy string
+	// CA bundle trusted by the outbound calls
+	// +private
+	CABundle *File
+	// OTLP/HTTP endpoint receiving the traces of the functions
+	// +private
+	OtlpEndpoint string
+	// Headers sent with the traces
+	// +private
+	OtlpHeaders *Secret
+	// W3C traceparent of the pipeline run
+	// +private
+	Traceparent string
+}
+
+// New creates a new YamlLint module pinned to the provided yamllint and kubeconform versions
+func New(
+	// The version of yamllint
+	// +optional
+	// +default="1.35.1"
+	version string,
+	// yamllint config replacing the shared ruleset
+	// +optional
+	config *File,
+	// The version of kubeconform
+	// +optional
+	// +default="v0.6.4"
+	kubeconformVersion string,
+	// HTTP(S) proxy URL used for outbound calls (ex: http://proxy.internal:3128)
+	// +optional
+	proxyUrl string,
+	// Comma separated hosts, domains (ex: .internal) and CIDRs reached without the proxy
+	// +optional
+	noProxy string,
+	// PEM encoded CA bundle trusted in addition to the system roots (ex: for TLS intercepting proxies)
+	// +optional
+	caBundle *File,
+	// OTLP/HTTP endpoint receiving the traces of the functions, tracing is disabled when empty (ex: http://otel-collector:4318)
+	// +optional
+	otlpEndpoint string,
+	// Headers sent with the traces, as comma separated key=value pairs (ex: api-key=...)
+	// +optional
+	otlpHeaders *Secret,
+	// W3C traceparent of the pipeline run, parent of the functions spans
+	// +optional
+	traceparent string,
+) *YamlLint {
+	return &YamlLint{
+		Version:            version,
+		Config:             config,
+		KubeconformVersion: kubeconformVersion,
+		ProxyURL:           proxyUrl,
+		NoProxy:            noProxy,
+		CABundle:           caBundle,
+		OtlpEndpoint:       otlpEndpoint,
+		OtlpHeaders:        otlpHeaders,
+		Traceparent:        traceparent,
+	}
+}
+
+type LintResult struct {
+	// Whether no error was found, warnings do not fail the lint
+	Passed   bool
+	Findings []*Finding
+	// +private
+	OtlpEndpoint string
+	// +private
+	OtlpHeaders *Secret
+	// +private
+	Traceparent string
+}
+
+type Finding struct {
+	// File, relative to the linted directory
+	File string
+	// Line of the finding, 0 for schema findings
+	Line   int
+	Column int
+	// error or warning
+	Level string
+	// Linter reporting the finding: yamllint or kubeconform
+	Linter string
+	// yamllint rule, or kind and name of the invalid resource
+	Rule    string
+	Message string
+}
+
+// Lint runs yamllint and, unless disabled, the Kubernetes schema validation over the YAML files of the directory.
+//
+// Example usage: dagger call lint --source=. --ignore="**/templates/**,clusters/*/flux-system/**" check
+func (m *YamlLint) Lint(
+	ctx context.Context,
+	// Directory holding the YAML files
+	// +required
+	source *Directory,
+	// Glob patterns of the linted files
+	// +optional
+	// +default=["**/*.yaml", "**/*.yml"]
+	patterns []string,
+	// Glob patterns of the files skipped by both linters (ex: Helm chart templates)
+	// +optional
+	// +default=["**/templates/**"]
+	ignore []string,
+	// Validate the Kubernetes resources against their schemas, YAML files without a kind must then be ignored (ex: .sops.yaml)
+	// +optional
+	// +default=true
+	schemas bool,
+	// Kubernetes version to validate against (ex: 1.29.0)
+	// +optional
+	// +default="master"
+	kubernetesVersion string,
+	// Accept resources without a known schema instead of failing (ex: in-house custom resources)
+	// +optional
+	ignoreMissingSchemas bool,
+) (lintResult *LintResult, err error) {
+	s := m.startSpan(ctx, "Lint")
+	defer s.End(&err)
+
+	files := dag.Directory().WithDirectory(".", source, DirectoryWithDirectoryOpts{Include: patterns, Exclude: ignore})
+
+	findings, err := m.yamllint(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	if schemas {
+		violations, err := m.schemas(ctx, files, kubernetesVersion, ignoreMissingSchemas)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, violations...)
+	}
+
+	result := &LintResult{
+		Passed:       true,
+		Findings:     findings,
+		OtlpEndpoint: m.OtlpEndpoint,
+		OtlpHeaders:  m.OtlpHeaders,
+		Traceparent:  m.Traceparent,
+	}
+	for _, f := range findings {
+		if f.Level == "error" {
+			result.Passed = false
+		}
+	}
+
+	return result, nil
+}
+
+// yamllint returns the findings of yamllint
+func (m *YamlLint) yamllint(ctx context.Context, files *Directory) ([]*Finding, error) {
+	config := dag.Directory().WithNewFile("yamllint.yaml", sharedRuleset).File("yamllint.yaml")
+	if m.Config != nil {
+		config = m.Config
+	}
+
+	// yamllint exits with 1 on errors, keep its output instead of failing the exec
+	c := m.withProxy(dag.Container().From("python:3.12-alpine")).
+		WithMountedCache("/root/.cache/pip", dag.CacheVolume("pip-cache")).
+		WithExec([]string{"pip", "install", "yamllint==" + m.Version}, ContainerWithExecOpts{SkipEntrypoint: true}).
+		WithFile("/tmp/yamllint.yaml", config).
+		WithDirectory("/workspace", files).
+		WithWorkdir("/workspace").
+		WithExec([]string{
+			"sh", "-c", "yamllint --format parsable --config-file /tmp/yamllint.yaml . > /tmp/output 2> /tmp/stderr; echo $? > /tmp/exit-code",
+		}, ContainerWithExecOpts{SkipEntrypoint: true})
+
+	exitCode, err := c.File("/tmp/exit-code").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run yamllint: %w", commandError(err))
+	}
+	if code := strings.TrimSpace(exitCode); code != "0" && code != "1" {
+		stderr, _ := c.File("/tmp/stderr").Contents(ctx)
+		return nil, commandFailures.Type(fmt.Errorf("yamllint exited with %s: %s", code, stderr), stderr)
+	}
+
+	output, err := c.File("/tmp/output").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read yamllint output: %w", commandError(err))
+	}
+
+	findings := []*Finding{}
+	for _, line := range strings.Split(output, "\n") {
+		match := parsableLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		findings = append(findings, &Finding{
+			File:    match[1],
+			Line:    lineNumber,
+			Column:  column,
+			Level:   match[4],
+			Linter:  "yamllint",
+			Rule:    match[6],
+			Message: match[5],
+		})
+	}
+
+	return findings, nil
+}
+
+// schemas returns the resources failing the schema validation of the kubeconform module
+func (m *YamlLint) schemas(ctx context.Context, files *Directory, kubernetesVersion string, ignoreMissingSchemas bool) ([]*Finding, error) {
+	violations, err := dag.Kubeconform(KubeconformOpts{
+		Version:  m.KubeconformVersion,
+		ProxyURL: m.ProxyURL,
+		NoProxy:  m.NoProxy,
+		CaBundle: m.CABundle,
+	}).
+		Validate(files, KubeconformValidateOpts{
+			KubernetesVersion:    kubernetesVersion,
+			Strict:               true,
+			IgnoreMissingSchemas: ignoreMissingSchemas,
+		}).
+		Violations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate schemas: %w", err)
+	}
+
+	findings := []*Finding{}
+	for _, v := range violations {
+		file, err := v.File(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get violation file: %w", err)
+		}
+		kind, err := v.Kind(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get violation kind: %w", err)
+		}
+		name, err := v.Name(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get violation name: %w", err)
+		}
+		message, err := v.Message(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get violation message: %w", err)
+		}
+		findings = append(findings, &Finding{
+			File:    file,
+			Level:   "error",
+			Linter:  "kubeconform",
+			Rule:    strings.Trim(kind+"/"+name, "/"),
+			Message: message,
+		})
+	}
+
+	return findings, nil
+}
+
+// Check fails when an error was found, and returns the number of warnings otherwise
+func (r *LintResult) Check(ctx context.Context) (out string, err error) {
+	s := r.startSpan(ctx, "Check")
+	defer s.End(&err)
+
+	if !r.Passed {
+		lines := []string{}
+		for _, f := range r.Findings {
+			lines = append(lines, fmt.Sprintf("%s:%d:%d: [%s] %s: %s (%s)", f.File, f.Line, f.Column, f.Level, f.Linter, f.Message, f.Rule))
+		}
+		return "", &typederr.ValidationError{
+			Err:  fmt.Errorf("%d findings:\n%s", len(r.Findings), strings.Join(lines, "\n")),
+			Hint: "fix the YAML reported by yamllint or the shared config",
+		}
+	}
+
+	return fmt.Sprintf("No errors, %d warnings", len(r.Findings)), nil
+}
+
+// withProxy applies the proxy settings and CA bundle to a container making outbound calls
+func (m *YamlLint) withProxy(c *Container) *Container {
+	return dag.Common().
+		Proxy(CommonProxyOpts{URL: m.ProxyURL, NoProxy: m.NoProxy, CaBundle: m.CABundle}).
+		Apply(c)
+}